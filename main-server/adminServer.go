@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/gogames/utils/signal"
+	"github.com/gogames/watchdog/main-server/pingClientManager"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/probe"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+const _ADMIN_TOKEN_KEY = "token"
+
+type (
+	adminServerStub struct{}
+)
+
+// admin server stub
+// every request should carry the admin token, see adminAuth
+
+func (adminServerStub) AddUser(username, password string, ctx hprose.Context) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if username == "" {
+		return fmt.Errorf("Username can not be empty")
+	}
+	return storeEngine.AddUser(requestContext(ctx), username, password)
+}
+
+func (adminServerStub) ListUsers() []string {
+	usernames := storeEngine.GetUsernames()
+	sort.Strings(usernames)
+	return usernames
+}
+
+func (adminServerStub) GetUser(username string) (u store.User, err error) {
+	up := storeEngine.GetUser(username)
+	if up == nil {
+		err = fmt.Errorf("User %v does not exist", username)
+		return
+	}
+	return *up, nil
+}
+
+// link the subject of the identity provider to the user, so the user can sign in by the provider
+func (adminServerStub) LinkExternalUser(username, provider, subject string, ctx hprose.Context) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	return storeEngine.LinkExternalUser(requestContext(ctx), username, provider, subject)
+}
+
+// move the user to the organization, see -isolation
+func (adminServerStub) SetOrganization(username, organization string, ctx hprose.Context) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	return storeEngine.SetOrganization(requestContext(ctx), username, organization)
+}
+
+// add servers in bulk, returns the servers failed to add with the reason
+func (adminServerStub) AddServers(username string, servers []string, ctx hprose.Context) map[string]string {
+	failed := make(map[string]string)
+	if err := checkWritable(); err != nil {
+		for _, server := range servers {
+			failed[server] = err.Error()
+		}
+		return failed
+	}
+	for _, server := range servers {
+		if err := targetPolicy.Validate(server); err != nil {
+			failed[server] = err.Error()
+			continue
+		}
+		if err := storeEngine.AddMonitorServer(requestContext(ctx), username, server); err != nil {
+			failed[server] = err.Error()
+		}
+	}
+	return failed
+}
+
+// delete servers in bulk, returns the servers failed to delete with the reason
+func (adminServerStub) DelServers(username string, servers []string, ctx hprose.Context) map[string]string {
+	failed := make(map[string]string)
+	if err := checkWritable(); err != nil {
+		for _, server := range servers {
+			failed[server] = err.Error()
+		}
+		return failed
+	}
+	for _, server := range servers {
+		if err := storeEngine.DeleteMonitorServer(requestContext(ctx), username, server); err != nil {
+			failed[server] = err.Error()
+		} else {
+			evaluator.Forget(username, server)
+		}
+	}
+	return failed
+}
+
+// list locations of the registered ping nodes
+func (adminServerStub) ListLocations() []string {
+	locations := make([]string, 0)
+	pcm.Iterate(func(location string, _ pingClientManager.PingClient) {
+		locations = append(locations, location)
+	})
+	sort.Strings(locations)
+	return locations
+}
+
+// location -> metadata of the ping nodes and the probe agents
+func (adminServerStub) ListProbes() map[string]probe.Metadata { return getProbes() }
+
+func (adminServerStub) GetMonitorResult(username, server string) (map[string][]store.PingRet, error) {
+	return storeEngine.GetMonitorResult(username, server)
+}
+
+// insert historical ping results of the server at the location, returns the number inserted
+func (adminServerStub) Backfill(server, location string, prs []store.PingRet, ctx hprose.Context) (int, error) {
+	if err := checkWritable(); err != nil {
+		return 0, err
+	}
+	return storeEngine.BackfillPingRets(requestContext(ctx), server, location, prs)
+}
+
+// location -> target -> latest ping result of the probe matrix
+func (adminServerStub) LatencyMatrix() map[string]map[string]store.PingRet {
+	return storeEngine.GetLatencyMatrix()
+}
+
+// reconcile the store to match the spec, see store.Spec
+func (adminServerStub) Apply(spec store.Spec, dryRun bool, ctx hprose.Context) ([]store.Change, error) {
+	if err := checkWritable(); !dryRun && err != nil {
+		return nil, err
+	}
+	return storeEngine.Apply(requestContext(ctx), spec, dryRun)
+}
+
+// change the log level at runtime, levels are RFC5424 levels
+func (adminServerStub) SetLogLevel(level int) {
+	setLogLevel(level)
+	logger.With("level", level).Info("log level changed")
+}
+
+// at most n store operations slower than the slow threshold, the slowest first
+// the users of the highest api or ingestion volume of the recent days
+func (adminServerStub) TopUsage(metric string, days, n int) ([]store.UserUsage, error) {
+	return storeEngine.TopUsage(metric, days, n)
+}
+
+// the state of the breaker of the store engine and the writes buffered
+func (adminServerStub) EngineBreaker() store.BreakerStatus { return storeEngine.BreakerStatus() }
+
+func (adminServerStub) SlowOps(n int) []store.SlowOp { return storeEngine.SlowOps(n) }
+
+// turn the maintenance mode of the store on or off, the mutating operations fail and the ping results are buffered meanwhile
+// returns the buffered ping results appended once turned off
+func (adminServerStub) SetReadOnly(on bool, ctx hprose.Context) (int, error) {
+	n, err := storeEngine.SetReadOnly(requestContext(ctx), on)
+	logger.With("read_only", on, "appended", n).Info("store maintenance mode changed")
+	return n, err
+}
+
+func (adminServerStub) ReadOnly() store.ReadOnlyStatus { return storeEngine.ReadOnlyStatus() }
+
+// what the store loaded from the engine on startup or last reload, and the corrupt records it skipped
+func (adminServerStub) RecoveryReport() store.RecoveryReport { return storeEngine.RecoveryReport() }
+
+// irreversibly remove the server and its data from all the users and tiers, on a data deletion request of the actor
+func (adminServerStub) PurgeServer(server, actor string, ctx hprose.Context) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	return storeEngine.PurgeServerData(requestContext(ctx), server, actor)
+}
+
+// irreversibly remove the user and the data of the servers nobody else monitors
+func (adminServerStub) PurgeUser(username, actor string, ctx hprose.Context) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	return storeEngine.PurgeUserData(requestContext(ctx), username, actor)
+}
+
+// the latest n entries of the audit log, like the purges
+func (adminServerStub) Audit(n int) []store.AuditEntry { return storeEngine.Audit(n) }
+
+// load the encryption keys of the store engine again and encrypt all its records by the current key, returns the files rewritten
+func (adminServerStub) RotateKeys(ctx hprose.Context) (int, error) {
+	if err := checkWritable(); err != nil {
+		return 0, err
+	}
+	return storeEngine.RotateKeys(requestContext(ctx))
+}
+
+// send every server to the ping loop again, as on the first startup, returns the servers sent
+// only the servers added or removed are sent on restart otherwise, see store.AssignmentStore
+func (adminServerStub) ResyncAssignments() (int, error) { return storeEngine.ResyncAssignments() }
+
+// reload the config like SIGHUP does, returns what changed
+func (adminServerStub) Reload() ([]string, error) { return reload() }
+
+// the token of "Authorization: Bearer <token>", or of the query of the older clients
+func adminToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get(_ADMIN_TOKEN_KEY)
+}
+
+// only requests with the correct admin token can reach h
+func adminAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := adminToken(r)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*flagAdminToken)) != 1 {
+			http.Error(w, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+var (
+	adminServer = hprose.NewHttpService()
+	adminMux    = http.NewServeMux()
+)
+
+func initAdminServer() {
+	if *flagAdminToken == "" {
+		logger.Info("admin token is not set, admin server is disabled")
+		return
+	}
+	adminServer.AddMethods(new(adminServerStub))
+	adminMux.Handle("/", adminAuth(instrument("admin", adminServer)))
+	adminMux.Handle("/metrics", adminAuth(http.HandlerFunc(metricsHandler)))
+	adminMux.Handle("/backup", adminAuth(instrument("backup", http.HandlerFunc(backupHandler))))
+	initSupport()
+	initDebug()
+	initReplication()
+	initExport()
+	go func() {
+		if err := http.ListenAndServe(fmt.Sprintf(":%v", *flagAdminPort), adminMux); err != nil {
+			logger.Emergency("can not listen and serve admin server: %v", err)
+			if err = signal.Signal(syscall.SIGQUIT); err != nil {
+				panic(fmt.Errorf("can not signal the current process: %v", err))
+			}
+		}
+	}()
+}
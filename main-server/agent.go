@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/main-server/pipeline"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/probe"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+// results delivered later than the ping frequences are not alerted
+const _MAX_ALERT_DELAY = 2
+
+// probe agents pull the targets and push the results, unlike ping nodes pinged by the main server
+// they are registered by location, a ping node and an agent of the same location report the same series
+
+// register the probe agent of the location, returns the interval in seconds to check the targets
+// the network of the probe is filled by the address it registers from, see -asndb
+func (pingServerStub) RegisterAgent(location string, meta probe.Metadata, ctx hprose.Context) (int, error) {
+	if location == "" {
+		return 0, fmt.Errorf("location can not be empty")
+	}
+	if c, ok := ctx.(*hprose.HttpContext); ok && c.Request != nil {
+		meta = enrichProbe(meta, getIp(c.Request.RemoteAddr))
+	}
+	if err := setProbeMetadata(location, meta); err != nil {
+		return 0, err
+	}
+	observeProbeReport(location)
+	logger.With("location", location).Info("probe agent registered")
+	return int(getPingFrequence() / time.Second), nil
+}
+
+// the servers pinged by the main server, virtual servers are pushed rather than checked
+// the checks of longer intervals than the ping frequence are assigned once in every interval
+func (pingServerStub) GetTargets(location string) ([]probe.Target, error) {
+	if isReplica() {
+		return nil, fmt.Errorf("replica does not assign targets")
+	}
+	targets := make([]probe.Target, 0)
+	now := time.Now()
+	for _, server := range storeEngine.GetServers() {
+		if shouldPing(server) && !store.IsVirtual(server) && checkDue(server, now) {
+			t := probe.TargetOf(server)
+			if t.Kind == probe.KIND_STEPS {
+				t.Steps = storeEngine.Transaction(server)
+			}
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// results rejected as malformed, see probe.Result.Validate
+var rejectedResults int64
+
+// the results are aligned to the ping frequence by the time of the probe
+// malformed results are rejected and logged, the others of the report are stored, so that the agent does not spool it
+func (pingServerStub) Report(location string, results []probe.Result, ctx hprose.Context) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if location == "" {
+		return fmt.Errorf("location can not be empty")
+	}
+	if err := probe.CheckBatch(results); err != nil {
+		return err
+	}
+	received := time.Now()
+	jobs := make([]pipeline.Job, 0, len(results))
+	// the history of a server, spooled by the probe during an outage, is appended at once
+	history := make(map[string]int)
+	for i, r := range results {
+		if err := r.Validate(i, received); err != nil {
+			atomic.AddInt64(&rejectedResults, 1)
+			logger.With("location", location).Warn("reject result: %v", err)
+			continue
+		}
+		probeTime := time.Unix(0, r.Time)
+		if r.Err != "" {
+			logger.With("server", r.Server, "location", location).Debug("probe can not check server: %v", r.Err)
+		}
+		p := store.PingRet{
+			Ping:         fmt.Sprintf("%.3f", r.Avg),
+			Time:         probeTime.Truncate(getPingFrequence()).Format(_TIME_LAYOUT),
+			ProbeTime:    probeTime.Format(time.RFC3339),
+			ReceivedTime: received.Format(time.RFC3339),
+		}
+		if len(r.Steps) > 0 {
+			steps := make([]string, len(r.Steps))
+			for i, l := range r.Steps {
+				steps[i] = fmt.Sprintf("%.3f", l)
+			}
+			p.Steps = strings.Join(steps, ",")
+		}
+		p.MTU = r.MTU
+		loss := -1.0
+		if r.Loss != nil {
+			loss = *r.Loss
+			p.Loss = fmt.Sprintf("%.1f", loss)
+		}
+		// the results spooled by the probe during an outage are history rather than incidents
+		if received.Sub(probeTime) >= _MAX_ALERT_DELAY*getPingFrequence() {
+			if i, ok := history[r.Server]; ok {
+				jobs[i].PingRets = append(jobs[i].PingRets, p)
+				continue
+			}
+			history[r.Server] = len(jobs)
+			jobs = append(jobs, pipeline.Job{Server: r.Server, Location: location, PingRets: []store.PingRet{p}})
+			continue
+		}
+		jobs = append(jobs, pipeline.Job{
+			Server: r.Server, Location: location, PingRets: []store.PingRet{p},
+			Sample:   alert.Sample{Time: p.Time, Ping: r.Avg, Down: r.Avg == 0, Loss: loss, MTU: r.MTU},
+			Evaluate: true,
+		})
+	}
+	// the probe spools the batch and reports it again after the time given
+	if retryAfter, ok := ingestion.Push(jobs); !ok {
+		return probe.BusyError{RetryAfter: retryAfter}
+	}
+	observeProbeReport(location)
+	return nil
+}
@@ -0,0 +1,406 @@
+// Package alert evaluates alert rules on the ping results of the monitored servers.
+//
+// Rules are grouped in templates, a template applies to every server of the user
+// whose labels match its selector, e.g. every server tagged env=prod.
+package alert
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// the average ping in milliseconds is above the threshold
+	METRIC_LATENCY = "latency"
+	// the ping node got no response
+	METRIC_DOWN = "down"
+	// the percent of the pings lost is above the threshold, of the icmp checks
+	METRIC_LOSS = "loss"
+	// the path mtu in bytes is below the threshold, of the mtu checks
+	METRIC_MTU = "mtu"
+)
+
+const (
+	SEVERITY_INFO     = "info"
+	SEVERITY_WARNING  = "warning"
+	SEVERITY_CRITICAL = "critical"
+)
+
+// severities by level, rules of no severity are warnings
+var severities = map[string]int{SEVERITY_INFO: 0, SEVERITY_WARNING: 1, SEVERITY_CRITICAL: 2}
+
+const (
+	STATE_FIRING   = "firing"
+	STATE_RESOLVED = "resolved"
+)
+
+// Rule fires if For consecutive samples of a location breach it, and resolves on the first sample not breaching it
+// with a positive Window it fires if For of the last Window samples breach it instead, and resolves once fewer do,
+// so that a single dropped packet never fires it, and it fires only after MinSamples samples in the window at least
+// the samples carrying no value of the metric, like the loss of a check not counting the pings lost, are not in the window
+type Rule struct {
+	Name       string  `json:"name"`
+	Metric     string  `json:"metric"`
+	Threshold  float64 `json:"threshold,omitempty"`
+	For        int     `json:"for,omitempty"`
+	Window     int     `json:"window,omitempty"`
+	MinSamples int     `json:"min_samples,omitempty"`
+	Severity   string  `json:"severity,omitempty"`
+}
+
+func (r Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule name can not be empty")
+	}
+	if r.Metric != METRIC_LATENCY && r.Metric != METRIC_DOWN && r.Metric != METRIC_LOSS && r.Metric != METRIC_MTU {
+		return fmt.Errorf("unknown metric %v of rule %v", r.Metric, r.Name)
+	}
+	if r.For < 0 {
+		return fmt.Errorf("for of rule %v can not be negative", r.Name)
+	}
+	if r.Window < 0 || r.MinSamples < 0 {
+		return fmt.Errorf("window and min_samples of rule %v can not be negative", r.Name)
+	}
+	if r.Window == 0 && r.MinSamples > 0 {
+		return fmt.Errorf("min_samples of rule %v requires a window", r.Name)
+	}
+	if r.Window > 0 && (r.For > r.Window || r.MinSamples > r.Window) {
+		return fmt.Errorf("for and min_samples of rule %v can not exceed its window %v", r.Name, r.Window)
+	}
+	if _, ok := severities[r.Severity]; !ok && r.Severity != "" {
+		return fmt.Errorf("unknown severity %v of rule %v", r.Severity, r.Name)
+	}
+	return nil
+}
+
+func (r Rule) severity() string {
+	if r.Severity == "" {
+		return SEVERITY_WARNING
+	}
+	return r.Severity
+}
+
+func (r Rule) breached(s Sample) bool {
+	switch r.Metric {
+	case METRIC_DOWN:
+		return s.Down
+	case METRIC_LATENCY:
+		return !s.Down && s.Ping > r.Threshold
+	case METRIC_LOSS:
+		return !s.Down && s.Loss > r.Threshold
+	case METRIC_MTU:
+		return !s.Down && s.MTU > 0 && float64(s.MTU) < r.Threshold
+	}
+	return false
+}
+
+// the value of the sample the rule watches
+func (r Rule) value(s Sample) float64 {
+	switch r.Metric {
+	case METRIC_LOSS:
+		return s.Loss
+	case METRIC_MTU:
+		return float64(s.MTU)
+	}
+	return s.Ping
+}
+
+// false if the sample carries no value of the metric
+func (r Rule) known(s Sample) bool {
+	switch r.Metric {
+	case METRIC_LOSS:
+		return s.Down || s.Loss >= 0
+	case METRIC_MTU:
+		return s.Down || s.MTU > 0
+	}
+	return true
+}
+
+func (r Rule) times() int {
+	if r.For < 1 {
+		return 1
+	}
+	return r.For
+}
+
+// Template is a named group of rules applied to the servers with all labels of the selector
+// an empty selector applies to all servers of the user
+type Template struct {
+	Name     string            `json:"name"`
+	Selector map[string]string `json:"selector,omitempty"`
+	Rules    []Rule            `json:"rules"`
+}
+
+func (t Template) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("template name can not be empty")
+	}
+	names := make(map[string]bool, len(t.Rules))
+	for _, r := range t.Rules {
+		if err := r.Validate(); err != nil {
+			return err
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule %v is duplicated in template %v", r.Name, t.Name)
+		}
+		names[r.Name] = true
+	}
+	return nil
+}
+
+func (t Template) Selects(labels map[string]string) bool {
+	for k, v := range t.Selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Sample is a ping result of a location
+type Sample struct {
+	Time string
+	Ping float64
+	Down bool
+	// the percent of the pings lost, negative if unknown
+	Loss float64
+	// the path mtu in bytes, 0 if unknown
+	MTU int
+	// when the sample is received, now if zero
+	At time.Time
+}
+
+// Subject is a user monitoring the server, with the labels of the server, the templates and the notification channels of the user
+// Parents are server -> the server it sits behind, like a router
+type Subject struct {
+	Username  string
+	Labels    map[string]string
+	Templates []Template
+	Channels  []Channel
+	Schedule  Schedule
+	Parents   map[string]string
+	// the locale of the notifications of the user
+	Locale string
+	// the alerts are not correlated if nil
+	Correlation *Correlation
+}
+
+type Alert struct {
+	Username string            `json:"username"`
+	Server   string            `json:"server"`
+	Location string            `json:"location"`
+	Template string            `json:"template"`
+	Rule     string            `json:"rule"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Severity string            `json:"severity"`
+	State    string            `json:"state"`
+	// the ping of the sample changing the state
+	Value float64 `json:"value"`
+	// time of the sample changing the state
+	Time string `json:"time"`
+	// when the alert fired
+	Since time.Time `json:"since"`
+	At    time.Time `json:"at"`
+	// the ancestor server firing when the alert fired, the alert is grouped into its incident rather than notified
+	Parent string `json:"parent,omitempty"`
+	// the label of the correlated incident the alert is of, and since when, see Correlation
+	// the alert correlating the servers, and the last one resolved, carry the servers correlated and are notified, the others are grouped
+	Correlation     string    `json:"correlation,omitempty"`
+	CorrelatedSince time.Time `json:"correlated_since,omitempty"`
+	Correlated      []string  `json:"correlated,omitempty"`
+	// the alert is held for the window of its correlation rather than notified, see Evaluator.Release
+	Held bool `json:"held,omitempty"`
+	// the locale of the texts notified, see Text
+	Locale string `json:"locale,omitempty"`
+}
+
+type seriesKey struct{ username, server, location, template, rule string }
+
+type ruleState struct {
+	breaches int
+	since    time.Time
+	severity string
+	parent   string
+	// the label the alert correlates by, see Correlation
+	correlation string
+	// whether the last samples breached the rule of a window, breaches counts those breaching
+	recent []bool
+	// the window the samples are recent of, they are observed again once the rule changes it
+	window window
+}
+
+type window struct{ times, size, minSamples int }
+
+func (r Rule) window() window { return window{r.times(), r.Window, r.MinSamples} }
+
+// observe the sample in the window of the rule
+// the samples observed in another window are dropped, an alert firing keeps firing until the window holds enough samples to resolve it
+func (st *ruleState) observe(breached bool, w window) {
+	if st.window != w {
+		st.window, st.recent = w, nil
+	}
+	st.recent = append(st.recent, breached)
+	for len(st.recent) > w.size {
+		st.recent = st.recent[1:]
+	}
+	st.breaches = 0
+	for _, b := range st.recent {
+		if b {
+			st.breaches++
+		}
+	}
+}
+
+// Evaluator keeps the state of every rule on every location of every server, and the correlated incidents
+type Evaluator struct {
+	states       map[seriesKey]*ruleState
+	correlations map[correlationKey]*correlation
+	mu           sync.Mutex
+}
+
+func NewEvaluator() *Evaluator {
+	return &Evaluator{states: make(map[seriesKey]*ruleState), correlations: make(map[correlationKey]*correlation)}
+}
+
+// Evaluate applies the rules selected for the server to the sample of the location
+// returns the alerts fired or resolved by the sample
+func (e *Evaluator) Evaluate(server, location string, subjects []Subject, s Sample) []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	alerts := make([]Alert, 0)
+	evaluated := make(map[seriesKey]bool)
+	now := s.At
+	if now.IsZero() {
+		now = time.Now()
+	}
+	for _, sub := range subjects {
+		for _, t := range sub.Templates {
+			if !t.Selects(sub.Labels) {
+				continue
+			}
+			for _, r := range t.Rules {
+				k := seriesKey{sub.Username, server, location, t.Name, r.Name}
+				evaluated[k] = true
+				st, ok := e.states[k]
+				if !ok {
+					st = new(ruleState)
+					e.states[k] = st
+				}
+				a := Alert{
+					Username: sub.Username, Server: server, Location: location,
+					Template: t.Name, Rule: r.Name, Labels: sub.Labels, Severity: r.severity(),
+					Value: r.value(s), Time: s.Time, At: now,
+				}
+				if r.Window > 0 {
+					if !r.known(s) {
+						continue
+					}
+					// the state of a window is kept while it resolves
+					st.observe(r.breached(s), r.window())
+					if firing := !st.since.IsZero(); !firing && st.breaches >= r.times() && len(st.recent) >= r.MinSamples {
+						alerts = append(alerts, e.fire(a, st, sub))
+					} else if firing && st.breaches < r.times() && len(st.recent) >= max(r.times(), r.MinSamples) {
+						alerts = append(alerts, e.resolve(a, st))
+						st.since, st.parent, st.correlation = time.Time{}, "", ""
+					}
+					continue
+				}
+				if r.breached(s) {
+					if st.breaches++; st.breaches == r.times() {
+						alerts = append(alerts, e.fire(a, st, sub))
+					}
+				} else {
+					if st.breaches >= r.times() {
+						alerts = append(alerts, e.resolve(a, st))
+					}
+					delete(e.states, k)
+				}
+			}
+		}
+	}
+	// the rules and the users gone from the server
+	for k, st := range e.states {
+		if k.server == server && k.location == location && !evaluated[k] {
+			e.drop(k, st)
+		}
+	}
+	return alerts
+}
+
+// Forget drops the state of the rules of the user on the server, once the user stops monitoring it
+func (e *Evaluator) Forget(username, server string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for k, st := range e.states {
+		if k.username == username && k.server == server {
+			e.drop(k, st)
+		}
+	}
+}
+
+// drop the state without notifying, the correlated incident no longer counts it
+// should be invoked with the lock held
+func (e *Evaluator) drop(k seriesKey, st *ruleState) {
+	if !st.since.IsZero() {
+		e.uncorrelate(&Alert{Username: k.username, Server: k.server, Location: k.location, Template: k.template, Rule: k.rule}, st)
+	}
+	delete(e.states, k)
+}
+
+// should be invoked with the lock held
+func (e *Evaluator) fire(a Alert, st *ruleState, sub Subject) Alert {
+	st.since, st.severity = a.At, a.Severity
+	st.parent = e.firingAncestor(sub.Username, a.Server, sub.Parents)
+	a.State, a.Since, a.Parent = STATE_FIRING, a.At, st.parent
+	// the alerts grouped into the incident of the parent are not correlated
+	if st.parent == "" {
+		e.correlate(&a, st, sub.Correlation)
+	}
+	return a
+}
+
+// should be invoked with the lock held
+func (e *Evaluator) resolve(a Alert, st *ruleState) Alert {
+	a.State, a.Since, a.Parent = STATE_RESOLVED, st.since, st.parent
+	e.uncorrelate(&a, st)
+	return a
+}
+
+// Firing returns the alerts firing of the user, the earliest first
+func (e *Evaluator) Firing(username string) []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	alerts := make([]Alert, 0)
+	for k, st := range e.states {
+		if k.username != username || st.since.IsZero() {
+			continue
+		}
+		a := Alert{
+			Username: k.username, Server: k.server, Location: k.location,
+			Template: k.template, Rule: k.rule, Severity: st.severity, State: STATE_FIRING, Since: st.since, Parent: st.parent,
+		}
+		if c, ok := e.correlations[correlationKey{k.username, k.template, k.rule, st.correlation}]; ok && !c.since.IsZero() {
+			a.Correlation, a.CorrelatedSince = st.correlation, c.since
+		}
+		alerts = append(alerts, a)
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].Since.Before(alerts[j].Since) })
+	return alerts
+}
+
+// returns the nearest ancestor of the server with an alert firing, empty if none
+// should be invoked with the lock held
+func (e *Evaluator) firingAncestor(username, server string, parents map[string]string) string {
+	seen := map[string]bool{server: true}
+	for parent := parents[server]; parent != "" && !seen[parent]; parent = parents[parent] {
+		seen[parent] = true
+		for k, st := range e.states {
+			if k.username == username && k.server == parent && !st.since.IsZero() {
+				return parent
+			}
+		}
+	}
+	return ""
+}
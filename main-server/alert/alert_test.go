@@ -0,0 +1,416 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_Evaluate(t *testing.T) {
+	prod := Template{
+		Name:     "prod-latency",
+		Selector: map[string]string{"env": "prod"},
+		Rules:    []Rule{{Name: "slow", Metric: METRIC_LATENCY, Threshold: 100, For: 2}},
+	}
+	if err := prod.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	subjects := []Subject{
+		{Username: "alice", Labels: map[string]string{"env": "prod"}, Templates: []Template{prod}},
+		{Username: "bob", Labels: map[string]string{"env": "dev"}, Templates: []Template{prod}},
+	}
+	e := NewEvaluator()
+	eval := func(ping float64) []Alert {
+		return e.Evaluate("google.com", "Tokyo", subjects, Sample{Time: "15-01-01 00:00", Ping: ping})
+	}
+
+	if alerts := eval(200); len(alerts) != 0 {
+		t.Errorf("should not fire on the first breach, got %v", alerts)
+	}
+	alerts := eval(300)
+	if len(alerts) != 1 || alerts[0].Username != "alice" || alerts[0].State != STATE_FIRING || alerts[0].Value != 300 || alerts[0].Severity != SEVERITY_WARNING {
+		t.Fatalf("should fire for alice only, got %v", alerts)
+	}
+	if alerts = eval(400); len(alerts) != 0 {
+		t.Errorf("should fire once, got %v", alerts)
+	}
+	if firing := e.Firing("alice"); len(firing) != 1 || firing[0].Rule != "slow" {
+		t.Errorf("got firing %v", firing)
+	}
+	if alerts = eval(50); len(alerts) != 1 || alerts[0].State != STATE_RESOLVED {
+		t.Errorf("should resolve, got %v", alerts)
+	}
+	if firing := e.Firing("alice"); len(firing) != 0 {
+		t.Errorf("got firing %v after resolved", firing)
+	}
+}
+
+func Test_Loss(t *testing.T) {
+	tpl := Template{Name: "loss", Rules: []Rule{{Name: "lossy", Metric: METRIC_LOSS, Threshold: 20}}}
+	if err := tpl.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	subjects := []Subject{{Username: "alice", Templates: []Template{tpl}}}
+	e := NewEvaluator()
+	eval := func(s Sample) []Alert { return e.Evaluate("google.com", "Tokyo", subjects, s) }
+	if alerts := eval(Sample{Ping: 10, Loss: -1}); len(alerts) != 0 {
+		t.Errorf("should not fire of unknown loss, got %v", alerts)
+	}
+	if alerts := eval(Sample{Ping: 0, Down: true, Loss: 100}); len(alerts) != 0 {
+		t.Errorf("should leave the down samples to the down rules, got %v", alerts)
+	}
+	if alerts := eval(Sample{Ping: 10, Loss: 33.3}); len(alerts) != 1 || alerts[0].State != STATE_FIRING || alerts[0].Value != 33.3 {
+		t.Fatalf("should fire of the loss, got %v", alerts)
+	}
+	if alerts := eval(Sample{Ping: 10, Loss: 0}); len(alerts) != 1 || alerts[0].State != STATE_RESOLVED {
+		t.Errorf("should resolve, got %v", alerts)
+	}
+}
+
+func Test_MTU(t *testing.T) {
+	tpl := Template{Name: "vpn", Rules: []Rule{{Name: "fragmented", Metric: METRIC_MTU, Threshold: 1400}}}
+	if err := tpl.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	subjects := []Subject{{Username: "alice", Templates: []Template{tpl}}}
+	e := NewEvaluator()
+	eval := func(s Sample) []Alert { return e.Evaluate("mtu://vpn.example.com", "Tokyo", subjects, s) }
+	if alerts := eval(Sample{Ping: 10, MTU: 1500}); len(alerts) != 0 {
+		t.Errorf("should not fire above the threshold, got %v", alerts)
+	}
+	if alerts := eval(Sample{Ping: 10}); len(alerts) != 0 {
+		t.Errorf("should not fire of unknown mtu, got %v", alerts)
+	}
+	if alerts := eval(Sample{Ping: 10, MTU: 1280}); len(alerts) != 1 || alerts[0].State != STATE_FIRING || alerts[0].Value != 1280 {
+		t.Fatalf("should fire when the mtu drops, got %v", alerts)
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	for _, tpl := range []Template{
+		{},
+		{Name: "t", Rules: []Rule{{Name: "r", Metric: "jitter"}}},
+		{Name: "t", Rules: []Rule{{Name: "r", Metric: METRIC_DOWN, Severity: "fatal"}}},
+		{Name: "t", Rules: []Rule{{Name: "r", Metric: METRIC_DOWN}, {Name: "r", Metric: METRIC_DOWN}}},
+	} {
+		if tpl.Validate() == nil {
+			t.Errorf("template %+v should be invalid", tpl)
+		}
+	}
+}
+
+func Test_History(t *testing.T) {
+	h := NewHistory(3)
+	for _, un := range []string{"alice", "bob", "alice", "alice"} {
+		h.Add(Alert{Username: un})
+	}
+	if alerts := h.List(""); len(alerts) != 3 {
+		t.Errorf("got %v alerts, want the latest 3", len(alerts))
+	}
+	if alerts := h.List("alice"); len(alerts) != 2 {
+		t.Errorf("got %v alerts of alice", len(alerts))
+	}
+}
+
+func Test_Replay(t *testing.T) {
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	samples := make(map[string][]Sample)
+	for i, ping := range []float64{50, 200, 300, 80, 250} {
+		samples["Tokyo"] = append(samples["Tokyo"], Sample{Ping: ping, At: start.Add(time.Duration(i) * time.Minute)})
+	}
+	alerts, err := Replay("google.com", nil, Rule{Name: "slow", Metric: METRIC_LATENCY, Threshold: 100, For: 2}, samples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 2 || alerts[0].State != STATE_FIRING || alerts[1].State != STATE_RESOLVED {
+		t.Fatalf("should fire and resolve, got %v", alerts)
+	}
+	if !alerts[0].Since.Equal(start.Add(2*time.Minute)) || !alerts[1].At.Equal(start.Add(3*time.Minute)) {
+		t.Errorf("alerts should be timed by the samples, got %v", alerts)
+	}
+	if _, err = Replay("google.com", nil, Rule{Name: "bad"}, samples); err == nil {
+		t.Error("should reject invalid rule")
+	}
+}
+
+func Test_Dependencies(t *testing.T) {
+	down := Template{Name: "down", Rules: []Rule{{Name: "down", Metric: METRIC_DOWN}}}
+	subjects := []Subject{{
+		Username:  "alice",
+		Templates: []Template{down},
+		Parents:   map[string]string{"web": "switch", "switch": "router"},
+	}}
+	e := NewEvaluator()
+	sample := Sample{Down: true}
+	if alerts := e.Evaluate("router", "Tokyo", subjects, sample); len(alerts) != 1 || alerts[0].Parent != "" {
+		t.Fatalf("router should fire, got %v", alerts)
+	}
+	alerts := e.Evaluate("web", "Tokyo", subjects, sample)
+	if len(alerts) != 1 || alerts[0].Parent != "router" {
+		t.Fatalf("web should be grouped into the incident of router, got %v", alerts)
+	}
+	if alerts = e.Evaluate("web", "Tokyo", subjects, Sample{}); len(alerts) != 1 || alerts[0].State != STATE_RESOLVED || alerts[0].Parent != "router" {
+		t.Errorf("resolved alert should keep the parent, got %v", alerts)
+	}
+}
+
+func Test_Incidents(t *testing.T) {
+	t0 := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(m int) time.Time { return t0.Add(time.Duration(m) * time.Minute) }
+	a := Alert{Username: "alice", Server: "router", Location: "Tokyo", Template: "down", Rule: "down", Severity: SEVERITY_CRITICAL}
+	alert := func(server, state string, since, now int, parent string) Alert {
+		ret := a
+		ret.Server, ret.State, ret.Since, ret.At, ret.Parent = server, state, at(since), at(now), parent
+		return ret
+	}
+	// the latest first, like History.List, the firing alert of the first incident is no longer kept
+	alerts := []Alert{
+		alert("router", STATE_FIRING, 30, 30, ""),
+		alert("web", STATE_RESOLVED, 12, 15, "router"),
+		alert("router", STATE_RESOLVED, 10, 20, ""),
+		alert("web", STATE_FIRING, 12, 12, "router"),
+		alert("router", STATE_RESOLVED, 0, 5, ""),
+	}
+	incidents := Incidents(alerts)
+	if len(incidents) != 3 {
+		t.Fatalf("got incidents %+v", incidents)
+	}
+	if i := incidents[0]; i.State != STATE_FIRING || !i.Start.Equal(at(30)) || !i.End.IsZero() || i.Duration(at(40)) != 10*time.Minute {
+		t.Errorf("got firing incident %+v", i)
+	}
+	if i := incidents[1]; i.State != STATE_RESOLVED || i.Duration(at(40)) != 10*time.Minute || len(i.Grouped) != 1 || i.Grouped[0] != "web" {
+		t.Errorf("got resolved incident %+v", i)
+	}
+	if i := incidents[2]; !i.Start.Equal(at(0)) || !i.End.Equal(at(5)) {
+		t.Errorf("got incident %+v without the firing alert", i)
+	}
+
+	f := Filter{From: at(6), To: at(25), States: []string{STATE_RESOLVED}}
+	if err := f.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, i := range incidents {
+		if f.MatchIncident(i) {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("got %v incidents resolved overlapping the range", n)
+	}
+	if f.Match(alerts[4]) || !f.Match(alerts[2]) {
+		t.Error("wrong alerts matched")
+	}
+	if (Filter{States: []string{"pending"}}).Validate() == nil || (Filter{From: at(1), To: at(0)}).Validate() == nil {
+		t.Error("should reject invalid filters")
+	}
+
+	var b bytes.Buffer
+	if err := ExportIncidents(&b, FORMAT_CSV, incidents, at(40)); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 4 || rows[0][0] != "start" || rows[2][2] != "600" || rows[2][12] != "web" {
+		t.Errorf("got csv %v", rows)
+	}
+	if err = ExportAlerts(&b, "xml", alerts); err == nil {
+		t.Error("should reject unknown format")
+	}
+}
+
+func Test_Correlation(t *testing.T) {
+	down := Template{Name: "down", Rules: []Rule{{Name: "down", Metric: METRIC_DOWN}}}
+	conf := &Correlation{Labels: []string{"provider"}, Window: 5, Min: 3}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if (Correlation{Labels: []string{"provider"}, Window: 5, Min: 1}).Validate() == nil {
+		t.Error("should reject min below 2")
+	}
+	providers := map[string]string{"a": "hetzner", "b": "hetzner", "c": "hetzner", "d": "hetzner", "x": "aws", "y": "aws", "z": "aws"}
+	e := NewEvaluator()
+	t0 := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	history := make([]Alert, 0)
+	evaluate := func(server string, m int, isDown bool) Alert {
+		subjects := []Subject{{Username: "alice", Labels: map[string]string{"provider": providers[server]}, Templates: []Template{down}, Correlation: conf}}
+		alerts := e.Evaluate(server, "Tokyo", subjects, Sample{Down: isDown, At: t0.Add(time.Duration(m) * time.Minute)})
+		if len(alerts) != 1 {
+			t.Fatalf("%v should change state, got %v", server, alerts)
+		}
+		history = append([]Alert{alerts[0]}, history...)
+		return alerts[0]
+	}
+	for i, server := range []string{"a", "b"} {
+		if a := evaluate(server, i, true); a.Correlation != "" || !a.Held {
+			t.Errorf("%v is not correlated yet and should be held, got %+v", server, a)
+		}
+	}
+	head := evaluate("c", 2, true)
+	if head.Correlation != "provider=hetzner" || fmt.Sprint(head.Correlated) != "[a b c]" || !head.CorrelatedSince.Equal(t0.Add(2*time.Minute)) {
+		t.Errorf("c should correlate the servers, got %+v", head)
+	}
+	if got := head.String(); got != "[firing] warning: down of down on 3 servers of provider=hetzner: a, b, c" {
+		t.Errorf("got %v", got)
+	}
+	if a := evaluate("d", 3, true); a.Correlation != "provider=hetzner" || a.Correlated != nil {
+		t.Errorf("d should be grouped into the correlated incident, got %+v", a)
+	}
+	if released := e.Release(t0.Add(time.Hour)); len(released) != 0 {
+		t.Errorf("the alerts held of the servers correlated should not be released, got %+v", released)
+	}
+	// fired beyond the window of each other, x is evicted by the time z fires
+	for i, server := range []string{"x", "y", "z"} {
+		if a := evaluate(server, i*3, true); a.Correlation != "" || !a.Held {
+			t.Errorf("%v should not be correlated, got %+v", server, a)
+		}
+	}
+	if released := e.Release(t0.Add(7 * time.Minute)); len(released) != 1 || released[0].Server != "x" || released[0].Held {
+		t.Errorf("x should be released once its window ends, got %+v", released)
+	}
+	if released := e.Release(t0.Add(time.Hour)); len(released) != 2 || released[0].Server != "y" || released[1].Server != "z" || !released[1].Since.Equal(t0.Add(6*time.Minute)) {
+		t.Errorf("got %+v", released)
+	}
+	if cs := e.Correlations("alice"); len(cs) != 1 || fmt.Sprint(cs[0].Servers, cs[0].Firing) != "[a b c d] [a b c d]" {
+		t.Errorf("got %+v", cs)
+	}
+	if firing := e.Firing("alice"); len(firing) != 7 {
+		t.Errorf("got %v", firing)
+	}
+	// the resolution of an alert released is notified, that of an alert held is held as well
+	if a := evaluate("x", 61, false); a.Held || a.Correlation != "" {
+		t.Errorf("got %+v", a)
+	}
+	if a := evaluate("x", 62, true); !a.Held {
+		t.Errorf("got %+v", a)
+	}
+	if a := evaluate("x", 63, false); !a.Held {
+		t.Errorf("got %+v", a)
+	}
+	if released := e.Release(t0.Add(2 * time.Hour)); len(released) != 0 {
+		t.Errorf("the alert held resolved should not be released, got %+v", released)
+	}
+	for _, server := range []string{"a", "b", "c"} {
+		if a := evaluate(server, 10, false); a.Correlation != "provider=hetzner" || a.Correlated != nil {
+			t.Errorf("%v should be grouped until the last resolves, got %+v", server, a)
+		}
+	}
+	if a := evaluate("d", 10, false); fmt.Sprint(a.Correlated) != "[a b c d]" {
+		t.Errorf("the last resolved should carry the servers, got %+v", a)
+	}
+	if cs := e.Correlations("alice"); len(cs) != 0 {
+		t.Errorf("got %+v", cs)
+	}
+
+	correlated := 0
+	for _, i := range Incidents(history) {
+		if i.Correlation == "provider=hetzner" {
+			correlated++
+		} else if i.Correlation != "" {
+			t.Errorf("got %+v", i)
+		}
+	}
+	if correlated != 4 {
+		t.Errorf("the incidents of the servers correlated should be of the correlation, including those fired before, got %v", correlated)
+	}
+}
+
+func Test_Window(t *testing.T) {
+	r := Rule{Name: "down", Metric: METRIC_DOWN, For: 3, Window: 5, MinSamples: 4}
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []Rule{
+		{Name: "r", Metric: METRIC_DOWN, For: 6, Window: 5},
+		{Name: "r", Metric: METRIC_DOWN, MinSamples: 2},
+		{Name: "r", Metric: METRIC_DOWN, Window: -1},
+	} {
+		if bad.Validate() == nil {
+			t.Errorf("rule %+v should be invalid", bad)
+		}
+	}
+	states := func(r Rule, samples ...Sample) string {
+		e := NewEvaluator()
+		subjects := []Subject{{Username: "alice", Templates: []Template{{Name: "t", Rules: []Rule{r}}}}}
+		got := ""
+		for _, s := range samples {
+			for _, a := range e.Evaluate("google.com", "Tokyo", subjects, s) {
+				got += a.State + " "
+			}
+			got += "."
+		}
+		return got
+	}
+	up, down := Sample{Ping: 1}, Sample{Down: true}
+	if got := states(r, up, down, up, down, down, up, up); got != "....firing ..resolved ." {
+		t.Errorf("3 of the last 5 samples should fire it, got %v", got)
+	}
+	if got := states(r, down, down, down); got != "..." {
+		t.Errorf("3 samples should not fire it before 4 samples, got %v", got)
+	}
+	if got := states(r, up, up, down, up, up, up, down, up); got != "........" {
+		t.Errorf("a single dropped packet should never fire it, got %v", got)
+	}
+	loss := Rule{Name: "loss", Metric: METRIC_LOSS, Threshold: 10, For: 2, Window: 2}
+	if got := states(loss, Sample{Loss: 50}, Sample{Loss: -1}, Sample{Loss: 50}); got != "..firing ." {
+		t.Errorf("the samples of unknown loss should not be in the window, got %v", got)
+	}
+}
+
+func Test_WindowChange(t *testing.T) {
+	e := NewEvaluator()
+	evaluate := func(r Rule, samples ...Sample) string {
+		subjects := []Subject{{Username: "alice", Templates: []Template{{Name: "t", Rules: []Rule{r}}}}}
+		got := ""
+		for _, s := range samples {
+			for _, a := range e.Evaluate("google.com", "Tokyo", subjects, s) {
+				got += a.State + " "
+			}
+			got += "."
+		}
+		return got
+	}
+	up, down := Sample{Ping: 1}, Sample{Down: true}
+	if got := evaluate(Rule{Name: "down", Metric: METRIC_DOWN, For: 3, Window: 5, MinSamples: 4}, up, down, down, down); got != "...firing ." {
+		t.Errorf("3 of the last 4 samples should fire it, got %v", got)
+	}
+	// the samples of the old window are dropped, it keeps firing until the new one holds 3 samples
+	if got := evaluate(Rule{Name: "down", Metric: METRIC_DOWN, For: 2, Window: 3, MinSamples: 3}, down, down, up, up); got != "...resolved ." {
+		t.Errorf("the new window should resolve it, got %v", got)
+	}
+	if got := evaluate(Rule{Name: "down", Metric: METRIC_DOWN, For: 2, Window: 2}, down, down); got != ".firing ." {
+		t.Errorf("2 of the last 2 samples should fire it, got %v", got)
+	}
+	if len(e.Firing("alice")) != 1 {
+		t.Fatalf("should be firing, got %v", e.Firing("alice"))
+	}
+	// the rule gone
+	if alerts := e.Evaluate("google.com", "Tokyo", []Subject{{Username: "alice"}}, down); len(alerts) != 0 || len(e.Firing("alice")) != 0 || len(e.states) != 0 {
+		t.Errorf("the state of the rule gone should be dropped, got %v, %v", alerts, e.Firing("alice"))
+	}
+	evaluate(Rule{Name: "down", Metric: METRIC_DOWN, For: 1, Window: 2}, down)
+	if e.Forget("alice", "google.com"); len(e.states) != 0 {
+		t.Errorf("the state of the server gone should be dropped, got %v", e.states)
+	}
+}
+
+func Test_PruneCorrelated(t *testing.T) {
+	down := Template{Name: "down", Rules: []Rule{{Name: "down", Metric: METRIC_DOWN, For: 1, Window: 1}}}
+	conf := &Correlation{Labels: []string{"provider"}, Window: 5, Min: 2}
+	e := NewEvaluator()
+	for _, server := range []string{"a", "b"} {
+		e.Evaluate(server, "Tokyo", []Subject{{Username: "alice", Labels: map[string]string{"provider": "hetzner"}, Templates: []Template{down}, Correlation: conf}}, Sample{Down: true})
+	}
+	if got := e.Correlations("alice"); len(got) != 1 {
+		t.Fatalf("a and b should be correlated, got %+v", got)
+	}
+	e.Forget("alice", "a")
+	e.Evaluate("b", "Tokyo", nil, Sample{Down: true})
+	if got := e.Correlations("alice"); len(got) != 0 {
+		t.Errorf("the correlated incident of the servers gone should be closed, got %+v", got)
+	}
+}
@@ -0,0 +1,210 @@
+package alert
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Correlation groups the alerts of a rule firing on Min servers or more sharing the value of one of the Labels within Window minutes,
+// like the servers of a provider going down together, into one correlated incident notified once
+// the alerts of the servers correlated are grouped into it until all of them resolve, the last resolution is notified with all the servers
+// the alerts fired before are held for the window, and notified one by one by Release unless the servers are correlated within it
+type Correlation struct {
+	Labels []string `json:"labels"`
+	Window int      `json:"window"`
+	Min    int      `json:"min"`
+}
+
+func (c Correlation) Validate() error {
+	if len(c.Labels) == 0 {
+		return fmt.Errorf("labels of correlation can not be empty")
+	}
+	if c.Window <= 0 {
+		return fmt.Errorf("window of correlation should be positive")
+	}
+	if c.Min < 2 {
+		return fmt.Errorf("min of correlation should be at least 2")
+	}
+	return nil
+}
+
+// the label of the server its alerts correlate by, like "provider=hetzner", empty if it has none of the labels
+func (c *Correlation) label(labels map[string]string) string {
+	if c == nil {
+		return ""
+	}
+	for _, k := range c.Labels {
+		if v, ok := labels[k]; ok {
+			return k + "=" + v
+		}
+	}
+	return ""
+}
+
+type correlationKey struct{ username, template, rule, label string }
+
+type heldKey struct{ server, location string }
+
+type correlation struct {
+	window time.Duration
+	// server -> when it fired, of the servers fired within the window, and the locations firing, of the servers firing
+	fired  map[string]time.Time
+	firing map[string]int
+	// the alerts fired held until the servers are correlated or the window ends
+	held map[heldKey]Alert
+	// when the servers fired within the window were correlated, zero until then, and the servers correlated
+	since   time.Time
+	servers []string
+}
+
+// drop the servers fired beyond the window before now
+func (c *correlation) evict(now time.Time) {
+	for server, at := range c.fired {
+		if now.Sub(at) > c.window {
+			delete(c.fired, server)
+		}
+	}
+}
+
+// whether any of the servers correlated is firing
+func (c *correlation) correlatedFiring() bool {
+	for _, server := range c.servers {
+		if c.firing[server] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Correlated is an open correlated incident, of the servers correlated since
+type Correlated struct {
+	Template string    `json:"template"`
+	Rule     string    `json:"rule"`
+	Label    string    `json:"label"`
+	Since    time.Time `json:"since"`
+	Servers  []string  `json:"servers"`
+	// the servers still firing
+	Firing []string `json:"firing"`
+}
+
+// correlate the alert fired, the alert correlating the servers carries them in Correlated, those after are grouped into it
+// the alerts before are held, see Release
+// should be invoked with the lock held
+func (e *Evaluator) correlate(a *Alert, st *ruleState, conf *Correlation) {
+	label := conf.label(a.Labels)
+	if label == "" {
+		return
+	}
+	st.correlation = label
+	k := correlationKey{a.Username, a.Template, a.Rule, label}
+	c, ok := e.correlations[k]
+	if !ok {
+		c = &correlation{fired: make(map[string]time.Time), firing: make(map[string]int), held: make(map[heldKey]Alert)}
+		e.correlations[k] = c
+	}
+	c.window = time.Duration(conf.Window) * time.Minute
+	if c.firing[a.Server]++; c.firing[a.Server] == 1 {
+		c.fired[a.Server] = a.At
+	}
+	if !c.since.IsZero() {
+		if !in(c.servers, a.Server) {
+			c.servers = append(c.servers, a.Server)
+		}
+		a.Correlation, a.CorrelatedSince = label, c.since
+		return
+	}
+	// the servers fired beyond the window do not count
+	c.evict(a.At)
+	if len(c.fired) < conf.Min {
+		a.Held = true
+		c.held[heldKey{a.Server, a.Location}] = *a
+		return
+	}
+	c.since = a.At
+	for server := range c.fired {
+		c.servers = append(c.servers, server)
+	}
+	sort.Strings(c.servers)
+	// the alerts held of the servers correlated are never notified, the others are released once their window ends
+	for hk := range c.held {
+		if in(c.servers, hk.server) {
+			delete(c.held, hk)
+		}
+	}
+	a.Correlation, a.CorrelatedSince, a.Correlated = label, c.since, append([]string(nil), c.servers...)
+}
+
+// the alert resolved of a correlated server is grouped into it, unless it is the last one, which carries all the servers
+// the alert resolved of an alert held is held as well, neither is notified
+// should be invoked with the lock held
+func (e *Evaluator) uncorrelate(a *Alert, st *ruleState) {
+	if st.correlation == "" {
+		return
+	}
+	k := correlationKey{a.Username, a.Template, a.Rule, st.correlation}
+	c, ok := e.correlations[k]
+	if !ok {
+		return
+	}
+	if c.firing[a.Server]--; c.firing[a.Server] <= 0 {
+		delete(c.firing, a.Server)
+		delete(c.fired, a.Server)
+	}
+	hk := heldKey{a.Server, a.Location}
+	if _, ok := c.held[hk]; ok {
+		delete(c.held, hk)
+		a.Held = true
+	} else if !c.since.IsZero() && in(c.servers, a.Server) {
+		a.Correlation, a.CorrelatedSince = st.correlation, c.since
+		if !c.correlatedFiring() {
+			a.Correlated = c.servers
+		}
+	}
+	if len(c.firing) == 0 {
+		delete(e.correlations, k)
+	}
+}
+
+// Release returns the alerts held whose window ended by now without the servers correlated, to be notified one by one
+func (e *Evaluator) Release(now time.Time) []Alert {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	alerts := make([]Alert, 0)
+	for _, c := range e.correlations {
+		for hk, a := range c.held {
+			if now.Sub(a.At) >= c.window {
+				delete(c.held, hk)
+				a.Held = false
+				alerts = append(alerts, a)
+			}
+		}
+	}
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].At.Before(alerts[j].At) })
+	return alerts
+}
+
+// Correlations returns the open correlated incidents of the user, the earliest first
+func (e *Evaluator) Correlations(username string) []Correlated {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ret := make([]Correlated, 0)
+	for k, c := range e.correlations {
+		if k.username != username || c.since.IsZero() {
+			continue
+		}
+		firing := make([]string, 0, len(c.firing))
+		for server := range c.firing {
+			if in(c.servers, server) {
+				firing = append(firing, server)
+			}
+		}
+		sort.Strings(firing)
+		ret = append(ret, Correlated{
+			Template: k.template, Rule: k.rule, Label: k.label, Since: c.since,
+			Servers: append([]string(nil), c.servers...), Firing: firing,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Since.Before(ret[j].Since) })
+	return ret
+}
@@ -0,0 +1,150 @@
+package alert
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/i18n"
+)
+
+// the alerts listed by the text of a digest, the rest are counted
+const _DIGEST_LINES = 50
+
+// the alerts kept by a digest, the later ones are counted, so that a flapping server does not grow it unbounded
+const _DIGEST_SIZE = 1 << 8
+
+// DigestNotifier sends the alerts of a digest in one message, the notifiers which are not send them one by one
+// more is the number of the alerts beyond the ones of the digest, which were not kept
+type DigestNotifier interface {
+	NotifyDigest(alerts []Alert, more int) error
+}
+
+type digestKey struct{ username, channel string }
+
+type digestBatch struct {
+	channel Channel
+	alerts  []Alert
+	// the alerts beyond _DIGEST_SIZE
+	more int
+	due  time.Time
+}
+
+// Digester batches the alerts of the channels in digest mode, see Channel.Digest
+type Digester struct {
+	mu      sync.Mutex
+	batches map[digestKey]*digestBatch
+}
+
+func NewDigester() *Digester { return &Digester{batches: make(map[digestKey]*digestBatch)} }
+
+// Dispatch is like Dispatch, but the alerts not critical of the channels in digest mode are batched rather than sent
+func (d *Digester) Dispatch(a Alert, channels []Channel, sched Schedule) map[string]error {
+	return dispatch(a, channels, sched, func(c Channel) bool { return d.add(a, c) })
+}
+
+// batch the alert, returns false if it should be sent at once
+func (d *Digester) add(a Alert, c Channel) bool {
+	if c.Digest <= 0 || a.Severity == SEVERITY_CRITICAL {
+		return false
+	}
+	at := a.At
+	if at.IsZero() {
+		at = time.Now()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	k := digestKey{a.Username, c.Name}
+	b, ok := d.batches[k]
+	if !ok {
+		b = &digestBatch{due: at.Add(time.Duration(c.Digest) * time.Minute)}
+		d.batches[k] = b
+	}
+	// the channel changed meanwhile is sent the digest by its latest config
+	b.channel = c
+	if len(b.alerts) < _DIGEST_SIZE {
+		b.alerts = append(b.alerts, a)
+	} else {
+		b.more++
+	}
+	return true
+}
+
+// Flush sends the digests due by now, returns username -> channel name -> error of the channels failed
+func (d *Digester) Flush(now time.Time) map[string]map[string]error {
+	return d.flush(func(b *digestBatch) bool { return !b.due.After(now) })
+}
+
+// FlushAll sends every digest, like on shutdown
+func (d *Digester) FlushAll() map[string]map[string]error {
+	return d.flush(func(*digestBatch) bool { return true })
+}
+
+func (d *Digester) flush(due func(b *digestBatch) bool) map[string]map[string]error {
+	d.mu.Lock()
+	batches := make(map[digestKey]*digestBatch)
+	for k, b := range d.batches {
+		if due(b) {
+			batches[k] = b
+			delete(d.batches, k)
+		}
+	}
+	d.mu.Unlock()
+	failed := make(map[string]map[string]error)
+	for k, b := range batches {
+		if err := notifyDigest(b.channel, b.alerts, b.more); err != nil {
+			if failed[k.username] == nil {
+				failed[k.username] = make(map[string]error)
+			}
+			failed[k.username][k.channel] = err
+		}
+	}
+	return failed
+}
+
+// Pending returns the alerts batched for the channels of the user by channel name
+func (d *Digester) Pending(username string) map[string]int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ret := make(map[string]int)
+	for k, b := range d.batches {
+		if k.username == username {
+			ret[k.channel] = len(b.alerts) + b.more
+		}
+	}
+	return ret
+}
+
+func notifyDigest(c Channel, alerts []Alert, more int) error {
+	n, err := c.notifier()
+	if err != nil {
+		return err
+	}
+	if dn, ok := n.(DigestNotifier); ok {
+		return dn.NotifyDigest(alerts, more)
+	}
+	// the alerts not kept are lost to the notifiers sending one by one
+	for _, a := range alerts {
+		if e := n.Notify(a); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// DigestText is the alerts in one message in the locale of the latest one, the earliest first, and the number of the others
+func DigestText(alerts []Alert, more int) string {
+	locale := alerts[len(alerts)-1].Locale
+	lines := []string{i18n.Sprintf(locale, "digest of %v alerts", len(alerts)+more)}
+	for i, a := range alerts {
+		if i == _DIGEST_LINES {
+			more += len(alerts) - i
+			break
+		}
+		lines = append(lines, a.Text())
+	}
+	if more > 0 {
+		lines = append(lines, i18n.Sprintf(locale, "and %v more", more))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,223 @@
+package alert
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FORMAT_CSV  = "csv"
+	FORMAT_JSON = "json"
+)
+
+// Filter selects the alerts changing state between From and To, the incidents overlapping them
+// of the servers, severities and states, empty fields select all
+type Filter struct {
+	From       time.Time `json:"from,omitempty"`
+	To         time.Time `json:"to,omitempty"`
+	Servers    []string  `json:"servers,omitempty"`
+	Severities []string  `json:"severities,omitempty"`
+	States     []string  `json:"states,omitempty"`
+}
+
+func (f Filter) Validate() error {
+	if !f.From.IsZero() && !f.To.IsZero() && f.To.Before(f.From) {
+		return fmt.Errorf("to %v is before from %v", f.To, f.From)
+	}
+	for _, s := range f.Severities {
+		if _, ok := severities[s]; !ok {
+			return fmt.Errorf("unknown severity %v", s)
+		}
+	}
+	for _, s := range f.States {
+		if s != STATE_FIRING && s != STATE_RESOLVED {
+			return fmt.Errorf("unknown state %v", s)
+		}
+	}
+	return nil
+}
+
+func (f Filter) match(server, severity, state string) bool {
+	return selects(f.Servers, server) && selects(f.Severities, severity) && selects(f.States, state)
+}
+
+// Match reports whether the alert changed state in the range and is of the servers, severities and states
+func (f Filter) Match(a Alert) bool {
+	return f.match(a.Server, a.Severity, a.State) && (f.From.IsZero() || !a.At.Before(f.From)) && (f.To.IsZero() || !a.At.After(f.To))
+}
+
+// MatchIncident reports whether the incident overlaps the range and is of the servers, severities and states
+func (f Filter) MatchIncident(i Incident) bool {
+	return f.match(i.Server, i.Severity, i.State) && (f.From.IsZero() || i.End.IsZero() || !i.End.Before(f.From)) && (f.To.IsZero() || !i.Start.After(f.To))
+}
+
+// empty values select all
+func selects(values []string, v string) bool { return len(values) == 0 || in(values, v) }
+
+// Incident is a rule firing on a location from Start until End, zero while firing
+// Grouped are the servers behind it whose alerts are grouped into it
+// Correlation is the label of the correlated incident it is of, fired since CorrelatedSince, see Alert.Correlation
+type Incident struct {
+	Username string            `json:"username"`
+	Server   string            `json:"server"`
+	Location string            `json:"location"`
+	Template string            `json:"template"`
+	Rule     string            `json:"rule"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Severity string            `json:"severity"`
+	State    string            `json:"state"`
+	Start    time.Time         `json:"start"`
+	End      time.Time         `json:"end,omitempty"`
+	// the ping of the sample firing the alert, and of the one resolving it
+	FiringValue   float64  `json:"firing_value"`
+	ResolvedValue float64  `json:"resolved_value,omitempty"`
+	Grouped       []string `json:"grouped,omitempty"`
+
+	Correlation     string    `json:"correlation,omitempty"`
+	CorrelatedSince time.Time `json:"correlated_since,omitempty"`
+}
+
+// Duration is the time the incident fired, until now if firing
+func (i Incident) Duration(now time.Time) time.Duration {
+	if i.End.IsZero() {
+		return now.Sub(i.Start)
+	}
+	return i.End.Sub(i.Start)
+}
+
+type incidentKey struct {
+	seriesKey
+	since time.Time
+}
+
+// Incidents pairs the firing and the resolved alerts into incidents, the latest first
+// an incident whose firing alert is no longer kept starts when the resolved alert says it fired
+func Incidents(alerts []Alert) []Incident {
+	incidents := make(map[incidentKey]*Incident)
+	grouped, correlating := make([]Alert, 0), make([]Alert, 0)
+	for _, a := range alerts {
+		if a.Parent != "" {
+			grouped = append(grouped, a)
+			continue
+		}
+		k := incidentKey{seriesKey{a.Username, a.Server, a.Location, a.Template, a.Rule}, a.Since}
+		i, ok := incidents[k]
+		if !ok {
+			i = &Incident{
+				Username: a.Username, Server: a.Server, Location: a.Location, Template: a.Template, Rule: a.Rule,
+				Labels: a.Labels, Severity: a.Severity, State: STATE_FIRING, Start: a.Since,
+			}
+			incidents[k] = i
+		}
+		if a.Correlation != "" {
+			i.Correlation, i.CorrelatedSince = a.Correlation, a.CorrelatedSince
+		}
+		if a.State == STATE_FIRING && len(a.Correlated) > 0 {
+			correlating = append(correlating, a)
+		}
+		if a.State == STATE_RESOLVED {
+			i.State, i.End, i.ResolvedValue = STATE_RESOLVED, a.At, a.Value
+		} else if !a.At.IsZero() {
+			// the alerts of Evaluator.Firing carry no sample
+			i.FiringValue = a.Value
+		}
+	}
+	ret := make([]Incident, 0, len(incidents))
+	for _, i := range incidents {
+		ret = append(ret, *i)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Start.After(ret[j].Start) })
+	// the servers fired before they were correlated are of the correlated incident as well
+	for _, a := range correlating {
+		for i := range ret {
+			inc := &ret[i]
+			if inc.Correlation == "" && inc.Username == a.Username && inc.Template == a.Template && inc.Rule == a.Rule && in(a.Correlated, inc.Server) &&
+				!inc.Start.After(a.At) && (inc.End.IsZero() || !inc.End.Before(a.At)) {
+				inc.Correlation, inc.CorrelatedSince = a.Correlation, a.CorrelatedSince
+			}
+		}
+	}
+	for _, a := range grouped {
+		if a.State != STATE_FIRING {
+			continue
+		}
+		// the earliest incident of the parent firing when the alert fired
+		for i := len(ret) - 1; i >= 0; i-- {
+			inc := &ret[i]
+			if inc.Username == a.Username && inc.Server == a.Parent && !a.Since.Before(inc.Start) && (inc.End.IsZero() || !a.Since.After(inc.End)) {
+				if !in(inc.Grouped, a.Server) {
+					inc.Grouped = append(inc.Grouped, a.Server)
+				}
+				break
+			}
+		}
+	}
+	return ret
+}
+
+// ExportAlerts writes the alerts as csv with a header, or as a json array
+func ExportAlerts(w io.Writer, format string, alerts []Alert) error {
+	if format == FORMAT_JSON {
+		return json.NewEncoder(w).Encode(alerts)
+	}
+	if format != FORMAT_CSV {
+		return fmt.Errorf("unknown format %v", format)
+	}
+	rows := [][]string{{"at", "username", "server", "location", "template", "rule", "severity", "state", "value", "time", "since", "parent", "labels"}}
+	for _, a := range alerts {
+		rows = append(rows, []string{
+			a.At.Format(time.RFC3339), a.Username, a.Server, a.Location, a.Template, a.Rule, a.Severity, a.State,
+			strconv.FormatFloat(a.Value, 'f', -1, 64), a.Time, a.Since.Format(time.RFC3339), a.Parent, formatLabels(a.Labels),
+		})
+	}
+	return writeCSV(w, rows)
+}
+
+// ExportIncidents writes the incidents as csv with a header, or as a json array
+// the durations of the csv are in seconds, until now if firing
+func ExportIncidents(w io.Writer, format string, incidents []Incident, now time.Time) error {
+	if format == FORMAT_JSON {
+		return json.NewEncoder(w).Encode(incidents)
+	}
+	if format != FORMAT_CSV {
+		return fmt.Errorf("unknown format %v", format)
+	}
+	rows := [][]string{{"start", "end", "duration", "username", "server", "location", "template", "rule", "severity", "state", "firing_value", "resolved_value", "grouped", "correlation", "labels"}}
+	for _, i := range incidents {
+		end := ""
+		if !i.End.IsZero() {
+			end = i.End.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{
+			i.Start.Format(time.RFC3339), end, strconv.FormatInt(int64(i.Duration(now).Seconds()), 10),
+			i.Username, i.Server, i.Location, i.Template, i.Rule, i.Severity, i.State,
+			strconv.FormatFloat(i.FiringValue, 'f', -1, 64), strconv.FormatFloat(i.ResolvedValue, 'f', -1, 64),
+			strings.Join(i.Grouped, ";"), i.Correlation, formatLabels(i.Labels),
+		})
+	}
+	return writeCSV(w, rows)
+}
+
+func writeCSV(w io.Writer, rows [][]string) error {
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+	return cw.Error()
+}
+
+// the labels sorted by key, like "env=prod;role=web"
+func formatLabels(labels map[string]string) string {
+	kvs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		kvs = append(kvs, k+"="+v)
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ";")
+}
@@ -0,0 +1,40 @@
+package alert
+
+import "sync"
+
+// History keeps the latest alerts in a ring buffer
+type History struct {
+	alerts []Alert
+	next   int
+	full   bool
+	mu     sync.RWMutex
+}
+
+func NewHistory(size int) *History { return &History{alerts: make([]Alert, size)} }
+
+func (h *History) Add(a Alert) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.alerts[h.next] = a
+	if h.next = (h.next + 1) % len(h.alerts); h.next == 0 {
+		h.full = true
+	}
+}
+
+// List returns the alerts of the user, the latest first, all users if username is empty
+func (h *History) List(username string) []Alert {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := h.next
+	if h.full {
+		n = len(h.alerts)
+	}
+	ret := make([]Alert, 0)
+	for i := 1; i <= n; i++ {
+		a := h.alerts[(h.next-i+len(h.alerts))%len(h.alerts)]
+		if username == "" || a.Username == username {
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
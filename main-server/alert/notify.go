@@ -0,0 +1,271 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/i18n"
+)
+
+const (
+	CHANNEL_WEBHOOK  = "webhook"
+	CHANNEL_TELEGRAM = "telegram"
+	CHANNEL_TEAMS    = "teams"
+	CHANNEL_DISCORD  = "discord"
+)
+
+const _NOTIFY_TIMEOUT = 10 * time.Second
+
+var (
+	notifiers  = make(map[string]func(config map[string]string) (Notifier, error))
+	httpClient = &http.Client{Timeout: _NOTIFY_TIMEOUT}
+)
+
+// Notifier sends the alert to a channel
+type Notifier interface {
+	Notify(a Alert) error
+}
+
+// RegisterNotifier registers the constructor of the notifiers of the channel type
+func RegisterNotifier(typ string, f func(config map[string]string) (Notifier, error)) error {
+	if _, ok := notifiers[typ]; ok {
+		return fmt.Errorf("notifier %v already exist", typ)
+	}
+	notifiers[typ] = f
+	return nil
+}
+
+// Channel is a named destination of the notifications of a user, configured by its type
+// it receives the alerts of the Severities, all alerts if empty but the sms channels receiving the critical ones
+// with a positive Digest the alerts not critical are batched into one message every Digest minutes, see Digester
+type Channel struct {
+	Name       string            `json:"name"`
+	Type       string            `json:"type"`
+	Config     map[string]string `json:"config,omitempty"`
+	Severities []string          `json:"severities,omitempty"`
+	Digest     int               `json:"digest,omitempty"`
+}
+
+func (c Channel) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("channel name can not be empty")
+	}
+	for _, severity := range c.Severities {
+		if _, ok := severities[severity]; !ok {
+			return fmt.Errorf("unknown severity %v of channel %v", severity, c.Name)
+		}
+	}
+	if c.Digest < 0 {
+		return fmt.Errorf("digest of channel %v can not be negative", c.Name)
+	}
+	_, err := c.notifier()
+	return err
+}
+
+func (c Channel) routes(severity string) bool {
+	if len(c.Severities) == 0 {
+		return c.Type != CHANNEL_SMS || severity == SEVERITY_CRITICAL
+	}
+	return in(c.Severities, severity)
+}
+
+func (c Channel) notifier() (Notifier, error) {
+	f, ok := notifiers[c.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown channel type %v", c.Type)
+	}
+	return f(c.Config)
+}
+
+// Dispatch sends the alert to the channels routing its severity and not muted by the schedule
+// returns channel name -> error of the channels failed
+func Dispatch(a Alert, channels []Channel, sched Schedule) map[string]error {
+	return dispatch(a, channels, sched, func(Channel) bool { return false })
+}
+
+// the alert is not sent to the channels batching it
+func dispatch(a Alert, channels []Channel, sched Schedule, batch func(c Channel) bool) map[string]error {
+	failed := make(map[string]error)
+	for _, c := range channels {
+		if !c.routes(a.Severity) || sched.Quiet(c.Name, a.Severity, a.At) || batch(c) {
+			continue
+		}
+		n, err := c.notifier()
+		if err == nil {
+			err = n.Notify(a)
+		}
+		if err != nil {
+			failed[c.Name] = err
+		}
+	}
+	return failed
+}
+
+func (a Alert) String() string {
+	if len(a.Correlated) > 0 {
+		return fmt.Sprintf("[%v] %v: %v of %v on %v servers of %v: %v", a.State, a.Severity, a.Rule, a.Template, len(a.Correlated), a.Correlation, strings.Join(a.Correlated, ", "))
+	}
+	return fmt.Sprintf("[%v] %v: %v of %v on %v from %v, value %v at %v", a.State, a.Severity, a.Rule, a.Template, a.Server, a.Location, a.Value, a.Time)
+}
+
+// Text is the alert in its locale, the text of the notifications to people rather than to the hooks
+func (a Alert) Text() string { return i18n.Localize(a.Locale, a.String()) }
+
+func postJSON(url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v responds %v", url, resp.Status)
+	}
+	return nil
+}
+
+// posts the alert as json to config url
+type webhookNotifier struct{ url string }
+
+func newWebhookNotifier(config map[string]string) (Notifier, error) {
+	if config["url"] == "" {
+		return nil, fmt.Errorf("url of webhook is required")
+	}
+	return webhookNotifier{config["url"]}, nil
+}
+
+func (w webhookNotifier) Notify(a Alert) error { return postJSON(w.url, a) }
+
+// a digest is posted as {"alerts": [...], "more": <the alerts not kept>}
+func (w webhookNotifier) NotifyDigest(alerts []Alert, more int) error {
+	return postJSON(w.url, struct {
+		Alerts []Alert `json:"alerts"`
+		More   int     `json:"more,omitempty"`
+	}{alerts, more})
+}
+
+// sends the alert by the bot of config token to config chat_id
+type telegramNotifier struct{ token, chatId string }
+
+func newTelegramNotifier(config map[string]string) (Notifier, error) {
+	if config["token"] == "" || config["chat_id"] == "" {
+		return nil, fmt.Errorf("token and chat_id of telegram are required")
+	}
+	return telegramNotifier{config["token"], config["chat_id"]}, nil
+}
+
+func (t telegramNotifier) Notify(a Alert) error { return t.send(a.Text()) }
+
+func (t telegramNotifier) NotifyDigest(alerts []Alert, more int) error {
+	return t.send(DigestText(alerts, more))
+}
+
+func (t telegramNotifier) send(text string) error {
+	return postJSON(fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", t.token), map[string]string{
+		"chat_id": t.chatId,
+		"text":    text,
+	})
+}
+
+// the style of the card of the alert, the resolved ones are good and the firing ones by their severity
+func style(a Alert) (teams string, discord int) {
+	switch {
+	case a.State == STATE_RESOLVED:
+		return "good", 0x2EB886
+	case a.Severity == SEVERITY_CRITICAL:
+		return "attention", 0xD40E0D
+	case a.Severity == SEVERITY_WARNING:
+		return "warning", 0xF2C744
+	}
+	return "accent", 0x439FE0
+}
+
+// posts the alert as an adaptive card to the incoming webhook of config url of a teams channel
+type teamsNotifier struct{ url string }
+
+func newTeamsNotifier(config map[string]string) (Notifier, error) {
+	if config["url"] == "" {
+		return nil, fmt.Errorf("url of teams is required")
+	}
+	return teamsNotifier{config["url"]}, nil
+}
+
+func (t teamsNotifier) Notify(a Alert) error {
+	color, _ := style(a)
+	return t.send(color, a.Text())
+}
+
+func (t teamsNotifier) NotifyDigest(alerts []Alert, more int) error {
+	color, _ := style(alerts[len(alerts)-1])
+	return t.send(color, DigestText(alerts, more))
+}
+
+func (t teamsNotifier) send(color, text string) error {
+	// the lines of a text block are separated by blank lines in markdown
+	text = strings.ReplaceAll(text, "\n", "\n\n")
+	return postJSON(t.url, map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]interface{}{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body":    []map[string]interface{}{{"type": "TextBlock", "text": text, "wrap": true, "color": color}},
+			},
+		}},
+	})
+}
+
+// the description of a discord embed is at most 4096 characters
+const _DISCORD_DESCRIPTION = 4096
+
+// posts the alert as an embed to the webhook of config url of a discord channel, as config username if set
+type discordNotifier struct{ url, username string }
+
+func newDiscordNotifier(config map[string]string) (Notifier, error) {
+	if config["url"] == "" {
+		return nil, fmt.Errorf("url of discord is required")
+	}
+	return discordNotifier{config["url"], config["username"]}, nil
+}
+
+func (d discordNotifier) Notify(a Alert) error {
+	_, color := style(a)
+	return d.send(color, a.Text(), a.At)
+}
+
+func (d discordNotifier) NotifyDigest(alerts []Alert, more int) error {
+	last := alerts[len(alerts)-1]
+	_, color := style(last)
+	return d.send(color, DigestText(alerts, more), last.At)
+}
+
+func (d discordNotifier) send(color int, text string, at time.Time) error {
+	if r := []rune(text); len(r) > _DISCORD_DESCRIPTION {
+		text = string(r[:_DISCORD_DESCRIPTION-1]) + "…"
+	}
+	embed := map[string]interface{}{"description": text, "color": color}
+	if !at.IsZero() {
+		embed["timestamp"] = at.UTC().Format(time.RFC3339)
+	}
+	msg := map[string]interface{}{"embeds": []map[string]interface{}{embed}}
+	if d.username != "" {
+		msg["username"] = d.username
+	}
+	return postJSON(d.url, msg)
+}
+
+func init() {
+	RegisterNotifier(CHANNEL_WEBHOOK, newWebhookNotifier)
+	RegisterNotifier(CHANNEL_TELEGRAM, newTelegramNotifier)
+	RegisterNotifier(CHANNEL_TEAMS, newTeamsNotifier)
+	RegisterNotifier(CHANNEL_DISCORD, newDiscordNotifier)
+}
@@ -0,0 +1,354 @@
+package alert
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Schedule(t *testing.T) {
+	sched := Schedule{
+		Timezone:   "Asia/Tokyo",
+		QuietHours: []QuietHours{{Start: "23:00", End: "07:00", Channels: []string{"telegram"}}},
+	}
+	if err := sched.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	// 15:00 UTC is 00:00 in Tokyo
+	midnight := time.Date(2015, 1, 1, 15, 0, 0, 0, time.UTC)
+	if !sched.Quiet("telegram", SEVERITY_WARNING, midnight) {
+		t.Error("telegram should be quiet at midnight in Tokyo")
+	}
+	if sched.Quiet("webhook", SEVERITY_WARNING, midnight) {
+		t.Error("webhook is not muted")
+	}
+	if sched.Quiet("telegram", SEVERITY_WARNING, midnight.Add(8*time.Hour)) {
+		t.Error("telegram should not be quiet at 08:00 in Tokyo")
+	}
+	sched.QuietHours[0].Except = []string{SEVERITY_CRITICAL}
+	if sched.Quiet("telegram", SEVERITY_CRITICAL, midnight) {
+		t.Error("critical alerts should not be muted")
+	}
+	for _, bad := range []Schedule{
+		{Timezone: "Mars/Olympus"},
+		{QuietHours: []QuietHours{{Start: "25:00", End: "07:00"}}},
+		{QuietHours: []QuietHours{{Start: "23:00", End: "07:00", Except: []string{"fatal"}}}},
+	} {
+		if bad.Validate() == nil {
+			t.Errorf("schedule %+v should be invalid", bad)
+		}
+	}
+}
+
+func Test_Dispatch(t *testing.T) {
+	got := make(chan Alert, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Alert
+		json.NewDecoder(r.Body).Decode(&a)
+		got <- a
+	}))
+	defer ts.Close()
+
+	channels := []Channel{{Name: "hook", Type: CHANNEL_WEBHOOK, Config: map[string]string{"url": ts.URL}}}
+	a := Alert{Username: "alice", Server: "google.com", Severity: SEVERITY_WARNING, State: STATE_FIRING, At: time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)}
+	if failed := Dispatch(a, channels, Schedule{}); len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	if b := <-got; b.Server != "google.com" {
+		t.Errorf("webhook got %+v", b)
+	}
+
+	quiet := Schedule{QuietHours: []QuietHours{{Start: "11:00", End: "13:00"}}}
+	if failed := Dispatch(a, channels, quiet); len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	select {
+	case b := <-got:
+		t.Errorf("should be quiet, webhook got %+v", b)
+	default:
+	}
+
+	channels[0].Severities = []string{SEVERITY_CRITICAL}
+	if failed := Dispatch(a, channels, Schedule{}); len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	select {
+	case b := <-got:
+		t.Errorf("should route critical alerts only, webhook got %+v", b)
+	default:
+	}
+
+	if (Channel{Name: "x", Type: CHANNEL_WEBHOOK}).Validate() == nil {
+		t.Error("webhook without url should be invalid")
+	}
+}
+
+func Test_Plugin(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.json")
+	script := "#!/bin/sh\ncat > " + out + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "pager.sh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "broken"), []byte("#!/bin/sh\necho oops >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a plugin"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	names, err := LoadPlugins(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("got plugins %v", names)
+	}
+
+	channels := []Channel{
+		{Name: "pager", Type: "pager", Config: map[string]string{"team": "ops"}},
+		{Name: "broken", Type: "broken"},
+	}
+	a := Alert{Username: "alice", Server: "google.com", Severity: SEVERITY_CRITICAL, State: STATE_FIRING}
+	failed := Dispatch(a, channels, Schedule{})
+	if err := failed["broken"]; err == nil || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("broken plugin should fail with its stderr, got %v", err)
+	}
+	if err := failed["pager"]; err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p pluginPayload
+	if err = json.Unmarshal(b, &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Alert.Server != "google.com" || p.Config["team"] != "ops" {
+		t.Errorf("plugin got %+v", p)
+	}
+}
+
+func Test_Text(t *testing.T) {
+	a := Alert{Server: "google.com", Location: "Tokyo", Template: "web", Rule: "slow", Severity: SEVERITY_CRITICAL, State: STATE_RESOLVED, Value: 300, Time: "12:00"}
+	if a.Text() != a.String() {
+		t.Errorf("want the text in english by default, got %v", a.Text())
+	}
+	a.Locale = "zh"
+	if got := a.Text(); got != "[已恢复] 严重：web 的规则 slow 在 google.com（来自 Tokyo），数值 300，时间 12:00" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func Test_Digest(t *testing.T) {
+	got := make(chan []byte, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got <- b
+	}))
+	defer ts.Close()
+
+	channels := []Channel{{Name: "hook", Type: CHANNEL_WEBHOOK, Config: map[string]string{"url": ts.URL}, Digest: 5}}
+	d := NewDigester()
+	start := time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i, server := range []string{"a.com", "b.com"} {
+		a := Alert{Username: "alice", Server: server, Severity: SEVERITY_WARNING, State: STATE_FIRING, At: start.Add(time.Duration(i) * time.Minute)}
+		if failed := d.Dispatch(a, channels, Schedule{}); len(failed) != 0 {
+			t.Fatal(failed)
+		}
+	}
+	// the critical alerts are sent at once
+	d.Dispatch(Alert{Username: "alice", Server: "c.com", Severity: SEVERITY_CRITICAL, State: STATE_FIRING, At: start}, channels, Schedule{})
+	var a Alert
+	if json.Unmarshal(<-got, &a); a.Server != "c.com" {
+		t.Errorf("webhook got %+v", a)
+	}
+	if pending := d.Pending("alice"); pending["hook"] != 2 {
+		t.Errorf("got %v", pending)
+	}
+
+	if failed := d.Flush(start.Add(4 * time.Minute)); len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	select {
+	case b := <-got:
+		t.Errorf("the digest is not due, webhook got %s", b)
+	default:
+	}
+	if failed := d.Flush(start.Add(5 * time.Minute)); len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	var digest struct{ Alerts []Alert }
+	if json.Unmarshal(<-got, &digest); len(digest.Alerts) != 2 || digest.Alerts[1].Server != "b.com" {
+		t.Errorf("webhook got %+v", digest)
+	}
+	if len(d.Pending("alice")) != 0 {
+		t.Error("the digest sent should not be pending")
+	}
+
+	channels[0].Config["url"] = "http://127.0.0.1:1"
+	d.Dispatch(Alert{Username: "alice", Server: "a.com", Severity: SEVERITY_INFO, State: STATE_RESOLVED, At: start}, channels, Schedule{})
+	if failed := d.FlushAll(); failed["alice"]["hook"] == nil {
+		t.Errorf("the digest should fail, got %v", failed)
+	}
+	// the alerts beyond the size of a digest are counted
+	channels[0].Config["url"] = ts.URL
+	for i := 0; i < _DIGEST_SIZE+3; i++ {
+		d.Dispatch(Alert{Username: "alice", Server: strconv.Itoa(i), Severity: SEVERITY_WARNING, State: STATE_FIRING, At: start}, channels, Schedule{})
+	}
+	if pending := d.Pending("alice"); pending["hook"] != _DIGEST_SIZE+3 {
+		t.Errorf("got %v", pending)
+	}
+	d.FlushAll()
+	var capped struct {
+		Alerts []Alert
+		More   int
+	}
+	if json.Unmarshal(<-got, &capped); len(capped.Alerts) != _DIGEST_SIZE || capped.More != 3 || capped.Alerts[0].Server != "0" {
+		t.Errorf("webhook got %v alerts and %v more", len(capped.Alerts), capped.More)
+	}
+	if (Channel{Name: "x", Type: CHANNEL_WEBHOOK, Config: map[string]string{"url": ts.URL}, Digest: -1}).Validate() == nil {
+		t.Error("negative digest should be invalid")
+	}
+
+	alerts := make([]Alert, _DIGEST_LINES+2)
+	for i := range alerts {
+		alerts[i] = Alert{Server: "google.com", Location: "Tokyo", Template: "web", Rule: "slow", Severity: SEVERITY_WARNING, State: STATE_FIRING, Value: 300, Time: "12:00", Locale: "zh"}
+	}
+	lines := strings.Split(DigestText(alerts, 0), "\n")
+	if len(lines) != _DIGEST_LINES+2 || lines[0] != "52 条告警摘要" || lines[len(lines)-1] != "另有 2 条" {
+		t.Errorf("got %v lines, %v ... %v", len(lines), lines[0], lines[len(lines)-1])
+	}
+	lines = strings.Split(DigestText(alerts[:1], 3), "\n")
+	if len(lines) != 3 || lines[0] != "4 条告警摘要" || lines[2] != "另有 3 条" {
+		t.Errorf("got %v", lines)
+	}
+}
+
+func Test_ChatNotifiers(t *testing.T) {
+	got := make(chan map[string]interface{}, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&msg)
+		got <- msg
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer ts.Close()
+
+	channels := []Channel{
+		{Name: "teams", Type: CHANNEL_TEAMS, Config: map[string]string{"url": ts.URL}},
+		{Name: "discord", Type: CHANNEL_DISCORD, Config: map[string]string{"url": ts.URL, "username": "watchdog"}, Severities: []string{SEVERITY_CRITICAL}},
+	}
+	a := Alert{Server: "google.com", Location: "Tokyo", Template: "web", Rule: "down", Severity: SEVERITY_CRITICAL, State: STATE_FIRING, Time: "12:00", At: time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)}
+	if failed := Dispatch(a, channels, Schedule{}); len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	for i := 0; i < 2; i++ {
+		msg := <-got
+		if attachments, ok := msg["attachments"].([]interface{}); ok {
+			card := attachments[0].(map[string]interface{})["content"].(map[string]interface{})
+			block := card["body"].([]interface{})[0].(map[string]interface{})
+			if block["text"] != a.Text() || block["color"] != "attention" {
+				t.Errorf("teams got %v", block)
+			}
+			continue
+		}
+		embed := msg["embeds"].([]interface{})[0].(map[string]interface{})
+		if embed["description"] != a.Text() || embed["color"] != float64(0xD40E0D) || embed["timestamp"] != "2015-01-01T12:00:00Z" || msg["username"] != "watchdog" {
+			t.Errorf("discord got %v", msg)
+		}
+	}
+
+	a.Severity = SEVERITY_WARNING
+	if failed := Dispatch(a, channels, Schedule{}); len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	if msg := <-got; msg["attachments"] == nil {
+		t.Errorf("only teams should receive the warning, got %v", msg)
+	}
+	select {
+	case msg := <-got:
+		t.Errorf("discord should route critical alerts only, got %v", msg)
+	default:
+	}
+
+	alerts := []Alert{a, a}
+	if err := (discordNotifier{url: ts.URL}).NotifyDigest(alerts, 0); err != nil {
+		t.Fatal(err)
+	}
+	if embed := (<-got)["embeds"].([]interface{})[0].(map[string]interface{}); embed["description"] != DigestText(alerts, 0) || embed["color"] != float64(0xF2C744) {
+		t.Errorf("discord got %v", embed)
+	}
+	for _, typ := range []string{CHANNEL_TEAMS, CHANNEL_DISCORD} {
+		if (Channel{Name: "x", Type: typ}).Validate() == nil {
+			t.Errorf("%v without url should be invalid", typ)
+		}
+	}
+}
+
+type fakeSMS map[string][]string
+
+func (f fakeSMS) SendSMS(to, text string) error {
+	f[to] = append(f[to], text)
+	return nil
+}
+
+func Test_SMS(t *testing.T) {
+	for phone, want := range map[string]string{"+1 (415) 555-2671": "+14155552671", "+81.3.1234.5678": "+81312345678", "4155552671": "", "+0123456789": "", "+1415555267a": ""} {
+		if got, err := NormalizePhone(phone); got != want || (err == nil) != (want != "") {
+			t.Errorf("%v: want %v, got %v, %v", phone, want, got, err)
+		}
+	}
+	SetSMSGateway(nil)
+	channels := []Channel{{Name: "phone", Type: CHANNEL_SMS, Config: map[string]string{"phone": "+14155552671"}}}
+	if channels[0].Validate() == nil {
+		t.Error("an sms channel should be invalid without a gateway")
+	}
+	sent := make(fakeSMS)
+	SetSMSGateway(sent)
+	defer SetSMSGateway(nil)
+	if err := channels[0].Validate(); err != nil {
+		t.Fatal(err)
+	}
+	a := Alert{Server: "google.com", Location: "Tokyo", Template: "web", Rule: "slow", Severity: SEVERITY_WARNING, State: STATE_FIRING, Time: "12:00"}
+	Dispatch(a, channels, Schedule{})
+	if len(sent) != 0 {
+		t.Errorf("an sms channel without severities should receive the critical alerts only, got %v", sent)
+	}
+	a.Severity = SEVERITY_CRITICAL
+	if failed := Dispatch(a, channels, Schedule{}); len(failed) != 0 {
+		t.Fatal(failed)
+	}
+	channels[0].Severities = []string{SEVERITY_WARNING}
+	a.Severity = SEVERITY_WARNING
+	Dispatch(a, channels, Schedule{})
+	if texts := sent["+14155552671"]; len(texts) != 2 || texts[1] != a.Text() {
+		t.Errorf("got %v", sent)
+	}
+
+	got := make(chan *http.Request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		got <- r
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+	twilio := NewTwilioGateway("AC1", "secret", "+15005550006")
+	twilio.URL = ts.URL
+	if err := twilio.SendSMS("+14155552671", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	r := <-got
+	if user, pass, _ := r.BasicAuth(); user != "AC1" || pass != "secret" || r.URL.Path != "/2010-04-01/Accounts/AC1/Messages.json" {
+		t.Errorf("got %v %v:%v", r.URL.Path, user, pass)
+	}
+	if r.PostForm.Get("To") != "+14155552671" || r.PostForm.Get("From") != "+15005550006" || r.PostForm.Get("Body") != "hello" {
+		t.Errorf("got %v", r.PostForm)
+	}
+}
@@ -0,0 +1,83 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// the payload written to the stdin of a plugin
+// a digest is written once with its Alerts, Alert is the latest of them
+type pluginPayload struct {
+	Alert  Alert   `json:"alert"`
+	Alerts []Alert `json:"alerts,omitempty"`
+	// the alerts of the digest not kept
+	More   int               `json:"more,omitempty"`
+	Config map[string]string `json:"config,omitempty"`
+}
+
+// RegisterPlugin registers the executable at path as the notifier of the channel type name
+// the plugin is run for every alert with the alert and the channel config as json on stdin, it fails by a non zero exit status
+func RegisterPlugin(name, path string) error {
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid plugin name %v", name)
+	}
+	return RegisterNotifier(name, func(config map[string]string) (Notifier, error) {
+		return pluginNotifier{path: path, config: config}, nil
+	})
+}
+
+// LoadPlugins registers the executables in dir as notifiers, named after the file name without extension
+// returns the channel types registered
+func LoadPlugins(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() || file.Mode().Perm()&0111 == 0 {
+			continue
+		}
+		name := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+		if err = RegisterPlugin(name, filepath.Join(dir, file.Name())); err != nil {
+			return names, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+type pluginNotifier struct {
+	path   string
+	config map[string]string
+}
+
+func (p pluginNotifier) Notify(a Alert) error {
+	return p.run(pluginPayload{Alert: a, Config: p.config})
+}
+
+func (p pluginNotifier) NotifyDigest(alerts []Alert, more int) error {
+	return p.run(pluginPayload{Alert: alerts[len(alerts)-1], Alerts: alerts, More: more, Config: p.config})
+}
+
+func (p pluginNotifier) run(payload pluginPayload) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), _NOTIFY_TIMEOUT)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, p.path)
+	cmd.Stdin, cmd.Stderr = bytes.NewReader(b), &stderr
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("plugin %v: %v: %v", filepath.Base(p.path), err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
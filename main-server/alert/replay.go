@@ -0,0 +1,23 @@
+package alert
+
+import "sort"
+
+const _DRY_RUN_TEMPLATE = "dry-run"
+
+// Replay evaluates the rule on the samples of every location in order, as if they were received,
+// and returns the alerts the rule would have fired or resolved, the earliest first
+func Replay(server string, labels map[string]string, r Rule, samples map[string][]Sample) ([]Alert, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	e := NewEvaluator()
+	subjects := []Subject{{Labels: labels, Templates: []Template{{Name: _DRY_RUN_TEMPLATE, Rules: []Rule{r}}}}}
+	alerts := make([]Alert, 0)
+	for location, ss := range samples {
+		for _, s := range ss {
+			alerts = append(alerts, e.Evaluate(server, location, subjects, s)...)
+		}
+	}
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].At.Before(alerts[j].At) })
+	return alerts, nil
+}
@@ -0,0 +1,78 @@
+package alert
+
+import (
+	"fmt"
+	"time"
+)
+
+const _CLOCK_LAYOUT = "15:04"
+
+// QuietHours mutes the channels between Start and End of every day, like "23:00" to "07:00"
+// an End earlier than Start spans midnight, empty Channels mutes all channels
+// the alerts of the Except severities, like "critical", are never muted
+type QuietHours struct {
+	Start    string   `json:"start"`
+	End      string   `json:"end"`
+	Channels []string `json:"channels,omitempty"`
+	Except   []string `json:"except,omitempty"`
+}
+
+// Schedule is the notification schedule of a user, the quiet hours are in the timezone, UTC if empty
+type Schedule struct {
+	Timezone   string       `json:"timezone,omitempty"`
+	QuietHours []QuietHours `json:"quiet_hours,omitempty"`
+}
+
+func (s Schedule) Validate() error {
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %v: %v", s.Timezone, err)
+	}
+	for _, q := range s.QuietHours {
+		for _, clock := range []string{q.Start, q.End} {
+			if _, err := time.Parse(_CLOCK_LAYOUT, clock); err != nil {
+				return fmt.Errorf("invalid time %q of quiet hours, should be like 23:00", clock)
+			}
+		}
+		for _, severity := range q.Except {
+			if _, ok := severities[severity]; !ok {
+				return fmt.Errorf("unknown severity %v", severity)
+			}
+		}
+	}
+	return nil
+}
+
+// Quiet returns true if the channel is muted for the alert of the severity at t
+func (s Schedule) Quiet(channel, severity string, t time.Time) bool {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	now := t.In(loc).Format(_CLOCK_LAYOUT)
+	for _, q := range s.QuietHours {
+		if !q.mutes(channel, severity) {
+			continue
+		}
+		// the clocks compare as strings
+		if q.Start <= q.End && now >= q.Start && now < q.End {
+			return true
+		}
+		if q.Start > q.End && (now >= q.Start || now < q.End) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q QuietHours) mutes(channel, severity string) bool {
+	return !in(q.Except, severity) && (len(q.Channels) == 0 || in(q.Channels, channel))
+}
+
+func in(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
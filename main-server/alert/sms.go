@@ -0,0 +1,124 @@
+package alert
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const CHANNEL_SMS = "sms"
+
+// the api of twilio, see TwilioGateway
+const TWILIO_API = "https://api.twilio.com"
+
+// a text message longer is rejected by twilio
+const _SMS_MAX = 1600
+
+// SMSGateway sends the text messages of the sms channels and of the phone verification
+type SMSGateway interface {
+	SendSMS(to, text string) error
+}
+
+var (
+	smsMu      sync.RWMutex
+	smsGateway SMSGateway
+)
+
+// SetSMSGateway sets the gateway of the sms channels, there are none without it
+func SetSMSGateway(g SMSGateway) {
+	smsMu.Lock()
+	defer smsMu.Unlock()
+	smsGateway = g
+}
+
+// SMSConfigured returns true if the gateway was set
+func SMSConfigured() bool {
+	smsMu.RLock()
+	defer smsMu.RUnlock()
+	return smsGateway != nil
+}
+
+// SendSMS sends the text to the phone by the gateway set
+func SendSMS(phone, text string) error {
+	smsMu.RLock()
+	g := smsGateway
+	smsMu.RUnlock()
+	if g == nil {
+		return fmt.Errorf("sms gateway is not configured")
+	}
+	if r := []rune(text); len(r) > _SMS_MAX {
+		text = string(r[:_SMS_MAX-1]) + "…"
+	}
+	return g.SendSMS(phone, text)
+}
+
+// NormalizePhone returns the phone in the E.164 format, like +14155552671, without the spaces, dots, dashes and parentheses
+func NormalizePhone(phone string) (string, error) {
+	p := strings.NewReplacer(" ", "", ".", "", "-", "", "(", "", ")", "").Replace(phone)
+	if !strings.HasPrefix(p, "+") || len(p) < 9 || len(p) > 16 || p[1] == '0' {
+		return "", fmt.Errorf("phone %v should be in the international format like +14155552671", phone)
+	}
+	for _, c := range p[1:] {
+		if c < '0' || c > '9' {
+			return "", fmt.Errorf("phone %v should be in the international format like +14155552671", phone)
+		}
+	}
+	return p, nil
+}
+
+// TwilioGateway sends the text messages from the number From of the twilio account
+type TwilioGateway struct {
+	AccountSid, AuthToken, From string
+	// TWILIO_API by default
+	URL string
+}
+
+func NewTwilioGateway(accountSid, authToken, from string) *TwilioGateway {
+	return &TwilioGateway{AccountSid: accountSid, AuthToken: authToken, From: from, URL: TWILIO_API}
+}
+
+func (t *TwilioGateway) SendSMS(to, text string) error {
+	form := url.Values{"To": {to}, "From": {t.From}, "Body": {text}}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", t.URL, t.AccountSid), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(t.AccountSid, t.AuthToken)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("twilio responds %v", resp.Status)
+	}
+	return nil
+}
+
+// sends the alert by the sms gateway to config phone, which the user verified, see store.Store.SetNotificationChannel
+// an sms channel without severities receives the critical alerts only
+type smsNotifier struct{ phone string }
+
+func newSMSNotifier(config map[string]string) (Notifier, error) {
+	phone, err := NormalizePhone(config["phone"])
+	if err != nil {
+		return nil, err
+	}
+	if !SMSConfigured() {
+		return nil, fmt.Errorf("sms gateway is not configured")
+	}
+	return smsNotifier{phone}, nil
+}
+
+func (s smsNotifier) Notify(a Alert) error { return SendSMS(s.phone, a.Text()) }
+
+func (s smsNotifier) NotifyDigest(alerts []Alert, more int) error {
+	return SendSMS(s.phone, DigestText(alerts, more))
+}
+
+func init() {
+	RegisterNotifier(CHANNEL_SMS, newSMSNotifier)
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+const _ALERT_HISTORY_SIZE = 1 << 12
+
+// the digests due are sent on the interval, a digest is late by it at most
+const _DIGEST_INTERVAL = 15 * time.Second
+
+// the alerts held for correlation are released on the interval once their window ends
+const _RELEASE_INTERVAL = 15 * time.Second
+
+var (
+	evaluator    = alert.NewEvaluator()
+	alertHistory = alert.NewHistory(_ALERT_HISTORY_SIZE)
+	digester     = alert.NewDigester()
+)
+
+// the ping results are evaluated where they are pinged, by the leader or the owner of the server
+// register the notification plugins, channels of their types run them with the alert as json on stdin
+func initNotifyPlugins() {
+	if *flagNotifyPlugins == "" {
+		return
+	}
+	names, err := alert.LoadPlugins(*flagNotifyPlugins)
+	if err != nil {
+		panic(fmt.Errorf("can not load notification plugins: %v", err))
+	}
+	logger.With("dir", *flagNotifyPlugins).Info("notification plugins loaded: %v", names)
+}
+
+// the sms channels and the phone verification send the text messages by twilio
+func initSMS() {
+	if *flagTwilioSid == "" {
+		return
+	}
+	alert.SetSMSGateway(alert.NewTwilioGateway(*flagTwilioSid, *flagTwilioToken, *flagTwilioFrom))
+	logger.With("from", *flagTwilioFrom).Info("sms gateway of twilio configured")
+}
+
+// send the digests of the channels in digest mode when they are due
+func initDigests() {
+	go func() {
+		for now := range time.Tick(_DIGEST_INTERVAL) {
+			flushDigests(digester.Flush(now))
+		}
+	}()
+}
+
+func flushDigests(failed map[string]map[string]error) {
+	for username, channels := range failed {
+		for channel, err := range channels {
+			logger.With("username", username).Warn("can not send digest to channel %v: %v", channel, err)
+		}
+	}
+}
+
+// notify the alerts held whose servers were not correlated within the window, one by one
+func initCorrelations() {
+	go func() {
+		for now := range time.Tick(_RELEASE_INTERVAL) {
+			releaseAlerts(now)
+		}
+	}()
+}
+
+func releaseAlerts(now time.Time) {
+	for _, a := range evaluator.Release(now) {
+		var sub alert.Subject
+		for _, s := range storeEngine.AlertSubjects(a.Server) {
+			if s.Username == a.Username {
+				sub = s
+			}
+		}
+		if a.Locale = sub.Locale; a.Locale == "" {
+			a.Locale = *flagLocale
+		}
+		l := logger.With("username", a.Username, "server", a.Server, "location", a.Location, "template", a.Template, "rule", a.Rule, "severity", a.Severity)
+		l.Warn("alert firing since %v, not correlated within the window, value %v at %v", a.Since, a.Value, a.Time)
+		send(a, sub, l)
+	}
+}
+
+func evaluateAlerts(server, location string, s alert.Sample) {
+	// evaluated even without subjects, dropping the state of the rules gone
+	subjects := storeEngine.AlertSubjects(server)
+	users := make(map[string]alert.Subject, len(subjects))
+	for _, sub := range subjects {
+		users[sub.Username] = sub
+	}
+	for _, a := range evaluator.Evaluate(server, location, subjects, s) {
+		notify(a, users[a.Username])
+	}
+}
+
+func notify(a alert.Alert, sub alert.Subject) {
+	if a.Locale = sub.Locale; a.Locale == "" {
+		a.Locale = *flagLocale
+	}
+	alertHistory.Add(a)
+	l := logger.With("username", a.Username, "server", a.Server, "location", a.Location, "template", a.Template, "rule", a.Rule, "severity", a.Severity)
+	// one page for the incident of the parent rather than one for every server behind it
+	if a.Parent != "" {
+		l.Info("alert %v, grouped into the incident of %v", a.State, a.Parent)
+		return
+	}
+	// and one for the servers correlated
+	if a.Correlation != "" && len(a.Correlated) == 0 {
+		l.Info("alert %v, grouped into the correlated incident of %v since %v", a.State, a.Correlation, a.CorrelatedSince)
+		return
+	}
+	// until the servers are correlated, or the window ends, see releaseAlerts
+	if a.Held {
+		l.Info("alert %v, held for correlation", a.State)
+		return
+	}
+	if a.State == alert.STATE_FIRING {
+		l.Warn("alert firing, value %v at %v", a.Value, a.Time)
+	} else {
+		l.Info("alert resolved, value %v at %v", a.Value, a.Time)
+	}
+	send(a, sub, l)
+}
+
+// post the alert to the inbox and notify the channels of the user
+func send(a alert.Alert, sub alert.Subject, l *structLogger) {
+	// the channels are slow external services, do not block the ping loop
+	go func() {
+		postAlert(a)
+		if len(sub.Channels) == 0 {
+			return
+		}
+		for channel, err := range digester.Dispatch(a, sub.Channels, sub.Schedule) {
+			l.Warn("can not notify channel %v: %v", channel, err)
+		}
+	}()
+}
+
+// update session life
+func (mainServerStub) SetServerLabels(sid, username, server string, labels map[string]string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.SetServerLabels(requestContext(ctx), username, server, labels); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// add or replace the alert template of the name, it applies to every server of the user with the labels of its selector
+// update session life
+func (mainServerStub) SetAlertTemplate(sid, username string, t alert.Template, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.SetAlertTemplate(requestContext(ctx), username, t); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// update session life
+func (mainServerStub) DeleteAlertTemplate(sid, username, name string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.DeleteAlertTemplate(requestContext(ctx), username, name); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// declare the server sits behind the parent, like a router, the alerts of the server are not notified while the parent is firing
+// empty parent removes the dependency
+// update session life
+func (mainServerStub) SetServerDependency(sid, username, server, parent string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.SetServerDependency(requestContext(ctx), username, server, parent); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// add or replace the notification channel of the name, like {"name": "phone", "type": "telegram", "config": {"token": "...", "chat_id": "..."}}
+// update session life
+func (mainServerStub) SetNotificationChannel(sid, username string, c alert.Channel, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.SetNotificationChannel(requestContext(ctx), username, c); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// update session life
+func (mainServerStub) DeleteNotificationChannel(sid, username, name string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.DeleteNotificationChannel(requestContext(ctx), username, name); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// set the quiet hours of the channels in the timezone of the user
+// update session life
+func (mainServerStub) SetNotificationSchedule(sid, username string, sched alert.Schedule, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.SetNotificationSchedule(requestContext(ctx), username, sched); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// correlate the alerts of a rule on the servers sharing the value of a label, like provider=hetzner, into one incident
+// like {"labels": ["provider"], "window": 5, "min": 3}, nil stops correlating them
+// update session life
+func (mainServerStub) SetAlertCorrelation(sid, username string, c *alert.Correlation, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.SetAlertCorrelation(requestContext(ctx), username, c); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get the correlated incidents of the user open now, the earliest first
+func (mainServerStub) GetCorrelations(sid, username string) (correlations []alert.Correlated, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			correlations = evaluator.Correlations(username)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// replay the ping results of the server between from and to, formatted as "06-01-02 15:04", through the candidate rule
+// returns the alerts the rule would have fired or resolved, to tune the threshold without waiting for an incident
+func (mainServerStub) DryRunAlertRule(sid, username, server string, r alert.Rule, from, to string) (alerts []alert.Alert, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			var ret map[string][]store.PingRet
+			if ret, err = storeEngine.GetMonitorResult(username, server); err != nil {
+				return
+			}
+			samples := make(map[string][]alert.Sample, len(ret))
+			for location, prs := range ret {
+				for _, pr := range prs {
+					if pr.Time >= from && (to == "" || pr.Time <= to) {
+						samples[location] = append(samples[location], sampleOf(pr))
+					}
+				}
+			}
+			if alerts, err = alert.Replay(server, storeEngine.GetServerLabels(username, server), r, samples); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// the padded ping results are down
+func sampleOf(pr store.PingRet) alert.Sample {
+	ping, _ := strconv.ParseFloat(pr.Ping, 64)
+	at, _ := time.ParseInLocation(_TIME_LAYOUT, pr.Time, time.Local)
+	loss, ok := pr.LossPercent()
+	if !ok {
+		loss = -1
+	}
+	return alert.Sample{Time: pr.Time, Ping: ping, Down: ping == 0, Loss: loss, MTU: pr.MTU, At: at}
+}
+
+// get the recent alerts of the user, the latest first, and the alerts firing now
+func (mainServerStub) GetAlerts(sid, username string) (recent, firing []alert.Alert, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			recent, firing = alertHistory.List(username), evaluator.Firing(username)
+			signedIn = true
+		}
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+// a line of the backup, either a user or a series of ping results
+type backupLine struct {
+	Username string          `json:"username,omitempty"`
+	User     *store.User     `json:"user,omitempty"`
+	Server   string          `json:"server,omitempty"`
+	Location string          `json:"location,omitempty"`
+	PingRets json.RawMessage `json:"ping_rets,omitempty"`
+}
+
+// streams a view of the store as json lines, the view is taken at once so the backup is consistent
+// while ingestion goes on during the long running encoding
+func backupHandler(w http.ResponseWriter, r *http.Request) {
+	v := storeEngine.View()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, username := range v.Usernames() {
+		u, _ := v.User(username)
+		if err := enc.Encode(backupLine{Username: username, User: u}); err != nil {
+			logger.Warn("can not write backup: %v", err)
+			return
+		}
+	}
+	// encoded from the series in memory, without decoding them to the ping results
+	v.RangeJSON(func(server, location string, prs []byte) bool {
+		if err := enc.Encode(backupLine{Server: server, Location: location, PingRets: prs}); err != nil {
+			logger.Warn("can not write backup: %v", err)
+			return false
+		}
+		return r.Context().Err() == nil
+	})
+}
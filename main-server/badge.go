@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/badge"
+)
+
+const (
+	_BADGE_PATH = "/badge"
+
+	_BADGE_METRIC_UPTIME  = "uptime"
+	_BADGE_METRIC_LATENCY = "latency"
+
+	_DEFAULT_BADGE_DAYS = 7
+	_MAX_BADGE_DAYS     = 90
+	_MAX_BADGE_LABEL    = 32
+	// camo of github and the like cache the badges at most this long
+	_BADGE_MAX_AGE = 5 * time.Minute
+)
+
+// GET /badge?token=<share token>[&metric=uptime|latency][&days=7][&label=<label>], the svg badge of the shared server
+// like "uptime 7d | 99.95%" of the last days including today, or "latency | 42 ms" of the latest ping results
+// a badge is served even if the token is invalid so that the embedding readme shows why
+func badgeHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	metric := q.Get("metric")
+	if metric == "" {
+		metric = _BADGE_METRIC_UPTIME
+	}
+	days := _DEFAULT_BADGE_DAYS
+	if d := q.Get("days"); d != "" {
+		var err error
+		if days, err = strconv.Atoi(d); err != nil || days <= 0 || days > _MAX_BADGE_DAYS {
+			http.Error(w, fmt.Sprintf("days should be between 1 and %v", _MAX_BADGE_DAYS), http.StatusBadRequest)
+			return
+		}
+	}
+	var label string
+	switch metric {
+	case _BADGE_METRIC_UPTIME:
+		label = fmt.Sprintf("uptime %vd", days)
+	case _BADGE_METRIC_LATENCY:
+		label = "latency"
+	default:
+		http.Error(w, fmt.Sprintf("unknown metric %v", metric), http.StatusBadRequest)
+		return
+	}
+	if l := q.Get("label"); l != "" {
+		if len([]rune(l)) > _MAX_BADGE_LABEL {
+			http.Error(w, fmt.Sprintf("label should be at most %v characters", _MAX_BADGE_LABEL), http.StatusBadRequest)
+			return
+		}
+		label = l
+	}
+
+	serve := func(code int, message, color string) {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(_BADGE_MAX_AGE.Seconds())))
+		w.WriteHeader(code)
+		w.Write(badge.Render(label, message, color))
+	}
+	username, server, err := shareSigner.Verify(q.Get("token"))
+	if err != nil {
+		serve(http.StatusForbidden, "invalid token", badge.COLOR_LIGHTGREY)
+		return
+	}
+	countRequest(username)
+	if metric == _BADGE_METRIC_LATENCY {
+		ms, err := latestLatency(username, server)
+		if err != nil {
+			serve(http.StatusNotFound, "unknown", badge.COLOR_LIGHTGREY)
+		} else if ms <= 0 {
+			serve(http.StatusOK, "down", badge.LatencyColor(ms))
+		} else {
+			serve(http.StatusOK, fmt.Sprintf("%.0f ms", ms), badge.LatencyColor(ms))
+		}
+		return
+	}
+	from := time.Now().AddDate(0, 0, 1-days).Format(_TIME_LAYOUT)
+	uptime, samples, err := storeEngine.GetUptime(username, server, from)
+	switch {
+	case err != nil:
+		serve(http.StatusNotFound, "unknown", badge.COLOR_LIGHTGREY)
+	case samples == 0:
+		serve(http.StatusOK, "no data", badge.UptimeColor(uptime, samples))
+	default:
+		serve(http.StatusOK, formatUptime(uptime), badge.UptimeColor(uptime, samples))
+	}
+}
+
+// the average latency of the locations whose latest ping result is up, 0 if every location is down
+func latestLatency(username, server string) (float64, error) {
+	overviews, err := storeEngine.GetOverview(username, 1)
+	if err != nil {
+		return 0, err
+	}
+	o, ok := overviews[server]
+	if !ok {
+		return 0, fmt.Errorf("server %v not exist", server)
+	}
+	var sum float64
+	n := 0
+	for _, pr := range o.Latest() {
+		if ping, err := strconv.ParseFloat(pr.Ping, 64); err == nil && ping > 0 {
+			sum += ping
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return sum / float64(n), nil
+}
+
+// 100% only if every ping result is up, never rounded up to it
+func formatUptime(uptime float64) string {
+	if uptime >= 1 {
+		return "100%"
+	}
+	s := strconv.FormatFloat(uptime*100, 'f', 2, 64)
+	if s == "100.00" {
+		s = "99.99"
+	}
+	return s + "%"
+}
+
+func initBadge() {
+	mainMux.Handle(_BADGE_PATH, instrument("badge", http.HandlerFunc(badgeHandler)))
+}
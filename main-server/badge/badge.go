@@ -0,0 +1,84 @@
+// Package badge renders the flat svg badges of shields.io, like "uptime 7d | 99.95%", embedded in the readmes of the projects
+package badge
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+)
+
+const (
+	COLOR_BRIGHTGREEN = "#4c1"
+	COLOR_GREEN       = "#97ca00"
+	COLOR_YELLOW      = "#dfb317"
+	COLOR_ORANGE      = "#fe7d37"
+	COLOR_RED         = "#e05d44"
+	COLOR_LIGHTGREY   = "#9f9f9f"
+)
+
+// the label is grey
+const _LABEL_COLOR = "#555"
+
+// the width of a character of 11px verdana, the average rather than the exact glyphs
+const (
+	_CHAR_WIDTH = 7
+	_PADDING    = 10
+)
+
+// Render returns the svg of the badge of the label and the message on the color
+func Render(label, message, color string) []byte {
+	lw, mw := width(label), width(message)
+	label, message = html.EscapeString(label), html.EscapeString(message)
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">`, lw+mw, label, message)
+	fmt.Fprintf(&b, `<title>%s: %s</title>`, label, message)
+	b.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	fmt.Fprintf(&b, `<clipPath id="r"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath>`, lw+mw)
+	fmt.Fprintf(&b, `<g clip-path="url(#r)"><rect width="%d" height="20" fill="%s"/><rect x="%d" width="%d" height="20" fill="%s"/><rect width="%d" height="20" fill="url(#s)"/></g>`,
+		lw, _LABEL_COLOR, lw, mw, html.EscapeString(color), lw+mw)
+	b.WriteString(`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`)
+	for _, t := range []struct {
+		x    int
+		text string
+	}{{lw / 2, label}, {lw + mw/2, message}} {
+		fmt.Fprintf(&b, `<text x="%d" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%d" y="14">%s</text>`, t.x, t.text, t.x, t.text)
+	}
+	b.WriteString(`</g></svg>`)
+	return b.Bytes()
+}
+
+func width(s string) int { return len([]rune(s))*_CHAR_WIDTH + _PADDING }
+
+// UptimeColor returns the color of the uptime ratio, lightgrey if there is no sample
+func UptimeColor(ratio float64, samples int64) string {
+	switch {
+	case samples == 0:
+		return COLOR_LIGHTGREY
+	case ratio >= 0.999:
+		return COLOR_BRIGHTGREEN
+	case ratio >= 0.99:
+		return COLOR_GREEN
+	case ratio >= 0.95:
+		return COLOR_YELLOW
+	case ratio >= 0.9:
+		return COLOR_ORANGE
+	}
+	return COLOR_RED
+}
+
+// LatencyColor returns the color of the latency in milliseconds, red if the server is down, 0
+func LatencyColor(ms float64) string {
+	switch {
+	case ms <= 0:
+		return COLOR_RED
+	case ms < 100:
+		return COLOR_BRIGHTGREEN
+	case ms < 200:
+		return COLOR_GREEN
+	case ms < 500:
+		return COLOR_YELLOW
+	case ms < 1000:
+		return COLOR_ORANGE
+	}
+	return COLOR_RED
+}
@@ -0,0 +1,40 @@
+package badge
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func Test_Render(t *testing.T) {
+	svg := Render("uptime 7d", "<99.95%>", COLOR_GREEN)
+	var v struct {
+		XMLName xml.Name
+		Width   int    `xml:"width,attr"`
+		Title   string `xml:"title"`
+	}
+	if err := xml.Unmarshal(svg, &v); err != nil {
+		t.Fatalf("invalid svg %s: %v", svg, err)
+	}
+	if v.XMLName.Local != "svg" || v.Title != "uptime 7d: <99.95%>" || v.Width != width("uptime 7d")+width("<99.95%>") {
+		t.Errorf("got %+v", v)
+	}
+	if !strings.Contains(string(svg), `fill="#97ca00"`) {
+		t.Errorf("want the message on the color, got %s", svg)
+	}
+}
+
+func Test_Colors(t *testing.T) {
+	for _, c := range []struct {
+		ratio   float64
+		samples int64
+		want    string
+	}{{1, 0, COLOR_LIGHTGREY}, {0.9995, 10, COLOR_BRIGHTGREEN}, {0.995, 10, COLOR_GREEN}, {0.96, 10, COLOR_YELLOW}, {0.5, 10, COLOR_RED}} {
+		if got := UptimeColor(c.ratio, c.samples); got != c.want {
+			t.Errorf("uptime %v of %v samples, got %v, want %v", c.ratio, c.samples, got, c.want)
+		}
+	}
+	if LatencyColor(0) != COLOR_RED || LatencyColor(50) != COLOR_BRIGHTGREEN || LatencyColor(600) != COLOR_ORANGE {
+		t.Error("wrong latency colors")
+	}
+}
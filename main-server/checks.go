@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/probe"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+// add or replace the check template of the name, its checks are added to the hosts of the servers of the user with the labels of its selector
+// returns the servers of the checks added
+// update session life
+func (mainServerStub) SetCheckTemplate(sid, username string, t store.CheckTemplate, ctx hprose.Context) (added []string, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			// the template applies to the hosts monitored already
+			if u := storeEngine.GetUser(username); u != nil {
+				for server := range u.MonitorServers {
+					if store.IsVirtual(server) {
+						continue
+					}
+					if err = checkTemplatesOwnership(username, store.HostOf(server), []store.CheckTemplate{t}, u.Labels[server]); err != nil {
+						return
+					}
+				}
+			}
+			if added, err = storeEngine.SetCheckTemplate(requestContext(ctx), username, t); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// the checks added by the template are kept
+// update session life
+func (mainServerStub) DeleteCheckTemplate(sid, username, name string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.DeleteCheckTemplate(requestContext(ctx), username, name); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// onboard the host with the labels by the checks of the check templates selecting them, or by icmp if none does
+// returns the servers of the checks added
+// update session life
+func (mainServerStub) AddHost(sid, username, host string, labels map[string]string, ctx hprose.Context) (added []string, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = targetPolicy.Validate(host); err != nil {
+				return
+			}
+			if u := storeEngine.GetUser(username); u != nil {
+				if err = checkTemplatesOwnership(username, host, u.CheckTemplates, labels); err != nil {
+					return
+				}
+			}
+			if added, err = storeEngine.AddHost(requestContext(ctx), username, host, labels); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// the intervals of the checks, read from the store at most every ping frequence
+var checkIntervals struct {
+	sync.Mutex
+	m      map[string]time.Duration
+	loaded time.Time
+}
+
+// returns true if the server is checked at the tick tn of the ping frequence
+// the checks of longer intervals are checked at the first tick of every interval, so the ticks need no state
+func checkDue(server string, tn time.Time) bool {
+	freq := getPingFrequence()
+	checkIntervals.Lock()
+	if checkIntervals.m == nil || time.Since(checkIntervals.loaded) >= freq {
+		checkIntervals.m, checkIntervals.loaded = storeEngine.CheckIntervals(), time.Now()
+	}
+	interval := checkIntervals.m[server]
+	checkIntervals.Unlock()
+	if interval <= freq {
+		return true
+	}
+	tn = tn.Truncate(freq)
+	return !tn.Truncate(interval).Equal(tn.Add(-freq).Truncate(interval))
+}
+
+// add the transaction of the name of the http steps, or replace its steps, run in order by the probe agents
+// the urls of the steps should be allowed by the target policy, returns the server of the transaction
+// update session life
+func (mainServerStub) SetTransaction(sid, username, name string, steps []probe.Step, ctx hprose.Context) (server string, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			for _, step := range steps {
+				if err = targetPolicy.Validate(step.URL); err != nil {
+					return
+				}
+				if err = checkHostOwnership(username, step.URL, probe.KIND_STEPS); err != nil {
+					return
+				}
+			}
+			if server, err = storeEngine.SetTransaction(requestContext(ctx), username, name, steps); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
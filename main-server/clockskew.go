@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// location -> clock of the ping node minus clock of the main server, measured on the latest ping
+var (
+	clockSkews    = make(map[string]time.Duration)
+	clockSkewsRwl sync.RWMutex
+)
+
+// the ping results are aligned by the time of the main server, skewed ping nodes are only reported
+func observeClockSkew(location string, skew time.Duration) {
+	clockSkewsRwl.Lock()
+	old, ok := clockSkews[location]
+	clockSkews[location] = skew
+	clockSkewsRwl.Unlock()
+
+	// log on crossing the threshold, rather than on every ping
+	if isSkewed(skew) && (!ok || !isSkewed(old)) {
+		logger.With("location", location, "skew", skew.String()).Warn("clock of ping node is skewed beyond %v", *flagMaxClockSkew)
+	} else if !isSkewed(skew) && ok && isSkewed(old) {
+		logger.With("location", location, "skew", skew.String()).Info("clock of ping node is back in sync")
+	}
+}
+
+func isSkewed(skew time.Duration) bool {
+	return skew > *flagMaxClockSkew || skew < -*flagMaxClockSkew
+}
+
+func writeClockSkewMetrics(w io.Writer) {
+	clockSkewsRwl.RLock()
+	defer clockSkewsRwl.RUnlock()
+	locations := make([]string, 0, len(clockSkews))
+	for location := range clockSkews {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	writeHeader(w, "watchdog_ping_node_clock_skew_seconds", "gauge", "clock of the ping node minus clock of the main server")
+	for _, location := range locations {
+		fmt.Fprintf(w, "watchdog_ping_node_clock_skew_seconds{location=%q} %v\n", location, clockSkews[location].Seconds())
+	}
+}
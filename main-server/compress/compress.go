@@ -0,0 +1,160 @@
+// gzip compression of http responses and of the bodies of the requests
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// the bodies of the requests smaller than it are sent as they are, gzip would not save much
+	_MIN_SIZE = 1 << 10
+	// the bodies of the requests decoded larger than it are rejected by default, see SetMaxBodySize
+	_MAX_BODY_SIZE = 8 << 20
+)
+
+var (
+	writerPool  = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	maxBodySize atomic.Int64
+)
+
+func init() { maxBodySize.Store(_MAX_BODY_SIZE) }
+
+// SetMaxBodySize sets the bytes a body of a request sent by gzip decodes to at most, Handler rejects the larger ones by 413
+// a few kilobytes by gzip decode to gigabytes, the body is never decoded beyond it
+func SetMaxBodySize(n int64) { maxBodySize.Store(n) }
+
+// the gzip writer is taken once the response turns out to have a body
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	head        bool
+	w           *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	// informational responses are followed by the final one
+	if code >= 200 {
+		g.wroteHeader = true
+		if !g.head && code != http.StatusNoContent && code != http.StatusNotModified {
+			g.Header().Set("Content-Encoding", "gzip")
+			g.Header().Del("Content-Length")
+			g.w = writerPool.Get().(*gzip.Writer)
+			g.w.Reset(g.ResponseWriter)
+		}
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.w == nil {
+		return g.ResponseWriter.Write(b)
+	}
+	return g.w.Write(b)
+}
+
+func (g *gzipResponseWriter) close() {
+	if g.w != nil {
+		g.w.Close()
+		writerPool.Put(g.w)
+	}
+}
+
+// Handler compresses the response of h if the client accepts gzip, and decodes the body of the request sent by gzip
+// the body is decoded before h serves the request, up to the size set by SetMaxBodySize
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+			gr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, "invalid gzip body", http.StatusBadRequest)
+				return
+			}
+			max := maxBodySize.Load()
+			b, err := ioutil.ReadAll(io.LimitReader(gr, max+1))
+			gr.Close()
+			if err != nil {
+				http.Error(w, "invalid gzip body", http.StatusBadRequest)
+				return
+			}
+			if int64(len(b)) > max {
+				http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{bytes.NewReader(b), r.Body}
+			r.Header.Del("Content-Encoding")
+			r.ContentLength = int64(len(b))
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, head: r.Method == http.MethodHead}
+		defer gw.close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+func acceptGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.Split(enc, ";")[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+type transport struct {
+	rt http.RoundTripper
+}
+
+// Transport sends the bodies of the requests by gzip through rt, http.DefaultTransport if nil, to the servers decoding them by Handler
+func Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return transport{rt: rt}
+}
+
+func (t transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.Header.Get("Content-Encoding") != "" {
+		return t.rt.RoundTrip(r)
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// the request is not modified, see http.RoundTripper
+	r = r.Clone(r.Context())
+	if len(b) >= _MIN_SIZE {
+		var buf bytes.Buffer
+		gw := writerPool.Get().(*gzip.Writer)
+		gw.Reset(&buf)
+		gw.Write(b)
+		gw.Close()
+		writerPool.Put(gw)
+		b = buf.Bytes()
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+	r.ContentLength = int64(len(b))
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	r.GetBody = func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(b)), nil }
+	return t.rt.RoundTrip(r)
+}
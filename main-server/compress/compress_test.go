@@ -0,0 +1,138 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_Handler(t *testing.T) {
+	body := strings.Repeat(`{"ping":"0.392","time":"15-01-09 18:10"}`, 100)
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Accept-Encoding", "deflate, gzip;q=1.0")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("response should be compressed")
+	}
+	if w.Body.Len() >= len(body) {
+		t.Errorf("compressed %v bytes into %v bytes", len(body), w.Body.Len())
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gr)
+	if err != nil || string(b) != body {
+		t.Errorf("can not decompress the body: %v", err)
+	}
+
+	r = httptest.NewRequest("POST", "/", nil)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != body {
+		t.Error("response should not be compressed without accept encoding")
+	}
+}
+
+func Test_Bodiless(t *testing.T) {
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/nocontent":
+			w.WriteHeader(http.StatusNoContent)
+		case "/notmodified":
+			w.WriteHeader(http.StatusNotModified)
+		default:
+			w.Header().Set("Content-Length", "4")
+			w.Write([]byte("body"))
+		}
+	}))
+	for _, c := range []struct{ method, path string }{{"GET", "/nocontent"}, {"GET", "/notmodified"}, {"HEAD", "/"}} {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Header().Get("Content-Encoding") != "" || w.Body.Len() != 0 && c.method != "HEAD" {
+			t.Errorf("%v %v should not be compressed, got %q", c.method, c.path, w.Body.String())
+		}
+	}
+}
+
+func Test_Transport(t *testing.T) {
+	body := strings.Repeat(`{"ping":"0.392","time":"15-01-09 18:10"}`, 100)
+	var encodings []string
+	srv := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(b)
+	})))
+	defer srv.Close()
+	raw := srv.Config.Handler
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		raw.ServeHTTP(w, r)
+	})
+	c := &http.Client{Transport: Transport(nil)}
+	for _, b := range []string{body, "small"} {
+		resp, err := c.Post(srv.URL, "application/json", strings.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || string(got) != b {
+			t.Errorf("the server should decode the body, got %v %q", resp.Status, got)
+		}
+	}
+	if len(encodings) != 2 || encodings[0] != "gzip" || encodings[1] != "" {
+		t.Errorf("only the large bodies should be compressed, got %v", encodings)
+	}
+
+	// a body claiming gzip it is not
+	r := httptest.NewRequest("POST", "/", strings.NewReader("plain"))
+	r.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	raw.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got %v", w.Code)
+	}
+}
+
+func Test_MaxBodySize(t *testing.T) {
+	defer SetMaxBodySize(_MAX_BODY_SIZE)
+	SetMaxBodySize(1 << 20)
+	read := 0
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		read += len(b)
+	}))
+	post := func(size int) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write(make([]byte, size))
+		gw.Close()
+		r := httptest.NewRequest("POST", "/", &buf)
+		r.Header.Set("Content-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	// a few kilobytes by gzip decoding to 64 megabytes of zeros
+	if w := post(64 << 20); w.Code != http.StatusRequestEntityTooLarge || read != 0 {
+		t.Errorf("the body decoded beyond the max should be rejected, got %v, %v bytes read", w.Code, read)
+	}
+	if w := post(1 << 20); w.Code != http.StatusOK || read != 1<<20 {
+		t.Errorf("the body of the max should be served, got %v, %v bytes read", w.Code, read)
+	}
+}
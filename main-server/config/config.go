@@ -0,0 +1,113 @@
+// config file and environment overrides of the flags
+//
+// the config file is a json object, the keys are flag names
+// objects whose key is not a flag name are sections grouping the flags
+//
+//	{
+//		"listen": {"port": 8683, "adminport": 8793},
+//		"engine": {"engine": "file", "engineconfig": {"serversDir": "servers", "usersDir": "users"}}
+//	}
+//
+// a flag NAME is overridden by environment variable WATCHDOG_NAME
+// flags on the command line take precedence over environment variables, which take precedence over the file
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const ENV_PREFIX = "WATCHDOG_"
+
+// Load reads the config file and returns the flag values in it
+func Load(path string, fs *flag.FlagSet) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	m := make(map[string]interface{})
+	if err = d.Decode(&m); err != nil {
+		return nil, fmt.Errorf("can not parse config file %v: %v", path, err)
+	}
+	values := make(map[string]string)
+	if err = flatten("", m, fs, values); err != nil {
+		return nil, fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+	return values, nil
+}
+
+func flatten(section string, m map[string]interface{}, fs *flag.FlagSet, values map[string]string) error {
+	for key, val := range m {
+		if fs.Lookup(key) != nil {
+			s, err := toString(val)
+			if err != nil {
+				return fmt.Errorf("%v: %v", key, err)
+			}
+			if _, ok := values[key]; ok {
+				return fmt.Errorf("%v is configured twice", key)
+			}
+			values[key] = s
+			continue
+		}
+		sub, ok := val.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("unknown key %v%v", section, key)
+		}
+		if err := flatten(section+key+".", sub, fs, values); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// objects and arrays are passed to the flag as json
+func toString(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return fmt.Sprint(v), nil
+	case nil:
+		return "", nil
+	default:
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+}
+
+// Env returns the flag values overridden by environment variables
+func Env(fs *flag.FlagSet) map[string]string {
+	values := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(ENV_PREFIX + strings.ToUpper(f.Name)); ok {
+			values[f.Name] = v
+		}
+	})
+	return values
+}
+
+// Apply sets the flags not set on the command line, later values take precedence
+func Apply(fs *flag.FlagSet, values ...map[string]string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, vs := range values {
+		for name, val := range vs {
+			if explicit[name] {
+				continue
+			}
+			if err := fs.Set(name, val); err != nil {
+				return fmt.Errorf("invalid value %q of %v: %v", val, name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newFlagSet() (*flag.FlagSet, *int, *string, *bool) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	port := fs.Int("port", 8683, "")
+	engineConfig := fs.String("engineconfig", "", "")
+	logJSON := fs.Bool("logjson", false, "")
+	return fs, port, engineConfig, logJSON
+}
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_Load(t *testing.T) {
+	fs, port, engineConfig, logJSON := newFlagSet()
+	if err := fs.Parse([]string{"-port", "9000"}); err != nil {
+		t.Fatal(err)
+	}
+	path := writeConfig(t, `{
+		"listen": {"port": 8000},
+		"log": {"logjson": true},
+		"engine": {"engineconfig": {"serversDir": "servers"}}
+	}`)
+	values, err := Load(path, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(ENV_PREFIX+"LOGJSON", "false")
+	defer os.Unsetenv(ENV_PREFIX + "LOGJSON")
+	if err = Apply(fs, values, Env(fs)); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 9000 {
+		t.Errorf("command line should take precedence, got port %v", *port)
+	}
+	if *logJSON {
+		t.Error("environment variable should take precedence over config file")
+	}
+	if *engineConfig != `{"serversDir":"servers"}` {
+		t.Errorf("object should be passed as json, got %v", *engineConfig)
+	}
+}
+
+func Test_LoadInvalid(t *testing.T) {
+	for _, content := range []string{
+		`{"listen": {"prot": 8000}}`,
+		`{"port": 1, "listen": {"port": 2}}`,
+		`{"port": `,
+	} {
+		fs, _, _, _ := newFlagSet()
+		if _, err := Load(writeConfig(t, content), fs); err == nil {
+			t.Errorf("%v should be invalid", content)
+		}
+	}
+
+	fs, _, _, _ := newFlagSet()
+	if err := Apply(fs, map[string]string{"port": "eighty"}); err == nil {
+		t.Error("invalid flag value should fail")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/main-server/pingClientManager"
+)
+
+const (
+	// the owner of the key checks the probes if sharded
+	_DEAD_PROBE_SHARD_KEY = "dead probe"
+	_DEAD_PROBE_TEMPLATE  = "probe"
+	_DEAD_PROBE_RULE      = "dead-probe"
+)
+
+// location -> when the ping node reported a ping result last time, and whether its dead probe alert is firing
+var (
+	probeReports    = make(map[string]time.Time)
+	deadProbes      = make(map[string]time.Time)
+	probeReportsRwl sync.RWMutex
+	probeChannels   []alert.Channel
+)
+
+// a ping node kicked for missing heartbeats, or reporting only errors, looks like stable charts rather than down servers
+func observeProbeReport(location string) {
+	probeReportsRwl.Lock()
+	probeReports[location] = time.Now()
+	since, dead := deadProbes[location]
+	delete(deadProbes, location)
+	probeReportsRwl.Unlock()
+	if dead {
+		notifyDeadProbe(location, alert.STATE_RESOLVED, since)
+	}
+}
+
+func checkDeadProbes() {
+	now := time.Now()
+	probeReportsRwl.Lock()
+	// the probes registered but never reported are silent since the first check
+	pcm.Iterate(func(location string, pc pingClientManager.PingClient) {
+		if _, ok := probeReports[location]; !ok {
+			probeReports[location] = now
+		}
+	})
+	fired := make([]string, 0)
+	for location, t := range probeReports {
+		if _, ok := deadProbes[location]; !ok && now.Sub(t) > *flagProbeGrace {
+			deadProbes[location] = now
+			fired = append(fired, location)
+		}
+	}
+	probeReportsRwl.Unlock()
+	for _, location := range fired {
+		notifyDeadProbe(location, alert.STATE_FIRING, now)
+	}
+}
+
+// dead probe alerts are of the operator, routed to -probechannels rather than the channels of the users
+func notifyDeadProbe(location, state string, since time.Time) {
+	now := time.Now()
+	probeReportsRwl.RLock()
+	silent := now.Sub(probeReports[location])
+	probeReportsRwl.RUnlock()
+	a := alert.Alert{
+		Location: location, Template: _DEAD_PROBE_TEMPLATE, Rule: _DEAD_PROBE_RULE, Severity: alert.SEVERITY_CRITICAL,
+		State: state, Value: silent.Seconds(), Since: since, At: now, Locale: *flagLocale,
+	}
+	alertHistory.Add(a)
+	l := logger.With("location", location, "rule", a.Rule)
+	if state == alert.STATE_FIRING {
+		l.Critical("ping node reported nothing for %v", silent)
+	} else {
+		l.Info("ping node is reporting again")
+	}
+	go func() {
+		for channel, err := range digester.Dispatch(a, probeChannels, alert.Schedule{}) {
+			l.Warn("can not notify channel %v: %v", channel, err)
+		}
+	}()
+}
+
+func writeProbeMetrics(w io.Writer) {
+	probeReportsRwl.RLock()
+	defer probeReportsRwl.RUnlock()
+	locations := make([]string, 0, len(probeReports))
+	for location := range probeReports {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	now := time.Now()
+	writeHeader(w, "watchdog_ping_node_silent_seconds", "gauge", "time since the ping node reported a ping result")
+	for _, location := range locations {
+		fmt.Fprintf(w, "watchdog_ping_node_silent_seconds{location=%q} %v\n", location, now.Sub(probeReports[location]).Seconds())
+	}
+}
+
+// the dead probe alerts, the latest first
+func (adminServerStub) DeadProbeAlerts() []alert.Alert {
+	return alertHistory.List("")
+}
+
+func initDeadProbe() {
+	if *flagProbeChannels != "" {
+		if err := json.Unmarshal([]byte(*flagProbeChannels), &probeChannels); err != nil {
+			panic(fmt.Errorf("can not parse probe channels: %v", err))
+		}
+		for _, c := range probeChannels {
+			if err := c.Validate(); err != nil {
+				panic(fmt.Errorf("invalid probe channel: %v", err))
+			}
+		}
+	}
+	if *flagProbeGrace <= 0 {
+		return
+	}
+	go func() {
+		for {
+			<-time.After(*flagProbeGrace / 4)
+			if shouldPing(_DEAD_PROBE_SHARD_KEY) {
+				checkDeadProbes()
+			}
+		}
+	}()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+)
+
+func initDebug() {
+	expvar.Publish("store", expvar.Func(func() interface{} {
+		if storeEngine == nil {
+			return nil
+		}
+		return storeEngine.Metrics()
+	}))
+
+	adminMux.Handle("/debug/pprof/", adminAuth(http.HandlerFunc(pprof.Index)))
+	adminMux.Handle("/debug/pprof/cmdline", adminAuth(http.HandlerFunc(pprof.Cmdline)))
+	adminMux.Handle("/debug/pprof/profile", adminAuth(http.HandlerFunc(pprof.Profile)))
+	adminMux.Handle("/debug/pprof/symbol", adminAuth(http.HandlerFunc(pprof.Symbol)))
+	adminMux.Handle("/debug/pprof/trace", adminAuth(http.HandlerFunc(pprof.Trace)))
+	adminMux.Handle("/debug/vars", adminAuth(expvar.Handler()))
+	adminMux.Handle("/debug/heapdump", adminAuth(http.HandlerFunc(heapDumpHandler)))
+}
+
+// POST writes a heap dump to the heap dump directory and responds its path
+func heapDumpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "should POST", http.StatusMethodNotAllowed)
+		return
+	}
+	path := filepath.Join(*flagHeapDumpDir, fmt.Sprintf("watchdog-%s.heapdump", time.Now().Format("20060102-150405")))
+	f, err := os.Create(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	debug.WriteHeapDump(f.Fd())
+	if err = f.Close(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.With("path", path).Info("heap dumped")
+	fmt.Fprintln(w, path)
+}
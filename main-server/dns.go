@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/main-server/target"
+)
+
+// resolve the hostname of the server every ping and record the addresses on change
+func observeResolution(server string, tn time.Time) {
+	host, err := target.Host(server)
+	if err != nil || net.ParseIP(host) != nil {
+		return
+	}
+	addrs, err := net.LookupIP(host)
+	if err != nil {
+		logger.With("server", server).Debug("can not resolve server: %v", err)
+		return
+	}
+	ips := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.String())
+	}
+	if changed, err := storeEngine.RecordResolution(context.Background(), server, ips, tn); err != nil {
+		logger.With("server", server).Error("can not record resolution %v: %v", ips, err)
+	} else if changed {
+		logger.With("server", server).Info("server resolves to %v", ips)
+	}
+}
+
+// GetDNSHistory returns the addresses the hostname of the server resolved to, the earliest first
+// update session life
+func (mainServerStub) GetDNSHistory(sid, username, server string) (h []store.Resolution, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if h, err = storeEngine.GetDNSHistory(username, server); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+)
+
+const (
+	_EXPORT_PATH = "/export/"
+
+	_EXPORT_ALERTS    = "alerts"
+	_EXPORT_INCIDENTS = "incidents"
+)
+
+// write the alerts or the incidents of the user selected by the filter in the format, all users if username is empty
+// the alerts are of the history, the incidents also of the alerts firing whose firing alert is no longer kept
+func exportAlerts(w *bytes.Buffer, username, kind, format string, f alert.Filter) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	history := alertHistory.List(username)
+	switch kind {
+	case _EXPORT_ALERTS:
+		alerts := make([]alert.Alert, 0)
+		for _, a := range history {
+			if f.Match(a) {
+				alerts = append(alerts, a)
+			}
+		}
+		return alert.ExportAlerts(w, format, alerts)
+	case _EXPORT_INCIDENTS:
+		users := map[string]bool{username: true}
+		if username == "" {
+			users = make(map[string]bool)
+			for _, a := range history {
+				users[a.Username] = true
+			}
+		}
+		all := history
+		for un := range users {
+			all = append(all, evaluator.Firing(un)...)
+		}
+		incidents := make([]alert.Incident, 0)
+		for _, i := range alert.Incidents(all) {
+			if f.MatchIncident(i) {
+				incidents = append(incidents, i)
+			}
+		}
+		return alert.ExportIncidents(w, format, incidents, time.Now())
+	}
+	return fmt.Errorf("unknown export %v, should be %v or %v", kind, _EXPORT_ALERTS, _EXPORT_INCIDENTS)
+}
+
+// the filter of the query, from and to are RFC3339, server, severity and state are comma separated
+func filterOf(q url.Values) (f alert.Filter, err error) {
+	for k, t := range map[string]*time.Time{"from": &f.From, "to": &f.To} {
+		if v := q.Get(k); v != "" {
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				return f, fmt.Errorf("%v should be RFC3339: %v", k, err)
+			}
+		}
+	}
+	for k, values := range map[string]*[]string{"server": &f.Servers, "severity": &f.Severities, "state": &f.States} {
+		if v := q.Get(k); v != "" {
+			*values = strings.Split(v, ",")
+		}
+	}
+	return f, f.Validate()
+}
+
+// GET the admin server /export/alerts or /export/incidents?[username=<username>][&format=csv|json] by the admin token
+// [&from=<RFC3339>][&to=<RFC3339>][&server=<server,...>][&severity=<severity,...>][&state=firing|resolved], all users by default
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f, err := filterOf(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = alert.FORMAT_CSV
+	}
+	kind := strings.TrimPrefix(r.URL.Path, _EXPORT_PATH)
+	var b bytes.Buffer
+	if err = exportAlerts(&b, q.Get("username"), kind, format, f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if format == alert.FORMAT_CSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v.csv"`, kind))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Write(b.Bytes())
+}
+
+func initExport() {
+	adminMux.Handle(_EXPORT_PATH, adminAuth(instrument("export", http.HandlerFunc(exportHandler))))
+}
+
+// export the alerts of the user kept by the history selected by the filter, as csv or json
+func (mainServerStub) ExportAlerts(sid, username, format string, filter alert.Filter) (data string, signedIn bool, err error) {
+	return exportOfUser(sid, username, _EXPORT_ALERTS, format, filter)
+}
+
+// export the incidents of the user overlapping the range of the filter, a firing alert and its resolution are one incident
+func (mainServerStub) ExportIncidents(sid, username, format string, filter alert.Filter) (data string, signedIn bool, err error) {
+	return exportOfUser(sid, username, _EXPORT_INCIDENTS, format, filter)
+}
+
+func exportOfUser(sid, username, kind, format string, filter alert.Filter) (data string, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			var b bytes.Buffer
+			if err = exportAlerts(&b, username, kind, format, filter); err == nil {
+				data = b.String()
+			}
+			signedIn = true
+		}
+	}
+	return
+}
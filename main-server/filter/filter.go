@@ -0,0 +1,308 @@
+// Package filter parses and evaluates the filter expressions of the queries, like
+//
+//	location=~"eu-.*" AND (loss>0 OR NOT down=false)
+//
+// a comparison is a field, an operator of =, !=, =~, !~, >, >=, < and <=, and a quoted string or a bare number or word,
+// combined by AND, OR, NOT and parentheses. =~ and !~ match the whole value by the regular expression,
+// the comparisons compare numbers if both sides are or strings otherwise, like time>="15-01-02 00:00",
+// an ordering of a number is false of the values not numbers.
+package filter
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// the longest expression parsed, so that a query does not cost more than it returns
+const MAX_LEN = 1024
+
+// Record is what an expression is evaluated on, the value of a field and false if the record has none
+// a comparison of a field the record has not is false, whatever the operator
+type Record interface {
+	Field(name string) (string, bool)
+}
+
+// Expr is a parsed expression, the nil Expr matches every record
+type Expr struct {
+	op          string
+	left, right *Expr
+	// of the comparisons
+	field, value string
+	number       float64
+	isNumber     bool
+	re           *regexp.Regexp
+}
+
+const (
+	_AND = "AND"
+	_OR  = "OR"
+	_NOT = "NOT"
+)
+
+// Parse parses the expression whose fields should be of fields, the empty expression is nil
+func Parse(s string, fields ...string) (*Expr, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	if len(s) > MAX_LEN {
+		return nil, fmt.Errorf("filter is longer than %v", MAX_LEN)
+	}
+	toks, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{toks: toks, fields: make(map[string]bool, len(fields))}
+	for _, f := range fields {
+		p.fields[f] = true
+	}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %v in filter", p.toks[p.pos].text)
+	}
+	return e, nil
+}
+
+// Match evaluates the expression on the record
+func (e *Expr) Match(r Record) bool {
+	if e == nil {
+		return true
+	}
+	switch e.op {
+	case _AND:
+		return e.left.Match(r) && e.right.Match(r)
+	case _OR:
+		return e.left.Match(r) || e.right.Match(r)
+	case _NOT:
+		return !e.left.Match(r)
+	}
+	v, ok := r.Field(e.field)
+	if !ok {
+		return false
+	}
+	switch e.op {
+	case "=~":
+		return e.re.MatchString(v)
+	case "!~":
+		return !e.re.MatchString(v)
+	}
+	switch e.op {
+	case "=":
+		return e.compare(v) == 0
+	case "!=":
+		return e.compare(v) != 0
+	}
+	if n, err := strconv.ParseFloat(v, 64); e.isNumber && err != nil || math.IsNaN(n) {
+		return false
+	}
+	c := e.compare(v)
+	switch e.op {
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	}
+	return false
+}
+
+// compare the value to the value of the comparison, as numbers if both are or as strings otherwise
+func (e *Expr) compare(v string) int {
+	if n, err := strconv.ParseFloat(v, 64); err == nil && e.isNumber {
+		switch {
+		case n < e.number:
+			return -1
+		case n > e.number:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(v, e.value)
+}
+
+type token struct {
+	text string
+	// the quoted strings are values, never keywords or operators
+	quoted bool
+}
+
+var operators = []string{"=~", "!~", "!=", ">=", "<=", "=", ">", "<", "(", ")"}
+
+func tokenize(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at %v of filter", i)
+			}
+			v, err := strconv.Unquote(s[i : j+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %v of filter: %v", i, err)
+			}
+			toks, i = append(toks, token{text: v, quoted: true}), j+1
+			continue
+		}
+		op := ""
+		for _, o := range operators {
+			if strings.HasPrefix(s[i:], o) {
+				op = o
+				break
+			}
+		}
+		if op != "" {
+			toks, i = append(toks, token{text: op}), i+len(op)
+			continue
+		}
+		j := i
+		for ; j < len(s) && isWord(rune(s[j])); j++ {
+		}
+		if j == i {
+			return nil, fmt.Errorf("unexpected %q at %v of filter", c, i)
+		}
+		toks, i = append(toks, token{text: s[i:j]}), j
+	}
+	return toks, nil
+}
+
+func isWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.-+:", r)
+}
+
+type parser struct {
+	toks   []token
+	pos    int
+	fields map[string]bool
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos], true
+	}
+	return token{}, false
+}
+
+// the next token is the keyword, case insensitive
+func (p *parser) keyword(k string) bool {
+	t, ok := p.peek()
+	if ok && !t.quoted && strings.EqualFold(t.text, k) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) or() (*Expr, error) {
+	left, err := p.and()
+	for err == nil && p.keyword(_OR) {
+		var right *Expr
+		if right, err = p.and(); err == nil {
+			left = &Expr{op: _OR, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) and() (*Expr, error) {
+	left, err := p.not()
+	for err == nil && p.keyword(_AND) {
+		var right *Expr
+		if right, err = p.not(); err == nil {
+			left = &Expr{op: _AND, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) not() (*Expr, error) {
+	if p.keyword(_NOT) {
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &Expr{op: _NOT, left: e}, nil
+	}
+	if t, ok := p.peek(); ok && !t.quoted && t.text == "(" {
+		p.pos++
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok = p.peek(); !ok || t.quoted || t.text != ")" {
+			return nil, fmt.Errorf("missing ) in filter")
+		}
+		p.pos++
+		return e, nil
+	}
+	return p.comparison()
+}
+
+func (p *parser) comparison() (*Expr, error) {
+	if p.pos+3 > len(p.toks) {
+		return nil, fmt.Errorf("incomplete comparison at the end of filter")
+	}
+	f, o, v := p.toks[p.pos], p.toks[p.pos+1], p.toks[p.pos+2]
+	if f.quoted || !p.fields[f.text] {
+		return nil, fmt.Errorf("unknown field %v in filter", f.text)
+	}
+	e := &Expr{op: o.text, field: f.text, value: v.text}
+	switch {
+	case o.quoted:
+		return nil, fmt.Errorf("%q after %v is not an operator", o.text, f.text)
+	case e.op == "=~" || e.op == "!~":
+		re, err := regexp.Compile("^(?:" + v.text + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q in filter: %v", v.text, err)
+		}
+		e.re = re
+	case e.op == "=" || e.op == "!=":
+		e.number, e.isNumber = parseNumber(v)
+	case e.op == ">" || e.op == ">=" || e.op == "<" || e.op == "<=":
+		if e.number, e.isNumber = parseNumber(v); !e.isNumber && !v.quoted {
+			return nil, fmt.Errorf("%v of %v should be a number or a quoted string", v.text, f.text)
+		}
+	default:
+		return nil, fmt.Errorf("%v after %v is not an operator", o.text, f.text)
+	}
+	if !v.quoted && isOperator(v.text) {
+		return nil, fmt.Errorf("missing the value of %v", f.text)
+	}
+	p.pos += 3
+	return e, nil
+}
+
+func parseNumber(t token) (float64, bool) {
+	if t.quoted {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(t.text, 64)
+	return n, err == nil
+}
+
+func isOperator(s string) bool {
+	for _, o := range operators {
+		if s == o {
+			return true
+		}
+	}
+	return false
+}
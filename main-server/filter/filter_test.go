@@ -0,0 +1,77 @@
+package filter
+
+import "testing"
+
+type record map[string]string
+
+func (r record) Field(name string) (string, bool) {
+	v, ok := r[name]
+	return v, ok
+}
+
+var fields = []string{"location", "ping", "loss", "down", "time"}
+
+func Test_Match(t *testing.T) {
+	tokyo := record{"location": "ap-tokyo", "ping": "120.500", "loss": "0.0", "down": "false", "time": "15-01-01 00:00"}
+	paris := record{"location": "eu-paris", "ping": "0.000", "loss": "33.3", "down": "true", "time": "15-01-02 00:00"}
+	for expr, want := range map[string][2]bool{
+		``:                               {true, true},
+		`location=~"eu-.*"`:              {false, true},
+		`location=~"eu"`:                 {false, false},
+		`location!~"eu-.*" and ping>100`: {true, false},
+		`location="ap-tokyo"`:            {true, false},
+		`loss>0`:                         {false, true},
+		`loss=0`:                         {true, false},
+		`ping>=120.5 OR down=true`:       {true, true},
+		`NOT (down=true OR ping<100)`:    {true, false},
+		`not down=true and not location=eu-paris`: {true, false},
+		`time>="15-01-02 00:00"`:                  {false, true},
+		`location=~"eu-.*" AND loss>0`:            {false, true},
+		`ping>1 OR ping<1 AND down=false`:         {true, false},
+	} {
+		e, err := Parse(expr, fields...)
+		if err != nil {
+			t.Errorf("%v: %v", expr, err)
+			continue
+		}
+		if got := [2]bool{e.Match(tokyo), e.Match(paris)}; got != want {
+			t.Errorf("%v: want %v, got %v", expr, want, got)
+		}
+	}
+	if e, _ := Parse(`mtu>0`, "mtu"); e.Match(tokyo) {
+		t.Error("should not match the records without the field")
+	}
+	if e, _ := Parse(`location>1`, fields...); e.Match(tokyo) {
+		t.Error("should not order the values not numbers by a number")
+	}
+}
+
+func Test_Parse(t *testing.T) {
+	for _, expr := range []string{
+		`city="Tokyo"`,
+		`location`,
+		`location=`,
+		`location="tokyo`,
+		`location=~"("`,
+		`ping>fast`,
+		`(ping>1`,
+		`ping>1)`,
+		`ping>1 AND`,
+		`ping>1 ping<2`,
+		`ping % 2`,
+		`"location"=tokyo`,
+		`location = =`,
+	} {
+		if _, err := Parse(expr, fields...); err == nil {
+			t.Errorf("%v should be invalid", expr)
+		}
+	}
+	long := make([]byte, MAX_LEN+1)
+	for i := range long {
+		long[i] = ' '
+	}
+	copy(long, "ping>1")
+	if _, err := Parse(string(long), fields...); err == nil {
+		t.Error("should reject filters longer than MAX_LEN")
+	}
+}
@@ -1,22 +1,246 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/astaxie/beego/logs"
+	"github.com/gogames/watchdog/main-server/config"
+	"github.com/gogames/watchdog/main-server/i18n"
+	"github.com/gogames/watchdog/main-server/secrets"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/main-server/target"
 )
 
 var (
+	flagConfig             = flag.String("config", "", "json config file, see package config")
+	flagCheckConfig        = flag.Bool("checkconfig", false, "check the config and exit")
 	flagLogFilePath        = flag.String("log", "/var/log/watchdog/main-server/logfile.log", "log file")
 	flagLogLevel           = flag.Int("level", logs.LevelDebug, "log level")
+	flagLogJSON            = flag.Bool("logjson", false, "write logs as json")
 	flagPingNodeServerPort = flag.Int("pingport", 8563, "port to invoke ping node")
 	flagManagerPort        = flag.Int("managerport", 8773, "port to run manager")
 	flagMainServerPort     = flag.Int("port", 8683, "port to run main server")
+	flagTLSCert            = flag.String("tlscert", "", "certificate file of main server, serve https if both tlscert and tlskey are set")
+	flagTLSKey             = flag.String("tlskey", "", "private key file of main server")
 	flagPingInterval       = flag.Int("pinginterval", 60, "number of seconds to kick a ping node")
 	flagServersPath        = flag.String("serverspath", "storeServers", "path to store ping results of servers")
 	flagUsersPath          = flag.String("userspath", "storeUsers", "path to store user information")
+	flagEngine             = flag.String("engine", store.ENGINE_FILE, "store engine, one of "+strings.Join(store.ListEngines(), ", "))
+	flagEngineConfig       = flag.String("engineconfig", "", "json config of the store engine, the file engine defaults to serverspath and userspath")
 	flagPingFrequence      = flag.Int("pingfreq", 10, "monitor the server by ping every ping frequence minutes")
 	flagSessionDirectory   = flag.String("sessiondir", "sessionDirectory", "path to store the sessions")
+	flagOAuth              = flag.String("oauth", "", "json config of oauth and openid connect sign in, disabled if empty")
+	flagOTLPEndpoint       = flag.String("otlpendpoint", "", "OTLP/HTTP endpoint to export traces to, like http://localhost:4318/v1/traces, disabled if empty")
+	flagTraceRatio         = flag.Float64("traceratio", 1, "ratio of the operations to trace")
+	flagSlowThreshold      = flag.Duration("slowthreshold", 500*time.Millisecond, "log store operations slower than it, 0 disables it")
+	flagAdminPort          = flag.Int("adminport", 8793, "port to run admin server")
+	flagAdminToken         = flag.String("admintoken", "", "token of admin requests, admin server is disabled if empty")
+	flagSupportTokens      = flag.String("supporttokens", "", "comma separated name=token of the support engineers viewing the users read only on /support of the admin server")
+	flagHeapDumpDir        = flag.String("heapdumpdir", os.TempDir(), "directory to write heap dumps triggered on admin server")
+	flagCORSOrigins        = flag.String("corsorigins", "", "comma separated origins allowed to access the main server cross domain")
+	flagShareSecret        = flag.String("sharesecret", "", "secret to sign share tokens, tokens are invalid after restart if empty")
+	flagHA                 = flag.Bool("ha", false, "run with other main servers sharing the store engine, only the leader pings the servers")
+	flagNodeId             = flag.String("nodeid", "", "id of the main server in leader election, defaults to hostname:port")
+	flagLeaseTTL           = flag.Duration("leasettl", 15*time.Second, "ttl of the leader lease, renewed every third of it")
+	flagHASync             = flag.Duration("hasync", time.Minute, "interval of reloading the store engine with -ha or -shards")
+	flagShards             = flag.String("shards", "", "comma separated nodeid=url of the main servers sharing the store engine, each pings the servers it owns by consistent hashing")
+	flagProbeMatrix        = flag.Bool("probematrix", false, "ping nodes also ping each other and the anchors every ping frequence, see GetLatencyMatrix")
+	flagAnchors            = flag.String("anchors", "", "comma separated hosts pinged by every ping node for the latency matrix")
+	flagMaxClockSkew       = flag.Duration("maxclockskew", 30*time.Second, "warn if the clock of a ping node is skewed beyond it")
+	flagProbeGrace         = flag.Duration("probegrace", 10*time.Minute, "alert if a ping node reports no ping result for longer than it, 0 to disable")
+	flagProbeChannels      = flag.String("probechannels", "", "json list of notification channels of the dead probe alerts")
+	flagEngineTimeout      = flag.Duration("enginetimeout", 10*time.Second, "abort engine writes taking longer than it, 0 to wait for the engine")
+	flagEngineRetries      = flag.Int("engineretries", 3, "attempts of an engine write, waiting -engineretrywait doubled between them")
+	flagEngineRetryWait    = flag.Duration("engineretrywait", 100*time.Millisecond, "wait before retrying a failed engine write, jittered")
+	flagEngineBreaker      = flag.Int("enginebreaker", 5, "consecutive failed engine writes opening the breaker, which buffers the writes, 0 to disable")
+	flagEngineCooldown     = flag.Duration("enginecooldown", 30*time.Second, "wait before trying the engine again once the breaker is open")
+	flagEngineBuffer       = flag.Int("enginebuffer", 1<<14, "engine writes buffered while the breaker is open, more are rejected")
+	flagMaxBody            = flag.Int64("maxbody", 8<<20, "bytes a request body sent by gzip decodes to at most, larger ones are rejected")
+	flagNotifyPlugins      = flag.String("notifyplugins", "", "directory of the executables registered as notification channel types, named after the file")
+	flagTwilioSid          = flag.String("twiliosid", "", "account sid of twilio sending the text messages of the sms channels and of the phone verification, no sms channels if empty")
+	flagTwilioToken        = flag.String("twiliotoken", "", "auth token of the twilio account")
+	flagTwilioFrom         = flag.String("twiliofrom", "", "phone number of the twilio account sending the text messages, like +14155552671")
+	flagPhoneCodes         = flag.Int("phonecodes", 100, "verification codes sent to the phones of all the users within the hour, more are rejected, a user is sent 5 at most")
+	flagBlocklist          = flag.String("blocklist", "", "comma separated CIDRs and domains users can not monitor, like 10.0.0.0/8,internal.example.com")
+	flagAllowlist          = flag.String("allowlist", "", "comma separated CIDRs and domains users can only monitor if set")
+	flagVerifyKinds        = flag.String("verifykinds", "", "comma separated kinds of checks, like http,tls,steps, users add only against the hosts they verified to own, none if empty")
+	flagReplicaOf          = flag.String("replicaof", "", "admin server url of the primary, like http://primary:8793, serve as its read only replica if set")
+	flagReplicaToken       = flag.String("replicatoken", "", "admin token of the primary")
+	flagHotTier            = flag.Duration("hottier", 0, "keep the ping results of it in memory and read the older ones from the store engine, everything is in memory if 0")
+	flagWarmTier           = flag.Duration("warmtier", 0, "drop the ping results older than it from the store engine with -hottier, their aggregates are kept, never if 0")
+	flagColdTier           = flag.String("coldtier", "", "directory to archive the aggregates of the ping results dropped by -warmtier, like a mounted bucket, the engine keeps them if empty")
+	flagTierInterval       = flag.Duration("tierinterval", time.Hour, "interval of moving the ping results down the tiers")
+	flagImporters          = flag.String("importers", "", `json list of the importers reconciling the hosts of inventories into the monitoring lists, like [{"name": "prod", "kind": "ec2", "username": "alice", "prune": true, "config": {...}}], see package importer`)
+	flagLocale             = flag.String("locale", i18n.DEFAULT_LOCALE, "locale of the api errors and the notifications of the users who set none and of the operator, one of "+strings.Join(i18n.Locales(), ", ")+" or their regions")
+	flagASNDB              = flag.String("asndb", "", "ip to asn table of iptoasn.com, like ip2asn-combined.tsv.gz, enriching the servers and the probes with their networks")
+	flagIngestWorkers      = flag.Int("ingestworkers", 0, "workers appending the samples reported by the probes and pushed to /ingest, GOMAXPROCS if 0")
+	flagShutdownGrace      = flag.Duration("shutdowngrace", 30*time.Second, "wait at most it on shutdown for the ingestion workers to append the samples queued")
+	flagIngestQueue        = flag.Int("ingestqueue", 1<<14, "samples queued for the ingestion workers, more are rejected with the time to retry after")
+	flagIsolation          = flag.String("isolation", store.ISOLATION_NONE, "none to show every user the whole ping results of the servers, organization to show them only since the organization of the user started monitoring the server")
+	flagInboxRetention     = flag.Duration("inboxretention", 30*24*time.Hour, "drop the messages of the inboxes of the users older than it, like the alerts notified")
+	flagStatusRules        = flag.String("statusrules", "", `json rules classifying the servers up, degraded or down, like {"samples": 3, "loss_ratio": 0.5, "latency": 300, "down_ratio": 1}, defaults if empty`)
 )
 
-func initFlag() { flag.Parse() }
+func initFlag() {
+	flag.Parse()
+
+	fileValues := make(map[string]string)
+	if *flagConfig != "" {
+		var err error
+		if fileValues, err = config.Load(*flagConfig, flag.CommandLine); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+	if err := config.Apply(flag.CommandLine, fileValues, config.Env(flag.CommandLine)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := resolveSecrets(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		os.Exit(2)
+	}
+	if err := checkFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		os.Exit(2)
+	}
+	if *flagCheckConfig {
+		fmt.Println("config ok")
+		os.Exit(0)
+	}
+}
+
+// flags whose values, or the string values of their json, may reference secrets like "secret:env:NAME", see package secrets
+// they are resolved once on startup
+var secretFlags = []string{"admintoken", "sharesecret", "replicatoken", "oauth", "engineconfig", "probechannels", "supporttokens", "importers", "twiliosid", "twiliotoken"}
+
+// flag name -> the value before resolved, so that reload compares the references rather than the secrets
+var secretRefs = make(map[string]string)
+
+func resolveSecrets() error {
+	for _, name := range secretFlags {
+		f := flag.Lookup(name)
+		raw := f.Value.String()
+		v, err := secrets.ResolveJSON(context.Background(), raw)
+		if err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+		secretRefs[name] = raw
+		if v != raw {
+			if err = f.Value.Set(v); err != nil {
+				return fmt.Errorf("%v: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkFlags() error {
+	for name, port := range map[string]int{
+		"port":        *flagMainServerPort,
+		"managerport": *flagManagerPort,
+		"pingport":    *flagPingNodeServerPort,
+		"adminport":   *flagAdminPort,
+	} {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("%v %v is out of range", name, port)
+		}
+	}
+	if *flagPingFrequence < _MIN_PING_FREQUENCE {
+		return fmt.Errorf("pingfreq should be at least %v minutes", _MIN_PING_FREQUENCE)
+	}
+	if (*flagHA || *flagShards != "") && (*flagLeaseTTL <= 0 || *flagHASync <= 0) {
+		return fmt.Errorf("leasettl and hasync should be positive")
+	}
+	if *flagReplicaOf != "" && (*flagHA || *flagShards != "") {
+		return fmt.Errorf("replicaof can not be set with ha or shards")
+	}
+	if *flagShards != "" {
+		if *flagHA {
+			return fmt.Errorf("ha and shards can not be set together")
+		}
+		shards, err := parseShards(*flagShards)
+		if err != nil {
+			return err
+		}
+		if _, ok := shards[nodeId()]; !ok {
+			return fmt.Errorf("nodeid %v is not in shards", nodeId())
+		}
+	}
+	if _, err := target.NewPolicy(*flagBlocklist, *flagAllowlist); err != nil {
+		return err
+	}
+	if err := checkVerifyKinds(*flagVerifyKinds); err != nil {
+		return fmt.Errorf("invalid verifykinds: %v", err)
+	}
+	if conf, err := engineConfig(); err != nil {
+		return err
+	} else if err = store.ValidateEngineConfig(*flagEngine, conf); err != nil {
+		return fmt.Errorf("invalid engineconfig: %v", err)
+	}
+	if *flagHotTier < 0 || *flagWarmTier < 0 || (*flagHotTier > 0 && *flagTierInterval <= 0) {
+		return fmt.Errorf("hottier and warmtier should not be negative, tierinterval should be positive")
+	}
+	if *flagWarmTier > 0 && (*flagHotTier == 0 || *flagWarmTier < *flagHotTier) {
+		return fmt.Errorf("warmtier should be set with hottier and be longer than it")
+	}
+	if *flagIngestWorkers < 0 || *flagIngestQueue <= 0 {
+		return fmt.Errorf("ingestworkers should not be negative, ingestqueue should be positive")
+	}
+	if err := store.ValidIsolation(*flagIsolation); err != nil {
+		return err
+	}
+	if *flagTwilioSid != "" && (*flagTwilioToken == "" || *flagTwilioFrom == "") {
+		return fmt.Errorf("twiliotoken and twiliofrom should be set with twiliosid")
+	}
+	if *flagPhoneCodes <= 0 {
+		return fmt.Errorf("phonecodes should be positive")
+	}
+	if err := i18n.Valid(*flagLocale); err != nil || *flagLocale == "" {
+		return fmt.Errorf("locale %q should be a language tag like en or pt-BR", *flagLocale)
+	}
+	if _, err := statusRules(); err != nil {
+		return fmt.Errorf("invalid statusrules: %v", err)
+	}
+	if *flagImporters != "" {
+		if _, err := parseImporters(*flagImporters); err != nil {
+			return fmt.Errorf("invalid importers: %v", err)
+		}
+	}
+	if (*flagTLSCert == "") != (*flagTLSKey == "") {
+		return fmt.Errorf("tlscert and tlskey should be set together")
+	}
+	for name, conf := range map[string]string{
+		"oauth":         *flagOAuth,
+		"probechannels": *flagProbeChannels,
+	} {
+		if conf != "" && !json.Valid([]byte(conf)) {
+			return fmt.Errorf("%v is not valid json", name)
+		}
+	}
+	return nil
+}
+
+func statusRules() (r store.StatusRules, err error) {
+	if *flagStatusRules == "" {
+		return store.DefaultStatusRules, nil
+	}
+	if err = json.Unmarshal([]byte(*flagStatusRules), &r); err != nil {
+		return
+	}
+	return r, r.Validate()
+}
+
+// the file engine is configured by serverspath and userspath unless engineconfig is set
+func engineConfig() (store.EngineConfig, error) {
+	if *flagEngineConfig == "" && *flagEngine == store.ENGINE_FILE {
+		return store.EngineConfig{"serversDir": *flagServersPath, "usersDir": *flagUsersPath}, nil
+	}
+	return store.ParseEngineConfig(*flagEngineConfig)
+}
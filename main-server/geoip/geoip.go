@@ -0,0 +1,148 @@
+// Package geoip maps addresses to the networks announcing them, by the ip to asn tables of iptoasn.com
+// which are embeddable tab separated files like "1.0.0.0	1.0.0.255	13335	US	CLOUDFLARENET", one range per line
+package geoip
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Network is the autonomous system announcing an address, Prefix is the largest CIDR of its range containing the address
+type Network struct {
+	ASN     int    `json:"asn"`
+	Org     string `json:"org,omitempty"`
+	Country string `json:"country,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+}
+
+type entry struct {
+	start, end   net.IP
+	asn          int
+	org, country string
+}
+
+// DB is the ranges of the table sorted by start, the ranges not routed are dropped
+type DB struct {
+	entries []entry
+}
+
+// Open loads the table of the file, gzipped if it ends with .gz
+func Open(path string) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := io.Reader(f)
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	return Load(r)
+}
+
+// Load parses the table, ipv4 and ipv6 ranges may be mixed
+func Load(r io.Reader) (*DB, error) {
+	db := new(DB)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		fields := strings.SplitN(s, "\t", 5)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %v: want start, end, asn, country and org separated by tabs", line)
+		}
+		e := entry{start: normalize(net.ParseIP(fields[0])), end: normalize(net.ParseIP(fields[1]))}
+		if e.start == nil || e.end == nil || len(e.start) != len(e.end) || bytes.Compare(e.start, e.end) > 0 {
+			return nil, fmt.Errorf("line %v: invalid range %v - %v", line, fields[0], fields[1])
+		}
+		var err error
+		if e.asn, err = strconv.Atoi(fields[2]); err != nil || e.asn < 0 {
+			return nil, fmt.Errorf("line %v: invalid asn %v", line, fields[2])
+		}
+		// not routed
+		if e.asn == 0 {
+			continue
+		}
+		if len(fields) > 3 && fields[3] != "None" {
+			e.country = fields[3]
+		}
+		if len(fields) > 4 {
+			e.org = fields[4]
+		}
+		db.entries = append(db.entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(db.entries, func(i, j int) bool { return less(db.entries[i].start, db.entries[j].start) })
+	return db, nil
+}
+
+// Len returns the number of the ranges routed
+func (db *DB) Len() int { return len(db.entries) }
+
+// Lookup returns the network of the address, false if it is not routed or db is nil
+func (db *DB) Lookup(ip net.IP) (Network, bool) {
+	if ip = normalize(ip); db == nil || ip == nil {
+		return Network{}, false
+	}
+	// the last range starting at or before the address
+	i := sort.Search(len(db.entries), func(i int) bool { return less(ip, db.entries[i].start) }) - 1
+	if i < 0 {
+		return Network{}, false
+	}
+	e := db.entries[i]
+	if len(e.start) != len(ip) || bytes.Compare(ip, e.end) > 0 {
+		return Network{}, false
+	}
+	return Network{ASN: e.asn, Org: e.org, Country: e.country, Prefix: prefix(ip, e.start, e.end)}, true
+}
+
+// ipv4 of 4 bytes, so that ipv4 sorts before ipv6
+func normalize(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func less(a, b net.IP) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// the largest CIDR within the range containing the address
+func prefix(ip, start, end net.IP) string {
+	bits := len(ip) * 8
+	lo, hi := new(big.Int).SetBytes(start), new(big.Int).SetBytes(end)
+	for ones := 0; ones <= bits; ones++ {
+		mask := net.CIDRMask(ones, bits)
+		network := ip.Mask(mask)
+		last := make(net.IP, len(ip))
+		for i := range network {
+			last[i] = network[i] | ^mask[i]
+		}
+		if new(big.Int).SetBytes(network).Cmp(lo) >= 0 && new(big.Int).SetBytes(last).Cmp(hi) <= 0 {
+			return (&net.IPNet{IP: network, Mask: mask}).String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,47 @@
+package geoip
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const table = `1.0.0.0	1.0.0.255	13335	US	CLOUDFLARENET
+1.0.1.0	1.0.3.255	0	None	Not routed
+8.8.8.0	8.8.8.255	15169	US	GOOGLE
+10.0.0.0	10.0.2.255	64512	ZZ	PRIVATE
+2001:4860::	2001:4860:ffff:ffff:ffff:ffff:ffff:ffff	15169	US	GOOGLE
+`
+
+func Test_Lookup(t *testing.T) {
+	db, err := Load(strings.NewReader(table))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Len() != 4 {
+		t.Errorf("got %v ranges, want the routed ones", db.Len())
+	}
+	for ip, want := range map[string]Network{
+		"8.8.8.8":              {ASN: 15169, Org: "GOOGLE", Country: "US", Prefix: "8.8.8.0/24"},
+		"::ffff:1.0.0.1":       {ASN: 13335, Org: "CLOUDFLARENET", Country: "US", Prefix: "1.0.0.0/24"},
+		"10.0.2.1":             {ASN: 64512, Org: "PRIVATE", Country: "ZZ", Prefix: "10.0.2.0/24"},
+		"10.0.1.1":             {ASN: 64512, Org: "PRIVATE", Country: "ZZ", Prefix: "10.0.0.0/23"},
+		"2001:4860:4860::8888": {ASN: 15169, Org: "GOOGLE", Country: "US", Prefix: "2001:4860::/32"},
+	} {
+		if got, ok := db.Lookup(net.ParseIP(ip)); !ok || got != want {
+			t.Errorf("%v: got %+v, %v, want %+v", ip, got, ok, want)
+		}
+	}
+	for _, ip := range []string{"1.0.2.1", "9.9.9.9", "0.0.0.1", "2001:db8::1"} {
+		if n, ok := db.Lookup(net.ParseIP(ip)); ok {
+			t.Errorf("%v should not be routed, got %+v", ip, n)
+		}
+	}
+	var none *DB
+	if _, ok := none.Lookup(net.ParseIP("8.8.8.8")); ok {
+		t.Error("nil db should route nothing")
+	}
+	if _, err = Load(strings.NewReader("8.8.8.255\t8.8.8.0\t15169\tUS\tGOOGLE")); err == nil {
+		t.Error("should reject the range ending before its start")
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"syscall"
 
 	"github.com/gogames/watchdog/main-server/pingClientManager"
+	"github.com/gogames/watchdog/main-server/sdnotify"
 	"github.com/gogames/utils/shutdown"
 )
 
@@ -16,17 +17,32 @@ func initShutdown() {
 		syscall.SIGTERM,
 	}
 	fs := []func(){
+		func() {
+			sdnotify.Notify(sdnotify.STOPPING)
+		},
 		func() {
 			pcm.Iterate(func(_ string, pc pingClientManager.PingClient) {
 				pc.Disable()
 			})
 		},
+		func() {
+			releaseLeader()
+		},
+		func() {
+			flushDigests(digester.FlushAll())
+		},
+		func() {
+			drainIngestion()
+		},
 		func() {
 			storeEngine.Close()
 		},
 		func() {
 			sess.Close()
 		},
+		func() {
+			closeTrace()
+		},
 		func() {
 			logger.Close()
 		},
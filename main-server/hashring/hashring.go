@@ -0,0 +1,88 @@
+// Package hashring partitions keys across nodes by consistent hashing,
+// adding or removing a node only moves the keys of its neighbours.
+package hashring
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const DEFAULT_REPLICAS = 128
+
+type Ring struct {
+	replicas int
+	hashes   []uint32
+	nodes    map[uint32]string
+	rwl      sync.RWMutex
+}
+
+// New returns a ring placing every node at replicas points, DEFAULT_REPLICAS if replicas <= 0
+func New(replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DEFAULT_REPLICAS
+	}
+	return &Ring{replicas: replicas, nodes: make(map[uint32]string)}
+}
+
+func hash(key string) uint32 { return crc32.ChecksumIEEE([]byte(key)) }
+
+func (r *Ring) Add(nodes ...string) {
+	r.rwl.Lock()
+	defer r.rwl.Unlock()
+	for _, node := range nodes {
+		for i := 0; i < r.replicas; i++ {
+			h := hash(strconv.Itoa(i) + node)
+			if _, ok := r.nodes[h]; !ok {
+				r.hashes = append(r.hashes, h)
+			}
+			r.nodes[h] = node
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+func (r *Ring) Remove(node string) {
+	r.rwl.Lock()
+	defer r.rwl.Unlock()
+	hashes := r.hashes[:0]
+	for _, h := range r.hashes {
+		if r.nodes[h] == node {
+			delete(r.nodes, h)
+		} else {
+			hashes = append(hashes, h)
+		}
+	}
+	r.hashes = hashes
+}
+
+// Get returns the node owning the key, empty if the ring is empty
+func (r *Ring) Get(key string) string {
+	r.rwl.RLock()
+	defer r.rwl.RUnlock()
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]]
+}
+
+func (r *Ring) Nodes() []string {
+	r.rwl.RLock()
+	defer r.rwl.RUnlock()
+	set := make(map[string]bool)
+	for _, node := range r.nodes {
+		set[node] = true
+	}
+	nodes := make([]string, 0, len(set))
+	for node := range set {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
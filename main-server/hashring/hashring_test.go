@@ -0,0 +1,39 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_Ring(t *testing.T) {
+	r := New(0)
+	if node := r.Get("google.com"); node != "" {
+		t.Errorf("empty ring should own nothing, got %v", node)
+	}
+	r.Add("a", "b", "c")
+
+	owners := make(map[string]string)
+	count := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("server%d.com", i)
+		owners[key] = r.Get(key)
+		count[owners[key]]++
+	}
+	for _, node := range []string{"a", "b", "c"} {
+		if count[node] < 500 {
+			t.Errorf("node %v owns %v of 3000 keys, the ring is unbalanced", node, count[node])
+		}
+	}
+
+	r.Remove("c")
+	for key, owner := range owners {
+		if node := r.Get(key); owner != "c" && node != owner {
+			t.Fatalf("%v moved from %v to %v after removing c", key, owner, node)
+		} else if node == "c" {
+			t.Fatalf("%v is still owned by removed node c", key)
+		}
+	}
+	if nodes := r.Nodes(); len(nodes) != 2 || nodes[0] != "a" || nodes[1] != "b" {
+		t.Errorf("got nodes %v", nodes)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// the process is up
+func livezHandler(w http.ResponseWriter, r *http.Request) { w.Write([]byte("ok\n")) }
+
+// the store is ready to serve, responds the health of the store in json
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if storeEngine == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "store is not initialized"})
+		return
+	}
+	h := storeEngine.Health(r.Context())
+	ret := map[string]interface{}{"store": h}
+	if err := h.Ready(); err != nil {
+		ret["error"] = err.Error()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(ret)
+}
+
+func initHealth() {
+	mainMux.HandleFunc("/healthz", livezHandler)
+	mainMux.HandleFunc("/livez", livezHandler)
+	mainMux.HandleFunc("/readyz", readyzHandler)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+const (
+	_HEARTBEAT_PATH     = "/heartbeat"
+	_HEARTBEAT_LOCATION = "heartbeat"
+	// the ping of a heartbeat without latency, any ping but the default one is up
+	_HEARTBEAT_PING = 1
+	_HEARTBEAT_TICK = 30 * time.Second
+)
+
+// GET or POST /heartbeat?server=<server>&token=<ingest token>[&latency=<ms>], curl friendly for cron jobs
+// the token can be "Authorization: Bearer <ingest token>" instead, latency is like the duration of the job
+func heartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	token := q.Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	server := q.Get("server")
+	if !storeEngine.CheckIngestToken(server, token) {
+		http.Error(w, "invalid ingest token", http.StatusUnauthorized)
+		return
+	}
+	if err := checkWritable(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	latency := float64(_HEARTBEAT_PING)
+	if l := q.Get("latency"); l != "" {
+		var err error
+		if latency, err = strconv.ParseFloat(l, 64); err != nil || latency <= 0 {
+			http.Error(w, "latency should be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := appendHeartbeat(r.Context(), server, latency, time.Now()); err != nil {
+		http.Error(w, "can not store heartbeat", http.StatusInternalServerError)
+		return
+	}
+	countIngestion(server, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// a missed heartbeat is a down sample, alerted by the rules of metric down
+func appendHeartbeat(ctx context.Context, server string, latency float64, t time.Time) error {
+	p := store.PingRet{
+		Ping:         fmt.Sprintf("%.3f", latency),
+		Time:         t.Format(_TIME_LAYOUT),
+		ReceivedTime: t.Format(time.RFC3339),
+	}
+	if err := storeEngine.AppendPingRet(ctx, server, _HEARTBEAT_LOCATION, p); err != nil {
+		logger.With("server", server).Error("can not append heartbeat %v: %v", p, err)
+		return err
+	}
+	evaluateAlerts(server, _HEARTBEAT_LOCATION, alert.Sample{Time: p.Time, Ping: latency, Down: latency == 0})
+	return nil
+}
+
+// append a down sample every interval the heartbeat misses, since the last one plus grace
+func checkHeartbeats(now time.Time) {
+	for server, hb := range storeEngine.Heartbeats() {
+		if !shouldPing(server) {
+			continue
+		}
+		lastUp, last := hb.Created, hb.Created
+		l, lu := storeEngine.LatestPingRets(server, _HEARTBEAT_LOCATION)
+		if t, err := time.Parse(time.RFC3339, lu.ReceivedTime); err == nil {
+			lastUp = t
+		}
+		if t, err := time.Parse(time.RFC3339, l.ReceivedTime); err == nil {
+			last = t
+		}
+		if now.Sub(lastUp) > hb.Interval+hb.Grace && (last.Equal(lastUp) || now.Sub(last) >= hb.Interval) {
+			logger.With("server", server).Info("heartbeat missed since %v", lastUp)
+			appendHeartbeat(context.Background(), server, 0, now)
+		}
+	}
+}
+
+// add a heartbeat of the name, which is down if the job does not hit /heartbeat for interval plus grace seconds
+// update session life
+func (mainServerStub) AddHeartbeat(sid, username, name string, intervalSeconds, graceSeconds int, ctx hprose.Context) (server, token string, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if server, token, err = storeEngine.AddHeartbeat(requestContext(ctx), username, name, time.Duration(intervalSeconds)*time.Second, time.Duration(graceSeconds)*time.Second); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+func initHeartbeat() {
+	mainMux.Handle(_HEARTBEAT_PATH, instrument("heartbeat", http.HandlerFunc(heartbeatHandler)))
+	go func() {
+		for {
+			checkHeartbeats(<-time.After(_HEARTBEAT_TICK))
+		}
+	}()
+}
@@ -0,0 +1,153 @@
+// Package i18n localizes the messages of the main server, the errors of the api and the texts of the notifications
+// a catalog translates the english formats of the messages, so messages built by fmt are localized by matching their formats
+package i18n
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// the locale of the messages as they are written, and of the users who set none
+const DEFAULT_LOCALE = "en"
+
+var (
+	localeRegexp = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+	verbRegexp   = regexp.MustCompile(`%[-+# 0]*[0-9]*(\.[0-9]+)?[vdsqxfgtw]`)
+)
+
+// a translated message, the english format as a regexp capturing its arguments
+type entry struct {
+	format      string
+	re          *regexp.Regexp
+	translation string
+}
+
+var (
+	catalogs = make(map[string][]entry)
+	rwl      sync.RWMutex
+)
+
+// Valid returns an error unless the locale is a language tag, like zh or pt-BR, it need not be registered
+func Valid(locale string) error {
+	if locale != "" && !localeRegexp.MatchString(locale) {
+		return fmt.Errorf("locale %v should be a language tag like en or pt-BR", locale)
+	}
+	return nil
+}
+
+// Register adds the catalog of the locale, english format -> translation
+// the translation refers to the arguments by %v, or by %[n]v if it orders them differently, the arguments are localized as well
+func Register(locale string, catalog map[string]string) error {
+	if err := Valid(locale); err != nil || locale == "" {
+		return fmt.Errorf("locale %q should be a language tag like en or pt-BR", locale)
+	}
+	formats := make([]string, 0, len(catalog))
+	for format := range catalog {
+		formats = append(formats, format)
+	}
+	// the longer formats first, so that "%v: %v" does not shadow them
+	sort.Slice(formats, func(i, j int) bool {
+		if len(formats[i]) != len(formats[j]) {
+			return len(formats[i]) > len(formats[j])
+		}
+		return formats[i] < formats[j]
+	})
+	entries := make([]entry, 0, len(formats))
+	for _, format := range formats {
+		re, err := compile(format)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{format: format, re: re, translation: catalog[format]})
+	}
+	rwl.Lock()
+	defer rwl.Unlock()
+	catalogs[strings.ToLower(locale)] = entries
+	return nil
+}
+
+func compile(format string) (*regexp.Regexp, error) {
+	// the arguments are localized by the catalog again, a format of arguments only would match them forever
+	if strings.TrimSpace(verbRegexp.ReplaceAllString(format, "")) == "" {
+		return nil, fmt.Errorf("format %q has no text to translate", format)
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for i, s := range strings.Split(format, "%%") {
+		if i > 0 {
+			b.WriteString("%")
+		}
+		last := 0
+		for _, loc := range verbRegexp.FindAllStringIndex(s, -1) {
+			b.WriteString(regexp.QuoteMeta(s[last:loc[0]]))
+			b.WriteString("(.+?)")
+			last = loc[1]
+		}
+		b.WriteString(regexp.QuoteMeta(s[last:]))
+	}
+	b.WriteString("$")
+	return regexp.Compile("(?s)" + b.String())
+}
+
+// Locales returns the locales registered, sorted
+func Locales() []string {
+	rwl.RLock()
+	defer rwl.RUnlock()
+	ret := make([]string, 0, len(catalogs)+1)
+	ret = append(ret, DEFAULT_LOCALE)
+	for locale := range catalogs {
+		ret = append(ret, locale)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// the entries of the locale or of its language, like zh of zh-TW, nil if neither is registered
+// should be invoked with read lock held
+func entriesOf(locale string) []entry {
+	locale = strings.ToLower(locale)
+	for {
+		if entries, ok := catalogs[locale]; ok {
+			return entries
+		}
+		i := strings.LastIndexByte(locale, '-')
+		if i < 0 {
+			return nil
+		}
+		locale = locale[:i]
+	}
+}
+
+// Localize translates the message to the locale, it is returned as it is if the catalog has no format of it
+func Localize(locale, msg string) string {
+	rwl.RLock()
+	defer rwl.RUnlock()
+	return localize(entriesOf(locale), msg)
+}
+
+func localize(entries []entry, msg string) string {
+	for _, e := range entries {
+		m := e.re.FindStringSubmatch(msg)
+		if m == nil {
+			continue
+		}
+		args := make([]interface{}, 0, len(m)-1)
+		for _, arg := range m[1:] {
+			args = append(args, localize(entries, arg))
+		}
+		return fmt.Sprintf(e.translation, args...)
+	}
+	return msg
+}
+
+// Sprintf formats the message in the locale, like fmt.Sprintf of the translation of the format
+func Sprintf(locale, format string, args ...interface{}) string {
+	return Localize(locale, fmt.Sprintf(format, args...))
+}
+
+func init() {
+	Register("zh", zh)
+}
@@ -0,0 +1,39 @@
+package i18n
+
+import "testing"
+
+func Test_Localize(t *testing.T) {
+	if err := Register("xx", map[string]string{
+		"User %v not exist":          "user %v is missing",
+		"can not list %v of %v: %v":  "%[2]v: %[3]v, listing %[1]v",
+		"100%% of %d hosts are down": "all %v hosts down",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ locale, msg, want string }{
+		{"xx", "User alice not exist", "user alice is missing"},
+		{"xx-YY", "User alice not exist", "user alice is missing"},
+		{"XX", "can not list hosts of ec2: User bob not exist", "ec2: user bob is missing, listing hosts"},
+		{"xx", "100% of 3 hosts are down", "all 3 hosts down"},
+		{"xx", "User alice not exist anymore", "User alice not exist anymore"},
+		{"yy", "User alice not exist", "User alice not exist"},
+		{DEFAULT_LOCALE, "User alice not exist", "User alice not exist"},
+		{"zh-CN", "[firing] warning: slow of web on google.com from Tokyo, value 300 at 2015-01-01 12:00",
+			"[触发] 警告：web 的规则 slow 在 google.com（来自 Tokyo），数值 300，时间 2015-01-01 12:00"},
+	} {
+		if got := Localize(c.locale, c.msg); got != c.want {
+			t.Errorf("localize %q to %v, got %q, want %q", c.msg, c.locale, got, c.want)
+		}
+	}
+	if got := Sprintf("zh", "User %v not exist", "alice"); got != "用户 alice 不存在" {
+		t.Errorf("got %q", got)
+	}
+	if err := Register("xx", map[string]string{"%v %v": "%v%v"}); err == nil {
+		t.Error("want the error of the format without text")
+	}
+	for _, bad := range []string{"", "english", "en_US"} {
+		if Register(bad, nil) == nil {
+			t.Errorf("locale %q should be invalid", bad)
+		}
+	}
+}
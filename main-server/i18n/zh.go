@@ -0,0 +1,80 @@
+package i18n
+
+// simplified chinese
+var zh = map[string]string{
+	// api errors
+	"Unexpected runtime error":                             "意外的运行时错误",
+	"User %v not exist":                                    "用户 %v 不存在",
+	"User %v does not exist":                               "用户 %v 不存在",
+	"User %v already exist":                                "用户 %v 已存在",
+	"Username can not be empty":                            "用户名不能为空",
+	"incorrect password":                                   "密码错误",
+	"You are not monitoring %v":                            "您没有监控 %v",
+	"%v is already in monitoring list":                     "%v 已在监控列表中",
+	"%q should be a host":                                  "%v 应该是一个主机",
+	"unknown kind %v":                                      "未知的类型 %v",
+	"ttl should be between 1 and %v hours":                 "有效期应在 1 到 %v 小时之间",
+	"invalid share token":                                  "无效的分享令牌",
+	"share token is expired":                               "分享令牌已过期",
+	"invalid time range %v":                                "无效的时间范围 %v",
+	"unknown timezone %v":                                  "未知的时区 %v",
+	"unknown units %v":                                     "未知的单位 %v",
+	"unknown chart type %v":                                "未知的图表类型 %v",
+	"unknown metric %v":                                    "未知的指标 %v",
+	"unknown resolution %v":                                "未知的分辨率 %v",
+	"unknown annotation kind %v":                           "未知的注释类型 %v",
+	"annotation %v not exist":                              "注释 %v 不存在",
+	"check template %v not exist":                          "检查模板 %v 不存在",
+	"template name can not be empty":                       "模板名称不能为空",
+	"slo %v not exist":                                     "服务等级目标 %v 不存在",
+	"slo name can not be empty":                            "服务等级目标名称不能为空",
+	"server %v is not monitored by %v":                     "%[2]v 没有监控 %[1]v",
+	"unknown format %v":                                    "未知的格式 %v",
+	"unknown severity %v":                                  "未知的严重级别 %v",
+	"unknown state %v":                                     "未知的状态 %v",
+	"channel name can not be empty":                        "通知渠道名称不能为空",
+	"unknown channel type %v":                              "未知的通知渠道类型 %v",
+	"%v is not a valid hostname":                           "%v 不是有效的主机名",
+	"%v is blocked":                                        "%v 已被屏蔽",
+	"%v is not allowed":                                    "%v 不在允许范围内",
+	"%v opted out of monitoring":                           "%v 已选择退出监控",
+	"%v: %v opted out of monitoring":                       "%v：%v 已选择退出监控",
+	"can not resolve %v: %v":                               "无法解析 %v：%v",
+	"%v resolves to no address":                            "%v 没有解析到任何地址",
+	"store is closed":                                      "存储已关闭",
+	"store is read only for maintenance":                   "存储处于只读维护模式",
+	"read only replica of %v, please write to the primary": "这是 %v 的只读副本，请写入主服务器",
+	"locale %v should be a language tag like en or pt-BR":  "语言 %v 应为语言标签，例如 en 或 pt-BR",
+	"asn database is not configured":                       "未配置 ASN 数据库",
+	"unknown field %v in filter":                           "过滤条件中的字段 %v 未知",
+	"filter is longer than %v":                             "过滤条件超过 %v 个字符",
+	"the ownership of %v should be verified before adding %v checks": "添加 %[2]v 检查前应先验证 %[1]v 的所有权",
+	"%v is not claimed":                "%v 尚未声明所有权",
+	"host can not be empty":            "主机不能为空",
+	"can not verify %v: %v, %v":        "无法验证 %v：%v，%v",
+	"unknown message kind %v":          "未知的消息类型 %v",
+	"message text should not be empty": "消息内容不能为空",
+	"sms gateway is not configured":    "未配置短信网关",
+	"phone %v should be in the international format like +14155552671": "电话 %v 应为国际格式，例如 +14155552671",
+	"phone %v should be verified before adding sms channels":           "添加短信渠道前应先验证电话 %v",
+	"phone %v is already verified":                                     "电话 %v 已验证",
+	"a code was sent to %v in the last minute":                         "最近一分钟内已向 %v 发送过验证码",
+	"no code was sent to %v":                                           "未向 %v 发送过验证码",
+	"too many codes sent, retry later":                                 "发送的验证码过多，请稍后重试",
+	"verify the phones pending before %v":                              "请先验证待验证的电话再添加 %v",
+	"the code sent to %v expired":                                      "发送给 %v 的验证码已失效",
+	"wrong code of %v":                                                 "%v 的验证码错误",
+	"phone %v not exist":                                               "电话 %v 不存在",
+
+	// notifications, see alert.Alert.String
+	"[%v] %v: %v of %v on %v servers of %v: %v":       "[%v] %v：%[4]v 的规则 %[3]v 在 %[6]v 的 %[5]v 台服务器上：%[7]v",
+	"digest of %v alerts":                             "%v 条告警摘要",
+	"and %v more":                                     "另有 %v 条",
+	"your watchdog verification code is %v":           "您的 watchdog 验证码为 %v",
+	"[%v] %v: %v of %v on %v from %v, value %v at %v": "[%v] %v：%[4]v 的规则 %[3]v 在 %[5]v（来自 %[6]v），数值 %[7]v，时间 %[8]v",
+	"firing":   "触发",
+	"resolved": "已恢复",
+	"info":     "信息",
+	"warning":  "警告",
+	"critical": "严重",
+}
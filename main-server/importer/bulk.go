@@ -0,0 +1,243 @@
+package importer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+// the importer label of the hosts of the bulk imports
+const BULK_IMPORTER = "bulk"
+
+// the addresses a bulk import expands at most, a /20 of ipv4
+const MAX_BULK_HOSTS = 1 << _MAX_BULK_BITS
+
+const _MAX_BULK_BITS = 12
+
+// Bulk imports the names of the address records of a zone file, or the addresses of a CIDR range, labeled by Labels
+// the hosts not answering a ping from the main server are skipped unless Unreachable is true
+type Bulk struct {
+	Zone string `json:"zone,omitempty"`
+	// the origin of the relative names of the zone, unless the zone sets $ORIGIN
+	Origin      string            `json:"origin,omitempty"`
+	CIDR        string            `json:"cidr,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Unreachable bool              `json:"unreachable,omitempty"`
+}
+
+// BulkReport is the changes of a bulk import and the hosts skipped, host -> why
+type BulkReport struct {
+	Changes []store.Change    `json:"changes"`
+	Skipped map[string]string `json:"skipped"`
+}
+
+// Hosts expands the zone or the CIDR range of the bulk import
+func (b Bulk) Hosts() ([]Host, error) {
+	var (
+		hosts []Host
+		err   error
+	)
+	switch {
+	case (b.Zone == "") == (b.CIDR == ""):
+		return nil, fmt.Errorf("either zone or cidr of the bulk import should be set")
+	case b.Zone != "":
+		hosts, err = ParseZone(strings.NewReader(b.Zone), b.Origin)
+	default:
+		var addrs []string
+		if addrs, err = ExpandCIDR(b.CIDR); err == nil {
+			hosts = make([]Host, 0, len(addrs))
+			for _, addr := range addrs {
+				hosts = append(hosts, Host{Name: addr, Labels: map[string]string{"cidr": b.CIDR}})
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		for k, v := range b.Labels {
+			h.Labels[k] = v
+		}
+	}
+	return hosts, nil
+}
+
+// ExpandCIDR returns the addresses of the range, without the network and broadcast addresses of an ipv4 range longer than /31
+func ExpandCIDR(cidr string) ([]string, error) {
+	ip, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := ipnet.Mask.Size()
+	if bits-ones > _MAX_BULK_BITS {
+		return nil, fmt.Errorf("%v has more than %v addresses", cidr, MAX_BULK_HOSTS)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	ip = ip.Mask(ipnet.Mask)
+	addrs := make([]string, 0, 1<<uint(bits-ones))
+	for ; ipnet.Contains(ip); ip = next(ip) {
+		addrs = append(addrs, ip.String())
+	}
+	if bits == 32 && bits-ones > 1 {
+		addrs = addrs[1 : len(addrs)-1]
+	}
+	return addrs, nil
+}
+
+// the address after ip, the zero address after the last one
+func next(ip net.IP) net.IP {
+	ret := append(net.IP(nil), ip...)
+	for i := len(ret) - 1; i >= 0; i-- {
+		if ret[i]++; ret[i] != 0 {
+			break
+		}
+	}
+	return ret
+}
+
+// ParseZone returns the names of the A, AAAA and CNAME records of the zone file, labeled by the zone
+// relative names are of origin, or of $ORIGIN, wildcard names are skipped
+func ParseZone(r io.Reader, origin string) ([]Host, error) {
+	origin = strings.TrimSuffix(origin, ".")
+	var (
+		hosts        []Host
+		seen         = make(map[string]bool)
+		owner, entry string
+		depth, line  int
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line++
+		s := scanner.Text()
+		if i := strings.IndexByte(s, ';'); i >= 0 {
+			s = s[:i]
+		}
+		// the records in parentheses continue on the next lines, like SOA
+		if depth == 0 {
+			entry = s
+		} else {
+			entry += " " + s
+		}
+		depth += strings.Count(s, "(") - strings.Count(s, ")")
+		if depth > 0 || strings.TrimSpace(entry) == "" {
+			continue
+		}
+		fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ").Replace(entry))
+		switch strings.ToUpper(fields[0]) {
+		case "$ORIGIN":
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %v: $ORIGIN without the origin", line)
+			}
+			origin = absolute(fields[1], origin)
+			continue
+		case "$TTL":
+			continue
+		case "$INCLUDE", "$GENERATE":
+			return nil, fmt.Errorf("line %v: %v is not supported", line, fields[0])
+		}
+		// a record starting with a space is of the owner of the previous one
+		if !unicode.IsSpace(rune(entry[0])) {
+			owner, fields = absolute(fields[0], origin), fields[1:]
+		}
+		for len(fields) > 0 && (isTTL(fields[0]) || isClass(fields[0])) {
+			fields = fields[1:]
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %v: record without type or data", line)
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "A", "AAAA", "CNAME":
+			if owner == "" || strings.HasPrefix(owner, "*") || seen[owner] {
+				continue
+			}
+			seen[owner] = true
+			hosts = append(hosts, Host{Name: owner, Labels: map[string]string{"zone": origin}})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("line %v: unbalanced parentheses", line)
+	}
+	return hosts, nil
+}
+
+// the name without the trailing dot, relative names are of origin
+func absolute(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case origin == "":
+		return name
+	}
+	return name + "." + origin
+}
+
+func isTTL(s string) bool { return s[0] >= '0' && s[0] <= '9' }
+
+func isClass(s string) bool {
+	switch strings.ToUpper(s) {
+	case "IN", "CH", "HS", "CS":
+		return true
+	}
+	return false
+}
+
+// LabelsOfPTR returns the labels of a host by the name of its PTR record, like ptr=web-01.fra1.example.com and role=web
+func LabelsOfPTR(name string) map[string]string {
+	name = strings.TrimSuffix(name, ".")
+	labels := map[string]string{"ptr": name}
+	first := strings.SplitN(name, ".", 2)[0]
+	if role := strings.TrimRight(first, "0123456789-_"); role != "" {
+		labels["role"] = role
+	}
+	return labels
+}
+
+// CheckHosts checks the hosts of a bulk import by the workers, returns the labels of the hosts passing and why the others are skipped
+// the hosts validate rejects are skipped without a check, check returns why the host is skipped, empty if it passes, and may label it
+func CheckHosts(list []Host, workers int, validate func(name string) error, check func(h *Host) string) (hosts map[string]map[string]string, skipped map[string]string) {
+	hosts, skipped = make(map[string]map[string]string, len(list)), make(map[string]string)
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, workers)
+	)
+	for _, h := range list {
+		if err := validate(h.Name); err != nil {
+			mu.Lock()
+			skipped[h.Name] = err.Error()
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(h Host) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			reason := check(&h)
+			mu.Lock()
+			defer mu.Unlock()
+			if reason != "" {
+				skipped[h.Name] = reason
+			} else {
+				hosts[h.Name] = h.Labels
+			}
+		}(h)
+	}
+	wg.Wait()
+	return
+}
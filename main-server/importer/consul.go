@@ -0,0 +1,77 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// lists the nodes of the consul catalog of config url, or the nodes of config service if set
+// config datacenter defaults to the one of the agent, config token is the acl token
+// the hosts are the node addresses, or the node names if config address is name, labeled by the node meta and the datacenter
+type consulImporter struct {
+	url, service, datacenter, token, address string
+}
+
+func newConsulImporter(config map[string]string) (Importer, error) {
+	if config["url"] == "" {
+		return nil, fmt.Errorf("url of consul is required")
+	}
+	a, err := address(config)
+	if err != nil {
+		return nil, err
+	}
+	if a == ADDRESS_PRIVATE {
+		return nil, fmt.Errorf("address of consul should be %v or %v", ADDRESS_PUBLIC, ADDRESS_NAME)
+	}
+	return consulImporter{
+		url: strings.TrimSuffix(config["url"], "/"), service: config["service"], datacenter: config["datacenter"], token: config["token"], address: a,
+	}, nil
+}
+
+type consulNode struct {
+	Node       string            `json:"Node"`
+	Address    string            `json:"Address"`
+	Datacenter string            `json:"Datacenter"`
+	Meta       map[string]string `json:"Meta"`
+	NodeMeta   map[string]string `json:"NodeMeta"`
+}
+
+func (c consulImporter) Hosts(ctx context.Context) ([]Host, error) {
+	u := c.url + "/v1/catalog/nodes"
+	if c.service != "" {
+		u = c.url + "/v1/catalog/service/" + url.PathEscape(c.service)
+	}
+	if c.datacenter != "" {
+		u += "?dc=" + url.QueryEscape(c.datacenter)
+	}
+	header := make(map[string]string)
+	if c.token != "" {
+		header["X-Consul-Token"] = c.token
+	}
+	var nodes []consulNode
+	if err := getJSON(ctx, u, header, &nodes); err != nil {
+		return nil, err
+	}
+	hosts := make([]Host, 0, len(nodes))
+	seen := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		labels := make(map[string]string, len(n.Meta)+len(n.NodeMeta)+1)
+		// the catalog of a service lists the meta of the nodes as NodeMeta
+		for _, meta := range []map[string]string{n.Meta, n.NodeMeta} {
+			for k, v := range meta {
+				labels[k] = v
+			}
+		}
+		if n.Datacenter != "" {
+			labels["datacenter"] = n.Datacenter
+		}
+		// a node is listed once per instance of the service
+		if h := pick(c.address, n.Address, "", n.Node, labels); h != nil && !seen[h.Name] {
+			seen[h.Name] = true
+			hosts = append(hosts, *h)
+		}
+	}
+	return hosts, nil
+}
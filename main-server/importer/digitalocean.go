@@ -0,0 +1,94 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const _DIGITALOCEAN_URL = "https://api.digitalocean.com"
+
+// lists the active droplets of the digitalocean account of config token, optionally of config tag
+// the hosts are labeled by the region and the tags, a tag "key:value" is the label key=value, others are the label tag=true
+type digitalOceanImporter struct {
+	url, token, tag, address string
+}
+
+func newDigitalOceanImporter(config map[string]string) (Importer, error) {
+	if config["token"] == "" {
+		return nil, fmt.Errorf("token of digitalocean is required")
+	}
+	a, err := address(config)
+	if err != nil {
+		return nil, err
+	}
+	d := digitalOceanImporter{url: _DIGITALOCEAN_URL, token: config["token"], tag: config["tag"], address: a}
+	if config["url"] != "" {
+		d.url = strings.TrimSuffix(config["url"], "/")
+	}
+	return d, nil
+}
+
+type digitalOceanDroplets struct {
+	Droplets []struct {
+		Name     string   `json:"name"`
+		Status   string   `json:"status"`
+		Tags     []string `json:"tags"`
+		Networks struct {
+			V4 []struct {
+				IPAddress string `json:"ip_address"`
+				Type      string `json:"type"`
+			} `json:"v4"`
+		} `json:"networks"`
+		Region struct {
+			Slug string `json:"slug"`
+		} `json:"region"`
+	} `json:"droplets"`
+	Links struct {
+		Pages struct {
+			Next string `json:"next"`
+		} `json:"pages"`
+	} `json:"links"`
+}
+
+func (d digitalOceanImporter) Hosts(ctx context.Context) ([]Host, error) {
+	hosts := make([]Host, 0)
+	for page := 1; ; page++ {
+		q := queryOf("per_page", "200", "page", fmt.Sprint(page))
+		if d.tag != "" {
+			q.Set("tag_name", d.tag)
+		}
+		var ret digitalOceanDroplets
+		if err := getJSON(ctx, d.url+"/v2/droplets?"+q.Encode(), map[string]string{"Authorization": "Bearer " + d.token}, &ret); err != nil {
+			return nil, err
+		}
+		for _, droplet := range ret.Droplets {
+			if droplet.Status != "active" {
+				continue
+			}
+			labels := map[string]string{"region": droplet.Region.Slug}
+			for _, tag := range droplet.Tags {
+				if kv := strings.SplitN(tag, ":", 2); len(kv) == 2 {
+					labels[kv[0]] = kv[1]
+				} else {
+					labels[tag] = "true"
+				}
+			}
+			var public, private string
+			for _, n := range droplet.Networks.V4 {
+				if n.Type == "public" && public == "" {
+					public = n.IPAddress
+				} else if n.Type == "private" && private == "" {
+					private = n.IPAddress
+				}
+			}
+			if host := pick(d.address, public, private, droplet.Name, labels); host != nil {
+				hosts = append(hosts, *host)
+			}
+		}
+		if ret.Links.Pages.Next == "" {
+			break
+		}
+	}
+	return hosts, nil
+}
@@ -0,0 +1,141 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/awsv4"
+)
+
+const _EC2_API_VERSION = "2016-11-15"
+
+// lists the running instances of config region by the keys config access_key_id and secret_access_key, config session_token if temporary
+// config filters are the filters of DescribeInstances, like "tag:env=prod;instance-type=t3.micro"
+// the hosts are labeled by the tags and the availability zone
+type ec2Importer struct {
+	url, region, accessKey, secretKey, sessionToken, address string
+	filters                                                  map[string]string
+}
+
+func newEC2Importer(config map[string]string) (Importer, error) {
+	if config["region"] == "" || config["access_key_id"] == "" || config["secret_access_key"] == "" {
+		return nil, fmt.Errorf("region, access_key_id and secret_access_key of ec2 are required")
+	}
+	a, err := address(config)
+	if err != nil {
+		return nil, err
+	}
+	e := ec2Importer{
+		url:    fmt.Sprintf("https://ec2.%v.amazonaws.com", config["region"]),
+		region: config["region"], accessKey: config["access_key_id"], secretKey: config["secret_access_key"], sessionToken: config["session_token"],
+		address: a, filters: make(map[string]string),
+	}
+	if config["url"] != "" {
+		e.url = strings.TrimSuffix(config["url"], "/")
+	}
+	if config["filters"] != "" {
+		for _, f := range strings.Split(config["filters"], ";") {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, fmt.Errorf("filter %q of ec2 should be name=value", f)
+			}
+			e.filters[kv[0]] = kv[1]
+		}
+	}
+	return e, nil
+}
+
+type ec2Instances struct {
+	Reservations []struct {
+		Instances []struct {
+			PrivateIP  string `xml:"privateIpAddress"`
+			PublicIP   string `xml:"ipAddress"`
+			PrivateDNS string `xml:"privateDnsName"`
+			PublicDNS  string `xml:"dnsName"`
+			Zone       string `xml:"placement>availabilityZone"`
+			InstanceId string `xml:"instanceId"`
+			Tags       []struct {
+				Key   string `xml:"key"`
+				Value string `xml:"value"`
+			} `xml:"tagSet>item"`
+		} `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+	NextToken string `xml:"nextToken"`
+}
+
+func (e ec2Importer) Hosts(ctx context.Context) ([]Host, error) {
+	hosts := make([]Host, 0)
+	for token := ""; ; {
+		ret, err := e.describeInstances(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range ret.Reservations {
+			for _, i := range r.Instances {
+				labels := map[string]string{"zone": i.Zone, "instance_id": i.InstanceId}
+				for _, t := range i.Tags {
+					labels[t.Key] = t.Value
+				}
+				name := i.PublicDNS
+				if name == "" {
+					name = i.PrivateDNS
+				}
+				if host := pick(e.address, i.PublicIP, i.PrivateIP, name, labels); host != nil {
+					hosts = append(hosts, *host)
+				}
+			}
+		}
+		if token = ret.NextToken; token == "" {
+			return hosts, nil
+		}
+	}
+}
+
+func (e ec2Importer) describeInstances(ctx context.Context, token string) (ret ec2Instances, err error) {
+	q := queryOf("Action", "DescribeInstances", "Version", _EC2_API_VERSION, "MaxResults", "1000",
+		"Filter.1.Name", "instance-state-name", "Filter.1.Value.1", "running")
+	names := make([]string, 0, len(e.filters))
+	for name := range e.filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		q.Set(fmt.Sprintf("Filter.%d.Name", i+2), name)
+		q.Set(fmt.Sprintf("Filter.%d.Value.1", i+2), e.filters[name])
+	}
+	if token != "" {
+		q.Set("NextToken", token)
+	}
+	body := []byte(q.Encode())
+	req, err := http.NewRequest(http.MethodPost, e.url+"/", bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if e.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", e.sessionToken)
+	}
+	awsv4.Sign(req, body, e.region, "ec2", e.accessKey, e.secretKey, time.Now())
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("ec2 responds %v: %s", resp.Status, b)
+		return
+	}
+	err = xml.Unmarshal(b, &ret)
+	return
+}
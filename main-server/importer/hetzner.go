@@ -0,0 +1,86 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const _HETZNER_URL = "https://api.hetzner.cloud"
+
+// lists the running servers of the hetzner cloud project of config token, optionally selected by config label_selector
+// the hosts are labeled by the server labels and the location
+type hetznerImporter struct {
+	url, token, selector, address string
+}
+
+func newHetznerImporter(config map[string]string) (Importer, error) {
+	if config["token"] == "" {
+		return nil, fmt.Errorf("token of hetzner is required")
+	}
+	a, err := address(config)
+	if err != nil {
+		return nil, err
+	}
+	h := hetznerImporter{url: _HETZNER_URL, token: config["token"], selector: config["label_selector"], address: a}
+	if config["url"] != "" {
+		h.url = strings.TrimSuffix(config["url"], "/")
+	}
+	return h, nil
+}
+
+type hetznerServers struct {
+	Servers []struct {
+		Name      string            `json:"name"`
+		Labels    map[string]string `json:"labels"`
+		PublicNet struct {
+			IPv4 struct {
+				IP string `json:"ip"`
+			} `json:"ipv4"`
+		} `json:"public_net"`
+		PrivateNet []struct {
+			IP string `json:"ip"`
+		} `json:"private_net"`
+		Datacenter struct {
+			Location struct {
+				Name string `json:"name"`
+			} `json:"location"`
+		} `json:"datacenter"`
+	} `json:"servers"`
+	Meta struct {
+		Pagination struct {
+			NextPage int `json:"next_page"`
+		} `json:"pagination"`
+	} `json:"meta"`
+}
+
+func (h hetznerImporter) Hosts(ctx context.Context) ([]Host, error) {
+	hosts := make([]Host, 0)
+	for page := 1; page > 0; {
+		q := queryOf("status", "running", "per_page", "50", "page", fmt.Sprint(page))
+		if h.selector != "" {
+			q.Set("label_selector", h.selector)
+		}
+		var ret hetznerServers
+		if err := getJSON(ctx, h.url+"/v1/servers?"+q.Encode(), map[string]string{"Authorization": "Bearer " + h.token}, &ret); err != nil {
+			return nil, err
+		}
+		for _, s := range ret.Servers {
+			labels := make(map[string]string, len(s.Labels)+1)
+			for k, v := range s.Labels {
+				labels[k] = v
+			}
+			labels["location"] = s.Datacenter.Location.Name
+			var private string
+			if len(s.PrivateNet) > 0 {
+				private = s.PrivateNet[0].IP
+			}
+			if host := pick(h.address, s.PublicNet.IPv4.IP, private, s.Name, labels); host != nil {
+				hosts = append(hosts, *host)
+			}
+		}
+		// null on the last page
+		page = ret.Meta.Pagination.NextPage
+	}
+	return hosts, nil
+}
@@ -0,0 +1,165 @@
+// Package importer pulls the hosts of inventories, like the instances of a cloud account, to be reconciled into the monitoring lists
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	KIND_EC2          = "ec2"
+	KIND_HETZNER      = "hetzner"
+	KIND_DIGITALOCEAN = "digitalocean"
+	KIND_CONSUL       = "consul"
+)
+
+// the interval of pulling the inventory if the importer does not set it
+const DEFAULT_INTERVAL = 10 * time.Minute
+
+// the address of the hosts of the cloud inventories, config address
+const (
+	ADDRESS_PUBLIC  = "public"
+	ADDRESS_PRIVATE = "private"
+	ADDRESS_NAME    = "name"
+)
+
+const _REQUEST_TIMEOUT = 30 * time.Second
+
+var (
+	importers  = make(map[string]func(config map[string]string) (Importer, error))
+	httpClient = &http.Client{Timeout: _REQUEST_TIMEOUT}
+)
+
+// Host is a host of an inventory, Name is its address to monitor, Labels are like its tags
+type Host struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Importer lists the hosts of an inventory
+type Importer interface {
+	Hosts(ctx context.Context) ([]Host, error)
+}
+
+// Register registers the constructor of the importers of the kind
+func Register(kind string, f func(config map[string]string) (Importer, error)) error {
+	if _, ok := importers[kind]; ok {
+		return fmt.Errorf("importer %v already exist", kind)
+	}
+	importers[kind] = f
+	return nil
+}
+
+// Config is an importer reconciling the hosts of its inventory into the monitoring list of the user every Interval
+// the hosts are labeled by Labels in addition to their own, the servers of the hosts vanished are deleted if Prune is true
+type Config struct {
+	Name     string            `json:"name"`
+	Kind     string            `json:"kind"`
+	Username string            `json:"username"`
+	Interval string            `json:"interval,omitempty"`
+	Prune    bool              `json:"prune,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Config   map[string]string `json:"config"`
+}
+
+func (c Config) Validate() error {
+	if c.Name == "" || c.Username == "" {
+		return fmt.Errorf("name and username of importer are required")
+	}
+	if _, err := c.GetInterval(); err != nil {
+		return err
+	}
+	_, err := c.New()
+	return err
+}
+
+// GetInterval returns the interval of the importer, DEFAULT_INTERVAL if not set
+func (c Config) GetInterval() (time.Duration, error) {
+	if c.Interval == "" {
+		return DEFAULT_INTERVAL, nil
+	}
+	d, err := time.ParseDuration(c.Interval)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("interval of importer %v should be a positive duration", c.Name)
+	}
+	return d, nil
+}
+
+// New returns the importer of the kind configured by Config
+func (c Config) New() (Importer, error) {
+	f, ok := importers[c.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown importer kind %v", c.Kind)
+	}
+	imp, err := f(c.Config)
+	if err != nil {
+		return nil, fmt.Errorf("importer %v: %v", c.Name, err)
+	}
+	return imp, nil
+}
+
+func address(config map[string]string) (string, error) {
+	switch a := config["address"]; a {
+	case "":
+		return ADDRESS_PUBLIC, nil
+	case ADDRESS_PUBLIC, ADDRESS_PRIVATE, ADDRESS_NAME:
+		return a, nil
+	default:
+		return "", fmt.Errorf("address should be one of %v, %v and %v", ADDRESS_PUBLIC, ADDRESS_PRIVATE, ADDRESS_NAME)
+	}
+}
+
+// the host of the addresses by the address config, nil if the host has no such address, like a stopped instance
+func pick(a, public, private, name string, labels map[string]string) *Host {
+	h := Host{Name: public, Labels: labels}
+	switch a {
+	case ADDRESS_PRIVATE:
+		h.Name = private
+	case ADDRESS_NAME:
+		h.Name = name
+	}
+	if h.Name == "" {
+		return nil
+	}
+	return &h
+}
+
+// the query of the key value pairs
+func queryOf(kvs ...string) url.Values {
+	q := make(url.Values, len(kvs)/2)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		q.Set(kvs[i], kvs[i+1])
+	}
+	return q
+}
+
+func getJSON(ctx context.Context, url string, header map[string]string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v responds %v", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func init() {
+	Register(KIND_EC2, newEC2Importer)
+	Register(KIND_HETZNER, newHetznerImporter)
+	Register(KIND_DIGITALOCEAN, newDigitalOceanImporter)
+	Register(KIND_CONSUL, newConsulImporter)
+}
@@ -0,0 +1,249 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func names(hosts []Host) string {
+	ret := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		ret = append(ret, h.Name)
+	}
+	sort.Strings(ret)
+	return strings.Join(ret, ",")
+}
+
+func Test_Validate(t *testing.T) {
+	for _, bad := range []Config{
+		{Kind: KIND_CONSUL, Username: "alice", Config: map[string]string{"url": "http://consul"}},
+		{Name: "x", Kind: "gcp", Username: "alice"},
+		{Name: "x", Kind: KIND_CONSUL, Username: "alice"},
+		{Name: "x", Kind: KIND_HETZNER, Username: "alice", Config: map[string]string{"token": "t", "address": "ipv6"}},
+		{Name: "x", Kind: KIND_EC2, Username: "alice", Config: map[string]string{"region": "eu-west-1"}},
+		{Name: "x", Kind: KIND_DIGITALOCEAN, Username: "alice", Interval: "-1m", Config: map[string]string{"token": "t"}},
+	} {
+		if bad.Validate() == nil {
+			t.Errorf("importer %+v should be invalid", bad)
+		}
+	}
+	c := Config{Name: "do", Kind: KIND_DIGITALOCEAN, Username: "alice", Config: map[string]string{"token": "t"}}
+	if d, err := c.GetInterval(); err != nil || d != DEFAULT_INTERVAL {
+		t.Errorf("got %v, %v", d, err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func Test_Consul(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Consul-Token") != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/catalog/nodes":
+			fmt.Fprint(w, `[{"Node":"web-1","Address":"10.0.0.1","Datacenter":"dc1","Meta":{"role":"web"}},{"Node":"db-1","Address":"10.0.0.2","Datacenter":"dc1"}]`)
+		case "/v1/catalog/service/web":
+			fmt.Fprint(w, `[{"Node":"web-1","Address":"10.0.0.1","Datacenter":"dc1","NodeMeta":{"role":"web"}},{"Node":"web-1","Address":"10.0.0.1","Datacenter":"dc1"}]`)
+		}
+	}))
+	defer ts.Close()
+
+	imp, err := Config{Name: "consul", Kind: KIND_CONSUL, Config: map[string]string{"url": ts.URL, "token": "secret"}}.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := imp.Hosts(context.Background())
+	if err != nil || names(hosts) != "10.0.0.1,10.0.0.2" || hosts[0].Labels["role"] != "web" || hosts[0].Labels["datacenter"] != "dc1" {
+		t.Errorf("got %+v, %v", hosts, err)
+	}
+	imp, _ = Config{Name: "consul", Kind: KIND_CONSUL, Config: map[string]string{"url": ts.URL, "token": "secret", "service": "web", "address": ADDRESS_NAME}}.New()
+	if hosts, err = imp.Hosts(context.Background()); err != nil || names(hosts) != "web-1" || hosts[0].Labels["role"] != "web" {
+		t.Errorf("want the node of the service listed once, got %+v, %v", hosts, err)
+	}
+	imp, _ = Config{Name: "consul", Kind: KIND_CONSUL, Config: map[string]string{"url": ts.URL}}.New()
+	if _, err = imp.Hosts(context.Background()); err == nil {
+		t.Error("want the error of the denied request")
+	}
+}
+
+func Test_Hetzner(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.URL.Query().Get("label_selector") != "env=prod" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("page") == "1" {
+			fmt.Fprint(w, `{"servers":[{"name":"web-1","labels":{"env":"prod"},"public_net":{"ipv4":{"ip":"1.1.1.1"}},"private_net":[{"ip":"10.0.0.1"}],"datacenter":{"location":{"name":"fsn1"}}}],"meta":{"pagination":{"next_page":2}}}`)
+			return
+		}
+		fmt.Fprint(w, `{"servers":[{"name":"web-2","public_net":{"ipv4":{"ip":"1.1.1.2"}},"datacenter":{"location":{"name":"nbg1"}}}],"meta":{"pagination":{"next_page":null}}}`)
+	}))
+	defer ts.Close()
+
+	imp, _ := Config{Name: "hetzner", Kind: KIND_HETZNER, Config: map[string]string{"url": ts.URL, "token": "secret", "label_selector": "env=prod"}}.New()
+	hosts, err := imp.Hosts(context.Background())
+	if err != nil || names(hosts) != "1.1.1.1,1.1.1.2" || hosts[0].Labels["env"] != "prod" || hosts[1].Labels["location"] != "nbg1" {
+		t.Errorf("got %+v, %v", hosts, err)
+	}
+	imp, _ = Config{Name: "hetzner", Kind: KIND_HETZNER, Config: map[string]string{"url": ts.URL, "token": "secret", "label_selector": "env=prod", "address": ADDRESS_PRIVATE}}.New()
+	if hosts, err = imp.Hosts(context.Background()); err != nil || names(hosts) != "10.0.0.1" {
+		t.Errorf("want the servers without private address skipped, got %+v, %v", hosts, err)
+	}
+}
+
+func Test_DigitalOcean(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "1" {
+			fmt.Fprintf(w, `{"droplets":[{"name":"web-1","status":"active","tags":["env:prod","web"],"networks":{"v4":[{"ip_address":"10.0.0.1","type":"private"},{"ip_address":"1.1.1.1","type":"public"}]},"region":{"slug":"ams3"}}],"links":{"pages":{"next":"%v/v2/droplets?page=2"}}}`, ts.URL)
+			return
+		}
+		fmt.Fprint(w, `{"droplets":[{"name":"off","status":"off","networks":{"v4":[{"ip_address":"1.1.1.2","type":"public"}]}}],"links":{}}`)
+	}))
+	defer ts.Close()
+
+	imp, _ := Config{Name: "do", Kind: KIND_DIGITALOCEAN, Config: map[string]string{"url": ts.URL, "token": "secret"}}.New()
+	hosts, err := imp.Hosts(context.Background())
+	if err != nil || names(hosts) != "1.1.1.1" {
+		t.Fatalf("got %+v, %v", hosts, err)
+	}
+	if labels := hosts[0].Labels; labels["env"] != "prod" || labels["web"] != "true" || labels["region"] != "ams3" {
+		t.Errorf("got labels %v", labels)
+	}
+}
+
+func Test_EC2(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || r.Form.Get("Filter.2.Name") != "tag:env" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.Form.Get("NextToken") == "" {
+			fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-1</instanceId>
+<privateIpAddress>10.0.0.1</privateIpAddress><ipAddress>1.1.1.1</ipAddress><placement><availabilityZone>eu-west-1a</availabilityZone></placement>
+<tagSet><item><key>env</key><value>prod</value></item></tagSet></item></instancesSet></item></reservationSet><nextToken>next</nextToken></DescribeInstancesResponse>`)
+			return
+		}
+		fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet><item><instanceId>i-2</instanceId>
+<privateIpAddress>10.0.0.2</privateIpAddress></item></instancesSet></item></reservationSet></DescribeInstancesResponse>`)
+	}))
+	defer ts.Close()
+
+	config := map[string]string{"url": ts.URL, "region": "eu-west-1", "access_key_id": "AKID", "secret_access_key": "secret", "filters": "tag:env=prod"}
+	imp, err := Config{Name: "ec2", Kind: KIND_EC2, Config: config}.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := imp.Hosts(context.Background())
+	if err != nil || names(hosts) != "1.1.1.1" || hosts[0].Labels["env"] != "prod" || hosts[0].Labels["zone"] != "eu-west-1a" {
+		t.Errorf("want the instances without public address skipped, got %+v, %v", hosts, err)
+	}
+	config["address"] = ADDRESS_PRIVATE
+	imp, _ = Config{Name: "ec2", Kind: KIND_EC2, Config: config}.New()
+	if hosts, err = imp.Hosts(context.Background()); err != nil || names(hosts) != "10.0.0.1,10.0.0.2" {
+		t.Errorf("got %+v, %v", hosts, err)
+	}
+}
+
+func Test_ParseZone(t *testing.T) {
+	zone := `$TTL 3600
+$ORIGIN example.com.
+@	IN	SOA	ns1 admin (
+		2015010101 ; serial
+		3600 900 604800 300 )
+	IN	NS	ns1
+	IN	A	1.1.1.1
+www	300	IN	A	1.1.1.1 ; the web server
+	IN	AAAA	::1
+api		CNAME	www
+*	IN	A	1.1.1.3
+mail	IN	MX	10 mx.other.com.
+db.internal.com.	IN	A	10.0.0.1
+`
+	hosts, err := ParseZone(strings.NewReader(zone), "")
+	if err != nil || names(hosts) != "api.example.com,db.internal.com,example.com,www.example.com" {
+		t.Fatalf("got %+v, %v", hosts, err)
+	}
+	if hosts[0].Labels["zone"] != "example.com" {
+		t.Errorf("got labels %v", hosts[0].Labels)
+	}
+	if hosts, err = ParseZone(strings.NewReader("www A 1.1.1.1"), "example.org."); err != nil || names(hosts) != "www.example.org" {
+		t.Errorf("want the names relative to the origin, got %+v, %v", hosts, err)
+	}
+	for _, bad := range []string{"@ SOA ns1 admin ( 1 2", "$INCLUDE other.zone", "www IN"} {
+		if _, err = ParseZone(strings.NewReader(bad), "example.com"); err == nil {
+			t.Errorf("zone %q should be invalid", bad)
+		}
+	}
+}
+
+func Test_ExpandCIDR(t *testing.T) {
+	addrs, err := ExpandCIDR("10.0.0.5/24")
+	if err != nil || len(addrs) != 254 || addrs[0] != "10.0.0.1" || addrs[253] != "10.0.0.254" {
+		t.Errorf("got %v addresses, %v", len(addrs), err)
+	}
+	if addrs, _ = ExpandCIDR("10.0.0.0/31"); fmt.Sprint(addrs) != "[10.0.0.0 10.0.0.1]" {
+		t.Errorf("want both addresses of a point to point range, got %v", addrs)
+	}
+	if addrs, _ = ExpandCIDR("2001:db8::/126"); len(addrs) != 4 || addrs[3] != "2001:db8::3" {
+		t.Errorf("got %v", addrs)
+	}
+	for _, bad := range []string{"10.0.0.0/16", "2001:db8::/64", "10.0.0.1"} {
+		if _, err = ExpandCIDR(bad); err == nil {
+			t.Errorf("want the error of %v", bad)
+		}
+	}
+	hosts, err := Bulk{CIDR: "10.0.0.0/30", Labels: map[string]string{"role": "db"}}.Hosts()
+	if err != nil || names(hosts) != "10.0.0.1,10.0.0.2" || hosts[0].Labels["role"] != "db" || hosts[0].Labels["cidr"] != "10.0.0.0/30" {
+		t.Errorf("got %+v, %v", hosts, err)
+	}
+	if _, err = (Bulk{}).Hosts(); err == nil {
+		t.Error("want the error of neither zone nor cidr")
+	}
+}
+
+func Test_LabelsOfPTR(t *testing.T) {
+	labels := LabelsOfPTR("web-01.fra1.example.com.")
+	if labels["ptr"] != "web-01.fra1.example.com" || labels["role"] != "web" {
+		t.Errorf("got %v", labels)
+	}
+	if labels = LabelsOfPTR("1.0.0.10.in-addr.arpa."); len(labels) != 1 {
+		t.Errorf("want no role of a numeric name, got %v", labels)
+	}
+}
+
+func Test_CheckHosts(t *testing.T) {
+	var list []Host
+	for i := 0; i < 64; i++ {
+		list = append(list, Host{Name: fmt.Sprintf("h%v.example.com", i), Labels: map[string]string{}})
+	}
+	validate := func(name string) error {
+		if strings.HasSuffix(name, "0.example.com") {
+			return fmt.Errorf("blocked")
+		}
+		return nil
+	}
+	check := func(h *Host) string {
+		if strings.HasSuffix(h.Name, "1.example.com") {
+			return "unreachable"
+		}
+		h.Labels["checked"] = "true"
+		return ""
+	}
+	hosts, skipped := CheckHosts(list, 8, validate, check)
+	if len(hosts)+len(skipped) != len(list) || len(skipped) != 14 {
+		t.Fatalf("got %v hosts, %v skipped", len(hosts), len(skipped))
+	}
+	if skipped["h10.example.com"] != "blocked" || skipped["h11.example.com"] != "unreachable" || hosts["h12.example.com"]["checked"] != "true" {
+		t.Errorf("got %v, %v", hosts["h12.example.com"], skipped)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/importer"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/probe"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+// the owner of the key of an importer runs it if sharded
+const _IMPORTER_SHARD_KEY = "importer "
+
+// the hosts of a bulk import checked at once, and the timeout of checking one
+const (
+	_BULK_WORKERS = 32
+	_BULK_TIMEOUT = 2 * time.Second
+)
+
+// the main server pings the hosts of the bulk imports in the most precise icmp mode permitted, detected once
+var bulkICMP sync.Once
+
+type importJob struct {
+	importer.Config
+	imp      importer.Importer
+	interval time.Duration
+}
+
+// name -> the importers of -importers
+var importJobs = make(map[string]importJob)
+
+func parseImporters(s string) ([]importer.Config, error) {
+	var configs []importer.Config
+	if err := json.Unmarshal([]byte(s), &configs); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(configs))
+	for _, c := range configs {
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("importer %v is duplicated", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return configs, nil
+}
+
+// pull the inventory and reconcile it into the monitoring list of the user of the importer
+// the hosts the target policy denies are skipped, the servers are not pruned if the inventory is empty
+// which is more likely a broken credential or filter than every host gone
+func runImport(ctx context.Context, j importJob, dryRun bool) ([]store.Change, error) {
+	ctx, cancel := context.WithTimeout(ctx, j.interval)
+	defer cancel()
+	l := logger.With("importer", j.Name, "username", j.Username)
+	list, err := j.imp.Hosts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("can not list the hosts of importer %v: %v", j.Name, err)
+	}
+	hosts := make(map[string]map[string]string, len(list))
+	for _, h := range list {
+		if err = targetPolicy.Validate(h.Name); err != nil {
+			l.Warn("skip host %v: %v", h.Name, err)
+			continue
+		}
+		labels := make(map[string]string, len(h.Labels)+len(j.Labels))
+		for _, m := range []map[string]string{h.Labels, j.Labels} {
+			for k, v := range m {
+				labels[k] = v
+			}
+		}
+		hosts[h.Name] = labels
+	}
+	prune := j.Prune
+	if prune && len(hosts) == 0 {
+		l.Warn("the inventory is empty, the servers of the importer are not pruned")
+		prune = false
+	}
+	changes, err := storeEngine.Import(ctx, j.Username, j.Name, hosts, prune, dryRun)
+	if err == nil && !dryRun && len(changes) > 0 {
+		l.Info("imported %v changes from %v hosts", len(changes), len(hosts))
+	}
+	return changes, err
+}
+
+func initImporters() {
+	if *flagImporters == "" {
+		return
+	}
+	configs, err := parseImporters(*flagImporters)
+	if err != nil {
+		panic(fmt.Errorf("can not parse importers: %v", err))
+	}
+	for _, c := range configs {
+		j := importJob{Config: c}
+		j.imp, _ = c.New()
+		j.interval, _ = c.GetInterval()
+		importJobs[c.Name] = j
+		go func(j importJob) {
+			for {
+				// the leader, or the owner of the importer if sharded, runs it, never the replica
+				if shouldPing(_IMPORTER_SHARD_KEY+j.Name) && checkWritable() == nil {
+					if _, err := runImport(context.Background(), j, false); err != nil {
+						logger.With("importer", j.Name).Error("%v", err)
+					}
+				}
+				<-time.After(j.interval)
+			}
+		}(j)
+	}
+}
+
+// run the importer of the name now and return the changes, nothing is changed if dryRun is true
+func (adminServerStub) Import(name string, dryRun bool, ctx hprose.Context) ([]store.Change, error) {
+	j, ok := importJobs[name]
+	if !ok {
+		return nil, fmt.Errorf("importer %v not exist", name)
+	}
+	if err := checkWritable(); !dryRun && err != nil {
+		return nil, err
+	}
+	return runImport(requestContext(ctx), j, dryRun)
+}
+
+// expand the bulk import, label the addresses by their PTR records and skip the hosts denied by the target policy or not answering a ping
+func bulkImport(ctx context.Context, username string, b importer.Bulk, dryRun bool) (report importer.BulkReport, err error) {
+	list, err := b.Hosts()
+	if err != nil {
+		return
+	}
+	bulkICMP.Do(func() { probe.SetICMPMode(probe.DetectICMPMode()) })
+	hosts, skipped := importer.CheckHosts(list, _BULK_WORKERS, targetPolicy.Validate, func(h *importer.Host) string {
+		if net.ParseIP(h.Name) != nil {
+			// the labels of the bulk import win
+			if names, err := net.DefaultResolver.LookupAddr(ctx, h.Name); err == nil && len(names) > 0 {
+				for k, v := range importer.LabelsOfPTR(names[0]) {
+					if _, ok := h.Labels[k]; !ok {
+						h.Labels[k] = v
+					}
+				}
+			}
+		}
+		if !b.Unreachable {
+			if r := probe.Check(probe.TargetOf(h.Name), _BULK_TIMEOUT); r.Err != "" {
+				return "unreachable: " + r.Err
+			} else if r.Avg == 0 {
+				return "unreachable"
+			}
+		}
+		return ""
+	})
+	report.Skipped = skipped
+	report.Changes, err = storeEngine.Import(ctx, username, importer.BULK_IMPORTER, hosts, false, dryRun)
+	return
+}
+
+// bulk add the names of a zone file or the addresses of a CIDR range to the monitoring list of the user, see importer.Bulk
+// nothing is changed if dryRun is true, the hosts are checked anyway
+func (adminServerStub) BulkImport(username string, b importer.Bulk, dryRun bool, ctx hprose.Context) (importer.BulkReport, error) {
+	if err := checkWritable(); !dryRun && err != nil {
+		return importer.BulkReport{}, err
+	}
+	return bulkImport(requestContext(ctx), username, b, dryRun)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+// the inboxes are pruned on it, the messages beyond -inboxretention are not shown meanwhile anyway
+const _INBOX_PRUNE_INTERVAL = time.Hour
+
+// the leader drops the messages beyond the retention from the inboxes on interval, the replicas follow the primary
+func pruneInboxLoop() {
+	for range time.Tick(_INBOX_PRUNE_INTERVAL) {
+		if isReplica() {
+			return
+		}
+		if !isLeader() {
+			continue
+		}
+		n, err := storeEngine.PruneInboxes(context.Background())
+		if err != nil {
+			logger.Error("can not prune the inboxes: %v", err)
+			continue
+		}
+		if n > 0 {
+			logger.With("dropped", n).Info("pruned the inboxes")
+		}
+	}
+}
+
+// the alerts notified are posted to the inbox of the user as well, so that the web ui shows them without any channel
+func postAlert(a alert.Alert) {
+	if checkWritable() != nil {
+		return
+	}
+	if _, err := storeEngine.PostMessage(context.Background(), a.Username, store.Message{Kind: store.MESSAGE_ALERT, Text: a.Text(), Alert: &a}); err != nil {
+		logger.With("username", a.Username).Warn("can not post alert to inbox: %v", err)
+	}
+}
+
+// get the latest n messages of the inbox of the user, all of them if n is not positive, only the unread ones if unread is true,
+// and the number of the unread ones
+// update session life
+func (mainServerStub) GetInbox(sid, username string, unread bool, n int) (messages []store.Message, unreadCount int, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if messages, unreadCount, err = storeEngine.GetInbox(username, unread, n); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// mark the messages of the ids read, all of them if ids is empty, returns the messages marked
+// update session life
+func (mainServerStub) MarkRead(sid, username string, ids []string, ctx hprose.Context) (n int, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if n, err = storeEngine.MarkRead(requestContext(ctx), username, ids); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// post the system message to the inbox of every user, like a maintenance announced, returns the users it was posted to
+func (adminServerStub) Broadcast(text string, ctx hprose.Context) (int, error) {
+	if err := checkWritable(); err != nil {
+		return 0, err
+	}
+	return storeEngine.Broadcast(requestContext(ctx), store.Message{Kind: store.MESSAGE_SYSTEM, Text: text})
+}
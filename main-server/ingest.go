@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/main-server/compress"
+	"github.com/gogames/watchdog/main-server/pipeline"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/probe"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+const (
+	_INGEST_PATH      = "/ingest"
+	_INGEST_LOCATION  = "webhook"
+	_MAX_INGEST_BYTES = 1 << 12
+)
+
+// the bodies of the samples pushed, at most _MAX_INGEST_BYTES each, reused across the requests
+var ingestBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// a sample pushed by an external system, like a cron job or another monitor
+type ingestSample struct {
+	Latency float64 `json:"latency"`
+	Down    bool    `json:"down"`
+}
+
+// POST /ingest?server=<virtual server>[&location=<location>] with "Authorization: Bearer <ingest token>"
+// the sample is stored and charted as a ping result of the current minute by the ingestion pipeline, 429 with Retry-After if it is full
+func ingestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	server, location := r.URL.Query().Get("server"), r.URL.Query().Get("location")
+	if location == "" {
+		location = _INGEST_LOCATION
+	}
+	if !storeEngine.CheckIngestToken(server, strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+		http.Error(w, "invalid ingest token", http.StatusUnauthorized)
+		return
+	}
+	if err := checkWritable(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	var sample ingestSample
+	buf := ingestBuffers.Get().(*bytes.Buffer)
+	defer ingestBuffers.Put(buf)
+	buf.Reset()
+	_, err := buf.ReadFrom(http.MaxBytesReader(w, r.Body, _MAX_INGEST_BYTES))
+	if err == nil {
+		err = json.Unmarshal(buf.Bytes(), &sample)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("can not decode sample: %v", err), http.StatusBadRequest)
+		return
+	}
+	if sample.Down {
+		sample.Latency = 0
+	} else if sample.Latency < 0 || sample.Latency > probe.MAX_LATENCY {
+		http.Error(w, fmt.Sprintf("latency %v is out of [0, %v]", sample.Latency, probe.MAX_LATENCY), http.StatusBadRequest)
+		return
+	}
+	p := store.PingRet{
+		Ping:         fmt.Sprintf("%.3f", sample.Latency),
+		Time:         time.Now().Format(_TIME_LAYOUT),
+		ReceivedTime: time.Now().Format(time.RFC3339),
+	}
+	j := pipeline.Job{Server: server, Location: location, PingRets: []store.PingRet{p}, Sample: alert.Sample{Time: p.Time, Ping: sample.Latency, Down: sample.Latency == 0}, Evaluate: true}
+	if retryAfter, ok := ingestion.Push([]pipeline.Job{j}); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+		http.Error(w, "too many samples queued, retry later", http.StatusTooManyRequests)
+		return
+	}
+	countIngestion(server, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// add a virtual server of the name, its samples are pushed to /ingest by the token rather than pinged
+// update session life
+func (mainServerStub) AddVirtualServer(sid, username, name string, ctx hprose.Context) (server, token string, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if server, token, err = storeEngine.AddVirtualServer(requestContext(ctx), username, name); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+func initIngest() {
+	mainMux.Handle(_INGEST_PATH, instrument("ingest", compress.Handler(http.HandlerFunc(ingestHandler))))
+}
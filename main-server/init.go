@@ -7,10 +7,27 @@ func init() {
 
 	initFlag()
 	initLogger()
+	initTrace()
+	initNotifyPlugins()
+	initSMS()
+	initDigests()
+	initCorrelations()
 	initShutdown()
+	initASN()
+	initPipeline()
 	initPingServer()
 	initPingClientManager()
 	initSession()
 	initMainServer()
+	initAdminServer()
 	initStore()
+	initOptOuts()
+	initLeader()
+	initShard()
+	initReplica()
+	initProbeMatrix()
+	initDeadProbe()
+	initSLO()
+	initImporters()
+	initReload()
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// 1 if the main server leads the main servers sharing the store engine
+var leader int32 = 1
+
+func isLeader() bool { return atomic.LoadInt32(&leader) == 1 }
+
+func nodeId() string {
+	if *flagNodeId != "" {
+		return *flagNodeId
+	}
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%v:%v", hostname, *flagMainServerPort)
+}
+
+// without -ha the main server is always the leader
+// with -ha the main servers campaign for the lease of the store engine, only the leader pings the servers
+// all of them serve the users and reload the store engine every -hasync to see the writes of others
+func initLeader() {
+	if !*flagHA {
+		return
+	}
+	atomic.StoreInt32(&leader, 0)
+	campaign()
+	go func() {
+		renew, sync := time.Tick(*flagLeaseTTL/3), time.Tick(*flagHASync)
+		for {
+			select {
+			case <-renew:
+				campaign()
+			case <-sync:
+				storeEngine.Reload()
+			}
+		}
+	}()
+}
+
+func campaign() {
+	ok, err := storeEngine.AcquireLeadership(nodeId(), *flagLeaseTTL)
+	if err != nil {
+		// ok tells whether the lease renewed last is still valid, the leader steps down before others can acquire it
+		logger.With("node", nodeId()).Error("can not acquire the leader lease: %v", err)
+	}
+	var v int32
+	if ok {
+		v = 1
+	}
+	if old := atomic.SwapInt32(&leader, v); old != v {
+		if ok {
+			logger.With("node", nodeId()).Info("become the leader")
+			// load the latest state written by the previous leader
+			storeEngine.Reload()
+		} else {
+			logger.With("node", nodeId()).Info("become a follower")
+		}
+	}
+}
+
+func releaseLeader() {
+	if !*flagHA || !isLeader() {
+		return
+	}
+	atomic.StoreInt32(&leader, 0)
+	if err := storeEngine.ReleaseLeadership(nodeId()); err != nil {
+		logger.With("node", nodeId()).Error("can not release the leader lease: %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/gogames/watchdog/main-server/i18n"
+)
+
+// translate the error returned to the user to the locale of the user, or to -locale, see package i18n
+// deferred by the stubs of the main server
+func localizeError(username string, err *error) {
+	if *err == nil {
+		return
+	}
+	if msg := i18n.Localize(userLocale(username), (*err).Error()); msg != (*err).Error() {
+		*err = errors.New(msg)
+	}
+}
+
+// the locale of the user, or -locale if the user set none
+func userLocale(username string) string {
+	if st, err := storeEngine.GetSettings(username); err == nil && st.Locale != "" {
+		return st.Locale
+	}
+	return *flagLocale
+}
@@ -1,16 +1,88 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
 
 	"github.com/astaxie/beego/logs"
 )
 
-var logger = logs.NewLogger(1 << 15)
+// printf style structured logger
+// levels are RFC5424 levels same as beego logs, the lower the more severe
+type structLogger struct {
+	l *slog.Logger
+	w io.Closer
+}
+
+var (
+	logLevel = new(slog.LevelVar)
+	logger   = &structLogger{l: slog.Default()}
+)
+
+// map RFC5424 levels to slog levels
+func toSlogLevel(level int) slog.Level {
+	switch {
+	case level <= logs.LevelCritical:
+		return slog.LevelError + 4
+	case level == logs.LevelError:
+		return slog.LevelError
+	case level == logs.LevelWarning:
+		return slog.LevelWarn
+	case level <= logs.LevelInformational:
+		return slog.LevelInfo
+	default:
+		return slog.LevelDebug
+	}
+}
 
 func initLogger() {
-	if err := logger.SetLogger("file", fmt.Sprintf(`{"filename":"%s"}`, *flagLogFilePath)); err != nil {
+	f, err := os.OpenFile(*flagLogFilePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
 		panic("can not set logger: " + err.Error())
 	}
-	logger.SetLevel(*flagLogLevel)
+	setLogLevel(*flagLogLevel)
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var h slog.Handler
+	if *flagLogJSON {
+		h = slog.NewJSONHandler(f, opts)
+	} else {
+		h = slog.NewTextHandler(f, opts)
+	}
+	logger = &structLogger{l: slog.New(h), w: f}
+}
+
+// the level can be changed at runtime
+func setLogLevel(level int) { logLevel.Set(toSlogLevel(level)) }
+
+// With returns a logger carrying the key value pairs in every record
+func (s *structLogger) With(args ...interface{}) *structLogger {
+	return &structLogger{l: s.l.With(args...), w: s.w}
+}
+
+func (s *structLogger) log(level slog.Level, format string, v ...interface{}) {
+	if !s.l.Enabled(context.Background(), level) {
+		return
+	}
+	s.l.Log(context.Background(), level, strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
+
+func (s *structLogger) Emergency(format string, v ...interface{}) {
+	s.log(toSlogLevel(logs.LevelEmergency), format, v...)
+}
+func (s *structLogger) Critical(format string, v ...interface{}) {
+	s.log(toSlogLevel(logs.LevelCritical), format, v...)
+}
+func (s *structLogger) Error(format string, v ...interface{}) { s.log(slog.LevelError, format, v...) }
+func (s *structLogger) Warn(format string, v ...interface{})  { s.log(slog.LevelWarn, format, v...) }
+func (s *structLogger) Info(format string, v ...interface{})  { s.log(slog.LevelInfo, format, v...) }
+func (s *structLogger) Debug(format string, v ...interface{}) { s.log(slog.LevelDebug, format, v...) }
+
+func (s *structLogger) Close() {
+	if s.w != nil {
+		s.w.Close()
+	}
 }
@@ -1,9 +1,17 @@
 package main
 
-import "log"
+import (
+	"log"
+
+	"github.com/gogames/watchdog/main-server/sdnotify"
+)
 
 func main() {
 	log.Println("The server is running...")
+	if err := sdnotify.Notify(sdnotify.READY); err != nil {
+		logger.Error("can not notify systemd: %v", err)
+	}
+	sdnotify.Watchdog()
 	c := make(chan int)
 	<-c
 }
@@ -5,9 +5,13 @@ import (
 	"net/http"
 	"reflect"
 	"syscall"
+	"time"
 
 	"github.com/gogames/utils/signal"
+	"github.com/gogames/watchdog/main-server/compress"
+	"github.com/gogames/watchdog/main-server/filter"
 	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/probe"
 	"github.com/hprose/hprose-go/hprose"
 )
 
@@ -23,12 +27,16 @@ type (
 
 // without signed in
 // auto sign the user in
-func (mainServerStub) Register(username, password string) (sid, un string, err error) {
+func (mainServerStub) Register(username, password string, ctx hprose.Context) (sid, un string, err error) {
+	defer localizeError(username, &err)
+	if err = checkWritable(); err != nil {
+		return
+	}
 	if username == "" {
 		err = fmt.Errorf("Username can not be empty")
 		return
 	}
-	if err = storeEngine.AddUser(username, password); err != nil {
+	if err = storeEngine.AddUser(requestContext(ctx), username, password); err != nil {
 		return
 	}
 	sid, err = sess.Set("", _SESS_KEY_USERNAME, username)
@@ -37,10 +45,12 @@ func (mainServerStub) Register(username, password string) (sid, un string, err e
 }
 
 func (mainServerStub) Login(username, password string) (sid, un string, err error) {
+	defer localizeError(username, &err)
 	un = username
 	if u := storeEngine.GetUser(username); u == nil {
 		err = fmt.Errorf("user %v does not exist", username)
-	} else if u.Password != password {
+	} else if u.Password == "" || u.Password != password {
+		// users signed up by identity providers have no password
 		err = fmt.Errorf("incorrect password")
 	} else {
 		sid, err = sess.Set("", _SESS_KEY_USERNAME, username)
@@ -49,14 +59,19 @@ func (mainServerStub) Login(username, password string) (sid, un string, err erro
 }
 
 // update session life
-func (mainServerStub) UpdatePassword(sid, username, oldP, newP string) (signedIn bool, err error) {
+func (mainServerStub) UpdatePassword(sid, username, oldP, newP string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
 	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
 		un, ok := v.(string)
 		if !ok {
 			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
 			err = fmt.Errorf("Unexpected runtime error")
 		} else if un == username {
-			if err = storeEngine.UpdatePassword(username, oldP, newP); err != nil {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.UpdatePassword(requestContext(ctx), username, oldP, newP); err != nil {
 				return
 			}
 			err = sess.Update(sid)
@@ -67,14 +82,25 @@ func (mainServerStub) UpdatePassword(sid, username, oldP, newP string) (signedIn
 }
 
 // update session life
-func (mainServerStub) AddServer(sid, username, server string) (signedIn bool, err error) {
+func (mainServerStub) AddServer(sid, username, server string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
 	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
 		un, ok := v.(string)
 		if !ok {
 			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
 			err = fmt.Errorf("Unexpected runtime error")
 		} else if un == username {
-			if err = storeEngine.AddMonitorServer(username, server); err != nil {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = targetPolicy.Validate(server); err != nil {
+				return
+			}
+			if err = checkOwnership(username, server); err != nil {
+				return
+			}
+			if err = storeEngine.AddMonitorServer(requestContext(ctx), username, server); err != nil {
 				return
 			}
 			err = sess.Update(sid)
@@ -84,17 +110,90 @@ func (mainServerStub) AddServer(sid, username, server string) (signedIn bool, er
 	return
 }
 
+// add the check of the kind, icmp, http, tcp or tls, of the host, returns the server of the check
+// the checks of a host are servers of their own, removed by DelServer
+func (mainServerStub) AddCheck(sid, username, host, kind string, ctx hprose.Context) (server string, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if server, err = probe.CheckServer(host, kind); err != nil {
+				return
+			}
+			if err = targetPolicy.Validate(server); err != nil {
+				return
+			}
+			if err = checkOwnership(username, server); err != nil {
+				return
+			}
+			if err = storeEngine.AddMonitorServer(requestContext(ctx), username, server); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get the hosts monitored by the user and the servers of their checks
+func (mainServerStub) GetHosts(sid, username string) (ret map[string][]string, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			ret, err = storeEngine.GetHosts(username)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get the monitor results of the host grouped by check
+func (mainServerStub) GetChecks(sid, username, host string) (ret []store.Check, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			ret, err = storeEngine.GetChecks(username, host)
+			signedIn = true
+		}
+	}
+	return
+}
+
 // update session life
-func (mainServerStub) DelServer(sid, username, server string) (signedIn bool, err error) {
+func (mainServerStub) DelServer(sid, username, server string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
 	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
 		un, ok := v.(string)
 		if !ok {
 			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
 			err = fmt.Errorf("Unexpected runtime error")
 		} else if un == username {
-			if err = storeEngine.DeleteMonitorServer(username, server); err != nil {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
 				return
 			}
+			if err = storeEngine.DeleteMonitorServer(requestContext(ctx), username, server); err != nil {
+				return
+			}
+			evaluator.Forget(username, server)
 			err = sess.Update(sid)
 			signedIn = true
 		}
@@ -103,12 +202,14 @@ func (mainServerStub) DelServer(sid, username, server string) (signedIn bool, er
 }
 
 func (mainServerStub) GetMonitorResult(sid, username, server string) (ret map[string][]store.PingRet, signedIn bool, err error) {
+	defer localizeError(username, &err)
 	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
 		un, ok := v.(string)
 		if !ok {
 			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
 			err = fmt.Errorf("Unexpected runtime error")
 		} else if un == username {
+			countRequest(username)
 			ret, err = storeEngine.GetMonitorResult(username, server)
 			signedIn = true
 		}
@@ -116,13 +217,278 @@ func (mainServerStub) GetMonitorResult(sid, username, server string) (ret map[st
 	return
 }
 
+// get at most maxPoints ping results of each location for the chart, selected keeping the spikes
+func (mainServerStub) GetMonitorResultDownsampled(sid, username, server string, maxPoints int) (ret map[string][]store.PingRet, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			ret, err = storeEngine.GetMonitorResultDownsampled(username, server, maxPoints)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get the hourly or daily aggregates of each location between from and to, see store.GetAggregates
+func (mainServerStub) GetAggregates(sid, username, server, resolution, from, to string) (ret map[string][]store.Aggregate, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			ret, err = storeEngine.GetAggregates(username, server, resolution, from, to)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get the ping results of each location between from and to, including those older than -hottier, see store.GetPingRets
+func (mainServerStub) GetPingRets(sid, username, server, from, to string) (ret map[string][]store.PingRet, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			ret, err = storeEngine.GetPingRets(username, server, from, to)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get the ping results of each location between from and to matching the filter expression, like location=~"eu-.*" AND loss>0
+// of the fields store.PING_RET_FIELDS, see GetPingRets and filter.Parse
+func (mainServerStub) GetPingRetsWhere(sid, username, server, from, to, where string) (ret map[string][]store.PingRet, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			signedIn = true
+			var e *filter.Expr
+			if e, err = filter.Parse(where, store.PING_RET_FIELDS...); err != nil {
+				return
+			}
+			if ret, err = storeEngine.GetPingRets(username, server, from, to); err == nil {
+				ret = store.FilterPingRets(ret, e)
+			}
+		}
+	}
+	return
+}
+
+// get the aggregates of each location between from and to matching the filter expression, like avg>100 OR uptime<0.99
+// of the fields store.AGGREGATE_FIELDS, see GetAggregates and filter.Parse
+func (mainServerStub) GetAggregatesWhere(sid, username, server, resolution, from, to, where string) (ret map[string][]store.Aggregate, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			signedIn = true
+			var e *filter.Expr
+			if e, err = filter.Parse(where, store.AGGREGATE_FIELDS...); err != nil {
+				return
+			}
+			if ret, err = storeEngine.GetAggregates(username, server, resolution, from, to); err == nil {
+				ret = store.FilterAggregates(ret, e)
+			}
+		}
+	}
+	return
+}
+
+// get at most limit ping results of each location after the cursor
+// pass the returned next cursor to get the next page
+func (mainServerStub) GetMonitorResultPage(sid, username, server, cursor string, limit int) (page store.ResultPage, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			page, err = storeEngine.GetMonitorResultPage(username, server, cursor, limit)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// pass the etag of the last result, the result is omitted if nothing changed since then
+func (mainServerStub) GetMonitorResultIfNoneMatch(sid, username, server, etag string) (ret map[string][]store.PingRet, newETag string, notModified, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			ret, newETag, notModified, err = storeEngine.GetMonitorResultIfNoneMatch(username, server, etag)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get the last points of every monitored servers in one request
+func (mainServerStub) GetOverview(sid, username string, points int) (ret map[string]store.Overview, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			ret, err = storeEngine.GetOverview(username, points)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get at most n servers of the user with the highest latency or downtime in the recent window hours, for the needs attention list
+// update session life
+func (mainServerStub) GetWorstServers(sid, username, metric string, windowHours, n int) (ret []store.ServerScore, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if ret, err = storeEngine.GetWorstServers(username, metric, time.Duration(windowHours)*time.Hour, n); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get the status of the server, up, degraded, down or unknown, and of each location
+func (mainServerStub) GetStatus(sid, username, server string) (ret store.ServerStatus, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			ret, err = storeEngine.GetStatus(username, server)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get the status of every monitored server in one request
+func (mainServerStub) GetStatuses(sid, username string) (ret map[string]store.ServerStatus, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			ret, err = storeEngine.GetStatuses(username)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// attach the annotation, like a deploy, to the timeline of the server, returns it with its id
+func (mainServerStub) AddAnnotation(sid, username, server string, a store.Annotation, ctx hprose.Context) (ret store.Annotation, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			signedIn = true
+			if err = checkWritable(); err != nil {
+				return
+			}
+			ret, err = storeEngine.AddAnnotation(requestContext(ctx), username, server, a)
+		}
+	}
+	return
+}
+
+func (mainServerStub) DeleteAnnotation(sid, username, server, id string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			signedIn = true
+			if err = checkWritable(); err != nil {
+				return
+			}
+			err = storeEngine.DeleteAnnotation(requestContext(ctx), username, server, id)
+		}
+	}
+	return
+}
+
+// get the annotations of the server from and to, in the time layout of the ping results, to is open if empty
+// the pages of GetMonitorResultPage carry the annotations of their period as well
+func (mainServerStub) GetAnnotations(sid, username, server, from, to string) (ret []store.Annotation, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			ret, err = storeEngine.GetAnnotations(username, server, from, to)
+			signedIn = true
+		}
+	}
+	return
+}
+
 func (mainServerStub) GetUser(sid, username string) (u store.User, signedIn bool, err error) {
+	defer localizeError(username, &err)
 	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
 		un, ok := v.(string)
 		if !ok {
 			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
 			err = fmt.Errorf("Unexpected runtime error")
 		} else if un == username {
+			countRequest(username)
 			up := storeEngine.GetUser(username)
 			if up == nil {
 				err = fmt.Errorf("User %v does not exist", username)
@@ -135,13 +501,58 @@ func (mainServerStub) GetUser(sid, username string) (u store.User, signedIn bool
 	return
 }
 
+func (mainServerStub) GetSettings(sid, username string) (st store.Settings, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if st, err = storeEngine.GetSettings(username); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// set the timezone, units, default time range and chart options of the user
+// update session life
+func (mainServerStub) SetSettings(sid, username string, st store.Settings, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.SetSettings(requestContext(ctx), username, st); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
 func (mainServerStub) Logout(sid, username string) (signedIn bool, err error) {
+	defer localizeError(username, &err)
 	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
 		un, ok := v.(string)
 		if !ok {
 			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
 			err = fmt.Errorf("Unexpected runtime error")
 		} else if un == username {
+			countRequest(username)
 			err = sess.Expire(sid)
 			signedIn = true
 		}
@@ -149,13 +560,34 @@ func (mainServerStub) Logout(sid, username string) (signedIn bool, err error) {
 	return
 }
 
-var mainServer = hprose.NewHttpService()
+var (
+	mainServer = hprose.NewHttpService()
+	mainMux    = http.NewServeMux()
+)
 
 func initMainServer() {
 	mainServer.AddMethods(new(mainServerStub))
 	mainServer.GetEnabled = true
+	initCORS()
+	initShare()
+	initTarget()
+	// the request bodies decoded from gzip are capped, of the ping server as well
+	compress.SetMaxBodySize(*flagMaxBody)
+	mainMux.Handle("/", instrument("main", compress.Handler(mainServer)))
+	initOAuth()
+	initIngest()
+	initHeartbeat()
+	initBadge()
+	initHealth()
 	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf(":%v", *flagMainServerPort), mainServer); err != nil {
+		addr := fmt.Sprintf(":%v", *flagMainServerPort)
+		var err error
+		if *flagTLSCert != "" {
+			err = http.ListenAndServeTLS(addr, *flagTLSCert, *flagTLSKey, mainMux)
+		} else {
+			err = http.ListenAndServe(addr, mainMux)
+		}
+		if err != nil {
 			logger.Emergency("can not listen and serve main server: %v", err)
 			if err = signal.Signal(syscall.SIGQUIT); err != nil {
 				panic(fmt.Errorf("can not signal the current process: %v", err))
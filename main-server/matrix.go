@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/pingClientManager"
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+// the owner of the key pings the probe matrix if sharded
+const _PROBE_MATRIX_SHARD_KEY = "probe matrix"
+
+// GetLatencyMatrix returns location -> target -> latest ping result, targets are other locations and the anchors
+// update session life
+func (mainServerStub) GetLatencyMatrix(sid, username string) (ret map[string]map[string]store.PingRet, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			ret = storeEngine.GetLatencyMatrix()
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+func anchors() []string {
+	hosts := make([]string, 0)
+	for _, host := range strings.Split(*flagAnchors, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// every ping node pings the other ping nodes and the anchors, telling probe side network problems from target problems
+func pingProbeMatrix(tn time.Time) {
+	locationIps := getLocationIps()
+	for location := range storeEngine.GetLatencyMatrix() {
+		if _, ok := locationIps[location]; !ok {
+			storeEngine.DeleteProbeLatency(location)
+		}
+	}
+	targets := make(map[string]string, len(locationIps))
+	for location, ip := range locationIps {
+		targets[location] = ip
+	}
+	for _, host := range anchors() {
+		targets[host] = host
+	}
+	pcm.Iterate(func(location string, pc pingClientManager.PingClient) {
+		for target, host := range targets {
+			if target == location {
+				continue
+			}
+			go func(location string, pc pingClientManager.PingClient, target, host string) {
+				pr, err := pc.Ping(host)
+				if err != nil {
+					logger.With("location", location, "target", target).Error("can not ping target of probe matrix: %v", err)
+					return
+				}
+				observeProbeReport(location)
+				storeEngine.SetProbeLatency(location, target, store.PingRet{
+					Ping: fmt.Sprintf("%.3f", pr.Avg),
+					Time: tn.Format(_TIME_LAYOUT),
+				})
+			}(location, pc, target, host)
+		}
+	})
+}
+
+func initProbeMatrix() {
+	if !*flagProbeMatrix {
+		return
+	}
+	go func() {
+		for {
+			tn := <-time.After(getPingFrequence())
+			if shouldPing(_PROBE_MATRIX_SHARD_KEY) {
+				pingProbeMatrix(tn)
+			}
+		}
+	}()
+}
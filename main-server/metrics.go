@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+// requests and response time of every http handler
+type handlerMetrics struct {
+	requests int64
+	nanos    int64
+}
+
+const _REQUEST_ID_HEADER = "X-Request-Id"
+
+var (
+	requestCounter int64
+	processId      = fmt.Sprintf("%x", time.Now().UnixNano())
+	httpMetrics    = make(map[string]*handlerMetrics)
+	httpMetricsRwl sync.RWMutex
+)
+
+// count the requests and the response time of h by name
+func instrument(name string, h http.Handler) http.Handler {
+	httpMetricsRwl.Lock()
+	m, ok := httpMetrics[name]
+	if !ok {
+		m = new(handlerMetrics)
+		httpMetrics[name] = m
+	}
+	httpMetricsRwl.Unlock()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestId := r.Header.Get(_REQUEST_ID_HEADER)
+		if requestId == "" {
+			requestId = newRequestId()
+		}
+		w.Header().Set(_REQUEST_ID_HEADER, requestId)
+		r = r.WithContext(store.WithRequestId(r.Context(), requestId))
+		sp := tracer.Start("http."+name, "request_id", requestId, "method", r.Method, "path", r.URL.Path)
+		h.ServeHTTP(w, r)
+		sp.End(nil)
+		d := time.Since(start)
+		atomic.AddInt64(&m.requests, 1)
+		atomic.AddInt64(&m.nanos, int64(d))
+		logger.With("request_id", requestId, "handler", name, "remote", r.RemoteAddr, "duration", d).Debug("%v %v", r.Method, r.URL.Path)
+	})
+}
+
+func newRequestId() string {
+	return fmt.Sprintf("%s-%d", processId, atomic.AddInt64(&requestCounter, 1))
+}
+
+// prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := storeEngine.Metrics()
+
+	writeMetric(w, "watchdog_ping_rets_appended_total", "counter", "ping results appended to the store", float64(m.PingRetsAppended))
+	writeMetric(w, "watchdog_ping_rets_duplicated_total", "counter", "duplicated ping results ignored by the store", float64(m.PingRetsDuplicated))
+	writeMetric(w, "watchdog_ping_rets_late_total", "counter", "ping results inserted before the latest one", float64(m.PingRetsLate))
+	writeMetric(w, "watchdog_engine_writes_total", "counter", "writes to the store engine", float64(m.EngineWrites))
+	writeMetric(w, "watchdog_engine_write_errors_total", "counter", "failed writes to the store engine", float64(m.EngineWriteErrors))
+	writeMetric(w, "watchdog_engine_write_seconds_total", "counter", "time spent writing to the store engine", m.EngineWriteTime.Seconds())
+	writeMetric(w, "watchdog_engine_write_retries_total", "counter", "retries of failed writes to the store engine", float64(m.EngineWriteRetries))
+	var open float64
+	if m.Breaker.State != store.BREAKER_CLOSED {
+		open = 1
+	}
+	writeMetric(w, "watchdog_engine_breaker_open", "gauge", "1 if the breaker of the store engine is open or half open", open)
+	writeMetric(w, "watchdog_engine_breaker_opens_total", "counter", "times the breaker of the store engine opened", float64(m.Breaker.Opens))
+	writeMetric(w, "watchdog_engine_buffered_writes", "gauge", "engine writes buffered while the breaker is open", float64(m.Breaker.Buffered))
+	writeMetric(w, "watchdog_engine_dropped_writes_total", "counter", "engine writes rejected as the buffer is full", float64(m.Breaker.Dropped))
+	writeMetric(w, "watchdog_response_cache_hits_total", "counter", "overviews, aggregates and uptimes served from the cache", float64(m.Cache.Hits))
+	writeMetric(w, "watchdog_response_cache_misses_total", "counter", "overviews, aggregates and uptimes computed", float64(m.Cache.Misses))
+	writeMetric(w, "watchdog_response_cache_entries", "gauge", "responses cached", float64(m.Cache.Entries))
+	ro := storeEngine.ReadOnlyStatus()
+	var readOnly float64
+	if ro.On {
+		readOnly = 1
+	}
+	writeMetric(w, "watchdog_store_read_only", "gauge", "1 if the store is read only for maintenance", readOnly)
+	writeMetric(w, "watchdog_read_only_buffered_ping_rets", "gauge", "ping results buffered while the store is read only", float64(ro.Buffered))
+	writeMetric(w, "watchdog_store_lock_acquires_total", "counter", "acquisitions of the store lock", float64(m.LockAcquires))
+	writeMetric(w, "watchdog_store_lock_wait_seconds_total", "counter", "time spent waiting for the store lock", m.LockWaitTime.Seconds())
+	writeMetric(w, "watchdog_store_lock_hold_seconds_total", "counter", "time spent holding the store lock", m.LockHoldTime.Seconds())
+	writeMetric(w, "watchdog_users", "gauge", "number of users", float64(m.Users))
+	writeMetric(w, "watchdog_servers", "gauge", "number of monitored servers", float64(m.Servers))
+	writeMetric(w, "watchdog_series", "gauge", "number of series of server and location in memory", float64(m.Locations))
+	writeMetric(w, "watchdog_ping_rets", "gauge", "number of ping results in memory", float64(m.PingRets))
+	writeMetric(w, "watchdog_add_server_chan_length", "gauge", "servers queued in add server channel", float64(m.AddServerChanLen))
+	writeMetric(w, "watchdog_add_server_chan_capacity", "gauge", "capacity of add server channel", float64(m.AddServerChanCap))
+	writeMetric(w, "watchdog_kick_server_chan_length", "gauge", "servers queued in kick server channel", float64(m.KickServerChanLen))
+	writeMetric(w, "watchdog_kick_server_chan_capacity", "gauge", "capacity of kick server channel", float64(m.KickServerChanCap))
+	writeMetric(w, "watchdog_add_server_queue_length", "gauge", "servers queued beyond the capacity of add server channel", float64(m.AddServerQueueLen))
+	writeMetric(w, "watchdog_kick_server_queue_length", "gauge", "servers queued beyond the capacity of kick server channel", float64(m.KickServerQueueLen))
+	writeMetric(w, "watchdog_server_chan_overflows_total", "counter", "servers which did not fit in the server channels", float64(m.ServerOverflows))
+	var leader float64
+	if isLeader() {
+		leader = 1
+	}
+	writeMetric(w, "watchdog_leader", "gauge", "1 if the main server is the leader", leader)
+	writeMetric(w, "watchdog_rejected_results_total", "counter", "malformed results of the probe agents rejected", float64(atomic.LoadInt64(&rejectedResults)))
+	queued, capacity, rejected := ingestion.Stats()
+	writeMetric(w, "watchdog_ingest_queued", "gauge", "samples queued for the ingestion workers", float64(queued))
+	writeMetric(w, "watchdog_ingest_queue_capacity", "gauge", "samples queued at most, -ingestqueue", float64(capacity))
+	writeMetric(w, "watchdog_ingest_rejected_total", "counter", "samples rejected as the ingestion queue is full", float64(rejected))
+	writeMetric(w, "watchdog_goroutines", "gauge", "number of goroutines", float64(runtime.NumGoroutine()))
+
+	writeClockSkewMetrics(w)
+	writeProbeMetrics(w)
+
+	httpMetricsRwl.RLock()
+	names := make([]string, 0, len(httpMetrics))
+	for name := range httpMetrics {
+		names = append(names, name)
+	}
+	httpMetricsRwl.RUnlock()
+	sort.Strings(names)
+
+	writeHeader(w, "watchdog_http_requests_total", "counter", "http requests by handler")
+	for _, name := range names {
+		fmt.Fprintf(w, "watchdog_http_requests_total{handler=%q} %v\n", name, atomic.LoadInt64(&httpMetrics[name].requests))
+	}
+	writeHeader(w, "watchdog_http_request_seconds_total", "counter", "time spent serving http requests by handler")
+	for _, name := range names {
+		fmt.Fprintf(w, "watchdog_http_request_seconds_total{handler=%q} %v\n", name, time.Duration(atomic.LoadInt64(&httpMetrics[name].nanos)).Seconds())
+	}
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeMetric(w io.Writer, name, typ, help string, val float64) {
+	writeHeader(w, name, typ, help)
+	fmt.Fprintf(w, "%s %v\n", name, val)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+// GetMTUChanges returns the changes of the path mtu of the mtu check of the server by location, the earliest first
+// a vpn endpoint whose path mtu drops breaks in weird ways, like large transfers hanging
+// update session life
+func (mainServerStub) GetMTUChanges(sid, username, server string) (changes []store.MTUChange, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if changes, err = storeEngine.GetMTUChanges(username, server); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+
+	"github.com/gogames/watchdog/main-server/geoip"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/main-server/target"
+	"github.com/gogames/watchdog/probe"
+)
+
+// the table of -asndb, nil if not set
+var asnDB *geoip.DB
+
+func initASN() {
+	if *flagASNDB == "" {
+		return
+	}
+	db, err := geoip.Open(*flagASNDB)
+	if err != nil {
+		panic(fmt.Errorf("can not load asn database: %v", err))
+	}
+	asnDB = db
+	logger.With("path", *flagASNDB).Info("asn database loaded, %v ranges", db.Len())
+}
+
+// fill the asn, the provider and the country of the probe by the address it registers from unless it set them
+// the prefix is of the address if the asn matches
+func enrichProbe(meta probe.Metadata, ip string) probe.Metadata {
+	n, ok := asnDB.Lookup(net.ParseIP(ip))
+	if !ok {
+		return meta
+	}
+	if meta.ASN == 0 {
+		meta.ASN = n.ASN
+		if meta.Provider == "" {
+			meta.Provider = n.Org
+		}
+	}
+	if meta.Country == "" {
+		meta.Country = n.Country
+	}
+	if meta.ASN == n.ASN {
+		meta.Prefix = n.Prefix
+	}
+	return meta
+}
+
+// the network of the probe of the location, like AS2516, empty if unknown
+func networkOf(location string) string {
+	probeMetadataRwl.RLock()
+	defer probeMetadataRwl.RUnlock()
+	if asn := probeMetadata[location].ASN; asn > 0 {
+		return fmt.Sprintf("AS%d", asn)
+	}
+	return ""
+}
+
+// the addresses of the server, of the latest resolution unless it is an address
+func addressesOf(username, server string) ([]string, error) {
+	h, err := storeEngine.GetDNSHistory(username, server)
+	if err != nil {
+		return nil, err
+	}
+	if host, err := target.Host(store.HostOf(server)); err == nil && net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	if len(h) == 0 {
+		return nil, nil
+	}
+	return h[len(h)-1].IPs, nil
+}
+
+// get address -> network of the addresses the server resolves to, see -asndb
+func (mainServerStub) GetServerNetworks(sid, username, server string) (ret map[string]geoip.Network, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			signedIn = true
+			if asnDB == nil {
+				err = fmt.Errorf("asn database is not configured")
+				return
+			}
+			var ips []string
+			if ips, err = addressesOf(username, server); err != nil {
+				return
+			}
+			ret = make(map[string]geoip.Network, len(ips))
+			for _, ip := range ips {
+				if n, ok := asnDB.Lookup(net.ParseIP(ip)); ok {
+					ret[ip] = n
+				}
+			}
+		}
+	}
+	return
+}
+
+// get the aggregates of the server merged by the networks of the probes, like AS2516 -> aggregates, rather than by location
+// the locations of the probes of unknown networks are left out, see GetAggregates
+func (mainServerStub) GetNetworkAggregates(sid, username, server, resolution, from, to string) (ret map[string][]store.Aggregate, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			var all map[string][]store.Aggregate
+			if all, err = storeEngine.GetAggregates(username, server, resolution, from, to); err != nil {
+				return
+			}
+			ret = store.GroupAggregates(all, networkOf)
+			signedIn = true
+		}
+	}
+	return
+}
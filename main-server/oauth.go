@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	_OAUTH_PATH         = "/oauth/"
+	_OAUTH_STATE_COOKIE = "watchdog_oauth_state"
+	_OAUTH_STATE_TTL    = 10 * time.Minute
+	_OAUTH_TIMEOUT      = 10 * time.Second
+)
+
+// the provider is configured by an openid connect issuer or the endpoints
+// SubjectField and UsernameField are fields of the user info
+type oauthProvider struct {
+	ClientId      string   `json:"client_id"`
+	ClientSecret  string   `json:"client_secret"`
+	Issuer        string   `json:"issuer"`
+	AuthURL       string   `json:"auth_url"`
+	TokenURL      string   `json:"token_url"`
+	UserInfoURL   string   `json:"userinfo_url"`
+	Scopes        []string `json:"scopes"`
+	SubjectField  string   `json:"subject_field"`
+	UsernameField string   `json:"username_field"`
+}
+
+type oauthConfig struct {
+	// base url of the main server, the callback is <callback_base>/oauth/<provider>/callback
+	CallbackBase string `json:"callback_base"`
+	// the front end page to redirect to after signed in, with sid and username in the fragment
+	Redirect string `json:"redirect"`
+	// create the user on first sign in, otherwise the identity should be linked by admin
+	AutoProvision bool                      `json:"auto_provision"`
+	Providers     map[string]*oauthProvider `json:"providers"`
+}
+
+var (
+	oauthPresets = map[string]oauthProvider{
+		"google": {
+			AuthURL:       "https://accounts.google.com/o/oauth2/v2/auth",
+			TokenURL:      "https://oauth2.googleapis.com/token",
+			UserInfoURL:   "https://openidconnect.googleapis.com/v1/userinfo",
+			Scopes:        []string{"openid", "email"},
+			SubjectField:  "sub",
+			UsernameField: "email",
+		},
+		"github": {
+			AuthURL:       "https://github.com/login/oauth/authorize",
+			TokenURL:      "https://github.com/login/oauth/access_token",
+			UserInfoURL:   "https://api.github.com/user",
+			Scopes:        []string{"read:user"},
+			SubjectField:  "id",
+			UsernameField: "login",
+		},
+	}
+	oauthConf   oauthConfig
+	oauthClient = &http.Client{Timeout: _OAUTH_TIMEOUT}
+)
+
+func initOAuth() {
+	if *flagOAuth == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(*flagOAuth), &oauthConf); err != nil {
+		panic(fmt.Errorf("can not parse oauth config: %v", err))
+	}
+	for name, p := range oauthConf.Providers {
+		if err := p.complete(name); err != nil {
+			panic(fmt.Errorf("can not config oauth provider %v: %v", name, err))
+		}
+	}
+	mainMux.Handle(_OAUTH_PATH, instrument("oauth", http.HandlerFunc(oauthHandler)))
+}
+
+// fill the preset and discover the endpoints of the issuer
+func (p *oauthProvider) complete(name string) error {
+	if preset, ok := oauthPresets[name]; ok {
+		if p.AuthURL == "" {
+			p.AuthURL = preset.AuthURL
+		}
+		if p.TokenURL == "" {
+			p.TokenURL = preset.TokenURL
+		}
+		if p.UserInfoURL == "" {
+			p.UserInfoURL = preset.UserInfoURL
+		}
+		if p.Scopes == nil {
+			p.Scopes = preset.Scopes
+		}
+		if p.SubjectField == "" {
+			p.SubjectField = preset.SubjectField
+		}
+		if p.UsernameField == "" {
+			p.UsernameField = preset.UsernameField
+		}
+	}
+	if p.Issuer != "" && (p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "") {
+		var discovery struct {
+			AuthURL     string `json:"authorization_endpoint"`
+			TokenURL    string `json:"token_endpoint"`
+			UserInfoURL string `json:"userinfo_endpoint"`
+		}
+		resp, err := oauthClient.Get(strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err = json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+			return fmt.Errorf("can not decode openid configuration: %v", err)
+		}
+		p.AuthURL, p.TokenURL, p.UserInfoURL = discovery.AuthURL, discovery.TokenURL, discovery.UserInfoURL
+	}
+	if p.Scopes == nil {
+		p.Scopes = []string{"openid", "email", "profile"}
+	}
+	if p.SubjectField == "" {
+		p.SubjectField = "sub"
+	}
+	if p.UsernameField == "" {
+		p.UsernameField = "preferred_username"
+	}
+	if p.ClientId == "" || p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "" {
+		return fmt.Errorf("client_id and endpoints are required")
+	}
+	return nil
+}
+
+// /oauth/<provider>/login redirects to the provider
+// /oauth/<provider>/callback signs the user in
+func oauthHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, _OAUTH_PATH), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	name := parts[0]
+	p, ok := oauthConf.Providers[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	redirectURI := fmt.Sprintf("%s%s%s/callback", strings.TrimSuffix(oauthConf.CallbackBase, "/"), _OAUTH_PATH, name)
+	switch parts[1] {
+	case "login":
+		state, err := randState()
+		if err != nil {
+			http.Error(w, "can not generate state", http.StatusInternalServerError)
+			return
+		}
+		http.SetCookie(w, stateCookie(state, time.Now().Add(_OAUTH_STATE_TTL)))
+		q := url.Values{
+			"response_type": {"code"},
+			"client_id":     {p.ClientId},
+			"redirect_uri":  {redirectURI},
+			"scope":         {strings.Join(p.Scopes, " ")},
+			"state":         {state},
+		}
+		http.Redirect(w, r, p.AuthURL+"?"+q.Encode(), http.StatusFound)
+	case "callback":
+		c, err := r.Cookie(_OAUTH_STATE_COOKIE)
+		// the state is used once
+		http.SetCookie(w, stateCookie("", time.Unix(0, 0)))
+		if err != nil || c.Value == "" || c.Value != r.URL.Query().Get("state") {
+			http.Error(w, "invalid oauth state", http.StatusBadRequest)
+			return
+		}
+		subject, username, err := p.identify(r.URL.Query().Get("code"), redirectURI)
+		if err != nil {
+			logger.Error("can not identify user by %v: %v", name, err)
+			http.Error(w, "can not identify user", http.StatusBadGateway)
+			return
+		}
+		un, err := oauthSignIn(r.Context(), name, subject, username)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		sid, err := sess.Set("", _SESS_KEY_USERNAME, un)
+		if err != nil {
+			http.Error(w, "can not sign in", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, oauthConf.Redirect+"#"+url.Values{"sid": {sid}, "username": {un}}.Encode(), http.StatusFound)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// the state cookie is sent back on the redirect of the provider, a top level navigation, and over https only if the callback is
+func stateCookie(state string, expires time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     _OAUTH_STATE_COOKIE,
+		Value:    state,
+		Path:     _OAUTH_PATH,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(oauthConf.CallbackBase, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// exchange the code and get the subject and the preferred username from user info
+func (p *oauthProvider) identify(code, redirectURI string) (subject, username string, err error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {p.ClientId},
+		"client_secret": {p.ClientSecret},
+	}
+	req, err := http.NewRequest("POST", p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err = doJSON(req, &token); err != nil {
+		return
+	}
+	if token.AccessToken == "" {
+		err = fmt.Errorf("no access token")
+		return
+	}
+
+	if req, err = http.NewRequest("GET", p.UserInfoURL, nil); err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	info := make(map[string]interface{})
+	if err = doJSON(req, &info); err != nil {
+		return
+	}
+	if info[p.SubjectField] == nil {
+		err = fmt.Errorf("no %v in user info", p.SubjectField)
+		return
+	}
+	subject = fmt.Sprint(info[p.SubjectField])
+	if info[p.UsernameField] != nil {
+		username = fmt.Sprint(info[p.UsernameField])
+	}
+	return
+}
+
+func doJSON(req *http.Request, v interface{}) error {
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v responds %v", req.URL, resp.Status)
+	}
+	d := json.NewDecoder(resp.Body)
+	// keep numeric ids as they are
+	d.UseNumber()
+	return d.Decode(v)
+}
+
+// returns the user linked to the identity, create one if auto provision is enabled
+func oauthSignIn(ctx context.Context, provider, subject, username string) (string, error) {
+	if un := storeEngine.GetExternalUser(provider, subject); un != "" {
+		return un, nil
+	}
+	if !oauthConf.AutoProvision {
+		return "", fmt.Errorf("%v user %v is not linked to any user", provider, subject)
+	}
+	if err := checkWritable(); err != nil {
+		return "", err
+	}
+	// the users are created only, an identity never takes over a user registered before, like one named after it
+	var err error
+	for _, un := range []string{username, provider + "-" + subject} {
+		if un == "" {
+			continue
+		}
+		if err = storeEngine.ProvisionExternalUser(ctx, un, provider, subject); err == nil {
+			logger.Info("user %v is provisioned by %v", un, provider)
+			return un, nil
+		}
+	}
+	// provisioned by another sign in meanwhile
+	if un := storeEngine.GetExternalUser(provider, subject); un != "" {
+		return un, nil
+	}
+	return "", err
+}
+
+func randState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
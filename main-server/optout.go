@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/main-server/target"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+// the opt-outs of the store are rejected by the target policy, so that the servers they match can not be added again
+func initOptOuts() {
+	if err := syncOptOuts(); err != nil {
+		panic(fmt.Errorf("can not load opt-outs: %v", err))
+	}
+}
+
+func syncOptOuts() error {
+	optOuts := storeEngine.GetOptOuts()
+	targets := make([]string, 0, len(optOuts))
+	for _, o := range optOuts {
+		targets = append(targets, o.Target)
+	}
+	return targetPolicy.SetOptOuts(targets)
+}
+
+// opt the host, exactly, or the network out of monitoring on a complaint of the actor, returns the servers kicked from the ping loop
+// the hostnames of the servers are resolved if it is a network
+func (adminServerStub) OptOut(entry, reason, actor string, ctx hprose.Context) ([]string, error) {
+	if err := checkWritable(); err != nil {
+		return nil, err
+	}
+	if actor == "" || reason == "" {
+		return nil, fmt.Errorf("the actor and the reason of an opt-out should be set")
+	}
+	entry, err := target.NormalizeOptOut(entry)
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]string, 0)
+	for _, server := range storeEngine.GetServers() {
+		if !store.IsVirtual(server) {
+			servers = append(servers, server)
+		}
+	}
+	if servers, err = targetPolicy.Matching(entry, servers); err != nil {
+		return nil, err
+	}
+	if err = storeEngine.AddOptOut(requestContext(ctx), store.OptOut{Target: entry, Reason: reason, Actor: actor, Servers: servers}); err != nil {
+		return nil, err
+	}
+	logger.With("target", entry, "actor", actor, "servers", len(servers)).Info("opted out")
+	return servers, syncOptOuts()
+}
+
+// remove the opt-out of the host or the network, the servers it kicked are pinged again
+func (adminServerStub) RemoveOptOut(entry, actor string, ctx hprose.Context) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if actor == "" {
+		return fmt.Errorf("the actor of an opt-out should be set")
+	}
+	entry, err := target.NormalizeOptOut(entry)
+	if err != nil {
+		return err
+	}
+	if err = storeEngine.RemoveOptOut(requestContext(ctx), entry, actor); err != nil {
+		return err
+	}
+	return syncOptOuts()
+}
+
+// the hosts and the networks opted out by target
+func (adminServerStub) OptOuts() []store.OptOut { return storeEngine.GetOptOuts() }
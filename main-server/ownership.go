@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/main-server/target"
+	"github.com/gogames/watchdog/probe"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+// the well known token file of a claim is fetched for at most it
+const _VERIFY_TIMEOUT = 10 * time.Second
+
+var (
+	ownershipVerifier = target.NewVerifier(_VERIFY_TIMEOUT)
+	// the kinds of checks of -verifykinds
+	verifyKinds map[string]bool
+)
+
+func initOwnership() {
+	verifyKinds = make(map[string]bool)
+	for _, kind := range strings.Split(*flagVerifyKinds, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			verifyKinds[kind] = true
+		}
+	}
+}
+
+func checkVerifyKinds(kinds string) error {
+	for _, kind := range strings.Split(kinds, ",") {
+		switch strings.TrimSpace(kind) {
+		case "", probe.KIND_ICMP, probe.KIND_TCP, probe.KIND_HTTP, probe.KIND_TLS, probe.KIND_MTU, probe.KIND_STEPS:
+		default:
+			return fmt.Errorf("unknown kind %v", kind)
+		}
+	}
+	return nil
+}
+
+// the checks of -verifykinds are added only against the hosts whose ownership the user or its organization verified,
+// so that a public instance does not hammer third parties by http requests or transactions
+func checkOwnership(username, server string) error {
+	return checkHostOwnership(username, server, probe.TargetOf(server).Kind)
+}
+
+// the server is a host, "tcp://host:port" or a url, like the url of a step
+func checkHostOwnership(username, server, kind string) error {
+	if !verifyKinds[kind] {
+		return nil
+	}
+	host, err := target.Host(server)
+	if err != nil {
+		return err
+	}
+	if !storeEngine.OwnershipVerified(username, host) {
+		return fmt.Errorf("the ownership of %v should be verified before adding %v checks", host, kind)
+	}
+	return nil
+}
+
+// the checks the check templates of the user selecting the labels add to the host
+func checkTemplatesOwnership(username, host string, templates []store.CheckTemplate, labels map[string]string) error {
+	for _, t := range templates {
+		if !t.Selects(labels) {
+			continue
+		}
+		for _, c := range t.Checks {
+			if err := checkHostOwnership(username, host, c.Kind); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// claim the ownership of the host, returns the token to publish as the TXT record "watchdog-verification=<token>" of the host
+// or at http://<host>/.well-known/watchdog-verification.txt, then VerifyHost
+// update session life
+func (mainServerStub) ClaimHost(sid, username, host string, ctx hprose.Context) (claim store.Claim, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = targetPolicy.Validate(host); err != nil {
+				return
+			}
+			if claim, err = storeEngine.ClaimHost(requestContext(ctx), username, host); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// look up the token of the claim of the host, returns how it was found
+// update session life
+func (mainServerStub) VerifyHost(sid, username, host string, ctx hprose.Context) (method string, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			var claims map[string]store.Claim
+			if claims, err = storeEngine.GetClaims(username); err != nil {
+				return
+			}
+			host = strings.ToLower(strings.TrimSuffix(host, "."))
+			claim, ok := claims[host]
+			if !ok {
+				err = fmt.Errorf("%v is not claimed", host)
+				return
+			}
+			if method, err = ownershipVerifier.Verify(host, claim.Token); err != nil {
+				return
+			}
+			if err = storeEngine.VerifyClaim(requestContext(ctx), username, host, method); err != nil {
+				return
+			}
+			logger.With("username", username, "host", host, "method", method).Info("ownership verified")
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get the claims of the user by host
+// update session life
+func (mainServerStub) GetClaims(sid, username string) (claims map[string]store.Claim, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if claims, err = storeEngine.GetClaims(username); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/main-server/i18n"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+// send a code to the phone by the sms gateway, the user verifies the phone by VerifyPhone with it before adding sms channels of it
+// update session life
+func (mainServerStub) SendPhoneCode(sid, username, phone string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if !alert.SMSConfigured() {
+				err = fmt.Errorf("sms gateway is not configured")
+				return
+			}
+			if phone, err = alert.NormalizePhone(phone); err != nil {
+				return
+			}
+			var code string
+			if code, err = storeEngine.RequestPhoneVerification(requestContext(ctx), username, phone); err != nil {
+				return
+			}
+			if err = alert.SendSMS(phone, i18n.Sprintf(userLocale(username), "your watchdog verification code is %v", code)); err != nil {
+				logger.With("username", username).Warn("can not send the verification code to %v: %v", phone, err)
+				// the code never reached the phone, drop it so that the user retries without waiting
+				if cerr := storeEngine.CancelPhoneVerification(requestContext(ctx), username, phone); cerr != nil {
+					logger.With("username", username).Warn("can not drop the verification code of %v: %v", phone, cerr)
+				}
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// verify the phone by the code sent to it
+// update session life
+func (mainServerStub) VerifyPhone(sid, username, phone, code string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.VerifyPhone(requestContext(ctx), username, phone, code); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get the phones of the user by number
+// update session life
+func (mainServerStub) GetPhones(sid, username string) (phones map[string]store.Phone, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if phones, err = storeEngine.GetPhones(username); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// remove the phone with the sms channels of it
+// update session life
+func (mainServerStub) DeletePhone(sid, username, phone string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.DeletePhone(requestContext(ctx), username, phone); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
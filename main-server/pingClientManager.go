@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"strings"
 	"sync"
 
@@ -34,10 +33,21 @@ func setLocationMapping(location, ip string) error {
 func deleteLocationMapping(ip string) {
 	rwl.Lock()
 	defer rwl.Unlock()
-	log.Printf("delete location mapping from %v to %v\n", ip, locationMapping[ip])
+	logger.With("ip", ip, "location", locationMapping[ip]).Info("delete location mapping")
 	delete(locationMapping, ip)
 }
 
+// location -> ip of the registered ping nodes
+func getLocationIps() map[string]string {
+	rwl.RLock()
+	defer rwl.RUnlock()
+	m := make(map[string]string, len(locationMapping))
+	for ip, location := range locationMapping {
+		m[location] = ip
+	}
+	return m
+}
+
 func getIp(remoteAddr string) string { return strings.Split(remoteAddr, ":")[0] }
 
 func getUri(ip string) string {
@@ -1,6 +1,8 @@
 package pingClientManager
 
 import (
+	"time"
+
 	"github.com/gogames/ping"
 	"github.com/hprose/hprose-go/hprose"
 )
@@ -8,6 +10,31 @@ import (
 type PingClientStub struct {
 	Ping    func(string) (ping.PingResult, error)
 	Disable func() error
+	// not provided by old ping nodes, see TimedPing
+	PingWithTime func(string) (TimedPingResult, error)
+}
+
+// TimedPingResult is the ping result with the time of the ping node when the ping finished
+type TimedPingResult struct {
+	Avg float64
+	// unix nano
+	Time int64
+	// the percent of the pings lost of Pings sent, no pings of the ping nodes too old to tell
+	Loss  float64
+	Pings int
+}
+
+// TimedPing returns the ping result with the time of the ping node, which is zero if the ping node is too old to tell
+// and the percent of the pings lost, negative if the ping node is too old to tell
+func (pc PingClient) TimedPing(server string) (avg, loss float64, probeTime time.Time, err error) {
+	if r, err := pc.PingWithTime(server); err == nil {
+		if loss = r.Loss; r.Pings == 0 {
+			loss = -1
+		}
+		return r.Avg, loss, time.Unix(0, r.Time), nil
+	}
+	pr, err := pc.Ping(server)
+	return pr.Avg, -1, time.Time{}, err
 }
 
 type PingClient struct {
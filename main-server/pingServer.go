@@ -6,6 +6,7 @@ import (
 	"syscall"
 
 	"github.com/gogames/utils/signal"
+	"github.com/gogames/watchdog/main-server/compress"
 	"github.com/hprose/hprose-go/hprose"
 )
 
@@ -26,16 +27,27 @@ func (pingServerStub) Register(location string, ctx hprose.Context) {
 	ip := getIp(ctx.(*hprose.HttpContext).Request.RemoteAddr)
 	pcm.Register(location, getUri(ip))
 	if err := setLocationMapping(location, ip); err != nil {
-		logger.Info(err.Error())
+		logger.With("location", location, "ip", ip).Info("%v", err)
 		panic(err)
 	}
-	logger.Info("%v register in\n", location)
+	// the ping nodes setting no metadata are of the network of their address
+	if asnDB != nil {
+		probeMetadataRwl.RLock()
+		meta := probeMetadata[location]
+		probeMetadataRwl.RUnlock()
+		if err := setProbeMetadata(location, enrichProbe(meta, ip)); err != nil {
+			logger.With("location", location, "ip", ip).Warn("can not set the network of the ping node: %v", err)
+		}
+	}
+	logger.With("location", location, "ip", ip).Info("ping node registered")
 }
 
 func (pingServerStub) UnRegister(ctx hprose.Context) {
 	ip := getIp(ctx.(*hprose.HttpContext).Request.RemoteAddr)
 	pcm.UnRegister(getLocation(ip))
-	logger.Info("%v unregister\n", getLocation(ip))
+	storeEngine.DeleteProbeLatency(getLocation(ip))
+	deleteProbeMetadata(getLocation(ip))
+	logger.With("location", getLocation(ip), "ip", ip).Info("ping node unregistered")
 	deleteLocationMapping(ip)
 }
 
@@ -45,7 +57,7 @@ func initPingServer() {
 	pingServer.AddMethods(new(pingServerStub))
 	pingServer.GetEnabled = true
 	go func() {
-		if err := http.ListenAndServe(fmt.Sprintf(":%v", *flagManagerPort), pingServer); err != nil {
+		if err := http.ListenAndServe(fmt.Sprintf(":%v", *flagManagerPort), instrument("ping", compress.Handler(pingServer))); err != nil {
 			logger.Emergency("can not listen and serve ping server: %v", err)
 			if err = signal.Signal(syscall.SIGQUIT); err != nil {
 				panic(fmt.Errorf("can not signal the current process: %v", err))
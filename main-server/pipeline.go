@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/gogames/watchdog/main-server/pipeline"
+)
+
+var ingestion *pipeline.Pipeline
+
+func initPipeline() {
+	workers := *flagIngestWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	ingestion = pipeline.New(workers, *flagIngestQueue, appendSample)
+}
+
+// the samples pushed are acknowledged once queued, append them before the store is closed
+func drainIngestion() {
+	if n := ingestion.Close(*flagShutdownGrace); n > 0 {
+		logger.Error("%v ingested samples are not appended in %v", n, *flagShutdownGrace)
+	}
+}
+
+// the samples are appended after the request is responded, so not with its context
+func appendSample(j pipeline.Job) {
+	if err := storeEngine.AppendPingRets(context.Background(), j.Server, j.Location, j.PingRets); err != nil {
+		logger.With("server", j.Server, "location", j.Location).Error("can not append %v ingested samples: %v", len(j.PingRets), err)
+		return
+	}
+	if j.Evaluate {
+		evaluateAlerts(j.Server, j.Location, j.Sample)
+	}
+}
@@ -0,0 +1,170 @@
+// Package pipeline queues the samples pushed by the probes and the ingest endpoint for the workers appending them to the store
+package pipeline
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+// the samples a worker appends before it looks at its queue again
+const _BATCH = 64
+
+// the time the pushes rejected are asked to wait, see retryAfter
+const (
+	_MIN_RETRY_AFTER = time.Second
+	_MAX_RETRY_AFTER = time.Minute
+)
+
+// Job is a sample of a probe report or of the ingest endpoint, appended to the store and evaluated by the alert rules unless it is history,
+// or the history of a server at a location, like the results spooled by a probe, appended at once so that the store merges them by one rewrite
+type Job struct {
+	Server, Location string
+	PingRets         []store.PingRet
+	// of the latest ping result, evaluated if Evaluate
+	Sample   alert.Sample
+	Evaluate bool
+}
+
+func samples(jobs []Job) (n int64) {
+	for _, j := range jobs {
+		n += int64(len(j.PingRets))
+	}
+	return
+}
+
+// Pipeline appends the samples pushed by its workers, those of a server by the same one so that they stay in order
+// at most capacity samples wait, pushes beyond are rejected at once with the time to retry after,
+// so that a herd of probes reporting at once is slowed down instead of queued in memory
+type Pipeline struct {
+	workers []*worker
+	// the samples waiting, at most capacity
+	queued   int64
+	capacity int64
+	rejected int64
+
+	// the pushes hold it for reading, so that Close never closes a worker being notified
+	closeMu sync.RWMutex
+	closed  bool
+	done    sync.WaitGroup
+}
+
+type worker struct {
+	mu   sync.Mutex
+	jobs []Job
+	// signaled when jobs are queued, buffered by one so that a push never blocks
+	notify chan struct{}
+}
+
+func New(workers, capacity int, f func(Job)) *Pipeline {
+	p := &Pipeline{workers: make([]*worker, workers), capacity: int64(capacity)}
+	for i := range p.workers {
+		w := &worker{notify: make(chan struct{}, 1)}
+		p.workers[i] = w
+		p.done.Add(1)
+		go p.run(w, f)
+	}
+	return p
+}
+
+func (p *Pipeline) run(w *worker, f func(Job)) {
+	defer p.done.Done()
+	for range w.notify {
+		p.drain(w, f)
+	}
+	// the jobs queued before Close
+	p.drain(w, f)
+}
+
+func (p *Pipeline) drain(w *worker, f func(Job)) {
+	for {
+		w.mu.Lock()
+		n := min(len(w.jobs), _BATCH)
+		batch := w.jobs[:n:n]
+		w.jobs = w.jobs[n:]
+		if len(w.jobs) == 0 {
+			// the backing array is dropped once drained, so that a burst does not pin its memory
+			w.jobs = nil
+		}
+		w.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		for _, j := range batch {
+			f(j)
+		}
+		atomic.AddInt64(&p.queued, -samples(batch))
+	}
+}
+
+// Push queues the samples, or none of them with the time to retry after if the queue is full or closed
+func (p *Pipeline) Push(jobs []Job) (retryAfter time.Duration, ok bool) {
+	p.closeMu.RLock()
+	defer p.closeMu.RUnlock()
+	if p.closed {
+		atomic.AddInt64(&p.rejected, samples(jobs))
+		return _MIN_RETRY_AFTER, false
+	}
+	if n := atomic.AddInt64(&p.queued, samples(jobs)); n > p.capacity {
+		atomic.AddInt64(&p.queued, -samples(jobs))
+		atomic.AddInt64(&p.rejected, samples(jobs))
+		return p.retryAfter(n), false
+	}
+	for _, j := range jobs {
+		w := p.workers[workerOf(j.Server, len(p.workers))]
+		w.mu.Lock()
+		w.jobs = append(w.jobs, j)
+		w.mu.Unlock()
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+	return 0, true
+}
+
+// Close rejects the pushes and waits at most timeout for the workers to append the samples queued,
+// the samples are acknowledged once queued, so they are lost unless appended before the store is closed
+// returns the samples still queued after the timeout
+func (p *Pipeline) Close(timeout time.Duration) int64 {
+	p.closeMu.Lock()
+	if !p.closed {
+		p.closed = true
+		for _, w := range p.workers {
+			close(w.notify)
+		}
+	}
+	p.closeMu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.done.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+	return atomic.LoadInt64(&p.queued)
+}
+
+// about the time the workers take to drain the queue, a millisecond a sample each, rounded up to the second
+func (p *Pipeline) retryAfter(queued int64) time.Duration {
+	d := time.Duration(queued/int64(len(p.workers))) * time.Millisecond
+	d = (d + time.Second - 1).Truncate(time.Second)
+	return max(_MIN_RETRY_AFTER, min(d, _MAX_RETRY_AFTER))
+}
+
+func workerOf(server string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(server))
+	return int(h.Sum32() % uint32(n))
+}
+
+// Stats returns the stats of the pipeline for the metrics
+func (p *Pipeline) Stats() (queued, capacity, rejected int64) {
+	return atomic.LoadInt64(&p.queued), p.capacity, atomic.LoadInt64(&p.rejected)
+}
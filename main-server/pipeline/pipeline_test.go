@@ -0,0 +1,79 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+func Test_Push(t *testing.T) {
+	release := make(chan struct{})
+	var appended int64
+	p := New(2, 4, func(j Job) {
+		<-release
+		atomic.AddInt64(&appended, int64(len(j.PingRets)))
+	})
+	jobs := func(servers ...int) []Job {
+		ret := make([]Job, len(servers))
+		for i, n := range servers {
+			ret[i] = Job{Server: fmt.Sprint(i), PingRets: make([]store.PingRet, n)}
+		}
+		return ret
+	}
+	// the samples are counted rather than the jobs
+	if _, ok := p.Push(jobs(1, 3)); !ok {
+		t.Fatal("the samples within the capacity should be queued")
+	}
+	if retryAfter, ok := p.Push(jobs(1)); ok || retryAfter < _MIN_RETRY_AFTER {
+		t.Errorf("the jobs beyond the capacity should be rejected, got %v, %v", retryAfter, ok)
+	}
+	if _, _, rejected := p.Stats(); rejected != 1 {
+		t.Errorf("got %v rejected", rejected)
+	}
+	close(release)
+	if n := p.Close(time.Second); n != 0 || atomic.LoadInt64(&appended) != 4 {
+		t.Errorf("got %v queued, %v appended", n, appended)
+	}
+	if _, ok := p.Push(jobs(1)); ok {
+		t.Error("the pushes should be rejected once closed")
+	}
+}
+
+func Test_Close(t *testing.T) {
+	dir := t.TempDir()
+	conf := store.EngineConfig{"serversDir": dir + "/servers", "usersDir": dir + "/users"}
+	s := store.NewStore().SetStoreEngine(store.ENGINE_FILE, conf)
+	s.AddUser(context.Background(), "alice", "pass")
+	s.AddMonitorServer(context.Background(), "alice", "google.com")
+	p := New(1, 1<<10, func(j Job) {
+		// slower than the pushes, so that the samples are queued on shutdown
+		time.Sleep(time.Millisecond)
+		s.AppendPingRets(context.Background(), j.Server, j.Location, j.PingRets)
+	})
+	start := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	jobs := make([]Job, 100)
+	for i := range jobs {
+		jobs[i] = Job{Server: "google.com", Location: "Tokyo", PingRets: []store.PingRet{{Ping: fmt.Sprint(i), Time: start.Add(time.Duration(i) * time.Minute).Format("06-01-02 15:04")}}}
+	}
+	if _, ok := p.Push(jobs); !ok {
+		t.Fatal("the jobs should be queued")
+	}
+	if n := p.Close(10 * time.Second); n != 0 {
+		t.Fatalf("%v samples are not appended", n)
+	}
+	s.Close()
+
+	s = store.NewStore().SetStoreEngine(store.ENGINE_FILE, conf)
+	defer s.Close()
+	ret, err := s.GetMonitorResult("alice", "google.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prs := ret["Tokyo"]; len(prs) != len(jobs) || prs[len(prs)-1].Ping != "99" {
+		t.Errorf("the samples queued should be appended before the store is closed, got %v", len(prs))
+	}
+}
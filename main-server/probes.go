@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/gogames/watchdog/main-server/pingClientManager"
+	"github.com/gogames/watchdog/probe"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+// location -> metadata registered by the ping node or the probe agent of the location
+var (
+	probeMetadata    = make(map[string]probe.Metadata)
+	probeMetadataRwl sync.RWMutex
+)
+
+func setProbeMetadata(location string, meta probe.Metadata) error {
+	if err := meta.Validate(); err != nil {
+		return err
+	}
+	probeMetadataRwl.Lock()
+	defer probeMetadataRwl.Unlock()
+	probeMetadata[location] = meta
+	return nil
+}
+
+func deleteProbeMetadata(location string) {
+	probeMetadataRwl.Lock()
+	defer probeMetadataRwl.Unlock()
+	delete(probeMetadata, location)
+}
+
+// location -> metadata of the registered ping nodes and the probe agents, empty if the probe registered none
+func getProbes() map[string]probe.Metadata {
+	probeMetadataRwl.RLock()
+	defer probeMetadataRwl.RUnlock()
+	probes := make(map[string]probe.Metadata, len(probeMetadata))
+	for location, meta := range probeMetadata {
+		probes[location] = meta
+	}
+	pcm.Iterate(func(location string, _ pingClientManager.PingClient) {
+		if _, ok := probes[location]; !ok {
+			probes[location] = probe.Metadata{}
+		}
+	})
+	return probes
+}
+
+// called by ping nodes after registered, the network is filled by the address of the ping node, see -asndb
+func (pingServerStub) SetProbeMetadata(location string, meta probe.Metadata, ctx hprose.Context) error {
+	if c, ok := ctx.(*hprose.HttpContext); ok && c.Request != nil {
+		meta = enrichProbe(meta, getIp(c.Request.RemoteAddr))
+	}
+	return setProbeMetadata(location, meta)
+}
+
+// GetProbes returns location -> metadata of the probes, like the country and the coordinates to render a map
+// update session life
+func (mainServerStub) GetProbes(sid, username string) (probes map[string]probe.Metadata, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			probes = getProbes()
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
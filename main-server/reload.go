@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/config"
+	"github.com/gogames/watchdog/main-server/sdnotify"
+)
+
+var (
+	// flags set on the command line are never reloaded
+	commandLineFlags = make(map[string]bool)
+	reloadMu         sync.Mutex
+	pingFrequence    int64
+)
+
+// flags applied at runtime, the others require restart
+var reloadable = map[string]func(){
+	"level":          func() { setLogLevel(*flagLogLevel) },
+	"slowthreshold":  func() { storeEngine.SetSlowThreshold(*flagSlowThreshold) },
+	"pingfreq":       func() { atomic.StoreInt64(&pingFrequence, int64(*flagPingFrequence)) },
+	"inboxretention": func() { storeEngine.SetInboxRetention(*flagInboxRetention) },
+	"phonecodes":     func() { storeEngine.SetPhoneCodeLimit(*flagPhoneCodes) },
+	// validated by checkFlags, the servers are classified by them as their ping results come in
+	"statusrules": func() {
+		r, _ := statusRules()
+		storeEngine.SetStatusRules(r)
+	},
+	"twiliofrom": initSMS,
+}
+
+func getPingFrequence() time.Duration {
+	return time.Duration(atomic.LoadInt64(&pingFrequence)) * time.Minute
+}
+
+func initReload() {
+	flag.Visit(func(f *flag.Flag) { commandLineFlags[f.Name] = true })
+	atomic.StoreInt64(&pingFrequence, int64(*flagPingFrequence))
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			sdnotify.Notify(sdnotify.RELOADING)
+			changes, err := reload()
+			sdnotify.Notify(sdnotify.READY)
+			if err != nil {
+				logger.Error("can not reload config: %v", err)
+			} else {
+				logger.With("changes", changes).Info("config reloaded")
+			}
+		}
+	}()
+}
+
+// reload the config file and environment variables
+// the changes are applied all or none, changes of flags not reloadable are reported but not applied
+// keys removed from the config file keep their values until restart
+func reload() (changes []string, err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	fileValues := make(map[string]string)
+	if *flagConfig != "" {
+		if fileValues, err = config.Load(*flagConfig, flag.CommandLine); err != nil {
+			return
+		}
+	}
+	values := fileValues
+	for name, val := range config.Env(flag.CommandLine) {
+		values[name] = val
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	old := make(map[string]string)
+	changes = make([]string, 0)
+	restart := make([]string, 0)
+	for _, name := range names {
+		if commandLineFlags[name] {
+			continue
+		}
+		f := flag.Lookup(name)
+		val, e := normalize(f, values[name])
+		if e != nil {
+			return nil, fmt.Errorf("invalid value %q of %v: %v", values[name], name, e)
+		}
+		if raw, ok := secretRefs[name]; ok {
+			// never print the secrets
+			if val != raw {
+				changes = append(changes, fmt.Sprintf("%v changed (requires restart)", name))
+				restart = append(restart, name)
+			}
+			continue
+		}
+		if val == f.Value.String() {
+			continue
+		}
+		if _, ok := reloadable[name]; !ok {
+			changes = append(changes, fmt.Sprintf("%v: %v -> %v (requires restart)", name, f.Value.String(), val))
+			restart = append(restart, name)
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%v: %v -> %v", name, f.Value.String(), val))
+		old[name] = f.Value.String()
+		f.Value.Set(val)
+	}
+	if err = checkFlags(); err != nil {
+		for name, val := range old {
+			flag.Lookup(name).Value.Set(val)
+		}
+		return nil, fmt.Errorf("invalid config: %v", err)
+	}
+	for name := range old {
+		reloadable[name]()
+	}
+	if len(restart) > 0 {
+		logger.With("flags", restart).Warn("the changes of the flags are not applied until restart")
+	}
+	return
+}
+
+// the value in the format of the flag, so that equal values compare equal
+func normalize(f *flag.Flag, raw string) (string, error) {
+	v, ok := reflect.New(reflect.TypeOf(f.Value).Elem()).Interface().(flag.Value)
+	if !ok {
+		return raw, nil
+	}
+	if err := v.Set(raw); err != nil {
+		return "", err
+	}
+	return v.String(), nil
+}
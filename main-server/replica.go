@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+const (
+	_REPLICATION_WAIT  = 30 * time.Second
+	_REPLICATION_RETRY = 5 * time.Second
+)
+
+var replicationClient = &http.Client{Timeout: _REPLICATION_WAIT + 10*time.Second}
+
+func isReplica() bool { return *flagReplicaOf != "" }
+
+// the replica serves the users read only, writes should go to the primary
+func checkWritable() error {
+	if isReplica() {
+		return fmt.Errorf("read only replica of %v, please write to the primary", *flagReplicaOf)
+	}
+	return nil
+}
+
+// the primary serves the snapshot and the change feed of the store on the admin server
+func initReplication() {
+	adminMux.Handle("/replication/snapshot", adminAuth(http.HandlerFunc(snapshotHandler)))
+	adminMux.Handle("/replication/changes", adminAuth(http.HandlerFunc(changesHandler)))
+}
+
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(storeEngine.Snapshot())
+}
+
+// long polls the events after seq of epoch, responds 410 if the replica should resync from a snapshot
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	epoch, err := strconv.ParseInt(q.Get("epoch"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid epoch", http.StatusBadRequest)
+		return
+	}
+	seq, err := strconv.ParseUint(q.Get("seq"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid seq", http.StatusBadRequest)
+		return
+	}
+	wait, _ := time.ParseDuration(q.Get("wait"))
+	if wait > _REPLICATION_WAIT {
+		wait = _REPLICATION_WAIT
+	}
+	events, err := storeEngine.Changes(epoch, seq, wait)
+	if err == store.ErrorFeedTruncated {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// the replica follows the primary, resyncs from a snapshot when the feed is truncated or the primary restarts
+func replicate() {
+	for {
+		var snap store.Snapshot
+		if err := getReplication("/replication/snapshot", nil, &snap); err != nil {
+			logger.With("primary", *flagReplicaOf).Error("can not get snapshot: %v", err)
+			time.Sleep(_REPLICATION_RETRY)
+			continue
+		}
+		storeEngine.ApplySnapshot(snap)
+		logger.With("primary", *flagReplicaOf, "seq", snap.Seq).Info("replica synced from snapshot")
+
+		for seq := snap.Seq; ; {
+			var events []store.FeedEvent
+			err := getReplication("/replication/changes", url.Values{
+				"epoch": {strconv.FormatInt(snap.Epoch, 10)},
+				"seq":   {strconv.FormatUint(seq, 10)},
+				"wait":  {_REPLICATION_WAIT.String()},
+			}, &events)
+			if err == store.ErrorFeedTruncated {
+				break
+			}
+			if err != nil {
+				logger.With("primary", *flagReplicaOf, "seq", seq).Error("can not get changes: %v", err)
+				time.Sleep(_REPLICATION_RETRY)
+				continue
+			}
+			if len(events) > 0 {
+				storeEngine.ApplyChanges(events)
+				seq = events[len(events)-1].Seq
+			}
+		}
+	}
+}
+
+func getReplication(path string, q url.Values, v interface{}) error {
+	if q == nil {
+		q = url.Values{}
+	}
+	req, err := http.NewRequest(http.MethodGet, *flagReplicaOf+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*flagReplicaToken)
+	resp, err := replicationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return json.NewDecoder(resp.Body).Decode(v)
+	case http.StatusGone:
+		return store.ErrorFeedTruncated
+	default:
+		return fmt.Errorf("primary responds %v", resp.Status)
+	}
+}
+
+func initReplica() {
+	if isReplica() {
+		go replicate()
+	}
+}
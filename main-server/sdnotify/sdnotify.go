@@ -0,0 +1,51 @@
+// systemd service notification, see sd_notify(3)
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	READY     = "READY=1"
+	STOPPING  = "STOPPING=1"
+	RELOADING = "RELOADING=1"
+	WATCHDOG  = "WATCHDOG=1"
+)
+
+// Notify sends the state to systemd, it does nothing if not run by systemd
+func Notify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	// abstract socket
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Watchdog keeps notifying systemd at half of the watchdog interval
+// it does nothing if the watchdog of the service is disabled
+func Watchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	go func() {
+		t := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+		defer t.Stop()
+		for range t.C {
+			Notify(WATCHDOG)
+		}
+	}()
+}
@@ -0,0 +1,33 @@
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Notify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := Notify(READY); err != nil {
+		t.Errorf("should do nothing without systemd, got %v", err)
+	}
+
+	name := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", name)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	if err = Notify(READY); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 64)
+	n, err := conn.Read(b)
+	if err != nil || string(b[:n]) != READY {
+		t.Errorf("got %q, %v", b[:n], err)
+	}
+}
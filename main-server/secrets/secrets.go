@@ -0,0 +1,266 @@
+// references to secrets in the config, so that the credentials do not live in the config file nor the command line
+//
+// a reference is "secret:<provider>:<name>", resolved by the provider registered by the name
+//
+//	secret:env:SMTP_PASSWORD                  the environment variable
+//	secret:file:/run/secrets/slack_token      the file, trailing new lines trimmed, like docker and kubernetes secrets
+//	secret:vault:secret/data/watchdog#dsn     the field of the kv secret of vault at VAULT_ADDR by VAULT_TOKEN
+//	secret:aws:prod/watchdog#dsn              the field of the json secret of aws secrets manager, the whole secret without #field
+//
+// aws secrets manager is reached at AWS_REGION by AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN if temporary
+// other providers are registered by Register
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/awsv4"
+)
+
+const PREFIX = "secret:"
+
+// resolved secrets are cached for it, so that the providers are not hit on every use
+const _CACHE_TTL = 5 * time.Minute
+
+// Provider looks up the secret of the name
+type Provider interface {
+	Get(ctx context.Context, name string) (string, error)
+}
+
+// ProviderFunc adapts a function to Provider
+type ProviderFunc func(ctx context.Context, name string) (string, error)
+
+func (f ProviderFunc) Get(ctx context.Context, name string) (string, error) { return f(ctx, name) }
+
+type cached struct {
+	value  string
+	expire time.Time
+}
+
+var (
+	providers = map[string]Provider{
+		"env":   ProviderFunc(getEnv),
+		"file":  ProviderFunc(getFile),
+		"vault": &vault{client: &http.Client{Timeout: 10 * time.Second}},
+		"aws":   &secretsManager{client: &http.Client{Timeout: 10 * time.Second}},
+	}
+	cache = make(map[string]cached)
+	mu    sync.RWMutex
+)
+
+// Register makes the provider available to the references "secret:<name>:...", it replaces the provider of the name
+func Register(name string, p Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+	providers[name] = p
+}
+
+// IsRef returns true if s is a reference to a secret
+func IsRef(s string) bool { return strings.HasPrefix(s, PREFIX) }
+
+// Resolve returns the secret s references, or s if it is not a reference
+func Resolve(ctx context.Context, s string) (string, error) {
+	if !IsRef(s) {
+		return s, nil
+	}
+	mu.RLock()
+	c, ok := cache[s]
+	mu.RUnlock()
+	if ok && time.Now().Before(c.expire) {
+		return c.value, nil
+	}
+	ref := strings.SplitN(strings.TrimPrefix(s, PREFIX), ":", 2)
+	if len(ref) != 2 || ref[1] == "" {
+		return "", fmt.Errorf("invalid secret reference %q, should be %v<provider>:<name>", s, PREFIX)
+	}
+	mu.RLock()
+	p, ok := providers[ref[0]]
+	mu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unknown secret provider %v", ref[0])
+	}
+	v, err := p.Get(ctx, ref[1])
+	if err != nil {
+		// the name is not a secret, the value would be
+		return "", fmt.Errorf("can not get secret %v of %v: %v", ref[1], ref[0], err)
+	}
+	mu.Lock()
+	cache[s] = cached{value: v, expire: time.Now().Add(_CACHE_TTL)}
+	mu.Unlock()
+	return v, nil
+}
+
+// ResolveJSON resolves the references of the string values of the json, nested in objects and arrays
+// other strings are returned as they are
+func ResolveJSON(ctx context.Context, s string) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return Resolve(ctx, s)
+	}
+	found := false
+	v, err := resolveValue(ctx, v, &found)
+	if err != nil || !found {
+		return s, err
+	}
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+func resolveValue(ctx context.Context, v interface{}, found *bool) (interface{}, error) {
+	var err error
+	switch t := v.(type) {
+	case string:
+		if IsRef(t) {
+			*found = true
+			return Resolve(ctx, t)
+		}
+	case map[string]interface{}:
+		for k, e := range t {
+			if t[k], err = resolveValue(ctx, e, found); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i, e := range t {
+			if t[i], err = resolveValue(ctx, e, found); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return v, nil
+}
+
+func getEnv(ctx context.Context, name string) (string, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable is not set")
+	}
+	return v, nil
+}
+
+func getFile(ctx context.Context, name string) (string, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// the kv secrets engine of vault, version 1 and 2, the name is <path>#<field>
+type vault struct {
+	client *http.Client
+}
+
+func (v *vault) Get(ctx context.Context, name string) (string, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if addr == "" || token == "" {
+		return "", fmt.Errorf("VAULT_ADDR and VAULT_TOKEN should be set")
+	}
+	i := strings.LastIndex(name, "#")
+	if i <= 0 || i == len(name)-1 {
+		return "", fmt.Errorf("should be <path>#<field>")
+	}
+	path, field := name[:i], name[i+1:]
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault responds %v", resp.Status)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	data := body.Data
+	// kv version 2 nests the secret in data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	s, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("field %v is not a string in the secret", field)
+	}
+	return s, nil
+}
+
+// aws secrets manager, the name is <secret id>[#<field>], the field of the secret string in json if set
+type secretsManager struct {
+	client *http.Client
+}
+
+func (m *secretsManager) Get(ctx context.Context, name string) (string, error) {
+	region, accessKey, secretKey := os.Getenv("AWS_REGION"), os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if region == "" || accessKey == "" || secretKey == "" {
+		return "", fmt.Errorf("AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY should be set")
+	}
+	id, field := name, ""
+	if i := strings.LastIndex(name, "#"); i >= 0 {
+		id, field = name[:i], name[i+1:]
+		if id == "" || field == "" {
+			return "", fmt.Errorf("should be <secret id>#<field>")
+		}
+	}
+	// AWS_ENDPOINT_URL reaches a vpc endpoint or a local emulator
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%v.amazonaws.com", region)
+	}
+	body, _ := json.Marshal(map[string]string{"SecretId": id})
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	if token := os.Getenv("AWS_SESSION_TOKEN"); token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+	awsv4.Sign(req, body, region, "secretsmanager", accessKey, secretKey, time.Now())
+	resp, err := m.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("secrets manager responds %v", resp.Status)
+	}
+	var ret struct {
+		SecretString *string `json:"SecretString"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return "", err
+	}
+	if ret.SecretString == nil {
+		return "", fmt.Errorf("the secret is binary")
+	}
+	if field == "" {
+		return *ret.SecretString, nil
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal([]byte(*ret.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("the secret is not json")
+	}
+	s, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("field %v is not a string in the secret", field)
+	}
+	return s, nil
+}
@@ -0,0 +1,122 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var ctx = context.Background()
+
+func Test_Resolve(t *testing.T) {
+	os.Setenv("WATCHDOG_TEST_SECRET", "s3cret")
+	defer os.Unsetenv("WATCHDOG_TEST_SECRET")
+	path := filepath.Join(t.TempDir(), "token")
+	if err := ioutil.WriteFile(path, []byte("t0ken\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	Register("static", ProviderFunc(func(ctx context.Context, name string) (string, error) { return "static-" + name, nil }))
+
+	for ref, want := range map[string]string{
+		"plain":                           "plain",
+		"secret:env:WATCHDOG_TEST_SECRET": "s3cret",
+		"secret:file:" + path:             "t0ken",
+		"secret:static:x":                 "static-x",
+	} {
+		if got, err := Resolve(ctx, ref); err != nil || got != want {
+			t.Errorf("%v: want %v, got %v, %v", ref, want, got, err)
+		}
+	}
+	for _, ref := range []string{"secret:env:WATCHDOG_TEST_UNSET", "secret:nope:x", "secret:env"} {
+		if _, err := Resolve(ctx, ref); err == nil {
+			t.Errorf("%v: want error", ref)
+		}
+	}
+}
+
+func Test_ResolveJSON(t *testing.T) {
+	os.Setenv("WATCHDOG_TEST_DSN", "user:pass@tcp(db)/watchdog")
+	defer os.Unsetenv("WATCHDOG_TEST_DSN")
+	got, err := ResolveJSON(ctx, `{"dsn": "secret:env:WATCHDOG_TEST_DSN", "hosts": ["a", "b"], "nested": {"n": 1}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"dsn":"user:pass@tcp(db)/watchdog","hosts":["a","b"],"nested":{"n":1}}`; got != want {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	// left as it is without references
+	if got, _ = ResolveJSON(ctx, `{"a": 1}`); got != `{"a": 1}` {
+		t.Errorf("got %v", got)
+	}
+}
+
+func Test_Vault(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "root" || r.URL.Path != "/v1/secret/data/watchdog" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"data": {"data": {"slack": "xoxb"}}}`))
+	}))
+	defer srv.Close()
+	os.Setenv("VAULT_ADDR", srv.URL)
+	os.Setenv("VAULT_TOKEN", "root")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	if got, err := Resolve(ctx, "secret:vault:secret/data/watchdog#slack"); err != nil || got != "xoxb" {
+		t.Errorf("got %v, %v", got, err)
+	}
+	if _, err := Resolve(ctx, "secret:vault:secret/data/other#slack"); err == nil {
+		t.Error("want the error of vault")
+	}
+}
+
+func Test_SecretsManager(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct{ SecretId string }
+		json.NewDecoder(r.Body).Decode(&req)
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/secretsmanager/aws4_request") ||
+			r.Header.Get("X-Amz-Target") != "secretsmanager.GetSecretValue" || r.Header.Get("X-Amz-Security-Token") != "session" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		switch req.SecretId {
+		case "prod/watchdog":
+			w.Write([]byte(`{"Name": "prod/watchdog", "SecretString": "{\"dsn\": \"user:pass@tcp(db)/watchdog\"}"}`))
+		case "prod/token":
+			w.Write([]byte(`{"Name": "prod/token", "SecretString": "t0ken"}`))
+		default:
+			http.Error(w, `{"__type": "ResourceNotFoundException"}`, http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	for k, v := range map[string]string{
+		"AWS_ENDPOINT_URL": srv.URL, "AWS_REGION": "eu-west-1",
+		"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "secret", "AWS_SESSION_TOKEN": "session",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	for ref, want := range map[string]string{
+		"secret:aws:prod/watchdog#dsn": "user:pass@tcp(db)/watchdog",
+		"secret:aws:prod/token":        "t0ken",
+	} {
+		if got, err := Resolve(ctx, ref); err != nil || got != want {
+			t.Errorf("%v: want %v, got %v, %v", ref, want, got, err)
+		}
+	}
+	for _, ref := range []string{"secret:aws:prod/other", "secret:aws:prod/watchdog#user", "secret:aws:prod/token#dsn", "secret:aws:#dsn"} {
+		if _, err := Resolve(ctx, ref); err == nil {
+			t.Errorf("%v: want error", ref)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/hashring"
+)
+
+// nil unless -shards is set
+var (
+	ring   *hashring.Ring
+	shards map[string]string
+)
+
+// parse comma separated nodeid=url
+func parseShards(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, shard := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(shard), "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("shard %q should be nodeid=url", shard)
+		}
+		if _, ok := m[kv[0]]; ok {
+			return nil, fmt.Errorf("shard %v is duplicated", kv[0])
+		}
+		m[kv[0]] = kv[1]
+	}
+	return m, nil
+}
+
+// the owner pings the server if sharded, otherwise the leader, the replica never does
+func shouldPing(server string) bool {
+	if isReplica() {
+		return false
+	}
+	if ring == nil {
+		return isLeader()
+	}
+	return ring.Get(server) == nodeId()
+}
+
+func shardOf(server string) (node, url string) {
+	node = ring.Get(server)
+	return node, shards[node]
+}
+
+// responds the node owning the server, so that clients may query the owner for the latest results
+func shardHandler(w http.ResponseWriter, r *http.Request) {
+	server := r.URL.Query().Get("server")
+	if server == "" {
+		http.Error(w, "server is required", http.StatusBadRequest)
+		return
+	}
+	node, url := shardOf(server)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"server": server, "node": node, "url": url})
+}
+
+// GetShard returns the main server owning the server
+func (mainServerStub) GetShard(server string) (node, url string, err error) {
+	if ring == nil {
+		err = fmt.Errorf("main server is not sharded")
+		return
+	}
+	node, url = shardOf(server)
+	return
+}
+
+// the main servers sharing the store engine partition the servers to ping by consistent hashing of the server
+// every one serves the users and reloads the store engine every -hasync to see the results of others
+func initShard() {
+	if *flagShards == "" {
+		return
+	}
+	// validated in checkFlags
+	shards, _ = parseShards(*flagShards)
+	ring = hashring.New(hashring.DEFAULT_REPLICAS)
+	for node := range shards {
+		ring.Add(node)
+	}
+	mainMux.HandleFunc("/shard", shardHandler)
+	go func() {
+		for range time.Tick(*flagHASync) {
+			storeEngine.Reload()
+		}
+	}()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/share"
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+const _MAX_SHARE_TTL = 24 * 365
+
+var shareSigner *share.Signer
+
+func initShare() {
+	secret := []byte(*flagShareSecret)
+	if len(secret) == 0 {
+		logger.Info("share secret is not set, share tokens are invalid after restart")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			panic(fmt.Errorf("can not generate share secret: %v", err))
+		}
+	}
+	shareSigner = share.NewSigner(secret)
+}
+
+func initCORS() {
+	if *flagCORSOrigins == "" {
+		return
+	}
+	mainServer.CrossDomainEnabled = true
+	for _, origin := range strings.Split(*flagCORSOrigins, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			mainServer.AddAccessControlAllowOrigin(origin)
+		}
+	}
+}
+
+// a token of the server which can be embedded in other sites without signing in
+func (mainServerStub) CreateShareToken(sid, username, server string, ttlHours int) (token string, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			signedIn = true
+			if ttlHours <= 0 || ttlHours > _MAX_SHARE_TTL {
+				err = fmt.Errorf("ttl should be between 1 and %v hours", _MAX_SHARE_TTL)
+				return
+			}
+			if _, err = storeEngine.GetMonitorResult(username, server); err != nil {
+				return
+			}
+			token = shareSigner.Sign(username, server, time.Now().Add(time.Duration(ttlHours)*time.Hour))
+		}
+	}
+	return
+}
+
+// read only result of the server shared by the token
+func (mainServerStub) GetSharedResult(token string) (server string, ret map[string][]store.PingRet, err error) {
+	var username string
+	if username, server, err = shareSigner.Verify(token); err != nil {
+		return
+	}
+	ret, err = storeEngine.GetMonitorResult(username, server)
+	return
+}
+
+// the branding of the user sharing the result by the token, rendered by the status pages embedding it
+func (mainServerStub) GetSharedBranding(token string) (b store.Branding, err error) {
+	username, _, err := shareSigner.Verify(token)
+	if err != nil {
+		return
+	}
+	st, err := storeEngine.GetSettings(username)
+	return st.Branding, err
+}
@@ -0,0 +1,66 @@
+// signed tokens granting read only access to the result of one server
+package share
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrorInvalidToken = errors.New("invalid share token")
+	ErrorExpiredToken = errors.New("share token is expired")
+)
+
+type claims struct {
+	Username string `json:"u"`
+	Server   string `json:"s"`
+	Expire   int64  `json:"e"`
+}
+
+type Signer struct {
+	secret []byte
+}
+
+func NewSigner(secret []byte) *Signer { return &Signer{secret: secret} }
+
+// Sign returns a token of the server monitored by the user, valid until expire
+func (s *Signer) Sign(username, server string, expire time.Time) string {
+	b, _ := json.Marshal(claims{Username: username, Server: server, Expire: expire.Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + s.sign(payload)
+}
+
+// Verify returns the user and server of a valid token
+func (s *Signer) Verify(token string) (username, server string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0]))) {
+		err = ErrorInvalidToken
+		return
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		err = ErrorInvalidToken
+		return
+	}
+	var c claims
+	if err = json.Unmarshal(b, &c); err != nil {
+		err = ErrorInvalidToken
+		return
+	}
+	if time.Now().Unix() > c.Expire {
+		err = ErrorExpiredToken
+		return
+	}
+	return c.Username, c.Server, nil
+}
+
+func (s *Signer) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,26 @@
+package share
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_Signer(t *testing.T) {
+	s := NewSigner([]byte("secret"))
+
+	token := s.Sign("alice", "google.com", time.Now().Add(time.Hour))
+	username, server, err := s.Verify(token)
+	if err != nil || username != "alice" || server != "google.com" {
+		t.Errorf("verify got %v, %v, %v", username, server, err)
+	}
+
+	if _, _, err = NewSigner([]byte("other")).Verify(token); err != ErrorInvalidToken {
+		t.Errorf("token signed by other secret got %v", err)
+	}
+	if _, _, err = s.Verify(token[1:]); err != ErrorInvalidToken {
+		t.Errorf("tampered token got %v", err)
+	}
+	if _, _, err = s.Verify(s.Sign("alice", "google.com", time.Now().Add(-time.Second))); err != ErrorExpiredToken {
+		t.Errorf("expired token got %v", err)
+	}
+}
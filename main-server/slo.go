@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+const (
+	_SLO_TICK     = time.Minute
+	_SLO_TEMPLATE = "slo"
+)
+
+// username -> slo -> since when the alert of its fast burn is firing, of the slos of the servers pinged here
+var fastBurns = make(map[string]map[string]time.Time)
+
+// fire the alerts of the slos burning fast and resolve those burning slow again, like the alert rules
+// the slos are checked where their servers are pinged, by the leader or the owner of the server
+func checkSLOs(now time.Time) {
+	seen := make(map[string]map[string]bool)
+	for _, sub := range storeEngine.SLOSubjects() {
+		sts, err := storeEngine.GetSLOs(sub.Username, now)
+		if err != nil {
+			logger.With("username", sub.Username).Warn("can not check slos: %v", err)
+			continue
+		}
+		seen[sub.Username] = make(map[string]bool, len(sts))
+		for _, st := range sts {
+			if !shouldPing(st.SLO.Server) {
+				continue
+			}
+			seen[sub.Username][st.SLO.Name] = true
+			since, firing := fastBurns[sub.Username][st.SLO.Name]
+			a := alert.Alert{
+				Username: sub.Username, Server: st.SLO.Server, Template: _SLO_TEMPLATE, Rule: st.SLO.Name,
+				Severity: alert.SEVERITY_CRITICAL, Value: st.BurnRate, Time: now.Format(_TIME_LAYOUT), Since: since, At: now,
+			}
+			switch {
+			case st.FastBurning && !firing:
+				if fastBurns[sub.Username] == nil {
+					fastBurns[sub.Username] = make(map[string]time.Time)
+				}
+				fastBurns[sub.Username][st.SLO.Name] = now
+				a.State, a.Since = alert.STATE_FIRING, now
+				notify(a, sub)
+			case !st.FastBurning && firing:
+				delete(fastBurns[sub.Username], st.SLO.Name)
+				a.State = alert.STATE_RESOLVED
+				notify(a, sub)
+			}
+		}
+	}
+	// the slos deleted, or of the servers pinged elsewhere now, are forgotten without resolving
+	for username, slos := range fastBurns {
+		for name := range slos {
+			if !seen[username][name] {
+				delete(slos, name)
+			}
+		}
+		if len(slos) == 0 {
+			delete(fastBurns, username)
+		}
+	}
+}
+
+func initSLO() {
+	go func() {
+		for {
+			checkSLOs(<-time.After(_SLO_TICK))
+		}
+	}()
+}
+
+// add the slo of the server or replace the one of the same name, see store.SLO
+// update session life
+func (mainServerStub) SetSLO(sid, username string, o store.SLO, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.SetSLO(requestContext(ctx), username, o); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// update session life
+func (mainServerStub) DeleteSLO(sid, username, name string, ctx hprose.Context) (signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if err = checkWritable(); err != nil {
+				return
+			}
+			if err = storeEngine.DeleteSLO(requestContext(ctx), username, name); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
+
+// get the remaining error budget and the burn rate of every slo of the user
+func (mainServerStub) GetSLOs(sid, username string) (sts []store.SLOStatus, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			sts, err = storeEngine.GetSLOs(username, time.Now())
+			signedIn = true
+		}
+	}
+	return
+}
@@ -1,75 +1,114 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"reflect"
 	"time"
 
+	"github.com/gogames/watchdog/main-server/alert"
 	"github.com/gogames/watchdog/main-server/pingClientManager"
 	"github.com/gogames/watchdog/main-server/safeMap"
 	"github.com/gogames/watchdog/main-server/store"
+	"github.com/hprose/hprose-go/hprose"
 )
 
 const (
 	_TIME_LAYOUT        = "06-01-02 15:04"
 	_MIN_PING_FREQUENCE = 1
+	// the retries of an engine write are bounded by -enginetimeout as well
+	_MAX_ENGINE_RETRY_WAIT = 5 * time.Second
 )
 
 var (
 	_STOP_PING_CHAN = struct{}{}
-	storeEngine     *store.Store
+	storeEngine     store.Interface
 )
 
 func initStore() {
+	conf, err := engineConfig()
+	if err != nil {
+		panic(err)
+	}
+	rules, err := statusRules()
+	if err != nil {
+		panic(err)
+	}
 	storeEngine = store.NewStore().
-		SetStoreEngine(store.ENGINE_FILE, fmt.Sprintf(`{"serversDir":"%s","usersDir":"%s"}`, *flagServersPath, *flagUsersPath))
+		SetLogger(logger.l).
+		SetTracer(tracer).
+		SetSlowThreshold(*flagSlowThreshold).
+		SetWriteTimeout(*flagEngineTimeout).
+		SetRetry(store.Retry{Attempts: *flagEngineRetries, Base: *flagEngineRetryWait, Max: _MAX_ENGINE_RETRY_WAIT}).
+		SetBreaker(store.BreakerConfig{Threshold: *flagEngineBreaker, Cooldown: *flagEngineCooldown, Buffer: *flagEngineBuffer}).
+		SetTiers(tiers()).
+		SetStatusRules(rules).
+		SetIsolation(*flagIsolation).
+		SetInboxRetention(*flagInboxRetention).
+		SetPhoneCodeLimit(*flagPhoneCodes).
+		SetTargetValidator(func(server string) error { return targetPolicy.Validate(server) }).
+		SetStoreEngine(*flagEngine, conf)
 	go pingLoop()
-	if *flagPingFrequence < _MIN_PING_FREQUENCE {
-		panic(fmt.Sprintf("should be larger than %v minutes", _MIN_PING_FREQUENCE))
+	go pruneInboxLoop()
+	if *flagHotTier > 0 {
+		go tierLoop()
+	}
+}
+
+func tiers() store.Tiers {
+	t := store.Tiers{Hot: *flagHotTier, Warm: *flagWarmTier}
+	if *flagColdTier != "" {
+		t.Cold = store.NewDirObjectStore(*flagColdTier)
+	}
+	return t
+}
+
+// move the ping results down the tiers on interval, the owners of the servers do, as they write them
+func tierLoop() {
+	for tn := range time.Tick(*flagTierInterval) {
+		if isReplica() {
+			return
+		}
+		r, err := storeEngine.Tier(context.Background(), tn, shouldPing)
+		if err != nil {
+			logger.Error("can not tier the ping results: %v", err)
+			continue
+		}
+		logger.With("evicted", r.Evicted, "expired", r.Expired, "archived", r.Archived).Info("tiered the ping results")
+	}
+}
+
+// the context of the http request of the hprose call, done when the client goes away
+func requestContext(ctx hprose.Context) context.Context {
+	if c, ok := ctx.(*hprose.HttpContext); ok && c.Request != nil {
+		rctx := c.Request.Context()
+		// instrument attaches the request id, the store logs it with the operations of the request
+		if store.RequestId(rctx) == "" {
+			if id := c.Request.Header.Get(_REQUEST_ID_HEADER); id != "" {
+				rctx = store.WithRequestId(rctx, id)
+			}
+		}
+		return rctx
 	}
+	return context.Background()
 }
 
 var stopChanMap = safeMap.NewSafeMap()
 
 func pingLoop() {
+	// the servers assigned before the restart are not sent again, see store.AssignmentStore
+	for _, s := range storeEngine.GetServers() {
+		startPinging(s)
+	}
 	for {
 		select {
-		case s := <-storeEngine.AddServerChan:
-			c := make(chan struct{})
-			if success := stopChanMap.Set(s, c); !success {
-				continue
-			}
-			go func(server string, stopChan <-chan struct{}) {
-				for {
-					select {
-					case tn := <-time.Tick(time.Duration(*flagPingFrequence) * time.Minute):
-						pcm.Iterate(func(location string, pc pingClientManager.PingClient) {
-							go func(location string, pc pingClientManager.PingClient) {
-								pr, err := pc.Ping(server)
-								if err != nil {
-									logger.Error("can not ping server %s: %v\n", server, err)
-									return
-								}
-								p := store.PingRet{
-									Ping: fmt.Sprintf("%.3f", pr.Avg),
-									Time: tn.Format(_TIME_LAYOUT),
-								}
-								if err = storeEngine.AppendPingRet(server, location, p); err != nil {
-									logger.Critical("can not append ping result: %v\n", p)
-								}
-							}(location, pc)
-						})
-					case <-stopChan:
-						stopChanMap.Delete(server)
-						return
-					}
-				}
-			}(s, c)
-		case s := <-storeEngine.KickServerChan:
+		case s := <-storeEngine.AddedServers():
+			startPinging(s)
+		case s := <-storeEngine.KickedServers():
 			if val := stopChanMap.Get(s); val != nil {
 				c, ok := val.(chan struct{})
 				if ok {
-					logger.Debug("stop ping the server %v", s)
+					logger.With("server", s).Debug("stop ping the server")
 					c <- _STOP_PING_CHAN
 				} else {
 					panic(fmt.Sprintf("the value is not struct{}, but %v", reflect.TypeOf(val).Name()))
@@ -78,3 +117,55 @@ func pingLoop() {
 		}
 	}
 }
+
+// ping the server every ping frequence until it is kicked, unless it is pinged already
+func startPinging(s string) {
+	c := make(chan struct{})
+	if success := stopChanMap.Set(s, c); !success {
+		return
+	}
+	go func(server string, stopChan <-chan struct{}) {
+		for {
+			select {
+			case tn := <-time.Tick(getPingFrequence()):
+				// others load the ping results written by the owner, the samples of virtual servers are pushed
+				// and the steps of the transactions are run by the probe agents
+				if !shouldPing(server) || store.IsVirtual(server) || store.IsTransaction(server) || !checkDue(server, tn) {
+					continue
+				}
+				go observeResolution(server, tn)
+				pcm.Iterate(func(location string, pc pingClientManager.PingClient) {
+					go func(location string, pc pingClientManager.PingClient) {
+						avg, loss, probeTime, err := pc.TimedPing(server)
+						if err != nil {
+							logger.With("server", server, "location", location).Error("can not ping server: %v", err)
+							return
+						}
+						received := time.Now()
+						p := store.PingRet{
+							Ping:         fmt.Sprintf("%.3f", avg),
+							Time:         tn.Format(_TIME_LAYOUT),
+							ReceivedTime: received.Format(time.RFC3339),
+						}
+						if !probeTime.IsZero() {
+							p.ProbeTime = probeTime.Format(time.RFC3339)
+							observeClockSkew(location, probeTime.Sub(received))
+						}
+						if loss >= 0 {
+							p.Loss = fmt.Sprintf("%.1f", loss)
+						}
+						if err = storeEngine.AppendPingRet(context.Background(), server, location, p); err != nil {
+							logger.With("server", server, "location", location).Critical("can not append ping result %v: %v", p, err)
+							return
+						}
+						observeProbeReport(location)
+						evaluateAlerts(server, location, alert.Sample{Time: p.Time, Ping: avg, Down: avg == 0, Loss: loss})
+					}(location, pc)
+				})
+			case <-stopChan:
+				stopChanMap.Delete(server)
+				return
+			}
+		}
+	}(s, c)
+}
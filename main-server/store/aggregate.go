@@ -0,0 +1,435 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	RESOLUTION_HOUR = "hour"
+	RESOLUTION_DAY  = "day"
+)
+
+// resolution -> length of the Start prefix of PingRet.Time, which is formatted as "06-01-02 15:04" by the main server
+var resolutions = map[string]int{
+	RESOLUTION_HOUR: len("06-01-02 15"),
+	RESOLUTION_DAY:  len("06-01-02"),
+}
+
+// the upper bounds in milliseconds of the latency buckets of the aggregates, the last bucket is above them
+var LATENCY_BUCKETS = []float64{10, 20, 30, 50, 80, 100, 150, 200, 300, 500, 800, 1000, 2000, 5000}
+
+// Aggregate is the statistics of the ping results of an hour or a day
+// Start is the prefix of PingRet.Time of the bucket, like "15-01-02 15" of an hour
+// results without response, like the padding, count as down and are excluded from Min, Max, Avg and Buckets
+type Aggregate struct {
+	Start  string  `json:"start"`
+	Count  int64   `json:"count"`
+	Down   int64   `json:"down"`
+	Sum    float64 `json:"sum"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	Avg    float64 `json:"avg"`
+	Uptime float64 `json:"uptime"`
+	// the ping results up by LATENCY_BUCKETS, empty of the aggregates written before the buckets
+	Buckets []int64 `json:"buckets,omitempty"`
+	// the average percent of the pings lost of the Pinged ping results telling it, see PingRet.Loss
+	Loss   float64 `json:"loss,omitempty"`
+	Pinged int64   `json:"pinged,omitempty"`
+}
+
+// Under returns the ping results up at most ms, which should be one of LATENCY_BUCKETS
+// false if the aggregate has no buckets
+func (a Aggregate) Under(ms float64) (n int64, ok bool) {
+	i := sort.SearchFloat64s(LATENCY_BUCKETS, ms)
+	if len(a.Buckets) != len(LATENCY_BUCKETS)+1 || i == len(LATENCY_BUCKETS) || LATENCY_BUCKETS[i] != ms {
+		return 0, false
+	}
+	for _, c := range a.Buckets[:i+1] {
+		n += c
+	}
+	return n, true
+}
+
+func (a *Aggregate) add(pr PingRet) {
+	a.Count++
+	defer func() { a.Uptime = float64(a.Count-a.Down) / float64(a.Count) }()
+	if loss, ok := pr.LossPercent(); ok {
+		a.Pinged++
+		a.Loss += (loss - a.Loss) / float64(a.Pinged)
+	}
+	p, err := strconv.ParseFloat(pr.Ping, 64)
+	if err != nil || pr.Ping == _DEFAULT_PING {
+		a.Down++
+		return
+	}
+	if up := a.Count - a.Down; up == 1 || p < a.Min {
+		a.Min = p
+	}
+	if p > a.Max {
+		a.Max = p
+	}
+	a.Sum += p
+	a.Avg = a.Sum / float64(a.Count-a.Down)
+	// an aggregate written before the buckets stays without them
+	if a.Count-a.Down > 1 && len(a.Buckets) == 0 {
+		return
+	}
+	// copied rather than modified, the aggregates returned share the buckets
+	buckets := make([]int64, len(LATENCY_BUCKETS)+1)
+	copy(buckets, a.Buckets)
+	buckets[sort.SearchFloat64s(LATENCY_BUCKETS, p)]++
+	a.Buckets = buckets
+}
+
+// Merge adds the statistics of the aggregate of the same Start, like of another location
+// the buckets are dropped unless both have them, or either has no ping result up
+func (a *Aggregate) Merge(b Aggregate) {
+	up, bup := a.Count-a.Down, b.Count-b.Down
+	switch {
+	case bup == 0:
+	case up == 0:
+		a.Min, a.Max, a.Buckets = b.Min, b.Max, b.Buckets
+	default:
+		a.Min, a.Max = math.Min(a.Min, b.Min), math.Max(a.Max, b.Max)
+		if len(a.Buckets) == 0 || len(a.Buckets) != len(b.Buckets) {
+			a.Buckets = nil
+			break
+		}
+		buckets := make([]int64, len(a.Buckets))
+		for i := range buckets {
+			buckets[i] = a.Buckets[i] + b.Buckets[i]
+		}
+		a.Buckets = buckets
+	}
+	if a.Pinged+b.Pinged > 0 {
+		a.Loss = (a.Loss*float64(a.Pinged) + b.Loss*float64(b.Pinged)) / float64(a.Pinged+b.Pinged)
+	}
+	a.Count, a.Down, a.Sum, a.Pinged = a.Count+b.Count, a.Down+b.Down, a.Sum+b.Sum, a.Pinged+b.Pinged
+	if a.Avg = 0; a.Count > a.Down {
+		a.Avg = a.Sum / float64(a.Count-a.Down)
+	}
+	if a.Uptime = 0; a.Count > 0 {
+		a.Uptime = float64(a.Count-a.Down) / float64(a.Count)
+	}
+}
+
+// GroupAggregates merges the aggregates of the locations of each group by Start, location -> group
+// like the locations of the probes of the same network, the locations of no group are left out
+func GroupAggregates(all map[string][]Aggregate, group func(location string) string) map[string][]Aggregate {
+	starts := make(map[string]map[string]*Aggregate)
+	for location, as := range all {
+		g := group(location)
+		if g == "" {
+			continue
+		}
+		if starts[g] == nil {
+			starts[g] = make(map[string]*Aggregate)
+		}
+		for _, a := range as {
+			if m, ok := starts[g][a.Start]; ok {
+				m.Merge(a)
+			} else {
+				m = &Aggregate{Start: a.Start}
+				m.Merge(a)
+				starts[g][a.Start] = m
+			}
+		}
+	}
+	ret := make(map[string][]Aggregate, len(starts))
+	for g, m := range starts {
+		as := make([]Aggregate, 0, len(m))
+		for _, a := range m {
+			as = append(as, *a)
+		}
+		sort.Slice(as, func(i, j int) bool { return as[i].Start < as[j].Start })
+		ret[g] = as
+	}
+	return ret
+}
+
+// server -> location -> resolution -> aggregates sorted by Start
+// the last aggregate is open, the others are closed and written to the engine
+type aggregates map[string]map[string]map[string][]Aggregate
+
+func (as aggregates) get(server, location, resolution string) []Aggregate {
+	return as[server][location][resolution]
+}
+
+func (as aggregates) set(server, location, resolution string, a []Aggregate) {
+	if _, ok := as[server]; !ok {
+		as[server] = make(map[string]map[string][]Aggregate)
+	}
+	if _, ok := as[server][location]; !ok {
+		as[server][location] = make(map[string][]Aggregate)
+	}
+	as[server][location][resolution] = a
+}
+
+// engines persisting the aggregates implement Aggregator, so that they outlive the ping results
+type Aggregator interface {
+	// WriteAggregates replaces the closed aggregates of the server at the location of the resolution
+	WriteAggregates(ctx context.Context, server, location, resolution string, as []Aggregate) error
+	// ReadAggregates returns all aggregates written
+	ReadAggregates() (aggregates, error)
+}
+
+// add the ping results to the aggregates, closed aggregates changed are written to the engine if persist
+// should be invoked with write lock held
+func (s *Store) aggregate(ctx context.Context, server, location string, persist bool, prs ...PingRet) {
+	for resolution, n := range resolutions {
+		as, changed := addToAggregates(s.aggregates.get(server, location, resolution), n, prs...)
+		s.aggregates.set(server, location, resolution, as)
+		if changed && persist {
+			s.writeAggregates(ctx, server, location, resolution, as[:len(as)-1])
+		}
+	}
+}
+
+// aggregate the rewritten ping results of the server at the location again, the whole series if the store is tiered
+// should be invoked with write lock held
+func (s *Store) rebuildAggregates(ctx context.Context, server, location string, persist bool, prs []PingRet) {
+	for resolution := range resolutions {
+		s.aggregates.set(server, location, resolution, nil)
+	}
+	s.aggregate(ctx, server, location, persist, prs...)
+}
+
+// aggregate the buckets of the ping results inserted again from the merged ping results, sorted by time, the others are kept
+// should be invoked with write lock held
+func (s *Store) reaggregate(ctx context.Context, server, location string, merged, inserted []PingRet) {
+	for resolution, n := range resolutions {
+		as := append([]Aggregate(nil), s.aggregates.get(server, location, resolution)...)
+		changed := false
+		for i, pr := range inserted {
+			if len(pr.Time) < n || (i > 0 && inserted[i-1].Time[:n] == pr.Time[:n]) {
+				continue
+			}
+			start := pr.Time[:n]
+			from := sort.Search(len(merged), func(i int) bool { return merged[i].Time >= start })
+			to := sort.Search(len(merged), func(i int) bool { return merged[i].Time[:min(n, len(merged[i].Time))] > start })
+			a := Aggregate{Start: start}
+			for _, m := range merged[from:to] {
+				a.add(m)
+			}
+			j := sort.Search(len(as), func(i int) bool { return as[i].Start >= start })
+			if j == len(as) || as[j].Start != start {
+				as = append(as, Aggregate{})
+				copy(as[j+1:], as[j:])
+			}
+			as[j] = a
+			changed = changed || j < len(as)-1
+		}
+		s.aggregates.set(server, location, resolution, as)
+		if changed {
+			s.writeAggregates(ctx, server, location, resolution, as[:len(as)-1])
+		}
+	}
+}
+
+// returns true if a closed aggregate is changed or a new one is opened
+func addToAggregates(as []Aggregate, n int, prs ...PingRet) ([]Aggregate, bool) {
+	changed := false
+	for _, pr := range prs {
+		if len(pr.Time) < n {
+			continue
+		}
+		start := pr.Time[:n]
+		i := sort.Search(len(as), func(i int) bool { return as[i].Start >= start })
+		if i == len(as) || as[i].Start != start {
+			as = append(as, Aggregate{})
+			copy(as[i+1:], as[i:])
+			as[i] = Aggregate{Start: start}
+			changed = changed || len(as) > 1
+		} else if i < len(as)-1 {
+			changed = true
+		}
+		as[i].add(pr)
+	}
+	return as, changed
+}
+
+func (s *Store) writeAggregates(ctx context.Context, server, location, resolution string, as []Aggregate) {
+	ag, ok := s.storeEngine.(Aggregator)
+	if !ok {
+		return
+	}
+	err := s.engineWrite(ctx, "StoreEngine.WriteAggregates", func(ctx context.Context) error {
+		return ag.WriteAggregates(ctx, server, location, resolution, as)
+	}, "server", server, "location", location, "resolution", resolution)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "can not write aggregates", "server", server, "location", location, "resolution", resolution, "error", err)
+	}
+}
+
+// the aggregates written to the engine, empty if the engine does not persist them
+// empty with the error if the aggregates can not be read, so that they are aggregated again
+func (s *Store) readAggregates() (aggregates, error) {
+	if ag, ok := s.storeEngine.(Aggregator); ok {
+		as, err := ag.ReadAggregates()
+		if err != nil {
+			return make(aggregates), err
+		}
+		return as, nil
+	}
+	return make(aggregates), nil
+}
+
+// add the ping results after the last aggregate of each series to the aggregates
+func aggregateServers(as aggregates, servers Servers) aggregates {
+	for server, locations := range servers {
+		for location, prs := range locations {
+			for resolution, n := range resolutions {
+				old := as.get(server, location, resolution)
+				var last string
+				if len(old) > 0 {
+					last = old[len(old)-1].Start
+				}
+				i := sort.Search(len(prs), func(i int) bool { return len(prs[i].Time) >= n && prs[i].Time[:n] > last })
+				a, _ := addToAggregates(old, n, prs[i:]...)
+				as.set(server, location, resolution, a)
+			}
+		}
+	}
+	return as
+}
+
+// getAggregates returns the aggregates of each location of the resolution between from and to
+// from and to are times like PingRet.Time, the aggregates containing them are included, empty is unbounded
+// the aggregates archived to the cold tier are included if the range starts before those in memory
+func (s *Store) getAggregates(username, server, resolution, from, to string) (ret map[string][]Aggregate, err error) {
+	n, ok := resolutions[resolution]
+	if !ok {
+		return nil, fmt.Errorf("unknown resolution %v", resolution)
+	}
+	if len(from) > n {
+		from = from[:n]
+	}
+	if len(to) > n {
+		to = to[:n]
+	}
+	all := make(map[string][]Aggregate)
+	cold := false
+	since := ""
+	s.withReadLock(func() {
+		if _, err = s.getMonitorResult(username, server); err != nil {
+			return
+		}
+		since = s.visibleSince(username, server)
+		for location, resolutions := range s.aggregates[server] {
+			as := resolutions[resolution]
+			all[location] = as
+			cold = cold || len(as) == 0 || from < as[0].Start
+		}
+		cold = cold && s.tiers.Cold != nil
+	})
+	if err != nil {
+		return
+	}
+	if cold {
+		var archived map[string][]Aggregate
+		if archived, err = s.coldAggregates(context.Background(), server, resolution); err != nil {
+			return nil, fmt.Errorf("can not read archived aggregates: %v", err)
+		}
+		for location, as := range archived {
+			all[location] = mergeAggregates(as, all[location])
+		}
+	}
+	ret = make(map[string][]Aggregate)
+	for location, merged := range all {
+		as := make([]Aggregate, 0)
+		for _, a := range merged {
+			if a.Start >= from && (to == "" || a.Start <= to) && (since == "" || startsSince(a.Start, since)) {
+				as = append(as, a)
+			}
+		}
+		ret[location] = as
+	}
+	return
+}
+
+// whether the aggregate starting at start covers no ping result before since, the aggregate containing since does unless it starts at it
+func startsSince(start, since string) bool {
+	n := len(start)
+	return start > since[:n] || start == since[:n] && strings.Trim(since[n:], " 0:") == ""
+}
+
+// getUptime returns the ratio of the ping results up of the server since from, formatted like PingRet.Time, of every location
+// by the daily aggregates, samples is 0 if there is no ping result since
+func (s *Store) getUptime(username, server, from string) (uptime float64, samples int64, err error) {
+	all, err := s.GetAggregates(username, server, RESOLUTION_DAY, from, "")
+	if err != nil {
+		return
+	}
+	var down int64
+	for _, as := range all {
+		for _, a := range as {
+			samples += a.Count
+			down += a.Down
+		}
+	}
+	if samples > 0 {
+		uptime = float64(samples-down) / float64(samples)
+	}
+	return
+}
+
+func (f *fileEngine) getAggregatesFilePath(server, location, resolution string) string {
+	return fmt.Sprintf("%v/%v/%v.%v", f.aggregatesDir, serverFileName(server), location, resolution)
+}
+
+func (f *fileEngine) WriteAggregates(ctx context.Context, server, location, resolution string, as []Aggregate) error {
+	if err := os.MkdirAll(filepath.Dir(f.getAggregatesFilePath(server, location, resolution)), os.ModePerm); err != nil {
+		return err
+	}
+	b, err := json.Marshal(as)
+	if err != nil {
+		return err
+	}
+	path := f.getAggregatesFilePath(server, location, resolution)
+	if err = ioutil.WriteFile(path+_TMP_SUFFIX, b, os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(path+_TMP_SUFFIX, path)
+}
+
+func (f *fileEngine) ReadAggregates() (aggregates, error) {
+	as := make(aggregates)
+	servers, err := ioutil.ReadDir(f.aggregatesDir)
+	if os.IsNotExist(err) {
+		return as, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, server := range servers {
+		files, err := ioutil.ReadDir(filepath.Join(f.aggregatesDir, server.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			i := strings.LastIndex(file.Name(), ".")
+			if i < 0 || strings.HasSuffix(file.Name(), _TMP_SUFFIX) {
+				continue
+			}
+			location, resolution := file.Name()[:i], file.Name()[i+1:]
+			b, err := ioutil.ReadFile(filepath.Join(f.aggregatesDir, server.Name(), file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			var a []Aggregate
+			if err = json.Unmarshal(b, &a); err != nil {
+				return nil, fmt.Errorf("can not read aggregates of %v: %v", file.Name(), err)
+			}
+			as.set(serverOfFileName(server.Name()), location, resolution, a)
+		}
+	}
+	return as, nil
+}
@@ -0,0 +1,226 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gogames/watchdog/main-server/alert"
+)
+
+// SetServerLabels replaces the labels of the server monitored by the user, alert templates select servers by labels
+// the checks of the check templates selecting the labels are added to the host of the server
+func (s *Store) SetServerLabels(ctx context.Context, username, server string, labels map[string]string) (err error) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			var added []string
+			err = s.updateUser(ctx, username, func(u *User) error {
+				if !u.MonitorServers[server] {
+					return fmt.Errorf("You are not monitoring %v", server)
+				}
+				if len(labels) == 0 {
+					delete(u.Labels, server)
+				} else {
+					u.Labels[server] = labels
+				}
+				if !IsVirtual(server) {
+					added = applyCheckTemplates(u, HostOf(server), labels)
+				}
+				return nil
+			})
+			if err == nil {
+				s.monitorAdded(added)
+			}
+		})
+	})
+	return
+}
+
+func (s *Store) GetServerLabels(username, server string) (labels map[string]string) {
+	s.withReadLock(func() {
+		if u, ok := s.users[username]; ok {
+			labels = make(map[string]string, len(u.Labels[server]))
+			for k, v := range u.Labels[server] {
+				labels[k] = v
+			}
+		}
+	})
+	return
+}
+
+// SetAlertTemplate adds the alert template of the user or replaces the one of the same name
+func (s *Store) SetAlertTemplate(ctx context.Context, username string, t alert.Template) (err error) {
+	if err = t.Validate(); err != nil {
+		return
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				templates := make([]alert.Template, 0, len(u.AlertTemplates)+1)
+				for _, old := range u.AlertTemplates {
+					if old.Name != t.Name {
+						templates = append(templates, old)
+					}
+				}
+				u.AlertTemplates = append(templates, t)
+				return nil
+			})
+		})
+	})
+	return
+}
+
+func (s *Store) DeleteAlertTemplate(ctx context.Context, username, name string) (err error) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				templates := make([]alert.Template, 0, len(u.AlertTemplates))
+				for _, t := range u.AlertTemplates {
+					if t.Name != name {
+						templates = append(templates, t)
+					}
+				}
+				if len(templates) == len(u.AlertTemplates) {
+					return fmt.Errorf("alert template %v not exist", name)
+				}
+				u.AlertTemplates = templates
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// SetServerDependency declares the server sits behind the parent, like a router, empty parent removes the dependency
+func (s *Store) SetServerDependency(ctx context.Context, username, server, parent string) (err error) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				for _, sv := range []string{server, parent} {
+					if sv != "" && !u.MonitorServers[sv] {
+						return fmt.Errorf("You are not monitoring %v", sv)
+					}
+				}
+				for p := parent; p != ""; p = u.Dependencies[p] {
+					if p == server {
+						return fmt.Errorf("%v can not depend on %v, which depends on it", server, parent)
+					}
+				}
+				if parent == "" {
+					delete(u.Dependencies, server)
+				} else {
+					u.Dependencies[server] = parent
+				}
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// SetNotificationChannel adds the notification channel of the user or replaces the one of the same name
+func (s *Store) SetNotificationChannel(ctx context.Context, username string, c alert.Channel) (err error) {
+	if err = c.Validate(); err != nil {
+		return
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				if c.Type == alert.CHANNEL_SMS {
+					if phone, _ := alert.NormalizePhone(c.Config["phone"]); !u.Phones[phone].IsVerified() {
+						return fmt.Errorf("phone %v should be verified before adding sms channels", c.Config["phone"])
+					}
+				}
+				channels := make([]alert.Channel, 0, len(u.Channels)+1)
+				for _, old := range u.Channels {
+					if old.Name != c.Name {
+						channels = append(channels, old)
+					}
+				}
+				u.Channels = append(channels, c)
+				return nil
+			})
+		})
+	})
+	return
+}
+
+func (s *Store) DeleteNotificationChannel(ctx context.Context, username, name string) (err error) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				channels := make([]alert.Channel, 0, len(u.Channels))
+				for _, c := range u.Channels {
+					if c.Name != name {
+						channels = append(channels, c)
+					}
+				}
+				if len(channels) == len(u.Channels) {
+					return fmt.Errorf("channel %v not exist", name)
+				}
+				u.Channels = channels
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// SetNotificationSchedule replaces the schedule by which the alerts of the user are dispatched
+func (s *Store) SetNotificationSchedule(ctx context.Context, username string, sched alert.Schedule) (err error) {
+	if err = sched.Validate(); err != nil {
+		return
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				u.Schedule = sched
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// SetAlertCorrelation replaces the correlation of the alerts of the user, nil stops correlating them
+func (s *Store) SetAlertCorrelation(ctx context.Context, username string, c *alert.Correlation) (err error) {
+	if c != nil {
+		if err = c.Validate(); err != nil {
+			return
+		}
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				u.Correlation = c
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// AlertSubjects returns the users monitoring the server with alert templates
+func (s *Store) AlertSubjects(server string) (subjects []alert.Subject) {
+	s.withReadLock(func() {
+		for username, u := range s.users {
+			if !u.MonitorServers[server] || len(u.AlertTemplates) == 0 {
+				continue
+			}
+			parents := make(map[string]string, len(u.Dependencies))
+			for child, parent := range u.Dependencies {
+				parents[child] = parent
+			}
+			subjects = append(subjects, alert.Subject{
+				Username:    username,
+				Labels:      u.Labels[server],
+				Templates:   u.AlertTemplates,
+				Channels:    u.Channels,
+				Schedule:    u.Schedule,
+				Parents:     parents,
+				Locale:      u.Settings.Locale,
+				Correlation: u.Correlation,
+			})
+		}
+	})
+	return
+}
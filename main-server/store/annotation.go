@@ -0,0 +1,145 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// the kinds of the annotations
+const (
+	ANNOTATION_DEPLOY = "deploy"
+	ANNOTATION_CONFIG = "config"
+	ANNOTATION_OUTAGE = "outage"
+	ANNOTATION_NOTE   = "note"
+)
+
+// the annotations kept of each server of a user, the earliest are dropped beyond it
+const _MAX_ANNOTATIONS = 1 << 9
+
+var annotationKinds = map[string]bool{ANNOTATION_DEPLOY: true, ANNOTATION_CONFIG: true, ANNOTATION_OUTAGE: true, ANNOTATION_NOTE: true}
+
+// Annotation marks an event on the timeline of a server, like a deploy, overlaid on the latency chart
+// Time and End are in the time layout of the ping results, End is empty unless the event spans a period, like a known outage
+type Annotation struct {
+	Id   string `json:"id"`
+	Kind string `json:"kind"`
+	Time string `json:"time"`
+	End  string `json:"end,omitempty"`
+	Text string `json:"text"`
+}
+
+func (a Annotation) validate() error {
+	if !annotationKinds[a.Kind] {
+		return fmt.Errorf("unknown annotation kind %v", a.Kind)
+	}
+	if _, err := time.Parse(_PING_TIME_LAYOUT, a.Time); err != nil {
+		return fmt.Errorf("annotation time %q is not formatted as %v", a.Time, _PING_TIME_LAYOUT)
+	}
+	if a.End != "" {
+		if _, err := time.Parse(_PING_TIME_LAYOUT, a.End); err != nil || a.End < a.Time {
+			return fmt.Errorf("annotation end %q should be formatted as %v and not before the time", a.End, _PING_TIME_LAYOUT)
+		}
+	}
+	if a.Text == "" {
+		return fmt.Errorf("annotation text should not be empty")
+	}
+	return nil
+}
+
+// returns true if the annotation overlaps the period from and to, both inclusive, to is open if empty
+func (a Annotation) overlaps(from, to string) bool {
+	end := a.End
+	if end == "" {
+		end = a.Time
+	}
+	return end >= from && (to == "" || a.Time <= to)
+}
+
+// AddAnnotation attaches the annotation to the timeline of the server monitored by the user, returns it with its id
+func (s *Store) AddAnnotation(ctx context.Context, username, server string, a Annotation) (ret Annotation, err error) {
+	if err = a.validate(); err != nil {
+		return
+	}
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	a.Id = hex.EncodeToString(b)
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				if !u.MonitorServers[server] {
+					return fmt.Errorf("You are not monitoring %v", server)
+				}
+				as := append(make([]Annotation, 0, len(u.Annotations[server])+1), u.Annotations[server]...)
+				i := sort.Search(len(as), func(i int) bool { return as[i].Time > a.Time })
+				as = append(as[:i], append([]Annotation{a}, as[i:]...)...)
+				if len(as) > _MAX_ANNOTATIONS {
+					as = as[len(as)-_MAX_ANNOTATIONS:]
+				}
+				if u.Annotations == nil {
+					u.Annotations = make(map[string][]Annotation)
+				}
+				u.Annotations[server] = as
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return
+	}
+	return a, nil
+}
+
+// DeleteAnnotation removes the annotation of the id from the timeline of the server
+func (s *Store) DeleteAnnotation(ctx context.Context, username, server, id string) (err error) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				as := make([]Annotation, 0, len(u.Annotations[server]))
+				for _, a := range u.Annotations[server] {
+					if a.Id != id {
+						as = append(as, a)
+					}
+				}
+				if len(as) == len(u.Annotations[server]) {
+					return fmt.Errorf("annotation %v not exist", id)
+				}
+				if len(as) == 0 {
+					delete(u.Annotations, server)
+				} else {
+					u.Annotations[server] = as
+				}
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// GetAnnotations returns the annotations of the server monitored by the user overlapping from and to, sorted by time
+// from and to are inclusive in the time layout of the ping results, to is open if empty
+func (s *Store) GetAnnotations(username, server, from, to string) (ret []Annotation, err error) {
+	s.withReadLock(func() {
+		if _, err = s.getMonitorResult(username, server); err != nil {
+			return
+		}
+		ret = s.annotations(username, server, from, to)
+	})
+	return
+}
+
+// should be invoked with read lock held
+func (s *Store) annotations(username, server, from, to string) []Annotation {
+	ret := make([]Annotation, 0)
+	for _, a := range s.users[username].Annotations[server] {
+		if a.overlaps(from, to) {
+			ret = append(ret, a)
+		}
+	}
+	return ret
+}
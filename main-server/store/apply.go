@@ -0,0 +1,117 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+const (
+	ACTION_ADD_USER        = "add user"
+	ACTION_UPDATE_PASSWORD = "update password"
+	ACTION_ADD_SERVER      = "add server"
+	ACTION_DELETE_SERVER   = "delete server"
+)
+
+// Spec declares the desired users and their monitored servers
+// users not in the spec are left untouched
+type Spec struct {
+	Users map[string]UserSpec `json:"users"`
+}
+
+// the password is left untouched if it is empty
+type UserSpec struct {
+	Password       string   `json:"password"`
+	MonitorServers []string `json:"monitor_servers"`
+}
+
+type Change struct {
+	Action   string `json:"action"`
+	Username string `json:"username"`
+	Server   string `json:"server,omitempty"`
+}
+
+// Apply reconciles the store to match the spec and returns the changes
+// nothing is changed if dryRun is true, nor if a server to add is rejected, see SetTargetValidator
+func (s *Store) Apply(ctx context.Context, spec Spec, dryRun bool) (changes []Change, err error) {
+	changes = s.diff(spec)
+	for _, c := range changes {
+		if c.Action != ACTION_ADD_SERVER {
+			continue
+		}
+		if err = s.checkTarget(c.Server); err != nil {
+			err = fmt.Errorf("can not add %v to %v: %v", c.Server, c.Username, err)
+			changes = nil
+			return
+		}
+	}
+	if dryRun {
+		return
+	}
+	for i, c := range changes {
+		switch c.Action {
+		case ACTION_ADD_USER:
+			err = s.AddUser(ctx, c.Username, spec.Users[c.Username].Password)
+		case ACTION_UPDATE_PASSWORD:
+			err = s.setPassword(ctx, c.Username, spec.Users[c.Username].Password)
+		case ACTION_ADD_SERVER:
+			err = s.AddMonitorServer(ctx, c.Username, c.Server)
+		case ACTION_DELETE_SERVER:
+			err = s.DeleteMonitorServer(ctx, c.Username, c.Server)
+		}
+		if err != nil {
+			// report the changes applied so far
+			changes = changes[:i]
+			return
+		}
+	}
+	return
+}
+
+func (s *Store) diff(spec Spec) (changes []Change) {
+	changes = make([]Change, 0)
+	usernames := make([]string, 0, len(spec.Users))
+	for username := range spec.Users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	s.withReadLock(func() {
+		for _, username := range usernames {
+			us := spec.Users[username]
+			want := make(map[string]bool)
+			for _, server := range us.MonitorServers {
+				want[server] = true
+			}
+			have := make(map[string]bool)
+			if u, ok := s.users[username]; !ok {
+				changes = append(changes, Change{Action: ACTION_ADD_USER, Username: username})
+			} else {
+				have = u.MonitorServers
+				if us.Password != "" && us.Password != u.Password {
+					changes = append(changes, Change{Action: ACTION_UPDATE_PASSWORD, Username: username})
+				}
+			}
+			for _, server := range sortedKeys(want) {
+				if !have[server] {
+					changes = append(changes, Change{Action: ACTION_ADD_SERVER, Username: username, Server: server})
+				}
+			}
+			for _, server := range sortedKeys(have) {
+				if !want[server] {
+					changes = append(changes, Change{Action: ACTION_DELETE_SERVER, Username: username, Server: server})
+				}
+			}
+		}
+	})
+	return
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
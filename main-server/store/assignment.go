@@ -0,0 +1,112 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// engines persisting the servers assigned to the ping loop implement AssignmentStore,
+// so that a restart sends AddServerChan and KickServerChan only the servers added or removed meanwhile rather than the whole fleet,
+// the consumers seed themselves by GetServers instead
+type AssignmentStore interface {
+	// ReadAssignments returns the servers written last, false if they were never written
+	ReadAssignments() (servers []string, ok bool, err error)
+	WriteAssignments(servers []string) error
+}
+
+// the servers added and removed since the assignments written last, all the servers are added if none were written
+// the assignments are written on startup, on resync and on close, the servers changed since are sent again after a crash
+func (s *Store) assignmentDelta() (added, removed []string) {
+	var (
+		prev  []string
+		found bool
+		err   error
+	)
+	if as, ok := s.storeEngine.(AssignmentStore); ok {
+		if prev, found, err = as.ReadAssignments(); err != nil {
+			s.logger.Warn("can not read the assignments, all servers are assigned again", "error", err)
+		}
+	}
+	if !found || err != nil {
+		for server := range s.allServers {
+			if !s.optedOut[server] {
+				added = append(added, server)
+			}
+		}
+		return
+	}
+	was := make(map[string]bool, len(prev))
+	for _, server := range prev {
+		was[server] = true
+	}
+	for server := range s.allServers {
+		if s.optedOut[server] {
+			continue
+		}
+		if !was[server] {
+			added = append(added, server)
+		}
+		delete(was, server)
+	}
+	for server := range was {
+		removed = append(removed, server)
+	}
+	return
+}
+
+func (s *Store) writeAssignments() error {
+	as, ok := s.storeEngine.(AssignmentStore)
+	if !ok {
+		return nil
+	}
+	servers := s.GetServers()
+	sort.Strings(servers)
+	return as.WriteAssignments(servers)
+}
+
+// ResyncAssignments sends every server but those opted out to AddServerChan again, for the consumers which lost track of them, returns the servers sent
+func (s *Store) ResyncAssignments() (n int, err error) {
+	s.do(func() {
+		s.withReadLock(func() {
+			for server := range s.allServers {
+				if !s.optedOut[server] {
+					s.addQueue.send(server)
+					n++
+				}
+			}
+		})
+		err = s.writeAssignments()
+	})
+	return
+}
+
+func (f *fileEngine) assignmentsFile() string { return filepath.Clean(f.serversDir) + ".assignments" }
+
+func (f *fileEngine) ReadAssignments() (servers []string, ok bool, err error) {
+	b, err := ioutil.ReadFile(f.assignmentsFile())
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	if err = json.Unmarshal(b, &servers); err != nil {
+		return nil, false, err
+	}
+	return servers, true, nil
+}
+
+// write and rename, so that the assignments are never partial
+func (f *fileEngine) WriteAssignments(servers []string) error {
+	b, err := json.Marshal(servers)
+	if err != nil {
+		return err
+	}
+	path := f.assignmentsFile()
+	if err = ioutil.WriteFile(path+_TMP_SUFFIX, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+_TMP_SUFFIX, path)
+}
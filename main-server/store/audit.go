@@ -0,0 +1,135 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// the actions audited
+const (
+	AUDIT_PURGE_SERVER = "purge_server"
+	AUDIT_PURGE_USER   = "purge_user"
+	// the data of the user viewed by support
+	AUDIT_IMPERSONATE = "impersonate"
+	// the operator registered or removed an opt-out
+	AUDIT_OPT_OUT         = "opt_out"
+	AUDIT_OPT_OUT_REMOVED = "opt_out_removed"
+)
+
+// the latest audit entries kept in memory, the engine keeps all
+const _AUDIT_SIZE = 1 << 12
+
+// AuditEntry records an operation on the data of the users, like a purge on a data deletion request
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// who requested it, like the admin token or the support engineer
+	Actor   string `json:"actor"`
+	Action  string `json:"action"`
+	Subject string `json:"subject"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// engines persisting the audit log implement Auditor, the entries are kept in memory only otherwise
+type Auditor interface {
+	// AppendAudit appends the entry, the audit log is never rewritten
+	AppendAudit(ctx context.Context, e AuditEntry) error
+	// ReadAudit returns the entries appended, the earliest first
+	ReadAudit() ([]AuditEntry, error)
+}
+
+// append the entry to the audit log before the audited operation, so that nothing audited goes unrecorded
+// should be invoked with write lock held
+func (s *Store) audit(ctx context.Context, e AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if a, ok := s.storeEngine.(Auditor); ok {
+		// never buffered, the entry is on disk before the operation
+		if err := s.engineWrite(unbuffered(ctx), "StoreEngine.AppendAudit", func(ctx context.Context) error {
+			return a.AppendAudit(ctx, e)
+		}, "action", e.Action, "subject", e.Subject); err != nil {
+			return fmt.Errorf("can not write audit entry: %v", err)
+		}
+	}
+	if s.auditLog = append(s.auditLog, e); len(s.auditLog) > _AUDIT_SIZE {
+		s.auditLog = append([]AuditEntry(nil), s.auditLog[len(s.auditLog)-_AUDIT_SIZE:]...)
+	}
+	s.logger.InfoContext(ctx, "audit", "actor", e.Actor, "action", e.Action, "subject", e.Subject, "detail", e.Detail)
+	return nil
+}
+
+// RecordAudit appends the entry of an operation done outside the store, like a view of the user by support
+func (s *Store) RecordAudit(ctx context.Context, e AuditEntry) (err error) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.audit(ctx, e)
+		})
+	})
+	return
+}
+
+// Audit returns the latest n entries of the audit log, the earliest first, all those in memory if n is not positive
+func (s *Store) Audit(n int) (ret []AuditEntry) {
+	s.withReadLock(func() {
+		es := s.auditLog
+		if n > 0 && len(es) > n {
+			es = es[len(es)-n:]
+		}
+		ret = append([]AuditEntry{}, es...)
+	})
+	return
+}
+
+// the audit log written to the engine, empty if the engine does not persist it
+func (s *Store) readAudit() ([]AuditEntry, error) {
+	a, ok := s.storeEngine.(Auditor)
+	if !ok {
+		return nil, nil
+	}
+	es, err := a.ReadAudit()
+	if err != nil {
+		return nil, err
+	}
+	if len(es) > _AUDIT_SIZE {
+		es = es[len(es)-_AUDIT_SIZE:]
+	}
+	return es, nil
+}
+
+// the audit log is a file of json lines
+func (f *fileEngine) AppendAudit(ctx context.Context, e AuditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return f.appendFile(f.auditFile, append(b, _NEW_LINE...), os.ModePerm)
+}
+
+func (f *fileEngine) ReadAudit() ([]AuditEntry, error) {
+	b, err := ioutil.ReadFile(f.auditFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var es []AuditEntry
+	for i, line := range bytes.Split(b, []byte(_NEW_LINE)) {
+		if len(line) == 0 {
+			continue
+		}
+		var e AuditEntry
+		if err = json.Unmarshal(line, &e); err != nil {
+			return es, fmt.Errorf("can not read line %v of %v: %v", i+1, f.auditFile, err)
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
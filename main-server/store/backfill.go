@@ -0,0 +1,175 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// engines able to rewrite a series implement SeriesWriter, required by BackfillPingRets
+type SeriesWriter interface {
+	// WritePingRets replaces the ping results of the server at the location
+	WritePingRets(ctx context.Context, server, location string, prs []PingRet) error
+}
+
+// BackfillPingRets inserts historical ping results of the server at the location, e.g. imported from another tool
+// the results are merged by time without padding, results of a time already stored are kept
+// returns the number of results inserted
+func (s *Store) BackfillPingRets(ctx context.Context, server, location string, prs []PingRet) (n int, err error) {
+	sw, ok := s.storeEngine.(SeriesWriter)
+	if !ok {
+		return 0, fmt.Errorf("store engine does not support backfill")
+	}
+	// imported from other tools, so nothing is stored unless all are well formed
+	for i, pr := range prs {
+		if err = pr.Validate(i); err != nil {
+			return
+		}
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			if s.allServers[server] <= 0 {
+				err = fmt.Errorf("server %v is not exist", server)
+				return
+			}
+			// the aggregates of the expired ones are archived already
+			now := time.Now()
+			for _, pr := range prs {
+				if s.expired(pr.Time, now) {
+					err = fmt.Errorf("ping result of %v is older than the warm tier", pr.Time)
+					return
+				}
+			}
+			var old, merged []PingRet
+			if old, err = s.series(ctx, server, location); err != nil {
+				return
+			}
+			if merged, n = mergePingRets(old, prs); n == 0 {
+				return
+			}
+			if err = s.engineWrite(ctx, "StoreEngine.WritePingRets", func(ctx context.Context) error {
+				return sw.WritePingRets(ctx, server, location, merged)
+			}, "server", server, "location", location, "count", len(merged)); err != nil {
+				n = 0
+				return
+			}
+			if _, ok := s.servers[server]; !ok {
+				s.servers[server] = make(map[string]Series)
+			}
+			hot := s.hotSeries(merged)
+			s.servers[server][location] = seriesOf(hot)
+			s.feed.record(FeedEvent{Server: server, Location: location, PingRets: hot, Replace: true})
+			s.rebuildAggregates(ctx, server, location, true, merged)
+			s.updateStatus(server)
+		})
+	})
+	return
+}
+
+// merge the results sorted by time, the time layout sorts as strings
+// returns the merged results and the number of new results
+func mergePingRets(old, prs []PingRet) ([]PingRet, int) {
+	times := make(map[string]bool, len(old))
+	for _, pr := range old {
+		times[pr.Time] = true
+	}
+	merged := make([]PingRet, len(old), len(old)+len(prs))
+	copy(merged, old)
+	for _, pr := range prs {
+		if !times[pr.Time] {
+			times[pr.Time] = true
+			merged = append(merged, pr)
+		}
+	}
+	n := len(merged) - len(old)
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Time < merged[j].Time })
+	return merged, n
+}
+
+func (f *fileEngine) WritePingRets(ctx context.Context, server, location string, prs []PingRet) error {
+	if err := f.notExistThenMkdir(f.getServerDir(server)); err != nil {
+		return err
+	}
+	path := f.getServerFilePath(server, location)
+	tmp := path + _TMP_SUFFIX
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := f.BatchWritePingRets(ctx, server, location+_TMP_SUFFIX, prs); err != nil {
+		return err
+	}
+	// the series is kept as it was if aborted
+	if err := ctx.Err(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// insert the ping results, sorted by time, before the latest one, replacing the padding of their time
+// the series is rewritten once for all of them, and only the aggregates of their hours and days are aggregated again
+// should be invoked with write lock held
+func (s *Store) insertLatePingRets(ctx context.Context, server, location string, late []PingRet) error {
+	sw, ok := s.storeEngine.(SeriesWriter)
+	if !ok {
+		return fmt.Errorf("store engine can not insert late ping result of %v", late[0].Time)
+	}
+	now := time.Now()
+	for _, pr := range late {
+		if s.expired(pr.Time, now) {
+			return fmt.Errorf("late ping result of %v is older than the warm tier", pr.Time)
+		}
+	}
+	prs, err := s.series(ctx, server, location)
+	if err != nil {
+		return err
+	}
+	merged := make([]PingRet, 0, len(prs)+len(late))
+	inserted := make([]PingRet, 0, len(late))
+	i := 0
+	for j, pr := range late {
+		for i < len(prs) && prs[i].Time < pr.Time {
+			merged = append(merged, prs[i])
+			i++
+		}
+		switch {
+		case j > 0 && late[j-1].Time == pr.Time:
+			atomic.AddInt64(&s.counters.pingRetsDuplicated, 1)
+			continue
+		case i < len(prs) && prs[i].Time == pr.Time:
+			if prs[i].Ping != _DEFAULT_PING {
+				atomic.AddInt64(&s.counters.pingRetsDuplicated, 1)
+				continue
+			}
+			// the padding of its time
+			i++
+		}
+		merged = append(merged, pr)
+		inserted = append(inserted, pr)
+	}
+	if len(inserted) == 0 {
+		return nil
+	}
+	merged = append(merged, prs[i:]...)
+	err = s.engineWrite(ctx, "StoreEngine.WritePingRets", func(ctx context.Context) error {
+		return sw.WritePingRets(ctx, server, location, merged)
+	}, "server", server, "location", location, "count", len(merged))
+	if err == ErrorReadOnly {
+		return err
+	}
+	if err != nil {
+		s.logger.ErrorContext(ctx, "can not write late ping results", "server", server, "location", location, "from", inserted[0].Time, "count", len(inserted), "error", err)
+		return err
+	}
+	hot := s.hotSeries(merged)
+	s.servers[server][location] = seriesOf(hot)
+	s.feed.record(FeedEvent{Server: server, Location: location, PingRets: hot, Replace: true})
+	s.reaggregate(ctx, server, location, merged, inserted)
+	s.updateStatus(server)
+	atomic.AddInt64(&s.counters.pingRetsAppended, int64(len(inserted)))
+	atomic.AddInt64(&s.counters.pingRetsLate, int64(len(inserted)))
+	return nil
+}
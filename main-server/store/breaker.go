@@ -0,0 +1,243 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BREAKER_CLOSED    = "closed"
+	BREAKER_OPEN      = "open"
+	BREAKER_HALF_OPEN = "half-open"
+
+	// the buffered writes drained between taking the breaker again
+	_DRAIN_BATCH = 64
+)
+
+// Retry retries a failed engine write up to Attempts in total
+// the wait is Base doubled every attempt up to Max, half of it is jittered
+type Retry struct {
+	Attempts  int
+	Base, Max time.Duration
+}
+
+func (r Retry) wait(attempt int) time.Duration {
+	d := r.Base << uint(attempt)
+	if r.Max > 0 && (d > r.Max || d <= 0) {
+		d = r.Max
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// BreakerConfig opens the breaker after Threshold consecutive failed writes, 0 disables it
+// writes are buffered up to Buffer while the breaker is open, the engine is tried again after Cooldown
+type BreakerConfig struct {
+	Threshold int
+	Cooldown  time.Duration
+	Buffer    int
+}
+
+type BreakerStatus struct {
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	Opened    time.Time `json:"opened"`
+	Opens     int64     `json:"opens"`
+	Buffered  int       `json:"buffered"`
+	Dropped   int64     `json:"dropped"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type unbufferedKey struct{}
+
+// the engine writes of the operation fail rather than being buffered while the breaker is open,
+// like those of the purges and the audit log, which are irreversible or should never go unrecorded
+func unbuffered(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unbufferedKey{}, true)
+}
+
+type bufferedWrite struct {
+	op    string
+	f     func(ctx context.Context) error
+	attrs []interface{}
+}
+
+// the breaker serializes the engine writes, so that the buffered ones are written in order
+type breaker struct {
+	mu       sync.Mutex
+	conf     BreakerConfig
+	state    string
+	failures int
+	opened   time.Time
+	opens    int64
+	dropped  int64
+	buffer   []bufferedWrite
+	// the buffer is written by drain, the writes meanwhile are buffered behind it
+	draining bool
+	lastErr  error
+}
+
+func (s *Store) SetRetry(r Retry) *Store {
+	s.retry = r
+	return s
+}
+
+func (s *Store) SetBreaker(c BreakerConfig) *Store {
+	s.breaker.mu.Lock()
+	defer s.breaker.mu.Unlock()
+	s.breaker.conf = c
+	return s
+}
+
+func (s *Store) BreakerStatus() BreakerStatus {
+	b := &s.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BreakerStatus{State: b.state, Failures: b.failures, Opened: b.opened, Opens: b.opens, Buffered: len(b.buffer), Dropped: b.dropped}
+	if st.State == "" {
+		st.State = BREAKER_CLOSED
+	}
+	if b.lastErr != nil {
+		st.LastError = b.lastErr.Error()
+	}
+	return st
+}
+
+// write to the engine with retries, the write is aborted once ctx is done or the write timeout elapses,
+// so that it never holds the lock for long
+// the writes are buffered rather than hammering the engine while the breaker is open, but those of the unbuffered operations
+func (s *Store) engineWrite(ctx context.Context, op string, f func(ctx context.Context) error, attrs ...interface{}) error {
+	buffer := ctx.Value(unbufferedKey{}) == nil
+	// the memory is only changed once written, so rejecting the write rejects the operation
+	if s.isReadOnly() {
+		return ErrorReadOnly
+	}
+	b := &s.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conf.Threshold <= 0 {
+		return s.writeWithRetry(ctx, op, f, attrs...)
+	}
+	if b.state == BREAKER_OPEN {
+		if time.Since(b.opened) < b.conf.Cooldown {
+			if !buffer {
+				return b.unavailable()
+			}
+			return b.enqueue(op, f, attrs)
+		}
+		b.state = BREAKER_HALF_OPEN
+	}
+	// written in order after the buffered writes
+	if len(b.buffer) > 0 {
+		if !b.draining {
+			go s.drain()
+		}
+		if !buffer {
+			return b.unavailable()
+		}
+		return b.enqueue(op, f, attrs)
+	}
+	err := s.writeWithRetry(ctx, op, f, attrs...)
+	switch {
+	case err == nil:
+		b.state, b.failures = BREAKER_CLOSED, 0
+	case ctx.Err() != nil:
+		// aborted by the caller, rather than failed by the engine
+	default:
+		if b.failures++; b.failures >= b.conf.Threshold || b.state == BREAKER_HALF_OPEN {
+			s.trip(err)
+		}
+		b.lastErr = err
+	}
+	return err
+}
+
+// drain writes the buffered writes in order once the cooldown elapsed, _DRAIN_BATCH at a time,
+// holding neither the lock of the store nor the breaker while writing, so that a backlog never stalls the store
+func (s *Store) drain() {
+	b := &s.breaker
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.draining || len(b.buffer) == 0 || b.state == BREAKER_OPEN && time.Since(b.opened) < b.conf.Cooldown {
+		return
+	}
+	b.state, b.draining = BREAKER_HALF_OPEN, true
+	for len(b.buffer) > 0 {
+		batch := append([]bufferedWrite(nil), b.buffer[:min(len(b.buffer), _DRAIN_BATCH)]...)
+		b.mu.Unlock()
+		written := 0
+		var err error
+		for _, w := range batch {
+			// the operations of the buffered writes are gone, they are bounded by the write timeout only
+			if err = s.writeWithRetry(context.Background(), w.op, w.f, w.attrs...); err != nil {
+				break
+			}
+			written++
+		}
+		b.mu.Lock()
+		// only appended to meanwhile
+		clear(b.buffer[:written])
+		b.buffer = b.buffer[written:]
+		if err != nil {
+			b.draining = false
+			s.trip(err)
+			return
+		}
+	}
+	b.state, b.failures, b.draining = BREAKER_CLOSED, 0, false
+}
+
+// open the breaker, the buffer is drained once the cooldown elapses
+// should be invoked with b.mu held
+func (s *Store) trip(err error) {
+	s.breaker.trip(err)
+	time.AfterFunc(s.breaker.conf.Cooldown, s.drain)
+}
+
+// should be invoked with b.mu held
+func (b *breaker) trip(err error) {
+	if b.state != BREAKER_OPEN {
+		b.opens++
+	}
+	b.state, b.opened, b.lastErr = BREAKER_OPEN, time.Now(), err
+}
+
+// should be invoked with b.mu held
+func (b *breaker) unavailable() error {
+	return fmt.Errorf("engine breaker is %v since %v, %v writes are buffered, the write can not be buffered: %v", b.state, b.opened.Format(time.RFC3339), len(b.buffer), b.lastErr)
+}
+
+// should be invoked with b.mu held
+func (b *breaker) enqueue(op string, f func(ctx context.Context) error, attrs []interface{}) error {
+	if len(b.buffer) >= b.conf.Buffer {
+		b.dropped++
+		return fmt.Errorf("engine breaker is open since %v, %v writes are buffered: %v", b.opened.Format(time.RFC3339), len(b.buffer), b.lastErr)
+	}
+	b.buffer = append(b.buffer, bufferedWrite{op: op, f: f, attrs: attrs})
+	return nil
+}
+
+func (s *Store) writeWithRetry(ctx context.Context, op string, f func(ctx context.Context) error, attrs ...interface{}) (err error) {
+	if s.writeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.writeTimeout)
+		defer cancel()
+	}
+	for attempt := 0; ; attempt++ {
+		if err = s.writeOnce(ctx, op, f, attrs...); err == nil || ctx.Err() != nil || attempt+1 >= s.retry.Attempts {
+			return
+		}
+		atomic.AddInt64(&s.counters.engineWriteRetries, 1)
+		select {
+		case <-time.After(s.retry.wait(attempt)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"strconv"
+	"sync"
+)
+
+// the responses cached at most, an arbitrary one is dropped beyond
+const _CACHE_SIZE = 4096
+
+// the responses of the expensive reads, the overviews, the aggregates and the uptimes, cached until the change feed invalidates them,
+// so that the dashboards of many viewers polling the same server compute them once between the ping results
+// a response depends on the user of its key and the servers it covers, every event of the feed of either drops it
+// the responses are shared by the callers, which should not modify them
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+	// dependency -> the keys depending on it
+	index map[string]map[cacheKey]bool
+	// incremented by every invalidation, a response computed across an invalidation of its dependencies is not cached
+	seq uint64
+	// dependency -> seq of its latest invalidation, and seq of the latest reset
+	invalidated map[string]uint64
+	reset       uint64
+	hits        int64
+	misses      int64
+}
+
+type cacheKey struct {
+	endpoint, username, server, args string
+}
+
+type cacheEntry struct {
+	value interface{}
+	deps  []string
+}
+
+// CacheStats is the hits and misses of the responses cached since the start and the number cached
+type CacheStats struct {
+	Hits    int64
+	Misses  int64
+	Entries int
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: make(map[cacheKey]cacheEntry), index: make(map[string]map[cacheKey]bool), invalidated: make(map[string]uint64)}
+}
+
+func userDep(username string) string { return "user " + username }
+
+func serverDep(server string) string { return "server " + server }
+
+// the response of the key, or the seq to put the response computed
+func (c *responseCache) get(k cacheKey) (value interface{}, seq uint64, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[k]; ok {
+		c.hits++
+		return e.value, 0, true
+	}
+	c.misses++
+	return nil, c.seq, false
+}
+
+// cache the response computed since seq unless a dependency is invalidated meanwhile
+func (c *responseCache) put(k cacheKey, value interface{}, seq uint64, deps []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.reset > seq {
+		return
+	}
+	for _, d := range deps {
+		if c.invalidated[d] > seq {
+			return
+		}
+	}
+	if _, ok := c.entries[k]; !ok && len(c.entries) >= _CACHE_SIZE {
+		for old := range c.entries {
+			c.remove(old)
+			break
+		}
+	}
+	c.entries[k] = cacheEntry{value: value, deps: deps}
+	for _, d := range deps {
+		if c.index[d] == nil {
+			c.index[d] = make(map[cacheKey]bool)
+		}
+		c.index[d][k] = true
+	}
+}
+
+// should be invoked with c.mu held
+func (c *responseCache) remove(k cacheKey) {
+	for _, d := range c.entries[k].deps {
+		if delete(c.index[d], k); len(c.index[d]) == 0 {
+			delete(c.index, d)
+		}
+	}
+	delete(c.entries, k)
+}
+
+// drop the responses depending on the dependencies
+func (c *responseCache) invalidate(deps ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	for _, d := range deps {
+		c.invalidated[d] = c.seq
+		for k := range c.index[d] {
+			c.remove(k)
+		}
+	}
+}
+
+// drop the responses the event may change
+func (c *responseCache) invalidateEvent(e FeedEvent) {
+	switch {
+	case e.Server != "":
+		c.invalidate(serverDep(e.Server))
+	case e.Username != "":
+		c.invalidate(userDep(e.Username))
+	}
+}
+
+// drop all, when the store is replaced
+func (c *responseCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	c.reset = c.seq
+	c.entries, c.index = make(map[cacheKey]cacheEntry), make(map[string]map[cacheKey]bool)
+}
+
+func (c *responseCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Entries: len(c.entries)}
+}
+
+// cached returns the response of the key, computed by f and cached unless it fails
+// f returns the servers the response covers besides the server of the key
+func (s *Store) cached(k cacheKey, f func() (interface{}, []string, error)) (interface{}, error) {
+	v, seq, ok := s.cache.get(k)
+	if ok {
+		return v, nil
+	}
+	v, servers, err := f()
+	if err != nil {
+		return nil, err
+	}
+	deps := append(make([]string, 0, len(servers)+2), userDep(k.username))
+	if k.server != "" {
+		deps = append(deps, serverDep(k.server))
+	}
+	for _, server := range servers {
+		deps = append(deps, serverDep(server))
+	}
+	s.cache.put(k, v, seq, deps)
+	return v, nil
+}
+
+// GetOverview is the overview of the servers of the user cached, see getOverview
+func (s *Store) GetOverview(username string, points int) (map[string]Overview, error) {
+	v, err := s.cached(cacheKey{endpoint: "overview", username: username, args: strconv.Itoa(points)}, func() (interface{}, []string, error) {
+		ret, err := s.getOverview(username, points)
+		servers := make([]string, 0, len(ret))
+		for server := range ret {
+			servers = append(servers, server)
+		}
+		return ret, servers, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]Overview), nil
+}
+
+// GetAggregates is the aggregates of the server cached, see getAggregates
+func (s *Store) GetAggregates(username, server, resolution, from, to string) (map[string][]Aggregate, error) {
+	v, err := s.cached(cacheKey{endpoint: "aggregates", username: username, server: server, args: resolution + " " + from + " " + to}, func() (interface{}, []string, error) {
+		ret, err := s.getAggregates(username, server, resolution, from, to)
+		return ret, nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string][]Aggregate), nil
+}
+
+type uptimeResponse struct {
+	uptime  float64
+	samples int64
+}
+
+// GetUptime is the uptime of the server cached, see getUptime
+func (s *Store) GetUptime(username, server, from string) (float64, int64, error) {
+	v, err := s.cached(cacheKey{endpoint: "uptime", username: username, server: server, args: from}, func() (interface{}, []string, error) {
+		u, samples, err := s.getUptime(username, server, from)
+		return uptimeResponse{u, samples}, nil, err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	u := v.(uptimeResponse)
+	return u.uptime, u.samples, nil
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/gogames/watchdog/main-server/target"
+	"github.com/gogames/watchdog/probe"
+)
+
+// the kind of the checks of virtual servers, pushed rather than checked by the probes
+const KIND_VIRTUAL = "virtual"
+
+// Check is one of the checks of a host, like its icmp, https and tls checks
+// each check is a server of its own, with its series, labels and alert rules
+type Check struct {
+	Server  string               `json:"server"`
+	Kind    string               `json:"kind"`
+	Status  string               `json:"status"`
+	Results map[string][]PingRet `json:"results"`
+}
+
+// HostOf returns the host checked by the server, e.g. google.com of "google.com", "https://google.com/healthz" and "tls://google.com"
+func HostOf(server string) string {
+	if IsVirtual(server) || IsTransaction(server) {
+		return server
+	}
+	if host, err := target.Host(server); err == nil {
+		return host
+	}
+	return server
+}
+
+func kindOf(server string) string {
+	if IsVirtual(server) {
+		return KIND_VIRTUAL
+	}
+	return probe.TargetOf(server).Kind
+}
+
+// GetHosts returns the hosts of the servers monitored by the user and their servers, one per check, sorted
+func (s *Store) GetHosts(username string) (ret map[string][]string, err error) {
+	s.withReadLock(func() {
+		u, ok := s.users[username]
+		if !ok {
+			err = fmt.Errorf("User %v not exist", username)
+			return
+		}
+		ret = make(map[string][]string)
+		for server := range u.MonitorServers {
+			host := HostOf(server)
+			ret[host] = append(ret[host], server)
+		}
+		for _, servers := range ret {
+			sort.Strings(servers)
+		}
+	})
+	return
+}
+
+// GetChecks returns the monitor results of the host grouped by check, sorted by kind and server
+func (s *Store) GetChecks(username, host string) (ret []Check, err error) {
+	s.withReadLock(func() {
+		u, ok := s.users[username]
+		if !ok {
+			err = fmt.Errorf("User %v not exist", username)
+			return
+		}
+		ret = make([]Check, 0)
+		for server := range u.MonitorServers {
+			if HostOf(server) != host {
+				continue
+			}
+			locations := s.visible(username, server)
+			c := Check{Server: server, Kind: kindOf(server), Status: s.serverStatus(server).Status, Results: make(map[string][]PingRet, len(locations))}
+			for location, series := range locations {
+				c.Results[location] = series.All()
+			}
+			ret = append(ret, c)
+		}
+		if len(ret) == 0 {
+			err = fmt.Errorf("You are not monitoring %v", host)
+			return
+		}
+		sort.Slice(ret, func(i, j int) bool {
+			if ret[i].Kind != ret[j].Kind {
+				return ret[i].Kind < ret[j].Kind
+			}
+			return ret[i].Server < ret[j].Server
+		})
+	})
+	return
+}
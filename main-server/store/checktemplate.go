@@ -0,0 +1,245 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gogames/watchdog/probe"
+)
+
+// CheckTemplate is the checks added to the hosts of the servers whose labels are selected, like "standard-web"
+type CheckTemplate struct {
+	Name     string            `json:"name"`
+	Selector map[string]string `json:"selector,omitempty"`
+	Checks   []CheckSpec       `json:"checks"`
+}
+
+// CheckSpec is a check of a host, Port is of the tcp and tls checks
+// Interval is rounded up to the ping frequence, every ping frequence if zero
+type CheckSpec struct {
+	Kind     string        `json:"kind"`
+	Port     int           `json:"port,omitempty"`
+	Interval time.Duration `json:"interval,omitempty"`
+}
+
+func (t CheckTemplate) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("template name can not be empty")
+	}
+	if len(t.Checks) == 0 {
+		return fmt.Errorf("check template %v has no check", t.Name)
+	}
+	servers := make(map[string]bool, len(t.Checks))
+	for _, c := range t.Checks {
+		if c.Interval < 0 || c.Port < 0 || c.Port > 65535 {
+			return fmt.Errorf("interval and port of %v check should not be negative, port should be at most 65535", c.Kind)
+		}
+		server, err := c.server("example.com")
+		if err != nil {
+			return err
+		}
+		if servers[server] {
+			return fmt.Errorf("%v check is duplicated in template %v", c.Kind, t.Name)
+		}
+		servers[server] = true
+	}
+	return nil
+}
+
+func (t CheckTemplate) Selects(labels map[string]string) bool {
+	for k, v := range t.Selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// the server of the check of the host
+func (c CheckSpec) server(host string) (string, error) {
+	if c.Port > 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(c.Port))
+	}
+	return probe.CheckServer(host, c.Kind)
+}
+
+// SetCheckTemplate adds the check template of the user or replaces the one of the same name
+// the checks are added to the hosts of the servers of the user selected by it, returns the servers added
+// checks added before are kept when the template changes
+func (s *Store) SetCheckTemplate(ctx context.Context, username string, t CheckTemplate) (added []string, err error) {
+	if err = t.Validate(); err != nil {
+		return
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				templates := make([]CheckTemplate, 0, len(u.CheckTemplates)+1)
+				for _, old := range u.CheckTemplates {
+					if old.Name != t.Name {
+						templates = append(templates, old)
+					}
+				}
+				u.CheckTemplates = append(templates, t)
+				servers := make([]string, 0, len(u.MonitorServers))
+				for server := range u.MonitorServers {
+					servers = append(servers, server)
+				}
+				sort.Strings(servers)
+				for _, server := range servers {
+					if !IsVirtual(server) {
+						added = append(added, applyCheckTemplates(u, HostOf(server), u.Labels[server])...)
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				added = nil
+				return
+			}
+			s.monitorAdded(added)
+		})
+	})
+	return
+}
+
+// DeleteCheckTemplate removes the check template, the checks it added are kept
+func (s *Store) DeleteCheckTemplate(ctx context.Context, username, name string) (err error) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				templates := make([]CheckTemplate, 0, len(u.CheckTemplates))
+				for _, t := range u.CheckTemplates {
+					if t.Name != name {
+						templates = append(templates, t)
+					}
+				}
+				if len(templates) == len(u.CheckTemplates) {
+					return fmt.Errorf("check template %v not exist", name)
+				}
+				u.CheckTemplates = templates
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// AddHost onboards the host with the labels, by the checks of the templates selecting the labels, or by icmp if none does
+// returns the servers of the checks added
+func (s *Store) AddHost(ctx context.Context, username, host string, labels map[string]string) (added []string, err error) {
+	if _, err = probe.CheckServer(host, probe.KIND_ICMP); err != nil {
+		return
+	}
+	if err = s.checkTarget(host); err != nil {
+		return
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				for server := range u.MonitorServers {
+					if HostOf(server) == host {
+						return fmt.Errorf("%v is already in monitoring list", host)
+					}
+				}
+				added = addHost(u, host, labels)
+				return nil
+			})
+			if err != nil {
+				added = nil
+				return
+			}
+			s.monitorAdded(added)
+		})
+	})
+	return
+}
+
+// add the checks of the templates selecting the labels to the host, or its icmp check if none does, returns the servers added
+func addHost(u *User, host string, labels map[string]string) []string {
+	if added := applyCheckTemplates(u, host, labels); len(added) > 0 {
+		return added
+	}
+	u.MonitorServers[host] = true
+	if len(labels) > 0 {
+		u.Labels[host] = labels
+	}
+	return []string{host}
+}
+
+// add the checks of the templates selecting the labels to the host, labeled by them, returns the servers added
+func applyCheckTemplates(u *User, host string, labels map[string]string) (added []string) {
+	for _, t := range u.CheckTemplates {
+		if !t.Selects(labels) {
+			continue
+		}
+		for _, c := range t.Checks {
+			server, err := c.server(host)
+			if err != nil || u.MonitorServers[server] {
+				continue
+			}
+			u.MonitorServers[server] = true
+			if len(labels) > 0 {
+				u.Labels[server] = labels
+			}
+			if c.Interval > 0 {
+				if u.Intervals == nil {
+					u.Intervals = make(map[string]time.Duration)
+				}
+				u.Intervals[server] = c.Interval
+			}
+			added = append(added, server)
+		}
+	}
+	return
+}
+
+// count the servers added to the monitoring list of a user, the servers nobody monitored are sent to AddServerChan
+// should be invoked with write lock held
+func (s *Store) monitorAdded(servers []string) {
+	for _, server := range servers {
+		if _, ok := s.allServers[server]; !ok {
+			s.assign(server)
+		}
+		s.allServers[server]++
+	}
+}
+
+// count the servers deleted from the monitoring list of a user, the servers nobody monitors are sent to KickServerChan
+// should be invoked with write lock held
+func (s *Store) monitorDeleted(servers []string) {
+	for _, server := range servers {
+		if s.allServers[server]--; s.allServers[server] <= 0 {
+			delete(s.allServers, server)
+			delete(s.dns, server)
+			s.kickQueue.send(server)
+		}
+	}
+}
+
+// CheckIntervals returns server -> interval of the checks not checked every ping frequence
+// the shortest interval wins if the users monitoring the server differ
+func (s *Store) CheckIntervals() (ret map[string]time.Duration) {
+	ret = make(map[string]time.Duration)
+	s.withReadLock(func() {
+		for _, u := range s.users {
+			for server, interval := range u.Intervals {
+				if old, ok := ret[server]; !ok || interval < old {
+					ret[server] = interval
+				}
+			}
+		}
+		// monitored by others every ping frequence
+		for _, u := range s.users {
+			for server := range u.MonitorServers {
+				if _, ok := u.Intervals[server]; !ok {
+					delete(ret, server)
+				}
+			}
+		}
+	})
+	return
+}
@@ -0,0 +1,43 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// EngineConfig is the config of a store engine, the engineconfig object of the main config file
+// engines decode it into their typed config
+type EngineConfig map[string]interface{}
+
+// ParseEngineConfig parses the json object of the config, empty is an empty config
+func ParseEngineConfig(s string) (EngineConfig, error) {
+	c := make(EngineConfig)
+	if s == "" {
+		return c, nil
+	}
+	if err := json.Unmarshal([]byte(s), &c); err != nil {
+		return nil, fmt.Errorf("engine config should be a json object: %v", err)
+	}
+	return c, nil
+}
+
+// Decode decodes the config into v, a pointer to the typed config of the engine, unknown keys are rejected
+func (c EngineConfig) Decode(v interface{}) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+// ValidateEngineConfig returns the error of the engine loading the config, without initializing it
+func ValidateEngineConfig(engineName string, c EngineConfig) error {
+	e, err := newEngine(engineName)
+	if err != nil {
+		return err
+	}
+	return e.LoadConfig(c)
+}
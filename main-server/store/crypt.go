@@ -0,0 +1,288 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// the prefix of an encrypted record, followed by the key id and the base64 of the nonce and the sealed record
+// records without it are plaintext, written before encryption was enabled
+const _ENCRYPTED_PREFIX = "enc:"
+
+// ErrorNoKey is the error of an encrypted record whose key is not configured
+var ErrorNoKey = errors.New("encryption key of the record is not configured")
+
+// EncryptionConfig is the "encryption" of the config of the file and the memory engines
+// the records are encrypted by AES-GCM with the current key, the others decrypt the records not rotated yet
+type EncryptionConfig struct {
+	// id of the key encrypting the new records
+	Current string `json:"current"`
+	// id -> base64 of a 16, 24 or 32 bytes key, or "env:NAME" of the environment variable holding the base64
+	Keys map[string]string `json:"keys"`
+	// name of the KeyProvider registered by RegisterKeyProvider, like a KMS client, rather than the keys
+	Provider string `json:"provider"`
+}
+
+// KeyProvider supplies the encryption keys, e.g. fetched from a KMS
+// it is asked again by RotateKeys, so that a new current key is used without restart
+type KeyProvider interface {
+	// Keys returns the id of the current key and the keys by id
+	Keys(ctx context.Context) (current string, keys map[string][]byte, err error)
+}
+
+var (
+	keyProviders    = make(map[string]KeyProvider)
+	keyProvidersRwl sync.RWMutex
+)
+
+// RegisterKeyProvider makes the provider available to the "provider" of the EncryptionConfig, it should be invoked in init
+func RegisterKeyProvider(name string, p KeyProvider) {
+	keyProvidersRwl.Lock()
+	defer keyProvidersRwl.Unlock()
+	keyProviders[name] = p
+}
+
+// the keys of the config, the environment variables are read again on every load
+type configKeys struct{ conf EncryptionConfig }
+
+func (c configKeys) Keys(ctx context.Context) (string, map[string][]byte, error) {
+	keys := make(map[string][]byte, len(c.conf.Keys))
+	for id, v := range c.conf.Keys {
+		if strings.HasPrefix(v, "env:") {
+			name := strings.TrimPrefix(v, "env:")
+			if v = os.Getenv(name); v == "" {
+				return "", nil, fmt.Errorf("environment variable %v of key %v is empty", name, id)
+			}
+		}
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return "", nil, fmt.Errorf("key %v is not base64: %v", id, err)
+		}
+		keys[id] = b
+	}
+	return c.conf.Current, keys, nil
+}
+
+// crypter seals and opens the records, a nil crypter writes plaintext
+type crypter struct {
+	provider KeyProvider
+
+	mu      sync.RWMutex
+	current string
+	aeads   map[string]cipher.AEAD
+}
+
+// returns nil if conf is nil, the keys are loaded
+func newCrypter(conf *EncryptionConfig) (*crypter, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	var p KeyProvider = configKeys{*conf}
+	if conf.Provider != "" {
+		if len(conf.Keys) > 0 {
+			return nil, fmt.Errorf("encryption should config either keys or provider")
+		}
+		keyProvidersRwl.RLock()
+		var ok bool
+		p, ok = keyProviders[conf.Provider]
+		keyProvidersRwl.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown key provider %v", conf.Provider)
+		}
+	}
+	c := &crypter{provider: p}
+	return c, c.load(context.Background())
+}
+
+// load the keys from the provider again
+func (c *crypter) load(ctx context.Context) error {
+	current, keys, err := c.provider.Keys(ctx)
+	if err != nil {
+		return fmt.Errorf("can not load encryption keys: %v", err)
+	}
+	if _, ok := keys[current]; !ok {
+		return fmt.Errorf("current encryption key %q is not configured", current)
+	}
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for id, key := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return fmt.Errorf("encryption key id %q should not be empty nor contain colon", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("encryption key %v: %v", id, err)
+		}
+		if aeads[id], err = cipher.NewGCM(block); err != nil {
+			return fmt.Errorf("encryption key %v: %v", id, err)
+		}
+	}
+	c.mu.Lock()
+	c.current, c.aeads = current, aeads
+	c.mu.Unlock()
+	return nil
+}
+
+// seal the record with the current key, the record should not contain a new line
+func (c *crypter) seal(b []byte) []byte {
+	if c == nil {
+		return b
+	}
+	c.mu.RLock()
+	id, aead := c.current, c.aeads[c.current]
+	c.mu.RUnlock()
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(b)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Errorf("can not read random nonce: %v", err))
+	}
+	// the key id is authenticated, so that a record can not be passed off as of another key
+	sealed := aead.Seal(nonce, nonce, b, []byte(id))
+	return []byte(_ENCRYPTED_PREFIX + id + ":" + base64.StdEncoding.EncodeToString(sealed))
+}
+
+// seal the line written with the new line
+func (c *crypter) sealLine(b []byte) []byte {
+	if c == nil {
+		return b
+	}
+	return append(c.seal(bytes.TrimSuffix(b, []byte(_NEW_LINE))), _NEW_LINE...)
+}
+
+// open the sealed record, a plaintext record is returned as it is
+func (c *crypter) open(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte(_ENCRYPTED_PREFIX)) {
+		return b, nil
+	}
+	rest := bytes.TrimPrefix(b, []byte(_ENCRYPTED_PREFIX))
+	i := bytes.IndexByte(rest, ':')
+	if i < 0 {
+		return nil, fmt.Errorf("encrypted record without key id")
+	}
+	id := string(rest[:i])
+	if c == nil {
+		return nil, ErrorNoKey
+	}
+	c.mu.RLock()
+	aead, ok := c.aeads[id]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrorNoKey, id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(rest[i+1:])))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted record is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+}
+
+// engines encrypting their records implement KeyRotator
+type KeyRotator interface {
+	// RotateKeys loads the keys again and encrypts all the records by the current key, returns the files rewritten
+	// the records of the old keys are readable meanwhile, the old keys can be removed once it returns
+	RotateKeys(ctx context.Context) (int, error)
+}
+
+// RotateKeys loads the keys of the engine again and encrypts all its records by the current key
+// the store is locked meanwhile, so that no record is appended by the old key
+func (s *Store) RotateKeys(ctx context.Context) (n int, err error) {
+	kr, ok := s.storeEngine.(KeyRotator)
+	if !ok {
+		return 0, fmt.Errorf("store engine does not encrypt its records")
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.engineWrite(ctx, "StoreEngine.RotateKeys", func(ctx context.Context) (err error) {
+				n, err = kr.RotateKeys(ctx)
+				return
+			})
+		})
+	})
+	if err == nil {
+		s.logger.Info("encryption keys rotated", "files", n)
+	}
+	return
+}
+
+// the line of the ping result, sealed if encrypted
+func (f *fileEngine) marshalPingRet(pr PingRet) []byte { return f.crypt.sealLine(pr.marshal()) }
+
+func (f *fileEngine) unmarshalPingRet(b []byte) (PingRet, error) {
+	b, err := f.crypt.open(b)
+	if err != nil {
+		return PingRet{}, err
+	}
+	return unmarshalPingRet(b)
+}
+
+// the ping results and the users are rewritten one by one by write and rename
+func (f *fileEngine) RotateKeys(ctx context.Context) (n int, err error) {
+	if f.crypt == nil {
+		return 0, fmt.Errorf("encryption is not configured")
+	}
+	if err = f.crypt.load(ctx); err != nil {
+		return
+	}
+	reseal := func(path string, lines bool) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		records := [][]byte{b}
+		if lines {
+			records = bytes.Split(b, []byte(_NEW_LINE))
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, len(b)))
+		for _, r := range records {
+			if len(r) == 0 {
+				continue
+			}
+			// corrupt records are left as they are, for Init to report
+			if p, err := f.crypt.open(r); err == nil {
+				r = f.crypt.seal(p)
+			}
+			buf.Write(r)
+			if lines {
+				buf.WriteString(_NEW_LINE)
+			}
+		}
+		if err = ioutil.WriteFile(path+_TMP_SUFFIX, buf.Bytes(), os.ModePerm); err != nil {
+			return err
+		}
+		n++
+		return os.Rename(path+_TMP_SUFFIX, path)
+	}
+	for dir, lines := range map[string]bool{f.serversDir: true, f.usersDir: false, f.inboxDir: false} {
+		if err = filepath.Walk(dir, func(path string, file os.FileInfo, err error) error {
+			// no message was posted yet
+			if path == f.inboxDir && os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if file.IsDir() || strings.HasSuffix(path, _TMP_SUFFIX) || strings.HasSuffix(path, _CORRUPT_SUFFIX) {
+				return nil
+			}
+			return reseal(path, lines)
+		}); err != nil {
+			return
+		}
+	}
+	return
+}
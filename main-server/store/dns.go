@@ -0,0 +1,120 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const _DNS_HISTORY_SIZE = 64
+
+// Resolution is the addresses the hostname of the server resolved to since Time, RFC3339
+type Resolution struct {
+	Time string   `json:"time"`
+	IPs  []string `json:"ips"`
+}
+
+// DNSHistorian is implemented by the engines persisting the dns history of the servers
+type DNSHistorian interface {
+	WriteDNSHistory(ctx context.Context, server string, h []Resolution) error
+	ReadDNSHistory() (map[string][]Resolution, error)
+}
+
+// RecordResolution appends the addresses of the server to its history if they changed
+// latency shifts often coincide with the server moving to another provider
+func (s *Store) RecordResolution(ctx context.Context, server string, ips []string, t time.Time) (changed bool, err error) {
+	ips = append([]string(nil), ips...)
+	sort.Strings(ips)
+	s.do(func() {
+		s.withWriteLock(func() {
+			h := s.dns[server]
+			if len(h) > 0 && strings.Join(h[len(h)-1].IPs, ",") == strings.Join(ips, ",") {
+				return
+			}
+			if h = append(h, Resolution{Time: t.Format(time.RFC3339), IPs: ips}); len(h) > _DNS_HISTORY_SIZE {
+				h = h[len(h)-_DNS_HISTORY_SIZE:]
+			}
+			if d, ok := s.storeEngine.(DNSHistorian); ok {
+				if err = s.engineWrite(ctx, "StoreEngine.WriteDNSHistory", func(ctx context.Context) error {
+					return d.WriteDNSHistory(ctx, server, h)
+				}, "server", server); err != nil {
+					return
+				}
+			}
+			s.dns[server], changed = h, true
+		})
+	})
+	return
+}
+
+// GetDNSHistory returns the addresses the server resolved to, the earliest first
+func (s *Store) GetDNSHistory(username, server string) (h []Resolution, err error) {
+	s.withReadLock(func() {
+		if _, err = s.getMonitorResult(username, server); err == nil {
+			h = append([]Resolution(nil), s.dns[server]...)
+		}
+	})
+	return
+}
+
+// empty with the error if the history can not be read
+func (s *Store) readDNSHistory() (map[string][]Resolution, error) {
+	if d, ok := s.storeEngine.(DNSHistorian); ok {
+		h, err := d.ReadDNSHistory()
+		if err != nil {
+			return make(map[string][]Resolution), err
+		}
+		return h, nil
+	}
+	return make(map[string][]Resolution), nil
+}
+
+func (f *fileEngine) getDNSFilePath(server string) string {
+	return fmt.Sprintf("%v/%v", f.dnsDir, serverFileName(server))
+}
+
+func (f *fileEngine) WriteDNSHistory(ctx context.Context, server string, h []Resolution) error {
+	if err := f.notExistThenMkdir(f.dnsDir); err != nil {
+		return err
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	path := f.getDNSFilePath(server)
+	if err = ioutil.WriteFile(path+_TMP_SUFFIX, b, os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(path+_TMP_SUFFIX, path)
+}
+
+func (f *fileEngine) ReadDNSHistory() (map[string][]Resolution, error) {
+	ret := make(map[string][]Resolution)
+	files, err := ioutil.ReadDir(f.dnsDir)
+	if os.IsNotExist(err) {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), _TMP_SUFFIX) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(f.dnsDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var h []Resolution
+		if err = json.Unmarshal(b, &h); err != nil {
+			return nil, fmt.Errorf("can not read dns history of %v: %v", file.Name(), err)
+		}
+		ret[serverOfFileName(file.Name())] = h
+	}
+	return ret, nil
+}
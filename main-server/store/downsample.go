@@ -0,0 +1,73 @@
+package store
+
+import (
+	"math"
+	"strconv"
+)
+
+// at least the first, the last and one between
+const _MIN_DOWNSAMPLE_POINTS = 3
+
+// Downsample selects at most maxPoints ping results by largest triangle three buckets,
+// which keeps the spikes a chart should show, unlike averaging
+// the ping results are returned as they are if there are no more than maxPoints
+func Downsample(prs []PingRet, maxPoints int) []PingRet {
+	if maxPoints < _MIN_DOWNSAMPLE_POINTS {
+		maxPoints = _MIN_DOWNSAMPLE_POINTS
+	}
+	if len(prs) <= maxPoints {
+		return prs
+	}
+	// the ping results are aligned to the ping frequence, the index stands for the time
+	ys := make([]float64, len(prs))
+	for i, pr := range prs {
+		ys[i], _ = strconv.ParseFloat(pr.Ping, 64)
+	}
+	sampled := make([]PingRet, 0, maxPoints)
+	sampled = append(sampled, prs[0])
+	every := float64(len(prs)-2) / float64(maxPoints-2)
+	a := 0
+	for i := 0; i < maxPoints-2; i++ {
+		// average point of the next bucket
+		avgStart, avgEnd := int(float64(i+1)*every)+1, int(float64(i+2)*every)+1
+		if avgEnd > len(prs) {
+			avgEnd = len(prs)
+		}
+		var avgX, avgY float64
+		for j := avgStart; j < avgEnd; j++ {
+			avgX += float64(j)
+			avgY += ys[j]
+		}
+		n := float64(avgEnd - avgStart)
+		avgX, avgY = avgX/n, avgY/n
+
+		// the point of this bucket forming the largest triangle with the last selected and the average
+		maxArea, next := -1.0, 0
+		for j := int(float64(i)*every) + 1; j < int(float64(i+1)*every)+1; j++ {
+			area := math.Abs((float64(a)-avgX)*(ys[j]-ys[a]) - (float64(a)-float64(j))*(avgY-ys[a]))
+			if area > maxArea {
+				maxArea, next = area, j
+			}
+		}
+		sampled = append(sampled, prs[next])
+		a = next
+	}
+	return append(sampled, prs[len(prs)-1])
+}
+
+// GetMonitorResultDownsampled is GetMonitorResult with at most maxPoints ping results of each location
+func (s *Store) GetMonitorResultDownsampled(username, server string, maxPoints int) (ret map[string][]PingRet, err error) {
+	sp := s.tracer.Start("Store.GetMonitorResultDownsampled", "username", username, "server", server, "max_points", maxPoints)
+	defer func() { sp.End(err) }()
+	s.withReadLock(func() {
+		var locations map[string]Series
+		if locations, err = s.getMonitorResult(username, server); err != nil {
+			return
+		}
+		ret = make(map[string][]PingRet, len(locations))
+		for location, series := range locations {
+			ret[location] = Downsample(series.All(), maxPoints)
+		}
+	})
+	return
+}
@@ -0,0 +1,48 @@
+package store
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// etag of the monitor result, changes whenever a ping result is appended to any location
+// should be invoked with read lock held
+func resultETag(ret map[string]Series) string {
+	locations := make([]string, 0, len(ret))
+	for location := range ret {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	h := sha1.New()
+	for _, location := range locations {
+		series := ret[location]
+		var last string
+		if series.Len() > 0 {
+			last = series.TimeAt(series.Len() - 1)
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00%s\x00", location, series.Len(), last)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// GetMonitorResultIfNoneMatch returns the monitor result with its etag
+// the result is omitted and notModified is true if the etag still matches
+func (s *Store) GetMonitorResultIfNoneMatch(username, server, etag string) (ret map[string][]PingRet, newETag string, notModified bool, err error) {
+	s.withReadLock(func() {
+		var locations map[string]Series
+		if locations, err = s.getMonitorResult(username, server); err != nil {
+			return
+		}
+		if newETag = resultETag(locations); newETag == etag {
+			notModified = true
+			return
+		}
+		ret = make(map[string][]PingRet, len(locations))
+		for location, series := range locations {
+			ret[location] = series.All()
+		}
+	})
+	return
+}
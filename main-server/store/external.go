@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"fmt"
+)
+
+func externalIdKey(provider, subject string) string { return provider + " " + subject }
+
+// should be invoked with write lock held or before the store is used
+func (s *Store) indexExternalIds() {
+	s.externalIds = make(map[string]string)
+	for username, u := range s.users {
+		for provider, subject := range u.ExternalIds {
+			s.externalIds[externalIdKey(provider, subject)] = username
+		}
+	}
+}
+
+// GetExternalUser returns the username linked to the subject of the identity provider
+// it returns empty string if no user is linked
+func (s *Store) GetExternalUser(provider, subject string) (username string) {
+	s.withReadLock(func() { username = s.externalIds[externalIdKey(provider, subject)] })
+	return
+}
+
+// LinkExternalUser links the subject of the identity provider to the user
+// the user is created without password if it does not exist
+func (s *Store) LinkExternalUser(ctx context.Context, username, provider, subject string) error {
+	return s.linkExternalUser(ctx, username, provider, subject, false)
+}
+
+// ProvisionExternalUser creates the user without password linked to the subject of the identity provider
+// it fails if the user exists, so that the identity never signs in as a user registered before it
+func (s *Store) ProvisionExternalUser(ctx context.Context, username, provider, subject string) error {
+	return s.linkExternalUser(ctx, username, provider, subject, true)
+}
+
+func (s *Store) linkExternalUser(ctx context.Context, username, provider, subject string, create bool) (err error) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			key := externalIdKey(provider, subject)
+			if un, ok := s.externalIds[key]; ok {
+				err = fmt.Errorf("%v of %v is already linked to user %v", subject, provider, un)
+				return
+			}
+			c := newUser()
+			if u, ok := s.users[username]; ok {
+				if create {
+					err = fmt.Errorf("User %v already exist", username)
+					return
+				}
+				c = u.copy()
+			}
+			if err = s.commitUser(ctx, username, c, func(u *User) error {
+				u.ExternalIds[provider] = subject
+				return nil
+			}); err == nil {
+				s.externalIds[key] = username
+			}
+		})
+	})
+	return
+}
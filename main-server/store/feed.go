@@ -0,0 +1,282 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gogames/watchdog/probe"
+)
+
+const _FEED_SIZE = 1 << 14
+
+// the replica should resync from a snapshot
+var ErrorFeedTruncated = errors.New("change feed is truncated, resync from a snapshot")
+
+// FeedEvent is a change of the store, either a user written or ping results appended
+type FeedEvent struct {
+	Seq      uint64    `json:"seq"`
+	Username string    `json:"username,omitempty"`
+	User     *User     `json:"user,omitempty"`
+	Server   string    `json:"server,omitempty"`
+	Location string    `json:"location,omitempty"`
+	PingRets []PingRet `json:"ping_rets,omitempty"`
+	// the ping results replace the series rather than being appended, see BackfillPingRets
+	Replace bool `json:"replace,omitempty"`
+	// the user or the server is removed with its data, see PurgeServerData and PurgeUserData
+	Purged bool `json:"purged,omitempty"`
+	// the status of the server changed, the replica classifies the ping results itself
+	Status *ServerStatus `json:"status,omitempty"`
+	// the inbox of the user replaced, without the user, empty if emptied
+	Inbox []Message `json:"inbox,omitempty"`
+}
+
+// Snapshot is the state of the store at Seq of the feed
+// Epoch changes when the store restarts, the seq of different epochs are not comparable
+type Snapshot struct {
+	Epoch   int64                `json:"epoch"`
+	Seq     uint64               `json:"seq"`
+	Servers Servers              `json:"servers"`
+	Users   Users                `json:"users"`
+	Inboxes map[string][]Message `json:"inboxes,omitempty"`
+}
+
+// the recent events in a ring buffer
+type feed struct {
+	epoch  int64
+	seq    uint64
+	events []FeedEvent
+	// closed and replaced when an event is recorded, to wake up the waiting readers
+	notify chan struct{}
+	// the responses the events invalidate
+	cache *responseCache
+	mu    sync.Mutex
+}
+
+func newFeed(cache *responseCache) *feed {
+	return &feed{epoch: time.Now().UnixNano(), events: make([]FeedEvent, _FEED_SIZE), notify: make(chan struct{}), cache: cache}
+}
+
+// should be invoked with the store lock held, so that the order of events is the order of changes
+func (f *feed) record(e FeedEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	e.Seq = f.seq
+	f.events[f.seq%_FEED_SIZE] = e
+	f.cache.invalidateEvent(e)
+	close(f.notify)
+	f.notify = make(chan struct{})
+}
+
+func (f *feed) since(epoch int64, seq uint64) ([]FeedEvent, <-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if epoch != f.epoch || seq > f.seq || f.seq-seq >= _FEED_SIZE {
+		return nil, nil, ErrorFeedTruncated
+	}
+	events := make([]FeedEvent, 0, f.seq-seq)
+	for i := seq + 1; i <= f.seq; i++ {
+		events = append(events, f.events[i%_FEED_SIZE])
+	}
+	return events, f.notify, nil
+}
+
+func (u *User) copy() *User {
+	c := newUser()
+	c.Password = u.Password
+	for server, ok := range u.MonitorServers {
+		c.MonitorServers[server] = ok
+	}
+	for provider, subject := range u.ExternalIds {
+		c.ExternalIds[provider] = subject
+	}
+	for server, labels := range u.Labels {
+		c.Labels[server] = make(map[string]string, len(labels))
+		for k, v := range labels {
+			c.Labels[server][k] = v
+		}
+	}
+	for server, parent := range u.Dependencies {
+		c.Dependencies[server] = parent
+	}
+	for server, token := range u.IngestTokens {
+		c.IngestTokens[server] = token
+	}
+	for server, hb := range u.Heartbeats {
+		c.Heartbeats[server] = hb
+	}
+	if u.Intervals != nil {
+		c.Intervals = make(map[string]time.Duration, len(u.Intervals))
+		for server, interval := range u.Intervals {
+			c.Intervals[server] = interval
+		}
+	}
+	if u.Transactions != nil {
+		// the steps of a transaction are replaced rather than modified
+		c.Transactions = make(map[string][]probe.Step, len(u.Transactions))
+		for server, steps := range u.Transactions {
+			c.Transactions[server] = steps
+		}
+	}
+	if u.Annotations != nil {
+		// the annotations of a server are replaced rather than modified
+		c.Annotations = make(map[string][]Annotation, len(u.Annotations))
+		for server, as := range u.Annotations {
+			c.Annotations[server] = as
+		}
+	}
+	// templates, slos, channels, schedule, correlation, phones and the codes sent are replaced rather than modified
+	c.AlertTemplates = u.AlertTemplates
+	c.CheckTemplates = u.CheckTemplates
+	c.SLOs = u.SLOs
+	c.Channels = u.Channels
+	c.Schedule = u.Schedule
+	c.Correlation = u.Correlation
+	c.Phones = u.Phones
+	c.PhoneCodes = u.PhoneCodes
+	c.Settings = u.Settings
+	c.Organization = u.Organization
+	if u.Claims != nil {
+		c.Claims = make(map[string]Claim, len(u.Claims))
+		for host, claim := range u.Claims {
+			c.Claims[host] = claim
+		}
+	}
+	if u.MonitorSince != nil {
+		c.MonitorSince = make(map[string]string, len(u.MonitorSince))
+		for server, since := range u.MonitorSince {
+			c.MonitorSince[server] = since
+		}
+	}
+	return c
+}
+
+// Snapshot returns the state of the store, the replica follows the feed since the snapshot
+// the events are fed under the write lock, so the view is consistent with the sequence
+func (s *Store) Snapshot() Snapshot {
+	v := s.View()
+	inboxes := make(map[string][]Message)
+	s.withReadLock(func() {
+		// replaced rather than modified, the events since the view replace them again
+		for username, ms := range s.inboxes {
+			inboxes[username] = ms
+		}
+	})
+	return Snapshot{Epoch: v.epoch, Seq: v.seq, Users: v.users, Servers: v.servers.servers(), Inboxes: inboxes}
+}
+
+// Changes returns the events after seq of the epoch, waiting at most wait for one if there is none
+func (s *Store) Changes(epoch int64, seq uint64, wait time.Duration) ([]FeedEvent, error) {
+	events, notify, err := s.feed.since(epoch, seq)
+	if err != nil || len(events) > 0 || wait <= 0 {
+		return events, err
+	}
+	select {
+	case <-notify:
+	case <-time.After(wait):
+	}
+	events, _, err = s.feed.since(epoch, seq)
+	return events, err
+}
+
+// ApplySnapshot replaces the state of the replica, the engine is not written
+func (s *Store) ApplySnapshot(snap Snapshot) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			s.replace(columnarOf(snap.Servers), snap.Users, countServers(snap.Users))
+			// the replica aggregates the ping results without its engine
+			s.aggregates = aggregateServers(make(aggregates), snap.Servers)
+			s.status = s.classifyServers(s.servers, time.Now())
+			if s.inboxes = snap.Inboxes; s.inboxes == nil {
+				s.inboxes = make(map[string][]Message)
+			}
+		})
+	})
+}
+
+// ApplyChanges applies the events of the feed to the replica, the engine is not written
+func (s *Store) ApplyChanges(events []FeedEvent) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			users := s.users
+			for _, e := range events {
+				s.cache.invalidateEvent(e)
+				if e.Purged {
+					if e.Server != "" {
+						delete(s.servers, e.Server)
+						delete(s.aggregates, e.Server)
+						delete(s.status, e.Server)
+					} else {
+						delete(users, e.Username)
+						delete(s.inboxes, e.Username)
+					}
+					continue
+				}
+				if e.User != nil {
+					users[e.Username] = e.User
+					for provider, subject := range e.User.ExternalIds {
+						s.externalIds[externalIdKey(provider, subject)] = e.Username
+					}
+					continue
+				}
+				if e.Status != nil {
+					continue
+				}
+				if e.Server == "" {
+					if len(e.Inbox) == 0 {
+						delete(s.inboxes, e.Username)
+					} else {
+						s.inboxes[e.Username] = e.Inbox
+					}
+					continue
+				}
+				if _, ok := s.servers[e.Server]; !ok {
+					s.servers[e.Server] = make(map[string]Series)
+				}
+				if e.Replace {
+					s.servers[e.Server][e.Location] = seriesOf(e.PingRets)
+					s.rebuildAggregates(context.Background(), e.Server, e.Location, false, e.PingRets)
+				} else {
+					s.servers[e.Server][e.Location] = s.servers[e.Server][e.Location].Append(e.PingRets...)
+					s.aggregate(context.Background(), e.Server, e.Location, false, e.PingRets...)
+				}
+				s.updateStatus(e.Server)
+			}
+			s.replace(s.servers, users, countServers(users))
+		})
+	})
+}
+
+// the number of users monitoring every server
+func countServers(users Users) map[string]int64 {
+	allServers := make(map[string]int64)
+	for _, u := range users {
+		for server, ok := range u.MonitorServers {
+			if ok {
+				allServers[server]++
+			}
+		}
+	}
+	return allServers
+}
+
+// replace the state, servers added or removed are sent to AddServerChan or KickServerChan
+// should be invoked with write lock held
+func (s *Store) replace(servers columnar, users Users, allServers map[string]int64) {
+	for server := range allServers {
+		if _, ok := s.allServers[server]; !ok {
+			s.assign(server)
+		}
+	}
+	for server := range s.allServers {
+		if _, ok := allServers[server]; !ok {
+			s.kickQueue.send(server)
+		}
+	}
+	s.servers, s.users, s.allServers = servers, users, allServers
+	s.indexExternalIds()
+	s.indexOrganizations()
+	s.cache.clear()
+}
@@ -2,22 +2,44 @@ package store
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 const (
 	_NEW_LINE   = "\n"
+	_TMP_SUFFIX = ".tmp"
 	ENGINE_FILE = "file"
 )
 
 type fileEngine struct {
 	serversDir, usersDir string
-	cursor               string
+	leaseFile            string
+	auditFile            string
+	schemaFile           string
+	aggregatesDir        string
+	dnsDir               string
+	inboxDir             string
+	corruptMode          string
+	// the files read at once by Init, GOMAXPROCS if 0
+	initConcurrency int
+	// nil if the records are written in plaintext
+	crypt *crypter
+	// found by last Init, by the files read at once
+	mu          sync.Mutex
+	corruptions []Corruption
+	warnings    []string
+	progress    func(done, total int)
 
 	servers    Servers
 	users      Users
@@ -25,7 +47,7 @@ type fileEngine struct {
 }
 
 func init() {
-	Register(ENGINE_FILE, newFileEngine)
+	MustRegister(ENGINE_FILE, newFileEngine)
 }
 
 func newFileEngine() StoreEngine {
@@ -36,24 +58,69 @@ func newFileEngine() StoreEngine {
 	}
 }
 
-func (f *fileEngine) LoadConfig(s string) {
-	m := make(map[string]string)
-	if err := json.Unmarshal([]byte(s), &m); err != nil {
-		panic(err)
+// the config of the file engine, the other files default to the siblings of serversDir
+type fileConfig struct {
+	ServersDir string `json:"serversDir"`
+	UsersDir   string `json:"usersDir"`
+	// the lease is shared by the main servers sharing the directories
+	LeaseFile     string `json:"leaseFile"`
+	AggregatesDir string `json:"aggregatesDir"`
+	DNSDir        string `json:"dnsDir"`
+	InboxDir      string `json:"inboxDir"`
+	AuditFile     string `json:"auditFile"`
+	// skip, repair or fail on corrupt records, skip by default
+	Corrupt string `json:"corrupt"`
+	// the ping results and the users are encrypted if set
+	Encryption *EncryptionConfig `json:"encryption"`
+	// the files read at once on startup, GOMAXPROCS by default
+	InitConcurrency int `json:"initConcurrency"`
+}
+
+func (f *fileEngine) LoadConfig(config EngineConfig) error {
+	var c fileConfig
+	if err := config.Decode(&c); err != nil {
+		return err
 	}
-	var ok bool
-	f.serversDir, ok = m["serversDir"]
-	if !ok {
-		panic("should config serversDir")
+	if c.ServersDir == "" {
+		return fmt.Errorf("should config serversDir")
 	}
-	f.usersDir, ok = m["usersDir"]
-	if !ok {
-		panic("should config usersDir")
+	if c.UsersDir == "" {
+		return fmt.Errorf("should config usersDir")
 	}
+	f.serversDir, f.usersDir = c.ServersDir, c.UsersDir
+	f.leaseFile = orDefault(c.LeaseFile, filepath.Clean(f.serversDir)+".lease")
+	f.schemaFile = filepath.Clean(f.serversDir) + ".schema"
+	f.aggregatesDir = orDefault(c.AggregatesDir, filepath.Clean(f.serversDir)+".aggregates")
+	f.dnsDir = orDefault(c.DNSDir, filepath.Clean(f.serversDir)+".dns")
+	f.inboxDir = orDefault(c.InboxDir, filepath.Clean(f.usersDir)+".inbox")
+	f.auditFile = orDefault(c.AuditFile, filepath.Clean(f.serversDir)+".audit")
+	f.corruptMode = orDefault(c.Corrupt, CORRUPT_SKIP)
+	if err := validCorruptMode(f.corruptMode); err != nil {
+		return err
+	}
+	if c.InitConcurrency < 0 {
+		return fmt.Errorf("initConcurrency should not be negative")
+	}
+	f.initConcurrency = c.InitConcurrency
+	var err error
+	f.crypt, err = newCrypter(c.Encryption)
+	return err
 }
 
-func (f *fileEngine) WriteUser(username string, u *User) error {
-	return ioutil.WriteFile(f.getUserFilePath(username), u.marshal(), os.ModePerm)
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// write and rename, so that the user is never partial
+func (f *fileEngine) WriteUser(ctx context.Context, username string, u *User) error {
+	path := f.getUserFilePath(username)
+	if err := ioutil.WriteFile(path+_TMP_SUFFIX, f.crypt.seal(u.marshal()), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(path+_TMP_SUFFIX, path)
 }
 
 // func (f *fileEngine) AppendPingRet(server string, location string, pr PingRet) (err error) {
@@ -66,24 +133,48 @@ func (f *fileEngine) WriteUser(username string, u *User) error {
 // 	return f.appendFile(f.getServerFilePath(server, location), pr.marshal(), os.ModePerm)
 // }
 
-func (f *fileEngine) BatchWritePingRets(server string, location string, prs []PingRet) (err error) {
+func (f *fileEngine) BatchWritePingRets(ctx context.Context, server string, location string, prs []PingRet) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
 			err = fmt.Errorf("%v", e)
 		}
 	}()
 	f.notExistThenMkdir(f.getServerDir(server))
-	bs := bytes.NewBuffer(make([]byte, 0))
+	buf := recordBuffers.Get().(*[]byte)
+	defer putRecordBuffer(buf)
+	b := (*buf)[:0]
 	for _, pr := range prs {
-		_, err = bs.Write(pr.marshal())
-		if err != nil {
-			return
+		if f.crypt == nil {
+			b = pr.appendRecord(b)
+		} else {
+			b = append(b, f.marshalPingRet(pr)...)
 		}
 	}
-	return f.appendFile(f.getServerFilePath(server, location), bs.Bytes(), os.ModePerm)
+	*buf = b
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	return f.appendFile(f.getServerFilePath(server, location), b, os.ModePerm)
+}
+
+// the buffers of the records written by BatchWritePingRets, reused as the ping results are appended thousands of times a second
+var recordBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// the buffers of big backfills are left to the garbage collector rather than pinned in the pool
+const _MAX_POOLED_BUFFER = 1 << 16
+
+func putRecordBuffer(buf *[]byte) {
+	if cap(*buf) <= _MAX_POOLED_BUFFER {
+		recordBuffers.Put(buf)
+	}
 }
 
 func (f *fileEngine) Init() (Servers, Users, map[string]int64) {
+	// Init is invoked again when the store reloads
+	f.servers = make(Servers)
+	f.users = make(Users)
+	f.allServers = make(map[string]int64)
+	f.corruptions, f.warnings = nil, nil
 	defer func() {
 		f.servers = nil
 		f.users = nil
@@ -93,46 +184,114 @@ func (f *fileEngine) Init() (Servers, Users, map[string]int64) {
 	f.notExistThenMkdir(f.serversDir)
 	f.notExistThenMkdir(f.usersDir)
 
-	f.cursor = f.serversDir
-	if err := filepath.Walk(f.serversDir, f.serversWalkerFunc); err != nil {
+	files, err := f.seriesFiles()
+	if err != nil {
 		panic("can not walk servers")
 	}
+	// the series are read and decoded at once, which takes most of the startup of a big store
+	prs := make([][]PingRet, len(files))
+	var done int64
+	parallel(len(files), f.concurrency(), func(i int) {
+		prs[i] = f.getPingRetsFromPath(files[i].path)
+		if f.progress != nil {
+			f.progress(int(atomic.AddInt64(&done, 1)), len(files))
+		}
+	})
+	for i, file := range files {
+		f.servers[file.server][file.location] = prs[i]
+	}
+	f.sortCorruptions(0)
 
-	f.cursor = f.usersDir
-	if err := filepath.Walk(f.usersDir, f.usersWalkerFunc); err != nil {
+	n := len(f.corruptions)
+	if err := f.loadUsers(); err != nil {
 		panic("can not walk users")
 	}
+	f.sortCorruptions(n)
 
 	return f.servers, f.users, f.allServers
 }
 
+// the files read at once by Init
+func (f *fileEngine) concurrency() int {
+	if f.initConcurrency > 0 {
+		return f.initConcurrency
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// SetProgress sets the func invoked with the series loaded and the total as Init goes on
+func (f *fileEngine) SetProgress(progress func(done, total int)) { f.progress = progress }
+
+type seriesFile struct {
+	server, location, path string
+}
+
+// the series in the directories of the servers, the servers without any are created empty
+func (f *fileEngine) seriesFiles() ([]seriesFile, error) {
+	dirs, err := ioutil.ReadDir(f.serversDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []seriesFile
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		server := serverOfFileName(dir.Name())
+		if f.servers[server] == nil {
+			f.servers[server] = make(map[string][]PingRet)
+		}
+		locations, err := ioutil.ReadDir(filepath.Join(f.serversDir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, location := range locations {
+			path := filepath.Join(f.serversDir, dir.Name(), location.Name())
+			// left by an interrupted rewrite
+			if strings.HasSuffix(location.Name(), _TMP_SUFFIX) {
+				f.warn(fmt.Sprintf("%v is left by an interrupted write, the series is loaded as it was before", path))
+				continue
+			}
+			if !location.IsDir() {
+				files = append(files, seriesFile{server: server, location: location.Name(), path: path})
+			}
+		}
+	}
+	return files, nil
+}
+
+// the directories should exist
+func (f *fileEngine) Health(ctx context.Context) error {
+	for _, dir := range []string{f.serversDir, f.usersDir} {
+		if exist, err := f.isDirExist(dir); err != nil {
+			return err
+		} else if !exist {
+			return fmt.Errorf("%v does not exist", dir)
+		}
+	}
+	return nil
+}
+
 func (f *fileEngine) getUserFilePath(username string) string {
 	return fmt.Sprintf("%v/%v", f.usersDir, username)
 }
 
 func (f *fileEngine) getServerFilePath(serverAddr, location string) string {
-	return fmt.Sprintf("%v/%v/%v", f.serversDir, serverAddr, location)
+	return fmt.Sprintf("%v/%v/%v", f.serversDir, serverFileName(serverAddr), location)
 }
 
 func (f *fileEngine) getServerDir(serverAddr string) string {
-	return fmt.Sprintf("%v/%v", f.serversDir, serverAddr)
+	return fmt.Sprintf("%v/%v", f.serversDir, serverFileName(serverAddr))
 }
 
-func (f *fileEngine) serversWalkerFunc(path string, file os.FileInfo, err error) error {
-	if file.Name() == f.cursor {
-		return nil
-	}
+// the servers of the checks like "https://google.com/healthz" are escaped in the file names, hosts are unchanged
+func serverFileName(server string) string { return url.PathEscape(server) }
 
-	if file.IsDir() {
-		f.cursor = file.Name()
-		if f.servers[f.cursor] == nil {
-			f.servers[f.cursor] = make(map[string][]PingRet)
-		}
-		return filepath.Walk(path, f.serversWalkerFunc)
-	} else {
-		f.servers[f.cursor][file.Name()] = f.getPingRetsFromPath(path)
+func serverOfFileName(name string) string {
+	if server, err := url.PathUnescape(name); err == nil {
+		return server
 	}
-	return nil
+	return name
 }
 
 func (f *fileEngine) getPingRetsFromPath(path string) []PingRet {
@@ -141,27 +300,61 @@ func (f *fileEngine) getPingRetsFromPath(path string) []PingRet {
 		panic(err)
 	}
 	ps := make([]PingRet, 0)
-	for _, v := range bytes.Split(bs, []byte(_NEW_LINE)) {
-		var p PingRet
+	corrupt := false
+	for i, v := range bytes.Split(bs, []byte(_NEW_LINE)) {
 		if len(v) == 0 {
 			continue
 		}
-		if err := json.Unmarshal(v, &p); err != nil {
-			panic(err)
+		p, err := f.unmarshalPingRet(v)
+		if err != nil {
+			f.corrupt(Corruption{Path: path, Line: i + 1, Reason: err.Error()})
+			corrupt = true
+			continue
 		}
 		ps = append(ps, p)
 	}
+	if corrupt && f.corruptMode == CORRUPT_REPAIR {
+		if err := f.repairPingRets(path, ps); err != nil {
+			panic(fmt.Errorf("can not repair %v: %v", path, err))
+		}
+	}
 	return ps
 }
 
-func (f *fileEngine) usersWalkerFunc(path string, file os.FileInfo, err error) error {
-	if file.Name() == f.cursor {
-		return nil
+// the users are read and decoded at once like the series
+func (f *fileEngine) loadUsers() error {
+	files, err := ioutil.ReadDir(f.usersDir)
+	if err != nil {
+		return err
 	}
-
-	if !file.IsDir() {
-		u := f.getUserFromPath(path)
-		f.users[file.Name()] = u
+	var names []string
+	for _, file := range files {
+		// left by an interrupted write or moved aside by a repair
+		if file.IsDir() || strings.HasSuffix(file.Name(), _TMP_SUFFIX) || strings.HasSuffix(file.Name(), _CORRUPT_SUFFIX) {
+			continue
+		}
+		names = append(names, file.Name())
+	}
+	users := make([]*User, len(names))
+	parallel(len(names), f.concurrency(), func(i int) {
+		path := filepath.Join(f.usersDir, names[i])
+		u, err := f.getUserFromPath(path)
+		if err != nil {
+			f.corrupt(Corruption{Path: path, Reason: err.Error()})
+			if f.corruptMode == CORRUPT_REPAIR {
+				if err = os.Rename(path, path+_CORRUPT_SUFFIX); err != nil {
+					panic(fmt.Errorf("can not move %v aside: %v", path, err))
+				}
+			}
+			return
+		}
+		users[i] = u
+	})
+	for i, u := range users {
+		if u == nil {
+			continue
+		}
+		f.users[names[i]] = u
 		for server := range u.MonitorServers {
 			f.allServers[server]++
 		}
@@ -169,16 +362,19 @@ func (f *fileEngine) usersWalkerFunc(path string, file os.FileInfo, err error) e
 	return nil
 }
 
-func (f *fileEngine) getUserFromPath(path string) *User {
+func (f *fileEngine) getUserFromPath(path string) (*User, error) {
 	bs, err := ioutil.ReadFile(path)
 	if err != nil {
 		panic(err)
 	}
+	if bs, err = f.crypt.open(bs); err != nil {
+		return nil, err
+	}
 	u := newUser()
 	if err := json.Unmarshal(bs, u); err != nil {
-		panic(err)
+		return nil, err
 	}
-	return u
+	return u, nil
 }
 
 func (f *fileEngine) notExistThenMkdir(dir string) error {
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"strconv"
+
+	"github.com/gogames/watchdog/main-server/filter"
+)
+
+// the fields of the filters of the ping results, see filter.Parse
+// down is true or false, loss and mtu are of the ping results telling them only
+var PING_RET_FIELDS = []string{"location", "time", "ping", "down", "loss", "mtu", "probe_time", "received_time"}
+
+// the fields of the filters of the aggregates, loss is of the aggregates of ping results telling it only
+var AGGREGATE_FIELDS = []string{"location", "start", "count", "down", "min", "max", "avg", "uptime", "loss"}
+
+type locatedPingRet struct {
+	location string
+	PingRet
+}
+
+func (r locatedPingRet) Field(name string) (string, bool) {
+	switch name {
+	case "location":
+		return r.location, true
+	case "time":
+		return r.Time, true
+	case "ping":
+		return r.Ping, true
+	case "down":
+		p, err := strconv.ParseFloat(r.Ping, 64)
+		return strconv.FormatBool(err != nil || r.Ping == _DEFAULT_PING || p == 0), true
+	case "loss":
+		return r.Loss, r.Loss != ""
+	case "mtu":
+		return strconv.Itoa(r.MTU), r.MTU > 0
+	case "probe_time":
+		return r.ProbeTime, r.ProbeTime != ""
+	case "received_time":
+		return r.ReceivedTime, r.ReceivedTime != ""
+	}
+	return "", false
+}
+
+type locatedAggregate struct {
+	location string
+	Aggregate
+}
+
+func (r locatedAggregate) Field(name string) (string, bool) {
+	float := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	switch name {
+	case "location":
+		return r.location, true
+	case "start":
+		return r.Start, true
+	case "count":
+		return strconv.FormatInt(r.Count, 10), true
+	case "down":
+		return strconv.FormatInt(r.Down, 10), true
+	case "min":
+		return float(r.Min), true
+	case "max":
+		return float(r.Max), true
+	case "avg":
+		return float(r.Avg), true
+	case "uptime":
+		return float(r.Uptime), true
+	case "loss":
+		return float(r.Loss), r.Pinged > 0
+	}
+	return "", false
+}
+
+// FilterPingRets returns the ping results of each location matching the expression of PING_RET_FIELDS
+// the locations of no ping result matching are left out
+func FilterPingRets(all map[string][]PingRet, e *filter.Expr) map[string][]PingRet {
+	if e == nil {
+		return all
+	}
+	ret := make(map[string][]PingRet)
+	for location, prs := range all {
+		for _, pr := range prs {
+			if e.Match(locatedPingRet{location, pr}) {
+				ret[location] = append(ret[location], pr)
+			}
+		}
+	}
+	return ret
+}
+
+// FilterAggregates returns the aggregates of each location matching the expression of AGGREGATE_FIELDS
+// the locations of no aggregate matching are left out
+func FilterAggregates(all map[string][]Aggregate, e *filter.Expr) map[string][]Aggregate {
+	if e == nil {
+		return all
+	}
+	ret := make(map[string][]Aggregate)
+	for location, as := range all {
+		for _, a := range as {
+			if e.Match(locatedAggregate{location, a}) {
+				ret[location] = append(ret[location], a)
+			}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// chans are saturated if they are fuller than this ratio
+const _SATURATED_RATIO = 0.9
+
+// engines implementing HealthChecker report their health in Store.Health
+type HealthChecker interface {
+	Health(ctx context.Context) error
+}
+
+type Health struct {
+	Closed        bool      `json:"closed"`
+	ReadOnly      bool      `json:"read_only"`
+	EngineError   string    `json:"engine_error,omitempty"`
+	LastWrite     time.Time `json:"last_write"`
+	LastWriteFail time.Time `json:"last_write_fail"`
+
+	AddServerChanLen  int `json:"add_server_chan_len"`
+	AddServerChanCap  int `json:"add_server_chan_cap"`
+	KickServerChanLen int `json:"kick_server_chan_len"`
+	KickServerChanCap int `json:"kick_server_chan_cap"`
+	// the servers queued beyond the capacity of the chans, they are sent once the chans are drained
+	AddServerQueueLen  int `json:"add_server_queue_len"`
+	KickServerQueueLen int `json:"kick_server_queue_len"`
+}
+
+// Ready returns the reason why the store is not ready to serve, nil if ready
+func (h Health) Ready() error {
+	switch {
+	case h.Closed:
+		return fmt.Errorf("store is closed")
+	case h.EngineError != "":
+		return fmt.Errorf("engine is unhealthy: %v", h.EngineError)
+	case saturated(h.AddServerChanLen, h.AddServerChanCap):
+		return fmt.Errorf("add server chan is saturated: %v/%v", h.AddServerChanLen, h.AddServerChanCap)
+	case saturated(h.KickServerChanLen, h.KickServerChanCap):
+		return fmt.Errorf("kick server chan is saturated: %v/%v", h.KickServerChanLen, h.KickServerChanCap)
+	}
+	return nil
+}
+
+func saturated(l, c int) bool { return c > 0 && float64(l) >= float64(c)*_SATURATED_RATIO }
+
+func (s *Store) Health(ctx context.Context) Health {
+	h := Health{
+		Closed:             s.isClosed,
+		ReadOnly:           s.isReadOnly(),
+		LastWrite:          unixNano(atomic.LoadInt64(&s.counters.lastWriteNanos)),
+		LastWriteFail:      unixNano(atomic.LoadInt64(&s.counters.lastWriteFailNanos)),
+		AddServerChanLen:   len(s.AddServerChan),
+		AddServerChanCap:   cap(s.AddServerChan),
+		KickServerChanLen:  len(s.KickServerChan),
+		KickServerChanCap:  cap(s.KickServerChan),
+		AddServerQueueLen:  s.addQueue.len(),
+		KickServerQueueLen: s.kickQueue.len(),
+	}
+	if hc, ok := s.storeEngine.(HealthChecker); ok {
+		if err := hc.Health(ctx); err != nil {
+			h.EngineError = err.Error()
+		}
+	}
+	return h
+}
+
+func unixNano(n int64) (t time.Time) {
+	if n != 0 {
+		t = time.Unix(0, n)
+	}
+	return
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/gogames/watchdog/probe"
+)
+
+// the label of the servers added by an importer, its value is the name of the importer
+const LABEL_IMPORTER = "importer"
+
+// Import reconciles the hosts pulled by the importer of the name into the monitoring list of the user, host -> labels
+// the new hosts are added like AddHost and labeled by LABEL_IMPORTER, the hosts already monitored are left untouched
+// if prune is true the servers labeled by the importer whose hosts vanished are deleted
+// returns the changes, nothing is changed if dryRun is true
+func (s *Store) Import(ctx context.Context, username, importer string, hosts map[string]map[string]string, prune, dryRun bool) (changes []Change, err error) {
+	for host := range hosts {
+		if _, err = probe.CheckServer(host, probe.KIND_ICMP); err != nil {
+			return
+		}
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			u, ok := s.users[username]
+			if !ok {
+				err = fmt.Errorf("User %v not exist", username)
+				return
+			}
+			if changes = importHosts(u.copy(), username, importer, hosts, prune); dryRun || len(changes) == 0 {
+				return
+			}
+			if err = s.updateUser(ctx, username, func(u *User) error {
+				changes = importHosts(u, username, importer, hosts, prune)
+				return nil
+			}); err != nil {
+				changes = nil
+				return
+			}
+			added, deleted := make([]string, 0, len(changes)), make([]string, 0)
+			for _, c := range changes {
+				if c.Action == ACTION_ADD_SERVER {
+					added = append(added, c.Server)
+				} else {
+					deleted = append(deleted, c.Server)
+				}
+			}
+			s.monitorAdded(added)
+			s.monitorDeleted(deleted)
+		})
+	})
+	return
+}
+
+// add the hosts not monitored by the user and delete the servers of the importer whose hosts vanished if prune is true
+func importHosts(u *User, username, importer string, hosts map[string]map[string]string, prune bool) (changes []Change) {
+	monitored := make(map[string]bool, len(u.MonitorServers))
+	servers := make([]string, 0, len(u.MonitorServers))
+	for server := range u.MonitorServers {
+		monitored[HostOf(server)] = true
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	for _, host := range names {
+		if monitored[host] {
+			continue
+		}
+		labels := make(map[string]string, len(hosts[host])+1)
+		for k, v := range hosts[host] {
+			labels[k] = v
+		}
+		labels[LABEL_IMPORTER] = importer
+		for _, server := range addHost(u, host, labels) {
+			changes = append(changes, Change{Action: ACTION_ADD_SERVER, Username: username, Server: server})
+		}
+	}
+	if !prune {
+		return
+	}
+	for _, server := range servers {
+		if _, ok := hosts[HostOf(server)]; !ok && u.Labels[server][LABEL_IMPORTER] == importer {
+			forgetServer(u, server)
+			changes = append(changes, Change{Action: ACTION_DELETE_SERVER, Username: username, Server: server})
+		}
+	}
+	return
+}
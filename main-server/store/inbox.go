@@ -0,0 +1,359 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+)
+
+// the kinds of the messages of the inbox
+const (
+	MESSAGE_ALERT  = "alert"
+	MESSAGE_SYSTEM = "system"
+)
+
+// the messages kept in the inbox of a user, the earliest are dropped beyond it
+const _MAX_MESSAGES = 1 << 8
+
+// the messages older are dropped, unless SetInboxRetention
+const _INBOX_RETENTION = 30 * 24 * time.Hour
+
+// the inboxes written to the engine at once by a broadcast
+const _INBOX_BATCH = 1 << 8
+
+// Message is a notification in the inbox of a user shown by the web ui, like an alert notified or a message of the operator
+type Message struct {
+	Id    string       `json:"id"`
+	Kind  string       `json:"kind"`
+	Time  time.Time    `json:"time"`
+	Text  string       `json:"text"`
+	Alert *alert.Alert `json:"alert,omitempty"`
+	Read  bool         `json:"read,omitempty"`
+}
+
+// engines persisting the inboxes apart from the users implement InboxStore, the inboxes are kept in memory only otherwise
+// so that an alert posted does not write the whole user again
+type InboxStore interface {
+	// WriteInboxes replaces the inboxes of the users, an empty one is removed
+	WriteInboxes(ctx context.Context, inboxes map[string][]Message) error
+	ReadInboxes() (map[string][]Message, error)
+}
+
+// SetInboxRetention drops the messages older than d from the inboxes, 30 days by default
+func (s *Store) SetInboxRetention(d time.Duration) *Store {
+	s.withWriteLock(func() { s.inboxRetention = d })
+	return s
+}
+
+func (s *Store) retention() time.Duration {
+	if s.inboxRetention <= 0 {
+		return _INBOX_RETENTION
+	}
+	return s.inboxRetention
+}
+
+// the latest messages within the retention, in the order posted
+func (s *Store) retained(ms []Message, now time.Time) []Message {
+	since := now.Add(-s.retention())
+	ret := make([]Message, 0, len(ms))
+	for _, m := range ms {
+		if !m.Time.Before(since) {
+			ret = append(ret, m)
+		}
+	}
+	if len(ret) > _MAX_MESSAGES {
+		ret = ret[len(ret)-_MAX_MESSAGES:]
+	}
+	return ret
+}
+
+func newMessage(m Message) (Message, error) {
+	if m.Kind != MESSAGE_ALERT && m.Kind != MESSAGE_SYSTEM {
+		return m, fmt.Errorf("unknown message kind %v", m.Kind)
+	}
+	if m.Text == "" {
+		return m, fmt.Errorf("message text should not be empty")
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return m, err
+	}
+	m.Id, m.Read = hex.EncodeToString(b), false
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	return m, nil
+}
+
+// the users written before the inboxes were stored apart keep them in their records, moved to the inboxes once loaded
+// returns the users whose inboxes were moved
+func moveInboxes(users Users, inboxes map[string][]Message) []string {
+	moved := make([]string, 0)
+	for username, u := range users {
+		if len(u.Inbox) == 0 {
+			continue
+		}
+		if _, ok := inboxes[username]; !ok {
+			inboxes[username] = u.Inbox
+			moved = append(moved, username)
+		}
+		u.Inbox = nil
+	}
+	return moved
+}
+
+// empty with the error if the inboxes can not be read
+func (s *Store) readInboxes() (map[string][]Message, error) {
+	if is, ok := s.storeEngine.(InboxStore); ok {
+		inboxes, err := is.ReadInboxes()
+		if err != nil {
+			return make(map[string][]Message), err
+		}
+		return inboxes, nil
+	}
+	return make(map[string][]Message), nil
+}
+
+// replace the inbox of the user in memory, the engine is written by writeInboxes
+// should be invoked with write lock held
+func (s *Store) setInbox(username string, ms []Message) {
+	if len(ms) == 0 {
+		delete(s.inboxes, username)
+	} else {
+		s.inboxes[username] = ms
+	}
+	s.feed.record(FeedEvent{Username: username, Inbox: ms})
+}
+
+// write the inboxes of the users as they are in memory, _INBOX_BATCH at once
+// the writes are serialized rather than holding the store lock, so that the engine always ends up by the latest inboxes
+func (s *Store) writeInboxes(ctx context.Context, usernames []string) error {
+	is, ok := s.storeEngine.(InboxStore)
+	if !ok || len(usernames) == 0 {
+		return nil
+	}
+	s.inboxWrite.Lock()
+	defer s.inboxWrite.Unlock()
+	for len(usernames) > 0 {
+		batch := usernames[:min(len(usernames), _INBOX_BATCH)]
+		usernames = usernames[len(batch):]
+		inboxes := make(map[string][]Message, len(batch))
+		s.withReadLock(func() {
+			for _, username := range batch {
+				// the inboxes are replaced rather than modified
+				inboxes[username] = s.inboxes[username]
+			}
+		})
+		if err := s.engineWrite(ctx, "StoreEngine.WriteInboxes", func(ctx context.Context) error {
+			return is.WriteInboxes(ctx, inboxes)
+		}, "inboxes", len(inboxes)); err != nil {
+			s.logger.ErrorContext(ctx, "can not write inboxes", "inboxes", len(inboxes), "error", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// post the message to the inboxes of the users in memory, returns the users it was posted to
+// the engine is written once the lock is released, the memory is changed first, so the store should be writable
+func (s *Store) postMessages(ctx context.Context, usernames []string, m Message) (posted []string, err error) {
+	if s.isReadOnly() {
+		return nil, ErrorReadOnly
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			if usernames == nil {
+				usernames = make([]string, 0, len(s.users))
+				for username := range s.users {
+					usernames = append(usernames, username)
+				}
+			}
+			now := time.Now()
+			for _, username := range usernames {
+				if _, ok := s.users[username]; !ok {
+					err = fmt.Errorf("User %v not exist", username)
+					return
+				}
+				inbox := s.inboxes[username]
+				s.setInbox(username, s.retained(append(inbox[:len(inbox):len(inbox)], m), now))
+			}
+			posted = usernames
+		})
+		if err == nil {
+			err = s.writeInboxes(ctx, posted)
+		}
+	})
+	return
+}
+
+// PostMessage adds the message to the inbox of the user, returns it with its id
+func (s *Store) PostMessage(ctx context.Context, username string, m Message) (ret Message, err error) {
+	if m, err = newMessage(m); err != nil {
+		return
+	}
+	if _, err = s.postMessages(ctx, []string{username}, m); err != nil {
+		return
+	}
+	return m, nil
+}
+
+// Broadcast adds the message to the inbox of every user, like a maintenance announced by the operator, returns the users it was added to
+func (s *Store) Broadcast(ctx context.Context, m Message) (n int, err error) {
+	if m, err = newMessage(m); err != nil {
+		return
+	}
+	posted, err := s.postMessages(ctx, nil, m)
+	return len(posted), err
+}
+
+// GetInbox returns the messages of the inbox of the user within the retention, the latest first, at most n if n is positive,
+// only the unread ones if unread is true, and the number of the unread ones
+func (s *Store) GetInbox(username string, unread bool, n int) (ret []Message, unreadCount int, err error) {
+	s.withReadLock(func() {
+		if _, ok := s.users[username]; !ok {
+			err = fmt.Errorf("User %v not exist", username)
+			return
+		}
+		ms := s.retained(s.inboxes[username], time.Now())
+		ret = make([]Message, 0)
+		for i := len(ms) - 1; i >= 0; i-- {
+			if ms[i].Read {
+				continue
+			}
+			unreadCount++
+		}
+		for i := len(ms) - 1; i >= 0 && (n <= 0 || len(ret) < n); i-- {
+			if !unread || !ms[i].Read {
+				ret = append(ret, ms[i])
+			}
+		}
+	})
+	return
+}
+
+// MarkRead marks the messages of the ids read, all of them if ids is empty, returns the messages marked
+func (s *Store) MarkRead(ctx context.Context, username string, ids []string) (n int, err error) {
+	if s.isReadOnly() {
+		return 0, ErrorReadOnly
+	}
+	marked := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		marked[id] = true
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			if _, ok := s.users[username]; !ok {
+				err = fmt.Errorf("User %v not exist", username)
+				return
+			}
+			inbox := make([]Message, len(s.inboxes[username]))
+			for i, m := range s.inboxes[username] {
+				if !m.Read && (len(ids) == 0 || marked[m.Id]) {
+					m.Read = true
+					n++
+				}
+				inbox[i] = m
+			}
+			if n > 0 {
+				s.setInbox(username, inbox)
+			}
+		})
+		if err == nil && n > 0 {
+			err = s.writeInboxes(ctx, []string{username})
+		}
+	})
+	return
+}
+
+// PruneInboxes drops the messages beyond the retention from the inboxes, returns the messages dropped
+// the messages are not shown once beyond it anyway, pruning frees the memory and the engine of the users gone quiet
+func (s *Store) PruneInboxes(ctx context.Context) (n int, err error) {
+	if s.isReadOnly() {
+		return 0, ErrorReadOnly
+	}
+	s.do(func() {
+		pruned := make([]string, 0)
+		s.withWriteLock(func() {
+			now := time.Now()
+			for username, ms := range s.inboxes {
+				if kept := s.retained(ms, now); len(kept) < len(ms) {
+					n += len(ms) - len(kept)
+					s.setInbox(username, kept)
+					pruned = append(pruned, username)
+				}
+			}
+		})
+		err = s.writeInboxes(ctx, pruned)
+	})
+	return
+}
+
+func (f *fileEngine) getInboxFilePath(username string) string {
+	return fmt.Sprintf("%v/%v", f.inboxDir, username)
+}
+
+func (f *fileEngine) WriteInboxes(ctx context.Context, inboxes map[string][]Message) error {
+	if err := f.notExistThenMkdir(f.inboxDir); err != nil {
+		return err
+	}
+	for username, ms := range inboxes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path := f.getInboxFilePath(username)
+		if len(ms) == 0 {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		b, err := json.Marshal(ms)
+		if err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(path+_TMP_SUFFIX, f.crypt.seal(b), os.ModePerm); err != nil {
+			return err
+		}
+		if err = os.Rename(path+_TMP_SUFFIX, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fileEngine) ReadInboxes() (map[string][]Message, error) {
+	ret := make(map[string][]Message)
+	files, err := ioutil.ReadDir(f.inboxDir)
+	if os.IsNotExist(err) {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), _TMP_SUFFIX) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(f.inboxDir, file.Name()))
+		if err == nil {
+			b, err = f.crypt.open(b)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var ms []Message
+		if err = json.Unmarshal(b, &ms); err != nil {
+			return nil, fmt.Errorf("can not read inbox of %v: %v", file.Name(), err)
+		}
+		ret[file.Name()] = ms
+	}
+	return ret, nil
+}
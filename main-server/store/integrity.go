@@ -0,0 +1,92 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// how the file engine handles the corrupt records found on Init, like a partial line written on power loss
+const (
+	// skip the corrupt records, the files are left as they are, the default
+	CORRUPT_SKIP = "skip"
+	// skip and remove the corrupt records, corrupt users are moved aside to <user>.corrupt
+	CORRUPT_REPAIR = "repair"
+	// fail the startup
+	CORRUPT_FAIL = "fail"
+
+	_CORRUPT_SUFFIX = ".corrupt"
+)
+
+// ErrorChecksum is the error of a record not matching its checksum
+var ErrorChecksum = errors.New("checksum mismatch")
+
+// Corruption is a corrupt record found on Init, Line is 0 for a whole file like a user
+type Corruption struct {
+	Path   string `json:"path"`
+	Line   int    `json:"line,omitempty"`
+	Reason string `json:"reason"`
+	// removed from the storage
+	Repaired bool `json:"repaired"`
+}
+
+// engines verifying their records implement CorruptionReporter, the corruptions found on Init are in the RecoveryReport
+type CorruptionReporter interface {
+	Corruptions() []Corruption
+}
+
+func validCorruptMode(mode string) error {
+	switch mode {
+	case CORRUPT_SKIP, CORRUPT_REPAIR, CORRUPT_FAIL:
+		return nil
+	}
+	return fmt.Errorf("corrupt should be %v, %v or %v", CORRUPT_SKIP, CORRUPT_REPAIR, CORRUPT_FAIL)
+}
+
+func (f *fileEngine) Corruptions() []Corruption { return append([]Corruption(nil), f.corruptions...) }
+
+func (f *fileEngine) Warnings() []string { return append([]string(nil), f.warnings...) }
+
+// record the corrupt record, or panic to fail Init
+func (f *fileEngine) corrupt(c Corruption) {
+	if f.corruptMode == CORRUPT_FAIL {
+		panic(fmt.Errorf("corrupt record in %v line %v: %v", c.Path, c.Line, c.Reason))
+	}
+	c.Repaired = f.corruptMode == CORRUPT_REPAIR
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.corruptions = append(f.corruptions, c)
+}
+
+// the corruptions found from i sorted by path and line, they are found in any order as the files are read at once
+func (f *fileEngine) sortCorruptions(i int) {
+	cs := f.corruptions[i:]
+	sort.SliceStable(cs, func(i, j int) bool {
+		if cs[i].Path != cs[j].Path {
+			return cs[i].Path < cs[j].Path
+		}
+		return cs[i].Line < cs[j].Line
+	})
+}
+
+func (f *fileEngine) warn(warning string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.warnings = append(f.warnings, warning)
+}
+
+// rewrite the file of ping results with the valid records, write and rename so that it is never partial
+func (f *fileEngine) repairPingRets(path string, prs []PingRet) error {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	for _, pr := range prs {
+		buf.Write(f.marshalPingRet(pr))
+	}
+	tmp := path + _TMP_SUFFIX
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
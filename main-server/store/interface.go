@@ -0,0 +1,152 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/probe"
+)
+
+// Interface is the public surface of the Store the main server depends on
+// application level tests substitute it, e.g. by the fake of storetest, rather than configuring an engine
+type Interface interface {
+	// users
+	GetUser(username string) *User
+	GetUsernames() []string
+	AddUser(ctx context.Context, username, password string) error
+	UpdatePassword(ctx context.Context, username, oldpassword, newpassword string) error
+	GetExternalUser(provider, subject string) string
+	LinkExternalUser(ctx context.Context, username, provider, subject string) error
+	ProvisionExternalUser(ctx context.Context, username, provider, subject string) error
+	SetOrganization(ctx context.Context, username, organization string) error
+	ClaimHost(ctx context.Context, username, host string) (Claim, error)
+	VerifyClaim(ctx context.Context, username, host, method string) error
+	GetClaims(username string) (map[string]Claim, error)
+	OwnershipVerified(username, host string) bool
+	GetSettings(username string) (Settings, error)
+	SetSettings(ctx context.Context, username string, st Settings) error
+	Apply(ctx context.Context, spec Spec, dryRun bool) ([]Change, error)
+	CountUsage(username string, requests, samples, bytes int64)
+	GetUsage(username string, days int) ([]Usage, error)
+	PurgeUserData(ctx context.Context, username, actor string) error
+	TopUsage(metric string, days, n int) ([]UserUsage, error)
+
+	// servers and their ping results
+	GetServers() []string
+	AddMonitorServer(ctx context.Context, username, server string) error
+	DeleteMonitorServer(ctx context.Context, username, server string) error
+	AddedServers() <-chan string
+	KickedServers() <-chan string
+	ResyncAssignments() (int, error)
+	AddOptOut(ctx context.Context, o OptOut) error
+	RemoveOptOut(ctx context.Context, target, actor string) error
+	GetOptOuts() []OptOut
+	SetServerLabels(ctx context.Context, username, server string, labels map[string]string) error
+	GetServerLabels(username, server string) map[string]string
+	AppendPingRet(ctx context.Context, server, location string, pr PingRet) error
+	AppendPingRets(ctx context.Context, server, location string, prs []PingRet) error
+	BackfillPingRets(ctx context.Context, server, location string, prs []PingRet) (int, error)
+	LatestPingRets(server, location string) (last, lastUp PingRet)
+	GetMonitorResult(username, server string) (map[string][]PingRet, error)
+	GetMonitorResultDownsampled(username, server string, maxPoints int) (map[string][]PingRet, error)
+	GetMonitorResultIfNoneMatch(username, server, etag string) (ret map[string][]PingRet, newETag string, notModified bool, err error)
+	GetMonitorResultPage(username, server, cursor string, limit int) (ResultPage, error)
+	GetAggregates(username, server, resolution, from, to string) (map[string][]Aggregate, error)
+	GetUptime(username, server, from string) (float64, int64, error)
+	GetPingRets(username, server, from, to string) (map[string][]PingRet, error)
+	GetOverview(username string, points int) (map[string]Overview, error)
+	GetWorstServers(username, metric string, window time.Duration, n int) ([]ServerScore, error)
+	GetStatus(username, server string) (ServerStatus, error)
+	GetHosts(username string) (map[string][]string, error)
+	GetChecks(username, host string) ([]Check, error)
+	SetCheckTemplate(ctx context.Context, username string, t CheckTemplate) ([]string, error)
+	DeleteCheckTemplate(ctx context.Context, username, name string) error
+	SetTransaction(ctx context.Context, username, name string, steps []probe.Step) (string, error)
+	Transaction(server string) []probe.Step
+	SetSLO(ctx context.Context, username string, o SLO) error
+	DeleteSLO(ctx context.Context, username, name string) error
+	GetSLOs(username string, now time.Time) ([]SLOStatus, error)
+	SLOSubjects() []alert.Subject
+	AddHost(ctx context.Context, username, host string, labels map[string]string) ([]string, error)
+	CheckIntervals() map[string]time.Duration
+	Import(ctx context.Context, username, importer string, hosts map[string]map[string]string, prune, dryRun bool) ([]Change, error)
+	AddAnnotation(ctx context.Context, username, server string, a Annotation) (Annotation, error)
+	DeleteAnnotation(ctx context.Context, username, server, id string) error
+	GetAnnotations(username, server, from, to string) ([]Annotation, error)
+	GetStatuses(username string) (map[string]ServerStatus, error)
+	RecordResolution(ctx context.Context, server string, ips []string, t time.Time) (bool, error)
+	GetDNSHistory(username, server string) ([]Resolution, error)
+	GetMTUChanges(username, server string) ([]MTUChange, error)
+	PurgeServerData(ctx context.Context, server, actor string) error
+
+	// virtual servers pushing their samples
+	AddVirtualServer(ctx context.Context, username, name string) (server, token string, err error)
+	AddHeartbeat(ctx context.Context, username, name string, interval, grace time.Duration) (server, token string, err error)
+	Heartbeats() map[string]Heartbeat
+	CheckIngestToken(server, token string) bool
+
+	// alerting
+	AlertSubjects(server string) []alert.Subject
+	SetAlertTemplate(ctx context.Context, username string, t alert.Template) error
+	DeleteAlertTemplate(ctx context.Context, username, name string) error
+	SetServerDependency(ctx context.Context, username, server, parent string) error
+	SetNotificationChannel(ctx context.Context, username string, c alert.Channel) error
+	DeleteNotificationChannel(ctx context.Context, username, name string) error
+	SetNotificationSchedule(ctx context.Context, username string, sched alert.Schedule) error
+	SetAlertCorrelation(ctx context.Context, username string, c *alert.Correlation) error
+	RequestPhoneVerification(ctx context.Context, username, phone string) (string, error)
+	VerifyPhone(ctx context.Context, username, phone, code string) error
+	CancelPhoneVerification(ctx context.Context, username, phone string) error
+	GetPhones(username string) (map[string]Phone, error)
+	DeletePhone(ctx context.Context, username, phone string) error
+
+	// the inboxes of the users
+	PostMessage(ctx context.Context, username string, m Message) (Message, error)
+	Broadcast(ctx context.Context, m Message) (int, error)
+	GetInbox(username string, unread bool, n int) ([]Message, int, error)
+	MarkRead(ctx context.Context, username string, ids []string) (int, error)
+	PruneInboxes(ctx context.Context) (int, error)
+
+	// latency matrix of the ping nodes
+	SetProbeLatency(location, target string, pr PingRet)
+	DeleteProbeLatency(location string)
+	GetLatencyMatrix() map[string]map[string]PingRet
+
+	// replication, leader election and backups
+	Snapshot() Snapshot
+	Changes(epoch int64, seq uint64, wait time.Duration) ([]FeedEvent, error)
+	ApplySnapshot(snap Snapshot)
+	ApplyChanges(events []FeedEvent)
+	AcquireLeadership(holder string, ttl time.Duration) (bool, error)
+	ReleaseLeadership(holder string) error
+	Reload()
+	View() *View
+
+	// operations
+	Health(ctx context.Context) Health
+	RecoveryReport() RecoveryReport
+	Audit(n int) []AuditEntry
+	RecordAudit(ctx context.Context, e AuditEntry) error
+	RotateKeys(ctx context.Context) (int, error)
+	SetReadOnly(ctx context.Context, on bool) (int, error)
+	Tier(ctx context.Context, now time.Time, owns func(server string) bool) (TierReport, error)
+	ReadOnlyStatus() ReadOnlyStatus
+	Metrics() Metrics
+	BreakerStatus() BreakerStatus
+	SlowOps(n int) []SlowOp
+	SetSlowThreshold(d time.Duration) *Store
+	SetInboxRetention(d time.Duration) *Store
+	SetPhoneCodeLimit(n int) *Store
+	SetStatusRules(r StatusRules) *Store
+	SetTargetValidator(f func(server string) error) *Store
+	Close()
+}
+
+var _ Interface = (*Store)(nil)
+
+// AddedServers receives the servers to start pinging, AddServerChan
+func (s *Store) AddedServers() <-chan string { return s.AddServerChan }
+
+// KickedServers receives the servers to stop pinging, KickServerChan
+func (s *Store) KickedServers() <-chan string { return s.KickServerChan }
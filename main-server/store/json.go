@@ -0,0 +1,191 @@
+package store
+
+import (
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// the ping results are the most of the snapshots, the backups and the charts, encoding/json reflects over every field of every one of them
+// the encoders here append the same bytes as encoding/json to a buffer without reflecting, and without allocating if it is big enough
+
+// AppendJSON appends the ping result encoded like encoding/json to dst
+func (pr PingRet) AppendJSON(dst []byte) []byte {
+	dst = append(dst, `{"ping":`...)
+	dst = appendJSONString(dst, pr.Ping)
+	dst = append(dst, `,"time":`...)
+	dst = appendJSONString(dst, pr.Time)
+	for _, f := range [...]struct{ key, value string }{
+		{`,"probe_time":`, pr.ProbeTime}, {`,"received_time":`, pr.ReceivedTime}, {`,"steps":`, pr.Steps}, {`,"loss":`, pr.Loss},
+	} {
+		if f.value != "" {
+			dst = appendJSONString(append(dst, f.key...), f.value)
+		}
+	}
+	if pr.MTU != 0 {
+		dst = strconv.AppendInt(append(dst, `,"mtu":`...), int64(pr.MTU), 10)
+	}
+	return append(dst, '}')
+}
+
+// AppendPingRetsJSON appends the ping results encoded like encoding/json to dst, null if prs is nil
+func AppendPingRetsJSON(dst []byte, prs []PingRet) []byte {
+	if prs == nil {
+		return append(dst, "null"...)
+	}
+	dst = append(dst, '[')
+	for i, pr := range prs {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = pr.AppendJSON(dst)
+	}
+	return append(dst, ']')
+}
+
+// AppendJSON appends the ping results of the series encoded like encoding/json to dst, straight from the columns
+func (s Series) AppendJSON(dst []byte) []byte {
+	dst = append(dst, '[')
+	raw := 0
+	for i := 0; i < s.Len(); i++ {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		if s.flags[i]&_FLAG_RAW != 0 {
+			dst = s.raw[raw].AppendJSON(dst)
+			raw++
+			continue
+		}
+		// none of the numbers and times needs escaping
+		dst = strconv.AppendFloat(append(dst, `{"ping":"`...), float64(s.values[i]), 'f', 3, 32)
+		dst = time.Unix(s.times[i], 0).UTC().AppendFormat(append(dst, `","time":"`...), _PING_TIME_LAYOUT)
+		dst = append(dst, '"')
+		if s.flags[i]&_FLAG_PROBED != 0 {
+			dst = s.appendRFC3339(append(dst, `,"probe_time":"`...), i, s.probed[i])
+		}
+		if s.flags[i]&_FLAG_RECEIVED != 0 {
+			dst = s.appendRFC3339(append(dst, `,"received_time":"`...), i, s.received[i])
+		}
+		if s.flags[i]&_FLAG_LOSS != 0 {
+			dst = strconv.AppendFloat(append(dst, `,"loss":"`...), float64(s.losses[i]), 'f', 1, 32)
+			dst = append(dst, '"')
+		}
+		dst = append(dst, '}')
+	}
+	return append(dst, ']')
+}
+
+// the time offset from the ping result at i formatted like time.RFC3339 in its zone and closed by the quote
+// the zone is formatted by hand, time.FixedZone allocates
+func (s Series) appendRFC3339(dst []byte, i int, offset int32) []byte {
+	dst = time.Unix(s.times[i]+int64(offset), 0).UTC().AppendFormat(dst, "2006-01-02T15:04:05")
+	zone := int(s.zones[i])
+	switch {
+	case zone == 0:
+		return append(dst, `Z"`...)
+	case zone < 0:
+		dst, zone = append(dst, '-'), -zone
+	default:
+		dst = append(dst, '+')
+	}
+	h, m := zone/60, zone%60
+	return append(dst, byte('0'+h/10), byte('0'+h%10), ':', byte('0'+m/10), byte('0'+m%10), '"')
+}
+
+// MarshalJSON encodes the servers like encoding/json, sorted by server and location
+func (servers Servers) MarshalJSON() ([]byte, error) {
+	if servers == nil {
+		return []byte("null"), nil
+	}
+	n := 0
+	for _, locations := range servers {
+		for _, prs := range locations {
+			n += len(prs)
+		}
+	}
+	// about the size of a ping result without the optional fields
+	dst := make([]byte, 0, 2+n*40)
+	names := make([]string, 0, len(servers))
+	for server := range servers {
+		names = append(names, server)
+	}
+	sort.Strings(names)
+	dst = append(dst, '{')
+	for i, server := range names {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = append(appendJSONString(dst, server), ':')
+		locations := servers[server]
+		if locations == nil {
+			dst = append(dst, "null"...)
+			continue
+		}
+		dst = append(dst, '{')
+		sorted := make([]string, 0, len(locations))
+		for location := range locations {
+			sorted = append(sorted, location)
+		}
+		sort.Strings(sorted)
+		for j, location := range sorted {
+			if j > 0 {
+				dst = append(dst, ',')
+			}
+			dst = AppendPingRetsJSON(append(appendJSONString(dst, location), ':'), locations[location])
+		}
+		dst = append(dst, '}')
+	}
+	return append(dst, '}'), nil
+}
+
+const _HEX = "0123456789abcdef"
+
+// the string quoted like encoding/json, the html characters, U+2028 and U+2029 escaped and the invalid utf-8 replaced
+func appendJSONString(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= ' ' && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			dst = append(dst, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				dst = append(dst, '\\', c)
+			case '\b':
+				dst = append(dst, '\\', 'b')
+			case '\f':
+				dst = append(dst, '\\', 'f')
+			case '\n':
+				dst = append(dst, '\\', 'n')
+			case '\r':
+				dst = append(dst, '\\', 'r')
+			case '\t':
+				dst = append(dst, '\\', 't')
+			default:
+				dst = append(dst, '\\', 'u', '0', '0', _HEX[c>>4], _HEX[c&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(append(dst, s[start:i]...), "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			dst = append(append(dst, s[start:i]...), '\\', 'u', '2', '0', '2', _HEX[r&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	return append(append(dst, s[start:]...), '"')
+}
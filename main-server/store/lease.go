@@ -0,0 +1,146 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+const (
+	_LEASE_LOCK_RETRY    = 100
+	_LEASE_LOCK_INTERVAL = 10 * time.Millisecond
+	// the leader failing to renew the lease steps down a third of the ttl before it expires, so that it never leads along with the next one
+	_LEASE_MARGIN = 3
+)
+
+// engines shared by several main servers implement Leaser to elect the leader
+type Leaser interface {
+	// AcquireLease acquires or renews the lease for ttl, returns false if another holder has a valid lease
+	AcquireLease(holder string, ttl time.Duration) (bool, error)
+	// ReleaseLease releases the lease if it is held by the holder
+	ReleaseLease(holder string) error
+}
+
+// AcquireLeadership returns true if the holder leads the main servers sharing the engine
+// the holder is always the leader if the engine is not a Leaser
+// if the engine fails, the holder leads as long as the lease it acquired last is valid, less a margin
+func (s *Store) AcquireLeadership(holder string, ttl time.Duration) (bool, error) {
+	l, ok := s.storeEngine.(Leaser)
+	if !ok {
+		return true, nil
+	}
+	// the lease expires ttl after it was requested at the latest
+	start := time.Now()
+	acquired, err := l.AcquireLease(holder, ttl)
+	s.leaseMu.Lock()
+	defer s.leaseMu.Unlock()
+	if err != nil {
+		return !s.leased.IsZero() && time.Since(s.leased) < ttl-ttl/_LEASE_MARGIN, err
+	}
+	if s.leased = start; !acquired {
+		s.leased = time.Time{}
+	}
+	return acquired, nil
+}
+
+func (s *Store) ReleaseLeadership(holder string) error {
+	s.leaseMu.Lock()
+	s.leased = time.Time{}
+	s.leaseMu.Unlock()
+	if l, ok := s.storeEngine.(Leaser); ok {
+		return l.ReleaseLease(holder)
+	}
+	return nil
+}
+
+// Reload loads the state from the engine again, for stores sharing the engine with other main servers
+// servers added or removed since last load are sent to AddServerChan or KickServerChan
+func (s *Store) Reload() {
+	s.do(func() {
+		l := s.load(true)
+		s.withWriteLock(func() {
+			s.replace(l.series, l.users, l.allServers)
+			s.aggregates, s.dns, s.recovery, s.auditLog, s.status = l.aggregates, l.dns, l.report, l.audit, l.status
+			s.inboxes = l.inboxes
+		})
+		if err := s.writeInboxes(context.Background(), l.movedInboxes); err != nil {
+			s.logger.Warn("can not move the inboxes out of the users", "users", len(l.movedInboxes), "error", err)
+		}
+	})
+}
+
+type lease struct {
+	Holder string    `json:"holder"`
+	Expire time.Time `json:"expire"`
+}
+
+func (f *fileEngine) AcquireLease(holder string, ttl time.Duration) (acquired bool, err error) {
+	err = f.withLeaseLock(ttl, func() error {
+		l, err := f.readLease()
+		if err != nil {
+			return err
+		}
+		if l.Holder != holder && time.Now().Before(l.Expire) {
+			return nil
+		}
+		b, _ := json.Marshal(lease{Holder: holder, Expire: time.Now().Add(ttl)})
+		// write and rename, so that others never read a partial lease
+		tmp := f.leaseFile + _TMP_SUFFIX
+		if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+			return err
+		}
+		if err = os.Rename(tmp, f.leaseFile); err != nil {
+			return err
+		}
+		acquired = true
+		return nil
+	})
+	return
+}
+
+func (f *fileEngine) ReleaseLease(holder string) error {
+	return f.withLeaseLock(time.Minute, func() error {
+		l, err := f.readLease()
+		if err != nil || l.Holder != holder {
+			return err
+		}
+		return os.Remove(f.leaseFile)
+	})
+}
+
+func (f *fileEngine) readLease() (l lease, err error) {
+	b, err := ioutil.ReadFile(f.leaseFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	err = json.Unmarshal(b, &l)
+	return
+}
+
+// the lock file guards reading and writing the lease, a lock older than ttl is left by a crashed holder
+func (f *fileEngine) withLeaseLock(ttl time.Duration, fc func() error) error {
+	lock := f.leaseFile + ".lock"
+	for i := 0; i < _LEASE_LOCK_RETRY; i++ {
+		file, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			file.Close()
+			defer os.Remove(lock)
+			return fc()
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		if info, err := os.Stat(lock); err == nil && time.Since(info.ModTime()) > ttl {
+			os.Remove(lock)
+			continue
+		}
+		time.Sleep(_LEASE_LOCK_INTERVAL)
+	}
+	return fmt.Errorf("lease %v is locked", f.leaseFile)
+}
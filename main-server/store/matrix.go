@@ -0,0 +1,47 @@
+package store
+
+import "sync"
+
+// the latest latency from every probe to other probes and anchors, kept in memory only
+type latencyMatrix struct {
+	m   map[string]map[string]PingRet
+	rwl sync.RWMutex
+}
+
+// SetProbeLatency records the latency from the probe at location to the target, another probe or an anchor
+func (s *Store) SetProbeLatency(location, target string, pr PingRet) {
+	s.matrix.rwl.Lock()
+	defer s.matrix.rwl.Unlock()
+	if s.matrix.m == nil {
+		s.matrix.m = make(map[string]map[string]PingRet)
+	}
+	if _, ok := s.matrix.m[location]; !ok {
+		s.matrix.m[location] = make(map[string]PingRet)
+	}
+	s.matrix.m[location][target] = pr
+}
+
+// DeleteProbeLatency forgets the latency from and to the location, when the probe is gone
+func (s *Store) DeleteProbeLatency(location string) {
+	s.matrix.rwl.Lock()
+	defer s.matrix.rwl.Unlock()
+	delete(s.matrix.m, location)
+	for _, targets := range s.matrix.m {
+		delete(targets, location)
+	}
+}
+
+// GetLatencyMatrix returns a copy of location -> target -> latest ping result
+// a probe slow to every target is likely the problem, rather than the monitored servers
+func (s *Store) GetLatencyMatrix() map[string]map[string]PingRet {
+	s.matrix.rwl.RLock()
+	defer s.matrix.rwl.RUnlock()
+	ret := make(map[string]map[string]PingRet, len(s.matrix.m))
+	for location, targets := range s.matrix.m {
+		ret[location] = make(map[string]PingRet, len(targets))
+		for target, pr := range targets {
+			ret[location][target] = pr
+		}
+	}
+	return ret
+}
@@ -0,0 +1,333 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const ENGINE_MEMORY = "memory"
+
+// memoryEngine keeps the users and the ping results in memory, for development, demos and tests
+// it is persisted to a json file on interval and on close if configured, otherwise everything is lost on exit
+type memoryEngine struct {
+	file          string
+	flushInterval time.Duration
+	// nil if the file is written in plaintext
+	crypt *crypter
+
+	mu      sync.Mutex
+	servers Servers
+	users   Users
+	dns     map[string][]Resolution
+	audit   []AuditEntry
+	inboxes map[string][]Message
+	// the writes since last flush
+	dirty bool
+
+	start sync.Once
+	stop  chan struct{}
+}
+
+// the json file of the memory engine
+type memoryState struct {
+	Version int                     `json:"version"`
+	Users   Users                   `json:"users"`
+	Servers Servers                 `json:"servers"`
+	DNS     map[string][]Resolution `json:"dns,omitempty"`
+	Audit   []AuditEntry            `json:"audit,omitempty"`
+	Inboxes map[string][]Message    `json:"inboxes,omitempty"`
+}
+
+type memoryConfig struct {
+	// empty not to persist
+	File string `json:"file"`
+	// like "30s", the file is only written on close if empty
+	FlushInterval string `json:"flushInterval"`
+	// the file is encrypted if set
+	Encryption *EncryptionConfig `json:"encryption"`
+}
+
+func init() {
+	MustRegister(ENGINE_MEMORY, newMemoryEngine)
+}
+
+func newMemoryEngine() StoreEngine {
+	return &memoryEngine{
+		servers: make(Servers),
+		users:   make(Users),
+		dns:     make(map[string][]Resolution),
+		inboxes: make(map[string][]Message),
+		stop:    make(chan struct{}),
+	}
+}
+
+func (m *memoryEngine) LoadConfig(config EngineConfig) error {
+	var c memoryConfig
+	if err := config.Decode(&c); err != nil {
+		return err
+	}
+	if c.FlushInterval != "" {
+		d, err := time.ParseDuration(c.FlushInterval)
+		if err != nil {
+			return fmt.Errorf("invalid flushInterval: %v", err)
+		}
+		if d <= 0 {
+			return fmt.Errorf("flushInterval should be positive")
+		}
+		if c.File == "" {
+			return fmt.Errorf("should config file to flush to")
+		}
+		m.flushInterval = d
+	}
+	m.file = c.File
+	if c.Encryption != nil && c.File == "" {
+		return fmt.Errorf("should config file to encrypt")
+	}
+	var err error
+	m.crypt, err = newCrypter(c.Encryption)
+	return err
+}
+
+// Init loads the file at first and returns a copy of the state, the flushing starts with it
+func (m *memoryEngine) Init() (Servers, Users, map[string]int64) {
+	m.start.Do(func() {
+		if err := m.load(); err != nil {
+			panic(fmt.Errorf("can not load %v: %v", m.file, err))
+		}
+		if m.flushInterval > 0 {
+			go m.flushLoop()
+		}
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	servers := make(Servers, len(m.servers))
+	for server, locations := range m.servers {
+		servers[server] = make(map[string][]PingRet, len(locations))
+		for location, prs := range locations {
+			servers[server][location] = append([]PingRet(nil), prs...)
+		}
+	}
+	users := make(Users, len(m.users))
+	allServers := make(map[string]int64)
+	for username, u := range m.users {
+		users[username] = u.copy()
+		for server := range u.MonitorServers {
+			allServers[server]++
+		}
+	}
+	return servers, users, allServers
+}
+
+func (m *memoryEngine) WriteUser(ctx context.Context, username string, u *User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users[username] = u.copy()
+	m.dirty = true
+	return nil
+}
+
+func (m *memoryEngine) BatchWritePingRets(ctx context.Context, server, location string, prs []PingRet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.servers[server] == nil {
+		m.servers[server] = make(map[string][]PingRet)
+	}
+	m.servers[server][location] = append(m.servers[server][location], prs...)
+	m.dirty = true
+	return nil
+}
+
+// WritePingRets replaces the series, see SeriesWriter
+func (m *memoryEngine) WritePingRets(ctx context.Context, server, location string, prs []PingRet) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.servers[server] == nil {
+		m.servers[server] = make(map[string][]PingRet)
+	}
+	m.servers[server][location] = append([]PingRet(nil), prs...)
+	m.dirty = true
+	return nil
+}
+
+// ReadPingRets returns a copy of the series, see SeriesReader
+func (m *memoryEngine) ReadPingRets(ctx context.Context, server, location string) ([]PingRet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]PingRet{}, m.servers[server][location]...), nil
+}
+
+func (m *memoryEngine) PurgeServer(ctx context.Context, server string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.servers, server)
+	delete(m.dns, server)
+	m.dirty = true
+	return nil
+}
+
+func (m *memoryEngine) DeleteUser(ctx context.Context, username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, username)
+	delete(m.inboxes, username)
+	m.dirty = true
+	return nil
+}
+
+func (m *memoryEngine) AppendAudit(ctx context.Context, e AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.audit = append(m.audit, e)
+	m.dirty = true
+	return nil
+}
+
+func (m *memoryEngine) ReadAudit() ([]AuditEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]AuditEntry(nil), m.audit...), nil
+}
+
+func (m *memoryEngine) WriteDNSHistory(ctx context.Context, server string, h []Resolution) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dns[server] = append([]Resolution(nil), h...)
+	m.dirty = true
+	return nil
+}
+
+func (m *memoryEngine) ReadDNSHistory() (map[string][]Resolution, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make(map[string][]Resolution, len(m.dns))
+	for server, h := range m.dns {
+		ret[server] = append([]Resolution(nil), h...)
+	}
+	return ret, nil
+}
+
+func (m *memoryEngine) WriteInboxes(ctx context.Context, inboxes map[string][]Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for username, ms := range inboxes {
+		if len(ms) == 0 {
+			delete(m.inboxes, username)
+		} else {
+			m.inboxes[username] = append([]Message(nil), ms...)
+		}
+	}
+	m.dirty = true
+	return nil
+}
+
+func (m *memoryEngine) ReadInboxes() (map[string][]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ret := make(map[string][]Message, len(m.inboxes))
+	for username, ms := range m.inboxes {
+		ret[username] = append([]Message(nil), ms...)
+	}
+	return ret, nil
+}
+
+// Close stops the flushing and flushes the writes since last flush
+func (m *memoryEngine) Close() error {
+	close(m.stop)
+	return m.flush()
+}
+
+// the file is written again by the current key
+func (m *memoryEngine) RotateKeys(ctx context.Context) (int, error) {
+	if m.crypt == nil {
+		return 0, fmt.Errorf("encryption is not configured")
+	}
+	if err := m.crypt.load(ctx); err != nil {
+		return 0, err
+	}
+	m.mu.Lock()
+	m.dirty = true
+	m.mu.Unlock()
+	return 1, m.flush()
+}
+
+func (m *memoryEngine) flushLoop() {
+	t := time.NewTicker(m.flushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			// retried on next tick
+			m.flush()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *memoryEngine) load() error {
+	if m.file == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(m.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if b, err = m.crypt.open(b); err != nil {
+		return err
+	}
+	var state memoryState
+	if err = json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	if state.Version > SCHEMA_VERSION {
+		return fmt.Errorf("state of schema version %v is newer than %v", state.Version, SCHEMA_VERSION)
+	}
+	if state.Users != nil {
+		m.users = state.Users
+	}
+	if state.Servers != nil {
+		m.servers = state.Servers
+	}
+	if state.DNS != nil {
+		m.dns = state.DNS
+	}
+	if state.Inboxes != nil {
+		m.inboxes = state.Inboxes
+	}
+	m.audit = state.Audit
+	return nil
+}
+
+// write and rename, so that the file is never partial
+func (m *memoryEngine) flush() error {
+	if m.file == "" {
+		return nil
+	}
+	m.mu.Lock()
+	if !m.dirty {
+		m.mu.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(memoryState{Version: SCHEMA_VERSION, Users: m.users, Servers: m.servers, DNS: m.dns, Audit: m.audit, Inboxes: m.inboxes})
+	m.dirty = false
+	m.mu.Unlock()
+	if err == nil {
+		if err = ioutil.WriteFile(m.file+_TMP_SUFFIX, m.crypt.seal(b), os.ModePerm); err == nil {
+			err = os.Rename(m.file+_TMP_SUFFIX, m.file)
+		}
+	}
+	if err != nil {
+		m.mu.Lock()
+		m.dirty = true
+		m.mu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// counters of the store, updated atomically
+type counters struct {
+	pingRetsAppended   int64
+	pingRetsDuplicated int64
+	pingRetsLate       int64
+	engineWrites       int64
+	engineWriteErrors  int64
+	engineWriteNanos   int64
+	engineWriteRetries int64
+	lockAcquires       int64
+	lockWaitNanos      int64
+	lockHoldNanos      int64
+
+	// unix nano of last engine write
+	lastWriteNanos     int64
+	lastWriteFailNanos int64
+}
+
+// Metrics is a snapshot of the counters and the state of the store
+type Metrics struct {
+	PingRetsAppended   int64
+	PingRetsDuplicated int64
+	PingRetsLate       int64
+	EngineWrites       int64
+	EngineWriteErrors  int64
+	EngineWriteTime    time.Duration
+	EngineWriteRetries int64
+	Breaker            BreakerStatus
+	Cache              CacheStats
+	LockAcquires       int64
+	LockWaitTime       time.Duration
+	LockHoldTime       time.Duration
+
+	Users             int
+	Servers           int
+	Locations         int
+	PingRets          int
+	AddServerChanLen  int
+	AddServerChanCap  int
+	KickServerChanLen int
+	KickServerChanCap int
+	// servers queued beyond the capacity of the chans
+	AddServerQueueLen  int
+	KickServerQueueLen int
+	ServerOverflows    int64
+}
+
+func (s *Store) Metrics() Metrics {
+	m := Metrics{
+		PingRetsAppended:   atomic.LoadInt64(&s.counters.pingRetsAppended),
+		PingRetsDuplicated: atomic.LoadInt64(&s.counters.pingRetsDuplicated),
+		PingRetsLate:       atomic.LoadInt64(&s.counters.pingRetsLate),
+		EngineWrites:       atomic.LoadInt64(&s.counters.engineWrites),
+		EngineWriteErrors:  atomic.LoadInt64(&s.counters.engineWriteErrors),
+		EngineWriteTime:    time.Duration(atomic.LoadInt64(&s.counters.engineWriteNanos)),
+		EngineWriteRetries: atomic.LoadInt64(&s.counters.engineWriteRetries),
+		Breaker:            s.BreakerStatus(),
+		Cache:              s.cache.stats(),
+		LockAcquires:       atomic.LoadInt64(&s.counters.lockAcquires),
+		LockWaitTime:       time.Duration(atomic.LoadInt64(&s.counters.lockWaitNanos)),
+		LockHoldTime:       time.Duration(atomic.LoadInt64(&s.counters.lockHoldNanos)),
+		AddServerChanLen:   len(s.AddServerChan),
+		AddServerChanCap:   cap(s.AddServerChan),
+		KickServerChanLen:  len(s.KickServerChan),
+		KickServerChanCap:  cap(s.KickServerChan),
+		AddServerQueueLen:  s.addQueue.len(),
+		KickServerQueueLen: s.kickQueue.len(),
+		ServerOverflows:    s.addQueue.overflowed() + s.kickQueue.overflowed(),
+	}
+	s.withReadLock(func() {
+		m.Users = len(s.users)
+		m.Servers = len(s.allServers)
+		for _, locations := range s.servers {
+			m.Locations += len(locations)
+			for _, series := range locations {
+				m.PingRets += series.Len()
+			}
+		}
+	})
+	return m
+}
+
+// time an attempt of the engine write and count the error
+// attrs are key value pairs describing the write in case it is slow
+func (s *Store) writeOnce(ctx context.Context, op string, f func(ctx context.Context) error, attrs ...interface{}) error {
+	start := time.Now()
+	err := ctx.Err()
+	if err == nil {
+		err = f(ctx)
+	}
+	d := time.Since(start)
+	atomic.AddInt64(&s.counters.engineWrites, 1)
+	atomic.AddInt64(&s.counters.engineWriteNanos, int64(d))
+	s.observeSlow(ctx, op, d, attrs...)
+	if err != nil {
+		atomic.AddInt64(&s.counters.engineWriteErrors, 1)
+		atomic.StoreInt64(&s.counters.lastWriteFailNanos, time.Now().UnixNano())
+	} else {
+		atomic.StoreInt64(&s.counters.lastWriteNanos, time.Now().UnixNano())
+	}
+	return err
+}
+
+// the change is fed to the replicas once written
+func (s *Store) writeUser(ctx context.Context, username string, u *User) error {
+	err := s.engineWrite(ctx, "StoreEngine.WriteUser", func(ctx context.Context) error {
+		return s.storeEngine.WriteUser(ctx, username, u)
+	}, "username", username)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "can not write user", "username", username, "error", err)
+		return err
+	}
+	s.feed.record(FeedEvent{Username: username, User: u.copy()})
+	return nil
+}
+
+func (s *Store) batchWritePingRets(ctx context.Context, server, location string, prs []PingRet) error {
+	err := s.engineWrite(ctx, "StoreEngine.BatchWritePingRets", func(ctx context.Context) error {
+		return s.storeEngine.BatchWritePingRets(ctx, server, location, prs)
+	}, "server", server, "location", location, "count", len(prs))
+	// buffered while read only
+	if err != nil && err != ErrorReadOnly {
+		s.logger.ErrorContext(ctx, "can not write ping results", "server", server, "location", location, "count", len(prs), "error", err)
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SCHEMA_VERSION is the version of the ping results written by the engines
+// bump it with a migration in pingRetMigrations when PingRet changes
+const SCHEMA_VERSION = 1
+
+// version -> upgrade a record of the version to the next version
+var pingRetMigrations = map[int]func(*pingRetRecord){
+	// records before versioning have the same fields
+	0: func(*pingRetRecord) {},
+}
+
+// engines persisting a schema version implement Migrator, the store migrates them before Init
+type Migrator interface {
+	// SchemaVersion returns the version of the data, 0 if the data is written before versioning
+	SchemaVersion() (int, error)
+	// Migrate upgrades the data from the version to SCHEMA_VERSION
+	Migrate(from int) error
+}
+
+func (s *Store) migrate() error {
+	m, ok := s.storeEngine.(Migrator)
+	if !ok {
+		return nil
+	}
+	v, err := m.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if v > SCHEMA_VERSION {
+		return fmt.Errorf("schema version %v of store engine is newer than %v", v, SCHEMA_VERSION)
+	}
+	if v == SCHEMA_VERSION {
+		return nil
+	}
+	s.logger.Info("migrating store engine", "from", v, "to", SCHEMA_VERSION)
+	return m.Migrate(v)
+}
+
+func (f *fileEngine) SchemaVersion() (int, error) {
+	b, err := ioutil.ReadFile(f.schemaFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(b)))
+}
+
+// rewrite every file of ping results in SCHEMA_VERSION, then the schema file
+func (f *fileEngine) Migrate(from int) error {
+	if err := f.notExistThenMkdir(f.serversDir); err != nil {
+		return err
+	}
+	err := filepath.Walk(f.serversDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || strings.HasSuffix(info.Name(), _TMP_SUFFIX) {
+			return err
+		}
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		buf := bytes.NewBuffer(make([]byte, 0, len(bs)))
+		for _, v := range bytes.Split(bs, []byte(_NEW_LINE)) {
+			if len(v) == 0 {
+				continue
+			}
+			pr, err := f.unmarshalPingRet(v)
+			if err != nil {
+				return fmt.Errorf("can not migrate %v: %v", path, err)
+			}
+			buf.Write(f.marshalPingRet(pr))
+		}
+		tmp := path + _TMP_SUFFIX
+		if err = ioutil.WriteFile(tmp, buf.Bytes(), os.ModePerm); err != nil {
+			return err
+		}
+		return os.Rename(tmp, path)
+	})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.schemaFile, []byte(strconv.Itoa(SCHEMA_VERSION)+_NEW_LINE), os.ModePerm)
+}
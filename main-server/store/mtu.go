@@ -0,0 +1,49 @@
+package store
+
+import "sort"
+
+// MTUChange is the path mtu of the location changed from From to To bytes at Time of the ping result, From is 0 of the first
+type MTUChange struct {
+	Location string `json:"location"`
+	Time     string `json:"time"`
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+}
+
+// GetMTUChanges returns the changes of the path mtu of the ping results of the mtu check of the server kept, the earliest first
+// the ping results down are skipped, they tell no mtu
+func (s *Store) GetMTUChanges(username, server string) (changes []MTUChange, err error) {
+	s.withReadLock(func() {
+		var locations map[string]Series
+		if locations, err = s.getMonitorResult(username, server); err != nil {
+			return
+		}
+		prs := make(map[string][]PingRet, len(locations))
+		for location, series := range locations {
+			prs[location] = series.All()
+		}
+		changes = mtuChanges(prs)
+	})
+	return
+}
+
+func mtuChanges(prs map[string][]PingRet) []MTUChange {
+	changes := make([]MTUChange, 0)
+	for location, ps := range prs {
+		last := 0
+		for _, pr := range ps {
+			if pr.MTU == 0 || pr.MTU == last {
+				continue
+			}
+			changes = append(changes, MTUChange{Location: location, Time: pr.Time, From: last, To: pr.MTU})
+			last = pr.MTU
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Time != changes[j].Time {
+			return changes[i].Time < changes[j].Time
+		}
+		return changes[i].Location < changes[j].Location
+	})
+	return changes
+}
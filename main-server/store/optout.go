@@ -0,0 +1,202 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// OptOut is a host or a network opted out of monitoring by the operator, on a complaint of the network probed
+// the servers it matched are kicked from the ping loop and never assigned again while it is registered,
+// they stay in the monitoring lists of the users
+type OptOut struct {
+	// an exact host, an address or a CIDR
+	Target  string    `json:"target"`
+	Reason  string    `json:"reason"`
+	Actor   string    `json:"actor"`
+	Created time.Time `json:"created"`
+	// the servers matched when it was added
+	Servers []string `json:"servers,omitempty"`
+}
+
+// engines persisting the opt-outs implement OptOutStore, they are kept in memory only otherwise
+type OptOutStore interface {
+	ReadOptOuts() ([]OptOut, error)
+	WriteOptOuts(optOuts []OptOut) error
+}
+
+// should be invoked before the store is used
+func (s *Store) loadOptOuts() {
+	s.optOuts = nil
+	if oo, ok := s.storeEngine.(OptOutStore); ok {
+		var err error
+		if s.optOuts, err = oo.ReadOptOuts(); err != nil {
+			s.logger.Warn("can not read the opt-outs", "error", err)
+		}
+	}
+	s.indexOptOuts()
+}
+
+// should be invoked with write lock held or before the store is used
+func (s *Store) indexOptOuts() {
+	s.optedOut = make(map[string]bool)
+	for _, o := range s.optOuts {
+		for _, server := range o.Servers {
+			s.optedOut[server] = true
+		}
+	}
+}
+
+// send the server to AddServerChan unless it opted out
+// should be invoked with lock held
+func (s *Store) assign(server string) {
+	if !s.optedOut[server] {
+		s.addQueue.send(server)
+	}
+}
+
+// should be invoked with write lock held
+func (s *Store) writeOptOuts() error {
+	if oo, ok := s.storeEngine.(OptOutStore); ok {
+		return oo.WriteOptOuts(s.optOuts)
+	}
+	return nil
+}
+
+// AddOptOut registers the opt-out and kicks the servers it matches at once
+// it replaces the one of the same target, keeping the servers that one matched
+// it is audited as requested by its actor, before anything changes
+func (s *Store) AddOptOut(ctx context.Context, o OptOut) (err error) {
+	if o.Target == "" {
+		return fmt.Errorf("target can not be empty")
+	}
+	if o.Created.IsZero() {
+		o.Created = time.Now()
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			if err = s.audit(ctx, AuditEntry{Actor: o.Actor, Action: AUDIT_OPT_OUT, Subject: o.Target, Detail: o.Reason}); err != nil {
+				return
+			}
+			prev := s.optOuts
+			servers := make(map[string]bool)
+			for _, old := range prev {
+				if old.Target == o.Target {
+					o.Servers = append(o.Servers, old.Servers...)
+				}
+			}
+			for _, server := range o.Servers {
+				servers[server] = true
+			}
+			o.Servers = make([]string, 0, len(servers))
+			for server := range servers {
+				o.Servers = append(o.Servers, server)
+			}
+			sort.Strings(o.Servers)
+			s.optOuts = append(removeOptOut(s.optOuts, o.Target), o)
+			sort.Slice(s.optOuts, func(i, j int) bool { return s.optOuts[i].Target < s.optOuts[j].Target })
+			if err = s.writeOptOuts(); err != nil {
+				s.optOuts = prev
+				return
+			}
+			s.reassign()
+		})
+		if err == nil {
+			err = s.writeAssignments()
+		}
+	})
+	return
+}
+
+// RemoveOptOut removes the opt-out of the target, the servers it matched are assigned again unless another one matches them
+func (s *Store) RemoveOptOut(ctx context.Context, target, actor string) (err error) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			rest := removeOptOut(s.optOuts, target)
+			if len(rest) == len(s.optOuts) {
+				err = fmt.Errorf("%v did not opt out", target)
+				return
+			}
+			if err = s.audit(ctx, AuditEntry{Actor: actor, Action: AUDIT_OPT_OUT_REMOVED, Subject: target}); err != nil {
+				return
+			}
+			prev := s.optOuts
+			if s.optOuts = rest; len(s.optOuts) == 0 {
+				s.optOuts = nil
+			}
+			if err = s.writeOptOuts(); err != nil {
+				s.optOuts = prev
+				return
+			}
+			s.reassign()
+		})
+		if err == nil {
+			err = s.writeAssignments()
+		}
+	})
+	return
+}
+
+// reindex the opt-outs, the monitored servers opting out are sent to KickServerChan and those opting in to AddServerChan
+// should be invoked with write lock held
+func (s *Store) reassign() {
+	before := s.optedOut
+	s.indexOptOuts()
+	for server := range s.allServers {
+		switch {
+		case s.optedOut[server] && !before[server]:
+			s.kickQueue.send(server)
+		case !s.optedOut[server] && before[server]:
+			s.addQueue.send(server)
+		}
+	}
+}
+
+func removeOptOut(optOuts []OptOut, target string) []OptOut {
+	ret := make([]OptOut, 0, len(optOuts))
+	for _, o := range optOuts {
+		if o.Target != target {
+			ret = append(ret, o)
+		}
+	}
+	return ret
+}
+
+// GetOptOuts returns the opt-outs by target
+func (s *Store) GetOptOuts() (ret []OptOut) {
+	s.withReadLock(func() {
+		ret = append([]OptOut{}, s.optOuts...)
+	})
+	return
+}
+
+func (f *fileEngine) optOutsFile() string { return filepath.Clean(f.serversDir) + ".optouts" }
+
+func (f *fileEngine) ReadOptOuts() (optOuts []OptOut, err error) {
+	b, err := ioutil.ReadFile(f.optOutsFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &optOuts)
+	return
+}
+
+// write and rename like the assignments
+func (f *fileEngine) WriteOptOuts(optOuts []OptOut) error {
+	b, err := json.Marshal(optOuts)
+	if err != nil {
+		return err
+	}
+	path := f.optOutsFile()
+	if err = ioutil.WriteFile(path+_TMP_SUFFIX, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+_TMP_SUFFIX, path)
+}
@@ -0,0 +1,52 @@
+package store
+
+import "fmt"
+
+const _DEFAULT_SPARKLINE_POINTS = 30
+
+// Overview is the latest status of a server
+// Sparkline holds the last points of each location, the last one is the latest
+type Overview struct {
+	Sparkline map[string][]PingRet `json:"sparkline"`
+	// see GetStatus
+	Status string `json:"status"`
+}
+
+// Latest returns the latest ping result of each location
+func (o Overview) Latest() map[string]PingRet {
+	ret := make(map[string]PingRet, len(o.Sparkline))
+	for location, prs := range o.Sparkline {
+		if len(prs) > 0 {
+			ret[location] = prs[len(prs)-1]
+		}
+	}
+	return ret
+}
+
+// getOverview returns the overview of all servers monitored by the user in one read
+func (s *Store) getOverview(username string, points int) (ret map[string]Overview, err error) {
+	if points <= 0 {
+		points = _DEFAULT_SPARKLINE_POINTS
+	}
+	s.withReadLock(func() {
+		u, ok := s.users[username]
+		if !ok {
+			err = fmt.Errorf("User %v not exist", username)
+			return
+		}
+		ret = make(map[string]Overview, len(u.MonitorServers))
+		for server := range u.MonitorServers {
+			locations := s.visible(username, server)
+			o := Overview{Sparkline: make(map[string][]PingRet, len(locations)), Status: s.serverStatus(server).Status}
+			for location, series := range locations {
+				start := series.Len() - points
+				if start < 0 {
+					start = 0
+				}
+				o.Sparkline[location] = series.PingRets(start, series.Len())
+			}
+			ret[server] = o
+		}
+	})
+	return
+}
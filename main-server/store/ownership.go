@@ -0,0 +1,117 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Claim is the claim of a user to own a host, proven by publishing the token, see target.Verifier
+// a verified claim of a domain covers its subdomains
+type Claim struct {
+	Token    string    `json:"token"`
+	Created  time.Time `json:"created"`
+	Verified time.Time `json:"verified"`
+	// how the token was found, like dns or http
+	Method string `json:"method,omitempty"`
+}
+
+func (c Claim) IsVerified() bool { return !c.Verified.IsZero() }
+
+func claimHost(host string) string { return strings.ToLower(strings.TrimSuffix(host, ".")) }
+
+// ClaimHost returns the claim of the user of the host, a new one with a random token if the user has none
+func (s *Store) ClaimHost(ctx context.Context, username, host string) (c Claim, err error) {
+	if host = claimHost(host); host == "" {
+		return c, fmt.Errorf("host can not be empty")
+	}
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			if u, ok := s.users[username]; ok {
+				if old, ok := u.Claims[host]; ok {
+					c = old
+					return
+				}
+			}
+			c = Claim{Token: hex.EncodeToString(b), Created: time.Now()}
+			err = s.updateUser(ctx, username, func(u *User) error {
+				if u.Claims == nil {
+					u.Claims = make(map[string]Claim)
+				}
+				u.Claims[host] = c
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// VerifyClaim marks the claim of the user of the host verified by the method
+func (s *Store) VerifyClaim(ctx context.Context, username, host, method string) (err error) {
+	host = claimHost(host)
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				c, ok := u.Claims[host]
+				if !ok {
+					return fmt.Errorf("%v is not claimed", host)
+				}
+				c.Verified, c.Method = time.Now(), method
+				u.Claims[host] = c
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// GetClaims returns the claims of the user by host
+func (s *Store) GetClaims(username string) (ret map[string]Claim, err error) {
+	s.withReadLock(func() {
+		u, ok := s.users[username]
+		if !ok {
+			err = fmt.Errorf("User %v not exist", username)
+			return
+		}
+		ret = make(map[string]Claim, len(u.Claims))
+		for host, c := range u.Claims {
+			ret[host] = c
+		}
+	})
+	return
+}
+
+// OwnershipVerified returns true if the user, or a member of its organization, verified the claim of the host or of a domain of it
+func (s *Store) OwnershipVerified(username, host string) (ok bool) {
+	host = claimHost(host)
+	s.withReadLock(func() {
+		u, exist := s.users[username]
+		if !exist {
+			return
+		}
+		members := []string{username}
+		if u.Organization != "" {
+			members = s.organizations[u.Organization]
+		}
+		for _, member := range members {
+			m, exist := s.users[member]
+			if !exist {
+				continue
+			}
+			for claimed, c := range m.Claims {
+				if c.IsVerified() && (host == claimed || strings.HasSuffix(host, "."+claimed)) {
+					ok = true
+					return
+				}
+			}
+		}
+	})
+	return
+}
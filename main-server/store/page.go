@@ -0,0 +1,79 @@
+package store
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+)
+
+const _MAX_PAGE_SIZE = 1 << 10
+
+// ResultPage is a bounded part of the monitor result
+// Total is the number of ping results of each location
+// NextCursor is empty if there is no more ping result after this page
+type ResultPage struct {
+	Results    map[string][]PingRet `json:"results"`
+	Total      map[string]int       `json:"total"`
+	NextCursor string               `json:"next_cursor"`
+	// the annotations of the period of the page
+	Annotations []Annotation `json:"annotations"`
+}
+
+// GetMonitorResultPage returns at most limit ping results of each location after the cursor
+// an empty cursor starts from the earliest ping result
+func (s *Store) GetMonitorResultPage(username, server, cursor string, limit int) (page ResultPage, err error) {
+	if limit <= 0 || limit > _MAX_PAGE_SIZE {
+		limit = _MAX_PAGE_SIZE
+	}
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		return
+	}
+	s.withReadLock(func() {
+		var ret map[string]Series
+		if ret, err = s.getMonitorResult(username, server); err != nil {
+			return
+		}
+		page.Results = make(map[string][]PingRet, len(ret))
+		page.Total = make(map[string]int, len(ret))
+		var last string
+		for location, series := range ret {
+			n := series.Len()
+			page.Total[location] = n
+			start := sort.Search(n, func(i int) bool { return series.TimeAt(i) > after })
+			end := start + limit
+			if end > n {
+				end = n
+			}
+			page.Results[location] = series.PingRets(start, end)
+			if end < n && (last == "" || series.TimeAt(end-1) < last) {
+				last = series.TimeAt(end - 1)
+			}
+		}
+		if last != "" {
+			page.NextCursor = encodeCursor(last)
+			// locations may go further than the cursor, cut them to keep the pages aligned
+			for location, prs := range page.Results {
+				page.Results[location] = prs[:sort.Search(len(prs), func(i int) bool { return prs[i].Time > last })]
+			}
+		}
+		// the cursor of the previous page is exclusive
+		page.Annotations = make([]Annotation, 0)
+		for _, a := range s.annotations(username, server, after, last) {
+			if a.Time > after || a.End > after {
+				page.Annotations = append(page.Annotations, a)
+			}
+		}
+	})
+	return
+}
+
+func encodeCursor(t string) string { return base64.URLEncoding.EncodeToString([]byte(t)) }
+
+func decodeCursor(cursor string) (string, error) {
+	b, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("invalid cursor %v", cursor)
+	}
+	return string(b), nil
+}
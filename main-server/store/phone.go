@@ -0,0 +1,246 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+)
+
+const (
+	// the code sent to verify a phone expires after it
+	_PHONE_CODE_TTL = 10 * time.Minute
+	// another code is sent to the phone after it at the earliest, so that nobody floods a phone by the verification
+	_PHONE_CODE_INTERVAL = time.Minute
+	// the wrong codes tried before the code is invalidated
+	_PHONE_CODE_ATTEMPTS = 5
+	// the phones a user verifies at once, so that nobody sends the codes to many phones by one user
+	_MAX_PENDING_PHONES = 3
+	// the codes sent to the phones of a user within the hour, and to those of all the users by default, see SetPhoneCodeLimit
+	_PHONE_CODES_PER_USER = 5
+	_PHONE_CODES          = 100
+)
+
+// Phone is a phone of a user, the sms channels send the alerts only to the phones the user verified by the code sent to it
+type Phone struct {
+	// sha256 of the code sent, empty once verified
+	Code     string    `json:"code,omitempty"`
+	Sent     time.Time `json:"sent"`
+	Attempts int       `json:"attempts,omitempty"`
+	Verified time.Time `json:"verified"`
+}
+
+func (p Phone) IsVerified() bool { return !p.Verified.IsZero() }
+
+// the code not verified within the ttl is dropped
+func (p Phone) stale(now time.Time) bool { return !p.IsVerified() && now.Sub(p.Sent) > _PHONE_CODE_TTL }
+
+// SetPhoneCodeLimit caps the codes sent to the phones of all the users within the hour, 100 by default
+func (s *Store) SetPhoneCodeLimit(n int) *Store {
+	s.withWriteLock(func() { s.phoneCodeLimit = n })
+	return s
+}
+
+// the phones of the user without the stale ones, the phones are replaced rather than modified, see User.copy
+func phonesOf(u *User, now time.Time) map[string]Phone {
+	phones := make(map[string]Phone, len(u.Phones)+1)
+	for p, v := range u.Phones {
+		if !v.stale(now) {
+			phones[p] = v
+		}
+	}
+	return phones
+}
+
+// the times within the hour
+func withinHour(sent []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(sent) && now.Sub(sent[i]) >= time.Hour {
+		i++
+	}
+	return sent[i:len(sent):len(sent)]
+}
+
+func phoneCode(code string) string {
+	h := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(h[:])
+}
+
+// RequestPhoneVerification returns a new code of 6 digits for the user to verify the phone by, to be sent to the phone
+func (s *Store) RequestPhoneVerification(ctx context.Context, username, phone string) (code string, err error) {
+	if phone, err = alert.NormalizePhone(phone); err != nil {
+		return
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(1e6))
+	if err != nil {
+		return
+	}
+	code = fmt.Sprintf("%06d", n.Int64())
+	now := time.Now()
+	s.do(func() {
+		s.withWriteLock(func() {
+			limit := s.phoneCodeLimit
+			if limit <= 0 {
+				limit = _PHONE_CODES
+			}
+			if s.phoneCodes = withinHour(s.phoneCodes, now); len(s.phoneCodes) >= limit {
+				err = fmt.Errorf("too many codes sent, retry later")
+				return
+			}
+			err = s.updateUser(ctx, username, func(u *User) error {
+				phones := phonesOf(u, now)
+				old, ok := phones[phone]
+				if old.IsVerified() {
+					return fmt.Errorf("phone %v is already verified", phone)
+				}
+				if now.Sub(old.Sent) < _PHONE_CODE_INTERVAL {
+					return fmt.Errorf("a code was sent to %v in the last minute", phone)
+				}
+				if !ok {
+					pending := 0
+					for _, v := range phones {
+						if !v.IsVerified() {
+							pending++
+						}
+					}
+					if pending >= _MAX_PENDING_PHONES {
+						return fmt.Errorf("verify the phones pending before %v", phone)
+					}
+				}
+				sent := withinHour(u.PhoneCodes, now)
+				if len(sent) >= _PHONE_CODES_PER_USER {
+					return fmt.Errorf("too many codes sent, retry later")
+				}
+				phones[phone] = Phone{Code: phoneCode(code), Sent: now}
+				u.Phones, u.PhoneCodes = phones, append(sent, now)
+				return nil
+			})
+			if err == nil {
+				s.phoneCodes = append(s.phoneCodes, now)
+			}
+		})
+	})
+	if err != nil {
+		code = ""
+	}
+	return
+}
+
+// VerifyPhone marks the phone of the user verified if the code is the one sent to it
+func (s *Store) VerifyPhone(ctx context.Context, username, phone, code string) (err error) {
+	if phone, err = alert.NormalizePhone(phone); err != nil {
+		return
+	}
+	now := time.Now()
+	s.do(func() {
+		s.withWriteLock(func() {
+			var wrong bool
+			err = s.updateUser(ctx, username, func(u *User) error {
+				p, ok := u.Phones[phone]
+				if !ok || p.IsVerified() || p.Code == "" {
+					return fmt.Errorf("no code was sent to %v", phone)
+				}
+				if now.Sub(p.Sent) > _PHONE_CODE_TTL || p.Attempts >= _PHONE_CODE_ATTEMPTS {
+					return fmt.Errorf("the code sent to %v expired", phone)
+				}
+				if subtle.ConstantTimeCompare([]byte(p.Code), []byte(phoneCode(code))) != 1 {
+					// the attempt is recorded, the write is not aborted
+					p.Attempts++
+					wrong = true
+				} else {
+					p.Code, p.Attempts, p.Verified = "", 0, now
+				}
+				phones := phonesOf(u, now)
+				phones[phone] = p
+				u.Phones = phones
+				return nil
+			})
+			if err == nil && wrong {
+				err = fmt.Errorf("wrong code of %v", phone)
+			}
+		})
+	})
+	return
+}
+
+// CancelPhoneVerification drops the code of the phone not verified, once it can not be sent to the phone
+// the code is still counted by the limits of the codes sent
+func (s *Store) CancelPhoneVerification(ctx context.Context, username, phone string) (err error) {
+	if phone, err = alert.NormalizePhone(phone); err != nil {
+		return
+	}
+	now := time.Now()
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				phones := phonesOf(u, now)
+				if p, ok := phones[phone]; !ok || p.IsVerified() {
+					return fmt.Errorf("no code was sent to %v", phone)
+				}
+				delete(phones, phone)
+				u.Phones = phones
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// GetPhones returns the phones of the user and since when they are verified, without the codes sent
+func (s *Store) GetPhones(username string) (ret map[string]Phone, err error) {
+	s.withReadLock(func() {
+		u, ok := s.users[username]
+		if !ok {
+			err = fmt.Errorf("User %v not exist", username)
+			return
+		}
+		ret = phonesOf(u, time.Now())
+		for phone, p := range ret {
+			p.Code = ""
+			ret[phone] = p
+		}
+	})
+	return
+}
+
+// DeletePhone removes the phone of the user, the sms channels of it are removed as well
+func (s *Store) DeletePhone(ctx context.Context, username, phone string) (err error) {
+	if phone, err = alert.NormalizePhone(phone); err != nil {
+		return
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				if _, ok := u.Phones[phone]; !ok {
+					return fmt.Errorf("phone %v not exist", phone)
+				}
+				phones := phonesOf(u, time.Now())
+				delete(phones, phone)
+				u.Phones = phones
+				channels := make([]alert.Channel, 0, len(u.Channels))
+				for _, c := range u.Channels {
+					if !smsTo(c, phone) {
+						channels = append(channels, c)
+					}
+				}
+				u.Channels = channels
+				return nil
+			})
+		})
+	})
+	return
+}
+
+func smsTo(c alert.Channel, phone string) bool {
+	if c.Type != alert.CHANNEL_SMS {
+		return false
+	}
+	p, err := alert.NormalizePhone(c.Config["phone"])
+	return err == nil && p == phone
+}
@@ -0,0 +1,190 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// engines able to delete data implement Purger, required by PurgeServerData and PurgeUserData
+type Purger interface {
+	// PurgeServer removes the ping results, the aggregates and the dns history of the server
+	PurgeServer(ctx context.Context, server string) error
+	// DeleteUser removes the user and its inbox
+	DeleteUser(ctx context.Context, username string) error
+}
+
+// PurgeServerData irreversibly removes the server from the monitoring lists of all the users
+// and its ping results, aggregates and dns history from memory, the engine and the cold tier
+// the purge is audited as requested by the actor, before anything is removed
+// the purge fails rather than being buffered while the breaker of the engine is open, see unbuffered
+func (s *Store) PurgeServerData(ctx context.Context, server, actor string) (err error) {
+	ctx = unbuffered(ctx)
+	p, ok := s.storeEngine.(Purger)
+	if !ok {
+		return fmt.Errorf("store engine can not purge data")
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			if err = s.audit(ctx, AuditEntry{Actor: actor, Action: AUDIT_PURGE_SERVER, Subject: server}); err != nil {
+				return
+			}
+			for username, u := range s.users {
+				if !u.MonitorServers[server] {
+					continue
+				}
+				if err = s.updateUser(ctx, username, func(u *User) error {
+					forgetServer(u, server)
+					return nil
+				}); err != nil {
+					return
+				}
+			}
+			err = s.purgeServer(ctx, p, server)
+		})
+	})
+	return
+}
+
+// PurgeUserData irreversibly removes the user, and the data of the servers nobody else monitors like PurgeServerData
+// the usage and the external ids of the user are forgotten as well
+func (s *Store) PurgeUserData(ctx context.Context, username, actor string) (err error) {
+	ctx = unbuffered(ctx)
+	p, ok := s.storeEngine.(Purger)
+	if !ok {
+		return fmt.Errorf("store engine can not purge data")
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			u, ok := s.users[username]
+			if !ok {
+				err = fmt.Errorf("User %v not exist", username)
+				return
+			}
+			if err = s.audit(ctx, AuditEntry{Actor: actor, Action: AUDIT_PURGE_USER, Subject: username}); err != nil {
+				return
+			}
+			// the user is gone first, a failure in the middle leaves data of servers nobody monitors, purged again by PurgeServerData
+			if err = s.engineWrite(ctx, "StoreEngine.DeleteUser", func(ctx context.Context) error {
+				return p.DeleteUser(ctx, username)
+			}, "username", username); err != nil {
+				return
+			}
+			delete(s.users, username)
+			delete(s.inboxes, username)
+			for key, un := range s.externalIds {
+				if un == username {
+					delete(s.externalIds, key)
+				}
+			}
+			s.feed.record(FeedEvent{Username: username, Purged: true})
+			s.usage.rwl.Lock()
+			delete(s.usage.m, username)
+			s.usage.rwl.Unlock()
+			for server := range u.MonitorServers {
+				if s.allServers[server]--; s.allServers[server] > 0 {
+					continue
+				}
+				if err = s.purgeServer(ctx, p, server); err != nil {
+					return
+				}
+			}
+		})
+	})
+	return
+}
+
+// remove the server the users no longer monitor from memory, the engine and the cold tier
+// should be invoked with write lock held
+func (s *Store) purgeServer(ctx context.Context, p Purger, server string) error {
+	if err := s.engineWrite(ctx, "StoreEngine.PurgeServer", func(ctx context.Context) error {
+		return p.PurgeServer(ctx, server)
+	}, "server", server); err != nil {
+		return err
+	}
+	if _, ok := s.allServers[server]; ok {
+		s.kickQueue.send(server)
+	}
+	s.forgetServerData(server)
+	s.feed.record(FeedEvent{Server: server, Purged: true})
+	if s.tiers.Cold == nil {
+		return nil
+	}
+	keys, err := s.tiers.Cold.List(ctx, fmt.Sprintf("%v%v/", _COLD_AGGREGATES_PREFIX, serverFileName(server)))
+	if err != nil {
+		return fmt.Errorf("can not list archived aggregates of %v: %v", server, err)
+	}
+	for _, key := range keys {
+		if err = s.tiers.Cold.Delete(ctx, key); err != nil {
+			return fmt.Errorf("can not delete archived aggregates %v: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// should be invoked with write lock held
+func (s *Store) forgetServerData(server string) {
+	delete(s.allServers, server)
+	delete(s.servers, server)
+	delete(s.aggregates, server)
+	delete(s.dns, server)
+	delete(s.status, server)
+}
+
+// remove the server and what the user set of it
+func forgetServer(u *User, server string) {
+	delete(u.MonitorServers, server)
+	delete(u.Labels, server)
+	delete(u.Dependencies, server)
+	delete(u.IngestTokens, server)
+	delete(u.Heartbeats, server)
+	delete(u.Annotations, server)
+	delete(u.Intervals, server)
+	delete(u.Transactions, server)
+	if len(u.SLOs) > 0 {
+		slos := make([]SLO, 0, len(u.SLOs))
+		for _, o := range u.SLOs {
+			if o.Server != server {
+				slos = append(slos, o)
+			}
+		}
+		u.SLOs = slos
+	}
+	for child, parent := range u.Dependencies {
+		if parent == server {
+			delete(u.Dependencies, child)
+		}
+	}
+}
+
+func (f *fileEngine) PurgeServer(ctx context.Context, server string) error {
+	for _, path := range []string{
+		f.getServerDir(server),
+		filepath.Join(f.aggregatesDir, serverFileName(server)),
+		f.getDNSFilePath(server),
+	} {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fileEngine) DeleteUser(ctx context.Context, username string) error {
+	path := f.getUserFilePath(username)
+	// left by a repair or an interrupted write, they hold the data of the user as well
+	for _, p := range []string{path, path + _TMP_SUFFIX, path + _CORRUPT_SUFFIX, f.getInboxFilePath(username)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *dirObjectStore) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(d.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
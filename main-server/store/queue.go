@@ -0,0 +1,76 @@
+package store
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// serverQueue sends the servers to the chan without blocking the sender, which holds the write lock of the store
+// servers exceeding the capacity of the chan queue up in memory and are sent in order by a pump goroutine
+type serverQueue struct {
+	ch      chan string
+	mu      sync.Mutex
+	queue   []string
+	pumping bool
+	// servers which did not fit in the chan
+	overflows int64
+}
+
+func newServerQueue(ch chan string) *serverQueue { return &serverQueue{ch: ch} }
+
+func (q *serverQueue) send(server string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	// the chan is only written directly if nothing is queued, so that the servers keep their order
+	if len(q.queue) == 0 {
+		select {
+		case q.ch <- server:
+			return
+		default:
+		}
+	}
+	q.queue = append(q.queue, server)
+	atomic.AddInt64(&q.overflows, 1)
+	if !q.pumping {
+		q.pumping = true
+		go q.pump()
+	}
+}
+
+func (q *serverQueue) pump() {
+	for {
+		q.mu.Lock()
+		if len(q.queue) == 0 {
+			q.pumping = false
+			q.mu.Unlock()
+			return
+		}
+		server := q.queue[0]
+		q.mu.Unlock()
+
+		// the head stays queued until received, so that senders meanwhile queue up behind it
+		q.ch <- server
+
+		q.mu.Lock()
+		q.queue[0] = ""
+		q.queue = q.queue[1:]
+		q.mu.Unlock()
+	}
+}
+
+// len returns the servers queued beyond the capacity of the chan
+func (q *serverQueue) len() int {
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queue)
+}
+
+func (q *serverQueue) overflowed() int64 {
+	if q == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&q.overflows)
+}
@@ -0,0 +1,528 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	ENGINE_RAFT = "raft"
+
+	_RAFT_DEFAULT_TIMEOUT = time.Second
+	_RAFT_MIN_TIMEOUT     = 10 * time.Millisecond
+	// a write waits that many election timeouts at most if its context has no deadline
+	_RAFT_WRITE_TIMEOUTS = 10
+	// the interval a write is retried at while the cluster has no leader
+	_RAFT_RETRY_INTERVAL = 10 * time.Millisecond
+	// the connections kept to every peer by the transport
+	_RAFT_MAX_POOL = 3
+	// the snapshots kept, the older ones hold the writes purged since
+	_RAFT_SNAPSHOTS_RETAINED = 1
+)
+
+var errRaftNoLeader = errors.New("no raft leader is elected")
+
+// raftEngine replicates the writes between the main servers of a cluster, 3 or 5 of them, by hashicorp/raft
+// every node applies the writes committed to a bolt database in its dir, which Init and the reads read,
+// so that a majority of the nodes keeps the state without any external database
+// a write to a node not leading is forwarded to the leader, it returns once the node applied it
+// the main server of the leading node leads the main servers, see Leaser
+type raftEngine struct {
+	conf             raftConfig
+	timeout          time.Duration
+	snapshotInterval time.Duration
+
+	start  sync.Once
+	logger hclog.Logger
+	raft   *raft.Raft
+	state  *raftState
+	logs   *raftLogStore
+	// nil of a single node, which serves no other node
+	stream    *raftStream
+	transport io.Closer
+	// closed once raft is set, the writes forwarded wait for it
+	ready chan struct{}
+
+	closeOnce sync.Once
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// the config of the raft engine, the same on every node but the id
+// the nodes are the peers the cluster is bootstrapped with, a node replacing another keeps its id and address
+type raftConfig struct {
+	Id string `json:"id"`
+	// id -> address the nodes reach the node by, like 10.0.0.1:8795, the node itself included
+	Peers map[string]string `json:"peers"`
+	// the node serves the others on it, the port of its address by default, nothing is served by a single node
+	Listen string `json:"listen"`
+	// the log, the snapshots and the state of the node
+	Dir string `json:"dir"`
+	// like "1s", a follower hearing of no leader for it starts an election
+	ElectionTimeout string `json:"electionTimeout"`
+	// the nodes authenticate each other by it
+	Secret string `json:"secret"`
+	// a node snapshots its state once that many writes are applied since its last snapshot, checked every snapshotInterval,
+	// and drops the entries of the log before the snapshot but the trailingLogs last, see raft.Config
+	// the followers too far behind are sent the snapshot, so that no node keeps the others from compacting
+	SnapshotThreshold uint64 `json:"snapshotThreshold"`
+	SnapshotInterval  string `json:"snapshotInterval"`
+	TrailingLogs      uint64 `json:"trailingLogs"`
+}
+
+func init() {
+	MustRegister(ENGINE_RAFT, newRaftEngine)
+}
+
+func newRaftEngine() StoreEngine {
+	return &raftEngine{timeout: _RAFT_DEFAULT_TIMEOUT, ready: make(chan struct{}), stop: make(chan struct{})}
+}
+
+func (r *raftEngine) LoadConfig(config EngineConfig) error {
+	var c raftConfig
+	if err := config.Decode(&c); err != nil {
+		return err
+	}
+	if c.Id == "" || c.Peers[c.Id] == "" {
+		return fmt.Errorf("should config id, one of the peers")
+	}
+	for id, peer := range c.Peers {
+		if len(id) > 0xff {
+			return fmt.Errorf("id of peer %v is too long", id)
+		}
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			return fmt.Errorf("invalid address of peer %v: %v", id, peer)
+		}
+	}
+	if len(c.Peers) > 1 && c.Secret == "" {
+		return fmt.Errorf("should config the secret of the peers")
+	}
+	if c.Dir == "" {
+		return fmt.Errorf("should config dir")
+	}
+	for _, d := range []struct {
+		name, v string
+		d       *time.Duration
+	}{{"electionTimeout", c.ElectionTimeout, &r.timeout}, {"snapshotInterval", c.SnapshotInterval, &r.snapshotInterval}} {
+		if d.v == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.v)
+		if err != nil {
+			return fmt.Errorf("invalid %v: %v", d.name, err)
+		}
+		if v < _RAFT_MIN_TIMEOUT {
+			return fmt.Errorf("%v should be %v at least", d.name, _RAFT_MIN_TIMEOUT)
+		}
+		*d.d = v
+	}
+	if c.Listen == "" {
+		_, port, _ := net.SplitHostPort(c.Peers[c.Id])
+		c.Listen = ":" + port
+	}
+	r.conf = c
+	return nil
+}
+
+// Init starts the node once, and reads the writes it applied
+func (r *raftEngine) Init() (Servers, Users, map[string]int64) {
+	r.start.Do(func() {
+		if err := r.open(); err != nil {
+			panic(fmt.Errorf("can not start raft node %v: %v", r.conf.Id, err))
+		}
+	})
+	servers, users, allServers, err := r.state.read()
+	if err != nil {
+		panic(fmt.Errorf("can not read raft state: %v", err))
+	}
+	return servers, users, allServers
+}
+
+// open opens the state, the log and the snapshots in the dir and starts the node,
+// the cluster is bootstrapped with the peers by every node starting on an empty dir
+func (r *raftEngine) open() (err error) {
+	var closers []io.Closer
+	defer func() {
+		if err != nil {
+			for i := len(closers) - 1; i >= 0; i-- {
+				closers[i].Close()
+			}
+		}
+	}()
+	if err = os.MkdirAll(r.conf.Dir, 0700); err != nil {
+		return err
+	}
+	// the warnings of raft are logged by the default logger
+	r.logger = hclog.New(&hclog.LoggerOptions{
+		Name: "raft", Level: hclog.Warn, DisableTime: true,
+		Output: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn).Writer(),
+	}).With("node", r.conf.Id)
+	if r.state, err = openRaftState(filepath.Join(r.conf.Dir, "state.db")); err != nil {
+		return err
+	}
+	closers = append(closers, r.state)
+	if r.logs, err = openRaftLogStore(filepath.Join(r.conf.Dir, "raft.db")); err != nil {
+		return err
+	}
+	closers = append(closers, r.logs)
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(r.conf.Dir, _RAFT_SNAPSHOTS_RETAINED, r.logger)
+	if err != nil {
+		return err
+	}
+
+	addr := raft.ServerAddress(r.conf.Peers[r.conf.Id])
+	var transport raft.Transport
+	if len(r.conf.Peers) == 1 {
+		_, t := raft.NewInmemTransport(addr)
+		transport, r.transport = t, t
+	} else {
+		if r.stream, err = listenRaftStream(r.conf.Listen, string(addr), r.conf.Id, r.conf.Secret, r.timeout, r.serveForward); err != nil {
+			return err
+		}
+		t := raft.NewNetworkTransportWithConfig(&raft.NetworkTransportConfig{
+			Stream: r.stream, MaxPool: _RAFT_MAX_POOL, Timeout: _RAFT_WRITE_TIMEOUTS * r.timeout, Logger: r.logger,
+		})
+		transport, r.transport = t, t
+	}
+	closers = append(closers, r.transport)
+
+	c := raft.DefaultConfig()
+	c.LocalID = raft.ServerID(r.conf.Id)
+	c.HeartbeatTimeout, c.ElectionTimeout, c.LeaderLeaseTimeout = r.timeout, r.timeout, r.timeout/2
+	if r.snapshotInterval > 0 {
+		c.SnapshotInterval = r.snapshotInterval
+	}
+	if r.conf.SnapshotThreshold > 0 {
+		c.SnapshotThreshold = r.conf.SnapshotThreshold
+	}
+	if r.conf.TrailingLogs > 0 {
+		c.TrailingLogs = r.conf.TrailingLogs
+	}
+	// the state is durable up to the index it applied, see raftState
+	c.NoSnapshotRestoreOnStart = true
+	c.BatchApplyCh = true
+	c.Logger = r.logger
+
+	exist, err := raft.HasExistingState(r.logs, r.logs, snaps)
+	if err != nil {
+		return err
+	}
+	if r.raft, err = raft.NewRaft(c, r.state, r.logs, r.logs, snaps, transport); err != nil {
+		return err
+	}
+	close(r.ready)
+	if !exist {
+		var servers []raft.Server
+		for id, peer := range r.conf.Peers {
+			servers = append(servers, raft.Server{ID: raft.ServerID(id), Address: raft.ServerAddress(peer)})
+		}
+		if err = r.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil {
+			r.raft.Shutdown()
+			return err
+		}
+	}
+	r.wg.Add(1)
+	go r.compactLoop()
+	return nil
+}
+
+// a node compacts its log once it applied a purge, so that no entry and no snapshot keeps the writes purged
+func (r *raftEngine) compactLoop() {
+	defer r.wg.Done()
+	for {
+		select {
+		case <-r.state.purged:
+			if err := r.compact(); err != nil {
+				r.logger.Warn("can not compact the log", "error", err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// compact snapshots the state and drops the entries of the log before it, with no trailing entries kept
+func (r *raftEngine) compact() error {
+	rc := r.raft.ReloadableConfig()
+	trailing := rc.TrailingLogs
+	rc.TrailingLogs = 0
+	if err := r.raft.ReloadConfig(rc); err != nil {
+		return err
+	}
+	defer func() {
+		rc.TrailingLogs = trailing
+		r.raft.ReloadConfig(rc)
+	}()
+	if err := r.raft.Snapshot().Error(); err != nil && err != raft.ErrNothingNewToSnapshot {
+		return err
+	}
+	return nil
+}
+
+// propose writes the command by the leader, the writes are retried while the cluster has no leader
+func (r *raftEngine) propose(ctx context.Context, c raftCommand) error {
+	cmd, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, _RAFT_WRITE_TIMEOUTS*r.timeout)
+		defer cancel()
+	}
+	for {
+		// never committed, so that it is safe to retry
+		if err = r.write(ctx, cmd); !errors.Is(err, errRaftNoLeader) && err != raft.ErrNotLeader && err != raft.ErrEnqueueTimeout {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %v", ctx.Err(), err)
+		case <-time.After(_RAFT_RETRY_INTERVAL):
+		}
+	}
+}
+
+func (r *raftEngine) write(ctx context.Context, cmd []byte) error {
+	deadline, _ := ctx.Deadline()
+	if r.raft.State() == raft.Leader {
+		_, err := r.apply(ctx, cmd, time.Until(deadline))
+		return err
+	}
+	leader, _ := r.raft.LeaderWithID()
+	if leader == "" || r.stream == nil {
+		return errRaftNoLeader
+	}
+	index, err := r.forward(ctx, string(leader), cmd, time.Until(deadline))
+	if err != nil {
+		return err
+	}
+	return r.waitApplied(ctx, index)
+}
+
+// apply commits the command and returns its index once the node applied it, the node should lead
+func (r *raftEngine) apply(ctx context.Context, cmd []byte, timeout time.Duration) (uint64, error) {
+	f := r.raft.Apply(cmd, timeout)
+	done := make(chan error, 1)
+	go func() { done <- f.Error() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			return 0, err
+		}
+		if err, ok := f.Response().(error); ok {
+			return f.Index(), err
+		}
+		return f.Index(), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// forward has the leader commit the command, and returns its index
+func (r *raftEngine) forward(ctx context.Context, leader string, cmd []byte, timeout time.Duration) (uint64, error) {
+	c, err := r.stream.dial(leader, _RAFT_STREAM_FORWARD, min(timeout, r.timeout))
+	if err != nil {
+		// nothing is sent to the leader, which may be gone
+		return 0, fmt.Errorf("%w: %v", errRaftNoLeader, err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	defer context.AfterFunc(ctx, func() { c.SetDeadline(time.Now()) })()
+	if err = writeRaftForward(c, timeout, cmd); err == nil {
+		var code byte
+		var index uint64
+		var msg string
+		if code, index, msg, err = readRaftReply(c); err == nil {
+			switch code {
+			case _RAFT_FORWARD_OK:
+				return index, nil
+			case _RAFT_FORWARD_NOT_LEADER:
+				return 0, raft.ErrNotLeader
+			}
+			return 0, errors.New(msg)
+		}
+	}
+	if ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	return 0, err
+}
+
+// serveForward commits a command forwarded by another node, if the node leads
+func (r *raftEngine) serveForward(c net.Conn) {
+	defer c.Close()
+	select {
+	case <-r.ready:
+	case <-r.stop:
+		return
+	}
+	c.SetDeadline(time.Now().Add(_RAFT_WRITE_TIMEOUTS * r.timeout))
+	timeout, cmd, err := readRaftForward(c)
+	if err != nil {
+		return
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var code byte = _RAFT_FORWARD_OK
+	var msg string
+	index, err := r.apply(ctx, cmd, timeout)
+	if err == raft.ErrNotLeader || err == raft.ErrEnqueueTimeout {
+		code = _RAFT_FORWARD_NOT_LEADER
+	} else if err != nil {
+		code, msg = _RAFT_FORWARD_ERROR, err.Error()
+	}
+	writeRaftReply(c, code, index, msg)
+}
+
+// the node forwarding a write reads it once applied
+func (r *raftEngine) waitApplied(ctx context.Context, index uint64) error {
+	for r.state.applied.Load() < index {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(_RAFT_RETRY_INTERVAL):
+		}
+	}
+	return nil
+}
+
+func (r *raftEngine) WriteUser(ctx context.Context, username string, u *User) error {
+	return r.propose(ctx, raftCommand{Op: _RAFT_WRITE_USER, Username: username, User: u.marshal()})
+}
+
+func (r *raftEngine) BatchWritePingRets(ctx context.Context, server, location string, prs []PingRet) error {
+	return r.propose(ctx, raftCommand{Op: _RAFT_WRITE_PINGRETS, Server: server, Location: location, PingRets: prs})
+}
+
+// WritePingRets replaces the series on every node, see SeriesWriter
+func (r *raftEngine) WritePingRets(ctx context.Context, server, location string, prs []PingRet) error {
+	return r.propose(ctx, raftCommand{Op: _RAFT_WRITE_SERIES, Server: server, Location: location, PingRets: prs})
+}
+
+// ReadPingRets reads the series the node applied, see SeriesReader
+func (r *raftEngine) ReadPingRets(ctx context.Context, server, location string) ([]PingRet, error) {
+	return r.state.readPingRets(server, location)
+}
+
+func (r *raftEngine) WriteAggregates(ctx context.Context, server, location, resolution string, as []Aggregate) error {
+	return r.propose(ctx, raftCommand{Op: _RAFT_WRITE_AGGREGATES, Server: server, Location: location, Resolution: resolution, Aggregates: as})
+}
+
+func (r *raftEngine) ReadAggregates() (aggregates, error) { return r.state.readAggregates() }
+
+func (r *raftEngine) WriteDNSHistory(ctx context.Context, server string, h []Resolution) error {
+	return r.propose(ctx, raftCommand{Op: _RAFT_WRITE_DNS, Server: server, DNS: h})
+}
+
+func (r *raftEngine) ReadDNSHistory() (map[string][]Resolution, error) {
+	return r.state.readDNSHistory()
+}
+
+func (r *raftEngine) AppendAudit(ctx context.Context, e AuditEntry) error {
+	return r.propose(ctx, raftCommand{Op: _RAFT_APPEND_AUDIT, Audit: &e})
+}
+
+func (r *raftEngine) ReadAudit() ([]AuditEntry, error) { return r.state.readAudit() }
+
+// PurgeServer removes the data of the server on every node, which compacts its log once it applied the purge
+func (r *raftEngine) PurgeServer(ctx context.Context, server string) error {
+	return r.propose(ctx, raftCommand{Op: _RAFT_PURGE_SERVER, Server: server})
+}
+
+// DeleteUser removes the user on every node, the log is compacted like by PurgeServer
+func (r *raftEngine) DeleteUser(ctx context.Context, username string) error {
+	return r.propose(ctx, raftCommand{Op: _RAFT_DELETE_USER, Username: username})
+}
+
+func (r *raftEngine) ReadOptOuts() (optOuts []OptOut, err error) {
+	_, err = r.state.readState(_RAFT_KEY_OPTOUTS, &optOuts)
+	return
+}
+
+func (r *raftEngine) WriteOptOuts(optOuts []OptOut) error {
+	return r.propose(context.Background(), raftCommand{Op: _RAFT_WRITE_OPTOUTS, OptOuts: optOuts})
+}
+
+func (r *raftEngine) ReadAssignments() (servers []string, ok bool, err error) {
+	ok, err = r.state.readState(_RAFT_KEY_ASSIGNMENTS, &servers)
+	return
+}
+
+func (r *raftEngine) WriteAssignments(servers []string) error {
+	return r.propose(context.Background(), raftCommand{Op: _RAFT_WRITE_ASSIGNMENTS, Assignments: servers})
+}
+
+func (r *raftEngine) WriteInboxes(ctx context.Context, inboxes map[string][]Message) error {
+	return r.propose(ctx, raftCommand{Op: _RAFT_WRITE_INBOXES, Inboxes: inboxes})
+}
+
+func (r *raftEngine) ReadInboxes() (map[string][]Message, error) { return r.state.readInboxes() }
+
+// the main server of the leading node holds the lease, as long as a majority of the nodes follows it
+func (r *raftEngine) AcquireLease(holder string, ttl time.Duration) (bool, error) {
+	if r.raft.State() != raft.Leader {
+		return false, nil
+	}
+	switch err := r.raft.VerifyLeader().Error(); err {
+	case nil:
+		return true, nil
+	case raft.ErrNotLeader, raft.ErrLeadershipLost:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// the leading node hands the leadership to another node, so that the cluster elects none once it stops
+func (r *raftEngine) ReleaseLease(holder string) error {
+	if len(r.conf.Peers) == 1 || r.raft.State() != raft.Leader {
+		return nil
+	}
+	if err := r.raft.LeadershipTransfer().Error(); err != nil && err != raft.ErrNotLeader {
+		return err
+	}
+	return nil
+}
+
+// the node is unhealthy while it knows of no leader, its writes fail meanwhile
+func (r *raftEngine) Health(ctx context.Context) error {
+	if r.raft.State() == raft.Shutdown {
+		return raft.ErrRaftShutdown
+	}
+	if leader, _ := r.raft.LeaderWithID(); leader == "" {
+		return errRaftNoLeader
+	}
+	return nil
+}
+
+// Close stops the node, closing it again is a no-op
+func (r *raftEngine) Close() (err error) {
+	if r.raft == nil {
+		return nil
+	}
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		err = r.raft.Shutdown().Error()
+		r.wg.Wait()
+		for _, c := range []io.Closer{r.transport, r.logs, r.state} {
+			if cerr := c.Close(); err == nil {
+				err = cerr
+			}
+		}
+	})
+	return
+}
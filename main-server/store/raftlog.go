@@ -0,0 +1,154 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/hashicorp/raft"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	_RAFT_BUCKET_LOGS   = []byte("logs")
+	_RAFT_BUCKET_STABLE = []byte("stable")
+
+	// raft tells a key never set by the message
+	errRaftNotFound = errors.New("not found")
+
+	// another node opening the dir fails instead of waiting for the lock of the databases
+	raftBoltOptions = &bolt.Options{Timeout: time.Second}
+)
+
+// raftLogStore keeps the log, the term and the vote of the node in a bolt database, see raft.LogStore and raft.StableStore
+// the entries are json by their big endian index, so that they are iterated in order
+type raftLogStore struct {
+	db *bolt.DB
+}
+
+func openRaftLogStore(path string) (*raftLogStore, error) {
+	db, err := bolt.Open(path, 0600, raftBoltOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{_RAFT_BUCKET_LOGS, _RAFT_BUCKET_STABLE} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &raftLogStore{db: db}, nil
+}
+
+func raftKey(i uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, i)
+	return k
+}
+
+func (l *raftLogStore) FirstIndex() (i uint64, err error) {
+	err = l.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(_RAFT_BUCKET_LOGS).Cursor().First(); k != nil {
+			i = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	return
+}
+
+func (l *raftLogStore) LastIndex() (i uint64, err error) {
+	err = l.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket(_RAFT_BUCKET_LOGS).Cursor().Last(); k != nil {
+			i = binary.BigEndian.Uint64(k)
+		}
+		return nil
+	})
+	return
+}
+
+func (l *raftLogStore) GetLog(index uint64, log *raft.Log) error {
+	return l.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(_RAFT_BUCKET_LOGS).Get(raftKey(index))
+		if v == nil {
+			return raft.ErrLogNotFound
+		}
+		return json.Unmarshal(v, log)
+	})
+}
+
+func (l *raftLogStore) StoreLog(log *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{log})
+}
+
+func (l *raftLogStore) StoreLogs(logs []*raft.Log) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(_RAFT_BUCKET_LOGS)
+		for _, log := range logs {
+			v, err := json.Marshal(log)
+			if err != nil {
+				return err
+			}
+			if err = b.Put(raftKey(log.Index), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteRange removes the entries from min to max, both included
+func (l *raftLogStore) DeleteRange(min, max uint64) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(_RAFT_BUCKET_LOGS)
+		// the keys are collected first, a cursor moved after a delete may skip the next key
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.Seek(raftKey(min)); k != nil && binary.BigEndian.Uint64(k) <= max; k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (l *raftLogStore) Set(key, val []byte) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(_RAFT_BUCKET_STABLE).Put(key, val)
+	})
+}
+
+func (l *raftLogStore) Get(key []byte) (val []byte, err error) {
+	err = l.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(_RAFT_BUCKET_STABLE).Get(key)
+		if v == nil {
+			return errRaftNotFound
+		}
+		val = append([]byte(nil), v...)
+		return nil
+	})
+	return
+}
+
+func (l *raftLogStore) SetUint64(key []byte, val uint64) error {
+	return l.Set(key, raftKey(val))
+}
+
+func (l *raftLogStore) GetUint64(key []byte) (uint64, error) {
+	v, err := l.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(v), nil
+}
+
+func (l *raftLogStore) Close() error { return l.db.Close() }
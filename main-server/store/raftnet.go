@@ -0,0 +1,259 @@
+package store
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	// the purposes of the connections between the nodes
+	_RAFT_STREAM_RAFT    = 'r'
+	_RAFT_STREAM_FORWARD = 'f'
+
+	_RAFT_NONCE_SIZE = 32
+	// a write forwarded to the leader is at most that large
+	_RAFT_MAX_FORWARD = 64 << 20
+
+	// the replies of the leader to a write forwarded
+	_RAFT_FORWARD_OK         = 0
+	_RAFT_FORWARD_NOT_LEADER = 1
+	_RAFT_FORWARD_ERROR      = 2
+)
+
+var errRaftStreamClosed = errors.New("raft stream is closed")
+
+// the address a node is reached by, which may differ from the one it listens on
+type raftAddr string
+
+func (a raftAddr) Network() string { return "tcp" }
+func (a raftAddr) String() string  { return string(a) }
+
+// raftStream is the stream layer of the raft transport, and carries the writes forwarded to the leader as well
+// the nodes prove each other to know the secret on every connection, by hmac of the nonces of both ends
+type raftStream struct {
+	id      string
+	addr    raftAddr
+	secret  []byte
+	timeout time.Duration
+	l       net.Listener
+	// the connections of the raft transport, see Accept
+	conns chan net.Conn
+	// serves a write forwarded, the connection is authenticated and closed by it
+	forwarded func(net.Conn)
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func listenRaftStream(listen, addr, id, secret string, timeout time.Duration, forwarded func(net.Conn)) (*raftStream, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	s := &raftStream{
+		id: id, addr: raftAddr(addr), secret: []byte(secret), timeout: timeout, l: l,
+		conns: make(chan net.Conn), forwarded: forwarded, closed: make(chan struct{}),
+	}
+	go s.serve()
+	return s, nil
+}
+
+func (s *raftStream) serve() {
+	for {
+		c, err := s.l.Accept()
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		go s.accept(c)
+	}
+}
+
+// the connections failing the handshake are closed
+func (s *raftStream) accept(c net.Conn) {
+	c.SetDeadline(time.Now().Add(s.timeout))
+	purpose, err := s.handshakeIn(c)
+	if err != nil {
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+	switch purpose {
+	case _RAFT_STREAM_RAFT:
+		select {
+		case s.conns <- c:
+		case <-s.closed:
+			c.Close()
+		}
+	case _RAFT_STREAM_FORWARD:
+		s.forwarded(c)
+	default:
+		c.Close()
+	}
+}
+
+func (s *raftStream) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.conns:
+		return c, nil
+	case <-s.closed:
+		return nil, errRaftStreamClosed
+	}
+}
+
+func (s *raftStream) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return s.l.Close()
+}
+
+func (s *raftStream) Addr() net.Addr { return s.addr }
+
+func (s *raftStream) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	return s.dial(string(address), _RAFT_STREAM_RAFT, timeout)
+}
+
+func (s *raftStream) dial(address string, purpose byte, timeout time.Duration) (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	if err = s.handshakeOut(c, purpose); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("can not authenticate with %v: %v", address, err)
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// the dialing node sends its purpose, its id and a nonce, the node accepting replies its nonce and its proof,
+// then the dialing node sends its proof
+func (s *raftStream) handshakeOut(c net.Conn, purpose byte) error {
+	nonce, err := raftNonce()
+	if err != nil {
+		return err
+	}
+	hello := append([]byte{purpose, byte(len(s.id))}, s.id...)
+	if _, err = c.Write(append(hello, nonce...)); err != nil {
+		return err
+	}
+	reply := make([]byte, _RAFT_NONCE_SIZE+sha256.Size)
+	if _, err = io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	peerNonce, proof := reply[:_RAFT_NONCE_SIZE], reply[_RAFT_NONCE_SIZE:]
+	if !hmac.Equal(proof, s.mac("accept", nonce, peerNonce)) {
+		return fmt.Errorf("the peer does not know the secret")
+	}
+	_, err = c.Write(s.mac("dial", hello, peerNonce, nonce))
+	return err
+}
+
+func (s *raftStream) handshakeIn(c net.Conn) (byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return 0, err
+	}
+	rest := make([]byte, int(head[1])+_RAFT_NONCE_SIZE)
+	if _, err := io.ReadFull(c, rest); err != nil {
+		return 0, err
+	}
+	hello, peerNonce := append(head, rest[:head[1]]...), rest[head[1]:]
+	nonce, err := raftNonce()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = c.Write(append(nonce, s.mac("accept", peerNonce, nonce)...)); err != nil {
+		return 0, err
+	}
+	proof := make([]byte, sha256.Size)
+	if _, err = io.ReadFull(c, proof); err != nil {
+		return 0, err
+	}
+	if !hmac.Equal(proof, s.mac("dial", hello, nonce, peerNonce)) {
+		return 0, fmt.Errorf("the peer does not know the secret")
+	}
+	return head[0], nil
+}
+
+func (s *raftStream) mac(label string, parts ...[]byte) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(label))
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+func raftNonce() ([]byte, error) {
+	b := make([]byte, _RAFT_NONCE_SIZE)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// a write forwarded is the time the leader has to commit it and the command, both prefixed by their size
+func writeRaftForward(w io.Writer, timeout time.Duration, cmd []byte) error {
+	b := make([]byte, 12, 12+len(cmd))
+	binary.BigEndian.PutUint64(b, uint64(timeout))
+	binary.BigEndian.PutUint32(b[8:], uint32(len(cmd)))
+	_, err := w.Write(append(b, cmd...))
+	return err
+}
+
+func readRaftForward(r io.Reader) (time.Duration, []byte, error) {
+	b := make([]byte, 12)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(b[8:])
+	if n > _RAFT_MAX_FORWARD {
+		return 0, nil, fmt.Errorf("write forwarded of %v bytes is too large", n)
+	}
+	cmd := make([]byte, n)
+	_, err := io.ReadFull(r, cmd)
+	return time.Duration(binary.BigEndian.Uint64(b)), cmd, err
+}
+
+// the reply is the code, the index of the write committed and the error message
+func writeRaftReply(w io.Writer, code byte, index uint64, msg string) error {
+	b := make([]byte, 13, 13+len(msg))
+	b[0] = code
+	binary.BigEndian.PutUint64(b[1:], index)
+	binary.BigEndian.PutUint32(b[9:], uint32(len(msg)))
+	_, err := w.Write(append(b, msg...))
+	return err
+}
+
+func readRaftReply(r io.Reader) (code byte, index uint64, msg string, err error) {
+	b := make([]byte, 13)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return
+	}
+	n := binary.BigEndian.Uint32(b[9:])
+	if n > _RAFT_MAX_FORWARD {
+		return 0, 0, "", fmt.Errorf("reply of %v bytes is too large", n)
+	}
+	m := make([]byte, n)
+	if _, err = io.ReadFull(r, m); err != nil {
+		return
+	}
+	return b[0], binary.BigEndian.Uint64(b[1:]), string(m), nil
+}
@@ -0,0 +1,550 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/raft"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	_RAFT_WRITE_USER        = "user"
+	_RAFT_WRITE_PINGRETS    = "pingrets"
+	_RAFT_WRITE_SERIES      = "series"
+	_RAFT_WRITE_AGGREGATES  = "aggregates"
+	_RAFT_WRITE_DNS         = "dns"
+	_RAFT_APPEND_AUDIT      = "audit"
+	_RAFT_WRITE_OPTOUTS     = "optouts"
+	_RAFT_WRITE_ASSIGNMENTS = "assignments"
+	_RAFT_WRITE_INBOXES     = "inboxes"
+	_RAFT_PURGE_SERVER      = "purgeServer"
+	_RAFT_DELETE_USER       = "deleteUser"
+
+	_RAFT_RESTORE_SUFFIX = ".restore"
+	// the records of a snapshot restored in a transaction
+	_RAFT_RESTORE_BATCH = 1 << 14
+)
+
+var (
+	// the index applied last, written along with the writes it applied
+	_RAFT_BUCKET_META = []byte("meta")
+	_RAFT_KEY_APPLIED = []byte("applied")
+	// username -> user
+	_RAFT_BUCKET_USERS = []byte("users")
+	// server -> location -> sequence -> ping result
+	_RAFT_BUCKET_PINGRETS = []byte("pingrets")
+	// server -> location -> resolution -> aggregates
+	_RAFT_BUCKET_AGGREGATES = []byte("aggregates")
+	// server -> dns history
+	_RAFT_BUCKET_DNS = []byte("dns")
+	// sequence -> audit entry
+	_RAFT_BUCKET_AUDIT = []byte("audit")
+	// username -> inbox
+	_RAFT_BUCKET_INBOXES = []byte("inboxes")
+	// the opt-outs and the assignments
+	_RAFT_BUCKET_STATE    = []byte("state")
+	_RAFT_KEY_OPTOUTS     = []byte("optouts")
+	_RAFT_KEY_ASSIGNMENTS = []byte("assignments")
+
+	_RAFT_STATE_BUCKETS = [][]byte{_RAFT_BUCKET_META, _RAFT_BUCKET_USERS, _RAFT_BUCKET_PINGRETS, _RAFT_BUCKET_AGGREGATES, _RAFT_BUCKET_DNS, _RAFT_BUCKET_AUDIT, _RAFT_BUCKET_INBOXES, _RAFT_BUCKET_STATE}
+)
+
+// a write replicated
+type raftCommand struct {
+	Op         string          `json:"op"`
+	Username   string          `json:"username,omitempty"`
+	User       json.RawMessage `json:"user,omitempty"`
+	Server     string          `json:"server,omitempty"`
+	Location   string          `json:"location,omitempty"`
+	Resolution string          `json:"resolution,omitempty"`
+	PingRets   []PingRet       `json:"pingrets,omitempty"`
+	Aggregates []Aggregate     `json:"aggregates,omitempty"`
+	DNS        []Resolution    `json:"dns,omitempty"`
+	Audit      *AuditEntry     `json:"audit,omitempty"`
+	OptOuts    []OptOut        `json:"optouts,omitempty"`
+	// the empty inboxes are removed, see InboxStore
+	Inboxes     map[string][]Message `json:"inboxes,omitempty"`
+	Assignments []string             `json:"assignments,omitempty"`
+}
+
+// raftState is the state machine of the raft engine, a bolt database every node applies the writes committed to
+// the index applied is written in the transaction of the writes, so that a write is applied once across restarts
+// and the node needs no snapshot restored on start, see raft.Config.NoSnapshotRestoreOnStart
+type raftState struct {
+	path string
+	// held to read, Restore replaces the database
+	mu sync.RWMutex
+	db *bolt.DB
+	// the index applied last, a node forwarding a write waits for it to read its write
+	applied atomic.Uint64
+	// signaled once a purge is applied, so that the purged writes are compacted out of the log
+	purged chan struct{}
+}
+
+func openRaftState(path string) (*raftState, error) {
+	st := &raftState{path: path, purged: make(chan struct{}, 1)}
+	if err := st.open(); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (st *raftState) open() error {
+	db, err := bolt.Open(st.path, 0600, raftBoltOptions)
+	if err != nil {
+		return err
+	}
+	var applied uint64
+	if err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range _RAFT_STATE_BUCKETS {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		if v := tx.Bucket(_RAFT_BUCKET_META).Get(_RAFT_KEY_APPLIED); v != nil {
+			applied = binary.BigEndian.Uint64(v)
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return err
+	}
+	st.db = db
+	st.applied.Store(applied)
+	return nil
+}
+
+func (st *raftState) Apply(l *raft.Log) interface{} {
+	return st.ApplyBatch([]*raft.Log{l})[0]
+}
+
+// ApplyBatch applies the writes in a transaction, the writes applied before are skipped, see raft.BatchingFSM
+// the result of a write is the error of its command, which fails alike on every node
+// the node panics if the transaction fails, as the writes after it would be applied without it otherwise
+func (st *raftState) ApplyBatch(logs []*raft.Log) []interface{} {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	rets := make([]interface{}, len(logs))
+	applied := st.applied.Load()
+	var purged bool
+	if err := st.db.Update(func(tx *bolt.Tx) error {
+		for i, l := range logs {
+			if l.Index <= applied {
+				continue
+			}
+			applied = l.Index
+			if l.Type != raft.LogCommand {
+				continue
+			}
+			var c raftCommand
+			if err := json.Unmarshal(l.Data, &c); err != nil {
+				rets[i] = err
+				continue
+			}
+			purged = purged || c.Op == _RAFT_PURGE_SERVER || c.Op == _RAFT_DELETE_USER
+			if err := applyRaftCommand(tx, c); err != nil {
+				rets[i] = err
+			}
+		}
+		return tx.Bucket(_RAFT_BUCKET_META).Put(_RAFT_KEY_APPLIED, raftKey(applied))
+	}); err != nil {
+		panic(fmt.Errorf("can not apply the raft log to %v: %v", st.path, err))
+	}
+	st.applied.Store(applied)
+	if purged {
+		select {
+		case st.purged <- struct{}{}:
+		default:
+		}
+	}
+	return rets
+}
+
+func applyRaftCommand(tx *bolt.Tx, c raftCommand) error {
+	switch c.Op {
+	case _RAFT_WRITE_USER:
+		return tx.Bucket(_RAFT_BUCKET_USERS).Put([]byte(c.Username), c.User)
+	case _RAFT_WRITE_PINGRETS:
+		b, err := nestedBucket(tx.Bucket(_RAFT_BUCKET_PINGRETS), c.Server, c.Location)
+		if err != nil {
+			return err
+		}
+		return appendRaftValues(b, c.PingRets)
+	case _RAFT_WRITE_SERIES:
+		sb, err := nestedBucket(tx.Bucket(_RAFT_BUCKET_PINGRETS), c.Server)
+		if err != nil {
+			return err
+		}
+		if sb.Bucket([]byte(c.Location)) != nil {
+			if err = sb.DeleteBucket([]byte(c.Location)); err != nil {
+				return err
+			}
+		}
+		b, err := sb.CreateBucket([]byte(c.Location))
+		if err != nil {
+			return err
+		}
+		return appendRaftValues(b, c.PingRets)
+	case _RAFT_WRITE_AGGREGATES:
+		b, err := nestedBucket(tx.Bucket(_RAFT_BUCKET_AGGREGATES), c.Server, c.Location)
+		if err != nil {
+			return err
+		}
+		return putRaftJSON(b, []byte(c.Resolution), c.Aggregates)
+	case _RAFT_WRITE_DNS:
+		return putRaftJSON(tx.Bucket(_RAFT_BUCKET_DNS), []byte(c.Server), c.DNS)
+	case _RAFT_APPEND_AUDIT:
+		if c.Audit == nil {
+			return fmt.Errorf("audit entry is missing")
+		}
+		return appendRaftValues(tx.Bucket(_RAFT_BUCKET_AUDIT), []AuditEntry{*c.Audit})
+	case _RAFT_WRITE_OPTOUTS:
+		return putRaftJSON(tx.Bucket(_RAFT_BUCKET_STATE), _RAFT_KEY_OPTOUTS, c.OptOuts)
+	case _RAFT_WRITE_ASSIGNMENTS:
+		return putRaftJSON(tx.Bucket(_RAFT_BUCKET_STATE), _RAFT_KEY_ASSIGNMENTS, c.Assignments)
+	case _RAFT_WRITE_INBOXES:
+		b := tx.Bucket(_RAFT_BUCKET_INBOXES)
+		for username, ms := range c.Inboxes {
+			var err error
+			if len(ms) == 0 {
+				err = b.Delete([]byte(username))
+			} else {
+				err = putRaftJSON(b, []byte(username), ms)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case _RAFT_PURGE_SERVER:
+		for _, name := range [][]byte{_RAFT_BUCKET_PINGRETS, _RAFT_BUCKET_AGGREGATES} {
+			if b := tx.Bucket(name); b.Bucket([]byte(c.Server)) != nil {
+				if err := b.DeleteBucket([]byte(c.Server)); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.Bucket(_RAFT_BUCKET_DNS).Delete([]byte(c.Server))
+	case _RAFT_DELETE_USER:
+		if err := tx.Bucket(_RAFT_BUCKET_USERS).Delete([]byte(c.Username)); err != nil {
+			return err
+		}
+		return tx.Bucket(_RAFT_BUCKET_INBOXES).Delete([]byte(c.Username))
+	}
+	return fmt.Errorf("unknown raft command %v", c.Op)
+}
+
+// the bucket nested in b by the names, created if absent
+func nestedBucket(b *bolt.Bucket, names ...string) (*bolt.Bucket, error) {
+	for _, name := range names {
+		var err error
+		if b, err = b.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// the values are keyed by the sequence of the bucket, in order
+func appendRaftValues[T any](b *bolt.Bucket, vs []T) error {
+	for _, v := range vs {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err = putRaftJSON(b, raftKey(seq), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putRaftJSON(b *bolt.Bucket, k []byte, v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(k, bs)
+}
+
+// readRaftValues decodes the values of the bucket in order, nil if the bucket is absent
+func readRaftValues[T any](b *bolt.Bucket) ([]T, error) {
+	if b == nil {
+		return nil, nil
+	}
+	vs := make([]T, 0)
+	err := b.ForEach(func(k, v []byte) error {
+		var t T
+		if err := json.Unmarshal(v, &t); err != nil {
+			return err
+		}
+		vs = append(vs, t)
+		return nil
+	})
+	return vs, err
+}
+
+func (st *raftState) view(f func(tx *bolt.Tx) error) error {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.db.View(f)
+}
+
+// read returns the users and the ping results applied, like Init
+func (st *raftState) read() (Servers, Users, map[string]int64, error) {
+	servers, users, allServers := make(Servers), make(Users), make(map[string]int64)
+	err := st.view(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(_RAFT_BUCKET_USERS).ForEach(func(k, v []byte) error {
+			u := newUser()
+			if err := json.Unmarshal(v, u); err != nil {
+				return fmt.Errorf("can not read user %s: %v", k, err)
+			}
+			users[string(k)] = u
+			for server := range u.MonitorServers {
+				allServers[server]++
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		b := tx.Bucket(_RAFT_BUCKET_PINGRETS)
+		return b.ForEach(func(server, _ []byte) error {
+			sb := b.Bucket(server)
+			return sb.ForEach(func(location, _ []byte) error {
+				prs, err := readRaftValues[PingRet](sb.Bucket(location))
+				if err != nil {
+					return fmt.Errorf("can not read ping results of %s at %s: %v", server, location, err)
+				}
+				if servers[string(server)] == nil {
+					servers[string(server)] = make(map[string][]PingRet)
+				}
+				servers[string(server)][string(location)] = prs
+				return nil
+			})
+		})
+	})
+	return servers, users, allServers, err
+}
+
+func (st *raftState) readPingRets(server, location string) (prs []PingRet, err error) {
+	err = st.view(func(tx *bolt.Tx) error {
+		if sb := tx.Bucket(_RAFT_BUCKET_PINGRETS).Bucket([]byte(server)); sb != nil {
+			prs, err = readRaftValues[PingRet](sb.Bucket([]byte(location)))
+		}
+		return err
+	})
+	if prs == nil && err == nil {
+		prs = []PingRet{}
+	}
+	return
+}
+
+func (st *raftState) readAggregates() (aggregates, error) {
+	as := make(aggregates)
+	err := st.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(_RAFT_BUCKET_AGGREGATES)
+		return b.ForEach(func(server, _ []byte) error {
+			sb := b.Bucket(server)
+			return sb.ForEach(func(location, _ []byte) error {
+				return sb.Bucket(location).ForEach(func(resolution, v []byte) error {
+					var a []Aggregate
+					if err := json.Unmarshal(v, &a); err != nil {
+						return err
+					}
+					as.set(string(server), string(location), string(resolution), a)
+					return nil
+				})
+			})
+		})
+	})
+	return as, err
+}
+
+func (st *raftState) readDNSHistory() (map[string][]Resolution, error) {
+	ret := make(map[string][]Resolution)
+	err := st.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(_RAFT_BUCKET_DNS).ForEach(func(server, v []byte) error {
+			var h []Resolution
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+			ret[string(server)] = h
+			return nil
+		})
+	})
+	return ret, err
+}
+
+func (st *raftState) readAudit() (es []AuditEntry, err error) {
+	err = st.view(func(tx *bolt.Tx) error {
+		es, err = readRaftValues[AuditEntry](tx.Bucket(_RAFT_BUCKET_AUDIT))
+		return err
+	})
+	if len(es) == 0 {
+		es = nil
+	}
+	return
+}
+
+func (st *raftState) readInboxes() (map[string][]Message, error) {
+	ret := make(map[string][]Message)
+	err := st.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(_RAFT_BUCKET_INBOXES).ForEach(func(username, v []byte) error {
+			var ms []Message
+			if err := json.Unmarshal(v, &ms); err != nil {
+				return err
+			}
+			ret[string(username)] = ms
+			return nil
+		})
+	})
+	return ret, err
+}
+
+// readState decodes the value of the key of the state into v, false if it was never written
+func (st *raftState) readState(k []byte, v interface{}) (ok bool, err error) {
+	err = st.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(_RAFT_BUCKET_STATE).Get(k)
+		if ok = b != nil; !ok {
+			return nil
+		}
+		return json.Unmarshal(b, v)
+	})
+	return
+}
+
+// Snapshot reads the database in a transaction of its own, the writes are applied meanwhile
+func (st *raftState) Snapshot() (raft.FSMSnapshot, error) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	tx, err := st.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return raftSnapshot{tx}, nil
+}
+
+// Restore replaces the database by the snapshot, e.g. of the leader for a node too far behind or replaced
+// the database is written apart and renamed, in transactions of _RAFT_RESTORE_BATCH records
+func (st *raftState) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	tmp := st.path + _RAFT_RESTORE_SUFFIX
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	db, err := bolt.Open(tmp, 0600, raftBoltOptions)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bufio.NewReader(rc))
+	for done := false; !done && err == nil; {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for i := 0; i < _RAFT_RESTORE_BATCH; i++ {
+				var rec raftRecord
+				if err := d.Decode(&rec); err == io.EOF {
+					done = true
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if err := rec.restore(tx); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("can not restore raft snapshot: %v", err)
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if err = st.db.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, st.path); err != nil {
+		return err
+	}
+	return st.open()
+}
+
+func (st *raftState) Close() error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.db.Close()
+}
+
+// a snapshot is the records of the database as of the transaction, the pages freed by the purges are not copied
+type raftSnapshot struct {
+	tx *bolt.Tx
+}
+
+// a record of a snapshot is a bucket by its path and its sequence, or a value by its bucket and its key
+type raftRecord struct {
+	Bucket   [][]byte `json:"b"`
+	Sequence uint64   `json:"s,omitempty"`
+	Key      []byte   `json:"k,omitempty"`
+	Value    []byte   `json:"v,omitempty"`
+}
+
+func (rec raftRecord) restore(tx *bolt.Tx) error {
+	if len(rec.Bucket) == 0 {
+		return fmt.Errorf("record of no bucket")
+	}
+	b, err := tx.CreateBucketIfNotExists(rec.Bucket[0])
+	for _, name := range rec.Bucket[1:] {
+		if err != nil {
+			break
+		}
+		b, err = b.CreateBucketIfNotExists(name)
+	}
+	if err != nil {
+		return err
+	}
+	// a key is never empty
+	if rec.Key == nil {
+		return b.SetSequence(rec.Sequence)
+	}
+	return b.Put(rec.Key, rec.Value)
+}
+
+func (s raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	w := bufio.NewWriter(sink)
+	e := json.NewEncoder(w)
+	err := s.tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return persistRaftBucket(e, [][]byte{name}, b)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func persistRaftBucket(e *json.Encoder, path [][]byte, b *bolt.Bucket) error {
+	if err := e.Encode(raftRecord{Bucket: path, Sequence: b.Sequence()}); err != nil {
+		return err
+	}
+	return b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return persistRaftBucket(e, append(path[:len(path):len(path)], k), b.Bucket(k))
+		}
+		return e.Encode(raftRecord{Bucket: path, Key: k, Value: v})
+	})
+}
+
+func (s raftSnapshot) Release() { s.tx.Rollback() }
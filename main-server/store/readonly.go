@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrorReadOnly is returned by the mutating operations while the store is read only
+var ErrorReadOnly = errors.New("store is read only for maintenance")
+
+// ping results buffered while read only, more are rejected
+const _READ_ONLY_BUFFER = 1 << 16
+
+// the maintenance mode, e.g. during engine migrations and backups, the engine is not written at all
+// the ping results are buffered and appended once the store is writable again, so the charts have no holes
+type readOnly struct {
+	mu      sync.Mutex
+	on      bool
+	since   time.Time
+	buffer  []bufferedPingRet
+	dropped int64
+}
+
+type bufferedPingRet struct {
+	server, location string
+	pr               PingRet
+}
+
+type ReadOnlyStatus struct {
+	On       bool      `json:"on"`
+	Since    time.Time `json:"since"`
+	Buffered int       `json:"buffered"`
+	Dropped  int64     `json:"dropped"`
+}
+
+// SetReadOnly turns the maintenance mode on or off, turning it off appends the ping results buffered meanwhile
+// returns the number of buffered ping results appended
+func (s *Store) SetReadOnly(ctx context.Context, on bool) (appended int, err error) {
+	r := &s.readOnly
+	r.mu.Lock()
+	if on {
+		if !r.on {
+			r.on, r.since = true, time.Now()
+		}
+		r.mu.Unlock()
+		return
+	}
+	r.on = false
+	// and those buffered by the appends rejected before it was turned off
+	for len(r.buffer) > 0 {
+		buffer := r.buffer
+		r.buffer = nil
+		r.mu.Unlock()
+		for i, b := range buffer {
+			if err = s.AppendPingRet(ctx, b.server, b.location, b.pr); err != nil {
+				// appended by the next call, before those buffered since
+				if ctx.Err() != nil {
+					r.mu.Lock()
+					r.buffer = append(buffer[i:], r.buffer...)
+					r.mu.Unlock()
+					return
+				}
+				// the servers deleted meanwhile are gone
+				s.logger.Error("can not append buffered ping result", "server", b.server, "location", b.location, "error", err)
+				continue
+			}
+			appended++
+		}
+		r.mu.Lock()
+	}
+	r.mu.Unlock()
+	return appended, nil
+}
+
+func (s *Store) ReadOnlyStatus() ReadOnlyStatus {
+	r := &s.readOnly
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return ReadOnlyStatus{On: r.on, Since: r.since, Buffered: len(r.buffer), Dropped: atomic.LoadInt64(&r.dropped)}
+}
+
+func (s *Store) isReadOnly() bool {
+	r := &s.readOnly
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.on
+}
+
+// buffer the ping results rejected by the engine if still read only, ErrorReadOnly if the buffer is full
+// the ping results are appended rather than buffered once writable again
+func (s *Store) bufferIfReadOnly(server, location string, prs []PingRet) (buffered bool, err error) {
+	r := &s.readOnly
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.on {
+		return false, nil
+	}
+	for _, pr := range prs {
+		if len(r.buffer) >= _READ_ONLY_BUFFER {
+			atomic.AddInt64(&r.dropped, 1)
+			err = ErrorReadOnly
+			continue
+		}
+		r.buffer = append(r.buffer, bufferedPingRet{server: server, location: location, pr: pr})
+	}
+	return true, err
+}
@@ -0,0 +1,175 @@
+package store
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RecoveryReport is what the store loaded from the engine on startup or reload
+// a clean report means nothing was lost, otherwise the corruptions and the warnings tell what was skipped
+type RecoveryReport struct {
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Reload   bool          `json:"reload"`
+
+	Users    int `json:"users"`
+	Servers  int `json:"servers"`
+	Series   int `json:"series"`
+	PingRets int `json:"ping_rets"`
+
+	Corruptions []Corruption `json:"corruptions,omitempty"`
+	Warnings    []string     `json:"warnings,omitempty"`
+}
+
+func (r RecoveryReport) Clean() bool { return len(r.Corruptions) == 0 && len(r.Warnings) == 0 }
+
+// engines noticing problems short of corruption on Init implement Warner, e.g. files left by an interrupted write
+type Warner interface {
+	Warnings() []string
+}
+
+// engines loading for long on Init implement ProgressReporter, the store logs the progress they report
+type ProgressReporter interface {
+	// SetProgress sets the func invoked with the series loaded and the total as Init goes on, by the goroutines loading them
+	SetProgress(progress func(done, total int))
+}
+
+// the progress of the startup is logged every _PROGRESS_INTERVAL
+const _PROGRESS_INTERVAL = time.Second
+
+// the state loaded from the engine
+type loaded struct {
+	servers Servers
+	// the servers in memory, see Series
+	series     columnar
+	users      Users
+	allServers map[string]int64
+	aggregates aggregates
+	dns        map[string][]Resolution
+	audit      []AuditEntry
+	status     map[string]ServerStatus
+	inboxes    map[string][]Message
+	// the users whose inboxes were moved out of their records, see moveInboxes
+	movedInboxes []string
+	report       RecoveryReport
+}
+
+// load the state from the engine and report the recovery
+// the aggregates and the dns history are rebuilt or start empty if they can not be read
+func (s *Store) load(reload bool) (l loaded) {
+	start := time.Now()
+	if pr, ok := s.storeEngine.(ProgressReporter); ok {
+		pr.SetProgress(s.logProgress(start))
+	}
+	l.servers, l.users, l.allServers = s.storeEngine.Init()
+	r := RecoveryReport{Time: start, Reload: reload, Users: len(l.users), Servers: len(l.allServers)}
+	for _, locations := range l.servers {
+		r.Series += len(locations)
+		for _, prs := range locations {
+			r.PingRets += len(prs)
+		}
+	}
+	if cr, ok := s.storeEngine.(CorruptionReporter); ok {
+		r.Corruptions = cr.Corruptions()
+	}
+	if w, ok := s.storeEngine.(Warner); ok {
+		r.Warnings = append(r.Warnings, w.Warnings()...)
+	}
+	as, err := s.readAggregates()
+	if err != nil {
+		r.Warnings = append(r.Warnings, fmt.Sprintf("can not read aggregates, aggregated the ping results again: %v", err))
+	}
+	l.aggregates = aggregateServers(as, l.servers)
+	// aggregated before, so that the aggregates cover the warm tier
+	if _, ok := s.tiered(); ok {
+		trimHot(l.servers, s.hotCutoff(time.Now()))
+	}
+	l.series = columnarOfParallel(l.servers, runtime.GOMAXPROCS(0))
+	l.status = s.classifyServers(l.series, start)
+	if l.dns, err = s.readDNSHistory(); err != nil {
+		r.Warnings = append(r.Warnings, fmt.Sprintf("can not read dns history, it starts empty: %v", err))
+	}
+	if l.audit, err = s.readAudit(); err != nil {
+		r.Warnings = append(r.Warnings, fmt.Sprintf("can not read the whole audit log: %v", err))
+	}
+	if l.inboxes, err = s.readInboxes(); err != nil {
+		r.Warnings = append(r.Warnings, fmt.Sprintf("can not read the inboxes, they start empty: %v", err))
+	}
+	l.movedInboxes = moveInboxes(l.users, l.inboxes)
+	r.Duration = time.Since(start)
+	l.report = r
+	s.logRecovery(r)
+	return
+}
+
+// the progress of Init logged at most every _PROGRESS_INTERVAL and once done
+func (s *Store) logProgress(start time.Time) func(done, total int) {
+	var mu sync.Mutex
+	last := start
+	return func(done, total int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if done < total && time.Since(last) < _PROGRESS_INTERVAL {
+			return
+		}
+		last = time.Now()
+		s.logger.Info("store loading", "series", done, "total", total, "elapsed", time.Since(start))
+	}
+}
+
+// parallel invokes f of 0 to n-1 by at most limit goroutines and waits for them
+// a panic of f stops the others and is raised again by parallel, so that a corrupt record still fails the startup
+func parallel(n, limit int, f func(i int)) {
+	if limit = min(limit, n); limit <= 1 {
+		for i := 0; i < n; i++ {
+			f(i)
+		}
+		return
+	}
+	var (
+		next     = int64(-1)
+		wg       sync.WaitGroup
+		once     sync.Once
+		failed   int32
+		panicked interface{}
+	)
+	for w := 0; w < limit; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if e := recover(); e != nil {
+					atomic.StoreInt32(&failed, 1)
+					once.Do(func() { panicked = e })
+				}
+			}()
+			for i := atomic.AddInt64(&next, 1); i < int64(n) && atomic.LoadInt32(&failed) == 0; i = atomic.AddInt64(&next, 1) {
+				f(int(i))
+			}
+		}()
+	}
+	wg.Wait()
+	if panicked != nil {
+		panic(panicked)
+	}
+}
+
+func (s *Store) logRecovery(r RecoveryReport) {
+	for _, c := range r.Corruptions {
+		s.logger.Error("corrupt record skipped", "path", c.Path, "line", c.Line, "reason", c.Reason, "repaired", c.Repaired)
+	}
+	for _, w := range r.Warnings {
+		s.logger.Warn("store recovery", "warning", w)
+	}
+	s.logger.Info("store recovered", "users", r.Users, "servers", r.Servers, "series", r.Series, "ping_rets", r.PingRets,
+		"corruptions", len(r.Corruptions), "warnings", len(r.Warnings), "duration", r.Duration, "reload", r.Reload)
+}
+
+// RecoveryReport returns the report of the last load from the engine
+func (s *Store) RecoveryReport() (r RecoveryReport) {
+	s.withReadLock(func() { r = s.recovery })
+	return
+}
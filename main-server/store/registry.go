@@ -0,0 +1,73 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrorEngineExist is returned by Register if another engine is registered by the name
+var ErrorEngineExist = errors.New("engine already exist")
+
+var (
+	engines    = make(map[string]func() StoreEngine)
+	enginesRwl sync.RWMutex
+)
+
+// Register registers the constructor of the store engine by the name, it is safe for concurrent use
+func Register(engineName string, f func() StoreEngine) error {
+	if engineName == "" || f == nil {
+		return fmt.Errorf("engine should have a name and a constructor")
+	}
+	enginesRwl.Lock()
+	defer enginesRwl.Unlock()
+	if _, ok := engines[engineName]; ok {
+		return fmt.Errorf("%w: %v", ErrorEngineExist, engineName)
+	}
+	engines[engineName] = f
+	return nil
+}
+
+// MustRegister is Register for the init of the engines, it panics on an invalid registration
+// the engine registered first is kept if the name is registered twice, e.g. by packages blank imported together
+func MustRegister(engineName string, f func() StoreEngine) {
+	if err := Register(engineName, f); err != nil && !errors.Is(err, ErrorEngineExist) {
+		panic(err)
+	}
+}
+
+// ListEngines returns the names of the registered engines sorted
+func ListEngines() []string {
+	enginesRwl.RLock()
+	defer enginesRwl.RUnlock()
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewEngine returns the registered engine loaded with the config, e.g. for the conformance tests of storetest
+// the store initializes it, others should not call Init of an engine used by a store
+func NewEngine(engineName string, config EngineConfig) (StoreEngine, error) {
+	e, err := newEngine(engineName)
+	if err != nil {
+		return nil, err
+	}
+	if err = e.LoadConfig(config); err != nil {
+		return nil, fmt.Errorf("invalid config of store engine %v: %v", engineName, err)
+	}
+	return e, nil
+}
+
+func newEngine(engineName string) (StoreEngine, error) {
+	enginesRwl.RLock()
+	f, ok := engines[engineName]
+	enginesRwl.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("store engine %v does not exist, should be one of %v", engineName, ListEngines())
+	}
+	return f(), nil
+}
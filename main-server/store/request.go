@@ -0,0 +1,43 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+)
+
+type requestIdKey struct{}
+
+// WithRequestId returns the context carrying the id of the request, which the store logs with the records of the operations of the request
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestId returns the id of the request the context carries, empty if none
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// adds the request id of the context to the records
+type requestIdHandler struct {
+	slog.Handler
+}
+
+func (h requestIdHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestId(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIdHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIdHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIdHandler) WithGroup(name string) slog.Handler {
+	return requestIdHandler{h.Handler.WithGroup(name)}
+}
+
+func withRequestId(l *slog.Logger) *slog.Logger {
+	return slog.New(requestIdHandler{l.Handler()})
+}
@@ -0,0 +1,264 @@
+package store
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Series is the ping results of a server at a location kept in memory by column rather than as PingRet of strings,
+// so that a ping result costs a few dozen bytes without pointers for the garbage collector to scan
+// and the statistics loop over the latencies without parsing them
+// it is appended and replaced like a slice, a Series taken under the lock keeps seeing the same ping results
+// the ping results the columns can not encode exactly, like the steps of transactions, are kept aside as they are
+type Series struct {
+	// the wall clock of Time in unix seconds as if it were UTC
+	times []int64
+	// Ping in milliseconds, 0 of the ping results down
+	values []float32
+	flags  []uint8
+	// Loss in percent, of _FLAG_LOSS
+	losses []float32
+	// the wall clocks of ProbeTime and ReceivedTime in seconds after the time, of _FLAG_PROBED and _FLAG_RECEIVED,
+	// and the offset of their zone in minutes
+	probed, received []int32
+	zones            []int16
+	// the positions of the ping results kept aside, ascending, of _FLAG_RAW
+	rawAt []int32
+	raw   []PingRet
+}
+
+const (
+	_FLAG_PROBED uint8 = 1 << iota
+	_FLAG_RECEIVED
+	_FLAG_LOSS
+	_FLAG_RAW
+)
+
+// a ping result encoded in the columns
+type sample struct {
+	time             int64
+	value            float32
+	flags            uint8
+	loss             float32
+	probed, received int32
+	zone             int16
+}
+
+// encode the ping result in the columns, false if they can not decode it exactly
+func encodePingRet(pr PingRet) (r sample, ok bool) {
+	t, err := time.Parse(_PING_TIME_LAYOUT, pr.Time)
+	if err != nil {
+		return r, false
+	}
+	r.time = t.Unix()
+	v, err := strconv.ParseFloat(pr.Ping, 32)
+	if err != nil || pr.Steps != "" || pr.MTU != 0 {
+		return r, false
+	}
+	r.value = float32(v)
+	if pr.Loss != "" {
+		l, err := strconv.ParseFloat(pr.Loss, 32)
+		if err != nil {
+			return r, false
+		}
+		r.flags, r.loss = r.flags|_FLAG_LOSS, float32(l)
+	}
+	zone := math.MinInt32
+	for _, c := range []struct {
+		rfc3339 string
+		flag    uint8
+		offset  *int32
+	}{{pr.ProbeTime, _FLAG_PROBED, &r.probed}, {pr.ReceivedTime, _FLAG_RECEIVED, &r.received}} {
+		if c.rfc3339 == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, c.rfc3339)
+		if err != nil {
+			return r, false
+		}
+		_, z := t.Zone()
+		// both are formatted in the zone of the main server
+		if zone != math.MinInt32 && z != zone || z%60 != 0 {
+			return r, false
+		}
+		zone = z
+		d := t.Unix() + int64(z) - r.time
+		if d < math.MinInt32 || d > math.MaxInt32 {
+			return r, false
+		}
+		r.flags, *c.offset = r.flags|c.flag, int32(d)
+	}
+	if zone != math.MinInt32 {
+		r.zone = int16(zone / 60)
+	}
+	return r, r.pingRet() == pr
+}
+
+func (r sample) pingRet() PingRet {
+	pr := PingRet{
+		Time: time.Unix(r.time, 0).UTC().Format(_PING_TIME_LAYOUT),
+		Ping: strconv.FormatFloat(float64(r.value), 'f', 3, 32),
+	}
+	if r.flags&_FLAG_LOSS != 0 {
+		pr.Loss = strconv.FormatFloat(float64(r.loss), 'f', 1, 32)
+	}
+	zone := time.FixedZone("", int(r.zone)*60)
+	at := func(offset int32) string {
+		return time.Unix(r.time+int64(offset)-int64(r.zone)*60, 0).In(zone).Format(time.RFC3339)
+	}
+	if r.flags&_FLAG_PROBED != 0 {
+		pr.ProbeTime = at(r.probed)
+	}
+	if r.flags&_FLAG_RECEIVED != 0 {
+		pr.ReceivedTime = at(r.received)
+	}
+	return pr
+}
+
+// seriesOf encodes the ping results
+func seriesOf(prs []PingRet) Series {
+	var s Series
+	return s.Append(prs...)
+}
+
+// Len returns the number of ping results
+func (s Series) Len() int { return len(s.flags) }
+
+// Append returns the series with the ping results appended like append, the series appended to keeps its ping results
+func (s Series) Append(prs ...PingRet) Series {
+	for _, pr := range prs {
+		r, ok := encodePingRet(pr)
+		if !ok {
+			s.rawAt, s.raw = append(s.rawAt, int32(len(s.flags))), append(s.raw, pr)
+			r = sample{time: r.time, flags: _FLAG_RAW}
+		}
+		s.times = append(s.times, r.time)
+		s.values = append(s.values, r.value)
+		s.flags = append(s.flags, r.flags)
+		s.losses = append(s.losses, r.loss)
+		s.probed = append(s.probed, r.probed)
+		s.received = append(s.received, r.received)
+		s.zones = append(s.zones, r.zone)
+	}
+	return s
+}
+
+// At returns the ping result at i
+func (s Series) At(i int) PingRet {
+	if s.flags[i]&_FLAG_RAW != 0 {
+		return s.raw[sort.Search(len(s.rawAt), func(j int) bool { return int(s.rawAt[j]) >= i })]
+	}
+	return sample{time: s.times[i], value: s.values[i], flags: s.flags[i], loss: s.losses[i], probed: s.probed[i], received: s.received[i], zone: s.zones[i]}.pingRet()
+}
+
+// TimeAt returns Time of the ping result at i
+func (s Series) TimeAt(i int) string {
+	if s.flags[i]&_FLAG_RAW != 0 {
+		return s.At(i).Time
+	}
+	return time.Unix(s.times[i], 0).UTC().Format(_PING_TIME_LAYOUT)
+}
+
+// Last returns the latest ping result, false if there is none
+func (s Series) Last() (PingRet, bool) {
+	if s.Len() == 0 {
+		return PingRet{}, false
+	}
+	return s.At(s.Len() - 1), true
+}
+
+// from returns the ping results from i on, sharing the columns
+func (s Series) from(i int) Series {
+	if i == 0 {
+		return s
+	}
+	r := Series{times: s.times[i:], values: s.values[i:], flags: s.flags[i:], losses: s.losses[i:], probed: s.probed[i:], received: s.received[i:], zones: s.zones[i:]}
+	if k := sort.Search(len(s.rawAt), func(j int) bool { return int(s.rawAt[j]) >= i }); k < len(s.rawAt) {
+		r.raw, r.rawAt = s.raw[k:], make([]int32, len(s.rawAt)-k)
+		for j, at := range s.rawAt[k:] {
+			r.rawAt[j] = at - int32(i)
+		}
+	}
+	return r
+}
+
+// PingRets decodes the ping results from i to j
+func (s Series) PingRets(i, j int) []PingRet {
+	prs := make([]PingRet, 0, j-i)
+	for ; i < j; i++ {
+		prs = append(prs, s.At(i))
+	}
+	return prs
+}
+
+// All decodes all ping results
+func (s Series) All() []PingRet { return s.PingRets(0, s.Len()) }
+
+// the latency of the ping result at i, false if it is down, the padding included
+func (s Series) up(i int) (float64, bool) {
+	if s.flags[i]&_FLAG_RAW != 0 {
+		pr := s.At(i)
+		p, err := strconv.ParseFloat(pr.Ping, 64)
+		return p, err == nil && pr.Ping != _DEFAULT_PING
+	}
+	// 0 is formatted as _DEFAULT_PING
+	return float64(s.values[i]), s.values[i] != 0
+}
+
+// the number of the ping results from i, those down and the sum of the latencies of the others
+// the ping results kept aside are as rare as the transactions, so the loop stays over the latencies
+func (s Series) stats(i int) (n, down int, sum float64) {
+	if len(s.rawAt) == 0 {
+		for _, v := range s.values[i:] {
+			if v == 0 {
+				down++
+			} else {
+				sum += float64(v)
+			}
+		}
+		return len(s.values) - i, down, sum
+	}
+	for j := i; j < s.Len(); j++ {
+		if p, ok := s.up(j); ok {
+			sum += p
+		} else {
+			down++
+		}
+	}
+	return s.Len() - i, down, sum
+}
+
+// server -> location -> the ping results kept in memory
+type columnar map[string]map[string]Series
+
+func columnarOf(servers Servers) columnar { return columnarOfParallel(servers, 1) }
+
+// the servers are encoded by at most limit goroutines, parsing every ping result takes most of the startup after reading them
+func columnarOfParallel(servers Servers, limit int) columnar {
+	c := make(columnar, len(servers))
+	names := make([]string, 0, len(servers))
+	for server, locations := range servers {
+		c[server] = make(map[string]Series, len(locations))
+		names = append(names, server)
+	}
+	parallel(len(names), limit, func(i int) {
+		for location, prs := range servers[names[i]] {
+			c[names[i]][location] = seriesOf(prs)
+		}
+	})
+	return c
+}
+
+// the ping results decoded
+func (c columnar) servers() Servers {
+	servers := make(Servers, len(c))
+	for server, locations := range c {
+		servers[server] = make(map[string][]PingRet, len(locations))
+		for location, s := range locations {
+			servers[server][location] = s.All()
+		}
+	}
+	return servers
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gogames/watchdog/main-server/i18n"
+)
+
+const (
+	UNIT_MILLISECOND = "ms"
+	UNIT_SECOND      = "s"
+
+	CHART_LINE = "line"
+	CHART_AREA = "area"
+	CHART_BAR  = "bar"
+)
+
+// Settings are the display preferences of the user, kept by the store so that they follow the user across devices
+// empty values are left to the defaults of the frontend
+type Settings struct {
+	// IANA name, like "Europe/Berlin"
+	Timezone string `json:"timezone,omitempty"`
+	// unit of the latency, ms or s
+	Units string `json:"units,omitempty"`
+	// time range of the charts by default, like "6h" or "7d"
+	DefaultRange string `json:"default_range,omitempty"`
+	// language tag of the api errors and the notifications, like zh or pt-BR, the -locale of the main server if empty
+	Locale   string       `json:"locale,omitempty"`
+	Chart    ChartOptions `json:"chart"`
+	Branding Branding     `json:"branding"`
+}
+
+type ChartOptions struct {
+	// line, area or bar
+	Type   string `json:"type,omitempty"`
+	Smooth bool   `json:"smooth"`
+	// logarithmic latency axis
+	LogScale bool `json:"log_scale"`
+	// the maximum points of a series, the results are downsampled to
+	MaxPoints int `json:"max_points,omitempty"`
+}
+
+// Branding is the name, logo and colors of the status pages rendering the results shared by the user, who stands for the organization
+// empty values are left to the defaults of the frontend
+type Branding struct {
+	Name string `json:"name,omitempty"`
+	// https url or data url of an image
+	Logo string `json:"logo,omitempty"`
+	// like #1a73e8
+	PrimaryColor    string `json:"primary_color,omitempty"`
+	BackgroundColor string `json:"background_color,omitempty"`
+	TextColor       string `json:"text_color,omitempty"`
+}
+
+const (
+	_MAX_BRANDING_NAME = 64
+	// the logo is kept with the user, a data url larger than it should be hosted
+	_MAX_BRANDING_LOGO = 1 << 16
+)
+
+var (
+	colorRegexp   = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+	dataURLRegexp = regexp.MustCompile(`^data:image/(png|jpeg|gif|webp|svg\+xml);base64,[A-Za-z0-9+/]+=*$`)
+)
+
+func (b Branding) Validate() error {
+	if utf8.RuneCountInString(b.Name) > _MAX_BRANDING_NAME {
+		return fmt.Errorf("branding name should be at most %v characters", _MAX_BRANDING_NAME)
+	}
+	if b.Logo != "" {
+		if len(b.Logo) > _MAX_BRANDING_LOGO {
+			return fmt.Errorf("branding logo should be at most %v bytes", _MAX_BRANDING_LOGO)
+		}
+		if u, err := url.Parse(b.Logo); (err != nil || u.Scheme != "https" || u.Host == "") && !dataURLRegexp.MatchString(b.Logo) {
+			return fmt.Errorf("branding logo should be an https url or a base64 data url of an image")
+		}
+	}
+	for name, color := range map[string]string{"primary": b.PrimaryColor, "background": b.BackgroundColor, "text": b.TextColor} {
+		if color != "" && !colorRegexp.MatchString(color) {
+			return fmt.Errorf("branding %v color %q should be like #1a73e8", name, color)
+		}
+	}
+	return nil
+}
+
+func (st Settings) Validate() error {
+	if _, err := time.LoadLocation(st.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %v", st.Timezone)
+	}
+	if err := i18n.Valid(st.Locale); err != nil {
+		return err
+	}
+	switch st.Units {
+	case "", UNIT_MILLISECOND, UNIT_SECOND:
+	default:
+		return fmt.Errorf("unknown units %v", st.Units)
+	}
+	if st.DefaultRange != "" {
+		if _, err := ParseRange(st.DefaultRange); err != nil {
+			return err
+		}
+	}
+	switch st.Chart.Type {
+	case "", CHART_LINE, CHART_AREA, CHART_BAR:
+	default:
+		return fmt.Errorf("unknown chart type %v", st.Chart.Type)
+	}
+	if st.Chart.MaxPoints < 0 {
+		return fmt.Errorf("max points %v should not be negative", st.Chart.MaxPoints)
+	}
+	return st.Branding.Validate()
+}
+
+// ParseRange parses a time range of time.ParseDuration or days, like "7d"
+func ParseRange(r string) (d time.Duration, err error) {
+	if days := strings.TrimSuffix(r, "d"); days != r {
+		var n int
+		if n, err = strconv.Atoi(days); err == nil {
+			d = time.Duration(n) * 24 * time.Hour
+		}
+	} else {
+		d, err = time.ParseDuration(r)
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid time range %v", r)
+	}
+	return
+}
+
+func (s *Store) GetSettings(username string) (st Settings, err error) {
+	s.withReadLock(func() {
+		if u, ok := s.users[username]; !ok {
+			err = fmt.Errorf("User %v not exist", username)
+		} else {
+			st = u.Settings
+		}
+	})
+	return
+}
+
+func (s *Store) SetSettings(ctx context.Context, username string, st Settings) (err error) {
+	if err = st.Validate(); err != nil {
+		return
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				u.Settings = st
+				return nil
+			})
+		})
+	})
+	return
+}
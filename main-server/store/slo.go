@@ -0,0 +1,196 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+)
+
+const (
+	DEFAULT_SLO_DAYS = 30
+	MAX_SLO_DAYS     = 366
+	// the burn rate exhausting the budget of 30 days in 2 days
+	DEFAULT_FAST_BURN = 14.4
+)
+
+// SLO is an objective of the server over the rolling window of the last Days days, DEFAULT_SLO_DAYS if zero
+// a ping result is good if it is up and, unless Latency is zero, at most Latency milliseconds, which should be one of LATENCY_BUCKETS
+// like 99% of the ping results under 80 ms monthly, Objective 0.99 and Latency 80
+// the alert fires once the burn rate of the last hour reaches FastBurn, DEFAULT_FAST_BURN if zero, never if negative
+type SLO struct {
+	Name      string  `json:"name"`
+	Server    string  `json:"server"`
+	Objective float64 `json:"objective"`
+	Latency   float64 `json:"latency,omitempty"`
+	Days      int     `json:"days,omitempty"`
+	FastBurn  float64 `json:"fast_burn,omitempty"`
+}
+
+func (o SLO) Validate() error {
+	if o.Name == "" {
+		return fmt.Errorf("slo name can not be empty")
+	}
+	if o.Objective <= 0 || o.Objective >= 1 {
+		return fmt.Errorf("objective of slo %v should be between 0 and 1", o.Name)
+	}
+	if o.Latency != 0 {
+		if i := sort.SearchFloat64s(LATENCY_BUCKETS, o.Latency); i == len(LATENCY_BUCKETS) || LATENCY_BUCKETS[i] != o.Latency {
+			return fmt.Errorf("latency of slo %v should be one of %v", o.Name, LATENCY_BUCKETS)
+		}
+	}
+	if o.Days < 0 || o.Days > MAX_SLO_DAYS {
+		return fmt.Errorf("days of slo %v should be between 1 and %v", o.Name, MAX_SLO_DAYS)
+	}
+	return nil
+}
+
+func (o SLO) days() int {
+	if o.Days == 0 {
+		return DEFAULT_SLO_DAYS
+	}
+	return o.Days
+}
+
+func (o SLO) fastBurn() float64 {
+	if o.FastBurn == 0 {
+		return DEFAULT_FAST_BURN
+	}
+	return o.FastBurn
+}
+
+// the good ones of the ping results of the aggregates
+// the aggregates without buckets are skipped by latency objectives
+func (o SLO) good(all map[string][]Aggregate) (total, good int64) {
+	for _, as := range all {
+		for _, a := range as {
+			if o.Latency == 0 {
+				total, good = total+a.Count, good+a.Count-a.Down
+			} else if n, ok := a.Under(o.Latency); ok {
+				total, good = total+a.Count, good+n
+			}
+		}
+	}
+	return
+}
+
+// SLOStatus is the state of the SLO of the daily and hourly aggregates of every location
+type SLOStatus struct {
+	SLO   SLO   `json:"slo"`
+	Total int64 `json:"total"`
+	Good  int64 `json:"good"`
+	// the ratio of the good ping results in the window, 1 if there is none
+	SLI float64 `json:"sli"`
+	// the ratio of the error budget of the window left, negative once it is exhausted
+	Remaining float64 `json:"remaining"`
+	// the ratio of the bad ping results of the last hour to the budget, at 1 the budget lasts exactly the window
+	BurnRate    float64 `json:"burn_rate"`
+	FastBurning bool    `json:"fast_burning"`
+}
+
+// SetSLO adds the SLO of the server monitored by the user or replaces the one of the same name
+func (s *Store) SetSLO(ctx context.Context, username string, o SLO) (err error) {
+	if err = o.Validate(); err != nil {
+		return
+	}
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				if !u.MonitorServers[o.Server] {
+					return fmt.Errorf("server %v is not monitored by %v", o.Server, username)
+				}
+				slos := make([]SLO, 0, len(u.SLOs)+1)
+				for _, old := range u.SLOs {
+					if old.Name != o.Name {
+						slos = append(slos, old)
+					}
+				}
+				u.SLOs = append(slos, o)
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// DeleteSLO removes the SLO of the user
+func (s *Store) DeleteSLO(ctx context.Context, username, name string) (err error) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				slos := make([]SLO, 0, len(u.SLOs))
+				for _, o := range u.SLOs {
+					if o.Name != name {
+						slos = append(slos, o)
+					}
+				}
+				if len(slos) == len(u.SLOs) {
+					return fmt.Errorf("slo %v not exist", name)
+				}
+				u.SLOs = slos
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// GetSLOs returns the status of every SLO of the user at now, sorted by name
+func (s *Store) GetSLOs(username string, now time.Time) (ret []SLOStatus, err error) {
+	var slos []SLO
+	s.withReadLock(func() {
+		u, ok := s.users[username]
+		if !ok {
+			err = fmt.Errorf("User %v not exist", username)
+			return
+		}
+		slos = u.SLOs
+	})
+	if err != nil {
+		return
+	}
+	ret = make([]SLOStatus, 0, len(slos))
+	for _, o := range slos {
+		st := SLOStatus{SLO: o, SLI: 1, Remaining: 1}
+		days, err := s.getAggregates(username, o.Server, RESOLUTION_DAY, now.AddDate(0, 0, 1-o.days()).Format(_PING_TIME_LAYOUT), "")
+		if err != nil {
+			return nil, err
+		}
+		hours, err := s.getAggregates(username, o.Server, RESOLUTION_HOUR, now.Add(-time.Hour).Format(_PING_TIME_LAYOUT), "")
+		if err != nil {
+			return nil, err
+		}
+		budget := 1 - o.Objective
+		if st.Total, st.Good = o.good(days); st.Total > 0 {
+			st.SLI = float64(st.Good) / float64(st.Total)
+			st.Remaining = 1 - (1-st.SLI)/budget
+		}
+		if total, good := o.good(hours); total > 0 {
+			st.BurnRate = float64(total-good) / float64(total) / budget
+		}
+		st.FastBurning = o.fastBurn() > 0 && st.BurnRate >= o.fastBurn()
+		ret = append(ret, st)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].SLO.Name < ret[j].SLO.Name })
+	return
+}
+
+// SLOSubjects returns the users with SLOs of the servers and their channels
+func (s *Store) SLOSubjects() (subjects []alert.Subject) {
+	s.withReadLock(func() {
+		for username, u := range s.users {
+			if len(u.SLOs) == 0 {
+				continue
+			}
+			subjects = append(subjects, alert.Subject{
+				Username: username,
+				Channels: u.Channels,
+				Schedule: u.Schedule,
+				Locale:   u.Settings.Locale,
+			})
+		}
+	})
+	return
+}
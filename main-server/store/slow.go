@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SlowOp aggregates the operations taking longer than the slow threshold
+type SlowOp struct {
+	Op          string        `json:"op"`
+	Count       int64         `json:"count"`
+	Max         time.Duration `json:"max"`
+	Total       time.Duration `json:"total"`
+	Last        time.Time     `json:"last"`
+	LastContext string        `json:"last_context"`
+}
+
+type slowOps struct {
+	threshold int64
+	ops       map[string]*SlowOp
+	mu        sync.Mutex
+}
+
+// operations taking longer than d are logged and aggregated, 0 disables it
+func (s *Store) SetSlowThreshold(d time.Duration) *Store {
+	atomic.StoreInt64(&s.slow.threshold, int64(d))
+	return s
+}
+
+// SlowOps returns at most n slow operations, the slowest first
+func (s *Store) SlowOps(n int) []SlowOp {
+	s.slow.mu.Lock()
+	ret := make([]SlowOp, 0, len(s.slow.ops))
+	for _, op := range s.slow.ops {
+		ret = append(ret, *op)
+	}
+	s.slow.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Max > ret[j].Max })
+	if n > 0 && len(ret) > n {
+		ret = ret[:n]
+	}
+	return ret
+}
+
+func (s *Store) isSlow(d time.Duration) bool {
+	threshold := atomic.LoadInt64(&s.slow.threshold)
+	return threshold > 0 && int64(d) > threshold
+}
+
+// attrs are key value pairs describing the operation
+func (s *Store) observeSlow(ctx context.Context, op string, d time.Duration, attrs ...interface{}) {
+	if !s.isSlow(d) {
+		return
+	}
+	s.logger.WarnContext(ctx, "slow store operation", append([]interface{}{"op", op, "duration", d}, attrs...)...)
+	s.slow.mu.Lock()
+	defer s.slow.mu.Unlock()
+	if s.slow.ops == nil {
+		s.slow.ops = make(map[string]*SlowOp)
+	}
+	so, ok := s.slow.ops[op]
+	if !ok {
+		so = &SlowOp{Op: op}
+		s.slow.ops[op] = so
+	}
+	so.Count++
+	so.Total += d
+	if d > so.Max {
+		so.Max = d
+	}
+	so.Last = time.Now()
+	so.LastContext = formatAttrs(attrs)
+}
+
+func formatAttrs(attrs []interface{}) string {
+	pairs := make([]string, 0, len(attrs)/2)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%v", attrs[i], attrs[i+1]))
+	}
+	return strings.Join(pairs, " ")
+}
+
+// the Store method holding the lock, skipping the lock helpers
+func lockHolder() string {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		name := frame.Function[strings.LastIndex(frame.Function, ".(*Store).")+1:]
+		if i := strings.Index(name, ".func"); i >= 0 {
+			name = name[:i]
+		}
+		switch name {
+		case "(*Store).withWriteLock", "(*Store).withReadLock", "(*Store).locked", "(*Store).do":
+		default:
+			if strings.HasPrefix(name, "(*Store).") || !more {
+				return strings.TrimPrefix(name, "(*Store).")
+			}
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
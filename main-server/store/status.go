@@ -0,0 +1,195 @@
+package store
+
+import (
+	"fmt"
+	"time"
+)
+
+// the status of a server
+const (
+	STATUS_UNKNOWN  = "unknown"
+	STATUS_UP       = "up"
+	STATUS_DEGRADED = "degraded"
+	STATUS_DOWN     = "down"
+)
+
+// StatusRules classify a server by the latest ping results of each location
+// a location is down if none of its latest Samples has a response, degraded if the ratio without response reaches LossRatio
+// or the average ping of the responses exceeds Latency
+// the server is down if the ratio of the locations down reaches DownRatio, degraded if any location is down or degraded
+// zero values are the defaults
+type StatusRules struct {
+	Samples   int     `json:"samples"`
+	LossRatio float64 `json:"loss_ratio"`
+	// in milliseconds, no location is degraded by the latency if zero
+	Latency   float64 `json:"latency"`
+	DownRatio float64 `json:"down_ratio"`
+}
+
+var DefaultStatusRules = StatusRules{Samples: 3, LossRatio: 0.5, DownRatio: 1}
+
+func (r StatusRules) Validate() error {
+	if r.Samples < 0 || r.Latency < 0 {
+		return fmt.Errorf("samples and latency of the status rules should not be negative")
+	}
+	if r.LossRatio < 0 || r.LossRatio > 1 || r.DownRatio < 0 || r.DownRatio > 1 {
+		return fmt.Errorf("loss_ratio and down_ratio of the status rules should be in [0, 1]")
+	}
+	return nil
+}
+
+func (r StatusRules) withDefaults() StatusRules {
+	if r.Samples == 0 {
+		r.Samples = DefaultStatusRules.Samples
+	}
+	if r.LossRatio == 0 {
+		r.LossRatio = DefaultStatusRules.LossRatio
+	}
+	if r.DownRatio == 0 {
+		r.DownRatio = DefaultStatusRules.DownRatio
+	}
+	return r
+}
+
+// ServerStatus is the status of a server and of each location, Since is when the status of the server last changed
+type ServerStatus struct {
+	Status    string            `json:"status"`
+	Since     time.Time         `json:"since"`
+	Locations map[string]string `json:"locations"`
+}
+
+// the status of the location by its latest ping results
+func (r StatusRules) location(series Series) string {
+	start := 0
+	if series.Len() > r.Samples {
+		start = series.Len() - r.Samples
+	}
+	n, lost, sum := series.stats(start)
+	switch {
+	case n == 0:
+		return STATUS_UNKNOWN
+	case lost == n:
+		return STATUS_DOWN
+	case float64(lost)/float64(n) >= r.LossRatio:
+		return STATUS_DEGRADED
+	case r.Latency > 0 && sum/float64(n-lost) > r.Latency:
+		return STATUS_DEGRADED
+	}
+	return STATUS_UP
+}
+
+// the status of the server by the ping results of its locations, Since is not set
+func (r StatusRules) classify(locations map[string]Series) ServerStatus {
+	st := ServerStatus{Status: STATUS_UNKNOWN, Locations: make(map[string]string, len(locations))}
+	known, down, degraded := 0, 0, 0
+	for location, series := range locations {
+		ls := r.location(series)
+		st.Locations[location] = ls
+		switch ls {
+		case STATUS_UNKNOWN:
+			continue
+		case STATUS_DOWN:
+			down++
+		case STATUS_DEGRADED:
+			degraded++
+		}
+		known++
+	}
+	switch {
+	case known == 0:
+	case float64(down)/float64(known) >= r.DownRatio:
+		st.Status = STATUS_DOWN
+	case down > 0 || degraded > 0:
+		st.Status = STATUS_DEGRADED
+	default:
+		st.Status = STATUS_UP
+	}
+	return st
+}
+
+// SetStatusRules sets the rules classifying the servers, it should be set before the store engine so that the load classifies by them
+func (s *Store) SetStatusRules(r StatusRules) *Store {
+	s.withWriteLock(func() { s.statusRules = r.withDefaults() })
+	return s
+}
+
+// the status of every server, classified on load
+func (s *Store) classifyServers(servers columnar, now time.Time) map[string]ServerStatus {
+	rules := s.statusRules.withDefaults()
+	ret := make(map[string]ServerStatus, len(servers))
+	for server, locations := range servers {
+		st := rules.classify(locations)
+		st.Since = now
+		ret[server] = st
+	}
+	return ret
+}
+
+// classify the server again after its ping results changed, a change is recorded in the feed
+// should be invoked with write lock held
+func (s *Store) updateStatus(server string) {
+	st := s.statusRules.withDefaults().classify(s.servers[server])
+	old, ok := s.status[server]
+	if ok && old.Status == st.Status {
+		if sameLocations(old.Locations, st.Locations) {
+			return
+		}
+		st.Since = old.Since
+	} else {
+		st.Since = time.Now()
+		s.logger.Info("server status changed", "server", server, "from", old.Status, "to", st.Status)
+	}
+	if s.status == nil {
+		s.status = make(map[string]ServerStatus)
+	}
+	s.status[server] = st
+	s.feed.record(FeedEvent{Server: server, Status: &st})
+}
+
+func sameLocations(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for location, st := range a {
+		if b[location] != st {
+			return false
+		}
+	}
+	return true
+}
+
+// GetStatus returns the status of the server monitored by the user, unknown before the first ping result
+func (s *Store) GetStatus(username, server string) (st ServerStatus, err error) {
+	s.withReadLock(func() {
+		if _, err = s.getMonitorResult(username, server); err != nil {
+			return
+		}
+		st = s.serverStatus(server)
+	})
+	return
+}
+
+// GetStatuses returns the status of every server monitored by the user
+func (s *Store) GetStatuses(username string) (ret map[string]ServerStatus, err error) {
+	s.withReadLock(func() {
+		u, ok := s.users[username]
+		if !ok {
+			err = fmt.Errorf("User %v not exist", username)
+			return
+		}
+		ret = make(map[string]ServerStatus, len(u.MonitorServers))
+		for server := range u.MonitorServers {
+			ret[server] = s.serverStatus(server)
+		}
+	})
+	return
+}
+
+// the locations are replaced rather than modified, so the status is returned as it is
+// should be invoked with read lock held
+func (s *Store) serverStatus(server string) ServerStatus {
+	if st, ok := s.status[server]; ok {
+		return st
+	}
+	return ServerStatus{Status: STATUS_UNKNOWN, Locations: map[string]string{}}
+}
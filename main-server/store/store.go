@@ -1,16 +1,21 @@
 package store
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/gogames/watchdog/main-server/trace"
 )
 
 var (
 	_ERROR_INCORRECT_PASSWORD = errors.New("incorrect password")
-	engines                   = make(map[string]func() StoreEngine)
 )
 
 const (
@@ -18,80 +23,192 @@ const (
 	_DEFAULT_PING        = "0.000"
 )
 
-func Register(engineName string, f func() StoreEngine) error {
-	if _, ok := engines[engineName]; ok {
-		return fmt.Errorf("engine %v already exist", engineName)
-	}
-	engines[engineName] = f
-	return nil
-}
-
 type StoreEngine interface {
-	LoadConfig(config string)
+	// LoadConfig returns the error of an invalid config, which stops the main server at startup
+	LoadConfig(config EngineConfig) error
 	Init() (Servers, Users, map[string]int64)
 
-	WriteUser(username string, u *User) error
-	BatchWritePingRets(server, location string, prs []PingRet) error
+	// the writes should return once ctx is done, the store holds the write lock meanwhile
+	WriteUser(ctx context.Context, username string, u *User) error
+	BatchWritePingRets(ctx context.Context, server, location string, prs []PingRet) error
 }
 
 type Store struct {
-	servers    Servers
+	servers    columnar
 	users      Users
 	allServers map[string]int64
-	rwl        sync.RWMutex
+	// "provider subject" -> username
+	externalIds map[string]string
+	// organization -> its members, and whether the ping results are isolated between them, see ISOLATION_ORGANIZATION
+	organizations map[string][]string
+	isolated      bool
+	rwl           sync.RWMutex
 
 	storeEngine StoreEngine
+	// the opt-outs by target, and the servers they kicked from the ping loop
+	optOuts  []OptOut
+	optedOut map[string]bool
 
+	// the servers to start and stop pinging, they never block the store as the servers beyond their capacity are queued
 	AddServerChan  chan string
 	KickServerChan chan string
+	addQueue       *serverQueue
+	kickQueue      *serverQueue
 
 	closeCounter *int64
 	isClosed     bool
+
+	counters counters
+	slow     slowOps
+	feed     *feed
+	cache    *responseCache
+	matrix   latencyMatrix
+	// continuous aggregates of the ping results
+	aggregates aggregates
+	// server -> the addresses its hostname resolved to
+	dns map[string][]Resolution
+	// of the last load from the engine
+	recovery RecoveryReport
+	readOnly readOnly
+	// hot ping results in memory, warm in the engine and the aggregates in the cold tier
+	tiers Tiers
+	// the latest entries of the audit log
+	auditLog []AuditEntry
+	// server -> its status by the latest ping results
+	status      map[string]ServerStatus
+	statusRules StatusRules
+	// engine writes are aborted after it if positive
+	writeTimeout time.Duration
+	retry        Retry
+	breaker      breaker
+	// api and ingestion volume of the users
+	usage usage
+	// when the lease held was acquired or renewed last, see AcquireLeadership
+	leaseMu sync.Mutex
+	leased  time.Time
+	// username -> the recent alerts and messages shown by the web ui, in the order posted, see PostMessage
+	inboxes map[string][]Message
+	// the inboxes are written to the engine one by one outside the lock, see writeInboxes
+	inboxWrite sync.Mutex
+	// the messages older are dropped from the inboxes, see SetInboxRetention
+	inboxRetention time.Duration
+	// when the codes of the last hour were sent to the phones of all the users, see SetPhoneCodeLimit
+	phoneCodes     []time.Time
+	phoneCodeLimit int
+	// the servers added are rejected by it, like those of the blocklist, see SetTargetValidator
+	validateTarget func(server string) error
+	logger         *slog.Logger
+	tracer         trace.Tracer
 }
 
-func NewStore() *Store { return &Store{closeCounter: new(int64)} }
+func NewStore() *Store {
+	cache := newResponseCache()
+	return &Store{closeCounter: new(int64), feed: newFeed(cache), cache: cache, logger: withRequestId(slog.Default()), tracer: trace.Noop}
+}
 
-func (s *Store) SetStoreEngine(engineName string, config string) *Store {
-	if f, ok := engines[engineName]; !ok {
-		panic(fmt.Errorf("store engine %v does not exist", engineName))
-	} else {
-		s.storeEngine = f()
-	}
+func (s *Store) SetTracer(t trace.Tracer) *Store {
+	s.tracer = t
+	return s
+}
+
+// SetWriteTimeout bounds every engine write, in addition to the deadline of the context of the operation
+func (s *Store) SetWriteTimeout(d time.Duration) *Store {
+	s.writeTimeout = d
+	return s
+}
+
+// SetTargetValidator rejects the servers the users can not monitor, whichever path adds them, every server is accepted if nil
+func (s *Store) SetTargetValidator(f func(server string) error) *Store {
+	s.withWriteLock(func() { s.validateTarget = f })
+	return s
+}
 
-	s.storeEngine.LoadConfig(config)
+func (s *Store) checkTarget(server string) (err error) {
+	s.withReadLock(func() {
+		if s.validateTarget != nil {
+			err = s.validateTarget(server)
+		}
+	})
+	return
+}
 
-	s.servers, s.users, s.allServers = s.storeEngine.Init()
+// the records of the operations carry the request id of their context, see WithRequestId
+func (s *Store) SetLogger(l *slog.Logger) *Store {
+	s.logger = withRequestId(l)
+	return s
+}
 
-	var l = len(s.allServers)
-	if l < _MIN_LEN_SERVER_CHAN {
-		l = _MIN_LEN_SERVER_CHAN
+func (s *Store) SetStoreEngine(engineName string, config EngineConfig) *Store {
+	e, err := NewEngine(engineName, config)
+	if err != nil {
+		panic(err)
 	}
-	s.AddServerChan = make(chan string, l)
-	for server := range s.allServers {
-		s.AddServerChan <- server
+	return s.SetEngine(e)
+}
+
+// SetEngine migrates and initializes the engine loaded with its config, e.g. an engine wrapped by the tests
+func (s *Store) SetEngine(e StoreEngine) *Store {
+	s.storeEngine = e
+	if err := s.migrate(); err != nil {
+		panic(fmt.Errorf("can not migrate store engine: %v", err))
+	}
+
+	ld := s.load(false)
+	s.servers, s.users, s.allServers = ld.series, ld.users, ld.allServers
+	s.aggregates, s.dns, s.recovery, s.auditLog, s.status = ld.aggregates, ld.dns, ld.report, ld.audit, ld.status
+	s.inboxes = ld.inboxes
+	if err := s.writeInboxes(context.Background(), ld.movedInboxes); err != nil {
+		s.logger.Warn("can not move the inboxes out of the users", "users", len(ld.movedInboxes), "error", err)
 	}
 
-	s.KickServerChan = make(chan string, l)
+	s.indexExternalIds()
+	s.indexOrganizations()
+	s.loadOptOuts()
+
+	added, removed := s.assignmentDelta()
+	var l = max(len(added), _MIN_LEN_SERVER_CHAN)
+	s.AddServerChan, s.KickServerChan = make(chan string, l), make(chan string, l)
+	s.addQueue, s.kickQueue = newServerQueue(s.AddServerChan), newServerQueue(s.KickServerChan)
+	for _, server := range added {
+		s.addQueue.send(server)
+	}
+	for _, server := range removed {
+		s.kickQueue.send(server)
+	}
+	if err := s.writeAssignments(); err != nil {
+		s.logger.Warn("can not write the assignments", "error", err)
+	}
+	s.logger.Info("assignments resumed", "servers", len(s.allServers), "added", len(added), "removed", len(removed))
 
 	return s
 }
 
+// Close rejects new operations, waits for the operations in flight and closes the engine if it is an io.Closer
 func (s *Store) Close() {
 	if s.isClosed {
 		return
 	}
+	s.isClosed = true
 	for atomic.LoadInt64(s.closeCounter) > 0 {
 		time.Sleep(10 * time.Millisecond)
 	}
-	s.isClosed = true
+	if err := s.writeAssignments(); err != nil {
+		s.logger.Error("can not write the assignments", "error", err)
+	}
+	if c, ok := s.storeEngine.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			s.logger.Error("can not close store engine", "error", err)
+		}
+	}
 }
 
 func (s *Store) do(f func()) {
+	// acquire before checking, so that Close waits for the operations passing the check
+	s.acquire()
+	defer s.release()
 	if s.isClosed {
 		return
 	}
-	s.acquire()
-	defer s.release()
 	f()
 }
 
@@ -100,157 +217,310 @@ func (s *Store) acquire() { atomic.AddInt64(s.closeCounter, 1) }
 func (s *Store) release() { atomic.AddInt64(s.closeCounter, -1) }
 
 func (s *Store) withWriteLock(f func()) {
+	start := time.Now()
 	s.rwl.Lock()
 	defer s.rwl.Unlock()
+	defer s.locked(start)()
 	f()
 }
 
 func (s *Store) withReadLock(f func()) {
+	start := time.Now()
 	s.rwl.RLock()
 	defer s.rwl.RUnlock()
+	defer s.locked(start)()
 	f()
 }
 
+// count the time waiting for the lock since start, the returned function counts the time holding it
+func (s *Store) locked(start time.Time) func() {
+	acquired := time.Now()
+	atomic.AddInt64(&s.counters.lockAcquires, 1)
+	atomic.AddInt64(&s.counters.lockWaitNanos, int64(acquired.Sub(start)))
+	return func() {
+		d := time.Since(acquired)
+		atomic.AddInt64(&s.counters.lockHoldNanos, int64(d))
+		if s.isSlow(d) {
+			s.observeSlow(context.Background(), "lock.hold", d, "holder", lockHolder())
+		}
+	}
+}
+
 // user operations
 func (s *Store) GetUser(username string) (u *User) {
 	s.withReadLock(func() { u = s.users[username] })
 	return
 }
 
-func (s *Store) UpdatePassword(username string, oldpassword, newpassword string) (err error) {
+func (s *Store) GetUsernames() (usernames []string) {
+	s.withReadLock(func() {
+		usernames = make([]string, 0, len(s.users))
+		for username := range s.users {
+			usernames = append(usernames, username)
+		}
+	})
+	return
+}
+
+// GetServers returns the servers monitored by any user
+func (s *Store) GetServers() (servers []string) {
+	s.withReadLock(func() {
+		servers = make([]string, 0, len(s.allServers))
+		for server := range s.allServers {
+			if !s.optedOut[server] {
+				servers = append(servers, server)
+			}
+		}
+	})
+	return
+}
+
+func (s *Store) UpdatePassword(ctx context.Context, username string, oldpassword, newpassword string) (err error) {
 	s.do(func() {
-		s.withReadLock(func() {
-			if u, ok := s.users[username]; ok {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
 				if u.Password != oldpassword {
-					err = _ERROR_INCORRECT_PASSWORD
-					return
+					return _ERROR_INCORRECT_PASSWORD
 				}
 				u.Password = newpassword
-				err = s.storeEngine.WriteUser(username, u)
-			}
+				return nil
+			})
+		})
+	})
+	return
+}
+
+// set the password without checking the old one
+func (s *Store) setPassword(ctx context.Context, username string, password string) (err error) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			err = s.updateUser(ctx, username, func(u *User) error {
+				u.Password = password
+				return nil
+			})
 		})
 	})
 	return
 }
 
-func (s *Store) AddUser(username string, password string) (err error) {
+func (s *Store) AddUser(ctx context.Context, username string, password string) (err error) {
 	s.do(func() {
 		s.withWriteLock(func() {
 			if _, ok := s.users[username]; ok {
 				err = fmt.Errorf("User %v already exist", username)
-			} else {
-				s.users[username] = newUser()
-				s.users[username].Password = password
-				err = s.storeEngine.WriteUser(username, s.users[username])
+				return
 			}
+			err = s.commitUser(ctx, username, newUser(), func(u *User) error {
+				u.Password = password
+				return nil
+			})
 		})
 	})
 	return
 }
 
 // monitor operations
-func (s *Store) DeleteMonitorServer(username string, server string) (err error) {
+func (s *Store) DeleteMonitorServer(ctx context.Context, username string, server string) (err error) {
 	s.do(func() {
 		s.withWriteLock(func() {
-			if u, ok := s.users[username]; !ok {
-				err = fmt.Errorf("user %v not exist", username)
-			} else {
-				if u.MonitorServers[server] {
-					delete(u.MonitorServers, server)
-					s.allServers[server]--
+			var monitored bool
+			if err = s.updateUser(ctx, username, func(u *User) error {
+				if monitored = u.MonitorServers[server]; !monitored {
+					return nil
 				}
-				if s.allServers[server] <= 0 {
-					delete(s.allServers, server)
-					s.KickServerChan <- server
-				}
-				err = s.storeEngine.WriteUser(username, u)
+				forgetServer(u, server)
+				return nil
+			}); err != nil {
+				return
+			}
+			if monitored {
+				s.allServers[server]--
+			}
+			if s.allServers[server] <= 0 {
+				delete(s.allServers, server)
+				delete(s.dns, server)
+				s.kickQueue.send(server)
 			}
 		})
 	})
 	return
 }
 
-func (s *Store) AddMonitorServer(username string, server string) (err error) {
+func (s *Store) AddMonitorServer(ctx context.Context, username string, server string) (err error) {
+	if err = s.checkTarget(server); err != nil {
+		return
+	}
 	s.do(func() {
-		s.withReadLock(func() {
-			if u, ok := s.users[username]; !ok {
-				err = fmt.Errorf("User %v not exist", username)
-			} else {
+		s.withWriteLock(func() {
+			if err = s.updateUser(ctx, username, func(u *User) error {
 				if u.MonitorServers[server] {
-					err = fmt.Errorf("%v is already in monitoring list", server)
-					return
+					return fmt.Errorf("%v is already in monitoring list", server)
 				}
 				u.MonitorServers[server] = true
-				if _, ok := s.allServers[server]; !ok {
-					s.AddServerChan <- server
-				}
-				s.allServers[server]++
-				err = s.storeEngine.WriteUser(username, u)
+				return nil
+			}); err != nil {
+				return
 			}
+			s.monitorAdded([]string{server})
 		})
 	})
 	return
 }
 
-func (s *Store) AppendPingRet(server string, location string, pr PingRet) (err error) {
+func (s *Store) AppendPingRet(ctx context.Context, server string, location string, pr PingRet) (err error) {
+	return s.AppendPingRets(ctx, server, location, []PingRet{pr})
+}
+
+// AppendPingRets appends the ping results of the server at the location in the order of their time,
+// those older than the latest one stored, like the results spooled by a probe, are merged by one rewrite of the series
+func (s *Store) AppendPingRets(ctx context.Context, server string, location string, prs []PingRet) (err error) {
+	sp := s.tracer.Start("Store.AppendPingRet", "server", server, "location", location, "count", len(prs))
+	defer func() { sp.End(err) }()
+	if len(prs) == 0 {
+		return
+	}
+	sorted := append([]PingRet(nil), prs...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Time < sorted[j].Time })
 	s.do(func() {
+		wait := sp.Child("Store.lock.wait")
 		s.withWriteLock(func() {
+			wait.End(nil)
 			if s.allServers[server] <= 0 {
 				err = fmt.Errorf("server %v is not exist", server)
 				return
 			}
 			if _, ok := s.servers[server]; !ok {
-				s.servers[server] = make(map[string][]PingRet)
+				s.servers[server] = make(map[string]Series)
 			}
-			if _, ok := s.servers[server][location]; !ok {
-				s.servers[server][location] = make([]PingRet, 0)
-			}
-			// pad the ping results to ease work of front end, the silly chart
-			var (
-				maxLength   = 0
-				maxLocation string
-				padPrs      = make([]PingRet, 0)
-			)
-			// find the max
-			for loc, prs := range s.servers[server] {
-				if len(prs) > maxLength {
-					maxLength = len(prs)
-					maxLocation = loc
-				}
-			}
-			// check maxLength first, in case of runtime error index out of range
-			// if maxLength == 0, there is no need to pad ping results
-			if maxLength != 0 {
-				// get max length
-				if s.servers[server][maxLocation][maxLength-1].Time == pr.Time {
-					maxLength--
+			// the ping results the engine rejects while read only are buffered, see SetReadOnly
+			for {
+				var rest []PingRet
+				if rest, err = s.appendSorted(ctx, sp, server, location, sorted); err != ErrorReadOnly {
+					return
 				}
-				// pad default pingret to the location
-				for i := len(s.servers[server][location]); i < maxLength; i++ {
-					padPrs = append(padPrs, defaultPingRet(s.servers[server][maxLocation][i].Time))
+				var buffered bool
+				if buffered, err = s.bufferIfReadOnly(server, location, rest); buffered {
+					return
 				}
+				// writable again meanwhile
+				sorted = rest
 			}
-			padPrs = append(padPrs, pr)
-			s.servers[server][location] = append(s.servers[server][location], padPrs...)
-			err = s.storeEngine.BatchWritePingRets(server, location, padPrs)
 		})
 	})
 	return
 }
 
+// append the ping results in the order of their time, returns those not appended if the engine rejects them
+// should be invoked with write lock held
+func (s *Store) appendSorted(ctx context.Context, sp trace.Span, server, location string, sorted []PingRet) (rest []PingRet, err error) {
+	var late []PingRet
+	if n := s.servers[server][location].Len(); n > 0 {
+		// only the time of the latest one is decoded
+		last := s.servers[server][location].TimeAt(n - 1)
+		i := sort.Search(len(sorted), func(i int) bool { return sorted[i].Time >= last })
+		// delivered late by a ping node on a flaky link
+		late, sorted = sorted[:i], sorted[i:]
+	}
+	if len(late) > 0 {
+		if err = s.insertLatePingRets(ctx, server, location, late); err != nil {
+			return append(late, sorted...), err
+		}
+	}
+	for i, pr := range sorted {
+		// the ping node retries after network errors, the sample of the same time is inserted once
+		if n := s.servers[server][location].Len(); n > 0 && s.servers[server][location].TimeAt(n-1) == pr.Time {
+			atomic.AddInt64(&s.counters.pingRetsDuplicated, 1)
+			s.logger.DebugContext(ctx, "duplicated ping result", "server", server, "location", location, "time", pr.Time)
+			continue
+		}
+		if err = s.appendPingRet(ctx, sp, server, location, pr); err != nil {
+			return sorted[i:], err
+		}
+	}
+	return nil, nil
+}
+
+// append the ping result later than the latest one of the location
+// should be invoked with write lock held
+func (s *Store) appendPingRet(ctx context.Context, sp trace.Span, server, location string, pr PingRet) (err error) {
+	n := s.servers[server][location].Len()
+	// pad the ping results to ease work of front end, the silly chart
+	var (
+		maxLength   = 0
+		maxLocation string
+		padPrs      []PingRet
+	)
+	// find the max
+	for loc, series := range s.servers[server] {
+		if series.Len() > maxLength {
+			maxLength = series.Len()
+			maxLocation = loc
+		}
+	}
+	// check maxLength first, in case of runtime error index out of range
+	// if maxLength == 0, there is no need to pad ping results
+	if maxLength != 0 {
+		longest := s.servers[server][maxLocation]
+		// get max length
+		if longest.TimeAt(maxLength-1) == pr.Time {
+			maxLength--
+		}
+		// allocated at once, the feed keeps it so it is never reused
+		if maxLength > n {
+			padPrs = make([]PingRet, 0, maxLength-n+1)
+		}
+		// pad default pingret to the location
+		for i := n; i < maxLength; i++ {
+			padPrs = append(padPrs, defaultPingRet(longest.TimeAt(i)))
+		}
+	}
+	padPrs = append(padPrs, pr)
+	// the results are kept in memory once written, so that a failed write is not served
+	write := sp.Child("StoreEngine.BatchWritePingRets", "count", len(padPrs))
+	err = s.batchWritePingRets(ctx, server, location, padPrs)
+	write.End(err)
+	if err != nil {
+		return
+	}
+	s.servers[server][location] = s.servers[server][location].Append(padPrs...)
+	s.feed.record(FeedEvent{Server: server, Location: location, PingRets: padPrs})
+	s.aggregate(ctx, server, location, true, padPrs...)
+	s.updateStatus(server)
+	atomic.AddInt64(&s.counters.pingRetsAppended, 1)
+	return
+}
+
 func defaultPingRet(t string) PingRet { return PingRet{Time: t, Ping: _DEFAULT_PING} }
 
 func (s *Store) GetMonitorResult(username string, server string) (ret map[string][]PingRet, err error) {
+	sp := s.tracer.Start("Store.GetMonitorResult", "username", username, "server", server)
+	defer func() { sp.End(err) }()
+	wait := sp.Child("Store.lock.wait")
 	s.withReadLock(func() {
-		if u, ok := s.users[username]; !ok {
-			err = fmt.Errorf("User %v not exist", username)
-		} else {
-			if _, ok := u.MonitorServers[server]; ok {
-				ret = s.servers[server]
-			} else {
-				err = fmt.Errorf("You are not monitoring %v", server)
-			}
+		wait.End(nil)
+		var locations map[string]Series
+		if locations, err = s.getMonitorResult(username, server); err != nil {
+			return
+		}
+		// the map is encoded after the lock is released, while new locations may be added
+		ret = make(map[string][]PingRet, len(locations))
+		for location, series := range locations {
+			ret[location] = series.All()
 		}
 	})
 	return
 }
+
+// should be invoked with read lock held
+func (s *Store) getMonitorResult(username string, server string) (ret map[string]Series, err error) {
+	if u, ok := s.users[username]; !ok {
+		err = fmt.Errorf("User %v not exist", username)
+	} else {
+		if _, ok := u.MonitorServers[server]; ok {
+			ret = s.visible(username, server)
+		} else {
+			err = fmt.Errorf("You are not monitoring %v", server)
+		}
+	}
+	return
+}
@@ -1,39 +1,88 @@
 package store
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/main-server/filter"
+	"github.com/gogames/watchdog/probe"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
 )
 
+// the context of the operations of the tests
+var ctx = context.Background()
+
+func testConfig(dir string) EngineConfig {
+	return EngineConfig{"serversDir": dir + "/servers", "usersDir": dir + "/users"}
+}
+
+func newTestStore(t *testing.T) *Store {
+	dir := t.TempDir()
+	return NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir))
+}
+
+// newSeededTestStore opens a store over the state testStore expects left by an earlier run: newuser monitoring google.com
+func newSeededTestStore(t *testing.T) *Store {
+	dir := t.TempDir()
+	seed := NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir))
+	if err := seed.AddUser(ctx, "newuser", "HELLO"); err != nil {
+		t.Fatal(err)
+	}
+	if err := seed.AddMonitorServer(ctx, "newuser", "google.com"); err != nil {
+		t.Fatal(err)
+	}
+	seed.Close()
+	return NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir))
+}
+
 // test
 func testStore(t *testing.T) {
-	s := NewStore().SetStoreEngine(ENGINE_FILE, `{"serversDir":"tmpServers","usersDir":"tmpUsers"}`)
+	s := newSeededTestStore(t)
 
-	// if err := s.AddUser("newuser", "HELLO"); err != nil {
+	// if err := s.AddUser(ctx, "newuser", "HELLO"); err != nil {
 	// 	t.Error(err)
 	// }
 
-	if err := s.AddMonitorServer("newuser", "baidu.com"); err != nil {
+	if err := s.AddMonitorServer(ctx, "newuser", "baidu.com"); err != nil {
 		t.Error(err)
 	}
 
-	// if err := s.AddMonitorServer("newuser", "google.com"); err != nil {
+	// if err := s.AddMonitorServer(ctx, "newuser", "google.com"); err != nil {
 	// 	t.Error(err)
 	// }
 
-	if err := s.AddMonitorServer("newuser", "yahoo.com"); err != nil {
+	if err := s.AddMonitorServer(ctx, "newuser", "yahoo.com"); err != nil {
 		t.Error(err)
 	}
 
-	if err := s.DeleteMonitorServer("newuser", "baidu.com"); err != nil {
+	if err := s.DeleteMonitorServer(ctx, "newuser", "baidu.com"); err != nil {
 		t.Error(err)
 	}
 
-	if err := s.DeleteMonitorServer("newuser", "yahoo.com"); err != nil {
+	if err := s.DeleteMonitorServer(ctx, "newuser", "yahoo.com"); err != nil {
 		t.Error(err)
 	}
 
-	if err := s.AppendPingRet("google.com", "Hong Kong", PingRet{0.392, time.Now().Unix()}); err != nil {
+	if err := s.AppendPingRet(ctx, "google.com", "Hong Kong", PingRet{Ping: "0.392", Time: time.Now().Format("06-01-02 15:04")}); err != nil {
 		t.Error(err)
 	}
 
@@ -51,7 +100,3367 @@ func testStore(t *testing.T) {
 	}
 
 	s.Close()
-	t.Log(s.close)
+	t.Log(s.isClosed)
 }
 
 func Test_Store(t *testing.T) { testStore(t) }
+
+func Test_Apply(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.AddUser(ctx, "alice", "old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddMonitorServer(ctx, "alice", "yahoo.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := Spec{Users: map[string]UserSpec{
+		"alice": {Password: "new", MonitorServers: []string{"google.com"}},
+		"bob":   {Password: "bob", MonitorServers: []string{"google.com"}},
+	}}
+	want := []Change{
+		{Action: ACTION_UPDATE_PASSWORD, Username: "alice"},
+		{Action: ACTION_ADD_SERVER, Username: "alice", Server: "google.com"},
+		{Action: ACTION_DELETE_SERVER, Username: "alice", Server: "yahoo.com"},
+		{Action: ACTION_ADD_USER, Username: "bob"},
+		{Action: ACTION_ADD_SERVER, Username: "bob", Server: "google.com"},
+	}
+
+	changes, err := s.Apply(ctx, spec, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(changes) != fmt.Sprint(want) {
+		t.Fatalf("dry run changes %v, want %v", changes, want)
+	}
+	if s.GetUser("bob") != nil {
+		t.Fatal("dry run should not add user")
+	}
+
+	if _, err = s.Apply(ctx, spec, false); err != nil {
+		t.Fatal(err)
+	}
+	if u := s.GetUser("alice"); u.Password != "new" || !u.MonitorServers["google.com"] || u.MonitorServers["yahoo.com"] {
+		t.Errorf("alice is not reconciled: %v", u)
+	}
+	if u := s.GetUser("bob"); u == nil || !u.MonitorServers["google.com"] {
+		t.Errorf("bob is not reconciled: %v", u)
+	}
+
+	if changes, _ = s.Apply(ctx, spec, true); len(changes) != 0 {
+		t.Errorf("should have nothing to change, got %v", changes)
+	}
+}
+
+func Test_ApplyTargetPolicy(t *testing.T) {
+	s := newTestStore(t).SetTargetValidator(func(server string) error {
+		if server == "10.0.0.1" {
+			return fmt.Errorf("%v is blocked", server)
+		}
+		return nil
+	})
+	spec := Spec{Users: map[string]UserSpec{"alice": {Password: "pass", MonitorServers: []string{"google.com", "10.0.0.1"}}}}
+	for _, dryRun := range []bool{true, false} {
+		if changes, err := s.Apply(ctx, spec, dryRun); err == nil || len(changes) != 0 {
+			t.Errorf("the spec of a blocked target should be rejected, dry run %v, got %v, %v", dryRun, changes, err)
+		}
+	}
+	if s.GetUser("alice") != nil {
+		t.Error("nothing of the spec rejected should be applied")
+	}
+	if err := s.AddUser(ctx, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddMonitorServer(ctx, "alice", "10.0.0.1"); err == nil {
+		t.Error("the blocked target should be rejected")
+	}
+	if err := s.AddMonitorServer(ctx, "alice", "google.com"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_GetMonitorResultPage(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.AddUser(ctx, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddMonitorServer(ctx, "alice", "google.com"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		tm := fmt.Sprintf("15-01-01 10:0%d", i)
+		for _, location := range []string{"Hong Kong", "Tokyo"} {
+			if err := s.AppendPingRet(ctx, "google.com", location, PingRet{Ping: "1.000", Time: tm}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var (
+		cursor string
+		pages  int
+		got    = make(map[string]int)
+	)
+	for {
+		page, err := s.GetMonitorResultPage("alice", "google.com", cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for location, prs := range page.Results {
+			if len(prs) > 2 {
+				t.Errorf("page of %v has %v ping results, want at most 2", location, len(prs))
+			}
+			got[location] += len(prs)
+			if page.Total[location] != 5 {
+				t.Errorf("total of %v is %v, want 5", location, page.Total[location])
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	if pages != 3 || got["Hong Kong"] != 5 || got["Tokyo"] != 5 {
+		t.Errorf("got %v ping results in %v pages", got, pages)
+	}
+
+	if _, err := s.GetMonitorResultPage("alice", "google.com", "!", 2); err == nil {
+		t.Error("invalid cursor should fail")
+	}
+}
+
+func Test_Checks(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	for _, server := range []string{"google.com", "https://google.com/healthz", "tls://google.com", "tcp://google.com:25", "yahoo.com"} {
+		s.AddMonitorServer(ctx, "alice", server)
+	}
+	s.AppendPingRet(ctx, "tls://google.com", "Tokyo", PingRet{Ping: "12.000", Time: "15-01-01 00:00"})
+
+	hosts, err := s.GetHosts("alice")
+	if err != nil || len(hosts) != 2 || len(hosts["google.com"]) != 4 || hosts["yahoo.com"][0] != "yahoo.com" {
+		t.Errorf("got hosts %v, %v", hosts, err)
+	}
+	checks, err := s.GetChecks("alice", "google.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make([]string, 0, len(checks))
+	for _, c := range checks {
+		kinds = append(kinds, c.Kind)
+	}
+	if fmt.Sprint(kinds) != "[http icmp tcp tls]" {
+		t.Errorf("got kinds %v", kinds)
+	}
+	if c := checks[3]; c.Server != "tls://google.com" || c.Status != STATUS_UP || len(c.Results["Tokyo"]) != 1 {
+		t.Errorf("got tls check %+v", c)
+	}
+	if _, err = s.GetChecks("alice", "bing.com"); err == nil {
+		t.Error("want the error of the host not monitored")
+	}
+	// the servers of the checks are file names of the file engine
+	if prs := s.load(true).servers["tls://google.com"]["Tokyo"]; len(prs) != 1 {
+		t.Errorf("want the ping result of the tls check loaded, got %v", prs)
+	}
+}
+
+func Test_CheckTemplates(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "old.com")
+	s.SetServerLabels(ctx, "alice", "old.com", map[string]string{"role": "web"})
+	web := CheckTemplate{Name: "standard-web", Selector: map[string]string{"role": "web"}, Checks: []CheckSpec{
+		{Kind: probe.KIND_ICMP},
+		{Kind: probe.KIND_HTTP, Interval: time.Minute},
+		{Kind: probe.KIND_TLS, Interval: 24 * time.Hour},
+	}}
+	for _, bad := range []CheckTemplate{
+		{Name: "none"},
+		{Name: "udp", Checks: []CheckSpec{{Kind: "udp"}}},
+		{Name: "tcp", Checks: []CheckSpec{{Kind: probe.KIND_TCP}}},
+		{Name: "twice", Checks: []CheckSpec{{Kind: probe.KIND_ICMP}, {Kind: probe.KIND_ICMP}}},
+	} {
+		if _, err := s.SetCheckTemplate(ctx, "alice", bad); err == nil {
+			t.Errorf("want the error of template %v", bad.Name)
+		}
+	}
+	// applied to the servers selected already
+	added, err := s.SetCheckTemplate(ctx, "alice", web)
+	if err != nil || fmt.Sprint(added) != "[https://old.com tls://old.com]" {
+		t.Errorf("got %v, %v", added, err)
+	}
+	if added, err = s.AddHost(ctx, "alice", "new.com", map[string]string{"role": "web"}); err != nil || len(added) != 3 {
+		t.Errorf("got %v, %v", added, err)
+	}
+	if _, err = s.AddHost(ctx, "alice", "new.com", nil); err == nil {
+		t.Error("want the error of the host monitored")
+	}
+	if added, _ = s.AddHost(ctx, "alice", "db.com", map[string]string{"role": "db"}); fmt.Sprint(added) != "[db.com]" {
+		t.Errorf("want the icmp check of the host no template selects, got %v", added)
+	}
+	// labeled later
+	s.SetServerLabels(ctx, "alice", "db.com", map[string]string{"role": "web"})
+	hosts, _ := s.GetHosts("alice")
+	if len(hosts["db.com"]) != 3 || len(hosts["new.com"]) != 3 || len(hosts["old.com"]) != 3 {
+		t.Errorf("got hosts %v", hosts)
+	}
+	if labels := s.GetServerLabels("alice", "tls://new.com"); labels["role"] != "web" {
+		t.Errorf("want the check labeled like the host, got %v", labels)
+	}
+	if servers := s.GetServers(); len(servers) != 9 {
+		t.Errorf("got servers %v", servers)
+	}
+	s.AddUser(ctx, "bob", "pass")
+	s.AddMonitorServer(ctx, "bob", "https://new.com")
+	intervals := s.CheckIntervals()
+	if len(intervals) != 5 || intervals["tls://old.com"] != 24*time.Hour || intervals["https://old.com"] != time.Minute {
+		t.Errorf("got intervals %v, want https://new.com checked every ping frequence for bob", intervals)
+	}
+
+	if err = s.DeleteCheckTemplate(ctx, "alice", web.Name); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.GetUser("alice").MonitorServers) != 9 {
+		t.Error("want the checks kept after the template is deleted")
+	}
+}
+
+func Test_Import(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "manual.com")
+	s.SetCheckTemplate(ctx, "alice", CheckTemplate{Name: "web", Selector: map[string]string{"role": "web"}, Checks: []CheckSpec{
+		{Kind: probe.KIND_ICMP}, {Kind: probe.KIND_HTTP},
+	}})
+	hosts := map[string]map[string]string{"manual.com": nil, "web.com": {"role": "web"}, "db.com": {"role": "db"}}
+	changes, err := s.Import(ctx, "alice", "ec2", hosts, true, true)
+	if err != nil || len(changes) != 3 {
+		t.Fatalf("got %v, %v", changes, err)
+	}
+	if len(s.GetUser("alice").MonitorServers) != 1 {
+		t.Fatal("want nothing changed by dry run")
+	}
+	if changes, err = s.Import(ctx, "alice", "ec2", hosts, true, false); err != nil || len(changes) != 3 {
+		t.Fatalf("got %v, %v", changes, err)
+	}
+	if labels := s.GetServerLabels("alice", "https://web.com"); labels[LABEL_IMPORTER] != "ec2" || labels["role"] != "web" {
+		t.Errorf("got labels %v", labels)
+	}
+	if changes, _ = s.Import(ctx, "alice", "ec2", hosts, true, false); len(changes) != 0 {
+		t.Errorf("want nothing to change, got %v", changes)
+	}
+	// web.com vanished, the hosts not imported are kept
+	delete(hosts, "web.com")
+	delete(hosts, "manual.com")
+	changes, _ = s.Import(ctx, "alice", "ec2", hosts, true, false)
+	if fmt.Sprint(changes) != "[{delete server alice https://web.com} {delete server alice web.com}]" {
+		t.Errorf("got %v", changes)
+	}
+	if servers := s.GetServers(); len(servers) != 2 {
+		t.Errorf("got servers %v", servers)
+	}
+	if _, err = s.Import(ctx, "alice", "ec2", map[string]map[string]string{"https://web.com": nil}, false, false); err == nil {
+		t.Error("want the error of the invalid host")
+	}
+	if _, err = s.Import(ctx, "bob", "ec2", hosts, false, false); err == nil {
+		t.Error("want the error of the user not exist")
+	}
+}
+
+func Test_Annotations(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddUser(ctx, "bob", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	s.AddMonitorServer(ctx, "bob", "google.com")
+	for i := 0; i < 4; i++ {
+		s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: fmt.Sprintf("15-01-01 10:0%d", i)})
+	}
+	for _, a := range []Annotation{
+		{Kind: ANNOTATION_OUTAGE, Time: "15-01-01 09:50", End: "15-01-01 10:00", Text: "known outage"},
+		{Kind: ANNOTATION_DEPLOY, Time: "15-01-01 10:03", Text: "v2"},
+		{Kind: ANNOTATION_CONFIG, Time: "15-01-01 10:01", Text: "cache on"},
+	} {
+		if _, err := s.AddAnnotation(ctx, "alice", "google.com", a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, a := range []Annotation{
+		{Kind: "party", Time: "15-01-01 10:00", Text: "x"},
+		{Kind: ANNOTATION_NOTE, Time: "yesterday", Text: "x"},
+		{Kind: ANNOTATION_NOTE, Time: "15-01-01 10:00", End: "15-01-01 09:00", Text: "x"},
+		{Kind: ANNOTATION_NOTE, Time: "15-01-01 10:00"},
+	} {
+		if _, err := s.AddAnnotation(ctx, "alice", "google.com", a); err == nil {
+			t.Errorf("want the error of %+v", a)
+		}
+	}
+	if _, err := s.AddAnnotation(ctx, "alice", "yahoo.com", Annotation{Kind: ANNOTATION_NOTE, Time: "15-01-01 10:00", Text: "x"}); err == nil {
+		t.Error("want the error of the server not monitored")
+	}
+
+	if as, err := s.GetAnnotations("alice", "google.com", "15-01-01 10:00", "15-01-01 10:01"); err != nil || len(as) != 2 || as[0].Text != "known outage" || as[1].Text != "cache on" {
+		t.Errorf("got %+v, %v", as, err)
+	}
+	if as, _ := s.GetAnnotations("bob", "google.com", "", ""); len(as) != 0 {
+		t.Errorf("want the annotations of alice hidden from bob, got %+v", as)
+	}
+	// every annotation is on exactly one page
+	var texts []string
+	for cursor := ""; ; {
+		page, err := s.GetMonitorResultPage("alice", "google.com", cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range page.Annotations {
+			texts = append(texts, a.Text)
+		}
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	if fmt.Sprint(texts) != "[known outage cache on v2]" {
+		t.Errorf("got annotations %v of the pages", texts)
+	}
+
+	as, _ := s.GetAnnotations("alice", "google.com", "", "")
+	if err := s.DeleteAnnotation(ctx, "alice", "google.com", as[1].Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteAnnotation(ctx, "alice", "google.com", as[1].Id); err == nil {
+		t.Error("want the error of the annotation deleted")
+	}
+	if as, _ = s.GetAnnotations("alice", "google.com", "", ""); len(as) != 2 {
+		t.Errorf("got %+v after delete", as)
+	}
+	s.DeleteMonitorServer(ctx, "alice", "google.com")
+	if u := s.GetUser("alice"); len(u.Annotations) != 0 {
+		t.Errorf("want the annotations forgotten with the server, got %+v", u.Annotations)
+	}
+}
+
+func Test_GetMonitorResultIfNoneMatch(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.AddUser(ctx, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddMonitorServer(ctx, "alice", "google.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 10:00"}); err != nil {
+		t.Fatal(err)
+	}
+
+	ret, etag, notModified, err := s.GetMonitorResultIfNoneMatch("alice", "google.com", "")
+	if err != nil || notModified || len(ret["Tokyo"]) != 1 {
+		t.Fatalf("first request got %v, %v, %v", ret, notModified, err)
+	}
+	if ret, _, notModified, _ = s.GetMonitorResultIfNoneMatch("alice", "google.com", etag); !notModified || ret != nil {
+		t.Errorf("unchanged result should not be modified, got %v", ret)
+	}
+
+	if err = s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 10:01"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, newETag, notModified, _ := s.GetMonitorResultIfNoneMatch("alice", "google.com", etag); notModified || newETag == etag {
+		t.Error("etag should change after appending ping result")
+	}
+}
+
+func Test_GetOverview(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.AddUser(ctx, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range []string{"google.com", "yahoo.com"} {
+		if err := s.AddMonitorServer(ctx, "alice", server); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		pr := PingRet{Ping: fmt.Sprintf("%d.000", i), Time: fmt.Sprintf("15-01-01 10:0%d", i)}
+		if err := s.AppendPingRet(ctx, "google.com", "Tokyo", pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ret, err := s.GetOverview("alice", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 2 {
+		t.Fatalf("got overview of %v servers, want 2", len(ret))
+	}
+	if prs := ret["google.com"].Sparkline["Tokyo"]; len(prs) != 3 || prs[0].Ping != "2.000" {
+		t.Errorf("sparkline is %v", prs)
+	}
+	if latest := ret["google.com"].Latest()["Tokyo"]; latest.Ping != "4.000" {
+		t.Errorf("latest is %v", latest)
+	}
+	if len(ret["yahoo.com"].Sparkline) != 0 {
+		t.Errorf("yahoo.com has no ping result, got %v", ret["yahoo.com"])
+	}
+}
+
+func Test_ResponseCache(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 10:00"})
+	overview := func() []PingRet {
+		ret, err := s.GetOverview("alice", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ret["google.com"].Sparkline["Tokyo"]
+	}
+	overview()
+	if prs := overview(); len(prs) != 1 || s.Metrics().Cache.Hits != 1 {
+		t.Errorf("want the overview cached, got %v of %+v", prs, s.Metrics().Cache)
+	}
+	// invalidated by the ping results and the changes of the user
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "2.000", Time: "15-01-01 10:01"})
+	if prs := overview(); len(prs) != 2 {
+		t.Errorf("want the overview of the ping result appended, got %v", prs)
+	}
+	s.AddMonitorServer(ctx, "alice", "yahoo.com")
+	if ret, _ := s.GetOverview("alice", 3); len(ret) != 2 {
+		t.Errorf("want the overview of the server added, got %v", ret)
+	}
+	if uptime, samples, _ := s.GetUptime("alice", "google.com", "15-01-01 00:00"); samples != 2 || uptime != 1 {
+		t.Errorf("want uptime 1 of 2 samples, got %v of %v", uptime, samples)
+	}
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: _DEFAULT_PING, Time: "15-01-01 10:02"})
+	if uptime, samples, _ := s.GetUptime("alice", "google.com", "15-01-01 00:00"); samples != 3 {
+		t.Errorf("want uptime of 3 samples, got %v of %v", uptime, samples)
+	}
+	// the errors are not cached
+	if _, err := s.GetOverview("bob", 3); err == nil {
+		t.Error("should fail of the user not exist")
+	}
+	s.AddUser(ctx, "bob", "pass")
+	if _, err := s.GetOverview("bob", 3); err != nil {
+		t.Error(err)
+	}
+
+	// a response computed across an invalidation is not cached
+	c := newResponseCache()
+	k := cacheKey{endpoint: "uptime", username: "alice", server: "google.com"}
+	_, seq, _ := c.get(k)
+	c.invalidate(serverDep("google.com"))
+	c.put(k, 1, seq, []string{userDep("alice"), serverDep("google.com")})
+	if _, _, ok := c.get(k); ok {
+		t.Error("should not cache the response computed across an invalidation")
+	}
+	_, seq, _ = c.get(k)
+	c.put(k, 1, seq, []string{userDep("alice"), serverDep("google.com")})
+	c.invalidate(userDep("alice"))
+	if _, _, ok := c.get(k); ok || len(c.index) != 0 {
+		t.Errorf("should drop the response of the user invalidated, got index %v", c.index)
+	}
+}
+
+func Test_LinkExternalUser(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.LinkExternalUser(ctx, "alice", "github", "42"); err != nil {
+		t.Fatal(err)
+	}
+	if u := s.GetUser("alice"); u == nil || u.Password != "" || u.ExternalIds["github"] != "42" {
+		t.Fatalf("alice should be created without password, got %v", u)
+	}
+	if username := s.GetExternalUser("github", "42"); username != "alice" {
+		t.Errorf("github 42 is linked to %v, want alice", username)
+	}
+	if err := s.LinkExternalUser(ctx, "bob", "github", "42"); err == nil {
+		t.Error("the subject should not be linked twice")
+	}
+	if username := s.GetExternalUser("google", "42"); username != "" {
+		t.Errorf("google 42 should not be linked, got %v", username)
+	}
+
+	// the user registered before never gets the identity provisioned
+	s.AddUser(ctx, "google-7", "pass")
+	if err := s.ProvisionExternalUser(ctx, "google-7", "google", "7"); err == nil {
+		t.Error("an existing user should not be provisioned")
+	}
+	if u := s.GetUser("google-7"); s.GetExternalUser("google", "7") != "" || len(u.ExternalIds) != 0 {
+		t.Errorf("google 7 should not be linked, got %v", u.ExternalIds)
+	}
+	if err := s.ProvisionExternalUser(ctx, "carol", "google", "7"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ProvisionExternalUser(ctx, "dave", "google", "7"); err == nil || s.GetUser("dave") != nil {
+		t.Error("the subject should not be provisioned twice")
+	}
+}
+
+func Test_Metrics(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.AddUser(ctx, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddMonitorServer(ctx, "alice", "google.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 10:00"}); err != nil {
+		t.Fatal(err)
+	}
+
+	m := s.Metrics()
+	if m.PingRetsAppended != 1 || m.EngineWrites != 3 || m.EngineWriteErrors != 0 {
+		t.Errorf("unexpected counters %+v", m)
+	}
+	if m.Users != 1 || m.Servers != 1 || m.AddServerChanLen != 1 || m.AddServerChanCap < _MIN_LEN_SERVER_CHAN {
+		t.Errorf("unexpected state %+v", m)
+	}
+	if m.LockAcquires == 0 {
+		t.Error("lock acquires should be counted")
+	}
+}
+
+func Test_Health(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.AddUser(ctx, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	h := s.Health(ctx)
+	if err := h.Ready(); err != nil {
+		t.Errorf("store should be ready, got %v", err)
+	}
+	if h.LastWrite.IsZero() {
+		t.Error("last write should be recorded")
+	}
+
+	h.AddServerChanLen = h.AddServerChanCap
+	if h.Ready() == nil {
+		t.Error("saturated add server chan should not be ready")
+	}
+
+	s.Close()
+	if s.Health(ctx).Ready() == nil {
+		t.Error("closed store should not be ready")
+	}
+}
+
+func Test_SlowOps(t *testing.T) {
+	s := newTestStore(t).SetSlowThreshold(time.Nanosecond)
+	if err := s.AddUser(ctx, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	ops := make(map[string]SlowOp)
+	for _, op := range s.SlowOps(0) {
+		ops[op.Op] = op
+	}
+	if ops["StoreEngine.WriteUser"].Count != 1 {
+		t.Errorf("slow engine write should be recorded, got %v", ops)
+	}
+	if ops["lock.hold"].LastContext != "holder=AddUser" {
+		t.Errorf("lock holder should be AddUser, got %v", ops["lock.hold"].LastContext)
+	}
+	if len(s.SlowOps(1)) != 1 {
+		t.Error("should return at most 1 slow operation")
+	}
+
+	s.SetSlowThreshold(0)
+	s.GetUser("alice")
+	if s.SlowOps(0)[0].Count+s.SlowOps(0)[1].Count != 2 {
+		t.Error("disabled slow threshold should record nothing")
+	}
+}
+
+func Test_Leadership(t *testing.T) {
+	dir := t.TempDir()
+	conf := testConfig(dir)
+	a, b := NewStore().SetStoreEngine(ENGINE_FILE, conf), NewStore().SetStoreEngine(ENGINE_FILE, conf)
+
+	if ok, err := a.AcquireLeadership("a", time.Minute); !ok || err != nil {
+		t.Fatalf("a should lead, got %v, %v", ok, err)
+	}
+	if ok, err := b.AcquireLeadership("b", time.Minute); ok || err != nil {
+		t.Fatalf("b should not lead while a holds the lease, got %v, %v", ok, err)
+	}
+	if ok, _ := a.AcquireLeadership("a", time.Minute); !ok {
+		t.Fatal("a should renew the lease")
+	}
+	if err := a.ReleaseLeadership("a"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := b.AcquireLeadership("b", time.Minute); !ok {
+		t.Fatal("b should lead after a released the lease")
+	}
+
+	if err := a.AddUser(ctx, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AddMonitorServer(ctx, "alice", "google.com"); err != nil {
+		t.Fatal(err)
+	}
+	b.Reload()
+	if b.GetUser("alice") == nil {
+		t.Error("b should load alice on reload")
+	}
+	select {
+	case server := <-b.AddServerChan:
+		if server != "google.com" {
+			t.Errorf("got %v from add server chan", server)
+		}
+	default:
+		t.Error("google.com should be sent to add server chan on reload")
+	}
+}
+
+// a cluster of raft engines on localhost, the nodes reach each other through proxies partitioning them
+type raftCluster struct {
+	t       *testing.T
+	conf    EngineConfig
+	peers   map[string]interface{}
+	listen  map[string]string
+	dirs    map[string]string
+	engines map[string]*raftEngine
+
+	mu sync.Mutex
+	// the nodes partitioned from the others
+	cut map[string]bool
+	// the connections proxied -> the nodes at both ends
+	conns map[net.Conn][2]string
+}
+
+func newRaftCluster(t *testing.T, conf EngineConfig, ids ...string) *raftCluster {
+	c := &raftCluster{
+		t: t, conf: conf, peers: make(map[string]interface{}), listen: make(map[string]string), dirs: make(map[string]string),
+		engines: make(map[string]*raftEngine), cut: make(map[string]bool), conns: make(map[net.Conn][2]string),
+	}
+	proxies := make(map[string]net.Listener)
+	for _, id := range ids {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.listen[id] = l.Addr().String()
+		l.Close()
+		if proxies[id], err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { proxies[id].Close() })
+		c.peers[id] = proxies[id].Addr().String()
+		c.dirs[id] = t.TempDir()
+	}
+	for id, l := range proxies {
+		go c.proxy(l, id)
+	}
+	for _, id := range ids {
+		c.start(id)
+	}
+	return c
+}
+
+// proxy forwards the connections to the node but those of the nodes partitioned
+func (c *raftCluster) proxy(l net.Listener, to string) {
+	for {
+		in, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			// the hello of the handshake tells the node dialing, see raftStream
+			hello := make([]byte, 2)
+			if _, err := io.ReadFull(in, hello); err != nil {
+				in.Close()
+				return
+			}
+			from := make([]byte, hello[1])
+			if _, err := io.ReadFull(in, from); err != nil {
+				in.Close()
+				return
+			}
+			out, err := net.Dial("tcp", c.listen[to])
+			if err != nil {
+				in.Close()
+				return
+			}
+			if !c.track(string(from), to, in, out) {
+				in.Close()
+				out.Close()
+				return
+			}
+			out.Write(append(hello, from...))
+			go func() {
+				io.Copy(out, in)
+				out.Close()
+			}()
+			io.Copy(in, out)
+			in.Close()
+		}()
+	}
+}
+
+func (c *raftCluster) track(from, to string, conns ...net.Conn) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cut[from] || c.cut[to] {
+		return false
+	}
+	for _, conn := range conns {
+		c.conns[conn] = [2]string{from, to}
+	}
+	return true
+}
+
+// partition cuts the nodes off the others, the connections of the nodes are closed
+func (c *raftCluster) partition(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		c.cut[id] = true
+	}
+	for conn, ends := range c.conns {
+		if c.cut[ends[0]] || c.cut[ends[1]] {
+			conn.Close()
+			delete(c.conns, conn)
+		}
+	}
+}
+
+func (c *raftCluster) heal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	clear(c.cut)
+}
+
+// start starts the node on its dir, the config of the cluster is applied over the defaults of the tests
+func (c *raftCluster) start(id string) *raftEngine {
+	conf := EngineConfig{"id": id, "peers": c.peers, "dir": c.dirs[id], "listen": c.listen[id], "secret": "secret", "electionTimeout": "100ms"}
+	for k, v := range c.conf {
+		conf[k] = v
+	}
+	e, err := NewEngine(ENGINE_RAFT, conf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	r := e.(*raftEngine)
+	r.Init()
+	c.t.Cleanup(func() { r.Close() })
+	c.engines[id] = r
+	return r
+}
+
+func (c *raftCluster) stop(id string) {
+	if err := c.engines[id].Close(); err != nil {
+		c.t.Error(err)
+	}
+	delete(c.engines, id)
+}
+
+// leader waits for one of the nodes to lead, as the main servers see it
+func (c *raftCluster) leader(ids ...string) string {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, id := range ids {
+			if ok, _ := c.engines[id].AcquireLease(id, time.Minute); ok {
+				return id
+			}
+		}
+	}
+	c.t.Fatalf("none of %v leads", ids)
+	return ""
+}
+
+// eventually waits for the condition to hold on the node
+func (c *raftCluster) eventually(id, what string, f func(e *raftEngine) bool) {
+	c.t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !f(c.engines[id]); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("%v should %v", id, what)
+		}
+	}
+}
+
+func hasRaftUser(username string) func(e *raftEngine) bool {
+	return func(e *raftEngine) bool {
+		_, users, _ := e.Init()
+		return users[username] != nil
+	}
+}
+
+func Test_RaftEngine(t *testing.T) {
+	c := newRaftCluster(t, nil, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+	for id, e := range c.engines {
+		if ok, _ := e.AcquireLease(id, time.Minute); ok != (id == leader) {
+			t.Errorf("%v leads %v, the leader is %v", id, ok, leader)
+		}
+		if err := e.Health(ctx); err != nil {
+			t.Errorf("%v is unhealthy: %v", id, err)
+		}
+	}
+	follower := "a"
+	if follower == leader {
+		follower = "b"
+	}
+	// forwarded to the leader
+	u := newUser()
+	u.Password, u.MonitorServers["google.com"] = "pass", true
+	if err := c.engines[follower].WriteUser(ctx, "alice", u); err != nil {
+		t.Fatal(err)
+	}
+	if _, users, _ := c.engines[follower].Init(); users["alice"] == nil || users["alice"].Password != "pass" {
+		t.Errorf("the node writing should read its write, got %v", users)
+	}
+	prs := []PingRet{{Ping: "1.000", Time: "15-01-01 10:00"}, {Ping: "2.000", Time: "15-01-01 10:01"}}
+	if err := c.engines[leader].BatchWritePingRets(ctx, "google.com", "Tokyo", prs); err != nil {
+		t.Fatal(err)
+	}
+	for id := range c.engines {
+		c.eventually(id, "apply the writes", func(e *raftEngine) bool {
+			servers, users, allServers := e.Init()
+			return users["alice"] != nil && len(servers["google.com"]["Tokyo"]) == 2 && allServers["google.com"] == 1
+		})
+	}
+}
+
+// a leader partitioned from the others commits nothing, the others elect another leader and the old one follows it once healed
+func Test_RaftPartition(t *testing.T) {
+	c := newRaftCluster(t, nil, "a", "b", "c")
+	old := c.leader("a", "b", "c")
+	var rest []string
+	for id := range c.engines {
+		if id != old {
+			rest = append(rest, id)
+		}
+	}
+	c.partition(old)
+
+	wctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	if err := c.engines[old].WriteUser(wctx, "mallory", newUser()); err == nil {
+		t.Error("a leader partitioned should not commit")
+	}
+	c.eventually(old, "step down", func(e *raftEngine) bool {
+		ok, _ := e.AcquireLease(old, time.Minute)
+		return !ok
+	})
+	leader := c.leader(rest...)
+	if err := c.engines[rest[0]].WriteUser(ctx, "bob", newUser()); err != nil {
+		t.Fatalf("the majority should commit, led by %v: %v", leader, err)
+	}
+	if err := c.engines[old].Health(ctx); err == nil {
+		t.Error("a node partitioned should be unhealthy")
+	}
+
+	c.heal()
+	c.eventually(old, "follow the new leader", hasRaftUser("bob"))
+	if ok, _ := c.engines[old].AcquireLease(old, time.Minute); ok {
+		t.Error("the old leader should follow")
+	}
+	for id, e := range c.engines {
+		if hasRaftUser("mallory")(e) {
+			t.Errorf("%v should drop the write never committed", id)
+		}
+	}
+}
+
+// the others keep writing once the leader stops, it catches up on restart
+func Test_RaftLeaderLoss(t *testing.T) {
+	c := newRaftCluster(t, nil, "a", "b", "c")
+	old := c.leader("a", "b", "c")
+	if err := c.engines[old].WriteUser(ctx, "alice", newUser()); err != nil {
+		t.Fatal(err)
+	}
+	c.stop(old)
+	var rest []string
+	for id := range c.engines {
+		rest = append(rest, id)
+	}
+	c.leader(rest...)
+	for _, id := range rest {
+		if err := c.engines[id].WriteUser(ctx, "bob."+id, newUser()); err != nil {
+			t.Fatalf("%v should write without the old leader: %v", id, err)
+		}
+	}
+
+	c.start(old)
+	for _, id := range rest {
+		c.eventually(old, "catch up", hasRaftUser("bob."+id))
+	}
+	if !hasRaftUser("alice")(c.engines[old]) {
+		t.Error("the writes applied should be kept across restarts")
+	}
+}
+
+// the leader compacts its log while a node is down, the node replaced by one on an empty dir is sent a snapshot
+func Test_RaftSnapshot(t *testing.T) {
+	c := newRaftCluster(t, EngineConfig{"snapshotThreshold": 4, "snapshotInterval": "10ms", "trailingLogs": 2}, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+	replaced := "a"
+	if replaced == leader {
+		replaced = "b"
+	}
+	c.stop(replaced)
+	if err := os.RemoveAll(c.dirs[replaced]); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := c.engines[leader].BatchWritePingRets(ctx, "google.com", "Tokyo", []PingRet{{Ping: "1.000", Time: fmt.Sprintf("15-01-01 10:%02d", i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u := newUser()
+	u.MonitorServers["google.com"] = true
+	if err := c.engines[leader].WriteUser(ctx, "alice", u); err != nil {
+		t.Fatal(err)
+	}
+	// the leader may change while the node is down
+	for id := range c.engines {
+		c.eventually(id, "compact its log without the node down", func(e *raftEngine) bool {
+			first, _ := e.logs.FirstIndex()
+			return first > 10
+		})
+	}
+
+	c.start(replaced)
+	c.eventually(replaced, "restore the snapshot of the leader", func(e *raftEngine) bool {
+		servers, users, _ := e.Init()
+		return users["alice"] != nil && len(servers["google.com"]["Tokyo"]) == 20 && e.raft.Stats()["last_snapshot_index"] != "0"
+	})
+	servers, _, _ := c.engines[replaced].Init()
+	for i, pr := range servers["google.com"]["Tokyo"] {
+		if want := fmt.Sprintf("15-01-01 10:%02d", i); pr.Time != want {
+			t.Fatalf("ping result %v should be at %v, got %+v", i, want, pr)
+		}
+	}
+}
+
+// the purged writes are dropped from the log and the snapshot of every node
+func Test_RaftPurge(t *testing.T) {
+	c := newRaftCluster(t, nil, "a", "b", "c")
+	leader := c.leader("a", "b", "c")
+	u := newUser()
+	u.MonitorServers["google.com"] = true
+	if err := c.engines[leader].WriteUser(ctx, "alice", u); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.engines[leader].BatchWritePingRets(ctx, "google.com", "Tokyo", []PingRet{{Ping: "1.000", Time: "15-01-01 10:00"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.engines[leader].WriteDNSHistory(ctx, "google.com", []Resolution{{Time: "15-01-01 10:00"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.engines[leader].WriteUser(ctx, "bob", newUser()); err != nil {
+		t.Fatal(err)
+	}
+	follower := "a"
+	if follower == leader {
+		follower = "b"
+	}
+	if err := c.engines[follower].PurgeServer(ctx, "google.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.engines[follower].DeleteUser(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the commands of the log keeping the data purged
+	purged := func(e *raftEngine) (kept []string) {
+		first, _ := e.logs.FirstIndex()
+		last, _ := e.logs.LastIndex()
+		for i := first; i <= last && first > 0; i++ {
+			var l raft.Log
+			var cmd raftCommand
+			if e.logs.GetLog(i, &l) != nil || l.Type != raft.LogCommand || json.Unmarshal(l.Data, &cmd) != nil {
+				continue
+			}
+			if cmd.Op == _RAFT_WRITE_USER && cmd.Username == "alice" || cmd.Op != _RAFT_PURGE_SERVER && cmd.Server == "google.com" {
+				kept = append(kept, cmd.Op)
+			}
+		}
+		return
+	}
+	// the state restored from the latest snapshot of the node
+	snapshotted := func(id string) (Servers, Users, int, error) {
+		snaps, err := raft.NewFileSnapshotStoreWithLogger(c.dirs[id], _RAFT_SNAPSHOTS_RETAINED, hclog.NewNullLogger())
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		metas, err := snaps.List()
+		if err != nil || len(metas) == 0 {
+			return nil, nil, 0, fmt.Errorf("no snapshot: %v", err)
+		}
+		_, rc, err := snaps.Open(metas[0].ID)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		st, err := openRaftState(filepath.Join(t.TempDir(), "state.db"))
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		defer st.Close()
+		if err = st.Restore(rc); err != nil {
+			return nil, nil, 0, err
+		}
+		servers, users, _, err := st.read()
+		return servers, users, len(metas), err
+	}
+	applied := func(servers Servers, users Users) bool {
+		return users["alice"] == nil && users["bob"] != nil && servers["google.com"] == nil
+	}
+	for id := range c.engines {
+		c.eventually(id, "drop the purged writes from its log and its snapshot", func(e *raftEngine) bool {
+			servers, users, _ := e.Init()
+			if !applied(servers, users) || len(purged(e)) != 0 {
+				return false
+			}
+			servers, users, _, err := snapshotted(id)
+			return err == nil && applied(servers, users)
+		})
+		if h, _ := c.engines[id].ReadDNSHistory(); h["google.com"] != nil {
+			t.Errorf("%v should purge the dns history, got %v", id, h)
+		}
+		if _, _, n, _ := snapshotted(id); n != 1 {
+			t.Errorf("%v should keep the snapshot taken after the purge only, got %v", id, n)
+		}
+	}
+}
+
+func Test_Feed(t *testing.T) {
+	primary, replica := newTestStore(t), newTestStore(t)
+	if err := primary.AddUser(ctx, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	snap := primary.Snapshot()
+	replica.ApplySnapshot(snap)
+	if replica.GetUser("alice") == nil {
+		t.Fatal("replica should have alice from the snapshot")
+	}
+
+	if err := primary.AddMonitorServer(ctx, "alice", "google.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "0.392", Time: "15-01-01 00:00"}); err != nil {
+		t.Fatal(err)
+	}
+	events, err := primary.Changes(snap.Epoch, snap.Seq, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the user, the ping result and the status of the server turning up
+	if len(events) != 3 || events[1].Seq != snap.Seq+2 || events[2].Status == nil || events[2].Status.Status != STATUS_UP {
+		t.Fatalf("got events %+v", events)
+	}
+	replica.ApplyChanges(events)
+	ret, err := replica.GetMonitorResult("alice", "google.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret["Tokyo"]) != 1 || ret["Tokyo"][0].Ping != "0.392" {
+		t.Errorf("got %v from replica", ret)
+	}
+	if st, _ := replica.GetStatus("alice", "google.com"); st.Status != STATUS_UP {
+		t.Errorf("got status %+v from replica", st)
+	}
+
+	// wait for the next event
+	go primary.AddUser(ctx, "bob", "pass")
+	if events, err = primary.Changes(snap.Epoch, snap.Seq+3, time.Second); err != nil || len(events) != 1 || events[0].Username != "bob" {
+		t.Errorf("got %+v, %v waiting for bob", events, err)
+	}
+	if _, err = primary.Changes(snap.Epoch+1, snap.Seq, 0); err != ErrorFeedTruncated {
+		t.Errorf("changes of another epoch should be truncated, got %v", err)
+	}
+}
+
+func Test_Status(t *testing.T) {
+	s := NewStore().SetStatusRules(StatusRules{Samples: 2, Latency: 100}).SetStoreEngine(ENGINE_FILE, testConfig(t.TempDir()))
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	status := func() ServerStatus {
+		st, err := s.GetStatus("alice", "google.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+	if st := status(); st.Status != STATUS_UNKNOWN {
+		t.Errorf("want unknown before the first ping result, got %+v", st)
+	}
+	down := _DEFAULT_PING
+	for _, c := range []struct {
+		time, tokyo, london string
+		want                string
+	}{
+		{"15-01-01 00:00", "1.000", "1.000", STATUS_UP},
+		// one of the latest 2 results of London without response
+		{"15-01-01 00:01", "1.000", down, STATUS_DEGRADED},
+		{"15-01-01 00:02", "1.000", down, STATUS_DEGRADED},
+		{"15-01-01 00:03", down, down, STATUS_DEGRADED},
+		{"15-01-01 00:04", down, down, STATUS_DOWN},
+		{"15-01-01 00:05", "500.000", "1.000", STATUS_DEGRADED},
+		// slower than the latency of the rules
+		{"15-01-01 00:06", "500.000", "1.000", STATUS_DEGRADED},
+		{"15-01-01 00:07", "1.000", "1.000", STATUS_DEGRADED},
+		{"15-01-01 00:08", "1.000", "1.000", STATUS_UP},
+	} {
+		s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: c.tokyo, Time: c.time})
+		s.AppendPingRet(ctx, "google.com", "London", PingRet{Ping: c.london, Time: c.time})
+		if st := status(); st.Status != c.want {
+			t.Errorf("%v: want %v, got %+v", c.time, c.want, st)
+		}
+	}
+	if sts, err := s.GetStatuses("alice"); err != nil || sts["google.com"].Status != STATUS_UP || sts["google.com"].Locations["Tokyo"] != STATUS_UP {
+		t.Errorf("got %+v, %v", sts, err)
+	}
+	if o, _ := s.GetOverview("alice", 1); o["google.com"].Status != STATUS_UP {
+		t.Errorf("got overview %+v", o)
+	}
+	if _, err := s.GetStatus("alice", "yahoo.com"); err == nil {
+		t.Error("want the error of the server not monitored")
+	}
+}
+
+func Test_LatencyMatrix(t *testing.T) {
+	s := newTestStore(t)
+	s.SetProbeLatency("Tokyo", "London", PingRet{Ping: "230.000", Time: "15-01-01 00:00"})
+	s.SetProbeLatency("Tokyo", "8.8.8.8", PingRet{Ping: "2.000", Time: "15-01-01 00:00"})
+	s.SetProbeLatency("London", "Tokyo", PingRet{Ping: "231.000", Time: "15-01-01 00:00"})
+
+	m := s.GetLatencyMatrix()
+	if len(m) != 2 || m["Tokyo"]["London"].Ping != "230.000" || m["Tokyo"]["8.8.8.8"].Ping != "2.000" {
+		t.Errorf("got matrix %v", m)
+	}
+	m["Tokyo"]["London"] = PingRet{}
+	if s.GetLatencyMatrix()["Tokyo"]["London"].Ping != "230.000" {
+		t.Error("matrix should be a copy")
+	}
+
+	s.DeleteProbeLatency("London")
+	if m = s.GetLatencyMatrix(); len(m) != 1 || len(m["Tokyo"]) != 1 {
+		t.Errorf("got matrix %v after deleting London", m)
+	}
+}
+
+func Test_Migrate(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(dir+"/servers/google.com", os.ModePerm)
+	os.MkdirAll(dir+"/users", os.ModePerm)
+	// written before versioning
+	ioutil.WriteFile(dir+"/servers/google.com/Tokyo", []byte(`{"ping":"0.392","time":"15-01-01 00:00"}`+"\n"), os.ModePerm)
+	ioutil.WriteFile(dir+"/users/alice", []byte(`{"password":"pass","monitor_servers":{"google.com":true}}`), os.ModePerm)
+
+	s := NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir))
+	ret, err := s.GetMonitorResult("alice", "google.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret["Tokyo"]) != 1 || ret["Tokyo"][0].Ping != "0.392" {
+		t.Errorf("got %v after migration", ret)
+	}
+	if b, _ := ioutil.ReadFile(dir + "/servers/google.com/Tokyo"); !strings.Contains(string(b), fmt.Sprintf(`"v":%d`, SCHEMA_VERSION)) {
+		t.Errorf("ping results should be rewritten in schema version %v, got %s", SCHEMA_VERSION, b)
+	}
+	if v, err := s.storeEngine.(Migrator).SchemaVersion(); err != nil || v != SCHEMA_VERSION {
+		t.Errorf("got schema version %v, %v", v, err)
+	}
+
+	ioutil.WriteFile(dir+"/servers.schema", []byte(fmt.Sprintf("%d\n", SCHEMA_VERSION+1)), os.ModePerm)
+	defer func() {
+		if recover() == nil {
+			t.Error("should refuse data of a newer schema version")
+		}
+	}()
+	NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir))
+}
+
+func Test_DuplicatedPingRet(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	pr := PingRet{Ping: "0.392", Time: "15-01-01 00:00"}
+	for i := 0; i < 3; i++ {
+		if err := s.AppendPingRet(ctx, "google.com", "Tokyo", pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ret, _ := s.GetMonitorResult("alice", "google.com")
+	if len(ret["Tokyo"]) != 1 {
+		t.Errorf("retried ping result should be inserted once, got %v", ret["Tokyo"])
+	}
+	if m := s.Metrics(); m.PingRetsAppended != 1 || m.PingRetsDuplicated != 2 {
+		t.Errorf("got %v appended and %v duplicated", m.PingRetsAppended, m.PingRetsDuplicated)
+	}
+}
+
+func Test_BackfillPingRets(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "0.392", Time: "15-01-01 00:10"})
+
+	n, err := s.BackfillPingRets(ctx, "google.com", "Tokyo", []PingRet{
+		{Ping: "0.500", Time: "15-01-01 00:05"},
+		{Ping: "0.100", Time: "15-01-01 00:00"},
+		// already stored
+		{Ping: "0.999", Time: "15-01-01 00:10"},
+	})
+	if err != nil || n != 2 {
+		t.Fatalf("got %v, %v", n, err)
+	}
+	want := []string{"15-01-01 00:00", "15-01-01 00:05", "15-01-01 00:10"}
+	check := func(prs []PingRet) {
+		if len(prs) != len(want) {
+			t.Fatalf("got %v", prs)
+		}
+		for i, pr := range prs {
+			if pr.Time != want[i] {
+				t.Errorf("got %v at %v, want %v", pr.Time, i, want[i])
+			}
+		}
+		if prs[2].Ping != "0.392" {
+			t.Errorf("stored result should be kept, got %v", prs[2])
+		}
+	}
+	ret, _ := s.GetMonitorResult("alice", "google.com")
+	check(ret["Tokyo"])
+
+	// the engine is rewritten in order
+	s.Reload()
+	ret, _ = s.GetMonitorResult("alice", "google.com")
+	check(ret["Tokyo"])
+
+	if _, err = s.BackfillPingRets(ctx, "bing.com", "Tokyo", nil); err == nil {
+		t.Error("should not backfill a server not monitored")
+	}
+}
+
+func Test_LatePingRet(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "0.100", Time: "15-01-01 00:00"})
+	s.AppendPingRet(ctx, "google.com", "London", PingRet{Ping: "0.200", Time: "15-01-01 00:00"})
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "0.300", Time: "15-01-01 00:10"})
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "0.400", Time: "15-01-01 00:20"})
+	// London is padded at 00:10
+	s.AppendPingRet(ctx, "google.com", "London", PingRet{Ping: "0.500", Time: "15-01-01 00:20"})
+
+	// late results of London, one replacing the padding and one between the results
+	if err := s.AppendPingRet(ctx, "google.com", "London", PingRet{Ping: "0.600", Time: "15-01-01 00:10"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendPingRet(ctx, "google.com", "London", PingRet{Ping: "0.700", Time: "15-01-01 00:15"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []PingRet{
+		{Ping: "0.200", Time: "15-01-01 00:00"},
+		{Ping: "0.600", Time: "15-01-01 00:10"},
+		{Ping: "0.700", Time: "15-01-01 00:15"},
+		{Ping: "0.500", Time: "15-01-01 00:20"},
+	}
+	check := func() {
+		ret, _ := s.GetMonitorResult("alice", "google.com")
+		if len(ret["London"]) != len(want) {
+			t.Fatalf("got %v", ret["London"])
+		}
+		for i, pr := range ret["London"] {
+			if pr != want[i] {
+				t.Errorf("got %v at %v, want %v", pr, i, want[i])
+			}
+		}
+	}
+	check()
+	s.Reload()
+	check()
+	if m := s.Metrics(); m.PingRetsLate != 2 {
+		t.Errorf("got %v late ping results", m.PingRetsLate)
+	}
+}
+
+func Test_Downsample(t *testing.T) {
+	prs := make([]PingRet, 1000)
+	for i := range prs {
+		prs[i] = PingRet{Ping: "1.000", Time: fmt.Sprintf("%04d", i)}
+	}
+	prs[500].Ping = "900.000"
+
+	sampled := Downsample(prs, 50)
+	if len(sampled) != 50 {
+		t.Fatalf("got %v points", len(sampled))
+	}
+	if sampled[0] != prs[0] || sampled[49] != prs[999] {
+		t.Error("the first and the last should be kept")
+	}
+	spike := false
+	for i, pr := range sampled {
+		if i > 0 && pr.Time <= sampled[i-1].Time {
+			t.Fatalf("points should keep the order, got %v after %v", pr.Time, sampled[i-1].Time)
+		}
+		spike = spike || pr.Ping == "900.000"
+	}
+	if !spike {
+		t.Error("the spike should be kept")
+	}
+	if len(Downsample(prs[:10], 50)) != 10 {
+		t.Error("results fewer than max points should be kept")
+	}
+}
+
+func Test_Aggregates(t *testing.T) {
+	dir := t.TempDir()
+	conf := testConfig(dir)
+	s := NewStore().SetStoreEngine(ENGINE_FILE, conf)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	for _, pr := range []PingRet{
+		{Ping: "1.000", Time: "15-01-01 00:00"},
+		{Ping: "3.000", Time: "15-01-01 00:30"},
+		{Ping: _DEFAULT_PING, Time: "15-01-01 00:50"},
+		{Ping: "5.000", Time: "15-01-01 01:00"},
+		{Ping: "7.000", Time: "15-01-02 00:00"},
+	} {
+		if err := s.AppendPingRet(ctx, "google.com", "Tokyo", pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(s *Store) {
+		hours, err := s.GetAggregates("alice", "google.com", RESOLUTION_HOUR, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if as := hours["Tokyo"]; len(as) != 3 {
+			t.Fatalf("got hourly aggregates %+v", as)
+		} else if a := as[0]; a.Start != "15-01-01 00" || a.Count != 3 || a.Down != 1 || a.Min != 1 || a.Max != 3 || a.Avg != 2 {
+			t.Errorf("got aggregate %+v of the first hour", a)
+		}
+		days, _ := s.GetAggregates("alice", "google.com", RESOLUTION_DAY, "15-01-01 12:00", "15-01-01 13:00")
+		if as := days["Tokyo"]; len(as) != 1 || as[0].Count != 4 || as[0].Uptime != 0.75 {
+			t.Errorf("got daily aggregates %+v", as)
+		}
+		if uptime, samples, _ := s.GetUptime("alice", "google.com", "15-01-01 00:00"); samples != 5 || uptime != 0.8 {
+			t.Errorf("got uptime %v of %v samples", uptime, samples)
+		}
+		if _, samples, _ := s.GetUptime("alice", "google.com", "15-01-03 00:00"); samples != 0 {
+			t.Errorf("got %v samples since the last day", samples)
+		}
+	}
+	check(s)
+	// closed aggregates are written to the engine
+	check(NewStore().SetStoreEngine(ENGINE_FILE, conf))
+	if _, err := ioutil.ReadFile(dir + "/servers.aggregates/google.com/Tokyo.hour"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := s.GetAggregates("alice", "google.com", "minute", "", ""); err == nil {
+		t.Error("should reject unknown resolution")
+	}
+}
+
+func Test_GroupAggregates(t *testing.T) {
+	var tokyo, osaka, paris Aggregate
+	for _, c := range []struct {
+		a    *Aggregate
+		ping string
+	}{{&tokyo, "10.000"}, {&tokyo, _DEFAULT_PING}, {&osaka, "30.000"}, {&osaka, "90.000"}, {&paris, _DEFAULT_PING}} {
+		c.a.add(PingRet{Ping: c.ping})
+	}
+	tokyo.Start, osaka.Start, paris.Start = "15-01-01", "15-01-01", "15-01-01"
+	all := map[string][]Aggregate{"Tokyo": {tokyo}, "Osaka": {osaka}, "Kyoto": {paris}, "Paris": {paris}, "Nowhere": {osaka}}
+	groups := GroupAggregates(all, func(location string) string {
+		return map[string]string{"Tokyo": "AS2516", "Osaka": "AS2516", "Kyoto": "AS2516", "Paris": "AS3215"}[location]
+	})
+	if len(groups) != 2 {
+		t.Fatalf("got groups %+v", groups)
+	}
+	a := groups["AS2516"][0]
+	if a.Count != 5 || a.Down != 2 || a.Min != 10 || a.Max != 90 || a.Avg != 130.0/3 || a.Uptime != 0.6 {
+		t.Errorf("got merged aggregate %+v", a)
+	}
+	if n, ok := a.Under(30); !ok || n != 2 {
+		t.Errorf("got %v under 30 ms, %v", n, ok)
+	}
+	if a = groups["AS3215"][0]; a.Count != 1 || a.Uptime != 0 || a.Min != 0 {
+		t.Errorf("got aggregate %+v of no ping result up", a)
+	}
+}
+
+func Test_Loss(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	for _, pr := range []PingRet{
+		{Ping: "1.000", Time: "15-01-01 00:00", Loss: "0.0"},
+		{Ping: "2.000", Time: "15-01-01 00:01", Loss: "66.7"},
+		{Ping: _DEFAULT_PING, Time: "15-01-01 00:02", Loss: "100.0"},
+		{Ping: "3.000", Time: "15-01-01 00:03"},
+	} {
+		if err := s.AppendPingRet(ctx, "google.com", "Tokyo", pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ret, _ := s.GetMonitorResult("alice", "google.com"); len(ret["Tokyo"]) != 4 || ret["Tokyo"][1].Loss != "66.7" {
+		t.Fatalf("should keep the loss of the ping results, got %+v", ret["Tokyo"])
+	}
+	hours, _ := s.GetAggregates("alice", "google.com", RESOLUTION_HOUR, "", "")
+	a := hours["Tokyo"][0]
+	if a.Pinged != 3 || math.Abs(a.Loss-166.7/3) > 1e-9 {
+		t.Errorf("should average the loss of the ping results telling it, got %+v", a)
+	}
+	b := Aggregate{Start: a.Start}
+	b.add(PingRet{Ping: "1.000", Loss: "0.0"})
+	if a.Merge(b); a.Pinged != 4 || math.Abs(a.Loss-166.7/4) > 1e-9 {
+		t.Errorf("should weight the loss by the ping results, got %+v", a)
+	}
+}
+
+func Test_MTUChanges(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "mtu://vpn.example.com")
+	for _, c := range []struct {
+		location string
+		pr       PingRet
+	}{
+		{"Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 00:00", MTU: 1500}},
+		{"Paris", PingRet{Ping: "2.000", Time: "15-01-01 00:00", MTU: 1420}},
+		{"Tokyo", PingRet{Ping: _DEFAULT_PING, Time: "15-01-01 00:01"}},
+		{"Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 00:02", MTU: 1500}},
+		{"Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 00:03", MTU: 1280}},
+	} {
+		if err := s.AppendPingRet(ctx, "mtu://vpn.example.com", c.location, c.pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	changes, err := s.GetMTUChanges("alice", "mtu://vpn.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MTUChange{
+		{Location: "Paris", Time: "15-01-01 00:00", To: 1420},
+		{Location: "Tokyo", Time: "15-01-01 00:00", To: 1500},
+		{Location: "Tokyo", Time: "15-01-01 00:03", From: 1500, To: 1280},
+	}
+	if fmt.Sprint(changes) != fmt.Sprint(want) {
+		t.Errorf("want changes %v, got %v", want, changes)
+	}
+	if _, err = s.GetMTUChanges("alice", "google.com"); err == nil {
+		t.Error("should fail of the servers not monitored")
+	}
+}
+
+func Test_Filter(t *testing.T) {
+	prs := map[string][]PingRet{
+		"eu-paris": {{Ping: "10.000", Time: "15-01-01 00:00", Loss: "0.0"}, {Ping: "12.000", Time: "15-01-01 00:01", Loss: "33.3"}, {Ping: _DEFAULT_PING, Time: "15-01-01 00:02"}},
+		"ap-tokyo": {{Ping: "200.000", Time: "15-01-01 00:00", Loss: "66.7"}},
+	}
+	e, err := filter.Parse(`location=~"eu-.*" AND loss>0`, PING_RET_FIELDS...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret := FilterPingRets(prs, e); len(ret) != 1 || len(ret["eu-paris"]) != 1 || ret["eu-paris"][0].Time != "15-01-01 00:01" {
+		t.Errorf("got filtered ping results %v", ret)
+	}
+	if e, _ = filter.Parse(`down=true`, PING_RET_FIELDS...); len(FilterPingRets(prs, e)["eu-paris"]) != 1 {
+		t.Errorf("should match the padding as down")
+	}
+	if ret := FilterPingRets(prs, nil); len(ret) != 2 {
+		t.Errorf("the empty filter should match all, got %v", ret)
+	}
+	as := map[string][]Aggregate{"eu-paris": {{Start: "15-01-01", Count: 3, Down: 1, Avg: 11, Uptime: 2.0 / 3}}, "ap-tokyo": {{Start: "15-01-01", Count: 1, Avg: 200, Uptime: 1}}}
+	if e, err = filter.Parse(`uptime<0.99 OR avg>=200`, AGGREGATE_FIELDS...); err != nil {
+		t.Fatal(err)
+	}
+	if ret := FilterAggregates(as, e); len(ret) != 2 {
+		t.Errorf("got filtered aggregates %v", ret)
+	}
+	if e, _ = filter.Parse(`loss>=0`, AGGREGATE_FIELDS...); len(FilterAggregates(as, e)) != 0 {
+		t.Errorf("the aggregates of no loss should not match")
+	}
+	if _, err = filter.Parse(`ping>1`, AGGREGATE_FIELDS...); err == nil {
+		t.Errorf("ping is not a field of the aggregates")
+	}
+}
+
+func Test_Series(t *testing.T) {
+	prs := []PingRet{
+		{Ping: "10.500", Time: "15-01-01 00:00"},
+		{Ping: _DEFAULT_PING, Time: "15-01-01 00:01", Loss: "100.0"},
+		{Ping: "12.000", Time: "15-01-01 00:02", Loss: "33.3", ProbeTime: "2015-01-01T09:02:01+09:00", ReceivedTime: "2015-01-01T09:02:03+09:00"},
+		// kept aside as they are
+		{Ping: "1", Time: "15-01-01 00:03"},
+		{Ping: "20.000", Time: "15-01-01 00:04", Steps: "login=1.000"},
+		{Ping: "30.000", Time: "15-01-01 00:05", MTU: 1500},
+		{Ping: "5.000", Time: "not a time"},
+	}
+	s := seriesOf(prs)
+	if s.Len() != len(prs) {
+		t.Fatalf("want %v ping results, got %v", len(prs), s.Len())
+	}
+	if got := s.All(); fmt.Sprint(got) != fmt.Sprint(prs) {
+		t.Errorf("want ping results %v, got %v", prs, got)
+	}
+	for i, pr := range prs {
+		if s.TimeAt(i) != pr.Time {
+			t.Errorf("want time %v at %v, got %v", pr.Time, i, s.TimeAt(i))
+		}
+	}
+	if len(s.raw) != 4 {
+		t.Errorf("want 4 ping results kept aside, got %v", len(s.raw))
+	}
+	if n, down, sum := s.stats(0); n != 7 || down != 1 || sum != 10.5+12+1+20+30+5 {
+		t.Errorf("want 7 ping results 1 down, got %v %v %v", n, down, sum)
+	}
+	if n, down, sum := seriesOf(prs[:3]).stats(1); n != 2 || down != 1 || sum != 12 {
+		t.Errorf("want 2 ping results 1 down, got %v %v %v", n, down, sum)
+	}
+	// the series taken before appending keeps seeing the same ping results
+	head := seriesOf(prs[:2])
+	b := head.Append(prs[2], prs[4])
+	if fmt.Sprint(head.All()) != fmt.Sprint(prs[:2]) || b.At(2) != prs[2] || b.At(3) != prs[4] {
+		t.Errorf("want the series appended apart, got %v and %v", head.All(), b.All())
+	}
+	if last, ok := b.Last(); !ok || last != prs[4] {
+		t.Errorf("want the last ping result %v, got %v", prs[4], last)
+	}
+	if _, ok := (Series{}).Last(); ok {
+		t.Error("should not have the last ping result of an empty series")
+	}
+}
+
+func Test_JSON(t *testing.T) {
+	prs := []PingRet{
+		{Ping: "10.500", Time: "15-01-01 00:00"},
+		{Ping: _DEFAULT_PING, Time: "15-01-01 00:01", Loss: "100.0"},
+		{Ping: "12.000", Time: "15-01-01 00:02", Loss: "33.3", ProbeTime: "2015-01-01T09:02:01+09:00", ReceivedTime: "2015-01-01T09:02:03+09:00"},
+		{Ping: "12.000", Time: "15-01-01 00:03", ProbeTime: "2014-12-31T20:33:01-03:30", ReceivedTime: "2015-01-01T00:03:02Z"},
+		{Ping: "20.000", Time: "15-01-01 00:04", Steps: "login=1.000", MTU: 1500},
+		{Ping: "<\"\\\n\t\x01&>\u2028\xff", Time: "not a time"},
+	}
+	want, _ := json.Marshal(prs)
+	if got := AppendPingRetsJSON(nil, prs); string(got) != string(want) {
+		t.Errorf("want %s, got %s", want, got)
+	}
+	if got := seriesOf(prs).AppendJSON(nil); string(got) != string(want) {
+		t.Errorf("want %s of the series, got %s", want, got)
+	}
+	if got := AppendPingRetsJSON(nil, nil); string(got) != "null" {
+		t.Errorf("want null, got %s", got)
+	}
+	servers := Servers{"google.com": {"Tokyo": prs, "Paris": prs[:1], "London": {}}, "<a>": nil}
+	want, _ = json.Marshal(map[string]map[string][]PingRet(servers))
+	if got, err := json.Marshal(servers); err != nil || string(got) != string(want) {
+		t.Errorf("want %s, got %s %v", want, got, err)
+	}
+	// the series is encoded without allocating into a buffer big enough
+	s := seriesOf(prs[:4])
+	b := make([]byte, 0, 4096)
+	if n := testing.AllocsPerRun(10, func() { b = s.AppendJSON(b[:0]) }); n != 0 {
+		t.Errorf("want no allocation, got %v", n)
+	}
+}
+
+func Test_Record(t *testing.T) {
+	for _, pr := range []PingRet{
+		{Ping: "10.500", Time: "15-01-01 00:00"},
+		{Ping: "12.000", Time: "15-01-01 00:02", Loss: "33.3", ProbeTime: "2015-01-01T09:02:01+09:00", Steps: "a<b", MTU: 1500},
+	} {
+		r := pingRetRecord{V: SCHEMA_VERSION, PingRet: pr}
+		r.C = r.checksum()
+		want, _ := json.Marshal(r)
+		got := pr.appendRecord([]byte("prefix"))
+		if string(got) != "prefix"+string(want)+"\n" {
+			t.Errorf("want record %s, got %s", want, got)
+		}
+		if back, err := unmarshalPingRet(got[len("prefix") : len(got)-1]); err != nil || back != pr {
+			t.Errorf("want %v back, got %v %v", pr, back, err)
+		}
+	}
+	// the buffer of the batch is reused
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	for i := 0; i < 3; i++ {
+		if err := s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: fmt.Sprintf("15-01-01 00:0%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if prs := s.load(true).servers["google.com"]["Tokyo"]; len(prs) != 3 || prs[2].Time != "15-01-01 00:02" {
+		t.Errorf("want 3 ping results written, got %v", prs)
+	}
+}
+
+func Test_SLO(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	for _, pr := range []PingRet{
+		{Ping: "50.000", Time: "15-01-01 00:00"},
+		{Ping: "90.000", Time: "15-01-01 00:01"},
+		{Ping: _DEFAULT_PING, Time: "15-01-01 00:02"},
+		{Ping: "40.000", Time: "15-01-01 00:03"},
+		{Ping: "30.000", Time: "15-01-02 12:00"},
+		{Ping: "100.000", Time: "15-01-02 12:01"},
+	} {
+		if err := s.AppendPingRet(ctx, "google.com", "Tokyo", pr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, bad := range []SLO{
+		{Name: "", Server: "google.com", Objective: 0.9},
+		{Name: "one", Server: "google.com", Objective: 1},
+		{Name: "odd", Server: "google.com", Objective: 0.9, Latency: 75},
+		{Name: "bing", Server: "bing.com", Objective: 0.9},
+	} {
+		if err := s.SetSLO(ctx, "alice", bad); err == nil {
+			t.Errorf("want the error of slo %+v", bad)
+		}
+	}
+	for _, o := range []SLO{
+		{Name: "fast", Server: "google.com", Objective: 0.9, Latency: 80, Days: 2, FastBurn: 4},
+		{Name: "up", Server: "google.com", Objective: 0.5},
+	} {
+		if err := s.SetSLO(ctx, "alice", o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Date(2015, 1, 2, 12, 30, 0, 0, time.Local)
+	sts, err := s.GetSLOs("alice", now)
+	if err != nil || len(sts) != 2 {
+		t.Fatalf("got %+v, %v", sts, err)
+	}
+	round := func(f float64) string { return fmt.Sprintf("%.2f", f) }
+	if st := sts[0]; st.Total != 6 || st.Good != 3 || round(st.Remaining) != "-4.00" || round(st.BurnRate) != "5.00" || !st.FastBurning {
+		t.Errorf("got status %+v of the latency slo", st)
+	}
+	if st := sts[1]; st.Good != 5 || round(st.SLI) != "0.83" || round(st.Remaining) != "0.67" || st.FastBurning {
+		t.Errorf("got status %+v of the availability slo", st)
+	}
+	if len(s.SLOSubjects()) != 1 {
+		t.Error("alice should be the subject of the slos")
+	}
+
+	s.DeleteMonitorServer(ctx, "alice", "google.com")
+	if sts, _ = s.GetSLOs("alice", now); len(sts) != 0 {
+		t.Errorf("the slos of the server deleted are left, got %+v", sts)
+	}
+	if err = s.DeleteSLO(ctx, "alice", "up"); err == nil {
+		t.Error("should not delete the slo not exist")
+	}
+}
+
+func Test_GetWorstServers(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	for server, pings := range map[string][]string{
+		"google.com": {"1.000", "1.000"},
+		"bing.com":   {"9.000", _DEFAULT_PING},
+		"yahoo.com":  {"5.000", "5.000"},
+	} {
+		s.AddMonitorServer(ctx, "alice", server)
+		s.AppendPingRet(ctx, server, "Tokyo", PingRet{Ping: pings[0], Time: "15-01-01 00:00"})
+		s.AppendPingRet(ctx, server, "Tokyo", PingRet{Ping: pings[1], Time: "15-01-01 00:10"})
+	}
+
+	ret, err := s.GetWorstServers("alice", METRIC_LATENCY, time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ret) != 2 || ret[0].Server != "bing.com" || ret[0].Value != 9 || ret[1].Server != "yahoo.com" {
+		t.Errorf("got worst latency %+v", ret)
+	}
+	ret, _ = s.GetWorstServers("alice", METRIC_DOWNTIME, time.Hour, 0)
+	if len(ret) != 3 || ret[0].Server != "bing.com" || ret[0].Value != 0.5 {
+		t.Errorf("got worst downtime %+v", ret)
+	}
+	if _, err = s.GetWorstServers("alice", "jitter", time.Hour, 1); err == nil {
+		t.Error("should reject unknown metric")
+	}
+}
+
+func Test_AlertSubjects(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	if err := s.SetServerLabels(ctx, "alice", "bing.com", map[string]string{"env": "prod"}); err == nil {
+		t.Error("should not label a server not monitored")
+	}
+	if err := s.SetServerLabels(ctx, "alice", "google.com", map[string]string{"env": "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.AlertSubjects("google.com")) != 0 {
+		t.Error("users without templates are not subjects")
+	}
+	if err := s.SetAlertTemplate(ctx, "alice", alert.Template{Name: "bad"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetAlertTemplate(ctx, "alice", alert.Template{Name: "prod-latency", Selector: map[string]string{"env": "prod"},
+		Rules: []alert.Rule{{Name: "slow", Metric: alert.METRIC_LATENCY, Threshold: 100}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetAlertTemplate(ctx, "alice", alert.Template{Name: "x", Rules: []alert.Rule{{Name: "r", Metric: "jitter"}}}); err == nil {
+		t.Error("should reject invalid template")
+	}
+	if err := s.DeleteAlertTemplate(ctx, "alice", "bad"); err != nil {
+		t.Fatal(err)
+	}
+
+	subjects := s.AlertSubjects("google.com")
+	if len(subjects) != 1 || subjects[0].Labels["env"] != "prod" || len(subjects[0].Templates) != 1 {
+		t.Errorf("got subjects %+v", subjects)
+	}
+	s.Reload()
+	if subjects = s.AlertSubjects("google.com"); len(subjects) != 1 || subjects[0].Templates[0].Name != "prod-latency" {
+		t.Errorf("templates should be written, got %+v", subjects)
+	}
+	s.DeleteMonitorServer(ctx, "alice", "google.com")
+	if u := s.GetUser("alice"); len(u.Labels) != 0 {
+		t.Errorf("labels should be deleted with the server, got %v", u.Labels)
+	}
+}
+
+func Test_NotificationChannels(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	s.SetAlertTemplate(ctx, "alice", alert.Template{Name: "down", Rules: []alert.Rule{{Name: "down", Metric: alert.METRIC_DOWN}}})
+	if err := s.SetNotificationChannel(ctx, "alice", alert.Channel{Name: "phone", Type: "pigeon"}); err == nil {
+		t.Error("should reject unknown channel type")
+	}
+	phone := alert.Channel{Name: "phone", Type: alert.CHANNEL_TELEGRAM, Config: map[string]string{"token": "t", "chat_id": "1"}}
+	if err := s.SetNotificationChannel(ctx, "alice", phone); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetNotificationSchedule(ctx, "alice", alert.Schedule{Timezone: "Nowhere/City"}); err == nil {
+		t.Error("should reject unknown timezone")
+	}
+	sched := alert.Schedule{Timezone: "Europe/Berlin", QuietHours: []alert.QuietHours{{Start: "23:00", End: "07:00", Channels: []string{"phone"}}}}
+	if err := s.SetNotificationSchedule(ctx, "alice", sched); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetAlertCorrelation(ctx, "alice", &alert.Correlation{Labels: []string{"provider"}}); err == nil {
+		t.Error("should reject correlation without window")
+	}
+	if err := s.SetAlertCorrelation(ctx, "alice", &alert.Correlation{Labels: []string{"provider"}, Window: 5, Min: 3}); err != nil {
+		t.Fatal(err)
+	}
+	s.Reload()
+	subjects := s.AlertSubjects("google.com")
+	if len(subjects) != 1 || len(subjects[0].Channels) != 1 || subjects[0].Schedule.Timezone != "Europe/Berlin" {
+		t.Errorf("channels and schedule should be written, got %+v", subjects)
+	}
+	if c := subjects[0].Correlation; c == nil || c.Min != 3 {
+		t.Errorf("correlation should be written, got %+v", c)
+	}
+	if err := s.DeleteNotificationChannel(ctx, "alice", "phone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteNotificationChannel(ctx, "alice", "phone"); err == nil {
+		t.Error("should not delete the channel twice")
+	}
+}
+
+func Test_ServerDependency(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	for _, server := range []string{"router", "switch", "web"} {
+		s.AddMonitorServer(ctx, "alice", server)
+	}
+	if err := s.SetServerDependency(ctx, "alice", "web", "bing.com"); err == nil {
+		t.Error("should not depend on a server not monitored")
+	}
+	if err := s.SetServerDependency(ctx, "alice", "web", "switch"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetServerDependency(ctx, "alice", "switch", "router"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetServerDependency(ctx, "alice", "router", "web"); err == nil {
+		t.Error("should reject cyclic dependency")
+	}
+	s.DeleteMonitorServer(ctx, "alice", "switch")
+	if u := s.GetUser("alice"); len(u.Dependencies) != 0 {
+		t.Errorf("dependencies should be deleted with the server, got %v", u.Dependencies)
+	}
+}
+
+func Test_Transaction(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	steps := []probe.Step{{Name: "home", URL: "https://example.com/"}, {Name: "login", Method: "POST", URL: "https://example.com/login"}}
+	for _, name := range []string{"", "a:b", "a/b"} {
+		if _, err := s.SetTransaction(ctx, "alice", name, steps); err == nil {
+			t.Errorf("want the error of name %q", name)
+		}
+	}
+	if _, err := s.SetTransaction(ctx, "alice", "checkout", nil); err == nil {
+		t.Error("want the error of no step")
+	}
+	server, err := s.SetTransaction(ctx, "alice", "checkout", steps)
+	if err != nil || server != "steps:alice:checkout" || probe.TargetOf(server).Kind != probe.KIND_STEPS || HostOf(server) != server {
+		t.Fatalf("got %v, %v", server, err)
+	}
+	if <-s.AddedServers() != server {
+		t.Error("the transaction should be pinged")
+	}
+	if _, err = s.SetTransaction(ctx, "alice", "checkout", steps[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Transaction(server); len(got) != 1 || got[0].Name != "home" {
+		t.Errorf("got steps %+v", got)
+	}
+	if s.Transaction("steps:bob:checkout") != nil || s.Transaction("google.com") != nil {
+		t.Error("want no steps of the servers not transactions")
+	}
+	s.DeleteMonitorServer(ctx, "alice", server)
+	if s.Transaction(server) != nil {
+		t.Error("the steps of the transaction deleted are left")
+	}
+}
+
+func Test_VirtualServer(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	if _, _, err := s.AddVirtualServer(ctx, "alice", "a:b"); err == nil {
+		t.Error("should reject name with colon")
+	}
+	server, token, err := s.AddVirtualServer(ctx, "alice", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsVirtual(server) || server != VirtualServer("alice", "backup") {
+		t.Errorf("got server %v", server)
+	}
+	if !s.CheckIngestToken(server, token) || s.CheckIngestToken(server, "x") || s.CheckIngestToken("google.com", token) {
+		t.Error("should accept the ingest token of the server only")
+	}
+	if err = s.AppendPingRet(ctx, server, "webhook", PingRet{Ping: "12.000", Time: "15-01-01 00:00"}); err != nil {
+		t.Fatal(err)
+	}
+	if ret, err := s.GetMonitorResult("alice", server); err != nil || len(ret["webhook"]) != 1 {
+		t.Errorf("got %v, %v", ret, err)
+	}
+	s.DeleteMonitorServer(ctx, "alice", server)
+	if s.CheckIngestToken(server, token) {
+		t.Error("token should be deleted with the server")
+	}
+}
+
+func Test_Heartbeat(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	if _, _, err := s.AddHeartbeat(ctx, "alice", "backup", 0, 0); err == nil {
+		t.Error("should reject zero interval")
+	}
+	server, _, err := s.AddHeartbeat(ctx, "alice", "backup", time.Hour, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hb, ok := s.Heartbeats()[server]; !ok || hb.Interval != time.Hour {
+		t.Errorf("got heartbeats %v", s.Heartbeats())
+	}
+	s.AppendPingRet(ctx, server, "heartbeat", PingRet{Ping: "1.000", Time: "15-01-01 00:00"})
+	s.AppendPingRet(ctx, server, "heartbeat", PingRet{Ping: _DEFAULT_PING, Time: "15-01-01 01:02"})
+	if last, lastUp := s.LatestPingRets(server, "heartbeat"); last.Time != "15-01-01 01:02" || lastUp.Time != "15-01-01 00:00" {
+		t.Errorf("got last %v, last up %v", last, lastUp)
+	}
+	s.DeleteMonitorServer(ctx, "alice", server)
+	if len(s.Heartbeats()) != 0 {
+		t.Error("heartbeat should be deleted with the server")
+	}
+}
+
+func Test_DNSHistory(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	now := time.Now()
+	for i, ips := range [][]string{{"1.1.1.1", "1.0.0.1"}, {"1.0.0.1", "1.1.1.1"}, {"8.8.8.8"}} {
+		changed, err := s.RecordResolution(ctx, "google.com", ips, now.Add(time.Duration(i)*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != (i != 1) {
+			t.Errorf("resolution %v changed should be %v", ips, i != 1)
+		}
+	}
+	s.Reload()
+	h, err := s.GetDNSHistory("alice", "google.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h) != 2 || h[0].IPs[0] != "1.0.0.1" || h[1].IPs[0] != "8.8.8.8" {
+		t.Errorf("got history %v", h)
+	}
+	if _, err = s.GetDNSHistory("alice", "bing.com"); err == nil {
+		t.Error("should not get history of a server not monitored")
+	}
+}
+
+func Test_Settings(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	st := Settings{Timezone: "Europe/Berlin", Units: UNIT_SECOND, DefaultRange: "7d", Locale: "zh-CN", Chart: ChartOptions{Type: CHART_AREA, Smooth: true},
+		Branding: Branding{Name: "Acme", Logo: "https://acme.com/logo.svg", PrimaryColor: "#1a73e8"}}
+	if err := s.SetSettings(ctx, "alice", st); err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []Settings{
+		{Timezone: "Mars/Olympus"}, {Units: "us"}, {DefaultRange: "-1h"}, {Chart: ChartOptions{Type: "pie"}}, {Locale: "zh_CN"},
+		{Branding: Branding{Logo: "http://acme.com/logo.svg"}}, {Branding: Branding{Logo: "data:text/html;base64,PHNjcmlwdD4="}},
+		{Branding: Branding{TextColor: "red"}}, {Branding: Branding{Name: strings.Repeat("a", 65)}},
+	} {
+		if err := s.SetSettings(ctx, "alice", invalid); err == nil {
+			t.Errorf("settings %+v should be invalid", invalid)
+		}
+	}
+	if err := s.SetSettings(ctx, "bob", st); err == nil {
+		t.Error("should not set settings of a user not exist")
+	}
+	s.Reload()
+	if got, err := s.GetSettings("alice"); err != nil {
+		t.Fatal(err)
+	} else if got != st {
+		t.Errorf("got settings %+v, expect %+v", got, st)
+	}
+}
+
+func Test_Usage(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddUser(ctx, "bob", "pass")
+	s.CountUsage("alice", 1, 0, 0)
+	s.CountUsage("alice", 1, 2, 100)
+	s.CountUsage("bob", 3, 1, 10)
+	us, err := s.GetUsage("alice", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(us) != 1 || us[0].Requests != 2 || us[0].Samples != 2 || us[0].Bytes != 100 {
+		t.Errorf("got usage %+v", us)
+	}
+	if _, err = s.GetUsage("carol", 1); err == nil {
+		t.Error("should not get usage of a user not exist")
+	}
+	top, err := s.TopUsage(USAGE_REQUESTS, 7, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 1 || top[0].Username != "bob" {
+		t.Errorf("got top usage %+v", top)
+	}
+	if top, _ = s.TopUsage(USAGE_BYTES, 7, 0); len(top) != 2 || top[0].Username != "alice" {
+		t.Errorf("got top usage by bytes %+v", top)
+	}
+	if _, err = s.TopUsage("cpu", 7, 1); err == nil {
+		t.Error("should not rank by an unknown metric")
+	}
+}
+
+func Test_EngineConfig(t *testing.T) {
+	for conf, valid := range map[string]bool{
+		`{"serversDir":"s","usersDir":"u"}`:                    true,
+		`{"serversDir":"s","usersDir":"u","leaseFile":"l"}`:    true,
+		`{"serversDir":"s"}`:                                   false,
+		`{"serversDir":"s","usersDir":"u","serverDir":"typo"}`: false,
+		`{"serversDir":1,"usersDir":"u"}`:                      false,
+		`["s","u"]`:                                            false,
+	} {
+		c, err := ParseEngineConfig(conf)
+		if err == nil {
+			err = ValidateEngineConfig(ENGINE_FILE, c)
+		}
+		if valid != (err == nil) {
+			t.Errorf("config %v valid should be %v, got %v", conf, valid, err)
+		}
+	}
+	if ValidateEngineConfig("nosql", EngineConfig{}) == nil {
+		t.Error("unknown engine should be invalid")
+	}
+}
+
+func Test_ContextCanceled(t *testing.T) {
+	s := newTestStore(t)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := s.AddUser(canceled, "alice", "pass"); err != context.Canceled {
+		t.Errorf("write of canceled context should be aborted, got %v", err)
+	}
+	s.SetWriteTimeout(time.Nanosecond)
+	if err := s.AddUser(ctx, "bob", "pass"); err != context.DeadlineExceeded {
+		t.Errorf("write should time out, got %v", err)
+	}
+	if m := s.Metrics(); m.EngineWriteErrors != 2 {
+		t.Errorf("aborted writes should be errors, got %v", m.EngineWriteErrors)
+	}
+}
+
+// fails the user writes of the file engine while fail is set
+type flakyEngine struct {
+	StoreEngine
+	fail int32
+}
+
+func (f *flakyEngine) WriteUser(ctx context.Context, username string, u *User) error {
+	if atomic.LoadInt32(&f.fail) == 1 {
+		return errors.New("engine is down")
+	}
+	return f.StoreEngine.WriteUser(ctx, username, u)
+}
+
+func Test_Breaker(t *testing.T) {
+	flaky := &flakyEngine{StoreEngine: newFileEngine()}
+	Register("flaky", func() StoreEngine { return flaky })
+	s := NewStore().SetStoreEngine("flaky", testConfig(t.TempDir())).
+		SetRetry(Retry{Attempts: 2, Base: time.Millisecond}).
+		SetBreaker(BreakerConfig{Threshold: 2, Cooldown: 50 * time.Millisecond, Buffer: 1})
+
+	atomic.StoreInt32(&flaky.fail, 1)
+	for _, username := range []string{"alice", "bob"} {
+		if err := s.AddUser(ctx, username, "pass"); err == nil {
+			t.Errorf("write of %v should fail", username)
+		}
+	}
+	if st := s.BreakerStatus(); st.State != BREAKER_OPEN || st.Opens != 1 {
+		t.Fatalf("breaker should be open, got %+v", st)
+	}
+	if err := s.AddUser(ctx, "carol", "pass"); err != nil {
+		t.Errorf("write should be buffered while the breaker is open, got %v", err)
+	}
+	if err := s.AddUser(ctx, "dave", "pass"); err == nil {
+		t.Error("write should be rejected once the buffer is full")
+	}
+
+	atomic.StoreInt32(&flaky.fail, 0)
+	// the buffer is drained in the background once the cooldown elapses
+	waitBreaker(t, s, BREAKER_CLOSED)
+	if err := s.AddUser(ctx, "erin", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.BreakerStatus(); st.State != BREAKER_CLOSED || st.Buffered != 0 || st.Dropped != 1 {
+		t.Errorf("breaker should be closed, got %+v", st)
+	}
+	if m := s.Metrics(); m.EngineWriteRetries != 2 {
+		t.Errorf("failed writes should be retried once, got %v retries", m.EngineWriteRetries)
+	}
+	s.Reload()
+	for username, written := range map[string]bool{"alice": false, "carol": true, "erin": true} {
+		if (s.GetUser(username) != nil) != written {
+			t.Errorf("user %v written should be %v", username, written)
+		}
+	}
+}
+
+// wait for the breaker to turn to the state
+func waitBreaker(t *testing.T, s *Store, state string) BreakerStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st := s.BreakerStatus()
+		if st.State == state {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("breaker should be %v, got %+v", state, st)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// the writes of the engine block once it is blocked, until released
+type blockingEngine struct {
+	StoreEngine
+	fail, block int32
+	released    chan struct{}
+}
+
+func (b *blockingEngine) WriteUser(ctx context.Context, username string, u *User) error {
+	if atomic.LoadInt32(&b.fail) == 1 {
+		return errors.New("engine is down")
+	}
+	if atomic.LoadInt32(&b.block) == 1 {
+		<-b.released
+	}
+	return b.StoreEngine.WriteUser(ctx, username, u)
+}
+
+// the buffer is drained in the background, the store is neither locked nor stalled by it
+func Test_BreakerDrain(t *testing.T) {
+	blocking := &blockingEngine{StoreEngine: newFileEngine(), released: make(chan struct{})}
+	Register("blocking", func() StoreEngine { return blocking })
+	s := NewStore().SetStoreEngine("blocking", testConfig(t.TempDir())).
+		SetBreaker(BreakerConfig{Threshold: 1, Cooldown: 20 * time.Millisecond, Buffer: 2 * _DRAIN_BATCH})
+	atomic.StoreInt32(&blocking.fail, 1)
+	if err := s.AddUser(ctx, "alice", "pass"); err == nil {
+		t.Fatal("write should fail")
+	}
+	usernames := make([]string, 0, _DRAIN_BATCH+1)
+	for i := 0; i <= _DRAIN_BATCH; i++ {
+		usernames = append(usernames, fmt.Sprint("user", i))
+		if err := s.AddUser(ctx, usernames[i], "pass"); err != nil {
+			t.Fatalf("write should be buffered, got %v", err)
+		}
+	}
+	atomic.StoreInt32(&blocking.block, 1)
+	atomic.StoreInt32(&blocking.fail, 0)
+	waitBreaker(t, s, BREAKER_HALF_OPEN)
+
+	done := make(chan error)
+	go func() {
+		s.GetUser("user0")
+		done <- s.AddUser(ctx, "bob", "pass")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("write should be buffered behind the drain, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the store should not be stalled by the drain")
+	}
+	close(blocking.released)
+	if st := waitBreaker(t, s, BREAKER_CLOSED); st.Buffered != 0 {
+		t.Errorf("the buffer should be drained, got %+v", st)
+	}
+	s.Reload()
+	for _, username := range append(usernames, "bob") {
+		if s.GetUser(username) == nil {
+			t.Errorf("%v should be written in order", username)
+		}
+	}
+}
+
+// a flaky file engine, which audits and purges
+type flakyFileEngine struct {
+	*fileEngine
+	fail int32
+}
+
+func (f *flakyFileEngine) WriteUser(ctx context.Context, username string, u *User) error {
+	if atomic.LoadInt32(&f.fail) == 1 {
+		return errors.New("engine is down")
+	}
+	return f.fileEngine.WriteUser(ctx, username, u)
+}
+
+// the purges and the audit entries are never buffered, they are on disk once they return
+func Test_BreakerUnbuffered(t *testing.T) {
+	flaky := &flakyFileEngine{fileEngine: newFileEngine().(*fileEngine)}
+	Register("unbuffered", func() StoreEngine { return flaky })
+	s := NewStore().SetStoreEngine("unbuffered", testConfig(t.TempDir())).
+		SetBreaker(BreakerConfig{Threshold: 1, Cooldown: time.Hour, Buffer: 10})
+	if err := s.AddUser(ctx, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&flaky.fail, 1)
+	if err := s.AddUser(ctx, "bob", "pass"); err == nil {
+		t.Fatal("write should fail")
+	}
+	if err := s.AddUser(ctx, "carol", "pass"); err != nil {
+		t.Fatalf("write should be buffered while the breaker is open, got %v", err)
+	}
+	if err := s.RecordAudit(ctx, AuditEntry{Actor: "support", Action: "view", Subject: "alice"}); err == nil {
+		t.Error("the audit entry should not be buffered")
+	}
+	if err := s.PurgeUserData(ctx, "alice", "support"); err == nil {
+		t.Error("the purge should not be buffered")
+	}
+	if s.GetUser("alice") == nil || len(s.Audit(0)) != 0 {
+		t.Error("nothing should be purged nor audited")
+	}
+	if st := s.BreakerStatus(); st.Buffered != 1 {
+		t.Errorf("only the write of carol should be buffered, got %+v", st)
+	}
+}
+
+func Test_Rollback(t *testing.T) {
+	flaky := &flakyEngine{StoreEngine: newFileEngine()}
+	Register("rollback", func() StoreEngine { return flaky })
+	s := NewStore().SetStoreEngine("rollback", testConfig(t.TempDir()))
+	if err := s.AddUser(ctx, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddMonitorServer(ctx, "alice", "google.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&flaky.fail, 1)
+	if err := s.AddUser(ctx, "bob", "pass"); err == nil {
+		t.Error("write should fail")
+	}
+	if s.GetUser("bob") != nil {
+		t.Error("user should not be added if the write fails")
+	}
+	if err := s.DeleteMonitorServer(ctx, "alice", "google.com"); err == nil {
+		t.Error("write should fail")
+	}
+	if !s.GetUser("alice").MonitorServers["google.com"] || len(s.GetServers()) != 1 {
+		t.Error("server should be kept if the write fails")
+	}
+	if err := s.UpdatePassword(ctx, "alice", "pass", "new"); err == nil {
+		t.Error("write should fail")
+	}
+	if s.GetUser("alice").Password != "pass" {
+		t.Error("password should be kept if the write fails")
+	}
+
+	atomic.StoreInt32(&flaky.fail, 0)
+	if err := s.DeleteMonitorServer(ctx, "alice", "google.com"); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.GetServers()) != 0 {
+		t.Error("server should be deleted")
+	}
+}
+
+func Test_View(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 00:00"})
+	v := s.View()
+
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "2.000", Time: "15-01-01 00:01"})
+	s.AppendPingRet(ctx, "google.com", "Osaka", PingRet{Ping: "3.000", Time: "15-01-01 00:01"})
+	s.UpdatePassword(ctx, "alice", "pass", "new")
+	s.AddUser(ctx, "bob", "pass")
+
+	if usernames := v.Usernames(); len(usernames) != 1 || usernames[0] != "alice" {
+		t.Errorf("view should not see later users, got %v", usernames)
+	}
+	if u, _ := v.User("alice"); u.Password != "pass" {
+		t.Error("view should not see later changes of the users")
+	}
+	var series int
+	v.Range(func(server, location string, prs []PingRet) bool {
+		series++
+		if location != "Tokyo" || len(prs) != 1 {
+			t.Errorf("view should not see later ping results, got %v %v", location, prs)
+		}
+		// appending to the view never writes the store
+		_ = append(prs, PingRet{Ping: "9.000", Time: "15-01-01 00:01"})
+		return true
+	})
+	if series != 1 {
+		t.Errorf("got %v series", series)
+	}
+	if ret, _ := s.GetMonitorResult("alice", "google.com"); ret["Tokyo"][1].Ping != "2.000" {
+		t.Errorf("store should keep its ping results, got %v", ret["Tokyo"])
+	}
+}
+
+func Test_Register(t *testing.T) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- Register("test", newFileEngine)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	var registered int
+	for err := range errs {
+		if err == nil {
+			registered++
+		} else if !errors.Is(err, ErrorEngineExist) {
+			t.Error(err)
+		}
+	}
+	if registered != 1 {
+		t.Errorf("engine should be registered once, got %v", registered)
+	}
+	// tolerated
+	MustRegister(ENGINE_FILE, newFileEngine)
+
+	names := ListEngines()
+	for _, name := range []string{ENGINE_FILE, ENGINE_MYSQL, ENGINE_REDIS, "test"} {
+		if i := sort.SearchStrings(names, name); i == len(names) || names[i] != name {
+			t.Errorf("%v is not listed in %v", name, names)
+		}
+	}
+	if err := ValidateEngineConfig("unknown", nil); err == nil {
+		t.Error("unknown engine should be invalid")
+	}
+}
+
+func Test_ServerQueue(t *testing.T) {
+	ch := make(chan string, 2)
+	q := newServerQueue(ch)
+	servers := []string{"a.com", "b.com", "c.com", "d.com", "e.com"}
+	for _, server := range servers {
+		// never blocks
+		q.send(server)
+	}
+	if l := q.len(); l != 3 {
+		t.Errorf("3 servers should be queued beyond the chan, got %v", l)
+	}
+	if n := q.overflowed(); n != 3 {
+		t.Errorf("got %v overflows", n)
+	}
+	for _, want := range servers {
+		select {
+		case got := <-ch:
+			if got != want {
+				t.Errorf("servers should be sent in order, want %v got %v", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v is not sent", want)
+		}
+	}
+	q.send("f.com")
+	if got := <-ch; got != "f.com" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func Test_MemoryEngine(t *testing.T) {
+	s := NewStore().SetStoreEngine(ENGINE_MEMORY, nil)
+	if err := s.AddUser(ctx, "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	file := t.TempDir() + "/state.json"
+	conf := EngineConfig{"file": file, "flushInterval": "1h"}
+	s = NewStore().SetStoreEngine(ENGINE_MEMORY, conf)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 00:00"})
+	// flushed on close
+	s.Close()
+
+	s = NewStore().SetStoreEngine(ENGINE_MEMORY, conf)
+	defer s.Close()
+	if s.GetUser("alice") == nil {
+		t.Fatal("users should be persisted")
+	}
+	if ret, _ := s.GetMonitorResult("alice", "google.com"); len(ret["Tokyo"]) != 1 {
+		t.Errorf("ping results should be persisted, got %v", ret)
+	}
+	if err := ValidateEngineConfig(ENGINE_MEMORY, EngineConfig{"flushInterval": "1m"}); err == nil {
+		t.Error("flushInterval without file should be invalid")
+	}
+}
+
+func Test_BackfillInvalidPingRets(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	prs := []PingRet{{Ping: "1.000", Time: "15-01-01 00:00"}, {Ping: "1.000", Time: "yesterday"}}
+	n, err := s.BackfillPingRets(ctx, "google.com", "Tokyo", prs)
+	if pe, ok := err.(*PingRetError); !ok || pe.Index != 1 || n != 0 {
+		t.Errorf("want invalid ping result 1, got %v inserted and %v", n, err)
+	}
+	if ret, _ := s.GetMonitorResult("alice", "google.com"); len(ret["Tokyo"]) != 0 {
+		t.Error("nothing should be inserted if any ping result is malformed")
+	}
+	for _, pr := range []PingRet{{Ping: "NaN", Time: "15-01-01 00:00"}, {Ping: "-1", Time: "15-01-01 00:00"}, {Ping: "1e9", Time: "15-01-01 00:00"},
+		{Ping: "1.000", Time: "15-01-01 00:00", Loss: "101.0"}, {Ping: "1.000", Time: "15-01-01 00:00", Loss: "lost"}} {
+		if pr.Validate(0) == nil {
+			t.Errorf("%v should be invalid", pr)
+		}
+	}
+}
+
+func Test_Corruption(t *testing.T) {
+	dir := t.TempDir()
+	conf := testConfig(dir)
+	s := NewStore().SetStoreEngine(ENGINE_FILE, conf)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddUser(ctx, "bob", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	for i := 0; i < 3; i++ {
+		s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: fmt.Sprintf("15-01-01 00:0%d", i)})
+	}
+	s.Close()
+
+	path := dir + "/servers/google.com/Tokyo"
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a flipped digit of the second record and a partial line of power loss
+	lines := strings.Split(string(b), "\n")
+	lines[1] = strings.Replace(lines[1], `"1.000"`, `"7.000"`, 1)
+	ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+`{"v":1,"pi`), os.ModePerm)
+	ioutil.WriteFile(dir+"/users/bob", []byte(`{"password":`), os.ModePerm)
+
+	open := func(mode string) *Store {
+		c := testConfig(dir)
+		c["corrupt"] = mode
+		return NewStore().SetStoreEngine(ENGINE_FILE, c)
+	}
+	s = open(CORRUPT_SKIP)
+	if cs := s.storeEngine.(CorruptionReporter).Corruptions(); len(cs) != 3 {
+		t.Errorf("want 3 corruptions, got %+v", cs)
+	}
+	if ret, _ := s.GetMonitorResult("alice", "google.com"); len(ret["Tokyo"]) != 2 {
+		t.Errorf("valid ping results should be loaded, got %v", ret["Tokyo"])
+	}
+	if s.GetUser("bob") != nil || s.GetUser("alice") == nil {
+		t.Error("corrupt user should be skipped")
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("corrupt records should fail the startup")
+			}
+		}()
+		open(CORRUPT_FAIL)
+	}()
+
+	open(CORRUPT_REPAIR)
+	if cs := open(CORRUPT_SKIP).storeEngine.(CorruptionReporter).Corruptions(); len(cs) != 0 {
+		t.Errorf("corruptions should be repaired, got %+v", cs)
+	}
+	if _, err := os.Stat(dir + "/users/bob" + _CORRUPT_SUFFIX); err != nil {
+		t.Errorf("corrupt user should be moved aside: %v", err)
+	}
+	if ValidateEngineConfig(ENGINE_FILE, EngineConfig{"serversDir": "a", "usersDir": "b", "corrupt": "ignore"}) == nil {
+		t.Error("unknown corrupt mode should be invalid")
+	}
+}
+
+func Test_ParallelInit(t *testing.T) {
+	dir := t.TempDir()
+	conf := testConfig(dir)
+	conf["initConcurrency"] = 4
+	s := NewStore().SetStoreEngine(ENGINE_FILE, conf)
+	for i := 0; i < 3; i++ {
+		s.AddUser(ctx, fmt.Sprintf("user%d", i), "pass")
+	}
+	for i := 0; i < 40; i++ {
+		server := fmt.Sprintf("server%02d.com", i)
+		s.AddMonitorServer(ctx, "user0", server)
+		for j := 0; j < 5; j++ {
+			s.AppendPingRet(ctx, server, "Tokyo", PingRet{Ping: "1.000", Time: fmt.Sprintf("15-01-01 00:0%d", j)})
+		}
+	}
+	s.Close()
+	for _, server := range []string{"server07.com", "server03.com"} {
+		f, _ := os.OpenFile(dir+"/servers/"+server+"/Tokyo", os.O_APPEND|os.O_WRONLY, os.ModePerm)
+		f.WriteString(`{"v":1,"pi`)
+		f.Close()
+	}
+
+	e, err := NewEngine(ENGINE_FILE, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		mu   sync.Mutex
+		last = 0
+	)
+	e.(ProgressReporter).SetProgress(func(done, total int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if total != 40 {
+			t.Errorf("want 40 series in total, got %v", total)
+		}
+		last = max(last, done)
+	})
+	servers, users, allServers := e.Init()
+	if len(servers) != 40 || len(users) != 3 || allServers["server39.com"] != 1 {
+		t.Errorf("got %v servers, %v users, %v", len(servers), len(users), allServers)
+	}
+	for server, locations := range servers {
+		if len(locations["Tokyo"]) != 5 {
+			t.Errorf("every series should be loaded, got %v of %v", locations, server)
+		}
+	}
+	if last != 40 {
+		t.Errorf("the progress should reach the total, got %v", last)
+	}
+	cs := e.(CorruptionReporter).Corruptions()
+	if len(cs) != 2 || !strings.Contains(cs[0].Path, "server03.com") || !strings.Contains(cs[1].Path, "server07.com") {
+		t.Errorf("corruptions should be sorted by path, got %+v", cs)
+	}
+
+	func() {
+		defer func() {
+			if e := recover(); e != "corrupt" {
+				t.Errorf("the panic of a goroutine should be raised again, got %v", e)
+			}
+		}()
+		parallel(10, 4, func(i int) {
+			if i == 5 {
+				panic("corrupt")
+			}
+		})
+	}()
+}
+
+func Test_RecoveryReport(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir))
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 00:00"})
+	s.Close()
+	ioutil.WriteFile(dir+"/servers/google.com/Osaka"+_TMP_SUFFIX, []byte("{"), os.ModePerm)
+
+	s = NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir))
+	r := s.RecoveryReport()
+	if r.Users != 1 || r.Servers != 1 || r.Series != 1 || r.PingRets != 1 || r.Reload {
+		t.Errorf("got %+v", r)
+	}
+	if r.Clean() || len(r.Warnings) != 1 {
+		t.Errorf("left temporary file should be warned, got %v", r.Warnings)
+	}
+	os.Remove(dir + "/servers/google.com/Osaka" + _TMP_SUFFIX)
+	s.Reload()
+	if r = s.RecoveryReport(); !r.Clean() || !r.Reload {
+		t.Errorf("reload should be reported clean, got %+v", r)
+	}
+}
+
+func Test_ReadOnly(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	s.SetReadOnly(ctx, true)
+	if err := s.AddUser(ctx, "bob", "pass"); err != ErrorReadOnly {
+		t.Errorf("writes should fail while read only, got %v", err)
+	}
+	if err := s.DeleteMonitorServer(ctx, "alice", "google.com"); err != ErrorReadOnly || !s.GetUser("alice").MonitorServers["google.com"] {
+		t.Errorf("rejected write should not change the store, got %v", err)
+	}
+	if err := s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 00:00"}); err != nil {
+		t.Errorf("ping results should be buffered, got %v", err)
+	}
+	if ret, _ := s.GetMonitorResult("alice", "google.com"); len(ret["Tokyo"]) != 0 {
+		t.Error("buffered ping results should not be stored yet")
+	}
+	if st := s.ReadOnlyStatus(); !st.On || st.Buffered != 1 || !s.Health(ctx).ReadOnly {
+		t.Errorf("got %+v", st)
+	}
+
+	if n, err := s.SetReadOnly(ctx, false); n != 1 || err != nil {
+		t.Errorf("buffered ping result should be appended, got %v %v", n, err)
+	}
+	if ret, _ := s.GetMonitorResult("alice", "google.com"); len(ret["Tokyo"]) != 1 {
+		t.Errorf("got %v", ret["Tokyo"])
+	}
+	if err := s.AddUser(ctx, "bob", "pass"); err != nil {
+		t.Error(err)
+	}
+}
+
+// the ping results buffered are kept if turning read only off is cancelled, and appended in order by the next call
+func Test_ReadOnlyCancel(t *testing.T) {
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	s.SetReadOnly(ctx, true)
+	for _, at := range []string{"15-01-01 00:00", "15-01-01 00:01"} {
+		if err := s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: at}); err != nil {
+			t.Fatalf("ping results should be buffered, got %v", err)
+		}
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := s.SetReadOnly(cancelled, false); err == nil {
+		t.Error("cancelled context should fail")
+	}
+	if st := s.ReadOnlyStatus(); st.Buffered != 2 || st.Dropped != 0 {
+		t.Errorf("the ping results not appended should be buffered again, got %+v", st)
+	}
+	if n, err := s.SetReadOnly(ctx, false); n != 2 || err != nil {
+		t.Errorf("buffered ping results should be appended, got %v %v", n, err)
+	}
+	if ret, _ := s.GetMonitorResult("alice", "google.com"); len(ret["Tokyo"]) != 2 || ret["Tokyo"][1].Time != "15-01-01 00:01" {
+		t.Errorf("got %v", ret["Tokyo"])
+	}
+}
+
+func Test_Tiers(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Store {
+		return NewStore().
+			SetTiers(Tiers{Hot: 6 * time.Hour, Warm: 7 * 24 * time.Hour, Cold: NewDirObjectStore(dir + "/cold")}).
+			SetStoreEngine(ENGINE_FILE, testConfig(dir))
+	}
+	s := open()
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	now := time.Now()
+	ago := func(d time.Duration) string { return now.Add(-d).Format(_PING_TIME_LAYOUT) }
+	for _, d := range []time.Duration{10 * 24 * time.Hour, 3 * 24 * time.Hour, time.Hour} {
+		if err := s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: ago(d)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := s.Tier(ctx, now, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Evicted != 2 || r.Expired != 1 || r.Archived != 2 {
+		t.Errorf("got %+v", r)
+	}
+	check := func(s *Store) {
+		if ret, _ := s.GetMonitorResult("alice", "google.com"); len(ret["Tokyo"]) != 1 {
+			t.Errorf("want the hot ping result in memory, got %v", ret["Tokyo"])
+		}
+		ret, err := s.GetPingRets("alice", "google.com", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if prs := ret["Tokyo"]; len(prs) != 2 || prs[0].Time != ago(3*24*time.Hour) {
+			t.Errorf("want the hot and the warm ping results, got %v", prs)
+		}
+		if ret, _ = s.GetPingRets("alice", "google.com", ago(2*time.Hour), ""); len(ret["Tokyo"]) != 1 {
+			t.Errorf("want the ping result of the range, got %v", ret["Tokyo"])
+		}
+		days, err := s.GetAggregates("alice", "google.com", RESOLUTION_DAY, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if as := days["Tokyo"]; len(as) != 3 || as[0].Start != ago(10 * 24 * time.Hour)[:len("06-01-02")] {
+			t.Errorf("want the aggregates spanning the tiers, got %+v", as)
+		}
+	}
+	check(s)
+	// the load keeps the hot tier in memory
+	check(open())
+
+	if _, err = s.BackfillPingRets(ctx, "google.com", "Tokyo", []PingRet{{Ping: "1.000", Time: ago(30 * 24 * time.Hour)}}); err == nil {
+		t.Error("want the ping results older than the warm tier rejected")
+	}
+	if r, err = s.Tier(ctx, now, nil); err != nil || r != (TierReport{}) {
+		t.Errorf("want nothing to tier again, got %+v, %v", r, err)
+	}
+}
+
+func Test_Purge(t *testing.T) {
+	dir := t.TempDir()
+	cold := NewDirObjectStore(dir + "/cold")
+	open := func() *Store {
+		return NewStore().SetTiers(Tiers{Cold: cold}).SetStoreEngine(ENGINE_FILE, testConfig(dir))
+	}
+	s := open()
+	s.AddUser(ctx, "alice", "pass")
+	s.AddUser(ctx, "bob", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	s.AddMonitorServer(ctx, "alice", "yahoo.com")
+	s.AddMonitorServer(ctx, "bob", "yahoo.com")
+	s.SetServerLabels(ctx, "bob", "yahoo.com", map[string]string{"env": "prod"})
+	for _, server := range []string{"google.com", "yahoo.com"} {
+		s.AppendPingRet(ctx, server, "Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 00:00"})
+		s.AppendPingRet(ctx, server, "Tokyo", PingRet{Ping: "1.000", Time: "15-01-02 00:00"})
+	}
+	cold.Put(ctx, coldAggregatesKey("yahoo.com", "Tokyo", RESOLUTION_DAY), []byte("[]"))
+
+	if err := s.PurgeServerData(ctx, "yahoo.com", "support"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PurgeUserData(ctx, "alice", "support"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PurgeUserData(ctx, "alice", "support"); err == nil {
+		t.Error("want the error of the user purged")
+	}
+	check := func(s *Store) {
+		if servers := s.GetServers(); len(servers) != 0 {
+			t.Errorf("want no servers, got %v", servers)
+		}
+		if usernames := s.GetUsernames(); len(usernames) != 1 || usernames[0] != "bob" {
+			t.Errorf("want bob only, got %v", usernames)
+		}
+		if u := s.GetUser("bob"); len(u.MonitorServers) != 0 || len(u.Labels) != 0 {
+			t.Errorf("want yahoo.com forgotten by bob, got %+v", u)
+		}
+		s.withReadLock(func() {
+			if len(s.servers) != 0 || len(s.aggregates) != 0 {
+				t.Errorf("want the ping results and the aggregates purged, got %v, %v", s.servers, s.aggregates)
+			}
+		})
+		es := s.Audit(0)
+		if len(es) != 2 || es[0].Action != AUDIT_PURGE_SERVER || es[0].Subject != "yahoo.com" || es[1].Action != AUDIT_PURGE_USER || es[1].Actor != "support" {
+			t.Errorf("got audit log %+v", es)
+		}
+	}
+	check(s)
+	check(open())
+	if keys, _ := cold.List(ctx, ""); len(keys) != 0 {
+		t.Errorf("want the archived aggregates purged, got %v", keys)
+	}
+}
+
+func Test_RequestIdLogged(t *testing.T) {
+	var buf bytes.Buffer
+	s := newTestStore(t).SetLogger(slog.New(slog.NewTextHandler(&buf, nil))).SetSlowThreshold(time.Nanosecond)
+	if err := s.RecordAudit(WithRequestId(ctx, "req-1"), AuditEntry{Actor: "carol", Action: AUDIT_IMPERSONATE, Subject: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddUser(ctx, "alice", "HELLO"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	found := 0
+	for _, line := range lines {
+		if strings.Contains(line, "msg=audit") || strings.Contains(line, "op=StoreEngine.AppendAudit") {
+			if !strings.Contains(line, "request_id=req-1") {
+				t.Errorf("the record should carry the request id: %v", line)
+			}
+			found++
+		} else if strings.Contains(line, "request_id") {
+			t.Errorf("the record of another request should carry no request id: %v", line)
+		}
+	}
+	if found == 0 {
+		t.Errorf("the audit should be logged, got %v", lines)
+	}
+}
+
+func Test_RecordAudit(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir))
+	if err := s.RecordAudit(ctx, AuditEntry{Actor: "carol", Action: AUDIT_IMPERSONATE, Subject: "alice", Detail: "user: ticket 42"}); err != nil {
+		t.Fatal(err)
+	}
+	// a view can not go unrecorded
+	s.SetReadOnly(ctx, true)
+	if err := s.RecordAudit(ctx, AuditEntry{Actor: "carol", Action: AUDIT_IMPERSONATE, Subject: "bob"}); err == nil {
+		t.Error("want the error of read only")
+	}
+	s.SetReadOnly(ctx, false)
+	for _, s := range []*Store{s, NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir))} {
+		if es := s.Audit(0); len(es) != 1 || es[0].Actor != "carol" || es[0].Subject != "alice" || es[0].Time.IsZero() {
+			t.Errorf("got audit log %+v", es)
+		}
+	}
+}
+
+func Test_Encryption(t *testing.T) {
+	dir := t.TempDir()
+	key := func(b byte) string { return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32)) }
+	conf := func(enc *EncryptionConfig) EngineConfig {
+		c := testConfig(dir)
+		if enc != nil {
+			c["encryption"] = enc
+		}
+		return c
+	}
+	// written before the encryption is enabled
+	s := NewStore().SetStoreEngine(ENGINE_FILE, conf(nil))
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: "15-01-01 00:00"})
+	s.Close()
+
+	os.Setenv("WATCHDOG_TEST_KEY", key(2))
+	defer os.Unsetenv("WATCHDOG_TEST_KEY")
+	k1 := &EncryptionConfig{Current: "k1", Keys: map[string]string{"k1": key(1)}}
+	s = NewStore().SetStoreEngine(ENGINE_FILE, conf(k1))
+	s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "2.000", Time: "15-01-01 00:01"})
+	s.AddMonitorServer(ctx, "alice", "yahoo.com")
+	b, _ := ioutil.ReadFile(dir + "/users/alice")
+	if !bytes.HasPrefix(b, []byte("enc:k1:")) || bytes.Contains(b, []byte("yahoo.com")) {
+		t.Errorf("want the user encrypted by k1, got %s", b)
+	}
+	s.Close()
+
+	check := func(s *Store) {
+		if ret, _ := s.GetMonitorResult("alice", "google.com"); len(ret["Tokyo"]) != 2 {
+			t.Errorf("want the plaintext and the encrypted ping results, got %v", ret["Tokyo"])
+		}
+		if u := s.GetUser("alice"); u == nil || !u.MonitorServers["yahoo.com"] {
+			t.Errorf("got user %+v", u)
+		}
+	}
+	// rotated to k2 held by the environment, k1 decrypts the records meanwhile
+	s = NewStore().SetStoreEngine(ENGINE_FILE, conf(&EncryptionConfig{Current: "k2", Keys: map[string]string{"k1": key(1), "k2": "env:WATCHDOG_TEST_KEY"}}))
+	check(s)
+	// the series and the user
+	if n, err := s.RotateKeys(ctx); err != nil || n != 2 {
+		t.Fatalf("got %v, %v", n, err)
+	}
+	s.Close()
+	b, _ = ioutil.ReadFile(dir + "/servers/google.com/Tokyo")
+	if lines := bytes.Split(bytes.TrimSpace(b), []byte("\n")); len(lines) != 2 || !bytes.HasPrefix(lines[0], []byte("enc:k2:")) || !bytes.HasPrefix(lines[1], []byte("enc:k2:")) {
+		t.Errorf("want the ping results encrypted by k2, got %s", b)
+	}
+	check(NewStore().SetStoreEngine(ENGINE_FILE, conf(&EncryptionConfig{Current: "k2", Keys: map[string]string{"k2": key(2)}})))
+
+	if err := ValidateEngineConfig(ENGINE_FILE, conf(&EncryptionConfig{Current: "k3", Keys: k1.Keys})); err == nil {
+		t.Error("want the error of the current key not configured")
+	}
+}
+
+// the servers sent to the chan so far, sorted
+func drain(ch chan string) (servers []string) {
+	for {
+		select {
+		case server := <-ch:
+			servers = append(servers, server)
+		default:
+			sort.Strings(servers)
+			return
+		}
+	}
+}
+
+func Test_Assignments(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Store { return NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir)) }
+	s := open()
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "a.com")
+	s.AddMonitorServer(ctx, "alice", "b.com")
+	s.Close()
+
+	s = open()
+	if added := drain(s.AddServerChan); len(added) != 0 {
+		t.Errorf("the servers assigned before should not be sent again, got %v", added)
+	}
+	if servers := s.GetServers(); len(servers) != 2 {
+		t.Errorf("got %v", servers)
+	}
+	// changed without closing, like a crash
+	s.AddMonitorServer(ctx, "alice", "c.com")
+	s.DeleteMonitorServer(ctx, "alice", "b.com")
+
+	s = open()
+	if added, kicked := drain(s.AddServerChan), drain(s.KickServerChan); fmt.Sprint(added, kicked) != "[c.com] [b.com]" {
+		t.Errorf("only the servers changed should be sent, got added %v kicked %v", added, kicked)
+	}
+	if n, err := s.ResyncAssignments(); err != nil || n != 2 {
+		t.Errorf("got %v, %v", n, err)
+	}
+	if added := drain(s.AddServerChan); fmt.Sprint(added) != "[a.com c.com]" {
+		t.Errorf("every server should be sent again, got %v", added)
+	}
+
+	os.Remove(dir + "/servers.assignments")
+	if added := drain(open().AddServerChan); fmt.Sprint(added) != "[a.com c.com]" {
+		t.Errorf("every server should be sent without the assignments, got %v", added)
+	}
+}
+
+func Test_Isolation(t *testing.T) {
+	s := newTestStore(t).SetIsolation(ISOLATION_ORGANIZATION)
+	for _, username := range []string{"alice", "bob"} {
+		s.AddUser(ctx, username, "pass")
+		s.AddMonitorServer(ctx, username, "google.com")
+	}
+	if s.GetUser("alice").MonitorSince["google.com"] == "" {
+		t.Fatal("the server added should be stamped")
+	}
+	// alice started monitoring the server an hour before bob
+	s.users["alice"].MonitorSince["google.com"] = "15-01-01 00:00"
+	s.users["bob"].MonitorSince["google.com"] = "15-01-01 01:30"
+	for _, tm := range []string{"15-01-01 00:00", "15-01-01 01:00", "15-01-01 01:30", "15-01-01 02:00"} {
+		s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "1.000", Time: tm})
+	}
+	s.cache.clear()
+
+	visible := func(username string) string {
+		ret, err := s.GetMonitorResult(username, "google.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		as, err := s.GetAggregates(username, "google.com", RESOLUTION_HOUR, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(len(ret["Tokyo"]), len(as["Tokyo"]))
+	}
+	if got := visible("alice"); got != "4 3" {
+		t.Errorf("alice should see the whole history, got %v", got)
+	}
+	// the aggregate of 01:00 covers a ping result before bob
+	if got := visible("bob"); got != "2 1" {
+		t.Errorf("bob should see the ping results since bob started monitoring, got %v", got)
+	}
+	worst := func(username string) int64 {
+		scores, err := s.GetWorstServers(username, METRIC_LATENCY, 24*time.Hour, 0)
+		if err != nil || len(scores) != 1 {
+			t.Fatalf("got %v, %v", scores, err)
+		}
+		return scores[0].Count
+	}
+	if alice, bob := worst("alice"), worst("bob"); alice != 4 || bob != 1 {
+		t.Errorf("the worst servers should be scored by the aggregates visible, got %v of alice and %v of bob", alice, bob)
+	}
+	for _, username := range []string{"alice", "bob"} {
+		if err := s.SetOrganization(ctx, username, "acme"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := visible("bob"); got != "4 3" {
+		t.Errorf("bob should see the history since the organization started monitoring, got %v", got)
+	}
+	if got := worst("bob"); got != 4 {
+		t.Errorf("got %v", got)
+	}
+	if s.DeleteMonitorServer(ctx, "alice", "google.com"); visible("bob") != "2 1" {
+		t.Errorf("alice should not widen the history of bob once alice stops monitoring, got %v", visible("bob"))
+	}
+	if s.SetIsolation(ISOLATION_NONE); visible("bob") != "4 3" {
+		t.Errorf("the whole history should be visible without isolation, got %v", visible("bob"))
+	}
+
+	series := seriesOf([]PingRet{{Ping: "1.000", Time: "15-01-01 00:00"}, {Ping: "x", Time: "15-01-01 00:01"}, {Ping: "2.000", Time: "15-01-01 00:02"}})
+	if prs := series.from(1).All(); fmt.Sprint(prs) != fmt.Sprint(series.All()[1:]) {
+		t.Errorf("got %v", prs)
+	}
+}
+
+func Test_Ownership(t *testing.T) {
+	s := newTestStore(t)
+	for _, username := range []string{"alice", "bob", "carol"} {
+		s.AddUser(ctx, username, "pass")
+	}
+	c, err := s.ClaimHost(ctx, "alice", "Example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := s.ClaimHost(ctx, "alice", "example.com"); again.Token != c.Token || c.IsVerified() {
+		t.Errorf("the claim should be reused, got %v and %v", c, again)
+	}
+	if _, err := s.ClaimHost(ctx, "alice", ""); err == nil {
+		t.Error("an empty host should not be claimed")
+	}
+	if err := s.VerifyClaim(ctx, "alice", "example.org", "dns"); err == nil {
+		t.Error("a host not claimed should not be verified")
+	}
+	if s.OwnershipVerified("alice", "example.com") {
+		t.Error("the claim is not verified yet")
+	}
+	if err := s.VerifyClaim(ctx, "alice", "example.com", "dns"); err != nil {
+		t.Fatal(err)
+	}
+	if claims, _ := s.GetClaims("alice"); !claims["example.com"].IsVerified() || claims["example.com"].Method != "dns" {
+		t.Errorf("got %v", claims)
+	}
+	for host, want := range map[string]bool{"example.com": true, "www.Example.com": true, "badexample.com": false, "example.org": false} {
+		if got := s.OwnershipVerified("alice", host); got != want {
+			t.Errorf("%v: want %v, got %v", host, want, got)
+		}
+	}
+	if s.OwnershipVerified("bob", "example.com") {
+		t.Error("bob should not share the claim of alice outside the organization")
+	}
+	for _, username := range []string{"alice", "bob"} {
+		s.SetOrganization(ctx, username, "acme")
+	}
+	if !s.OwnershipVerified("bob", "www.example.com") || s.OwnershipVerified("carol", "example.com") {
+		t.Error("the claims should be shared within the organization only")
+	}
+}
+
+func Test_OptOut(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Store { return NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir)) }
+	s := open()
+	s.AddUser(ctx, "alice", "pass")
+	for _, server := range []string{"a.com", "b.com", "tcp://b.com:80"} {
+		s.AddMonitorServer(ctx, "alice", server)
+	}
+	drain(s.AddServerChan)
+
+	if err := s.AddOptOut(ctx, OptOut{Target: "b.com", Reason: "complaint", Actor: "carol", Servers: []string{"tcp://b.com:80", "b.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if kicked := drain(s.KickServerChan); fmt.Sprint(kicked) != "[b.com tcp://b.com:80]" {
+		t.Errorf("the servers opted out should be kicked at once, got %v", kicked)
+	}
+	if servers := s.GetServers(); fmt.Sprint(servers) != "[a.com]" {
+		t.Errorf("got %v", servers)
+	}
+	if !s.GetUser("alice").MonitorServers["b.com"] {
+		t.Error("the server opted out should stay in the monitoring list")
+	}
+	if es := s.Audit(1); len(es) != 1 || es[0].Action != AUDIT_OPT_OUT || es[0].Actor != "carol" || es[0].Detail != "complaint" {
+		t.Errorf("got %v", es)
+	}
+	// deleted and added again, it is never assigned
+	s.DeleteMonitorServer(ctx, "alice", "b.com")
+	s.AddMonitorServer(ctx, "alice", "b.com")
+	if n, _ := s.ResyncAssignments(); n != 1 || fmt.Sprint(drain(s.AddServerChan)) != "[a.com]" {
+		t.Errorf("the servers opted out should not be resynced, got %v", n)
+	}
+	// updated, it keeps the servers kicked
+	if err := s.AddOptOut(ctx, OptOut{Target: "b.com", Reason: "second complaint", Actor: "carol"}); err != nil {
+		t.Fatal(err)
+	}
+	if added := drain(s.AddServerChan); len(added) != 0 {
+		t.Errorf("got %v", added)
+	}
+	s.Close()
+
+	s = open()
+	if added := drain(s.AddServerChan); len(added) != 0 {
+		t.Errorf("got %v", added)
+	}
+	if oos := s.GetOptOuts(); len(oos) != 1 || oos[0].Reason != "second complaint" || len(oos[0].Servers) != 2 {
+		t.Errorf("the opt-outs should be persisted, got %v", oos)
+	}
+	if err := s.RemoveOptOut(ctx, "c.com", "carol"); err == nil {
+		t.Error("c.com did not opt out")
+	}
+	if err := s.RemoveOptOut(ctx, "b.com", "carol"); err != nil {
+		t.Fatal(err)
+	}
+	if added := drain(s.AddServerChan); fmt.Sprint(added) != "[b.com tcp://b.com:80]" {
+		t.Errorf("the servers opted in should be assigned again, got %v", added)
+	}
+	if es := s.Audit(1); es[0].Action != AUDIT_OPT_OUT_REMOVED {
+		t.Errorf("got %v", es)
+	}
+	if len(s.GetOptOuts()) != 0 || len(s.GetServers()) != 3 {
+		t.Errorf("got %v, %v", s.GetOptOuts(), s.GetServers())
+	}
+}
+
+func Test_Inbox(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Store { return NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir)) }
+	s := open()
+	for _, username := range []string{"alice", "bob"} {
+		s.AddUser(ctx, username, "pass")
+	}
+	if _, err := s.PostMessage(ctx, "alice", Message{Kind: MESSAGE_ALERT}); err == nil {
+		t.Error("a message without text should not be posted")
+	}
+	if _, err := s.PostMessage(ctx, "alice", Message{Kind: "spam", Text: "hi"}); err == nil {
+		t.Error("a message of an unknown kind should not be posted")
+	}
+	if _, err := s.PostMessage(ctx, "nobody", Message{Kind: MESSAGE_SYSTEM, Text: "hi"}); err == nil {
+		t.Error("a message should not be posted to a user not exist")
+	}
+	a := alert.Alert{Username: "alice", Server: "a.com", State: alert.STATE_FIRING}
+	first, err := s.PostMessage(ctx, "alice", Message{Kind: MESSAGE_ALERT, Text: "a.com down", Alert: &a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Broadcast(ctx, Message{Kind: MESSAGE_SYSTEM, Text: "maintenance"}); err != nil || n != 2 {
+		t.Fatalf("got %v, %v", n, err)
+	}
+	ms, unread, _ := s.GetInbox("alice", false, 0)
+	if len(ms) != 2 || unread != 2 || ms[0].Text != "maintenance" || ms[1].Id != first.Id || ms[1].Alert.Server != "a.com" {
+		t.Errorf("the latest should be first, got %v, %v", ms, unread)
+	}
+	if ms, _, _ := s.GetInbox("alice", false, 1); len(ms) != 1 || ms[0].Text != "maintenance" {
+		t.Errorf("got %v", ms)
+	}
+	if n, _ := s.MarkRead(ctx, "alice", []string{first.Id, "unknown"}); n != 1 {
+		t.Errorf("got %v", n)
+	}
+	if ms, unread, _ := s.GetInbox("alice", true, 0); len(ms) != 1 || unread != 1 || ms[0].Text != "maintenance" {
+		t.Errorf("got %v, %v", ms, unread)
+	}
+	s.Close()
+
+	s = open()
+	if _, unread, _ := s.GetInbox("alice", false, 0); unread != 1 {
+		t.Errorf("the inbox should be persisted, got %v unread", unread)
+	}
+	if n, _ := s.MarkRead(ctx, "bob", nil); n != 1 {
+		t.Errorf("all the messages should be marked read, got %v", n)
+	}
+	if _, unread, _ := s.GetInbox("bob", false, 0); unread != 0 {
+		t.Errorf("got %v", unread)
+	}
+	// the messages beyond the retention or the capacity are dropped
+	s.SetInboxRetention(time.Hour)
+	s.PostMessage(ctx, "bob", Message{Kind: MESSAGE_SYSTEM, Text: "old", Time: time.Now().Add(-2 * time.Hour)})
+	if ms, _, _ := s.GetInbox("bob", false, 0); len(ms) != 1 || ms[0].Text != "maintenance" {
+		t.Errorf("got %v", ms)
+	}
+	for i := 0; i < _MAX_MESSAGES+1; i++ {
+		s.PostMessage(ctx, "bob", Message{Kind: MESSAGE_SYSTEM, Text: fmt.Sprint(i)})
+	}
+	if ms, unread, _ := s.GetInbox("bob", false, 0); len(ms) != _MAX_MESSAGES || unread != _MAX_MESSAGES || ms[0].Text != fmt.Sprint(_MAX_MESSAGES) {
+		t.Errorf("got %v messages, %v unread", len(ms), unread)
+	}
+}
+
+func Test_InboxStore(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *Store { return NewStore().SetStoreEngine(ENGINE_FILE, testConfig(dir)) }
+	s := open()
+	s.AddUser(ctx, "alice", "pass")
+	s.AddUser(ctx, "bob", "pass")
+	if _, err := s.PostMessage(ctx, "alice", Message{Kind: MESSAGE_SYSTEM, Text: "recent", Time: time.Now().Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	// the user record is not written by the messages
+	if b, err := ioutil.ReadFile(dir + "/users/alice"); err != nil || strings.Contains(string(b), "recent") {
+		t.Errorf("the inbox should be stored apart from the user, got %s, %v", b, err)
+	}
+	if _, err := os.Stat(dir + "/users.inbox/alice"); err != nil {
+		t.Error(err)
+	}
+	// the inbox written within the user record before is moved out once loaded
+	u := s.users["bob"].copy()
+	u.Inbox = []Message{{Id: "1", Kind: MESSAGE_SYSTEM, Text: "legacy", Time: time.Now().Add(-time.Minute)}}
+	if err := s.storeEngine.WriteUser(ctx, "bob", u); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = open()
+	if ms, _, _ := s.GetInbox("bob", false, 0); len(ms) != 1 || ms[0].Text != "legacy" {
+		t.Errorf("the inbox of the record should be moved, got %v", ms)
+	}
+	if inboxes, err := s.storeEngine.(InboxStore).ReadInboxes(); err != nil || len(inboxes["bob"]) != 1 || len(inboxes["alice"]) != 1 {
+		t.Errorf("got %v, %v", inboxes, err)
+	}
+	// the replica follows the inboxes by the feed
+	snap := s.Snapshot()
+	if n, err := s.Broadcast(ctx, Message{Kind: MESSAGE_SYSTEM, Text: "maintenance"}); err != nil || n != 2 {
+		t.Fatalf("got %v, %v", n, err)
+	}
+	events, _ := s.Changes(snap.Epoch, snap.Seq, 0)
+	r := NewStore().SetStoreEngine(ENGINE_MEMORY, EngineConfig{})
+	r.ApplySnapshot(snap)
+	r.ApplyChanges(events)
+	if ms, _, _ := r.GetInbox("alice", false, 0); len(ms) != 2 || ms[0].Text != "maintenance" {
+		t.Errorf("the replica should follow the inboxes, got %v", ms)
+	}
+
+	// the messages beyond the retention are pruned from memory and the engine
+	s.SetInboxRetention(30 * time.Second)
+	if n, err := s.PruneInboxes(ctx); err != nil || n != 2 {
+		t.Errorf("want the old messages pruned, got %v, %v", n, err)
+	}
+	if n, _ := s.PruneInboxes(ctx); n != 0 {
+		t.Errorf("nothing left to prune, got %v", n)
+	}
+	s.SetInboxRetention(0)
+	if ms, _, _ := s.GetInbox("alice", false, 0); len(ms) != 1 || ms[0].Text != "maintenance" {
+		t.Errorf("got %v", ms)
+	}
+	s.SetReadOnly(ctx, true)
+	if _, err := s.PostMessage(ctx, "alice", Message{Kind: MESSAGE_SYSTEM, Text: "hi"}); err != ErrorReadOnly {
+		t.Errorf("want the error of read only, got %v", err)
+	}
+	s.SetReadOnly(ctx, false)
+	s.Close()
+	s = open()
+	if ms, _, _ := s.GetInbox("bob", false, 0); len(ms) != 1 || ms[0].Text != "maintenance" {
+		t.Errorf("the inbox pruned should be persisted, got %v", ms)
+	}
+}
+
+type nopSMS struct{}
+
+func (nopSMS) SendSMS(to, text string) error { return nil }
+
+func Test_Phone(t *testing.T) {
+	alert.SetSMSGateway(nopSMS{})
+	defer alert.SetSMSGateway(nil)
+	s := newTestStore(t)
+	s.AddUser(ctx, "alice", "pass")
+	sms := alert.Channel{Name: "pager", Type: alert.CHANNEL_SMS, Config: map[string]string{"phone": "+1 415 555 2671"}}
+	if err := s.SetNotificationChannel(ctx, "alice", sms); err == nil {
+		t.Error("an sms channel of a phone not verified should be rejected")
+	}
+	if _, err := s.RequestPhoneVerification(ctx, "alice", "555 2671"); err == nil {
+		t.Error("a phone not in the international format should be rejected")
+	}
+	code, err := s.RequestPhoneVerification(ctx, "alice", "+1 415 555 2671")
+	if err != nil || len(code) != 6 {
+		t.Fatalf("got %v, %v", code, err)
+	}
+	if _, err := s.RequestPhoneVerification(ctx, "alice", "+14155552671"); err == nil {
+		t.Error("another code should not be sent within a minute")
+	}
+	if err := s.VerifyPhone(ctx, "alice", "+14155552671", "wrong"); err == nil {
+		t.Error("a wrong code should not verify the phone")
+	}
+	if phones, _ := s.GetPhones("alice"); phones["+14155552671"].Code != "" || phones["+14155552671"].IsVerified() {
+		t.Errorf("got %v", phones)
+	}
+	if s.GetUser("alice").Phones["+14155552671"].Attempts != 1 {
+		t.Error("the wrong code should be counted")
+	}
+	if err := s.VerifyPhone(ctx, "alice", "+14155552671", code); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.VerifyPhone(ctx, "alice", "+14155552671", code); err == nil {
+		t.Error("the code should not be reused")
+	}
+	if _, err := s.RequestPhoneVerification(ctx, "alice", "+14155552671"); err == nil {
+		t.Error("a verified phone should not be verified again")
+	}
+	if err := s.SetNotificationChannel(ctx, "alice", sms); err != nil {
+		t.Fatal(err)
+	}
+	s.Reload()
+	if phones, _ := s.GetPhones("alice"); !phones["+14155552671"].IsVerified() || len(s.GetUser("alice").Channels) != 1 {
+		t.Errorf("the phones should be written, got %v", phones)
+	}
+	if err := s.DeletePhone(ctx, "alice", "+14155552671"); err != nil {
+		t.Fatal(err)
+	}
+	if u := s.GetUser("alice"); len(u.Phones) != 0 || len(u.Channels) != 0 {
+		t.Errorf("the sms channels of the phone should be removed, got %v", u.Channels)
+	}
+
+	// the code expires, and so do too many wrong attempts
+	code, _ = s.RequestPhoneVerification(ctx, "alice", "+81312345678")
+	for i := 0; i < _PHONE_CODE_ATTEMPTS; i++ {
+		s.VerifyPhone(ctx, "alice", "+81312345678", "wrong")
+	}
+	if err := s.VerifyPhone(ctx, "alice", "+81312345678", code); err == nil {
+		t.Error("the code should be invalidated after too many wrong attempts")
+	}
+}
+
+func Test_PhoneLimits(t *testing.T) {
+	s := newTestStore(t).SetPhoneCodeLimit(7)
+	s.AddUser(ctx, "alice", "pass")
+	s.AddUser(ctx, "bob", "pass")
+	for i := 0; i < _MAX_PENDING_PHONES; i++ {
+		if _, err := s.RequestPhoneVerification(ctx, "alice", fmt.Sprintf("+8131234567%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.RequestPhoneVerification(ctx, "alice", "+81312345679"); err == nil {
+		t.Error("the phones pending should be capped")
+	}
+	// the code not sent is dropped
+	if err := s.CancelPhoneVerification(ctx, "alice", "+81312345670"); err != nil {
+		t.Fatal(err)
+	}
+	if phones, _ := s.GetPhones("alice"); len(phones) != _MAX_PENDING_PHONES-1 {
+		t.Errorf("got %v", phones)
+	}
+	if _, err := s.RequestPhoneVerification(ctx, "alice", "+81312345679"); err != nil {
+		t.Fatal(err)
+	}
+	// the phones not verified in time are dropped
+	s.withWriteLock(func() {
+		s.updateUser(ctx, "alice", func(u *User) error {
+			phones := make(map[string]Phone, len(u.Phones))
+			for phone, p := range u.Phones {
+				p.Sent = p.Sent.Add(-_PHONE_CODE_TTL - time.Minute)
+				phones[phone] = p
+			}
+			u.Phones = phones
+			return nil
+		})
+	})
+	if phones, _ := s.GetPhones("alice"); len(phones) != 0 {
+		t.Errorf("the stale phones should be dropped, got %v", phones)
+	}
+	if _, err := s.RequestPhoneVerification(ctx, "alice", "+81312345671"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RequestPhoneVerification(ctx, "alice", "+81312345672"); err == nil {
+		t.Error("the codes sent to a user should be capped within the hour")
+	}
+	if len(s.GetUser("alice").Phones) != 1 {
+		t.Errorf("the stale phones should be dropped by the write, got %v", s.GetUser("alice").Phones)
+	}
+	// 5 of alice, the 7th of all the users is rejected
+	for i := 0; i < 2; i++ {
+		if _, err := s.RequestPhoneVerification(ctx, "bob", fmt.Sprintf("+1415555267%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.RequestPhoneVerification(ctx, "bob", "+14155552672"); err == nil {
+		t.Error("the codes sent to all the users should be capped within the hour")
+	}
+}
+
+// fails the leases of the file engine while fail is set
+type downLeaser struct {
+	StoreEngine
+	fail int32
+}
+
+func (d *downLeaser) AcquireLease(holder string, ttl time.Duration) (bool, error) {
+	if atomic.LoadInt32(&d.fail) == 1 {
+		return false, errors.New("lease backend is down")
+	}
+	return d.StoreEngine.(Leaser).AcquireLease(holder, ttl)
+}
+
+func (d *downLeaser) ReleaseLease(holder string) error {
+	return d.StoreEngine.(Leaser).ReleaseLease(holder)
+}
+
+func Test_LeadershipDown(t *testing.T) {
+	down := &downLeaser{StoreEngine: newFileEngine()}
+	Register("downlease", func() StoreEngine { return down })
+	s := NewStore().SetStoreEngine("downlease", testConfig(t.TempDir()))
+	ttl := 300 * time.Millisecond
+	if ok, err := s.AcquireLeadership("a", ttl); !ok || err != nil {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	atomic.StoreInt32(&down.fail, 1)
+	if ok, err := s.AcquireLeadership("a", ttl); !ok || err == nil {
+		t.Errorf("the leader should keep leading while its lease is valid, got %v, %v", ok, err)
+	}
+	time.Sleep(ttl - ttl/_LEASE_MARGIN)
+	if ok, _ := s.AcquireLeadership("a", ttl); ok {
+		t.Error("the leader should step down before its lease expires")
+	}
+	atomic.StoreInt32(&down.fail, 0)
+	if ok, err := s.AcquireLeadership("a", ttl); !ok || err != nil {
+		t.Errorf("the leader should lead again once the backend is up, got %v, %v", ok, err)
+	}
+	s.ReleaseLeadership("a")
+	atomic.StoreInt32(&down.fail, 1)
+	if ok, _ := s.AcquireLeadership("a", ttl); ok {
+		t.Error("the holder should not lead by the lease it released")
+	}
+}
+
+// counts the rewrites of the series of the file engine
+type rewriteCounter struct {
+	*fileEngine
+	rewrites int32
+}
+
+func (r *rewriteCounter) WritePingRets(ctx context.Context, server, location string, prs []PingRet) error {
+	atomic.AddInt32(&r.rewrites, 1)
+	return r.fileEngine.WritePingRets(ctx, server, location, prs)
+}
+
+func Test_LatePingRets(t *testing.T) {
+	counter := &rewriteCounter{fileEngine: newFileEngine().(*fileEngine)}
+	Register("rewrites", func() StoreEngine { return counter })
+	dir := t.TempDir()
+	s := NewStore().SetStoreEngine("rewrites", testConfig(dir))
+	s.AddUser(ctx, "alice", "pass")
+	s.AddMonitorServer(ctx, "alice", "google.com")
+	at := func(minute int) string {
+		return time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(minute) * time.Minute).Format(_PING_TIME_LAYOUT)
+	}
+	// every other minute of 3 hours, then the minutes between them delivered late along with a duplicate and a new one
+	for m := 0; m < 180; m += 2 {
+		s.AppendPingRet(ctx, "google.com", "Tokyo", PingRet{Ping: "10.000", Time: at(m)})
+	}
+	var late []PingRet
+	for m := 179; m > 0; m -= 2 {
+		late = append(late, PingRet{Ping: "20.000", Time: at(m)})
+	}
+	late = append(late, PingRet{Ping: "30.000", Time: at(2)}, PingRet{Ping: "40.000", Time: at(180)})
+	if err := s.AppendPingRets(ctx, "google.com", "Tokyo", late); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&counter.rewrites); n != 1 {
+		t.Errorf("the late ping results should be merged by one rewrite, got %v", n)
+	}
+	ret, _ := s.GetMonitorResult("alice", "google.com")
+	if prs := ret["Tokyo"]; len(prs) != 181 || prs[1].Ping != "20.000" || prs[2].Ping != "10.000" || prs[180].Ping != "40.000" {
+		t.Fatalf("got %v ping results", len(prs))
+	}
+	if m := s.Metrics(); m.PingRetsLate != 89 || m.PingRetsDuplicated != 1 {
+		t.Errorf("got %v late, %v duplicated", m.PingRetsLate, m.PingRetsDuplicated)
+	}
+	as, _ := s.GetAggregates("alice", "google.com", RESOLUTION_HOUR, "", "")
+	if hours := as["Tokyo"]; len(hours) != 4 || hours[0].Count != 60 || hours[0].Avg != 15 || hours[3].Count != 1 {
+		t.Errorf("the hours of the late ping results should be aggregated again, got %+v", hours)
+	}
+	// the closed ones are written
+	s.Close()
+	s = NewStore().SetStoreEngine("rewrites", testConfig(dir))
+	if as, _ := s.GetAggregates("alice", "google.com", RESOLUTION_HOUR, "", ""); len(as["Tokyo"]) != 4 || as["Tokyo"][1].Avg != 15 {
+		t.Errorf("got %+v", as["Tokyo"])
+	}
+}
@@ -0,0 +1,94 @@
+package storetest
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+// FakeEngine is the memory engine with scripted failures, for application level tests of the handlers and the alerting
+type FakeEngine struct {
+	store.StoreEngine
+
+	mu     sync.Mutex
+	err    error
+	writes int
+}
+
+// NewFake returns a store on a FakeEngine, closed when the test finishes
+func NewFake(t *testing.T) (*store.Store, *FakeEngine) {
+	e, err := store.NewEngine(store.ENGINE_MEMORY, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &FakeEngine{StoreEngine: e}
+	s := store.NewStore().SetEngine(f)
+	t.Cleanup(s.Close)
+	return s, f
+}
+
+// FailWrites makes the engine writes fail with err until called with nil
+func (f *FakeEngine) FailWrites(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Writes returns the engine writes which succeeded
+func (f *FakeEngine) Writes() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes
+}
+
+func (f *FakeEngine) write(w func() error) error {
+	f.mu.Lock()
+	err := f.err
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = w(); err == nil {
+		f.mu.Lock()
+		f.writes++
+		f.mu.Unlock()
+	}
+	return err
+}
+
+func (f *FakeEngine) WriteUser(ctx context.Context, username string, u *store.User) error {
+	return f.write(func() error { return f.StoreEngine.WriteUser(ctx, username, u) })
+}
+
+func (f *FakeEngine) BatchWritePingRets(ctx context.Context, server, location string, prs []store.PingRet) error {
+	return f.write(func() error { return f.StoreEngine.BatchWritePingRets(ctx, server, location, prs) })
+}
+
+// the optional interfaces of the memory engine are not promoted by the embedded StoreEngine
+
+func (f *FakeEngine) WritePingRets(ctx context.Context, server, location string, prs []store.PingRet) error {
+	return f.write(func() error {
+		return f.StoreEngine.(store.SeriesWriter).WritePingRets(ctx, server, location, prs)
+	})
+}
+
+func (f *FakeEngine) ReadPingRets(ctx context.Context, server, location string) ([]store.PingRet, error) {
+	return f.StoreEngine.(store.SeriesReader).ReadPingRets(ctx, server, location)
+}
+
+func (f *FakeEngine) WriteDNSHistory(ctx context.Context, server string, h []store.Resolution) error {
+	return f.write(func() error {
+		return f.StoreEngine.(store.DNSHistorian).WriteDNSHistory(ctx, server, h)
+	})
+}
+
+func (f *FakeEngine) ReadDNSHistory() (map[string][]store.Resolution, error) {
+	return f.StoreEngine.(store.DNSHistorian).ReadDNSHistory()
+}
+
+func (f *FakeEngine) Close() error {
+	return f.StoreEngine.(io.Closer).Close()
+}
@@ -0,0 +1,271 @@
+// Package storetest is the conformance suite of the store engines
+//
+// An engine registered by a third party is verified by running the suite in its tests:
+//
+//	func Test_Conformance(t *testing.T) {
+//		storetest.Suite{Open: func(t *testing.T) func() store.StoreEngine {
+//			conf := store.EngineConfig{"dsn": newTestDatabase(t)}
+//			return func() store.StoreEngine { return mustNewEngine(t, "mine", conf) }
+//		}}.Run(t)
+//	}
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+// Suite exercises the semantics the store expects of an engine
+type Suite struct {
+	// Open returns a constructor of the engines sharing a fresh storage, the engines are loaded with their config
+	// an engine constructed after another recovers what the other wrote
+	Open func(t *testing.T) func() store.StoreEngine
+	// the engine loses the writes not flushed by Close, e.g. the memory engine
+	SkipCrashRecovery bool
+}
+
+func (s Suite) Run(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		f    func(t *testing.T, open func() store.StoreEngine)
+	}{
+		{"InitEmpty", testInitEmpty},
+		{"WriteUser", testWriteUser},
+		{"BatchWritePingRets", testBatchWritePingRets},
+		{"ConcurrentBatchWritePingRets", testConcurrentBatchWritePingRets},
+		{"CrashRecovery", s.testCrashRecovery},
+		{"SeriesWriter", testSeriesWriter},
+		{"SeriesReader", testSeriesReader},
+		{"DNSHistorian", testDNSHistorian},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) { c.f(t, s.Open(t)) })
+	}
+}
+
+var ctx = context.Background()
+
+// close the engine, like the store on shutdown, and open another one on the storage
+func restart(t *testing.T, e store.StoreEngine, open func() store.StoreEngine) store.StoreEngine {
+	if c, ok := e.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			t.Fatalf("can not close engine: %v", err)
+		}
+	}
+	return open()
+}
+
+func newUser(password string, servers ...string) *store.User {
+	u := &store.User{Password: password, MonitorServers: make(map[string]bool)}
+	for _, server := range servers {
+		u.MonitorServers[server] = true
+	}
+	return u
+}
+
+func ping(i int) store.PingRet {
+	return store.PingRet{Ping: fmt.Sprintf("%d.000", i), Time: fmt.Sprintf("15-01-01 %02d:%02d", i/60, i%60)}
+}
+
+func pings(from, to int) []store.PingRet {
+	prs := make([]store.PingRet, 0, to-from)
+	for i := from; i < to; i++ {
+		prs = append(prs, ping(i))
+	}
+	return prs
+}
+
+func testInitEmpty(t *testing.T, open func() store.StoreEngine) {
+	servers, users, allServers := open().Init()
+	if len(servers) != 0 || len(users) != 0 || len(allServers) != 0 {
+		t.Errorf("fresh engine should be empty, got %v servers %v users %v monitored servers", len(servers), len(users), len(allServers))
+	}
+}
+
+func testWriteUser(t *testing.T, open func() store.StoreEngine) {
+	e := open()
+	e.Init()
+	for username, u := range map[string]*store.User{
+		"alice": newUser("pass", "google.com"),
+		"bob":   newUser("pass", "google.com", "yahoo.com"),
+	} {
+		if err := e.WriteUser(ctx, username, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the latest write wins
+	if err := e.WriteUser(ctx, "alice", newUser("new", "google.com", "bing.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, users, allServers := restart(t, e, open).Init()
+	if len(users) != 2 {
+		t.Fatalf("got %v users", len(users))
+	}
+	if u := users["alice"]; u == nil || u.Password != "new" || !reflect.DeepEqual(u.MonitorServers, newUser("", "google.com", "bing.com").MonitorServers) {
+		t.Errorf("user should be overwritten by the latest write, got %+v", u)
+	}
+	// the number of users monitoring the servers
+	if want := map[string]int64{"google.com": 2, "yahoo.com": 1, "bing.com": 1}; !reflect.DeepEqual(allServers, want) {
+		t.Errorf("want monitored servers %v, got %v", want, allServers)
+	}
+}
+
+func testBatchWritePingRets(t *testing.T, open func() store.StoreEngine) {
+	e := open()
+	e.Init()
+	// appended in order of the batches
+	for _, prs := range [][]store.PingRet{pings(0, 3), pings(3, 4), pings(4, 10)} {
+		if err := e.BatchWritePingRets(ctx, "google.com", "Tokyo", prs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.BatchWritePingRets(ctx, "google.com", "Osaka", pings(0, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, _, _ := restart(t, e, open).Init()
+	if got := servers["google.com"]["Tokyo"]; !reflect.DeepEqual(got, pings(0, 10)) {
+		t.Errorf("want %v, got %v", pings(0, 10), got)
+	}
+	if got := servers["google.com"]["Osaka"]; !reflect.DeepEqual(got, pings(0, 1)) {
+		t.Errorf("want %v, got %v", pings(0, 1), got)
+	}
+}
+
+// the store writes the series of different servers and locations concurrently, e.g. flushing the buffer of the breaker
+func testConcurrentBatchWritePingRets(t *testing.T, open func() store.StoreEngine) {
+	e := open()
+	e.Init()
+	const series, batches = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, series)
+	for i := 0; i < series; i++ {
+		wg.Add(1)
+		go func(location string) {
+			defer wg.Done()
+			for b := 0; b < batches; b++ {
+				if err := e.BatchWritePingRets(ctx, "google.com", location, pings(b*2, b*2+2)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(fmt.Sprintf("location%d", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	servers, _, _ := restart(t, e, open).Init()
+	if len(servers["google.com"]) != series {
+		t.Fatalf("want %v series, got %v", series, len(servers["google.com"]))
+	}
+	for location, prs := range servers["google.com"] {
+		if !reflect.DeepEqual(prs, pings(0, batches*2)) {
+			t.Errorf("%v: want %v ping results in order, got %v", location, batches*2, prs)
+		}
+	}
+}
+
+// the writes returned without error survive a crash, the engine is opened again without closing the previous one
+func (s Suite) testCrashRecovery(t *testing.T, open func() store.StoreEngine) {
+	if s.SkipCrashRecovery {
+		t.Skip("engine loses the writes not flushed by close")
+	}
+	e := open()
+	e.Init()
+	if err := e.WriteUser(ctx, "alice", newUser("pass", "google.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.BatchWritePingRets(ctx, "google.com", "Tokyo", pings(0, 5)); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, users, _ := open().Init()
+	if users["alice"] == nil {
+		t.Error("user should be recovered")
+	}
+	if got := servers["google.com"]["Tokyo"]; !reflect.DeepEqual(got, pings(0, 5)) {
+		t.Errorf("want %v, got %v", pings(0, 5), got)
+	}
+}
+
+func testSeriesWriter(t *testing.T, open func() store.StoreEngine) {
+	e := open()
+	sw, ok := e.(store.SeriesWriter)
+	if !ok {
+		t.Skip("engine is not a SeriesWriter")
+	}
+	e.Init()
+	if err := e.BatchWritePingRets(ctx, "google.com", "Tokyo", pings(0, 5)); err != nil {
+		t.Fatal(err)
+	}
+	// the series is replaced
+	if err := sw.WritePingRets(ctx, "google.com", "Tokyo", pings(2, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	servers, _, _ := restart(t, e, open).Init()
+	if got := servers["google.com"]["Tokyo"]; !reflect.DeepEqual(got, pings(2, 4)) {
+		t.Errorf("want %v, got %v", pings(2, 4), got)
+	}
+}
+
+func testSeriesReader(t *testing.T, open func() store.StoreEngine) {
+	e := open()
+	sr, ok := e.(store.SeriesReader)
+	if !ok {
+		t.Skip("engine is not a SeriesReader")
+	}
+	e.Init()
+	if got, err := sr.ReadPingRets(ctx, "google.com", "Tokyo"); err != nil || len(got) != 0 {
+		t.Errorf("want no ping results of a series never written, got %v, %v", got, err)
+	}
+	if err := e.BatchWritePingRets(ctx, "google.com", "Tokyo", pings(0, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.BatchWritePingRets(ctx, "google.com", "Tokyo", pings(3, 5)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := sr.ReadPingRets(ctx, "google.com", "Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, pings(0, 5)) {
+		t.Errorf("want %v, got %v", pings(0, 5), got)
+	}
+}
+
+func testDNSHistorian(t *testing.T, open func() store.StoreEngine) {
+	e := open()
+	if _, ok := e.(store.DNSHistorian); !ok {
+		t.Skip("engine is not a DNSHistorian")
+	}
+	e.Init()
+	h := []store.Resolution{{Time: "2015-01-01T00:00:00Z", IPs: []string{"1.1.1.1"}}}
+	if err := e.(store.DNSHistorian).WriteDNSHistory(ctx, "google.com", h); err != nil {
+		t.Fatal(err)
+	}
+	h = append(h, store.Resolution{Time: "2015-01-02T00:00:00Z", IPs: []string{"2.2.2.2"}})
+	if err := e.(store.DNSHistorian).WriteDNSHistory(ctx, "google.com", h); err != nil {
+		t.Fatal(err)
+	}
+
+	e = restart(t, e, open)
+	e.Init()
+	got, err := e.(store.DNSHistorian).ReadDNSHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got["google.com"], h) {
+		t.Errorf("want %v, got %v", h, got["google.com"])
+	}
+}
@@ -0,0 +1,77 @@
+package storetest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+func engine(t *testing.T, engineName string, conf store.EngineConfig) func() store.StoreEngine {
+	return func() store.StoreEngine {
+		e, err := store.NewEngine(engineName, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+}
+
+func Test_FileEngine(t *testing.T) {
+	Suite{Open: func(t *testing.T) func() store.StoreEngine {
+		dir := t.TempDir()
+		return engine(t, store.ENGINE_FILE, store.EngineConfig{"serversDir": dir + "/servers", "usersDir": dir + "/users"})
+	}}.Run(t)
+}
+
+func Test_MemoryEngine(t *testing.T) {
+	Suite{Open: func(t *testing.T) func() store.StoreEngine {
+		return engine(t, store.ENGINE_MEMORY, store.EngineConfig{"file": t.TempDir() + "/state.json"})
+	}, SkipCrashRecovery: true}.Run(t)
+}
+
+func Test_RaftEngine(t *testing.T) {
+	Suite{Open: func(t *testing.T) func() store.StoreEngine {
+		dir := t.TempDir()
+		open := engine(t, store.ENGINE_RAFT, store.EngineConfig{"id": "a", "peers": map[string]interface{}{"a": "127.0.0.1:8795"}, "dir": dir})
+		var last io.Closer
+		return func() store.StoreEngine {
+			// the node holds the lock of the dir until closed, as a node crashed would release it,
+			// the writes are committed once they return so that closing it flushes nothing
+			if last != nil {
+				last.Close()
+			}
+			e := open()
+			last = e.(io.Closer)
+			t.Cleanup(func() { e.(io.Closer).Close() })
+			return e
+		}
+	}}.Run(t)
+}
+
+func Test_Fake(t *testing.T) {
+	var s store.Interface
+	s, f := NewFake(t)
+	if err := s.AddUser(context.Background(), "alice", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	f.FailWrites(errors.New("engine is down"))
+	if err := s.AddMonitorServer(context.Background(), "alice", "google.com"); err == nil {
+		t.Error("scripted failure should fail the write")
+	}
+	if s.GetUser("alice").MonitorServers["google.com"] {
+		t.Error("failed write should not change the store")
+	}
+	f.FailWrites(nil)
+	if err := s.AddMonitorServer(context.Background(), "alice", "google.com"); err != nil {
+		t.Fatal(err)
+	}
+	if server := <-s.AddedServers(); server != "google.com" {
+		t.Errorf("got %v", server)
+	}
+	if n := f.Writes(); n != 2 {
+		t.Errorf("want 2 writes, got %v", n)
+	}
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// the ping results of a server are shared by the users monitoring it, since they are pinged once
+// with ISOLATION_ORGANIZATION a user sees them only since its organization started monitoring the server,
+// so that an organization adding a server does not see the history pinged for another one
+const (
+	ISOLATION_NONE         = "none"
+	ISOLATION_ORGANIZATION = "organization"
+)
+
+func ValidIsolation(mode string) error {
+	switch mode {
+	case ISOLATION_NONE, ISOLATION_ORGANIZATION:
+		return nil
+	}
+	return fmt.Errorf("unknown isolation %v, want %v or %v", mode, ISOLATION_NONE, ISOLATION_ORGANIZATION)
+}
+
+// SetIsolation sets how the ping results are isolated between the organizations, ISOLATION_NONE by default
+func (s *Store) SetIsolation(mode string) *Store {
+	s.isolated = mode == ISOLATION_ORGANIZATION
+	s.cache.clear()
+	return s
+}
+
+// SetOrganization moves the user to the organization, the user is an organization of its own if it is empty
+func (s *Store) SetOrganization(ctx context.Context, username, organization string) (err error) {
+	s.do(func() {
+		s.withWriteLock(func() {
+			if err = s.updateUser(ctx, username, func(u *User) error {
+				u.Organization = organization
+				return nil
+			}); err != nil {
+				return
+			}
+			s.indexOrganizations()
+			// the histories the members see start earlier or later
+			s.cache.clear()
+		})
+	})
+	return
+}
+
+// should be invoked with write lock held or before the store is used
+func (s *Store) indexOrganizations() {
+	s.organizations = make(map[string][]string)
+	for username, u := range s.users {
+		if u.Organization != "" {
+			s.organizations[u.Organization] = append(s.organizations[u.Organization], username)
+		}
+	}
+}
+
+// stamp the servers added to the monitoring list of the user since before with the time, returns the servers added or removed
+// every server is stamped, so that the isolation turned on later covers the servers added before
+func stampMonitorSince(u *User, before map[string]bool, now time.Time) (changed []string) {
+	for server := range u.MonitorServers {
+		if before[server] {
+			continue
+		}
+		if u.MonitorSince == nil {
+			u.MonitorSince = make(map[string]string)
+		}
+		u.MonitorSince[server] = now.Format(_PING_TIME_LAYOUT)
+		changed = append(changed, server)
+	}
+	for server := range before {
+		if !u.MonitorServers[server] {
+			delete(u.MonitorSince, server)
+			changed = append(changed, server)
+		}
+	}
+	return
+}
+
+// the time the ping results of the server are visible to the user since, formatted like PingRet.Time, empty if all of them are
+// the earliest the members of its organization started monitoring the server, the servers monitored before the stamps are wholly visible
+// should be invoked with read lock held
+func (s *Store) visibleSince(username, server string) string {
+	u, ok := s.users[username]
+	if !s.isolated || !ok {
+		return ""
+	}
+	if u.Organization == "" {
+		return u.MonitorSince[server]
+	}
+	since := ""
+	for _, member := range s.organizations[u.Organization] {
+		m, ok := s.users[member]
+		if !ok || !m.MonitorServers[server] {
+			continue
+		}
+		t, ok := m.MonitorSince[server]
+		if !ok {
+			return ""
+		}
+		if since == "" || t < since {
+			since = t
+		}
+	}
+	return since
+}
+
+// the ping results of the server visible to the user, see visibleSince
+// should be invoked with read lock held
+func (s *Store) visible(username, server string) map[string]Series {
+	locations := s.servers[server]
+	since := s.visibleSince(username, server)
+	if since == "" {
+		return locations
+	}
+	ret := make(map[string]Series, len(locations))
+	for location, series := range locations {
+		ret[location] = series.from(sort.Search(series.Len(), func(i int) bool { return series.TimeAt(i) >= since }))
+	}
+	return ret
+}
@@ -0,0 +1,446 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrorObjectNotExist is returned by ObjectStore.Get of a key never put
+var ErrorObjectNotExist = errors.New("object is not exist")
+
+const _COLD_AGGREGATES_PREFIX = "aggregates/"
+
+// Tiers configures the tiered storage of the ping results
+// the store keeps the hot ping results in memory, the engine the warm ones, and the cold tier their aggregates
+// e.g. 6 hours in memory, 4 weeks in the engine and a year of hourly and daily aggregates in object storage
+type Tiers struct {
+	// the ping results kept in memory, tiering is disabled if 0 and the store keeps everything in memory
+	Hot time.Duration
+	// the ping results kept by the engine, everything if 0
+	// older ones are dropped from the engine by Tier, after their aggregates are archived to Cold
+	Warm time.Duration
+	// the archive of the aggregates older than Warm, the engine keeps them if nil
+	Cold ObjectStore
+}
+
+// engines able to read a series back implement SeriesReader, required by tiering as the store only keeps the hot ping results
+type SeriesReader interface {
+	// ReadPingRets returns the ping results of the server at the location, empty if none
+	ReadPingRets(ctx context.Context, server, location string) ([]PingRet, error)
+}
+
+// ObjectStore is the cold tier, keys are slash separated like "aggregates/example.com/beijing.day"
+type ObjectStore interface {
+	// Get returns ErrorObjectNotExist if the key is never put
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put replaces the object of the key
+	Put(ctx context.Context, key string, b []byte) error
+	// List returns the sorted keys of the prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes the object of the key, if any
+	Delete(ctx context.Context, key string) error
+}
+
+// TierReport is the result of a Tier
+type TierReport struct {
+	// ping results dropped from memory, the engine still keeps them
+	Evicted int `json:"evicted"`
+	// ping results dropped from the engine, their aggregates are kept
+	Expired int `json:"expired"`
+	// aggregates moved to the cold tier
+	Archived int `json:"archived"`
+}
+
+// SetTiers enables the tiered storage, it should be set before the store engine so that the load keeps only the hot tier
+func (s *Store) SetTiers(t Tiers) *Store {
+	s.tiers = t
+	return s
+}
+
+// the engine if tiering is enabled and the engine is able to read back and rewrite the series
+func (s *Store) tiered() (SeriesReader, bool) {
+	if s.tiers.Hot <= 0 {
+		return nil, false
+	}
+	sr, ok := s.storeEngine.(SeriesReader)
+	if _, w := s.storeEngine.(SeriesWriter); !w {
+		return nil, false
+	}
+	return sr, ok
+}
+
+func (s *Store) hotCutoff(now time.Time) string {
+	return now.Add(-s.tiers.Hot).Format(_PING_TIME_LAYOUT)
+}
+
+// the day the warm tier starts, it is cut at the start of the day so that no daily aggregate is split between the tiers
+func (s *Store) warmCutoff(now time.Time) string {
+	return now.Add(-s.tiers.Warm).Format(_PING_TIME_LAYOUT)[:resolutions[RESOLUTION_DAY]]
+}
+
+// returns true if the ping results of the time are dropped from the engine by Tier, their aggregates are archived
+func (s *Store) expired(t string, now time.Time) bool {
+	_, ok := s.tiered()
+	return ok && s.tiers.Warm > 0 && t < s.warmCutoff(now)
+}
+
+// the ping results of the hot tier
+func hotPingRets(prs []PingRet, cutoff string) []PingRet {
+	i := sort.Search(len(prs), func(i int) bool { return prs[i].Time >= cutoff })
+	if i == 0 {
+		return prs
+	}
+	// copied, so that the evicted ones are freed
+	return append([]PingRet(nil), prs[i:]...)
+}
+
+// drop the ping results older than the hot tier from the servers, returns the number dropped
+func trimHot(servers Servers, cutoff string) (n int) {
+	for _, locations := range servers {
+		for location, prs := range locations {
+			hot := hotPingRets(prs, cutoff)
+			n += len(prs) - len(hot)
+			locations[location] = hot
+		}
+	}
+	return
+}
+
+// the whole series of the server at the location, read back from the engine if the store keeps only the hot tier
+// should be invoked with lock held
+func (s *Store) series(ctx context.Context, server, location string) ([]PingRet, error) {
+	sr, ok := s.tiered()
+	if !ok {
+		return s.servers[server][location].All(), nil
+	}
+	prs, err := sr.ReadPingRets(ctx, server, location)
+	if err != nil {
+		return nil, fmt.Errorf("can not read ping results of %v at %v: %v", server, location, err)
+	}
+	// the engine lags while the breaker buffers the writes
+	merged, _ := mergePingRets(s.servers[server][location].All(), prs)
+	return merged, nil
+}
+
+// the series of the memory after it is rewritten
+func (s *Store) hotSeries(prs []PingRet) []PingRet {
+	if _, ok := s.tiered(); ok {
+		return hotPingRets(prs, s.hotCutoff(time.Now()))
+	}
+	return prs
+}
+
+// Tier moves the ping results of the servers owned down the tiers, all the servers if owns is nil
+// the ping results older than Hot are dropped from memory, those older than Warm from the engine
+// after their aggregates are archived to Cold, so that a crash in the middle never loses an aggregate
+// it is invoked on interval by the main server writing the engine
+func (s *Store) Tier(ctx context.Context, now time.Time, owns func(server string) bool) (r TierReport, err error) {
+	sr, ok := s.tiered()
+	if !ok {
+		return r, fmt.Errorf("tiering is disabled or the store engine can not read back and rewrite the series")
+	}
+	if s.tiers.Warm > 0 && s.tiers.Cold == nil {
+		// the aggregates of the expired ping results would be lost on restart otherwise
+		if _, ok := s.storeEngine.(Aggregator); !ok {
+			return r, fmt.Errorf("store engine does not persist the aggregates, the cold tier is required to expire ping results")
+		}
+	}
+	if s.isReadOnly() {
+		return r, ErrorReadOnly
+	}
+	type series struct{ server, location string }
+	var all []series
+	s.withReadLock(func() {
+		for server, locations := range s.servers {
+			if owns != nil && !owns(server) {
+				continue
+			}
+			for location := range locations {
+				all = append(all, series{server, location})
+			}
+		}
+	})
+	hot := s.hotCutoff(now)
+	// locked by series, so that the ping results are appended in between
+	for _, sl := range all {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		s.do(func() {
+			s.withWriteLock(func() {
+				series, ok := s.servers[sl.server][sl.location]
+				if !ok {
+					return
+				}
+				// the series is encoded again only if a ping result is evicted
+				if i := sort.Search(series.Len(), func(i int) bool { return series.TimeAt(i) >= hot }); i > 0 {
+					// the evictions and the archives are not fed to the replicas, which keep their own tiers
+					s.cache.invalidate(serverDep(sl.server))
+					r.Evicted += i
+					s.servers[sl.server][sl.location] = seriesOf(series.PingRets(i, series.Len()))
+				}
+				if s.tiers.Warm <= 0 {
+					return
+				}
+				var n int
+				if n, err = s.archive(ctx, sl.server, sl.location, now); err != nil {
+					return
+				}
+				if n > 0 {
+					s.cache.invalidate(serverDep(sl.server))
+				}
+				r.Archived += n
+				n, err = s.expire(ctx, sr, sl.server, sl.location, now)
+				r.Expired += n
+			})
+		})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// move the closed aggregates older than the warm tier to the cold tier, returns the number moved
+// should be invoked with write lock held
+func (s *Store) archive(ctx context.Context, server, location string, now time.Time) (n int, err error) {
+	if s.tiers.Cold == nil {
+		return 0, nil
+	}
+	warm := s.warmCutoff(now)
+	for resolution := range resolutions {
+		as := s.aggregates.get(server, location, resolution)
+		// the last one is open
+		i := sort.Search(len(as), func(i int) bool { return as[i].Start >= warm })
+		if i == len(as) {
+			i--
+		}
+		if i <= 0 {
+			continue
+		}
+		key := coldAggregatesKey(server, location, resolution)
+		old, err := s.readColdAggregates(ctx, key)
+		if err != nil {
+			return n, err
+		}
+		b, err := json.Marshal(mergeAggregates(old, as[:i]))
+		if err != nil {
+			return n, err
+		}
+		if err = s.tiers.Cold.Put(ctx, key, b); err != nil {
+			return n, fmt.Errorf("can not archive aggregates of %v at %v: %v", server, location, err)
+		}
+		rest := append([]Aggregate(nil), as[i:]...)
+		s.aggregates.set(server, location, resolution, rest)
+		s.writeAggregates(ctx, server, location, resolution, rest[:len(rest)-1])
+		n += i
+	}
+	return
+}
+
+// drop the ping results older than the warm tier from the engine, returns the number dropped
+// should be invoked with write lock held
+func (s *Store) expire(ctx context.Context, sr SeriesReader, server, location string, now time.Time) (int, error) {
+	prs, err := sr.ReadPingRets(ctx, server, location)
+	if err != nil {
+		return 0, fmt.Errorf("can not read ping results of %v at %v: %v", server, location, err)
+	}
+	warm := s.warmCutoff(now)
+	i := sort.Search(len(prs), func(i int) bool { return prs[i].Time >= warm })
+	if i == 0 {
+		return 0, nil
+	}
+	kept := prs[i:]
+	err = s.engineWrite(ctx, "StoreEngine.WritePingRets", func(ctx context.Context) error {
+		return s.storeEngine.(SeriesWriter).WritePingRets(ctx, server, location, kept)
+	}, "server", server, "location", location, "count", len(kept))
+	if err != nil {
+		return 0, err
+	}
+	return i, nil
+}
+
+func coldAggregatesKey(server, location, resolution string) string {
+	return fmt.Sprintf("%v%v/%v.%v", _COLD_AGGREGATES_PREFIX, serverFileName(server), location, resolution)
+}
+
+func (s *Store) readColdAggregates(ctx context.Context, key string) ([]Aggregate, error) {
+	b, err := s.tiers.Cold.Get(ctx, key)
+	if err == ErrorObjectNotExist {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var as []Aggregate
+	if err = json.Unmarshal(b, &as); err != nil {
+		return nil, fmt.Errorf("can not read archived aggregates %v: %v", key, err)
+	}
+	return as, nil
+}
+
+// the archived aggregates of each location of the server of the resolution
+func (s *Store) coldAggregates(ctx context.Context, server, resolution string) (map[string][]Aggregate, error) {
+	prefix := fmt.Sprintf("%v%v/", _COLD_AGGREGATES_PREFIX, serverFileName(server))
+	keys, err := s.tiers.Cold.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]Aggregate)
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if !strings.HasSuffix(name, "."+resolution) || strings.Contains(name, "/") {
+			continue
+		}
+		as, err := s.readColdAggregates(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		ret[strings.TrimSuffix(name, "."+resolution)] = as
+	}
+	return ret, nil
+}
+
+// merge the aggregates sorted by Start, those of newer of the same Start win
+func mergeAggregates(older, newer []Aggregate) []Aggregate {
+	merged := make([]Aggregate, 0, len(older)+len(newer))
+	i, j := 0, 0
+	for i < len(older) || j < len(newer) {
+		switch {
+		case j == len(newer) || (i < len(older) && older[i].Start < newer[j].Start):
+			merged = append(merged, older[i])
+			i++
+		case i == len(older) || newer[j].Start < older[i].Start:
+			merged = append(merged, newer[j])
+			j++
+		default:
+			merged = append(merged, newer[j])
+			i, j = i+1, j+1
+		}
+	}
+	return merged
+}
+
+// GetPingRets returns the ping results of each location between from and to, which are times like PingRet.Time, empty is unbounded
+// unlike GetMonitorResult, which returns the hot tier in memory, the older ping results are read back from the engine
+func (s *Store) GetPingRets(username, server, from, to string) (ret map[string][]PingRet, err error) {
+	inRange := func(prs []PingRet) []PingRet {
+		i := sort.Search(len(prs), func(i int) bool { return prs[i].Time >= from })
+		j := len(prs)
+		if to != "" {
+			j = sort.Search(len(prs), func(i int) bool { return prs[i].Time > to })
+		}
+		if i >= j {
+			return []PingRet{}
+		}
+		return append([]PingRet(nil), prs[i:j]...)
+	}
+	s.withReadLock(func() {
+		var locations map[string]Series
+		if locations, err = s.getMonitorResult(username, server); err != nil {
+			return
+		}
+		from = max(from, s.visibleSince(username, server))
+		sr, tiered := s.tiered()
+		ret = make(map[string][]PingRet, len(locations))
+		for location, series := range locations {
+			prs := series.All()
+			if tiered && (len(prs) == 0 || from < prs[0].Time) {
+				var warm []PingRet
+				if warm, err = sr.ReadPingRets(context.Background(), server, location); err != nil {
+					err = fmt.Errorf("can not read ping results of %v at %v: %v", server, location, err)
+					return
+				}
+				prs, _ = mergePingRets(prs, warm)
+			}
+			ret[location] = inRange(prs)
+		}
+	})
+	return
+}
+
+// the directory ObjectStore, e.g. a bucket mounted by s3fs or gcsfuse, or a local disk for small deployments
+type dirObjectStore struct {
+	dir string
+}
+
+// NewDirObjectStore returns the ObjectStore of the objects as files under the directory
+func NewDirObjectStore(dir string) ObjectStore {
+	return &dirObjectStore{dir: dir}
+}
+
+func (d *dirObjectStore) path(key string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(key))
+}
+
+func (d *dirObjectStore) Get(ctx context.Context, key string) ([]byte, error) {
+	b, err := ioutil.ReadFile(d.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrorObjectNotExist
+	}
+	return b, err
+}
+
+// written and renamed, so that an object is never partial
+func (d *dirObjectStore) Put(ctx context.Context, key string, b []byte) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+_TMP_SUFFIX, b, os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(path+_TMP_SUFFIX, path)
+}
+
+func (d *dirObjectStore) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	err := filepath.Walk(d.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, _TMP_SUFFIX) {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (f *fileEngine) ReadPingRets(ctx context.Context, server, location string) ([]PingRet, error) {
+	bs, err := ioutil.ReadFile(f.getServerFilePath(server, location))
+	if os.IsNotExist(err) {
+		return []PingRet{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	prs := make([]PingRet, 0)
+	for _, v := range strings.Split(string(bs), _NEW_LINE) {
+		if len(v) == 0 {
+			continue
+		}
+		// the corrupt records are reported by Init
+		if pr, err := f.unmarshalPingRet([]byte(v)); err == nil {
+			prs = append(prs, pr)
+		}
+	}
+	return prs, nil
+}
@@ -0,0 +1,61 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/gogames/watchdog/probe"
+)
+
+// the transactions are named after the user like the virtual servers, users can not see each other's steps
+func TransactionServer(username, name string) string {
+	return probe.STEPS_PREFIX + username + ":" + name
+}
+
+func IsTransaction(server string) bool { return strings.HasPrefix(server, probe.STEPS_PREFIX) }
+
+// SetTransaction adds the transaction of the name of the http steps to the monitoring list of the user, or replaces its steps
+// the probes run the steps in order and record the latency of each, see probe.Step, returns the server of the transaction
+func (s *Store) SetTransaction(ctx context.Context, username, name string, steps []probe.Step) (server string, err error) {
+	if name == "" || strings.ContainsAny(name, ":/") {
+		err = fmt.Errorf("invalid name %q of transaction", name)
+		return
+	}
+	if err = probe.ValidateSteps(steps); err != nil {
+		return
+	}
+	server = TransactionServer(username, name)
+	s.do(func() {
+		s.withWriteLock(func() {
+			added := false
+			if err = s.updateUser(ctx, username, func(u *User) error {
+				if u.Transactions == nil {
+					u.Transactions = make(map[string][]probe.Step)
+				}
+				u.Transactions[server] = steps
+				if added = !u.MonitorServers[server]; added {
+					u.MonitorServers[server] = true
+				}
+				return nil
+			}); err == nil && added {
+				s.monitorAdded([]string{server})
+			}
+		})
+	})
+	return
+}
+
+// Transaction returns the steps of the transaction, empty if the server is not a transaction
+func (s *Store) Transaction(server string) (steps []probe.Step) {
+	if !IsTransaction(server) {
+		return
+	}
+	username := server[len(probe.STEPS_PREFIX):strings.LastIndex(server, ":")]
+	s.withReadLock(func() {
+		if u, ok := s.users[username]; ok {
+			steps = u.Transactions[server]
+		}
+	})
+	return
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// updateUser applies f to a copy of the user and writes the copy to the engine
+// the user is replaced by the copy only if f and the write succeed, so that the memory never diverges from the engine
+// should be invoked with write lock held
+func (s *Store) updateUser(ctx context.Context, username string, f func(u *User) error) error {
+	u, ok := s.users[username]
+	if !ok {
+		return fmt.Errorf("User %v not exist", username)
+	}
+	return s.commitUser(ctx, username, u.copy(), f)
+}
+
+// commitUser applies f to the user c, which is not in the store yet, and stores it once written to the engine
+// should be invoked with write lock held
+func (s *Store) commitUser(ctx context.Context, username string, c *User, f func(u *User) error) error {
+	before := make(map[string]bool, len(c.MonitorServers))
+	for server := range c.MonitorServers {
+		before[server] = true
+	}
+	if f != nil {
+		if err := f(c); err != nil {
+			return err
+		}
+	}
+	changed := stampMonitorSince(c, before, time.Now())
+	if err := s.writeUser(ctx, username, c); err != nil {
+		return err
+	}
+	s.users[username] = c
+	if s.isolated && c.Organization != "" {
+		// the histories the other members see may start earlier or later
+		for _, server := range changed {
+			s.cache.invalidate(serverDep(server))
+		}
+	}
+	return nil
+}
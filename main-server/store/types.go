@@ -3,6 +3,13 @@ package store
 import (
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/probe"
 )
 
 type Users map[string]*User
@@ -10,9 +17,56 @@ type Users map[string]*User
 type User struct {
 	Password       string          `json:"password"`
 	MonitorServers map[string]bool `json:"monitor_servers"`
+	// identity provider -> subject, users signed up by identity providers have no password
+	ExternalIds map[string]string `json:"external_ids,omitempty"`
+	// server -> labels of the server
+	Labels         map[string]map[string]string `json:"labels,omitempty"`
+	AlertTemplates []alert.Template             `json:"alert_templates,omitempty"`
+	// the alerts are dispatched to the channels by the schedule
+	Channels []alert.Channel `json:"channels,omitempty"`
+	Schedule alert.Schedule  `json:"schedule"`
+	// server -> the server it depends on, alerts of a server are grouped into the incident of its parent
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+	// the alerts of the servers sharing labels are correlated by it, not correlated if nil
+	Correlation *alert.Correlation `json:"correlation,omitempty"`
+	// virtual server -> token to push its samples
+	IngestTokens map[string]string    `json:"ingest_tokens,omitempty"`
+	Heartbeats   map[string]Heartbeat `json:"heartbeats,omitempty"`
+	// added to the hosts of the servers they select, see SetCheckTemplate
+	CheckTemplates []CheckTemplate `json:"check_templates,omitempty"`
+	// server -> interval of its check, every ping frequence if absent
+	Intervals map[string]time.Duration `json:"intervals,omitempty"`
+	// server -> annotations of its timeline sorted by time
+	Annotations map[string][]Annotation `json:"annotations,omitempty"`
+	// transaction server -> its http steps, see SetTransaction
+	Transactions map[string][]probe.Step `json:"transactions,omitempty"`
+	// the objectives of the servers, see SetSLO
+	SLOs     []SLO    `json:"slos,omitempty"`
+	Settings Settings `json:"settings"`
+	// the organization the user belongs to, it is an organization of its own if empty, see ISOLATION_ORGANIZATION
+	Organization string `json:"organization,omitempty"`
+	// server -> the time it was added to the monitoring list formatted like PingRet.Time, absent of the servers added before the stamps
+	MonitorSince map[string]string `json:"monitor_since,omitempty"`
+	// host -> the claim of the user to own it, see ClaimHost
+	Claims map[string]Claim `json:"claims,omitempty"`
+	// the inbox of the user written before the inboxes were stored apart, moved out once loaded, see InboxStore
+	Inbox []Message `json:"inbox,omitempty"`
+	// phone -> its verification, the sms channels send to the verified ones only, see VerifyPhone
+	Phones map[string]Phone `json:"phones,omitempty"`
+	// when the codes of the last hour were sent to the phones, see RequestPhoneVerification
+	PhoneCodes []time.Time `json:"phone_codes,omitempty"`
 }
 
-func newUser() *User { return &User{MonitorServers: make(map[string]bool)} }
+func newUser() *User {
+	return &User{
+		MonitorServers: make(map[string]bool),
+		ExternalIds:    make(map[string]string),
+		Labels:         make(map[string]map[string]string),
+		Dependencies:   make(map[string]string),
+		IngestTokens:   make(map[string]string),
+		Heartbeats:     make(map[string]Heartbeat),
+	}
+}
 
 func (u User) marshal() []byte {
 	b, _ := json.Marshal(u)
@@ -27,12 +81,112 @@ type Servers map[string]map[string][]PingRet
 
 type PingRet struct {
 	Ping string `json:"ping"`
+	// time of the main server aligned to the ping frequence, the charts are aligned by it
 	Time string `json:"time"`
+	// RFC3339 times of the ping node when the ping finished and the main server when the result is received
+	ProbeTime    string `json:"probe_time,omitempty"`
+	ReceivedTime string `json:"received_time,omitempty"`
+	// the comma separated latencies of the steps of a transaction formatted like Ping, whose Ping is their sum, see SetTransaction
+	Steps string `json:"steps,omitempty"`
+	// the percent of the pings lost of an icmp check, empty of the other checks and the ping nodes too old to tell
+	Loss string `json:"loss,omitempty"`
+	// the path mtu in bytes of an mtu check, 0 of the other checks or if down
+	MTU int `json:"mtu,omitempty"`
+}
+
+// LossPercent returns the percent of the pings lost, false if the ping result tells none
+func (pr PingRet) LossPercent() (float64, bool) {
+	if pr.Loss == "" {
+		return 0, false
+	}
+	loss, err := strconv.ParseFloat(pr.Loss, 64)
+	return loss, err == nil
+}
+
+// the ping result as written by the engines, tagged with the schema version
+// C is the checksum of the record without it, records written before checksums have none
+type pingRetRecord struct {
+	V int `json:"v"`
+	PingRet
+	C uint32 `json:"c,omitempty"`
+}
+
+func (pr PingRet) marshal() []byte { return pr.appendRecord(nil) }
+
+// appendRecord appends the line of the record of the ping result to dst, the same bytes as encoding/json
+// encoded once without reflecting, the checksum is of the record before C is appended
+func (pr PingRet) appendRecord(dst []byte) []byte {
+	start := len(dst)
+	dst = strconv.AppendInt(append(dst, `{"v":`...), SCHEMA_VERSION, 10)
+	// the fields of the embedded ping result follow V
+	mark := len(dst)
+	dst = pr.AppendJSON(dst)
+	dst[mark] = ','
+	if c := crc32.ChecksumIEEE(dst[start:]); c != 0 {
+		dst = strconv.AppendUint(append(dst[:len(dst)-1], `,"c":`...), uint64(c), 10)
+		dst = append(dst, '}')
+	}
+	return append(dst, '\n')
+}
+
+func (r pingRetRecord) checksum() uint32 {
+	r.C = 0
+	b, _ := json.Marshal(r)
+	return crc32.ChecksumIEEE(b)
+}
+
+// decode a record of any version and upgrade it to SCHEMA_VERSION
+func unmarshalPingRet(b []byte) (pr PingRet, err error) {
+	var r pingRetRecord
+	if err = json.Unmarshal(b, &r); err != nil {
+		return
+	}
+	if r.C != 0 && r.C != r.checksum() {
+		err = ErrorChecksum
+		return
+	}
+	if r.V > SCHEMA_VERSION {
+		err = fmt.Errorf("ping result of schema version %v is newer than %v", r.V, SCHEMA_VERSION)
+		return
+	}
+	for ; r.V < SCHEMA_VERSION; r.V++ {
+		pingRetMigrations[r.V](&r)
+	}
+	return r.PingRet, nil
+}
+
+// the time of the ping results, aligned to the minute
+const _PING_TIME_LAYOUT = "06-01-02 15:04"
+
+// _MAX_PING is the max latency in milliseconds of a ping result, like probe.MAX_LATENCY
+const _MAX_PING = 60 * 1000
+
+// PingRetError is the malformed ping result at Index of a batch
+type PingRetError struct {
+	Index  int
+	Reason string
+}
+
+func (e *PingRetError) Error() string {
+	return fmt.Sprintf("invalid ping result %v: %v", e.Index, e.Reason)
 }
 
-func (pr PingRet) marshal() []byte {
-	b, _ := json.Marshal(pr)
-	return append(b, byte('\n'))
+// Validate returns the *PingRetError of the ping result at index i of a batch
+func (pr PingRet) Validate(i int) error {
+	if _, err := time.Parse(_PING_TIME_LAYOUT, pr.Time); err != nil {
+		return &PingRetError{Index: i, Reason: fmt.Sprintf("time %q is not formatted as %v", pr.Time, _PING_TIME_LAYOUT)}
+	}
+	ping, err := strconv.ParseFloat(pr.Ping, 64)
+	if err != nil || math.IsNaN(ping) || ping < 0 || ping > _MAX_PING {
+		return &PingRetError{Index: i, Reason: fmt.Sprintf("ping %q is not a latency in [0, %v]", pr.Ping, _MAX_PING)}
+	}
+	if loss, ok := pr.LossPercent(); pr.Loss != "" && (!ok || !(loss >= 0 && loss <= 100)) {
+		return &PingRetError{Index: i, Reason: fmt.Sprintf("loss %q is not a percent", pr.Loss)}
+	}
+	if pr.MTU < 0 || pr.MTU > probe.MAX_MTU {
+		return &PingRetError{Index: i, Reason: fmt.Sprintf("mtu %v is out of [0, %v]", pr.MTU, probe.MAX_MTU)}
+	}
+	return nil
 }
 
 func (pr PingRet) String() string {
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	USAGE_REQUESTS = "requests"
+	USAGE_SAMPLES  = "samples"
+	USAGE_BYTES    = "bytes"
+
+	_USAGE_DAYS       = 31
+	_USAGE_DAY_LAYOUT = "2006-01-02"
+)
+
+// Usage is the api and ingestion volume of a user of a day
+type Usage struct {
+	Day      string `json:"day"`
+	Requests int64  `json:"requests"`
+	Samples  int64  `json:"samples"`
+	Bytes    int64  `json:"bytes"`
+}
+
+func (u Usage) get(metric string) int64 {
+	switch metric {
+	case USAGE_SAMPLES:
+		return u.Samples
+	case USAGE_BYTES:
+		return u.Bytes
+	}
+	return u.Requests
+}
+
+type UserUsage struct {
+	Username string `json:"username"`
+	Usage
+}
+
+// username -> usage of the recent days sorted by day, kept in memory only
+type usage struct {
+	m   map[string][]Usage
+	rwl sync.RWMutex
+}
+
+// CountUsage adds the requests, the samples ingested and their bytes to the usage of the user today
+func (s *Store) CountUsage(username string, requests, samples, bytes int64) {
+	day := time.Now().Format(_USAGE_DAY_LAYOUT)
+	s.usage.rwl.Lock()
+	defer s.usage.rwl.Unlock()
+	if s.usage.m == nil {
+		s.usage.m = make(map[string][]Usage)
+	}
+	us := s.usage.m[username]
+	if len(us) == 0 || us[len(us)-1].Day != day {
+		if us = append(us, Usage{Day: day}); len(us) > _USAGE_DAYS {
+			us = us[len(us)-_USAGE_DAYS:]
+		}
+	}
+	last := &us[len(us)-1]
+	last.Requests += requests
+	last.Samples += samples
+	last.Bytes += bytes
+	s.usage.m[username] = us
+}
+
+// GetUsage returns the usage of the user of the recent days, the earliest first
+func (s *Store) GetUsage(username string, days int) (ret []Usage, err error) {
+	if s.GetUser(username) == nil {
+		return nil, fmt.Errorf("User %v not exist", username)
+	}
+	s.usage.rwl.RLock()
+	defer s.usage.rwl.RUnlock()
+	return append([]Usage{}, recentUsage(s.usage.m[username], days)...), nil
+}
+
+// TopUsage returns at most n users of the highest metric, requests, samples or bytes, summed over the recent days
+// Day of the usage returned is the earliest day counted
+func (s *Store) TopUsage(metric string, days, n int) (ret []UserUsage, err error) {
+	if metric != USAGE_REQUESTS && metric != USAGE_SAMPLES && metric != USAGE_BYTES {
+		return nil, fmt.Errorf("unknown metric %v", metric)
+	}
+	s.usage.rwl.RLock()
+	for username, us := range s.usage.m {
+		uu := UserUsage{Username: username}
+		for i, u := range recentUsage(us, days) {
+			if i == 0 {
+				uu.Day = u.Day
+			}
+			uu.Requests, uu.Samples, uu.Bytes = uu.Requests+u.Requests, uu.Samples+u.Samples, uu.Bytes+u.Bytes
+		}
+		if uu.Day != "" {
+			ret = append(ret, uu)
+		}
+	}
+	s.usage.rwl.RUnlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if vi, vj := ret[i].get(metric), ret[j].get(metric); vi != vj {
+			return vi > vj
+		}
+		return ret[i].Username < ret[j].Username
+	})
+	if n > 0 && len(ret) > n {
+		ret = ret[:n]
+	}
+	return
+}
+
+// the usage of the days back from today
+func recentUsage(us []Usage, days int) []Usage {
+	since := time.Now().AddDate(0, 0, 1-days).Format(_USAGE_DAY_LAYOUT)
+	i := sort.Search(len(us), func(i int) bool { return us[i].Day >= since })
+	return us[i:]
+}
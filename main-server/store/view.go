@@ -0,0 +1,102 @@
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// View is an immutable view of the users and the ping results of the store at Time
+// the users are copy on write and the series are only appended or replaced, so the view shares them with the store
+// rather than copying them, exports, reports and backups iterate it without holding the lock of the store
+type View struct {
+	Time    time.Time
+	epoch   int64
+	seq     uint64
+	users   Users
+	servers columnar
+}
+
+// View takes the view under the read lock, in time proportional to the number of users and series
+func (s *Store) View() (v *View) {
+	s.withReadLock(func() {
+		v = &View{Time: time.Now(), epoch: s.feed.epoch, seq: s.feed.seq, users: make(Users, len(s.users)), servers: make(columnar, len(s.servers))}
+		for username, u := range s.users {
+			v.users[username] = u
+		}
+		for server, locations := range s.servers {
+			v.servers[server] = make(map[string]Series, len(locations))
+			for location, series := range locations {
+				v.servers[server][location] = series
+			}
+		}
+	})
+	return
+}
+
+// Usernames returns the users of the view sorted
+func (v *View) Usernames() []string {
+	usernames := make([]string, 0, len(v.users))
+	for username := range v.users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// User returns a copy of the user, which is safe to modify
+func (v *View) User(username string) (*User, bool) {
+	u, ok := v.users[username]
+	if !ok {
+		return nil, false
+	}
+	return u.copy(), true
+}
+
+// Servers returns the servers with ping results of the view sorted
+func (v *View) Servers() []string {
+	servers := make([]string, 0, len(v.servers))
+	for server := range v.servers {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// PingRets returns location -> ping results of the server decoded
+func (v *View) PingRets(server string) map[string][]PingRet {
+	ret := make(map[string][]PingRet, len(v.servers[server]))
+	for location, series := range v.servers[server] {
+		ret[location] = series.All()
+	}
+	return ret
+}
+
+// Range calls f for every series of the view sorted by server and location until f returns false
+func (v *View) Range(f func(server, location string, prs []PingRet) bool) {
+	v.each(func(server, location string, series Series) bool { return f(server, location, series.All()) })
+}
+
+// RangeJSON is Range with the ping results encoded like encoding/json straight from the series,
+// into a buffer reused, so that prs is valid until f returns
+func (v *View) RangeJSON(f func(server, location string, prs []byte) bool) {
+	var b []byte
+	v.each(func(server, location string, series Series) bool {
+		b = series.AppendJSON(b[:0])
+		return f(server, location, b)
+	})
+}
+
+func (v *View) each(f func(server, location string, series Series) bool) {
+	for _, server := range v.Servers() {
+		locations := make([]string, 0, len(v.servers[server]))
+		for location := range v.servers[server] {
+			locations = append(locations, location)
+		}
+		sort.Strings(locations)
+		for _, location := range locations {
+			if !f(server, location, v.servers[server][location]) {
+				return
+			}
+		}
+	}
+}
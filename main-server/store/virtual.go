@@ -0,0 +1,130 @@
+package store
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// virtual servers are not pinged, external systems push their samples by the ingest token
+const VIRTUAL_PREFIX = "virtual:"
+
+func IsVirtual(server string) bool { return strings.HasPrefix(server, VIRTUAL_PREFIX) }
+
+// the virtual servers are named after the user, users can not push to each other's servers
+// the name is a file name of the file engine, so it is separated by colon rather than slash
+func VirtualServer(username, name string) string { return VIRTUAL_PREFIX + username + ":" + name }
+
+// VirtualServerOwner returns the user the virtual server is named after
+func VirtualServerOwner(server string) string {
+	if !IsVirtual(server) {
+		return ""
+	}
+	return server[len(VIRTUAL_PREFIX):strings.LastIndex(server, ":")]
+}
+
+// Heartbeat is a virtual server expecting a sample every Interval, it is down if none arrives for Interval plus Grace
+type Heartbeat struct {
+	Interval time.Duration `json:"interval"`
+	Grace    time.Duration `json:"grace"`
+	Created  time.Time     `json:"created"`
+}
+
+// AddVirtualServer adds the virtual server of the name to the monitoring list of the user
+// returns the server and the token to push samples of it
+func (s *Store) AddVirtualServer(ctx context.Context, username, name string) (server, token string, err error) {
+	return s.addVirtualServer(ctx, username, name, nil)
+}
+
+// AddHeartbeat adds the virtual server of the name pushed periodically by a job, like a backup script
+func (s *Store) AddHeartbeat(ctx context.Context, username, name string, interval, grace time.Duration) (server, token string, err error) {
+	if interval <= 0 || grace < 0 {
+		err = fmt.Errorf("interval should be positive and grace should not be negative")
+		return
+	}
+	return s.addVirtualServer(ctx, username, name, func(u *User, server string) {
+		if u.Heartbeats == nil {
+			u.Heartbeats = make(map[string]Heartbeat)
+		}
+		u.Heartbeats[server] = Heartbeat{Interval: interval, Grace: grace, Created: time.Now()}
+	})
+}
+
+// Heartbeats returns virtual server -> heartbeat of all users
+func (s *Store) Heartbeats() (ret map[string]Heartbeat) {
+	ret = make(map[string]Heartbeat)
+	s.withReadLock(func() {
+		for _, u := range s.users {
+			for server, hb := range u.Heartbeats {
+				ret[server] = hb
+			}
+		}
+	})
+	return
+}
+
+// LatestPingRets returns the last ping result of the location and the last one not down
+func (s *Store) LatestPingRets(server, location string) (last, lastUp PingRet) {
+	s.withReadLock(func() {
+		series := s.servers[server][location]
+		var ok bool
+		if last, ok = series.Last(); !ok {
+			return
+		}
+		for i := series.Len() - 1; i >= 0; i-- {
+			if pr := series.At(i); pr.Ping != _DEFAULT_PING {
+				lastUp = pr
+				return
+			}
+		}
+	})
+	return
+}
+
+func (s *Store) addVirtualServer(ctx context.Context, username, name string, f func(u *User, server string)) (server, token string, err error) {
+	if name == "" || strings.ContainsAny(name, ":/") {
+		err = fmt.Errorf("invalid name %q of virtual server", name)
+		return
+	}
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	server, token = VirtualServer(username, name), hex.EncodeToString(b)
+	s.do(func() {
+		s.withWriteLock(func() {
+			if err = s.updateUser(ctx, username, func(u *User) error {
+				if u.MonitorServers[server] {
+					return fmt.Errorf("%v is already in monitoring list", server)
+				}
+				u.MonitorServers[server] = true
+				u.IngestTokens[server] = token
+				if f != nil {
+					f(u, server)
+				}
+				return nil
+			}); err == nil {
+				s.allServers[server]++
+			}
+		})
+	})
+	return
+}
+
+// CheckIngestToken returns true if the token is the ingest token of the virtual server
+func (s *Store) CheckIngestToken(server, token string) (ok bool) {
+	if !IsVirtual(server) || token == "" {
+		return false
+	}
+	username := VirtualServerOwner(server)
+	s.withReadLock(func() {
+		if u, exist := s.users[username]; exist {
+			ok = subtle.ConstantTimeCompare([]byte(u.IngestTokens[server]), []byte(token)) == 1
+		}
+	})
+	return
+}
@@ -0,0 +1,77 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	METRIC_LATENCY  = "latency"
+	METRIC_DOWNTIME = "downtime"
+)
+
+// ServerScore is the metric of a server over the recent window of all locations
+// Value is the average ping of latency, or the ratio of results without response of downtime
+type ServerScore struct {
+	Server string  `json:"server"`
+	Value  float64 `json:"value"`
+	Count  int64   `json:"count"`
+}
+
+// GetWorstServers returns at most n servers monitored by the user with the highest metric in the recent window, the worst first
+// the scores come from the hourly aggregates visible to the user, see visibleSince,
+// the window is rounded up to hours back from the latest aggregate of each location
+func (s *Store) GetWorstServers(username, metric string, window time.Duration, n int) (ret []ServerScore, err error) {
+	if metric != METRIC_LATENCY && metric != METRIC_DOWNTIME {
+		return nil, fmt.Errorf("unknown metric %v", metric)
+	}
+	hours := int((window + time.Hour - 1) / time.Hour)
+	if hours <= 0 {
+		hours = 1
+	}
+	s.withReadLock(func() {
+		u, ok := s.users[username]
+		if !ok {
+			err = fmt.Errorf("User %v not exist", username)
+			return
+		}
+		ret = make([]ServerScore, 0, len(u.MonitorServers))
+		for server := range u.MonitorServers {
+			var sum float64
+			var count, down int64
+			since := s.visibleSince(username, server)
+			for _, resolutions := range s.aggregates[server] {
+				as := resolutions[RESOLUTION_HOUR]
+				if len(as) > hours {
+					as = as[len(as)-hours:]
+				}
+				for _, a := range as {
+					if since == "" || startsSince(a.Start, since) {
+						sum, count, down = sum+a.Sum, count+a.Count, down+a.Down
+					}
+				}
+			}
+			if count == 0 {
+				continue
+			}
+			sc := ServerScore{Server: server, Count: count}
+			if metric == METRIC_DOWNTIME {
+				sc.Value = float64(down) / float64(count)
+			} else if count > down {
+				sc.Value = sum / float64(count-down)
+			}
+			ret = append(ret, sc)
+		}
+	})
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Value != ret[j].Value {
+			return ret[i].Value > ret[j].Value
+		}
+		return ret[i].Server < ret[j].Server
+	})
+	if n > 0 && len(ret) > n {
+		ret = ret[:n]
+	}
+	return
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+const (
+	_SUPPORT_PATH = "/support"
+	// the actor of the admin token
+	_ADMIN_ACTOR = "admin"
+)
+
+type (
+	supportServerStub struct{}
+	actorKey          struct{}
+)
+
+var (
+	supportServer = hprose.NewHttpService()
+	// token -> name of the support engineer
+	supportTokens map[string]string
+)
+
+// support server stub, served on /support of the admin server
+// the support engineers view the users read only by their support tokens, to debug reports like an empty chart
+// every view is written to the audit log with the reason, like the ticket, before anything is returned
+
+// the user without the password and the ingest tokens
+func (supportServerStub) ViewUser(username, reason string, ctx hprose.Context) (u store.User, err error) {
+	if err = auditView(ctx, username, "user", reason); err != nil {
+		return
+	}
+	up := storeEngine.GetUser(username)
+	if up == nil {
+		err = fmt.Errorf("User %v does not exist", username)
+		return
+	}
+	u = *up
+	u.Password = ""
+	u.IngestTokens = nil
+	// the webhooks and the addresses of the channels may hold credentials
+	u.Channels = nil
+	u.Phones = nil
+	return u, nil
+}
+
+// the ping results of the server the user monitors, like the chart of the user
+func (supportServerStub) ViewMonitorResult(username, server, reason string, ctx hprose.Context) (map[string][]store.PingRet, error) {
+	if err := auditView(ctx, username, "result "+server, reason); err != nil {
+		return nil, err
+	}
+	return storeEngine.GetMonitorResult(username, server)
+}
+
+// the hourly or daily aggregates of the server the user monitors, see store.GetAggregates
+func (supportServerStub) ViewAggregates(username, server, resolution, from, to, reason string, ctx hprose.Context) (map[string][]store.Aggregate, error) {
+	if err := auditView(ctx, username, "aggregates "+server, reason); err != nil {
+		return nil, err
+	}
+	return storeEngine.GetAggregates(username, server, resolution, from, to)
+}
+
+// the settings of the user, like the time zone the chart is drawn in
+func (supportServerStub) ViewSettings(username, reason string, ctx hprose.Context) (store.Settings, error) {
+	if err := auditView(ctx, username, "settings", reason); err != nil {
+		return store.Settings{}, err
+	}
+	return storeEngine.GetSettings(username)
+}
+
+// write the view of the user by the actor of the request to the audit log, the view is denied if it can not be audited
+func auditView(ctx hprose.Context, username, what, reason string) error {
+	if strings.TrimSpace(reason) == "" {
+		return fmt.Errorf("reason is required to view the user")
+	}
+	c := requestContext(ctx)
+	actor, _ := c.Value(actorKey{}).(string)
+	if actor == "" {
+		return fmt.Errorf("unknown actor")
+	}
+	logger.With("actor", actor, "username", username, "view", what).Info("user viewed by support")
+	return storeEngine.RecordAudit(c, store.AuditEntry{Actor: actor, Action: store.AUDIT_IMPERSONATE, Subject: username, Detail: what + ": " + reason})
+}
+
+// name=token of the support engineers
+func parseSupportTokens(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	if s == "" {
+		return m, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		nt := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(nt) != 2 || nt[0] == "" || nt[1] == "" {
+			return nil, fmt.Errorf("support token %q should be name=token", kv)
+		}
+		if nt[0] == _ADMIN_ACTOR {
+			return nil, fmt.Errorf("support engineer can not be named %v", _ADMIN_ACTOR)
+		}
+		if _, ok := m[nt[1]]; ok {
+			return nil, fmt.Errorf("support token of %v is duplicated", nt[0])
+		}
+		m[nt[1]] = nt[0]
+	}
+	return m, nil
+}
+
+// requests with a support token or the admin token can reach h, the actor is in the context of the request
+func supportAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := adminToken(r)
+		var actor string
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*flagAdminToken)) == 1 {
+			actor = _ADMIN_ACTOR
+		}
+		for t, name := range supportTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				actor = name
+			}
+		}
+		if actor == "" {
+			http.Error(w, "invalid support token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), actorKey{}, actor)))
+	})
+}
+
+func initSupport() {
+	var err error
+	if supportTokens, err = parseSupportTokens(*flagSupportTokens); err != nil {
+		panic(err)
+	}
+	supportServer.AddMethods(new(supportServerStub))
+	adminMux.Handle(_SUPPORT_PATH, supportAuth(instrument("support", supportServer)))
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/gogames/watchdog/main-server/target"
+)
+
+var targetPolicy *target.Policy
+
+func initTarget() {
+	var err error
+	if targetPolicy, err = target.NewPolicy(*flagBlocklist, *flagAllowlist); err != nil {
+		panic(fmt.Errorf("can not parse target policy: %v", err))
+	}
+	initOwnership()
+}
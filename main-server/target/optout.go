@@ -0,0 +1,109 @@
+package target
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// the hosts and the networks opted out of monitoring, on the complaints of the networks probed
+// unlike the blocklist a host matches itself only, not its subdomains, and they change at runtime
+type optOuts struct {
+	hosts map[string]bool
+	nets  []*net.IPNet
+}
+
+// NormalizeOptOut returns the canonical form of the host, the address or the CIDR opting out
+func NormalizeOptOut(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return "", err
+		}
+		return n.String(), nil
+	}
+	if ip := net.ParseIP(entry); ip != nil {
+		return ip.String(), nil
+	}
+	if entry == "" || !hostnameRegexp.MatchString(entry) {
+		return "", fmt.Errorf("%v is neither a host nor a cidr", entry)
+	}
+	return strings.ToLower(strings.TrimSuffix(entry, ".")), nil
+}
+
+func parseOptOuts(entries []string) (o optOuts, err error) {
+	o.hosts = make(map[string]bool)
+	for _, entry := range entries {
+		if entry, err = NormalizeOptOut(entry); err != nil {
+			return
+		}
+		if !strings.Contains(entry, "/") && net.ParseIP(entry) == nil {
+			o.hosts[entry] = true
+			continue
+		}
+		var nets []*net.IPNet
+		if nets, _, err = parseList(entry); err != nil {
+			return
+		}
+		o.nets = append(o.nets, nets...)
+	}
+	return
+}
+
+// SetOptOuts replaces the hosts and the networks opted out of monitoring, Validate rejects them afterwards
+func (p *Policy) SetOptOuts(entries []string) error {
+	o, err := parseOptOuts(entries)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.optOuts = o
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Policy) optedOut() optOuts {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.optOuts
+}
+
+// Matching returns the servers the entry opts out, the hostnames are resolved if the entry is a network
+// the servers which can not be resolved do not match
+func (p *Policy) Matching(entry string, servers []string) ([]string, error) {
+	o, err := parseOptOuts([]string{entry})
+	if err != nil {
+		return nil, err
+	}
+	var matched []string
+	for _, server := range servers {
+		host, err := Host(server)
+		if err != nil {
+			continue
+		}
+		if o.hosts[strings.ToLower(strings.TrimSuffix(host, "."))] {
+			matched = append(matched, server)
+		} else if len(o.nets) > 0 && p.matchOptedOutNets(o, host) != nil {
+			matched = append(matched, server)
+		}
+	}
+	return matched, nil
+}
+
+// the address of the host in the networks opted out, nil if none is or it can not be resolved
+func (p *Policy) matchOptedOutNets(o optOuts, host string) net.IP {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		if ips, err = p.Lookup(host); err != nil {
+			return nil
+		}
+	}
+	for _, ip := range ips {
+		if matchNet(o.nets, ip) {
+			return ip
+		}
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package target
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// the owner of a host proves it by either the TXT record "watchdog-verification=<token>" of the host
+// or the token served at http://<host>/.well-known/watchdog-verification.txt
+const (
+	TXT_PREFIX      = "watchdog-verification="
+	WELL_KNOWN_PATH = "/.well-known/watchdog-verification.txt"
+
+	METHOD_DNS  = "dns"
+	METHOD_HTTP = "http"
+)
+
+// the file served is short, a page served instead of it is not read wholly
+const _MAX_TOKEN_FILE = 1 << 10
+
+// Verifier verifies the claims of ownership of the hosts
+type Verifier struct {
+	// net.LookupTXT by default
+	LookupTXT func(host string) ([]string, error)
+	// the well known file is fetched by it
+	Client *http.Client
+}
+
+// the well known file is fetched from the host claimed only, never from where it redirects to like an internal address
+func NewVerifier(timeout time.Duration) *Verifier {
+	return &Verifier{LookupTXT: net.LookupTXT, Client: &http.Client{
+		Timeout:       timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}}
+}
+
+// the host fetched may be anything the user claims, what it responds is not echoed back to the user
+var errNoTokenFile = fmt.Errorf("%v does not hold the token", WELL_KNOWN_PATH)
+
+// Verify returns the method proving the host is owned by the holder of the token, or why neither does
+func (v *Verifier) Verify(host, token string) (method string, err error) {
+	records, dnsErr := v.LookupTXT(host)
+	for _, r := range records {
+		if strings.TrimSpace(r) == TXT_PREFIX+token {
+			return METHOD_DNS, nil
+		}
+	}
+	httpErr := v.verifyHTTP(host, token)
+	if httpErr == nil {
+		return METHOD_HTTP, nil
+	}
+	if dnsErr == nil {
+		dnsErr = fmt.Errorf("no TXT record %v%v", TXT_PREFIX, token)
+	}
+	return "", fmt.Errorf("can not verify %v: %v, %v", host, dnsErr, httpErr)
+}
+
+func (v *Verifier) verifyHTTP(host, token string) error {
+	resp, err := v.Client.Get("http://" + host + WELL_KNOWN_PATH)
+	if err != nil {
+		return errNoTokenFile
+	}
+	defer resp.Body.Close()
+	// the redirects are not followed
+	if resp.StatusCode != http.StatusOK {
+		return errNoTokenFile
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, _MAX_TOKEN_FILE))
+	if err != nil || strings.TrimSpace(string(b)) != token {
+		return errNoTokenFile
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Package target validates the servers users add to monitor, so that a public instance can not be used
+// to ping internal or abusive targets.
+package target
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var hostnameRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.?$`)
+
+// Policy rejects the hosts not resolvable, loopback, multicast, unspecified or link local, and those blocked or opted out
+// if any is allowed, the hosts not allowed are rejected too
+// a domain matches itself and its subdomains
+type Policy struct {
+	blockedNets    []*net.IPNet
+	blockedDomains []string
+	allowedNets    []*net.IPNet
+	allowedDomains []string
+
+	// resolves the hostnames, net.LookupIP by default
+	Lookup func(host string) ([]net.IP, error)
+
+	mu      sync.RWMutex
+	optOuts optOuts
+}
+
+// NewPolicy parses the comma separated CIDRs and domains of the blocklist and the allowlist
+func NewPolicy(blocklist, allowlist string) (*Policy, error) {
+	p := &Policy{Lookup: net.LookupIP}
+	var err error
+	if p.blockedNets, p.blockedDomains, err = parseList(blocklist); err != nil {
+		return nil, fmt.Errorf("invalid blocklist: %v", err)
+	}
+	if p.allowedNets, p.allowedDomains, err = parseList(allowlist); err != nil {
+		return nil, fmt.Errorf("invalid allowlist: %v", err)
+	}
+	return p, nil
+}
+
+func parseList(list string) (nets []*net.IPNet, domains []string, err error) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if strings.Contains(item, "/") {
+			var n *net.IPNet
+			if _, n, err = net.ParseCIDR(item); err != nil {
+				return
+			}
+			nets = append(nets, n)
+		} else if ip := net.ParseIP(item); ip != nil {
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			domains = append(domains, strings.ToLower(strings.Trim(item, ".")))
+		}
+	}
+	return
+}
+
+// Host returns the host of the server, which is a host, "tcp://host:port" or a url
+func Host(server string) (string, error) {
+	if !strings.Contains(server, "://") {
+		return server, nil
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("no host in %v", server)
+	}
+	return u.Hostname(), nil
+}
+
+// Validate returns the reason the server should not be monitored
+func (p *Policy) Validate(server string) error {
+	host, err := Host(server)
+	if err != nil {
+		return err
+	}
+	opted := p.optedOut()
+	if opted.hosts[strings.ToLower(strings.TrimSuffix(host, "."))] {
+		return fmt.Errorf("%v opted out of monitoring", host)
+	}
+	ips := make([]net.IP, 0)
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		if !hostnameRegexp.MatchString(host) {
+			return fmt.Errorf("%v is not a valid hostname", host)
+		}
+		domain := strings.ToLower(strings.TrimSuffix(host, "."))
+		if matchDomain(p.blockedDomains, domain) {
+			return fmt.Errorf("%v is blocked", host)
+		}
+		if (len(p.allowedNets) > 0 || len(p.allowedDomains) > 0) && matchDomain(p.allowedDomains, domain) {
+			// the allowed domains are trusted, but not within the networks opted out
+			if len(opted.nets) > 0 {
+				if ip := p.matchOptedOutNets(opted, host); ip != nil {
+					return fmt.Errorf("%v: %v opted out of monitoring", host, ip)
+				}
+			}
+			return nil
+		}
+		if ips, err = p.Lookup(host); err != nil {
+			return fmt.Errorf("can not resolve %v: %v", host, err)
+		}
+		if len(ips) == 0 {
+			return fmt.Errorf("%v resolves to no address", host)
+		}
+	}
+	// every address should be safe, the hostname may resolve to any of them
+	for _, ip := range ips {
+		if err = p.validateIP(ip, opted); err != nil {
+			return fmt.Errorf("%v: %v", host, err)
+		}
+	}
+	return nil
+}
+
+func (p *Policy) validateIP(ip net.IP, opted optOuts) error {
+	switch {
+	case ip.IsLoopback():
+		return fmt.Errorf("%v is loopback", ip)
+	case ip.IsMulticast():
+		return fmt.Errorf("%v is multicast", ip)
+	case ip.IsUnspecified():
+		return fmt.Errorf("%v is unspecified", ip)
+	case ip.IsLinkLocalUnicast():
+		return fmt.Errorf("%v is link local", ip)
+	case matchNet(p.blockedNets, ip):
+		return fmt.Errorf("%v is blocked", ip)
+	case matchNet(opted.nets, ip):
+		return fmt.Errorf("%v opted out of monitoring", ip)
+	case (len(p.allowedNets) > 0 || len(p.allowedDomains) > 0) && !matchNet(p.allowedNets, ip):
+		return fmt.Errorf("%v is not allowed", ip)
+	}
+	return nil
+}
+
+func matchNet(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchDomain(domains []string, domain string) bool {
+	for _, d := range domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
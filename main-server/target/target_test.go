@@ -0,0 +1,159 @@
+package target
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPolicy(t *testing.T, blocklist, allowlist string) *Policy {
+	p, err := NewPolicy(blocklist, allowlist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Lookup = func(host string) ([]net.IP, error) {
+		switch host {
+		case "google.com", "tcp.google.com":
+			return []net.IP{net.ParseIP("142.250.0.1")}, nil
+		case "intranet.example.com":
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		case "localhost":
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+	return p
+}
+
+func Test_Validate(t *testing.T) {
+	p := testPolicy(t, "10.0.0.0/8, abuse.com", "")
+	for server, ok := range map[string]bool{
+		"google.com":                 true,
+		"tcp://tcp.google.com:80":    true,
+		"https://google.com/healthz": true,
+		"8.8.8.8":                    true,
+		"localhost":                  false,
+		"127.0.0.1":                  false,
+		"224.0.0.1":                  false,
+		"0.0.0.0":                    false,
+		"169.254.0.1":                false,
+		"intranet.example.com":       false,
+		"www.abuse.com":              false,
+		"no.such.host":               false,
+		"bad_host!":                  false,
+		"tcp://":                     false,
+	} {
+		if err := p.Validate(server); (err == nil) != ok {
+			t.Errorf("validate %v should be ok %v, got %v", server, ok, err)
+		}
+	}
+}
+
+func Test_Allowlist(t *testing.T) {
+	p := testPolicy(t, "", "142.250.0.0/16, example.com")
+	for server, ok := range map[string]bool{
+		"google.com":           true,
+		"intranet.example.com": true,
+		"8.8.8.8":              false,
+	} {
+		if err := p.Validate(server); (err == nil) != ok {
+			t.Errorf("validate %v should be ok %v, got %v", server, ok, err)
+		}
+	}
+	if _, err := NewPolicy("10.0.0.0/33", ""); err == nil {
+		t.Error("should reject invalid cidr")
+	}
+}
+
+func Test_Verify(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == WELL_KNOWN_PATH {
+			fmt.Fprintln(w, "web-token")
+		}
+	}))
+	defer ts.Close()
+	v := NewVerifier(time.Second)
+	v.LookupTXT = func(host string) ([]string, error) {
+		if host == "dns.example.com" {
+			return []string{"v=spf1 -all", TXT_PREFIX + "dns-token"}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+	if method, err := v.Verify("dns.example.com", "dns-token"); err != nil || method != METHOD_DNS {
+		t.Errorf("got %v, %v", method, err)
+	}
+	web := strings.TrimPrefix(ts.URL, "http://")
+	if method, err := v.Verify(web, "web-token"); err != nil || method != METHOD_HTTP {
+		t.Errorf("got %v, %v", method, err)
+	}
+	for host, token := range map[string]string{"dns.example.com": "web-token", web: "dns-token"} {
+		if _, err := v.Verify(host, token); err == nil {
+			t.Errorf("%v should not be verified by %v", host, token)
+		}
+	}
+
+	// the redirects are not followed, and what the host responds is not echoed
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "internal-token")
+	}))
+	defer internal.Close()
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, internal.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer redirect.Close()
+	_, err := v.Verify(strings.TrimPrefix(redirect.URL, "http://"), "internal-token")
+	if err == nil {
+		t.Fatal("the redirect should not be followed")
+	}
+	if strings.Contains(err.Error(), "302") || strings.Contains(err.Error(), "Found") {
+		t.Errorf("the status should not be echoed, got %v", err)
+	}
+}
+
+func Test_OptOut(t *testing.T) {
+	p := testPolicy(t, "", "")
+	for entry, want := range map[string]string{"Google.com.": "google.com", "142.250.0.0/16": "142.250.0.0/16", "8.8.8.8": "8.8.8.8", "bad_host!": ""} {
+		if got, _ := NormalizeOptOut(entry); got != want {
+			t.Errorf("%v: want %v, got %v", entry, want, got)
+		}
+	}
+	servers := []string{"google.com", "tcp://tcp.google.com:80", "8.8.8.8", "https://8.8.4.4/healthz", "no.such.host"}
+	for entry, want := range map[string]string{
+		"google.com":     "[google.com]",
+		"142.250.0.0/16": "[google.com tcp://tcp.google.com:80]",
+		"8.8.0.0/16":     "[8.8.8.8 https://8.8.4.4/healthz]",
+	} {
+		if matched, err := p.Matching(entry, servers); err != nil || fmt.Sprint(matched) != want {
+			t.Errorf("%v: want %v, got %v, %v", entry, want, matched, err)
+		}
+	}
+
+	if err := p.SetOptOuts([]string{"google.com", "8.8.0.0/16"}); err != nil {
+		t.Fatal(err)
+	}
+	for server, ok := range map[string]bool{
+		"google.com":              false,
+		"https://GOOGLE.com/":     false,
+		"tcp://tcp.google.com:80": true,
+		"8.8.8.8":                 false,
+		"1.1.1.1":                 true,
+	} {
+		if err := p.Validate(server); (err == nil) != ok {
+			t.Errorf("validate %v should be ok %v, got %v", server, ok, err)
+		}
+	}
+	if err := p.SetOptOuts([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("should reject invalid cidr")
+	}
+
+	// the allowed domains are opted out by the networks as well
+	p = testPolicy(t, "", "google.com")
+	p.SetOptOuts([]string{"142.250.0.0/16"})
+	if err := p.Validate("tcp.google.com"); err == nil || !strings.Contains(err.Error(), "opted out") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "github.com/gogames/watchdog/main-server/trace"
+
+var (
+	tracer   = trace.Noop
+	exporter *trace.Exporter
+)
+
+func initTrace() {
+	if *flagOTLPEndpoint == "" {
+		return
+	}
+	exporter = trace.NewExporter(*flagOTLPEndpoint, "watchdog-main-server", *flagTraceRatio)
+	tracer = exporter
+}
+
+func closeTrace() {
+	if exporter != nil {
+		exporter.Close()
+	}
+}
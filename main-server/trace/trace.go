@@ -0,0 +1,246 @@
+// spans exported in OTLP/HTTP json
+package trace
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	_BATCH_SIZE     = 1 << 9
+	_FLUSH_INTERVAL = 5 * time.Second
+	_EXPORT_TIMEOUT = 10 * time.Second
+
+	_STATUS_OK    = 1
+	_STATUS_ERROR = 2
+)
+
+// Span is a timed operation, attrs are key value pairs
+type Span interface {
+	Child(name string, attrs ...interface{}) Span
+	End(err error)
+}
+
+type Tracer interface {
+	Start(name string, attrs ...interface{}) Span
+}
+
+// Noop traces nothing
+var Noop Tracer = noop{}
+
+type noop struct{}
+
+func (noop) Start(string, ...interface{}) Span { return noop{} }
+func (noop) Child(string, ...interface{}) Span { return noop{} }
+func (noop) End(error)                         {}
+
+// Exporter is a tracer sending the ended spans to an OTLP/HTTP endpoint in batches
+type Exporter struct {
+	endpoint string
+	service  string
+	ratio    float64
+	client   *http.Client
+
+	mu        sync.Mutex
+	spans     []*span
+	flushChan chan struct{}
+	closeChan chan struct{}
+	wg        sync.WaitGroup
+}
+
+// NewExporter traces ratio of the root spans, endpoint is like http://localhost:4318/v1/traces
+func NewExporter(endpoint, service string, ratio float64) *Exporter {
+	e := &Exporter{
+		endpoint:  endpoint,
+		service:   service,
+		ratio:     ratio,
+		client:    &http.Client{Timeout: _EXPORT_TIMEOUT},
+		spans:     make([]*span, 0, _BATCH_SIZE),
+		flushChan: make(chan struct{}, 1),
+		closeChan: make(chan struct{}),
+	}
+	e.wg.Add(1)
+	go e.loop()
+	return e
+}
+
+func (e *Exporter) Start(name string, attrs ...interface{}) Span {
+	if e.ratio < 1 && mrand.Float64() >= e.ratio {
+		return noop{}
+	}
+	return e.newSpan(randHex(16), "", name, attrs)
+}
+
+// Close exports the remaining spans
+func (e *Exporter) Close() {
+	close(e.closeChan)
+	e.wg.Wait()
+}
+
+func (e *Exporter) newSpan(traceId, parentId, name string, attrs []interface{}) *span {
+	return &span{
+		e:        e,
+		TraceId:  traceId,
+		SpanId:   randHex(8),
+		ParentId: parentId,
+		Name:     name,
+		start:    time.Now(),
+		attrs:    attrs,
+	}
+}
+
+func (e *Exporter) end(s *span) {
+	e.mu.Lock()
+	e.spans = append(e.spans, s)
+	full := len(e.spans) >= _BATCH_SIZE
+	e.mu.Unlock()
+	if full {
+		select {
+		case e.flushChan <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *Exporter) loop() {
+	defer e.wg.Done()
+	t := time.NewTicker(_FLUSH_INTERVAL)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-e.flushChan:
+		case <-e.closeChan:
+			e.flush()
+			return
+		}
+		e.flush()
+	}
+}
+
+func (e *Exporter) flush() {
+	e.mu.Lock()
+	spans := e.spans
+	e.spans = make([]*span, 0, _BATCH_SIZE)
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	// tracing should never break the server, drop the batch on error
+	e.export(spans)
+}
+
+func (e *Exporter) export(spans []*span) error {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, s.otlp())
+	}
+	body := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttr{attr("service.name", e.service)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "watchdog"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%v responds %v", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+type span struct {
+	e *Exporter
+
+	TraceId, SpanId, ParentId string
+	Name                      string
+
+	start, end time.Time
+	attrs      []interface{}
+	err        error
+}
+
+func (s *span) Child(name string, attrs ...interface{}) Span {
+	return s.e.newSpan(s.TraceId, s.SpanId, name, attrs)
+}
+
+func (s *span) End(err error) {
+	s.end = time.Now()
+	s.err = err
+	s.e.end(s)
+}
+
+type otlpAttr struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+func attr(key string, val interface{}) otlpAttr {
+	return otlpAttr{Key: key, Value: map[string]string{"stringValue": fmt.Sprint(val)}}
+}
+
+type otlpSpan struct {
+	TraceId           string     `json:"traceId"`
+	SpanId            string     `json:"spanId"`
+	ParentSpanId      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (s *span) otlp() otlpSpan {
+	o := otlpSpan{
+		TraceId:           s.TraceId,
+		SpanId:            s.SpanId,
+		ParentSpanId:      s.ParentId,
+		Name:              s.Name,
+		Kind:              1,
+		StartTimeUnixNano: fmt.Sprint(s.start.UnixNano()),
+		EndTimeUnixNano:   fmt.Sprint(s.end.UnixNano()),
+		Status:            otlpStatus{Code: _STATUS_OK},
+	}
+	for i := 0; i+1 < len(s.attrs); i += 2 {
+		o.Attributes = append(o.Attributes, attr(fmt.Sprint(s.attrs[i]), s.attrs[i+1]))
+	}
+	if s.err != nil {
+		o.Status = otlpStatus{Code: _STATUS_ERROR, Message: s.err.Error()}
+	}
+	return o
+}
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
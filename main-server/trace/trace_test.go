@@ -0,0 +1,47 @@
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_Exporter(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{})
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		received <- body
+	}))
+	defer ts.Close()
+
+	e := NewExporter(ts.URL, "main-server", 1)
+	root := e.Start("Store.AppendPingRet", "server", "google.com")
+	root.Child("lock.wait").End(nil)
+	root.End(errors.New("can not write"))
+	e.Close()
+
+	body := <-received
+	spans := body["resourceSpans"].([]interface{})[0].(map[string]interface{})["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	if len(spans) != 2 {
+		t.Fatalf("got %v spans, want 2", len(spans))
+	}
+	child, parent := spans[0].(map[string]interface{}), spans[1].(map[string]interface{})
+	if child["parentSpanId"] != parent["spanId"] || child["traceId"] != parent["traceId"] {
+		t.Errorf("lock.wait should be the child of Store.AppendPingRet: %v, %v", child, parent)
+	}
+	if parent["status"].(map[string]interface{})["code"].(float64) != _STATUS_ERROR {
+		t.Errorf("status should be error: %v", parent["status"])
+	}
+}
+
+func Test_Noop(t *testing.T) {
+	e := NewExporter("http://127.0.0.1:0", "main-server", 0)
+	e.Start("nothing").Child("nothing").End(nil)
+	e.Close()
+	Noop.Start("nothing").End(nil)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/gogames/watchdog/main-server/store"
+)
+
+// count an api request of the signed in user
+func countRequest(username string) { storeEngine.CountUsage(username, 1, 0, 0) }
+
+// count a sample pushed to the virtual server, by the bytes of the url and the body
+func countIngestion(server string, r *http.Request) {
+	bytes := int64(len(r.URL.RequestURI()))
+	if r.ContentLength > 0 {
+		bytes += r.ContentLength
+	}
+	storeEngine.CountUsage(store.VirtualServerOwner(server), 1, 1, bytes)
+}
+
+// GetUsage returns the api requests, the samples ingested and their bytes of the user of the recent days
+// update session life
+func (mainServerStub) GetUsage(sid, username string, days int) (ret []store.Usage, signedIn bool, err error) {
+	defer localizeError(username, &err)
+	if v := sess.Get(sid, _SESS_KEY_USERNAME); v != nil {
+		un, ok := v.(string)
+		if !ok {
+			logger.Debug("the username is not type string, but %v", reflect.TypeOf(v).Name())
+			err = fmt.Errorf("Unexpected runtime error")
+		} else if un == username {
+			countRequest(username)
+			if ret, err = storeEngine.GetUsage(username, days); err != nil {
+				return
+			}
+			err = sess.Update(sid)
+			signedIn = true
+		}
+	}
+	return
+}
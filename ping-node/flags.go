@@ -11,6 +11,13 @@ var (
 	flagMainServerAddress = flag.String("addr", "127.0.0.1:8773", "network address of main server")
 	flagLocation          = flag.String("location", "local", "location of the ping node")
 	flagLogFilePath       = flag.String("log", "/var/log/watchdog/ping-node/logfile.log", "location of the ping node")
+	flagCountry           = flag.String("country", "", "country of the ping node, like JP")
+	flagCity              = flag.String("city", "", "city of the ping node")
+	flagASN               = flag.Int("asn", 0, "autonomous system number of the network of the ping node")
+	flagProvider          = flag.String("provider", "", "hosting provider of the ping node")
+	flagLatitude          = flag.Float64("lat", 0, "latitude of the ping node")
+	flagLongitude         = flag.Float64("lon", 0, "longitude of the ping node")
+	flagLabels            = flag.String("labels", "", "comma separated key=value labels of the ping node")
 	flagLogLevel          = flag.Int("level", logs.LevelDebug, "log level according to RFC5424, default debug level")
 )
 
@@ -6,12 +6,16 @@ import (
 	"syscall"
 
 	"github.com/gogames/utils/shutdown"
+	"github.com/gogames/watchdog/main-server/sdnotify"
 )
 
 func initShutdown() {
 	functions := make([]func(), 0)
 
 	functions = append(functions,
+		func() {
+			sdnotify.Notify(sdnotify.STOPPING)
+		},
 		func() {
 			pingClient.l.Lock()
 			defer pingClient.l.Unlock()
@@ -5,6 +5,8 @@ import (
 	"sync"
 	"time"
 
+	"github.com/gogames/watchdog/main-server/compress"
+	"github.com/gogames/watchdog/probe"
 	"github.com/hprose/hprose-go/hprose"
 )
 
@@ -17,6 +19,8 @@ type pingClientStub struct {
 	GetServerPort   func() (int, error)
 	Register        func(location string) error // location of the ping node
 	UnRegister      func() error
+	// not provided by old main servers
+	SetProbeMetadata func(location string, meta probe.Metadata) error
 }
 
 type pingClientStruct struct {
@@ -32,6 +36,7 @@ type pingClientStruct struct {
 var (
 	pingClient   = new(pingClientStruct)
 	hproseClient hprose.Client
+	metadata     probe.Metadata
 )
 
 func enable() {
@@ -46,6 +51,10 @@ func enable() {
 						return false
 					}
 
+					if err := pingClient.SetProbeMetadata(*flagLocation, metadata); err != nil {
+						logger.Debug(fmt.Sprintf("can not set metadata of ping node: %v\n", err))
+					}
+
 					if i, err := pingClient.GetPingInterval(); err != nil {
 						logger.Debug(fmt.Sprintf("can not get ping interval: %v\n", err))
 						return false
@@ -90,7 +99,22 @@ func pingLoop() {
 }
 
 func initPingClient() {
-	hproseClient = hprose.NewHttpClient("http://" + *flagMainServerAddress)
+	labels, err := probe.ParseLabels(*flagLabels)
+	if err != nil {
+		panic(fmt.Sprintf("invalid labels: %v", err))
+	}
+	metadata = probe.Metadata{
+		Country: *flagCountry, City: *flagCity, ASN: *flagASN, Provider: *flagProvider,
+		Latitude: *flagLatitude, Longitude: *flagLongitude, Labels: labels,
+	}
+	if err = metadata.Validate(); err != nil {
+		panic(fmt.Sprintf("invalid metadata: %v", err))
+	}
+
+	c := hprose.NewHttpClient("http://" + *flagMainServerAddress)
+	// the ping results reported are sent by gzip
+	c.Http().Transport = compress.Transport(c.Http().Transport)
+	hproseClient = c
 	hproseClient.UseService(&pingClient.pingClientStub)
 
 	pingClient.interval = time.Second
@@ -8,6 +8,8 @@ import (
 
 	"github.com/gogames/ping"
 	"github.com/gogames/utils/signal"
+	"github.com/gogames/watchdog/main-server/compress"
+	"github.com/gogames/watchdog/probe"
 	"github.com/hprose/hprose-go/hprose"
 )
 
@@ -15,6 +17,15 @@ var (
 	hproseServer = hprose.NewHttpService()
 )
 
+type timedPingResult struct {
+	Avg float64
+	// unix nano
+	Time int64
+	// the percent of the pings lost of Pings sent
+	Loss  float64
+	Pings int
+}
+
 func initPingServer() {
 	hproseServer.CrossDomainEnabled = false
 
@@ -23,6 +34,12 @@ func initPingServer() {
 		return ping.Ping(addr, 3, 10*time.Second)
 	})
 
+	// ping with the time of the ping node, so that main server can tell the clock skew, and the packet loss
+	hproseServer.AddFunction("pingWithTime", func(addr string) timedPingResult {
+		avg, loss, _ := probe.Ping(addr, 10*time.Second)
+		return timedPingResult{Avg: avg, Time: time.Now().UnixNano(), Loss: loss, Pings: probe.ICMP_COUNT}
+	})
+
 	// disable and run in for loop checking if main server is up
 	hproseServer.AddFunction("disable", func() {
 		pingClient.l.Lock()
@@ -49,7 +66,7 @@ func startServer() {
 				panic(fmt.Sprintf("can not get ping server port from main server: %v\n", err))
 			}
 			addr := fmt.Sprintf(":%d", port)
-			if err = http.ListenAndServe(addr, hproseServer); err != nil {
+			if err = http.ListenAndServe(addr, compress.Handler(hproseServer)); err != nil {
 				logger.Emergency("can not listen and serve: %v", err)
 				if err = signal.Signal(syscall.SIGQUIT); err != nil {
 					panic(fmt.Sprintf("can not send signal current process: %v\n", err))
@@ -0,0 +1,205 @@
+package probe
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client is the main server as seen by the agent
+// Register returns the interval to check the targets, the ping frequence of the main server
+type Client interface {
+	Register(location string, meta Metadata) (time.Duration, error)
+	Targets(location string) ([]Target, error)
+	Report(location string, results []Result) error
+}
+
+// Agent checks the targets of the location every interval given by the main server and reports them in a batch
+// with a Spool, the batches failed to report are spooled and replayed once the main server is back
+type Agent struct {
+	Location string
+	Metadata Metadata
+	Timeout  time.Duration
+	Client   Client
+	Spool    *Spool
+	Logf     func(format string, v ...interface{})
+	// at most Workers checks run at once, and at most Rate checks start every second if positive
+	// so that thousands of targets are not checked in a burst, which providers rate limit or flag
+	Workers int
+	Rate    float64
+
+	interval time.Duration
+	// the last targets given by the main server, checked while it is unreachable
+	targets []Target
+	// the spool is not replayed before it, as the main server is busy
+	busyUntil time.Time
+}
+
+const (
+	_REGISTER_RETRY  = 5 * time.Second
+	_DEFAULT_WORKERS = 64
+)
+
+// Run registers the agent and checks the targets every interval until stop is closed
+// the agent registers again if the main server fails, like after restarting
+func (a *Agent) Run(stop <-chan struct{}) {
+	registered := false
+	for {
+		if !registered {
+			if interval, err := a.Client.Register(a.Location, a.Metadata); err != nil {
+				a.Logf("can not register to main server: %v", err)
+			} else {
+				a.interval, registered = interval, true
+			}
+		}
+		// registered once
+		if a.interval > 0 {
+			if err := a.Round(); err != nil {
+				a.Logf("%v", err)
+				// a busy main server is still up
+				if _, busy := RetryAfter(err); !busy {
+					registered = false
+				}
+			}
+		}
+		wait := a.interval
+		if wait == 0 {
+			wait = _REGISTER_RETRY
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Round checks the targets once and reports the results, then replays the spooled batches
+func (a *Agent) Round() error {
+	targets, err := a.Client.Targets(a.Location)
+	if err != nil {
+		if a.Spool == nil || a.targets == nil {
+			return err
+		}
+		// keep the charts of the maintenance of the main server
+		a.spool(a.check(a.targets))
+		return err
+	}
+	a.targets = targets
+	results := a.check(targets)
+	if len(results) == 0 {
+		return nil
+	}
+	if err = a.report(results); err != nil {
+		return err
+	}
+	if a.Spool == nil || time.Now().Before(a.busyUntil) {
+		return nil
+	}
+	// the main server ignores the results it already has and inserts the late ones in order
+	n, err := a.Spool.Replay(func(results []Result) error { return a.Client.Report(a.Location, results) })
+	if n > 0 {
+		a.Logf("replayed %v spooled batches", n)
+	}
+	a.backOff(err)
+	return err
+}
+
+// the main server rejecting a report as busy is reported to again after the time it gives
+func (a *Agent) backOff(err error) {
+	if d, ok := RetryAfter(err); ok {
+		a.busyUntil = time.Now().Add(d)
+	}
+}
+
+func (a *Agent) check(targets []Target) []Result {
+	workers := a.Workers
+	if workers <= 0 {
+		workers = _DEFAULT_WORKERS
+	}
+	if a.Rate > 0 && a.interval > 0 {
+		if d := time.Duration(float64(len(targets)) / a.Rate * float64(time.Second)); d > a.interval {
+			a.Logf("%v targets at rate %v take %v, longer than the interval %v", len(targets), a.Rate, d, a.interval)
+		}
+	}
+	var pace <-chan time.Time
+	if a.Rate > 0 {
+		t := time.NewTicker(time.Duration(float64(time.Second) / a.Rate))
+		defer t.Stop()
+		pace = t.C
+	}
+	results := make([]Result, len(targets))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(targets); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = Check(targets[i], a.Timeout)
+			}
+		}()
+	}
+	for i := range targets {
+		if pace != nil && i > 0 {
+			<-pace
+		}
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// report the results in batches of MAX_BATCH, the batches failed to report are spooled
+func (a *Agent) report(results []Result) error {
+	for i := 0; i < len(results); i += MAX_BATCH {
+		batch := results[i:min(i+MAX_BATCH, len(results))]
+		if err := a.Client.Report(a.Location, batch); err != nil {
+			if a.Spool != nil {
+				a.spool(results[i:])
+			}
+			a.backOff(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// spooled in batches of MAX_BATCH, so that they are replayed like reported
+func (a *Agent) spool(results []Result) {
+	for i := 0; i < len(results); i += MAX_BATCH {
+		batch := results[i:min(i+MAX_BATCH, len(results))]
+		if err := a.Spool.Write(batch); err != nil {
+			a.Logf("can not spool %v results: %v", len(batch), err)
+		}
+	}
+}
+
+// BusyError is the error of the main server rejecting a report as its ingestion queue is full,
+// the agent spools the batch and reports it again after RetryAfter
+type BusyError struct {
+	RetryAfter time.Duration
+}
+
+const _BUSY_PREFIX = "main server is busy, retry after "
+
+func (e BusyError) Error() string { return _BUSY_PREFIX + e.RetryAfter.String() }
+
+// RetryAfter returns RetryAfter of a BusyError, also of its message relayed by the rpc, false if err is not one
+func RetryAfter(err error) (time.Duration, bool) {
+	if err == nil {
+		return 0, false
+	}
+	s := err.Error()
+	i := strings.Index(s, _BUSY_PREFIX)
+	if i < 0 {
+		return 0, false
+	}
+	s = s[i+len(_BUSY_PREFIX):]
+	if j := strings.IndexAny(s, " \n"); j >= 0 {
+		s = s[:j]
+	}
+	d, err := time.ParseDuration(s)
+	return d, err == nil
+}
@@ -0,0 +1,167 @@
+// watchdog-loadgen simulates probe agents reporting the results of servers to a running main server
+// and reports the ingestion throughput and the latency percentiles of the reports, to size the hardware
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gogames/watchdog/probe"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+var (
+	flagMainServerAddress = flag.String("addr", "127.0.0.1:8773", "network address of the ping node server of the main server")
+	flagProbes            = flag.Int("probes", 10, "number of simulated probe agents, each of its own location")
+	flagServers           = flag.Int("servers", 1000, "number of servers every probe reports")
+	flagRate              = flag.Float64("rate", 1000, "results reported every second by all the probes, unlimited if 0")
+	flagBatch             = flag.Int("batch", 100, "results in a report")
+	flagDuration          = flag.Duration("duration", time.Minute, "duration of the load")
+	flagProgress          = flag.Duration("progress", 10*time.Second, "interval to print the progress, disabled if 0")
+)
+
+// invoke functions provided by the ping node server of main server
+type serverStub struct {
+	RegisterAgent func(location string, meta probe.Metadata) (int, error)
+	Report        func(location string, results []probe.Result) error
+}
+
+type stats struct {
+	mu        sync.Mutex
+	results   int
+	errors    int
+	latencies []time.Duration
+}
+
+func (s *stats) observe(results int, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.results += results
+	s.latencies = append(s.latencies, d)
+}
+
+func (s *stats) print(elapsed time.Duration) {
+	s.mu.Lock()
+	latencies := append([]time.Duration(nil), s.latencies...)
+	results, errors := s.results, s.errors
+	s.mu.Unlock()
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Printf("%v\tresults=%v\t%.1f/s\treports=%v\terrors=%v\tp50=%v\tp90=%v\tp99=%v\tmax=%v\n",
+		elapsed.Truncate(time.Second), results, float64(results)/elapsed.Seconds(), len(latencies), errors,
+		percentile(latencies, 0.5), percentile(latencies, 0.9), percentile(latencies, 0.99), percentile(latencies, 1))
+}
+
+// of the sorted latencies
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(latencies))*p+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(latencies) {
+		i = len(latencies) - 1
+	}
+	return latencies[i]
+}
+
+// report the servers in batches, each probe sending its share of the rate
+func run(stub *serverStub, location string, interval time.Duration, s *stats, stop <-chan struct{}) {
+	if _, err := stub.RegisterAgent(location, probe.Metadata{}); err != nil {
+		log.Printf("%v can not register: %v", location, err)
+		return
+	}
+	var next int
+	for {
+		results := make([]probe.Result, 0, *flagBatch)
+		for len(results) < *flagBatch {
+			results = append(results, probe.Result{
+				Server: fmt.Sprintf("loadgen-%d.test", next),
+				Avg:    10 + rand.Float64()*190,
+				Time:   time.Now().UnixNano(),
+			})
+			next = (next + 1) % *flagServers
+		}
+		start := time.Now()
+		err := stub.Report(location, results)
+		s.observe(len(results), time.Since(start), err)
+		if err != nil {
+			log.Printf("%v can not report: %v", location, err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval - time.Since(start)):
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *flagProbes <= 0 || *flagServers <= 0 || *flagBatch <= 0 || *flagRate < 0 {
+		log.Fatal("probes, servers and batch should be positive, rate should not be negative")
+	}
+	if *flagBatch > *flagServers {
+		*flagBatch = *flagServers
+	}
+	// every probe reports a batch every interval
+	var interval time.Duration
+	if *flagRate > 0 {
+		interval = time.Duration(float64(*flagBatch) * float64(*flagProbes) / *flagRate * float64(time.Second))
+	}
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+		case <-time.After(*flagDuration):
+		}
+		close(stop)
+	}()
+
+	log.Printf("%v probes reporting %v servers to %v, %v results every second", *flagProbes, *flagServers, *flagMainServerAddress, *flagRate)
+	s := new(stats)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *flagProbes; i++ {
+		// a client of every probe, so that the reports are concurrent like those of the agents
+		hproseClient := hprose.NewHttpClient("http://" + *flagMainServerAddress)
+		stub := new(serverStub)
+		hproseClient.UseService(stub)
+		wg.Add(1)
+		go func(location string) {
+			defer wg.Done()
+			run(stub, location, interval, s, stop)
+		}(fmt.Sprintf("loadgen-%d", i))
+	}
+	if *flagProgress > 0 {
+		go func() {
+			t := time.NewTicker(*flagProgress)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					s.print(time.Since(start))
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	s.print(time.Since(start))
+}
@@ -0,0 +1,109 @@
+// watchdog-probe is the probe agent, it registers with the main server, checks the targets assigned to its location
+// and reports the results in batches
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/compress"
+	"github.com/gogames/watchdog/probe"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+var (
+	flagMainServerAddress = flag.String("addr", "127.0.0.1:8773", "network address of the ping node server of the main server")
+	flagLocation          = flag.String("location", "local", "location of the probe")
+	flagCountry           = flag.String("country", "", "country of the probe, like JP")
+	flagCity              = flag.String("city", "", "city of the probe")
+	flagASN               = flag.Int("asn", 0, "autonomous system number of the network of the probe")
+	flagProvider          = flag.String("provider", "", "hosting provider of the probe")
+	flagLatitude          = flag.Float64("lat", 0, "latitude of the probe")
+	flagLongitude         = flag.Float64("lon", 0, "longitude of the probe")
+	flagLabels            = flag.String("labels", "", "comma separated key=value labels of the probe")
+	flagTimeout           = flag.Duration("timeout", 10*time.Second, "timeout of every check")
+	flagICMPMode          = flag.String("icmp", "auto", "how to ping hosts, raw, dgram, udp or auto to detect the mode permitted")
+	flagWorkers           = flag.Int("workers", 64, "max checks running at once")
+	flagRate              = flag.Float64("rate", 100, "max checks started every second, unlimited if 0")
+	flagSpool             = flag.String("spool", "", "directory to spool the results while the main server is unreachable, disabled if empty")
+	flagSpoolMax          = flag.Int("spoolmax", 10000, "max batches spooled, the oldest are dropped beyond it")
+)
+
+// invoke functions provided by the ping node server of main server
+type serverStub struct {
+	RegisterAgent func(location string, meta probe.Metadata) (int, error)
+	GetTargets    func(location string) ([]probe.Target, error)
+	Report        func(location string, results []probe.Result) error
+}
+
+type client struct{ *serverStub }
+
+func (c client) Register(location string, meta probe.Metadata) (time.Duration, error) {
+	seconds, err := c.RegisterAgent(location, meta)
+	return time.Duration(seconds) * time.Second, err
+}
+
+func (c client) Targets(location string) ([]probe.Target, error) { return c.GetTargets(location) }
+
+func (c client) Report(location string, results []probe.Result) error {
+	return c.serverStub.Report(location, results)
+}
+
+func main() {
+	flag.Parse()
+	hproseClient := hprose.NewHttpClient("http://" + *flagMainServerAddress)
+	// the results reported are sent by gzip
+	hproseClient.Http().Transport = compress.Transport(hproseClient.Http().Transport)
+	stub := new(serverStub)
+	hproseClient.UseService(stub)
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(stop)
+	}()
+
+	labels, err := probe.ParseLabels(*flagLabels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	meta := probe.Metadata{
+		Country: *flagCountry, City: *flagCity, ASN: *flagASN, Provider: *flagProvider,
+		Latitude: *flagLatitude, Longitude: *flagLongitude, Labels: labels,
+	}
+	if err = meta.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	a := &probe.Agent{
+		Location: *flagLocation,
+		Metadata: meta,
+		Timeout:  *flagTimeout,
+		Client:   client{stub},
+		Logf:     log.Printf,
+		Workers:  *flagWorkers,
+		Rate:     *flagRate,
+	}
+	mode := *flagICMPMode
+	if mode == "auto" {
+		mode = probe.DetectICMPMode()
+	}
+	if err = probe.SetICMPMode(mode); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("ping hosts by %v icmp mode", mode)
+	if *flagSpool != "" {
+		spool, err := probe.NewSpool(*flagSpool, *flagSpoolMax)
+		if err != nil {
+			log.Fatalf("can not open spool: %v", err)
+		}
+		a.Spool = spool
+	}
+	log.Printf("probe %v is up, main server %v", *flagLocation, *flagMainServerAddress)
+	a.Run(stop)
+}
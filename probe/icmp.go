@@ -0,0 +1,145 @@
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	// raw sockets, needs root or CAP_NET_RAW
+	ICMP_MODE_RAW = "raw"
+	// icmp datagram sockets, needs the group of the agent in net.ipv4.ping_group_range
+	ICMP_MODE_DGRAM = "dgram"
+	// udp to a closed port, the latency of the icmp port unreachable, works unprivileged everywhere
+	ICMP_MODE_UDP = "udp"
+)
+
+const _UDP_PING_PORT = 33434
+
+// mode -> ping returning the average latency in milliseconds and the loss in percent
+var icmpModes = map[string]func(addr string, timeout time.Duration) (float64, float64, error){
+	ICMP_MODE_RAW:   checkICMP,
+	ICMP_MODE_DGRAM: checkDgram,
+	ICMP_MODE_UDP:   checkUDP,
+}
+
+// DetectICMPMode returns the most precise mode permitted, raw, dgram, then udp
+func DetectICMPMode() string {
+	if c, err := net.ListenPacket("ip4:icmp", "0.0.0.0"); err == nil {
+		c.Close()
+		return ICMP_MODE_RAW
+	}
+	if c, err := listenDgram(); err == nil {
+		c.Close()
+		return ICMP_MODE_DGRAM
+	}
+	return ICMP_MODE_UDP
+}
+
+// SetICMPMode sets how the hosts are pinged
+func SetICMPMode(mode string) error {
+	f, ok := icmpModes[mode]
+	if !ok {
+		return fmt.Errorf("unknown icmp mode %v", mode)
+	}
+	pingICMP = f
+	return nil
+}
+
+// Ping pings the host ICMP_COUNT times by the icmp mode, returns the average latency in milliseconds and the loss in percent
+func Ping(addr string, timeout time.Duration) (avg, loss float64, err error) {
+	return pingICMP(addr, timeout)
+}
+
+// echo request of the id and seq, the kernel replaces the id of datagram sockets
+func echoRequest(id, seq int) []byte {
+	b := []byte{8, 0, 0, 0, byte(id >> 8), byte(id), byte(seq >> 8), byte(seq), 'w', 'a', 't', 'c', 'h', 'd', 'o', 'g'}
+	var sum uint32
+	for i := 0; i < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	sum = sum>>16 + sum&0xffff
+	sum += sum >> 16
+	b[2], b[3] = byte(^sum>>8), byte(^sum)
+	return b
+}
+
+func checkDgram(addr string, timeout time.Duration) (float64, float64, error) {
+	ip, err := net.ResolveIPAddr("ip4", addr)
+	if err != nil {
+		return 0, 100, err
+	}
+	c, err := listenDgram()
+	if err != nil {
+		return 0, 100, err
+	}
+	defer c.Close()
+	return average(func(seq int) (time.Duration, error) {
+		start := time.Now()
+		if _, err := c.WriteTo(echoRequest(0, seq), &net.UDPAddr{IP: ip.IP}); err != nil {
+			return 0, err
+		}
+		c.SetReadDeadline(start.Add(timeout))
+		b := make([]byte, 1500)
+		for {
+			n, _, err := c.ReadFrom(b)
+			if err != nil {
+				return 0, err
+			}
+			// echo reply of the seq, the datagram socket receives no ip header
+			if n >= 8 && b[0] == 0 && int(b[6])<<8|int(b[7]) == seq {
+				return time.Since(start), nil
+			}
+		}
+	})
+}
+
+// the connected udp socket reads ECONNREFUSED on the icmp port unreachable of the host
+func checkUDP(addr string, timeout time.Duration) (float64, float64, error) {
+	c, err := net.DialTimeout("udp", net.JoinHostPort(addr, fmt.Sprint(_UDP_PING_PORT)), timeout)
+	if err != nil {
+		return 0, 100, err
+	}
+	defer c.Close()
+	return average(func(seq int) (time.Duration, error) {
+		start := time.Now()
+		if _, err := c.Write([]byte("watchdog")); err != nil {
+			return 0, err
+		}
+		c.SetReadDeadline(start.Add(timeout))
+		_, err := c.Read(make([]byte, 16))
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return time.Since(start), nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%v responds on udp port %v", addr, _UDP_PING_PORT)
+		}
+		return 0, err
+	})
+}
+
+// the average latency of ICMP_COUNT pings in milliseconds and the percent of them lost, the host is down if all are lost
+func average(ping func(seq int) (time.Duration, error)) (float64, float64, error) {
+	var (
+		total    time.Duration
+		received int
+		err      error
+	)
+	for seq := 1; seq <= ICMP_COUNT; seq++ {
+		d, e := ping(seq)
+		if e != nil {
+			err = e
+			continue
+		}
+		total += d
+		received++
+	}
+	loss := float64(ICMP_COUNT-received) * 100 / ICMP_COUNT
+	if received == 0 {
+		return 0, loss, err
+	}
+	return milliseconds(total) / float64(received), loss, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package probe
+
+import (
+	"fmt"
+	"net"
+)
+
+func listenDgram() (net.PacketConn, error) {
+	return nil, fmt.Errorf("icmp datagram sockets are only supported on linux")
+}
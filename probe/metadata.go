@@ -0,0 +1,46 @@
+package probe
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Metadata describes where the probe is, registered with the main server so that the locations are shown on a map
+// and grouped by country or provider rather than by raw names
+type Metadata struct {
+	Country  string `json:"country,omitempty"`
+	City     string `json:"city,omitempty"`
+	ASN      int    `json:"asn,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	// the prefix announced by the asn the probe registers from, filled by the main server
+	Prefix    string            `json:"prefix,omitempty"`
+	Latitude  float64           `json:"latitude,omitempty"`
+	Longitude float64           `json:"longitude,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+func (m Metadata) Validate() error {
+	if m.Latitude < -90 || m.Latitude > 90 || m.Longitude < -180 || m.Longitude > 180 {
+		return fmt.Errorf("invalid coordinates %v, %v", m.Latitude, m.Longitude)
+	}
+	if m.ASN < 0 {
+		return fmt.Errorf("invalid asn %v", m.ASN)
+	}
+	return nil
+}
+
+// ParseLabels parses comma separated key=value pairs
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		i := strings.Index(kv, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid label %q, should be key=value", kv)
+		}
+		labels[kv[:i]] = kv[i+1:]
+	}
+	return labels, nil
+}
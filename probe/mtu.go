@@ -0,0 +1,76 @@
+package probe
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// KIND_MTU checks "mtu://host", the path mtu to the host and the latency of the smallest probe
+const KIND_MTU = "mtu"
+
+const (
+	// the smallest datagram every ipv4 host reassembles, the path mtu is at least it
+	MIN_MTU = 576
+	// the ip and udp headers of a probe
+	_UDP_HEADERS = 28
+)
+
+// PathMTU returns the largest datagram reaching the host unfragmented, by binary searching the size of udp probes
+// sent with the don't fragment bit to a closed port, the probe arrived if the host responds icmp port unreachable
+// a probe too large for a link is refused by the kernel once a router reports it, or lost if the path black holes it
+// the latency is of the smallest probe, the host is down if it gets no response, the largest size found is returned at the timeout
+func PathMTU(addr string, timeout time.Duration) (mtu int, latency float64, err error) {
+	c, err := net.DialTimeout("udp4", net.JoinHostPort(addr, fmt.Sprint(_UDP_PING_PORT)), timeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer c.Close()
+	uc := c.(*net.UDPConn)
+	// the mtu of the route is the upper bound
+	hi, err := dontFragment(uc)
+	if err != nil {
+		return 0, 0, err
+	}
+	deadline := time.Now().Add(timeout)
+	// the probes lost wait for the response up to a 16th of the timeout, the search stops at the deadline
+	wait := timeout / 16
+	probe := func(size int) (time.Duration, error) {
+		start := time.Now()
+		if _, err := c.Write(make([]byte, size-_UDP_HEADERS)); err != nil {
+			return 0, err
+		}
+		c.SetReadDeadline(start.Add(wait))
+		_, err := c.Read(make([]byte, 16))
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return time.Since(start), nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%v responds on udp port %v", addr, _UDP_PING_PORT)
+		}
+		return 0, err
+	}
+	d, err := probe(MIN_MTU)
+	if err != nil {
+		return 0, 0, err
+	}
+	lo := MIN_MTU
+	for lo < hi && time.Now().Before(deadline) {
+		mid := (lo + hi + 1) / 2
+		if _, err := probe(mid); err == nil {
+			lo = mid
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() || errors.Is(err, syscall.EMSGSIZE) {
+			hi = mid - 1
+		} else {
+			return 0, 0, err
+		}
+	}
+	return lo, milliseconds(d), nil
+}
+
+func checkMTU(addr string, timeout time.Duration) (float64, error) {
+	_, latency, err := PathMTU(addr, timeout)
+	return latency, err
+}
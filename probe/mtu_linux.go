@@ -0,0 +1,22 @@
+package probe
+
+import (
+	"net"
+	"syscall"
+)
+
+// set the don't fragment bit of the probes and return the mtu of the route
+func dontFragment(c *net.UDPConn) (mtu int, err error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	if e := raw.Control(func(fd uintptr) {
+		if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO); err == nil {
+			mtu, err = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU)
+		}
+	}); e != nil {
+		return 0, e
+	}
+	return
+}
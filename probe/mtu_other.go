@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package probe
+
+import (
+	"fmt"
+	"net"
+)
+
+func dontFragment(c *net.UDPConn) (int, error) {
+	return 0, fmt.Errorf("path mtu checks are only supported on linux")
+}
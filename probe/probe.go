@@ -0,0 +1,221 @@
+// Package probe checks the targets assigned by the main server and reports the results in batches.
+//
+// A target is checked by the kind of its server, "tcp://host:port" is connected, "tls://host[:port]" is handshaken,
+// "http://" and "https://" urls are fetched, the path mtu to "mtu://host" is searched, the steps of "steps:" transactions are run and the others are hosts pinged by icmp.
+// The servers of the checks of a host, like its icmp, https and tls checks, are named by CheckServer.
+package probe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gogames/ping"
+)
+
+const (
+	KIND_ICMP = "icmp"
+	KIND_TCP  = "tcp"
+	KIND_HTTP = "http"
+	KIND_TLS  = "tls"
+)
+
+// ICMP_COUNT is the pings of an icmp check, the loss is of them
+const ICMP_COUNT = 3
+
+// the default port of tls checks
+const _TLS_PORT = "443"
+
+// TLS_EXPIRY is how long before its expiry a certificate fails the tls check, so that it alerts before the expiry
+const TLS_EXPIRY = 14 * 24 * time.Hour
+
+// kind -> check returning the latency in milliseconds
+var checkers = map[string]func(addr string, timeout time.Duration) (float64, error){
+	KIND_ICMP: checkPing,
+	KIND_TCP:  checkTCP,
+	KIND_HTTP: checkHTTP,
+	KIND_TLS:  checkTLS,
+	KIND_MTU:  checkMTU,
+}
+
+// RegisterChecker adds the check of a new kind of targets
+func RegisterChecker(kind string, f func(addr string, timeout time.Duration) (float64, error)) error {
+	if _, ok := checkers[kind]; ok {
+		return fmt.Errorf("checker %v already exist", kind)
+	}
+	checkers[kind] = f
+	return nil
+}
+
+// Target is a monitored server, Addr is what the checker of the Kind checks
+// Steps are of the transactions, given by the main server
+type Target struct {
+	Server string `json:"server"`
+	Kind   string `json:"kind"`
+	Addr   string `json:"addr"`
+	Steps  []Step `json:"steps,omitempty"`
+}
+
+func TargetOf(server string) Target {
+	switch {
+	case strings.HasPrefix(server, "tcp://"):
+		return Target{Server: server, Kind: KIND_TCP, Addr: strings.TrimPrefix(server, "tcp://")}
+	case strings.HasPrefix(server, "tls://"):
+		addr := strings.TrimPrefix(server, "tls://")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, _TLS_PORT)
+		}
+		return Target{Server: server, Kind: KIND_TLS, Addr: addr}
+	case strings.HasPrefix(server, "http://"), strings.HasPrefix(server, "https://"):
+		return Target{Server: server, Kind: KIND_HTTP, Addr: server}
+	case strings.HasPrefix(server, "mtu://"):
+		return Target{Server: server, Kind: KIND_MTU, Addr: strings.TrimPrefix(server, "mtu://")}
+	case strings.HasPrefix(server, STEPS_PREFIX):
+		return Target{Server: server, Kind: KIND_STEPS, Addr: server}
+	}
+	return Target{Server: server, Kind: KIND_ICMP, Addr: server}
+}
+
+// CheckServer returns the server of the check of the kind of the host, tcp checks need the port of the host
+func CheckServer(host, kind string) (string, error) {
+	if host == "" || strings.Contains(host, "://") {
+		return "", fmt.Errorf("%q should be a host", host)
+	}
+	switch kind {
+	case KIND_ICMP:
+		return host, nil
+	case KIND_HTTP:
+		return "https://" + host, nil
+	case KIND_TLS:
+		return "tls://" + host, nil
+	case KIND_MTU:
+		return "mtu://" + host, nil
+	case KIND_TCP:
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			return "", fmt.Errorf("tcp check of %v needs the port", host)
+		}
+		return "tcp://" + host, nil
+	}
+	return "", fmt.Errorf("unknown kind %v", kind)
+}
+
+// Result is a check of the server, Avg is the latency in milliseconds, 0 if the server is down
+// Steps are the latencies of the steps of a transaction, whose Avg is their sum
+// Loss is the percent of the pings lost of an icmp check, nil of the other kinds, MTU is the path mtu of an mtu check
+type Result struct {
+	Server string  `json:"server"`
+	Avg    float64 `json:"avg"`
+	// unix nano of the probe when the check finished
+	Time  int64     `json:"time"`
+	Err   string    `json:"err,omitempty"`
+	Steps []float64 `json:"steps,omitempty"`
+	Loss  *float64  `json:"loss,omitempty"`
+	MTU   int       `json:"mtu,omitempty"`
+}
+
+// Check checks the target by the checker of its kind
+func Check(t Target, timeout time.Duration) Result {
+	r := Result{Server: t.Server}
+	f, ok := checkers[t.Kind]
+	if t.Kind == KIND_STEPS {
+		var err error
+		if r.Steps, err = CheckSteps(t.Steps, timeout); err != nil {
+			r.Err = err.Error()
+		} else {
+			for _, l := range r.Steps {
+				r.Avg += l
+			}
+		}
+	} else if t.Kind == KIND_ICMP {
+		avg, loss, err := pingICMP(t.Addr, timeout)
+		if r.Avg, r.Loss = avg, &loss; err != nil {
+			r.Err = err.Error()
+		}
+	} else if t.Kind == KIND_MTU {
+		var err error
+		if r.MTU, r.Avg, err = PathMTU(t.Addr, timeout); err != nil {
+			r.Err = err.Error()
+		}
+	} else if !ok {
+		r.Err = fmt.Sprintf("unknown kind %v", t.Kind)
+	} else if avg, err := f(t.Addr, timeout); err != nil {
+		r.Err = err.Error()
+	} else {
+		r.Avg = avg
+	}
+	r.Time = time.Now().UnixNano()
+	return r
+}
+
+// the ping of the icmp mode, see SetICMPMode
+var pingICMP = checkICMP
+
+func checkPing(addr string, timeout time.Duration) (float64, error) {
+	avg, _, err := pingICMP(addr, timeout)
+	return avg, err
+}
+
+// pinged one by one to tell the loss, a ping of no reply is lost
+func checkICMP(addr string, timeout time.Duration) (float64, float64, error) {
+	return average(func(int) (time.Duration, error) {
+		if avg := ping.Ping(addr, 1, timeout).Avg; avg > 0 {
+			return time.Duration(avg * float64(time.Millisecond)), nil
+		}
+		return 0, fmt.Errorf("no reply from %v", addr)
+	})
+}
+
+func checkTCP(addr string, timeout time.Duration) (float64, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return 0, err
+	}
+	d := time.Since(start)
+	conn.Close()
+	return milliseconds(d), nil
+}
+
+// the latency is of the response headers, 5xx is down
+func checkHTTP(addr string, timeout time.Duration) (float64, error) {
+	c := &http.Client{Timeout: timeout}
+	start := time.Now()
+	resp, err := c.Get(addr)
+	if err != nil {
+		return 0, err
+	}
+	d := time.Since(start)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return 0, fmt.Errorf("%v responds %v", addr, resp.Status)
+	}
+	return milliseconds(d), nil
+}
+
+// the latency is of the handshake, a certificate not verified or expiring within TLS_EXPIRY is down
+func checkTLS(addr string, timeout time.Duration) (float64, error) {
+	start := time.Now()
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, nil)
+	if err != nil {
+		return 0, err
+	}
+	d := time.Since(start)
+	defer conn.Close()
+	return milliseconds(d), verifyExpiry(conn.ConnectionState().PeerCertificates, time.Now())
+}
+
+func verifyExpiry(certs []*x509.Certificate, now time.Time) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificate")
+	}
+	if expire := certs[0].NotAfter; expire.Before(now.Add(TLS_EXPIRY)) {
+		return fmt.Errorf("certificate of %v expires at %v", certs[0].Subject.CommonName, expire.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func milliseconds(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
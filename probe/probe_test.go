@@ -0,0 +1,471 @@
+package probe
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_TargetOf(t *testing.T) {
+	for server, kind := range map[string]string{
+		"google.com":          KIND_ICMP,
+		"tcp://google.com:80": KIND_TCP,
+		"https://google.com/": KIND_HTTP,
+		"tls://google.com":    KIND_TLS,
+		"steps:alice:login":   KIND_STEPS,
+	} {
+		if target := TargetOf(server); target.Kind != kind {
+			t.Errorf("kind of %v should be %v, got %v", server, kind, target.Kind)
+		}
+	}
+	if target := TargetOf("tcp://google.com:80"); target.Addr != "google.com:80" {
+		t.Errorf("got addr %v", target.Addr)
+	}
+	if target := TargetOf("tls://google.com"); target.Addr != "google.com:443" {
+		t.Errorf("tls check should default to port 443, got addr %v", target.Addr)
+	}
+}
+
+func Test_CheckServer(t *testing.T) {
+	for kind, want := range map[string]string{
+		KIND_ICMP: "google.com",
+		KIND_HTTP: "https://google.com",
+		KIND_TLS:  "tls://google.com",
+	} {
+		if server, err := CheckServer("google.com", kind); err != nil || server != want {
+			t.Errorf("%v: want %v, got %v, %v", kind, want, server, err)
+		} else if TargetOf(server).Kind != kind {
+			t.Errorf("%v should be checked by %v", server, kind)
+		}
+	}
+	if server, err := CheckServer("google.com:25", KIND_TCP); err != nil || server != "tcp://google.com:25" {
+		t.Errorf("got %v, %v", server, err)
+	}
+	for _, c := range [][2]string{{"google.com", KIND_TCP}, {"google.com", "udp"}, {"https://google.com", KIND_TLS}, {"", KIND_ICMP}} {
+		if _, err := CheckServer(c[0], c[1]); err == nil {
+			t.Errorf("want the error of %v check of %q", c[1], c[0])
+		}
+	}
+}
+
+func Test_CheckTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	// the certificate of the test server is not trusted
+	if r := Check(TargetOf("tls://"+ts.Listener.Addr().String()), time.Second); r.Err == "" || r.Avg != 0 {
+		t.Errorf("tls check of untrusted certificate should be down, got %+v", r)
+	}
+	cert := ts.Certificate()
+	if err := verifyExpiry([]*x509.Certificate{cert}, cert.NotAfter.Add(-TLS_EXPIRY-time.Hour)); err != nil {
+		t.Errorf("certificate should be valid, got %v", err)
+	}
+	if err := verifyExpiry([]*x509.Certificate{cert}, cert.NotAfter.Add(-time.Hour)); err == nil {
+		t.Error("certificate expiring in an hour should fail")
+	}
+}
+
+func Test_CheckSteps(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.FormValue("password") != "pass" {
+			http.Error(w, "denied", http.StatusForbidden)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1"})
+		fmt.Fprint(w, `<input name="csrf" value="abc">`)
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "s1" || r.Header.Get("X-CSRF") != "abc" {
+			http.Error(w, "signed out", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "welcome alice")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	steps := []Step{
+		{Name: "login", Method: http.MethodPost, URL: ts.URL + "/login", Body: "password=pass",
+			Headers: map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, Extract: map[string]string{"csrf": `name="csrf" value="([^"]+)"`}},
+		{Name: "account", URL: ts.URL + "/account", Headers: map[string]string{"X-CSRF": "{{csrf}}"}, Contains: "welcome"},
+	}
+	r := Check(Target{Server: "steps:alice:login", Kind: KIND_STEPS, Steps: steps}, time.Second)
+	if r.Err != "" || len(r.Steps) != 2 || r.Avg <= 0 || r.Avg != r.Steps[0]+r.Steps[1] {
+		t.Fatalf("got %+v", r)
+	}
+	steps[1].Contains = "goodbye"
+	if r = Check(Target{Server: "steps:alice:login", Kind: KIND_STEPS, Steps: steps}, time.Second); r.Avg != 0 || !strings.Contains(r.Err, "step account") || r.Steps[0] <= 0 || r.Steps[1] != 0 {
+		t.Errorf("the failed step should be down, got %+v", r)
+	}
+	for _, bad := range [][]Step{
+		nil,
+		{{Name: "ftp", URL: "ftp://example.com"}},
+		{{URL: "https://example.com"}},
+		{{Name: "extract", URL: "https://example.com", Extract: map[string]string{"a": "(a)(b)"}}},
+	} {
+		if err := ValidateSteps(bad); err == nil {
+			t.Errorf("want the error of steps %+v", bad)
+		}
+	}
+}
+
+func Test_Check(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer ts.Close()
+	if r := Check(TargetOf(ts.URL), time.Second); r.Err != "" || r.Avg <= 0 {
+		t.Errorf("http check should be up, got %+v", r)
+	}
+	if r := Check(TargetOf(ts.URL+"/broken"), time.Second); r.Err == "" || r.Avg != 0 {
+		t.Errorf("http check should be down, got %+v", r)
+	}
+	if r := Check(TargetOf("tcp://"+ts.Listener.Addr().String()), time.Second); r.Err != "" || r.Avg <= 0 {
+		t.Errorf("tcp check should be up, got %+v", r)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	if r := Check(TargetOf("tcp://"+addr), time.Second); r.Err == "" || r.Avg != 0 {
+		t.Errorf("tcp check of closed port should be down, got %+v", r)
+	}
+	if r := Check(Target{Server: "x", Kind: "udp"}, time.Second); r.Err == "" {
+		t.Error("unknown kind should fail")
+	}
+}
+
+type fakeClient struct {
+	targets []Target
+	mu      sync.Mutex
+	reports [][]Result
+	down    bool
+	busy    time.Duration
+}
+
+func (c *fakeClient) Register(location string, meta Metadata) (time.Duration, error) {
+	return time.Hour, nil
+}
+
+func (c *fakeClient) Targets(location string) ([]Target, error) {
+	if c.down {
+		return nil, fmt.Errorf("main server is down")
+	}
+	return c.targets, nil
+}
+
+func (c *fakeClient) Report(location string, results []Result) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down {
+		return fmt.Errorf("main server is down")
+	}
+	if c.busy > 0 {
+		// relayed by the rpc as the message
+		return fmt.Errorf("%v", BusyError{RetryAfter: c.busy})
+	}
+	c.reports = append(c.reports, results)
+	return nil
+}
+
+func Test_Agent(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	c := &fakeClient{targets: []Target{TargetOf(ts.URL), TargetOf("tcp://" + ts.Listener.Addr().String())}}
+	a := &Agent{Location: "Tokyo", Timeout: time.Second, Client: c, Logf: t.Logf}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		a.Run(stop)
+		close(done)
+	}()
+	for i := 0; ; i++ {
+		c.mu.Lock()
+		n := len(c.reports)
+		c.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("agent did not report")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+	if len(c.reports[0]) != 2 || c.reports[0][0].Server != ts.URL || c.reports[0][0].Time == 0 {
+		t.Errorf("got report %+v", c.reports[0])
+	}
+}
+
+func Test_Spool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err := NewSpool(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	c := &fakeClient{targets: []Target{TargetOf(ts.URL)}}
+	a := &Agent{Location: "Tokyo", Timeout: time.Second, Client: c, Spool: spool, Logf: t.Logf}
+	if err = a.Round(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.down = true
+	for i := 0; i < 3; i++ {
+		if a.Round() == nil {
+			t.Fatal("round should fail while the main server is down")
+		}
+	}
+	if spool.Len() != 2 {
+		t.Errorf("should spool 2 batches at most, got %v", spool.Len())
+	}
+
+	c.down = false
+	if err = a.Round(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.reports) != 3 || spool.Len() != 0 {
+		t.Errorf("should replay the spooled batches in one report, got %v reports, %v spooled", len(c.reports), spool.Len())
+	}
+	if len(c.reports[2]) != 2 || c.reports[2][0].Time >= c.reports[2][1].Time {
+		t.Error("should replay the oldest first")
+	}
+}
+
+func Test_Busy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err := NewSpool(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	c := &fakeClient{targets: []Target{TargetOf(ts.URL)}, busy: time.Minute}
+	a := &Agent{Location: "Tokyo", Timeout: time.Second, Client: c, Spool: spool, Logf: t.Logf}
+	err = a.Round()
+	if d, ok := RetryAfter(err); !ok || d != time.Minute {
+		t.Fatalf("want the time to retry after of %v, got %v", err, d)
+	}
+	if spool.Len() != 1 || a.busyUntil.IsZero() {
+		t.Errorf("should spool the batch rejected, got %v spooled", spool.Len())
+	}
+
+	// the spool is replayed once the time given passes
+	c.busy = 0
+	if err = a.Round(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.reports) != 1 || spool.Len() != 1 {
+		t.Errorf("should not replay the spool before the time given, got %v reports, %v spooled", len(c.reports), spool.Len())
+	}
+	a.busyUntil = time.Now()
+	if err = a.Round(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.reports) != 3 || spool.Len() != 0 {
+		t.Errorf("should replay the spool, got %v reports, %v spooled", len(c.reports), spool.Len())
+	}
+	if _, ok := RetryAfter(fmt.Errorf("main server is down")); ok {
+		t.Error("should not retry after of other errors")
+	}
+}
+
+func Test_ICMPMode(t *testing.T) {
+	defer SetICMPMode(ICMP_MODE_RAW)
+	if err := SetICMPMode("ssh"); err == nil {
+		t.Error("should reject unknown mode")
+	}
+	if _, ok := icmpModes[DetectICMPMode()]; !ok {
+		t.Error("should detect a known mode")
+	}
+	SetICMPMode(ICMP_MODE_UDP)
+	if r := Check(TargetOf("127.0.0.1"), time.Second); r.Err != "" || r.Avg <= 0 || r.Loss == nil || *r.Loss != 0 {
+		t.Errorf("udp ping of localhost should be up without loss, got %+v", r)
+	}
+	if r := Check(TargetOf("tcp://127.0.0.1:1"), time.Second); r.Loss != nil {
+		t.Errorf("tcp check should have no loss, got %v", *r.Loss)
+	}
+	if c, err := listenDgram(); err != nil {
+		t.Logf("skip dgram mode: %v", err)
+	} else {
+		c.Close()
+		SetICMPMode(ICMP_MODE_DGRAM)
+		if r := Check(TargetOf("127.0.0.1"), time.Second); r.Err != "" || r.Avg <= 0 {
+			t.Errorf("dgram ping of localhost should be up, got %+v", r)
+		}
+	}
+}
+
+func Test_Loss(t *testing.T) {
+	avg, loss, err := average(func(seq int) (time.Duration, error) {
+		if seq == 2 {
+			return 0, fmt.Errorf("timeout")
+		}
+		return time.Duration(seq) * time.Millisecond, nil
+	})
+	if err != nil || avg != 2 || math.Abs(loss-100.0/3) > 1e-9 {
+		t.Errorf("should average the replies and count the lost, got %v, %v, %v", avg, loss, err)
+	}
+	if avg, loss, err = average(func(int) (time.Duration, error) { return 0, fmt.Errorf("timeout") }); err == nil || avg != 0 || loss != 100 {
+		t.Errorf("should be down if all are lost, got %v, %v, %v", avg, loss, err)
+	}
+	loss = 101
+	if err = (Result{Server: "google.com", Time: time.Now().UnixNano(), Loss: &loss}).Validate(0, time.Now()); err == nil {
+		t.Error("should reject loss above 100")
+	}
+}
+
+func Test_Pacing(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		running int
+		peak    int
+	)
+	RegisterChecker("slow", func(addr string, timeout time.Duration) (float64, error) {
+		mu.Lock()
+		if running++; running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return 1, nil
+	})
+	targets := make([]Target, 20)
+	for i := range targets {
+		targets[i] = Target{Server: fmt.Sprint(i), Kind: "slow"}
+	}
+	a := &Agent{Workers: 4, Logf: t.Logf}
+	results := a.check(targets)
+	if peak > 4 {
+		t.Errorf("at most 4 checks should run at once, got %v", peak)
+	}
+	for i, r := range results {
+		if r.Server != fmt.Sprint(i) || r.Avg != 1 {
+			t.Errorf("result %v is %+v", i, r)
+		}
+	}
+
+	a = &Agent{Workers: 100, Rate: 200, Logf: t.Logf}
+	start := time.Now()
+	a.check(targets)
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("20 checks at rate 200 should take about 100ms, took %v", d)
+	}
+}
+
+func Test_Metadata(t *testing.T) {
+	labels, err := ParseLabels("tier=edge, ipv6=yes")
+	if err != nil || labels["tier"] != "edge" || labels["ipv6"] != "yes" {
+		t.Errorf("got labels %v, %v", labels, err)
+	}
+	if _, err = ParseLabels("edge"); err == nil {
+		t.Error("should reject label without value")
+	}
+	if (Metadata{Latitude: 35.7, Longitude: 139.7}).Validate() != nil {
+		t.Error("coordinates of Tokyo are valid")
+	}
+	if (Metadata{Latitude: 135.7}).Validate() == nil {
+		t.Error("latitude beyond 90 is invalid")
+	}
+}
+
+func Test_Validate(t *testing.T) {
+	now := time.Now()
+	valid := Result{Server: "google.com", Avg: 12.5, Time: now.UnixNano()}
+	if err := valid.Validate(0, now); err != nil {
+		t.Errorf("result should be valid, got %v", err)
+	}
+	for field, r := range map[string]Result{
+		"server": {Avg: 1, Time: now.UnixNano()},
+		"avg":    {Server: "google.com", Avg: -1, Time: now.UnixNano()},
+		"time":   {Server: "google.com", Avg: 1, Time: now.Add(-MAX_RESULT_AGE - time.Hour).UnixNano()},
+	} {
+		err := r.Validate(3, now)
+		if pe, ok := err.(*PayloadError); !ok || pe.Field != field || pe.Index != 3 {
+			t.Errorf("want invalid %v of result 3, got %v", field, err)
+		}
+	}
+	if err := CheckBatch(make([]Result, MAX_BATCH+1)); err == nil {
+		t.Error("report larger than MAX_BATCH should be rejected")
+	}
+}
+
+func Test_ReportInBatches(t *testing.T) {
+	c := &fakeClient{}
+	a := &Agent{Location: "Tokyo", Client: c, Logf: t.Logf}
+	if err := a.report(make([]Result, MAX_BATCH*2+1)); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.reports) != 3 || len(c.reports[2]) != 1 {
+		t.Errorf("results should be reported in batches of %v, got %v reports", MAX_BATCH, len(c.reports))
+	}
+}
+
+func FuzzValidate(f *testing.F) {
+	now := time.Now()
+	f.Add("google.com", 12.5, now.UnixNano(), "")
+	f.Add("", math.NaN(), int64(0), "timeout")
+	f.Add("tcp://google.com:80", math.Inf(1), int64(math.MaxInt64), strings.Repeat("x", 2000))
+	f.Fuzz(func(t *testing.T, server string, avg float64, tm int64, e string) {
+		r := Result{Server: server, Avg: avg, Time: tm, Err: e}
+		err := r.Validate(0, now)
+		if err == nil {
+			// the valid results are stored as formatted by the main server
+			if server == "" || math.IsNaN(avg) || avg < 0 || avg > MAX_LATENCY || math.Abs(float64(now.UnixNano()-tm)) > float64(MAX_RESULT_AGE) {
+				t.Errorf("result %+v should be invalid", r)
+			}
+		} else if _, ok := err.(*PayloadError); !ok {
+			t.Errorf("error should be a *PayloadError, got %T", err)
+		}
+	})
+}
+
+func Test_PathMTU(t *testing.T) {
+	if target := TargetOf("mtu://10.0.0.1"); target.Kind != KIND_MTU || target.Addr != "10.0.0.1" {
+		t.Errorf("got target %+v", target)
+	}
+	if server, _ := CheckServer("10.0.0.1", KIND_MTU); server != "mtu://10.0.0.1" {
+		t.Errorf("got server %v", server)
+	}
+	r := Check(TargetOf("mtu://127.0.0.1"), time.Second)
+	if runtime.GOOS != "linux" {
+		if r.Err == "" {
+			t.Error("should fail but on linux")
+		}
+		return
+	}
+	// the loopback takes jumbo datagrams
+	if r.Err != "" || r.Avg <= 0 || r.MTU <= 1500 {
+		t.Errorf("path mtu of localhost should be beyond 1500, got %+v", r)
+	}
+	if err := (Result{Server: "mtu://127.0.0.1", Time: time.Now().UnixNano(), MTU: MAX_MTU + 1}).Validate(0, time.Now()); err == nil {
+		t.Error("should reject mtu above MAX_MTU")
+	}
+}
@@ -0,0 +1,124 @@
+package probe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	_SPOOL_SUFFIX = ".json"
+	_TMP_SUFFIX   = ".tmp"
+)
+
+// Spool keeps the batches failed to report in a directory, one file per batch, to report them later
+// the oldest batches are dropped beyond max
+type Spool struct {
+	dir string
+	max int
+}
+
+func NewSpool(dir string, max int) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Spool{dir: dir, max: max}, nil
+}
+
+// Write writes the batch, the files are named by time so that they sort in order
+func (s *Spool) Write(results []Result) error {
+	b, err := json.Marshal(results)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), _SPOOL_SUFFIX))
+	if err = ioutil.WriteFile(path+_TMP_SUFFIX, b, 0600); err != nil {
+		return err
+	}
+	if err = os.Rename(path+_TMP_SUFFIX, path); err != nil {
+		return err
+	}
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(files)-s.max; i++ {
+		os.Remove(files[i])
+	}
+	return nil
+}
+
+// Replay reports the batches oldest first, coalesced into reports of MAX_BATCH results at most,
+// so that the main server merges the results of a server spooled during an outage at once rather than one round at a time
+// a batch is removed once reported, it stops on the first failure, the rest are replayed next time
+// returns the batches replayed
+func (s *Spool) Replay(report func([]Result) error) (n int, err error) {
+	files, err := s.files()
+	if err != nil {
+		return
+	}
+	var (
+		results  []Result
+		reported []string
+	)
+	flush := func() error {
+		if len(reported) == 0 {
+			return nil
+		}
+		if err := report(results); err != nil {
+			return err
+		}
+		for _, file := range reported {
+			os.Remove(file)
+		}
+		n += len(reported)
+		results, reported = nil, nil
+		return nil
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return n, err
+		}
+		var batch []Result
+		if err = json.Unmarshal(b, &batch); err != nil {
+			// can not be replayed ever
+			os.Remove(file)
+			continue
+		}
+		if len(results)+len(batch) > MAX_BATCH {
+			if err = flush(); err != nil {
+				return n, err
+			}
+		}
+		results, reported = append(results, batch...), append(reported, file)
+	}
+	err = flush()
+	return
+}
+
+// Len returns the number of the batches spooled
+func (s *Spool) Len() int {
+	files, _ := s.files()
+	return len(files)
+}
+
+func (s *Spool) files() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), _SPOOL_SUFFIX) {
+			files = append(files, filepath.Join(s.dir, info.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
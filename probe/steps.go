@@ -0,0 +1,142 @@
+package probe
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// the servers of the transactions of http steps, named like "steps:<username>:<name>"
+const (
+	KIND_STEPS   = "steps"
+	STEPS_PREFIX = "steps:"
+)
+
+const (
+	MAX_STEPS = 10
+	// bytes of a response read to assert and extract
+	_MAX_STEP_BODY = 1 << 20
+)
+
+// Step is a request of a transaction, like signing in, fetching a page and asserting its content
+// Status is the status expected, any below 400 if zero, Contains is the text the body should contain
+// Extract is name -> regexp of one group captured from the body, "{{name}}" in the url, the headers and the body of the next steps is replaced by it
+// the cookies are kept across the steps, like a browser
+type Step struct {
+	Name     string            `json:"name"`
+	Method   string            `json:"method,omitempty"`
+	URL      string            `json:"url"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Status   int               `json:"status,omitempty"`
+	Contains string            `json:"contains,omitempty"`
+	Extract  map[string]string `json:"extract,omitempty"`
+}
+
+// ValidateSteps returns the error of the transaction of the steps
+func ValidateSteps(steps []Step) error {
+	if len(steps) == 0 || len(steps) > MAX_STEPS {
+		return fmt.Errorf("a transaction should have 1 to %v steps", MAX_STEPS)
+	}
+	for i, s := range steps {
+		if s.Name == "" {
+			return fmt.Errorf("step %v has no name", i)
+		}
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("url %q of step %v should be an http or https url", s.URL, s.Name)
+		}
+		if s.Status != 0 && (s.Status < 100 || s.Status > 599) {
+			return fmt.Errorf("status %v of step %v is not an http status", s.Status, s.Name)
+		}
+		for name, expr := range s.Extract {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return fmt.Errorf("extract %v of step %v: %v", name, s.Name, err)
+			}
+			if re.NumSubexp() != 1 {
+				return fmt.Errorf("extract %v of step %v should capture one group", name, s.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// CheckSteps runs the steps in order within the timeout and returns the latency of each step in milliseconds
+// the steps after the one failing are not run, their latencies are 0
+func CheckSteps(steps []Step, timeout time.Duration) ([]float64, error) {
+	latencies := make([]float64, len(steps))
+	if err := ValidateSteps(steps); err != nil {
+		return latencies, err
+	}
+	jar, _ := cookiejar.New(nil)
+	c := &http.Client{Timeout: timeout, Jar: jar}
+	deadline := time.Now().Add(timeout)
+	vars := make(map[string]string)
+	for i, s := range steps {
+		if time.Now().After(deadline) {
+			return latencies, fmt.Errorf("step %v: transaction timed out after %v", s.Name, timeout)
+		}
+		c.Timeout = time.Until(deadline)
+		d, err := checkStep(c, s, vars)
+		if err != nil {
+			return latencies, fmt.Errorf("step %v: %v", s.Name, err)
+		}
+		latencies[i] = milliseconds(d)
+	}
+	return latencies, nil
+}
+
+// the latency is of the whole response, which is asserted and extracted
+func checkStep(c *http.Client, s Step, vars map[string]string) (time.Duration, error) {
+	kvs := make([]string, 0, 2*len(vars))
+	for name, v := range vars {
+		kvs = append(kvs, "{{"+name+"}}", v)
+	}
+	r := strings.NewReplacer(kvs...)
+	method := s.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	var body io.Reader
+	if s.Body != "" {
+		body = strings.NewReader(r.Replace(s.Body))
+	}
+	req, err := http.NewRequest(method, r.Replace(s.URL), body)
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range s.Headers {
+		req.Header.Set(k, r.Replace(v))
+	}
+	start := time.Now()
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, _MAX_STEP_BODY))
+	d := time.Since(start)
+	if err != nil {
+		return 0, err
+	}
+	if (s.Status == 0 && resp.StatusCode >= 400) || (s.Status != 0 && resp.StatusCode != s.Status) {
+		return 0, fmt.Errorf("responds %v", resp.Status)
+	}
+	if s.Contains != "" && !strings.Contains(string(b), s.Contains) {
+		return 0, fmt.Errorf("response does not contain %q", s.Contains)
+	}
+	for name, expr := range s.Extract {
+		m := regexp.MustCompile(expr).FindSubmatch(b)
+		if m == nil {
+			return 0, fmt.Errorf("can not extract %v", name)
+		}
+		vars[name] = string(m[1])
+	}
+	return d, nil
+}
@@ -0,0 +1,79 @@
+package probe
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// the caps of the reports, the main server rejects the results beyond them rather than storing garbage
+const (
+	MAX_BATCH = 5000
+	// milliseconds
+	MAX_LATENCY = 60 * 1000
+	// bytes, of an ip datagram
+	MAX_MTU = 65535
+	// results spooled longer are history nobody charts
+	MAX_RESULT_AGE = 30 * 24 * time.Hour
+	// beyond the clock skew of a sane probe
+	MAX_RESULT_AHEAD = 10 * time.Minute
+	_MAX_SERVER_LEN  = 2048
+	_MAX_ERR_LEN     = 1024
+)
+
+// PayloadError is a malformed field of the result at Index of the report, or of the whole report if Index is -1
+type PayloadError struct {
+	Index  int
+	Field  string
+	Reason string
+}
+
+func (e *PayloadError) Error() string {
+	if e.Index < 0 {
+		return fmt.Sprintf("invalid report: %v %v", e.Field, e.Reason)
+	}
+	return fmt.Sprintf("invalid result %v: %v %v", e.Index, e.Field, e.Reason)
+}
+
+// CheckBatch returns the error of a report too large to be processed at once, the agent splits its reports by MAX_BATCH
+func CheckBatch(results []Result) error {
+	if len(results) > MAX_BATCH {
+		return &PayloadError{Index: -1, Field: "batch", Reason: fmt.Sprintf("of %v results exceeds %v", len(results), MAX_BATCH)}
+	}
+	return nil
+}
+
+// Validate returns the *PayloadError of the result at index i of the report received at now
+func (r Result) Validate(i int, now time.Time) error {
+	invalid := func(field, format string, v ...interface{}) error {
+		return &PayloadError{Index: i, Field: field, Reason: fmt.Sprintf(format, v...)}
+	}
+	switch {
+	case r.Server == "":
+		return invalid("server", "is empty")
+	case len(r.Server) > _MAX_SERVER_LEN:
+		return invalid("server", "is longer than %v", _MAX_SERVER_LEN)
+	case math.IsNaN(r.Avg) || math.IsInf(r.Avg, 0):
+		return invalid("avg", "is not a number")
+	case r.Avg < 0 || r.Avg > MAX_LATENCY:
+		return invalid("avg", "%v is out of [0, %v]", r.Avg, MAX_LATENCY)
+	case len(r.Err) > _MAX_ERR_LEN:
+		return invalid("err", "is longer than %v", _MAX_ERR_LEN)
+	case len(r.Steps) > MAX_STEPS:
+		return invalid("steps", "are more than %v", MAX_STEPS)
+	case r.Loss != nil && !(*r.Loss >= 0 && *r.Loss <= 100):
+		return invalid("loss", "%v is out of [0, 100]", *r.Loss)
+	case r.MTU < 0 || r.MTU > MAX_MTU:
+		return invalid("mtu", "%v is out of [0, %v]", r.MTU, MAX_MTU)
+	}
+	for _, l := range r.Steps {
+		if math.IsNaN(l) || l < 0 || l > MAX_LATENCY {
+			return invalid("steps", "latency %v is out of [0, %v]", l, MAX_LATENCY)
+		}
+	}
+	t := time.Unix(0, r.Time)
+	if t.Before(now.Add(-MAX_RESULT_AGE)) || t.After(now.Add(MAX_RESULT_AHEAD)) {
+		return invalid("time", "%v is out of [-%v, +%v] of now", t.Format(time.RFC3339), MAX_RESULT_AGE, MAX_RESULT_AHEAD)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gogames/watchdog/main-server/alert"
+	"github.com/gogames/watchdog/main-server/importer"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/probe"
+	"github.com/hprose/hprose-go/hprose"
+)
+
+// invoke functions provided by admin server of main server
+type adminClientStub struct {
+	AddUser           func(username, password string) error
+	ListUsers         func() ([]string, error)
+	GetUser           func(username string) (store.User, error)
+	SetOrganization   func(username, organization string) error
+	AddServers        func(username string, servers []string) (map[string]string, error)
+	DelServers        func(username string, servers []string) (map[string]string, error)
+	ListLocations     func() ([]string, error)
+	ListProbes        func() (map[string]probe.Metadata, error)
+	GetMonitorResult  func(username, server string) (map[string][]store.PingRet, error)
+	LatencyMatrix     func() (map[string]map[string]store.PingRet, error)
+	DeadProbeAlerts   func() ([]alert.Alert, error)
+	Backfill          func(server, location string, prs []store.PingRet) (int, error)
+	Apply             func(spec store.Spec, dryRun bool) ([]store.Change, error)
+	Import            func(name string, dryRun bool) ([]store.Change, error)
+	BulkImport        func(username string, b importer.Bulk, dryRun bool) (importer.BulkReport, error)
+	SetLogLevel       func(level int) error
+	SlowOps           func(n int) ([]store.SlowOp, error)
+	EngineBreaker     func() (store.BreakerStatus, error)
+	RecoveryReport    func() (store.RecoveryReport, error)
+	SetReadOnly       func(on bool) (int, error)
+	ReadOnly          func() (store.ReadOnlyStatus, error)
+	TopUsage          func(metric string, days, n int) ([]store.UserUsage, error)
+	PurgeServer       func(server, actor string) error
+	PurgeUser         func(username, actor string) error
+	Audit             func(n int) ([]store.AuditEntry, error)
+	RotateKeys        func() (int, error)
+	Reload            func() ([]string, error)
+	ResyncAssignments func() (int, error)
+	OptOut            func(entry, reason, actor string) ([]string, error)
+	RemoveOptOut      func(entry, actor string) error
+	OptOuts           func() ([]store.OptOut, error)
+	Broadcast         func(text string) (int, error)
+}
+
+// invoke functions provided on /support of admin server, by a support token or the admin token
+// every call is recorded in the audit log of main server with the reason
+type supportClientStub struct {
+	ViewUser          func(username, reason string) (store.User, error)
+	ViewMonitorResult func(username, server, reason string) (map[string][]store.PingRet, error)
+	ViewAggregates    func(username, server, resolution, from, to, reason string) (map[string][]store.Aggregate, error)
+	ViewSettings      func(username, reason string) (store.Settings, error)
+}
+
+var (
+	adminClient   = new(adminClientStub)
+	supportClient = new(supportClientStub)
+	hproseClient  hprose.Client
+	// of the requests to the admin server besides the rpc, like the backup
+	httpClient = &http.Client{Transport: tokenTransport{http.DefaultTransport}}
+)
+
+// tokenTransport sends the token as "Authorization: Bearer <token>", never in the url recorded by the proxies and the access logs
+type tokenTransport struct {
+	rt http.RoundTripper
+}
+
+func (t tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// the request is not modified, see http.RoundTripper
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+*flagAdminToken)
+	return t.rt.RoundTrip(r)
+}
+
+func initAdminClient() {
+	c := hprose.NewHttpClient(fmt.Sprintf("http://%s/", *flagAdminAddress))
+	c.Http().Transport = tokenTransport{c.Http().Transport}
+	hproseClient = c
+	hproseClient.UseService(adminClient)
+	sc := hprose.NewHttpClient(fmt.Sprintf("http://%s/support", *flagAdminAddress))
+	sc.Http().Transport = tokenTransport{sc.Http().Transport}
+	sc.UseService(supportClient)
+}
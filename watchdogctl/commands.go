@@ -0,0 +1,760 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gogames/watchdog/main-server/importer"
+	"github.com/gogames/watchdog/main-server/store"
+	"github.com/gogames/watchdog/probe"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"adduser": {
+		usage: "adduser <username> <password>",
+		run: func(args []string) error {
+			if len(args) != 2 {
+				return errUsage
+			}
+			return adminClient.AddUser(args[0], args[1])
+		},
+	},
+	"users": {
+		usage: "users",
+		run: func(args []string) error {
+			usernames, err := adminClient.ListUsers()
+			if err != nil {
+				return err
+			}
+			for _, username := range usernames {
+				fmt.Println(username)
+			}
+			return nil
+		},
+	},
+	"user": {
+		usage: "user <username>",
+		run: func(args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			u, err := adminClient.GetUser(args[0])
+			if err != nil {
+				return err
+			}
+			for _, server := range sortedServers(u.MonitorServers) {
+				fmt.Println(server)
+			}
+			return nil
+		},
+	},
+	"org": {
+		usage: "org <username> [organization]",
+		run: func(args []string) error {
+			if len(args) != 1 && len(args) != 2 {
+				return errUsage
+			}
+			organization := ""
+			if len(args) == 2 {
+				organization = args[1]
+			}
+			return adminClient.SetOrganization(args[0], organization)
+		},
+	},
+	"addservers": {
+		usage: "addservers <username> <server|-f file>...",
+		run: func(args []string) error {
+			return bulk(args, adminClient.AddServers)
+		},
+	},
+	"delservers": {
+		usage: "delservers <username> <server|-f file>...",
+		run: func(args []string) error {
+			return bulk(args, adminClient.DelServers)
+		},
+	},
+	"locations": {
+		usage: "locations",
+		run: func(args []string) error {
+			locations, err := adminClient.ListLocations()
+			if err != nil {
+				return err
+			}
+			for _, location := range locations {
+				fmt.Println(location)
+			}
+			return nil
+		},
+	},
+	"probes": {
+		usage: "probes",
+		run: func(args []string) error {
+			probes, err := adminClient.ListProbes()
+			if err != nil {
+				return err
+			}
+			locations := make([]string, 0, len(probes))
+			for location := range probes {
+				locations = append(locations, location)
+			}
+			sort.Strings(locations)
+			for _, location := range locations {
+				m := probes[location]
+				fmt.Printf("%v\t%v\t%v\tAS%v\t%v\t%v,%v\t%v\n", location, m.Country, m.City, m.ASN, m.Provider, m.Latitude, m.Longitude, m.Labels)
+			}
+			return nil
+		},
+	},
+	"export": {
+		usage: "export <username> <server>",
+		run: func(args []string) error {
+			if len(args) != 2 {
+				return errUsage
+			}
+			ret, err := adminClient.GetMonitorResult(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(os.Stdout).Encode(ret)
+		},
+	},
+	"exportalerts": {
+		usage: "exportalerts [-format csv|json] [-username username] [-from RFC3339] [-to RFC3339] [-server s,...] [-severity s,...] [-state firing|resolved] <alerts|incidents>",
+		run:   exportAlerts,
+	},
+	"backup": {
+		usage: "backup [file]",
+		run:   backup,
+	},
+	"backfill": {
+		usage: "backfill <server> <results.json>",
+		run: func(args []string) error {
+			if len(args) != 2 {
+				return errUsage
+			}
+			b, err := ioutil.ReadFile(args[1])
+			if err != nil {
+				return err
+			}
+			// location -> ping results, as written by export
+			var ret map[string][]store.PingRet
+			if err = json.Unmarshal(b, &ret); err != nil {
+				return err
+			}
+			for location, prs := range ret {
+				n, err := adminClient.Backfill(args[0], location, prs)
+				if err != nil {
+					return fmt.Errorf("can not backfill %v: %v", location, err)
+				}
+				fmt.Printf("%v\t%v inserted\n", location, n)
+			}
+			return nil
+		},
+	},
+	"apply": {
+		usage: "apply [-dry-run] <spec.json>",
+		run:   apply,
+	},
+	"import": {
+		usage: "import [-dry-run] <importer>",
+		run:   runImport,
+	},
+	"bulkimport": {
+		usage: "bulkimport [-dry-run] [-unreachable] [-labels k=v,...] [-origin origin] <username> <zone file|cidr>",
+		run:   bulkImport,
+	},
+	"loglevel": {
+		usage: "loglevel <RFC5424 level>",
+		run: func(args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+			level, err := strconv.Atoi(args[0])
+			if err != nil {
+				return err
+			}
+			return adminClient.SetLogLevel(level)
+		},
+	},
+	"matrix": {
+		usage: "matrix",
+		run: func(args []string) error {
+			m, err := adminClient.LatencyMatrix()
+			if err != nil {
+				return err
+			}
+			locations := make([]string, 0, len(m))
+			for location := range m {
+				locations = append(locations, location)
+			}
+			sort.Strings(locations)
+			for _, location := range locations {
+				targets := make([]string, 0, len(m[location]))
+				for target := range m[location] {
+					targets = append(targets, target)
+				}
+				sort.Strings(targets)
+				for _, target := range targets {
+					pr := m[location][target]
+					fmt.Printf("%v\t%v\t%v\t%v\n", location, target, pr.Ping, pr.Time)
+				}
+			}
+			return nil
+		},
+	},
+	"deadprobes": {
+		usage: "deadprobes",
+		run: func(args []string) error {
+			alerts, err := adminClient.DeadProbeAlerts()
+			if err != nil {
+				return err
+			}
+			for _, a := range alerts {
+				fmt.Printf("%v\t%v\t%v\tsilent=%vs\n", a.At.Format(time.RFC3339), a.Location, a.State, int64(a.Value))
+			}
+			return nil
+		},
+	},
+	"slowops": {
+		usage: "slowops [n]",
+		run: func(args []string) error {
+			n := 10
+			if len(args) == 1 {
+				var err error
+				if n, err = strconv.Atoi(args[0]); err != nil {
+					return err
+				}
+			} else if len(args) > 1 {
+				return errUsage
+			}
+			ops, err := adminClient.SlowOps(n)
+			if err != nil {
+				return err
+			}
+			for _, op := range ops {
+				fmt.Printf("%v\tcount=%v\tmax=%v\ttotal=%v\tlast=%v\t%v\n", op.Op, op.Count, op.Max, op.Total, op.Last.Format(time.RFC3339), op.LastContext)
+			}
+			return nil
+		},
+	},
+	"breaker": {
+		usage: "breaker",
+		run: func(args []string) error {
+			b, err := adminClient.EngineBreaker()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("state=%v\tfailures=%v\topens=%v\tbuffered=%v\tdropped=%v\n", b.State, b.Failures, b.Opens, b.Buffered, b.Dropped)
+			if b.State != store.BREAKER_CLOSED {
+				fmt.Printf("opened=%v\terror=%v\n", b.Opened.Format(time.RFC3339), b.LastError)
+			}
+			return nil
+		},
+	},
+	"readonly": {
+		usage: "readonly [on|off]",
+		run: func(args []string) error {
+			if len(args) > 1 {
+				return errUsage
+			}
+			if len(args) == 1 {
+				if args[0] != "on" && args[0] != "off" {
+					return errUsage
+				}
+				n, err := adminClient.SetReadOnly(args[0] == "on")
+				if err != nil {
+					return err
+				}
+				if args[0] == "off" {
+					fmt.Printf("%v buffered ping results appended\n", n)
+				}
+			}
+			ro, err := adminClient.ReadOnly()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("read_only=%v\tbuffered=%v\tdropped=%v\n", ro.On, ro.Buffered, ro.Dropped)
+			if ro.On {
+				fmt.Printf("since=%v\n", ro.Since.Format(time.RFC3339))
+			}
+			return nil
+		},
+	},
+	"recovery": {
+		usage: "recovery",
+		run: func(args []string) error {
+			r, err := adminClient.RecoveryReport()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("time=%v\treload=%v\tduration=%v\tusers=%v\tservers=%v\tseries=%v\tping_rets=%v\tclean=%v\n",
+				r.Time.Format(time.RFC3339), r.Reload, r.Duration, r.Users, r.Servers, r.Series, r.PingRets, r.Clean())
+			for _, c := range r.Corruptions {
+				fmt.Printf("corrupt\t%v:%v\t%v\trepaired=%v\n", c.Path, c.Line, c.Reason, c.Repaired)
+			}
+			for _, w := range r.Warnings {
+				fmt.Printf("warning\t%v\n", w)
+			}
+			return nil
+		},
+	},
+	"purge": {
+		usage: "purge <server|user> <name>",
+		run: func(args []string) error {
+			if len(args) != 2 {
+				return errUsage
+			}
+			if *flagActor == "" {
+				return fmt.Errorf("-actor should be set, it is recorded in the audit log")
+			}
+			switch args[0] {
+			case "server":
+				return adminClient.PurgeServer(args[1], *flagActor)
+			case "user":
+				return adminClient.PurgeUser(args[1], *flagActor)
+			}
+			return errUsage
+		},
+	},
+	"audit": {
+		usage: "audit [n]",
+		run: func(args []string) error {
+			n := 20
+			if len(args) == 1 {
+				var err error
+				if n, err = strconv.Atoi(args[0]); err != nil {
+					return err
+				}
+			} else if len(args) > 1 {
+				return errUsage
+			}
+			es, err := adminClient.Audit(n)
+			if err != nil {
+				return err
+			}
+			for _, e := range es {
+				fmt.Printf("%v	%v	%v	%v	%v\n", e.Time.Format(time.RFC3339), e.Actor, e.Action, e.Subject, e.Detail)
+			}
+			return nil
+		},
+	},
+	"view": {
+		usage: "view <user|settings> <username> <reason> | view <result|hourly|daily> <username> <server> <reason>",
+		run: func(args []string) error {
+			if len(args) < 3 {
+				return errUsage
+			}
+			var (
+				ret interface{}
+				err error
+			)
+			switch kind, username := args[0], args[1]; {
+			case kind == "user" && len(args) == 3:
+				ret, err = supportClient.ViewUser(username, args[2])
+			case kind == "settings" && len(args) == 3:
+				ret, err = supportClient.ViewSettings(username, args[2])
+			case kind == "result" && len(args) == 4:
+				ret, err = supportClient.ViewMonitorResult(username, args[2], args[3])
+			case kind == "hourly" && len(args) == 4:
+				ret, err = supportClient.ViewAggregates(username, args[2], store.RESOLUTION_HOUR, "", "", args[3])
+			case kind == "daily" && len(args) == 4:
+				ret, err = supportClient.ViewAggregates(username, args[2], store.RESOLUTION_DAY, "", "", args[3])
+			default:
+				return errUsage
+			}
+			if err != nil {
+				return err
+			}
+			return json.NewEncoder(os.Stdout).Encode(ret)
+		},
+	},
+	"rotatekeys": {
+		usage: "rotatekeys",
+		run: func(args []string) error {
+			if len(args) != 0 {
+				return errUsage
+			}
+			n, err := adminClient.RotateKeys()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%v files encrypted by the current key\n", n)
+			return nil
+		},
+	},
+	"usage": {
+		usage: "usage <requests|samples|bytes> [days] [n]",
+		run: func(args []string) error {
+			if len(args) < 1 || len(args) > 3 {
+				return errUsage
+			}
+			days, n := 1, 10
+			var err error
+			if len(args) > 1 {
+				if days, err = strconv.Atoi(args[1]); err != nil {
+					return err
+				}
+			}
+			if len(args) > 2 {
+				if n, err = strconv.Atoi(args[2]); err != nil {
+					return err
+				}
+			}
+			users, err := adminClient.TopUsage(args[0], days, n)
+			if err != nil {
+				return err
+			}
+			for _, u := range users {
+				fmt.Printf("%v\trequests=%v\tsamples=%v\tbytes=%v\tsince=%v\n", u.Username, u.Requests, u.Samples, u.Bytes, u.Day)
+			}
+			return nil
+		},
+	},
+	"reload": {
+		usage: "reload",
+		run: func(args []string) error {
+			changes, err := adminClient.Reload()
+			if err != nil {
+				return err
+			}
+			for _, c := range changes {
+				fmt.Println(c)
+			}
+			return nil
+		},
+	},
+	"optout": {
+		usage: "optout <add <host|cidr> <reason>|remove <host|cidr>|list>",
+		run: func(args []string) error {
+			if len(args) == 1 && args[0] == "list" {
+				optOuts, err := adminClient.OptOuts()
+				if err != nil {
+					return err
+				}
+				for _, o := range optOuts {
+					fmt.Printf("%v	%v	%v	%v	%v servers\n", o.Target, o.Created.Format(time.RFC3339), o.Actor, o.Reason, len(o.Servers))
+				}
+				return nil
+			}
+			if len(args) < 2 {
+				return errUsage
+			}
+			if *flagActor == "" {
+				return fmt.Errorf("-actor should be set, it is recorded in the audit log")
+			}
+			switch {
+			case args[0] == "add" && len(args) >= 3:
+				kicked, err := adminClient.OptOut(args[1], strings.Join(args[2:], " "), *flagActor)
+				if err != nil {
+					return err
+				}
+				for _, server := range kicked {
+					fmt.Println(server)
+				}
+				fmt.Printf("%v servers kicked\n", len(kicked))
+				return nil
+			case args[0] == "remove" && len(args) == 2:
+				return adminClient.RemoveOptOut(args[1], *flagActor)
+			}
+			return errUsage
+		},
+	},
+	"resync": {
+		usage: "resync",
+		run: func(args []string) error {
+			n, err := adminClient.ResyncAssignments()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%v servers sent again\n", n)
+			return nil
+		},
+	},
+	"broadcast": {
+		usage: "broadcast <text>",
+		run: func(args []string) error {
+			if len(args) == 0 {
+				return errUsage
+			}
+			n, err := adminClient.Broadcast(strings.Join(args, " "))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("posted to %v users\n", n)
+			return nil
+		},
+	},
+	"tail": {
+		usage: "tail [-interval duration] <username> <server>",
+		run:   tail,
+	},
+}
+
+var errUsage = fmt.Errorf("wrong number of arguments")
+
+func sortedServers(servers map[string]bool) []string {
+	ret := make([]string, 0, len(servers))
+	for server := range servers {
+		ret = append(ret, server)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// args are the username followed by servers, "-f file" reads servers from the file line by line
+func bulk(args []string, f func(string, []string) (map[string]string, error)) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	servers := make([]string, 0)
+	for i := 1; i < len(args); i++ {
+		if args[i] != "-f" {
+			servers = append(servers, args[i])
+			continue
+		}
+		if i++; i == len(args) {
+			return errUsage
+		}
+		ss, err := readLines(args[i])
+		if err != nil {
+			return err
+		}
+		servers = append(servers, ss...)
+	}
+	failed, err := f(args[0], servers)
+	if err != nil {
+		return err
+	}
+	for _, server := range servers {
+		if reason, ok := failed[server]; ok {
+			fmt.Printf("%v\tfailed: %v\n", server, reason)
+		} else {
+			fmt.Printf("%v\tok\n", server)
+		}
+	}
+	return nil
+}
+
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// reconcile users and servers to the json spec and print the diff
+func apply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "print the changes without applying them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	b, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var spec store.Spec
+	if err = json.Unmarshal(b, &spec); err != nil {
+		return fmt.Errorf("can not parse spec: %v", err)
+	}
+	changes, err := adminClient.Apply(spec, *dryRun)
+	for _, c := range changes {
+		fmt.Printf("%v\t%v\t%v\n", c.Action, c.Username, c.Server)
+	}
+	return err
+}
+
+// run the importer of the main server now and print the changes
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "print the changes without applying them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+	changes, err := adminClient.Import(fs.Arg(0), *dryRun)
+	for _, c := range changes {
+		fmt.Printf("%v\t%v\t%v\n", c.Action, c.Username, c.Server)
+	}
+	return err
+}
+
+// bulk add the names of the zone file or the addresses of the CIDR range and print the changes and the hosts skipped
+func bulkImport(args []string) error {
+	fs := flag.NewFlagSet("bulkimport", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "print the changes without applying them")
+	unreachable := fs.Bool("unreachable", false, "add the hosts not answering a ping from the main server too")
+	labels := fs.String("labels", "", "comma separated key=value labels of the hosts")
+	origin := fs.String("origin", "", "origin of the relative names of the zone file")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+	b := importer.Bulk{Origin: *origin, Unreachable: *unreachable}
+	var err error
+	if b.Labels, err = probe.ParseLabels(*labels); err != nil {
+		return err
+	}
+	if _, _, err = net.ParseCIDR(fs.Arg(1)); err == nil {
+		b.CIDR = fs.Arg(1)
+	} else {
+		zone, err := ioutil.ReadFile(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		b.Zone = string(zone)
+	}
+	report, err := adminClient.BulkImport(fs.Arg(0), b, *dryRun)
+	for _, c := range report.Changes {
+		fmt.Printf("%v\t%v\t%v\n", c.Action, c.Username, c.Server)
+	}
+	skipped := make([]string, 0, len(report.Skipped))
+	for host := range report.Skipped {
+		skipped = append(skipped, host)
+	}
+	sort.Strings(skipped)
+	for _, host := range skipped {
+		fmt.Printf("skip\t%v\t%v\n", host, report.Skipped[host])
+	}
+	return err
+}
+
+// print the alerts or the incidents exported by the admin server, of every user by default
+func exportAlerts(args []string) error {
+	fs := flag.NewFlagSet("exportalerts", flag.ContinueOnError)
+	q := url.Values{}
+	for name, usage := range map[string]string{
+		"format":   "csv or json",
+		"username": "the user of the alerts, every user if empty",
+		"from":     "RFC3339 start of the range",
+		"to":       "RFC3339 end of the range",
+		"server":   "comma separated servers",
+		"severity": "comma separated severities",
+		"state":    "firing or resolved",
+	} {
+		name := name
+		fs.Func(name, usage, func(v string) error {
+			q.Set(name, v)
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 || (fs.Arg(0) != "alerts" && fs.Arg(0) != "incidents") {
+		return errUsage
+	}
+	resp, err := httpClient.Get(fmt.Sprintf("http://%v/export/%v?%v", *flagAdminAddress, fs.Arg(0), q.Encode()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(b)))
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+// poll the monitor result and print the ping results newer than those printed
+// by their time rather than their index, the series shrinks once the old results are trimmed or dropped by retention
+func tail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	interval := fs.Duration("interval", 30*time.Second, "interval to poll the main server")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errUsage
+	}
+	username, server := fs.Arg(0), fs.Arg(1)
+	// location -> the time of the result printed last
+	last := make(map[string]string)
+	for {
+		ret, err := adminClient.GetMonitorResult(username, server)
+		if err != nil {
+			return err
+		}
+		locations := make([]string, 0, len(ret))
+		for location := range ret {
+			locations = append(locations, location)
+		}
+		sort.Strings(locations)
+		for _, location := range locations {
+			prs := ret[location]
+			i := sort.Search(len(prs), func(i int) bool { return prs[i].Time > last[location] })
+			printPingRets(location, prs[i:])
+			if len(prs) > 0 {
+				last[location] = prs[len(prs)-1].Time
+			}
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func printPingRets(location string, prs []store.PingRet) {
+	for _, pr := range prs {
+		fmt.Printf("%v\t%v\t%v\n", pr.Time, location, pr.Ping)
+	}
+}
+
+// download the backup streamed by the admin server
+func backup(args []string) error {
+	if len(args) > 1 {
+		return errUsage
+	}
+	w := io.Writer(os.Stdout)
+	if len(args) == 1 {
+		f, err := os.Create(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	resp, err := httpClient.Get(fmt.Sprintf("http://%v/backup", *flagAdminAddress))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(b)))
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,15 @@
+// parse flags
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+var (
+	flagAdminAddress = flag.String("addr", "127.0.0.1:8793", "network address of admin server of main server")
+	flagAdminToken   = flag.String("token", "", "admin token of main server")
+	flagActor        = flag.String("actor", os.Getenv("USER"), "who runs the command, recorded in the audit log of main server")
+)
+
+func initFlag() { flag.Parse() }